@@ -0,0 +1,99 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"sort"
+)
+
+// Alias is a phony target used as a user facing name for other targets, e.g.
+// "build all: phony out1 out2".
+type Alias struct {
+	// Node is the phony target.
+	Node *Node
+	// Targets are the explicit inputs of the phony edge.
+	Targets []*Node
+}
+
+// Aliases returns the phony edges with explicit inputs, sorted by name.
+//
+// Phony edges without inputs are not aliases; they are used to tolerate
+// missing files, e.g. removed headers still listed in a depfile.
+func (s *State) Aliases() []Alias {
+	var out []Alias
+	for _, e := range s.Edges {
+		if e.Rule != PhonyRule {
+			continue
+		}
+		explicit := len(e.Inputs) - int(e.ImplicitDeps) - int(e.OrderOnlyDeps)
+		if explicit == 0 {
+			continue
+		}
+		for _, o := range e.Outputs {
+			out = append(out, Alias{Node: o, Targets: e.Inputs[:explicit]})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Node.Path < out[j].Node.Path
+	})
+	return out
+}
+
+// AliasShadow is a phony alias that may not do what the user expects.
+type AliasShadow struct {
+	// Path is the name of the alias.
+	Path string
+	// Reason describes the conflict.
+	Reason string
+}
+
+// ShadowedAliases returns the phony aliases conflicting with real files.
+//
+// It reports paths that were declared both as a phony alias and as the output
+// of another edge, which is only possible when duplicate edges are not an
+// error; only the first declaration was kept. It also reports aliases whose
+// name is an existing file on disk, which is confusing since "nin <alias>"
+// never builds that file.
+func (s *State) ShadowedAliases(di FileSystem) ([]AliasShadow, error) {
+	var out []AliasShadow
+	seen := map[*Node]struct{}{}
+	for _, n := range s.shadowed {
+		if _, ok := seen[n]; ok {
+			continue
+		}
+		seen[n] = struct{}{}
+		reason := "also generated by a phony edge, which was ignored"
+		if n.InEdge.Rule == PhonyRule {
+			reason = "phony alias hides the output of another edge, which was ignored"
+		}
+		out = append(out, AliasShadow{Path: n.Path, Reason: reason})
+	}
+	for _, a := range s.Aliases() {
+		if _, ok := seen[a.Node]; ok {
+			continue
+		}
+		mtime, err := di.Stat(a.Node.Path)
+		if mtime == -1 {
+			return nil, err
+		}
+		if mtime > 0 {
+			out = append(out, AliasShadow{Path: a.Node.Path, Reason: "phony alias has the same name as an existing file"})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Path < out[j].Path
+	})
+	return out, nil
+}
@@ -0,0 +1,53 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestState_Aliases(t *testing.T) {
+	s := NewStateTestWithBuiltinRules(t)
+	s.AssertParse(&s.state, "build out1: cat in1\nbuild out2: cat in2\nbuild all: phony out1 out2 | in1\nbuild a: phony out1\nbuild missing.h: phony\nbuild out1: phony in1\nbuild docs: phony out2\n", ParseManifestOpts{Quiet: true})
+
+	var got []string
+	for _, a := range s.state.Aliases() {
+		l := a.Node.Path + ":"
+		for _, t := range a.Targets {
+			l += " " + t.Path
+		}
+		got = append(got, l)
+	}
+	want := []string{"a: out1", "all: out1 out2", "docs: out2"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatal(diff)
+	}
+
+	fs := NewVirtualFileSystem()
+	fs.Create("docs", "")
+	shadows, err := s.state.ShadowedAliases(&fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantShadows := []AliasShadow{
+		{Path: "docs", Reason: "phony alias has the same name as an existing file"},
+		{Path: "out1", Reason: "also generated by a phony edge, which was ignored"},
+	}
+	if diff := cmp.Diff(wantShadows, shadows); diff != "" {
+		t.Fatal(diff)
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// AnalyzerConfig configures AddAnalyzerEdges.
+type AnalyzerConfig struct {
+	// Command is the command running the analyzer on a source file. $in is
+	// the source file, $out the file to write the results to and $flags the
+	// arguments of the compile command, e.g.
+	// "clang-tidy --quiet $in -- $flags > $out".
+	//
+	// The command must write $out, otherwise it runs again on the next build.
+	Command string
+	// Dir is the directory where the results are written, one file per
+	// compile edge.
+	Dir string
+	// Pool, if not nil, limits the number of concurrent analyzer runs.
+	Pool *Pool
+}
+
+// AddAnalyzerEdges adds to state an edge running a static analyzer, e.g.
+// clang-tidy, on the source file of each compile edge. It returns the
+// outputs of the new edges, sorted, to be built with a Builder.
+//
+// The new edges have the inputs of the compile edges, including the headers
+// recorded in depsLog, which may be nil. Since their command includes the
+// compile command, the build log only runs again the analysis of the sources
+// whose content or compile command changed.
+//
+// The compile edges are the ones with a depfile, deps or scan binding.
+func AddAnalyzerEdges(state *State, depsLog *DepsLog, config *AnalyzerConfig) ([]*Node, error) {
+	if strings.TrimSpace(config.Command) == "" {
+		return nil, errors.New("no analyzer command")
+	}
+	l := lexer{}
+	if err := l.Start("analyzer", []byte(config.Command+"\n\x00")); err != nil {
+		return nil, err
+	}
+	command, err := l.readEvalString(false)
+	if err != nil {
+		return nil, err
+	}
+	rule := NewRule("nin_analyze")
+	rule.Bindings["command"] = &command
+	rule.Bindings["description"] = &EvalString{Parsed: []EvalStringToken{{Value: "ANALYZE "}, {Value: "in", IsSpecial: true}}}
+	pool := config.Pool
+	if pool == nil {
+		pool = DefaultPool
+	}
+
+	defer state.lock()()
+	// Don't iterate over the edges being added.
+	edges := state.Edges
+	var out []*Node
+	for _, e := range edges {
+		explicit := len(e.Inputs) - int(e.ImplicitDeps) - int(e.OrderOnlyDeps)
+		if explicit == 0 || len(e.Outputs) == 0 || !isCompileEdge(e) {
+			continue
+		}
+		path := filepath.ToSlash(filepath.Join(config.Dir, e.Outputs[0].Path+".analysis"))
+		if state.Paths[path] != nil {
+			// TODO(maruel): Use %q for real quoting.
+			return nil, fmt.Errorf("'%s' is already in the graph", path)
+		}
+		a := state.addEdge(rule)
+		a.Pool = pool
+		a.Env = NewBindingEnv(state.Bindings)
+		a.Env.Bindings["flags"] = compileFlags(e.EvaluateCommand(false))
+		state.addOut(a, path, 0)
+		state.addIn(a, e.Inputs[0].Path, e.Inputs[0].SlashBits)
+		implicit := append([]*Node{}, e.Inputs[1:explicit+int(e.ImplicitDeps)]...)
+		if depsLog != nil {
+			if deps := depsLog.GetDeps(e.Outputs[0]); deps != nil {
+				implicit = append(implicit, deps.Nodes...)
+			}
+		}
+		for _, n := range implicit {
+			state.addIn(a, n.Path, n.SlashBits)
+		}
+		a.ImplicitDeps = int32(len(implicit))
+		for _, n := range e.Inputs[explicit+int(e.ImplicitDeps):] {
+			state.addIn(a, n.Path, n.SlashBits)
+		}
+		a.OrderOnlyDeps = e.OrderOnlyDeps
+		out = append(out, a.Outputs[0])
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Path < out[j].Path })
+	return out, nil
+}
+
+// compileFlags returns the arguments of the compile command, skipping the
+// compiler and the compiler cache, if any.
+func compileFlags(command string) string {
+	prog, rest := commandProgram(command)
+	if name := strings.TrimSuffix(filepath.Base(prog), ".exe"); name == "ccache" || name == "sccache" {
+		_, rest = commandProgram(rest)
+	}
+	return strings.TrimSpace(rest)
+}
@@ -0,0 +1,53 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"testing"
+)
+
+func TestAddAnalyzerEdges(t *testing.T) {
+	s := NewStateTestWithBuiltinRules(t)
+	s.AssertParse(&s.state, "rule cc\n  command = ccache cc -Iinc -c $in -o $out\n  depfile = $out.d\n"+
+		"build gen.h: cat gen.in\n"+
+		"build a.o: cc a.cc | extra.h || gen.h\n"+
+		"build lib.a: cat a.o\n", ParseManifestOpts{})
+	config := AnalyzerConfig{Command: "tidy $in -- $flags > $out", Dir: "out/analysis"}
+	nodes, err := AddAnalyzerEdges(&s.state, nil, &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 1 || nodes[0].Path != "out/analysis/a.o.analysis" {
+		t.Fatal(nodes)
+	}
+	e := nodes[0].InEdge
+	if got := e.EvaluateCommand(false); got != "tidy a.cc -- -Iinc -c a.cc -o a.o > out/analysis/a.o.analysis" {
+		t.Fatal(got)
+	}
+	if got := e.GetBinding("description"); got != "ANALYZE a.cc" {
+		t.Fatal(got)
+	}
+	if len(e.Inputs) != 3 || e.ImplicitDeps != 1 || e.OrderOnlyDeps != 1 || e.Inputs[1].Path != "extra.h" || e.Inputs[2].Path != "gen.h" {
+		t.Fatal(e.Inputs)
+	}
+
+	// Adding them twice is an error.
+	if _, err := AddAnalyzerEdges(&s.state, nil, &config); err == nil {
+		t.Fatal("expected error")
+	}
+	if _, err := AddAnalyzerEdges(&s.state, nil, &AnalyzerConfig{}); err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -15,9 +15,15 @@
 package nin
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"math/rand"
 	"os"
+	"runtime/trace"
+	"sort"
+	"strconv"
+	"sync/atomic"
 	"time"
 )
 
@@ -62,23 +68,130 @@ type Result struct {
 	Edge     *Edge
 	ExitCode ExitStatus
 	Output   string
+	// Usage is the resources used by the command, if it ran in a subprocess.
+	Usage ResourceUsage
+	// Cause is set when the command failed and an earlier failed edge likely
+	// caused the failure, e.g. by not generating a header the command
+	// includes.
+	Cause *Edge
+
+	// notRun is set when the command was not run, e.g. it was skipped by
+	// BuilderHooks.BeforeEdge or deduplicated.
+	notRun bool
 }
 
 // TODO(maruel): The build per se shouldn't have verbosity as a flag. It should
 // be composed.
 
 // BuildConfig are the options (e.g. verbosity, parallelism) passed to a build.
+//
+// It can be serialized as JSON, with the durations as strings like "1.5s".
+// The enums are serialized as their name.
 type BuildConfig struct {
-	Verbosity       Verbosity
-	DryRun          bool
-	Parallelism     int
-	FailuresAllowed int
+	Verbosity       Verbosity `json:"verbosity" toml:"verbosity"`
+	DryRun          bool      `json:"dry_run,omitempty" toml:"dry_run,omitempty"`
+	Parallelism     int       `json:"parallelism" toml:"parallelism"`
+	FailuresAllowed int       `json:"failures_allowed" toml:"failures_allowed"`
+	// RemoteParallelism is the number of edges whose rule has the
+	// "remoteable" binding, e.g. compiles sent to a distcc or icecc farm,
+	// that can run concurrently. Parallelism then only limits the other
+	// edges. 0 means the remoteable edges are limited by Parallelism like the
+	// others.
+	RemoteParallelism int `json:"remote_parallelism,omitempty" toml:"remote_parallelism,omitempty"`
+	// RemoteableRules are the rules whose edges are remoteable even without
+	// the "remoteable" binding.
+	RemoteableRules map[string]bool `json:"remoteable_rules,omitempty" toml:"remoteable_rules,omitempty"`
+	// MemoryLimit, when positive, is the memory in bytes the commands running
+	// concurrently are expected to use at most. The memory of a command is
+	// estimated with its "mem" binding, e.g. "mem = 4G", or else with the max
+	// RSS recorded in the build log. It prevents running out of memory when
+	// e.g. LTO links would be started together.
+	MemoryLimit int64 `json:"memory_limit,omitempty" toml:"memory_limit,omitempty"`
+	// DedupCommands runs the command of the edges that have the same command
+	// and the same inputs only once, e.g. with duplicated code generation
+	// rules. The other edges share its result. Edges with a "deps" binding
+	// are not deduplicated.
+	DedupCommands bool `json:"dedup_commands,omitempty" toml:"dedup_commands,omitempty"`
 	// The maximum load average we must not exceed. A negative or zero value
 	// means that we do not have any limit.
-	MaxLoadAvg float64
+	MaxLoadAvg float64 `json:"max_load_avg,omitempty" toml:"max_load_avg,omitempty"`
+	// MaxSpawnRate is the maximum number of processes started per second on
+	// average. A negative or zero value means that we do not have any limit.
+	MaxSpawnRate float64 `json:"max_spawn_rate,omitempty" toml:"max_spawn_rate,omitempty"`
+	// SpawnBurst is the number of processes that can be started at once
+	// without being limited by MaxSpawnRate. It defaults to 1.
+	SpawnBurst int `json:"spawn_burst,omitempty" toml:"spawn_burst,omitempty"`
+	// DepfileWorkers is the number of goroutines reading and parsing the
+	// depfiles concurrently when scanning the dependencies. 0 or 1 means the
+	// depfiles are read one at a time as they are needed. When it is larger
+	// than 1, the FileSystem must be safe for concurrent use.
+	DepfileWorkers int `json:"depfile_workers,omitempty" toml:"depfile_workers,omitempty"`
+	// PrefetchWorkers is the number of goroutines reading ahead the source
+	// files of the edges as they become ready, so on a cold OS cache the IO
+	// overlaps with the commands already running. 0 disables prefetching.
+	PrefetchWorkers int `json:"prefetch_workers,omitempty" toml:"prefetch_workers,omitempty"`
+	// ManifestChange defines what to do when a file watched with
+	// Builder.WatchManifest changes during the build.
+	ManifestChange ManifestChangePolicy `json:"manifest_change,omitempty" toml:"manifest_change,omitempty"`
+	// ManifestPollInterval is how often the watched files are checked. It
+	// defaults to one second.
+	ManifestPollInterval time.Duration `json:"manifest_poll_interval,omitempty" toml:"manifest_poll_interval,omitempty"`
+	// Shuffle starts the ready edges in a random order seeded with
+	// ShuffleSeed instead of in manifest order. Undeclared dependencies
+	// between edges then cause failures that can be reproduced with the same
+	// seed.
+	Shuffle     bool  `json:"shuffle,omitempty" toml:"shuffle,omitempty"`
+	ShuffleSeed int64 `json:"shuffle_seed,omitempty" toml:"shuffle_seed,omitempty"`
+	// ShuffleMaxDelay, when Shuffle is set, delays the start of each command
+	// by a random duration up to this value to further vary the schedule.
+	ShuffleMaxDelay time.Duration `json:"shuffle_max_delay,omitempty" toml:"shuffle_max_delay,omitempty"`
+	// VerifyOutputs fails the edges whose command succeeded but didn't write
+	// all their outputs, instead of letting the broken outputs poison the
+	// edges depending on them. The outputs of the edges with "restat" only
+	// have to exist.
+	VerifyOutputs bool `json:"verify_outputs,omitempty" toml:"verify_outputs,omitempty"`
+	// CancelGrace, when positive, stops starting commands on the first
+	// failure, whatever FailuresAllowed is, and cancels the commands still
+	// running after this duration. It bounds the time of a build whose
+	// outcome is already decided.
+	CancelGrace time.Duration `json:"cancel_grace,omitempty" toml:"cancel_grace,omitempty"`
+	// LowMemory trades speed for a smaller memory footprint, e.g. in
+	// constrained CI containers. NewBuilder calls State.DisableMemoization.
+	LowMemory bool `json:"low_memory,omitempty" toml:"low_memory,omitempty"`
+	// TrackTools records the digest of the program of every command in the
+	// build log, as if it was an input of the edge, so swapping the compiler
+	// rebuilds the edges that used it even though no declared input changed.
+	//
+	// The program is the first word of the command, resolved in PATH. Shell
+	// builtins and programs not found are not tracked, and neither are the
+	// programs started by a wrapper, e.g. the compiler run by ccache. Changing
+	// the value rebuilds everything once, as the commands recorded differ.
+	//
+	// The edges with a toolchain always record the digest of their program.
+	TrackTools bool `json:"track_tools,omitempty" toml:"track_tools,omitempty"`
+	// PosixShell, when set, is the shell used to run the commands on Windows,
+	// e.g. the sh.exe of MSYS2 or Cygwin, for the manifests generated for
+	// these toolchains. Otherwise the commands are run directly with
+	// CreateProcess. NewBuilder calls State.UsePosixShell so the paths in the
+	// commands are quoted and translated for it.
+	//
+	// It is ignored on other operating systems.
+	PosixShell string `json:"posix_shell,omitempty" toml:"posix_shell,omitempty"`
+	// LogSync is how the build log and the deps log are flushed to the disk
+	// when closed. NewBuilder sets it on the logs.
+	LogSync LogSyncPolicy `json:"log_sync,omitempty" toml:"log_sync,omitempty"`
+	// ToolDigests caches the digests of the programs of the commands. Load and
+	// save it in the build directory so the programs are not hashed again at
+	// every build. NewBuilder uses an empty one when nil.
+	ToolDigests *DigestStore `json:"-" toml:"-"`
 }
 
-// NewBuildConfig returns the default build configuration.
+// NewBuildConfig returns the default build configuration: Normal verbosity,
+// one command at a time, stopping at the first failure. The other fields are
+// disabled or use their documented default.
+//
+// Decode a configuration file into the value it returns so the missing keys
+// keep their default, then call Validate.
 func NewBuildConfig() BuildConfig {
 	return BuildConfig{
 		Verbosity:       Normal,
@@ -99,6 +212,9 @@ const (
 	Normal
 	// Verbose prints out commands executed.
 	Verbose
+	// Terse is like NoStatusUpdate and also prints a one-line statistics
+	// summary at the end of the build. It is meant for CI logs.
+	Terse
 )
 
 // A CommandRunner that doesn't actually run the commands.
@@ -141,45 +257,163 @@ type realCommandRunner struct {
 	config        *BuildConfig
 	subprocs      *subprocessSet
 	subprocToEdge map[*subprocess]*Edge
+	limiter       *spawnLimiter
+	workers       *workerPool
+	// delays, if set, is used to delay the start of each command.
+	delays *rand.Rand
+	// remoteRunning is the number of remoteable edges in subprocToEdge.
+	remoteRunning int
+	// buildLog, if set, provides the max RSS of the previous builds. See
+	// edgeMemory.
+	buildLog *BuildLog
+	// memoryRunning is the sum of the expected memory of the edges in
+	// subprocToEdge, which is kept in memory for each edge.
+	memoryRunning int64
+	memory        map[*Edge]int64
 }
 
 func newRealCommandRunner(config *BuildConfig) *realCommandRunner {
-	return &realCommandRunner{
+	r := &realCommandRunner{
 		config:        config,
 		subprocs:      newSubprocessSet(),
 		subprocToEdge: map[*subprocess]*Edge{},
+		workers:       newWorkerPool(),
+		memory:        map[*Edge]int64{},
+	}
+	r.subprocs.shell = config.PosixShell
+	if config.MaxSpawnRate > 0 {
+		r.limiter = newSpawnLimiter(config.MaxSpawnRate, config.SpawnBurst)
+	}
+	if config.Shuffle && config.ShuffleMaxDelay > 0 {
+		r.delays = rand.New(rand.NewSource(config.ShuffleSeed))
 	}
+	return r
 }
 
 func (r *realCommandRunner) GetActiveEdges() []*Edge {
 	var edges []*Edge
 	for _, e := range r.subprocToEdge {
-		edges = append(edges, e)
+		if len(e.batch) != 0 {
+			edges = append(edges, e.batch...)
+		} else {
+			edges = append(edges, e)
+		}
 	}
 	return edges
 }
 
 func (r *realCommandRunner) Abort() {
 	r.subprocs.Clear()
+	r.workers.shutdown()
 }
 
 func (r *realCommandRunner) CanRunMore() bool {
 	subprocNumber := r.subprocs.Running() + r.subprocs.Finished()
 	more := subprocNumber < r.config.Parallelism
+	if r.config.RemoteParallelism > 0 {
+		local := len(r.subprocToEdge) - r.remoteRunning
+		more = local < r.config.Parallelism || r.remoteRunning < r.config.RemoteParallelism
+	}
 	load := r.subprocs.Running() == 0 || r.config.MaxLoadAvg <= 0. || getLoadAverage() < r.config.MaxLoadAvg
 	return more && load
 }
 
 func (r *realCommandRunner) StartCommand(edge *Edge) bool {
-	command := edge.EvaluateCommand(false)
-	subproc := r.subprocs.Add(command, edge.Pool == ConsolePool)
+	if r.limiter != nil {
+		r.limiter.wait()
+	}
+	command := edge.command
+	if command == "" {
+		command = edge.spilledCommand
+	}
+	if command == "" {
+		command = edge.EvaluateCommand(false)
+	}
+	// A command overridden by the hooks, e.g. a launcher, keeps its program.
+	// It still runs with the PATH of the toolchain.
+	resolved, env := edge.toolchainCommand(command)
+	if edge.command == "" {
+		command = resolved
+	}
+	var delay time.Duration
+	if r.delays != nil {
+		delay = time.Duration(r.delays.Int63n(int64(r.config.ShuffleMaxDelay) + 1))
+	}
+	dir := edge.Cwd()
+	var subproc *subprocess
+	// The workers run the commands in their own directory.
+	if edge.GetBinding("worker") != "" && edge.Pool != ConsolePool && dir == "" {
+		// Commands that cannot be run on a worker are run normally.
+		if args, err := splitCommand(command); err == nil {
+			if startup, req, ok := splitWorkerArgs(args); ok {
+				subproc = r.subprocs.addFunc(func(ctx context.Context, s *subprocess) {
+					sleepContext(ctx, delay)
+					out, code := r.workers.run(ctx, startup, req, env)
+					s.buf = out
+					s.exitCode = int32(code)
+				})
+			}
+		}
+	}
+	if subproc == nil && (delay != 0 || env != nil || dir != "") {
+		useConsole := edge.Pool == ConsolePool
+		subproc = r.subprocs.addFunc(func(ctx context.Context, s *subprocess) {
+			sleepContext(ctx, delay)
+			s.run(ctx, command, env, dir, useConsole)
+		})
+	} else if subproc == nil {
+		subproc = r.subprocs.Add(command, edge.Pool == ConsolePool)
+	}
 	if subproc == nil {
 		return false
 	}
 	r.subprocToEdge[subproc] = edge
+	if r.isRemoteable(edge) {
+		r.remoteRunning++
+	}
+	if r.config.MemoryLimit > 0 {
+		m := r.edgeMemory(edge)
+		r.memory[edge] = m
+		r.memoryRunning += m
+	}
 	return true
 }
 
+// canStart returns true if there is a slot for edge, depending on whether it
+// is remoteable, and enough memory. Only used when RemoteParallelism or
+// MemoryLimit is set.
+func (r *realCommandRunner) canStart(edge *Edge) bool {
+	if !r.fitsInMemory(edge) {
+		return false
+	}
+	if r.config.RemoteParallelism <= 0 {
+		return true
+	}
+	if r.isRemoteable(edge) {
+		return r.remoteRunning < r.config.RemoteParallelism
+	}
+	return len(r.subprocToEdge)-r.remoteRunning < r.config.Parallelism
+}
+
+// isRemoteable returns true if the edge's command can run on a remote
+// machine, e.g. with distcc or icecc.
+func (r *realCommandRunner) isRemoteable(edge *Edge) bool {
+	return r.config.RemoteableRules[edge.Rule.Name] || edge.GetBinding("remoteable") != ""
+}
+
+// sleepContext sleeps for d or until ctx is canceled.
+func sleepContext(ctx context.Context, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	}
+}
+
 func (r *realCommandRunner) WaitForCommand(result *Result) bool {
 	var subproc *subprocess
 	for {
@@ -194,10 +428,18 @@ func (r *realCommandRunner) WaitForCommand(result *Result) bool {
 
 	result.ExitCode = subproc.Finish()
 	result.Output = subproc.GetOutput()
+	result.Usage = subproc.usage
 
 	e := r.subprocToEdge[subproc]
 	result.Edge = e
 	delete(r.subprocToEdge, subproc)
+	if r.isRemoteable(e) {
+		r.remoteRunning--
+	}
+	if m, ok := r.memory[e]; ok {
+		r.memoryRunning -= m
+		delete(r.memory, e)
+	}
 	return true
 }
 
@@ -221,6 +463,16 @@ type plan struct {
 
 	// Total remaining number of wanted edges.
 	wantedEdges int
+
+	// replay, if set, dictates the order in which the edges are started.
+	replay *ReplaySchedule
+	// shuffle, if set, picks the ready edges at random.
+	shuffle *rand.Rand
+	// only, if set, is the set of edges to build; the other edges are
+	// considered up to date. See Builder.RestrictTo.
+	only map[*Edge]struct{}
+	// failed are the edges that failed, in order. See edgeFailed.
+	failed []*Edge
 }
 
 // Returns true if there's more work to be done.
@@ -244,6 +496,7 @@ func (p *plan) Reset() {
 	p.wantedEdges = 0
 	p.want = map[*Edge]Want{}
 	p.ready = NewEdgeSet()
+	p.failed = nil
 }
 
 // Add a target to our plan (including all its dependencies).
@@ -257,13 +510,16 @@ func (p *plan) addSubTarget(node *Node, dependent *Node, dyndepWalk map[*Edge]st
 	edge := node.InEdge
 	if edge == nil { // Leaf node.
 		if node.Dirty {
-			referenced := ""
+			err := &ErrMissingInput{Path: node.Path}
 			if dependent != nil {
-				// TODO(maruel): Use %q for real quoting.
-				referenced = fmt.Sprintf(", needed by '%s',", dependent.Path)
+				err.Dependent = dependent.Path
 			}
-			// TODO(maruel): Use %q for real quoting.
-			return false, fmt.Errorf("'%s'%s missing and no known rule to make it", node.Path, referenced)
+			if p.builder != nil {
+				if e := p.builder.state.SkippedOutputs()[node.Path]; e != nil {
+					err.Skipped = e.Condition
+				}
+			}
+			return false, err
 		}
 		return false, nil
 	}
@@ -272,6 +528,12 @@ func (p *plan) addSubTarget(node *Node, dependent *Node, dyndepWalk map[*Edge]st
 		// Don't need to do anything.
 		return false, nil
 	}
+	if p.excluded(edge) {
+		// Consider the edge up to date, even if it is dirty.
+		edge.OutputsReady = true
+		return false, nil
+	}
+	p.skipExcludedInputs(edge)
 
 	// If an entry in want does not already exist for edge, create an entry which
 	// maps to WantNothing, indicating that we do not want to build this entry itself.
@@ -321,9 +583,52 @@ func (p *plan) edgeWanted(edge *Edge) {
 // Pop a ready edge off the queue of edges to build.
 // Returns NULL if there's no work to do.
 func (p *plan) findWork() *Edge {
+	if p.replay != nil {
+		return p.replay.findWork(p)
+	}
+	var accept func(*Edge) bool
+	if p.builder != nil {
+		if r, ok := p.builder.commandRunner.(*realCommandRunner); ok && (r.config.RemoteParallelism > 0 || r.config.MemoryLimit > 0) {
+			accept = r.canStart
+		}
+	}
+	if p.shuffle != nil && len(p.ready.edges) > 1 {
+		// The edges are iterated in a stable order so the seed reproduces
+		// the same choices.
+		i := p.shuffle.Intn(len(p.ready.edges))
+		if e := p.ready.popMatching(1, func(e *Edge) bool { i--; return i < 0 && (accept == nil || accept(e)) }); len(e) != 0 {
+			return e[0]
+		}
+	}
+	if accept != nil {
+		if e := p.ready.popMatching(1, accept); len(e) != 0 {
+			return e[0]
+		}
+		return nil
+	}
 	return p.ready.Pop()
 }
 
+// findBatch pops the ready edges that can run in the same command as edge,
+// up to the value of the rule's "batch" binding.
+//
+// Only edges of the same rule, in the same pool and without edge level
+// bindings of their own are batched together, so that their commands only
+// differ by their inputs and outputs. Returns nil if edge is not batched.
+func (p *plan) findBatch(edge *Edge) []*Edge {
+	n, err := strconv.Atoi(edge.GetBinding("batch"))
+	if err != nil || n <= 1 {
+		return nil
+	}
+	others := p.ready.popMatching(n-1, func(e *Edge) bool {
+		return e.Rule == edge.Rule && e.Pool == edge.Pool && e.Env == edge.Env
+	})
+	if len(others) == 0 {
+		return nil
+	}
+	return append([]*Edge{edge}, others...)
+}
+
 // Submits a ready edge as a candidate for execution.
 // The edge may be delayed from running, for example if it's a member of a
 // currently-full pool.
@@ -348,6 +653,9 @@ func (p *plan) ScheduleWork(edge *Edge, want Want) {
 		pool.edgeScheduled(edge)
 		p.ready.Add(edge)
 	}
+	if p.builder != nil && p.builder.prefetch != nil {
+		p.builder.prefetch.edge(edge)
+	}
 }
 
 // edgeFinished marks an edge as done building (whether it succeeded or
@@ -357,6 +665,9 @@ func (p *plan) ScheduleWork(edge *Edge, want Want) {
 // loads dynamic dependencies from the nodes' paths.
 func (p *plan) edgeFinished(edge *Edge, result edgeResult) error {
 	directlyWanted := p.want[edge] != WantNothing
+	if p.replay != nil {
+		p.replay.finished(edge)
+	}
 
 	// See if this job frees up any delayed jobs.
 	if directlyWanted {
@@ -650,26 +961,93 @@ func (p *plan) Dump() {
 
 //
 
+// EdgeDecision is returned by BuilderHooks.BeforeEdge to control how an edge
+// is run.
+type EdgeDecision struct {
+	// Command, if not empty, is run instead of the edge's command. The
+	// original command is still the one recorded in the build log, so
+	// rewriting a command doesn't make the edge dirty on the next build.
+	Command string
+	// Skip marks the edge as succeeded without running its command, e.g.
+	// because the hook restored the outputs from a cache. The outputs are
+	// restat'ed as usual.
+	Skip bool
+	// Err, if not nil, fails the edge without running its command. Its
+	// message is used as the command output.
+	Err error
+}
+
+// BuilderHooks are optional callbacks that let an embedder observe and alter
+// the execution of each edge.
+//
+// They are called from the goroutine running Builder.Build. Phony edges are
+// not reported.
+type BuilderHooks struct {
+	// BeforeEdge is called before the command of an edge is started.
+	//
+	// When edges are batched, it is called for the first edge only and a
+	// decision other than the default disables batching.
+	BeforeEdge func(edge *Edge) EdgeDecision
+	// AfterEdge is called once the command of result.Edge completed, before
+	// the status is updated and the logs are written. It may modify
+	// result.ExitCode and result.Output.
+	AfterEdge func(result *Result, startTimeMillis, endTimeMillis int32)
+}
+
 // Builder wraps the build process: starting commands, updating status.
 type Builder struct {
+	// Hooks are called around each edge. They must be set before Build is
+	// called.
+	Hooks BuilderHooks
+
 	state         *State
 	config        *BuildConfig
 	plan          plan
 	commandRunner commandRunner
 	status        Status
 
+	// Results of the edges that were vetoed or skipped by Hooks.BeforeEdge, or
+	// that were run by the builder itself, reaped before waiting on the
+	// command runner.
+	hookResults []Result
+
+	// Targets added with QueueTarget that are not yet scanned.
+	queuedTargets []*Node
+
+	// Set while Build runs when BuildConfig.PrefetchWorkers is set.
+	prefetch *prefetcher
+
+	// Set by WatchManifest.
+	watch *manifestWatcher
+
+	// Called by Build with the state unlocked at each iteration of its main
+	// loop, when the graph is consistent. Set by Run.
+	unlocked func()
+
 	// Map of running edge to time the edge started running.
 	runningEdges map[*Edge]int32
 
+	// Map of running edge to its runtime/trace task, set while a trace is
+	// being captured. Batched edges share the task of the first edge.
+	edgeTasks map[*Edge]*trace.Task
+
+	// Number of command edges that completed, and how many of them failed.
+	finishedEdges, failedEdges int
+	// Number of command edges skipped by Hooks.BeforeEdge.
+	skippedEdges int
+
+	// dedup tracks the commands run when BuildConfig.DedupCommands is set.
+	dedup dedupState
+
 	// Time the build started.
 	startTimeMillis int64
 
-	di   DiskInterface
+	di   FileSystem
 	scan DependencyScan
 }
 
 // NewBuilder returns an initialized Builder.
-func NewBuilder(state *State, config *BuildConfig, buildLog *BuildLog, depsLog *DepsLog, di DiskInterface, status Status, startTimeMillis int64) *Builder {
+func NewBuilder(state *State, config *BuildConfig, buildLog *BuildLog, depsLog *DepsLog, di FileSystem, status Status, startTimeMillis int64) *Builder {
 	b := &Builder{
 		state:           state,
 		config:          config,
@@ -679,7 +1057,27 @@ func NewBuilder(state *State, config *BuildConfig, buildLog *BuildLog, depsLog *
 		di:              di,
 	}
 	b.plan = newPlan(b)
+	if config.Shuffle {
+		b.plan.shuffle = rand.New(rand.NewSource(config.ShuffleSeed))
+	}
 	b.scan = NewDependencyScan(state, buildLog, depsLog, di)
+	b.scan.depLoader.workers = config.DepfileWorkers
+	b.scan.tools = &toolTracker{all: config.TrackTools, digests: config.ToolDigests}
+	if b.scan.tools.digests == nil {
+		b.scan.tools.digests = NewDigestStore()
+	}
+	if config.LowMemory {
+		state.DisableMemoization()
+	}
+	if config.PosixShell != "" {
+		state.UsePosixShell()
+	}
+	if buildLog != nil {
+		buildLog.Sync = config.LogSync
+	}
+	if depsLog != nil {
+		depsLog.Sync = config.LogSync
+	}
 	return b
 }
 
@@ -738,6 +1136,13 @@ func (b *Builder) addTargetName(name string) (*Node, error) {
 // Returns true if the target is dirty. Returns false and no error if the
 // target is up to date.
 func (b *Builder) AddTarget(target *Node) (bool, error) {
+	defer b.state.lock()()
+	return b.addTarget(target)
+}
+
+// addTarget is AddTarget with the state already locked.
+func (b *Builder) addTarget(target *Node) (bool, error) {
+	defer traceRegion("scan")()
 	validationNodes, err := b.scan.RecomputeDirty(target)
 	if err != nil {
 		return false, err
@@ -764,9 +1169,109 @@ func (b *Builder) AddTarget(target *Node) (bool, error) {
 	return true, nil
 }
 
+// QueueTarget adds a target to the build without scanning its dependencies
+// yet.
+//
+// Queued targets are scanned by Build when no command can be started, e.g.
+// while the commands of the targets already scanned are running. This reduces
+// the latency until the first command starts when building many independent
+// targets. Errors found while scanning are returned by Build.
+//
+// The stat cache of the FileSystem must be disabled, as the outputs of edges
+// run before the target is scanned may be examined. An error is returned
+// otherwise.
+func (b *Builder) QueueTarget(target *Node) error {
+	if c, ok := b.di.(interface{ statCacheEnabled() bool }); ok && c.statCacheEnabled() {
+		return errors.New("the stat cache must be disabled to queue targets")
+	}
+	b.queuedTargets = append(b.queuedTargets, target)
+	return nil
+}
+
 // AlreadyUpToDate returns true if the build targets are already up to date.
+//
+// It returns false as long as there are queued targets to scan.
 func (b *Builder) AlreadyUpToDate() bool {
-	return !b.plan.moreToDo()
+	return !b.plan.moreToDo() && len(b.queuedTargets) == 0
+}
+
+// scanQueuedTarget scans the next queued target and adds it to the plan.
+func (b *Builder) scanQueuedTarget() error {
+	target := b.queuedTargets[0]
+	b.queuedTargets = b.queuedTargets[1:]
+	if _, err := b.addTarget(target); err != nil {
+		return err
+	}
+	b.status.PlanHasTotalEdges(b.plan.commandEdges)
+	return nil
+}
+
+// ProgressSnapshot is a point in time view of the progress of a build.
+//
+// Only edges with a command are counted, phony edges are ignored.
+type ProgressSnapshot struct {
+	// Total is the number of edges in the plan. It can decrease during the
+	// build when restat cleans edges, or increase when dyndeps are loaded.
+	Total int
+	// Finished is the number of edges that completed, including the failed
+	// ones.
+	Finished int
+	// Failed is the number of edges that completed with an error.
+	Failed int
+	// Skipped is the number of finished edges whose command was not run
+	// because BuilderHooks.BeforeEdge skipped them, e.g. on a cache hit.
+	Skipped int
+	// Running is the number of edges being run.
+	Running int
+	// Ready is the number of edges that can be started as soon as the command
+	// runner has capacity.
+	Ready int
+	// Blocked is the number of edges waiting on their inputs or on a pool.
+	Blocked int
+	// Pools is the state of each pool with a depth, sorted by name.
+	Pools []PoolProgress
+}
+
+// PoolProgress is the state of a pool in a ProgressSnapshot.
+type PoolProgress struct {
+	Name    string
+	Depth   int
+	InUse   int
+	Delayed int
+}
+
+// Progress returns a snapshot of the progress of the build.
+//
+// It must be called from the goroutine running Build, e.g. from a Status or
+// a BuilderHooks callback.
+func (b *Builder) Progress() ProgressSnapshot {
+	p := ProgressSnapshot{
+		Total:    b.plan.commandEdges,
+		Finished: b.finishedEdges,
+		Failed:   b.failedEdges,
+		Skipped:  b.skippedEdges,
+		Running:  len(b.runningEdges),
+	}
+	for e := range b.plan.ready.edges {
+		if e.Rule != PhonyRule {
+			p.Ready++
+		}
+	}
+	if p.Blocked = p.Total - p.Finished - p.Running - p.Ready; p.Blocked < 0 {
+		p.Blocked = 0
+	}
+	for _, pool := range b.state.AllPools() {
+		if pool.Depth() != 0 {
+			p.Pools = append(p.Pools, PoolProgress{
+				Name:    pool.Name,
+				Depth:   pool.Depth(),
+				InUse:   pool.CurrentUse(),
+				Delayed: pool.DelayedEdges(),
+			})
+		}
+	}
+	sort.Slice(p.Pools, func(i, j int) bool { return p.Pools[i].Name < p.Pools[j].Name })
+	return p
 }
 
 // Build runs the build.
@@ -776,20 +1281,53 @@ func (b *Builder) Build() error {
 	if b.AlreadyUpToDate() {
 		return errors.New("already up to date")
 	}
+	defer b.state.lock()()
+	defer traceRegion("build")()
 
 	b.status.PlanHasTotalEdges(b.plan.commandEdges)
 	pendingCommands := 0
 	failuresAllowed := b.config.FailuresAllowed
+	// graceExpired is set once the commands still running CancelGrace after
+	// the first failure were canceled.
+	var graceExpired int32
+	var graceTimer *time.Timer
+	defer func() {
+		if graceTimer != nil {
+			graceTimer.Stop()
+		}
+	}()
 
-	// Set up the command runner if we haven't done so already.
-	if b.commandRunner == nil {
-		if b.config.DryRun {
-			b.commandRunner = &dryRunCommandRunner{}
-		} else {
-			b.commandRunner = newRealCommandRunner(b.config)
+	b.setupCommandRunner()
+	if r, ok := b.commandRunner.(*realCommandRunner); ok {
+		defer r.workers.shutdown()
+	}
+
+	if b.config.PrefetchWorkers > 0 && !b.config.DryRun {
+		b.prefetch = newPrefetcher(b.config.PrefetchWorkers, prefetchFile)
+		defer func() {
+			b.prefetch.shutdown()
+			b.prefetch = nil
+		}()
+		// The edges that became ready while scanning the targets, in the order
+		// they will be started.
+		b.plan.ready.recreate()
+		for i := len(b.plan.ready.sorted) - 1; i >= 0; i-- {
+			b.prefetch.edge(b.plan.ready.sorted[i])
 		}
 	}
 
+	if b.watch != nil && b.config.ManifestChange != ManifestChangeIgnore {
+		if r, ok := b.commandRunner.(*realCommandRunner); ok && b.config.ManifestChange == ManifestChangeCancel {
+			// Interrupt the running commands right away instead of waiting for
+			// them to complete.
+			b.watch.onChange = r.subprocs.cancel
+		}
+		b.watch.start()
+		defer b.watch.shutdown()
+	} else {
+		b.watch = nil
+	}
+
 	// We are about to start the build process.
 	b.status.BuildStarted()
 
@@ -798,9 +1336,22 @@ func (b *Builder) Build() error {
 	// First, we attempt to start as many commands as allowed by the
 	// command runner.
 	// Second, we attempt to wait for / reap the next finished command.
-	for b.plan.moreToDo() {
+	for b.plan.moreToDo() || len(b.queuedTargets) != 0 {
+		if b.unlocked != nil {
+			b.callUnlocked(b.unlocked)
+		}
+
+		// Stop operating on a stale graph. With ManifestChangeFinish, the
+		// running commands are reaped first.
+		changed := b.watch.err()
+		if changed != nil && (pendingCommands == 0 || b.config.ManifestChange == ManifestChangeCancel) {
+			b.cleanup()
+			b.status.BuildFinished()
+			return changed
+		}
+
 		// See if we can start any more commands.
-		if failuresAllowed != 0 && b.commandRunner.CanRunMore() {
+		if changed == nil && failuresAllowed != 0 && b.commandRunner.CanRunMore() {
 			if edge := b.plan.findWork(); edge != nil {
 				if edge.GetBinding("generator") != "" {
 					if err := b.scan.buildLog.Close(); err != nil {
@@ -832,27 +1383,85 @@ func (b *Builder) Build() error {
 			}
 		}
 
+		// No command can be started; scan a queued target while the running
+		// commands complete.
+		if changed == nil && failuresAllowed != 0 && len(b.queuedTargets) != 0 {
+			if err := b.scanQueuedTarget(); err != nil {
+				b.cleanup()
+				b.status.BuildFinished()
+				return err
+			}
+			continue
+		}
+
 		// See if we can reap any finished commands.
 		if pendingCommands != 0 {
 			var result Result
-			if !b.commandRunner.WaitForCommand(&result) || result.ExitCode == ExitInterrupted {
+			if len(b.hookResults) != 0 {
+				result = b.hookResults[0]
+				b.hookResults = b.hookResults[1:]
+			} else if !b.waitForCommand(&result) || (result.ExitCode == ExitInterrupted && atomic.LoadInt32(&graceExpired) == 0) {
 				b.cleanup()
 				b.status.BuildFinished()
 				// TODO(maruel): This will use context.
-				return errors.New("interrupted by user")
+				return ErrInterrupted
+			}
+			if err := b.watch.err(); err != nil && b.config.ManifestChange == ManifestChangeCancel {
+				// The command was likely interrupted; don't report it as failed.
+				b.cleanup()
+				b.status.BuildFinished()
+				return err
+			}
+			if atomic.LoadInt32(&graceExpired) != 0 {
+				b.cleanup()
+				b.status.BuildFinished()
+				return fmt.Errorf("subcommand failed; canceled the commands still running %s after the failure", b.config.CancelGrace)
 			}
 
 			pendingCommands--
+			// Clear the batch before logging the command so that each edge is
+			// recorded with its own command.
+			batch := result.Edge.batch
+			result.Edge.batch = nil
+			if batch != nil {
+				// Drop the bindings that were expanded with $in_batch.
+				result.Edge.invalidateBindings()
+			}
+			result.Edge.command = ""
+			exitCode := result.ExitCode
 			if err := b.finishCommand(&result); err != nil {
 				b.cleanup()
 				b.status.BuildFinished()
 				return err
 			}
+			if b.config.DedupCommands {
+				b.dedup.finished(b, &result)
+			}
+			for i := 1; i < len(batch); i++ {
+				other := Result{Edge: batch[i], ExitCode: exitCode}
+				if err := b.finishCommand(&other); err != nil {
+					b.cleanup()
+					b.status.BuildFinished()
+					return err
+				}
+			}
 
 			if result.ExitCode != ExitSuccess {
 				if failuresAllowed != 0 {
 					failuresAllowed--
 				}
+				if b.config.CancelGrace > 0 && graceTimer == nil {
+					// The build failed; stop starting commands and give the
+					// running ones some time to complete.
+					failuresAllowed = 0
+					r, _ := b.commandRunner.(*realCommandRunner)
+					graceTimer = time.AfterFunc(b.config.CancelGrace, func() {
+						atomic.StoreInt32(&graceExpired, 1)
+						if r != nil {
+							r.subprocs.cancel()
+						}
+					})
+				}
 			}
 
 			// We made some progress; start the main loop over.
@@ -875,21 +1484,104 @@ func (b *Builder) Build() error {
 	return nil
 }
 
+// setupCommandRunner sets up the command runner if we haven't done so already.
+func (b *Builder) setupCommandRunner() {
+	if b.commandRunner == nil {
+		if b.config.DryRun {
+			b.commandRunner = &dryRunCommandRunner{}
+		} else {
+			r := newRealCommandRunner(b.config)
+			r.buildLog = b.scan.buildLog
+			b.commandRunner = r
+		}
+	}
+}
+
+// callUnlocked calls fn with the state unlocked.
+func (b *Builder) callUnlocked(fn func()) {
+	if mu := b.state.mu; mu != nil {
+		mu.Unlock()
+		defer mu.Lock()
+	}
+	fn()
+}
+
+// waitForCommand waits for a command to complete with the state unlocked, so
+// State.View callers are not blocked for the duration of the commands.
+func (b *Builder) waitForCommand(result *Result) bool {
+	if mu := b.state.mu; mu != nil {
+		mu.Unlock()
+		defer mu.Lock()
+	}
+	return b.commandRunner.WaitForCommand(result)
+}
+
 func (b *Builder) startEdge(edge *Edge) error {
 	defer metricRecord("StartEdge")()
 	if edge.Rule == PhonyRule {
 		return nil
 	}
 	startTimeMillis := int32(time.Now().UnixMilli() - b.startTimeMillis)
-	b.runningEdges[edge] = startTimeMillis
-
-	b.status.BuildEdgeStarted(edge, startTimeMillis)
-
-	// Create directories necessary for outputs.
-	// XXX: this will block; do we care?
-	for _, o := range edge.Outputs {
-		if err := MakeDirs(b.di, o.Path); err != nil {
-			return err
+	if trace.IsEnabled() {
+		// The task spans from the start of the edge to its completion, so the
+		// trace shows the goroutines working for it.
+		ctx, task := trace.NewTask(context.Background(), "edge")
+		trace.Log(ctx, "rule", edge.Rule.Name)
+		trace.Log(ctx, "output", edge.Outputs[0].Path)
+		if b.edgeTasks == nil {
+			b.edgeTasks = map[*Edge]*trace.Task{}
+		}
+		b.edgeTasks[edge] = task
+	}
+	if isBuiltinRule(edge.Rule) {
+		b.runningEdges[edge] = startTimeMillis
+		b.status.BuildEdgeStarted(edge, startTimeMillis)
+		b.hookResults = append(b.hookResults, b.runBuiltin(edge))
+		return nil
+	}
+	var d EdgeDecision
+	if b.Hooks.BeforeEdge != nil {
+		d = b.Hooks.BeforeEdge(edge)
+	}
+	if d.Skip || d.Err != nil {
+		b.runningEdges[edge] = startTimeMillis
+		b.status.BuildEdgeStarted(edge, startTimeMillis)
+		r := Result{Edge: edge, notRun: true}
+		if d.Err != nil {
+			r.ExitCode = ExitFailure
+			r.Output = d.Err.Error()
+		} else {
+			b.skippedEdges++
+		}
+		b.hookResults = append(b.hookResults, r)
+		return nil
+	}
+	if d.Command == "" && b.config.DedupCommands && b.dedup.start(b, edge, startTimeMillis) {
+		return nil
+	}
+	edge.command = d.Command
+	var batch []*Edge
+	if d.Command == "" {
+		batch = b.plan.findBatch(edge)
+	}
+	edge.batch = batch
+	if batch == nil {
+		batch = []*Edge{edge}
+	} else {
+		// The bindings may have been memoized before the batch was known, e.g.
+		// to estimate the build.
+		edge.invalidateBindings()
+	}
+	for _, e := range batch {
+		b.runningEdges[e] = startTimeMillis
+		b.status.BuildEdgeStarted(e, startTimeMillis)
+
+		// Create directories necessary for outputs.
+		// XXX: this will block; do we care?
+		for _, o := range e.Outputs {
+			if err := MakeDirs(b.di, o.Path); err != nil {
+				return err
+			}
 		}
 	}
 
@@ -903,6 +1595,11 @@ func (b *Builder) startEdge(edge *Edge) error {
 		}
 	}
 
+	if err := b.fitCommand(edge); err != nil {
+		b.hookResults = append(b.hookResults, Result{Edge: edge, ExitCode: ExitFailure, Output: err.Error(), notRun: true})
+		return nil
+	}
+
 	// start command computing and run it
 	if !b.commandRunner.StartCommand(edge) {
 		// TODO(maruel): Use %q for real quoting.
@@ -938,11 +1635,35 @@ func (b *Builder) finishCommand(result *Result) error {
 		}
 	}
 
+	if result.ExitCode == ExitSuccess && b.config.VerifyOutputs && !b.config.DryRun && !result.notRun {
+		if err := b.verifyOutputs(edge); err != nil {
+			if result.Output != "" {
+				result.Output += "\n"
+			}
+			result.Output += err.Error()
+			result.ExitCode = ExitFailure
+		}
+	}
+
 	var startTimeMillis, endTimeMillis int32
 	startTimeMillis = b.runningEdges[edge]
 	endTimeMillis = int32(time.Now().UnixMilli() - b.startTimeMillis)
 	delete(b.runningEdges, edge)
+	if task := b.edgeTasks[edge]; task != nil {
+		task.End()
+		delete(b.edgeTasks, edge)
+	}
 
+	if result.ExitCode != ExitSuccess {
+		result.Cause = b.plan.edgeFailed(edge, result.Output)
+	}
+	if b.Hooks.AfterEdge != nil {
+		b.Hooks.AfterEdge(result, startTimeMillis, endTimeMillis)
+	}
+	b.finishedEdges++
+	if result.ExitCode != ExitSuccess {
+		b.failedEdges++
+	}
 	b.status.BuildEdgeFinished(edge, endTimeMillis, result.ExitCode == ExitSuccess, result.Output)
 
 	// The rest of this function only applies to successful commands.
@@ -974,7 +1695,10 @@ func (b *Builder) finishCommand(result *Result) error {
 			}
 		}
 
-		if nodeCleaned {
+		// The links have the mtime of their input, which may be older than the
+		// other inputs of the edge. So do the outputs of restat edges whose
+		// command preserves the mtime, e.g. an APFS clone made with "cp -c".
+		if nodeCleaned || restat {
 			restatMtime := TimeStamp(0)
 			// If any output was cleaned, find the most recent mtime of any
 			// (existing) non-order-only input or the depfile.
@@ -1003,7 +1727,9 @@ func (b *Builder) finishCommand(result *Result) error {
 			// of a restat.
 			b.status.PlanHasTotalEdges(b.plan.commandEdges)
 
-			outputMtime = restatMtime
+			if nodeCleaned || edge.Rule == HardlinkRule || edge.Rule == SymlinkRule || restatMtime > outputMtime {
+				outputMtime = restatMtime
+			}
 		}
 	}
 
@@ -1017,9 +1743,15 @@ func (b *Builder) finishCommand(result *Result) error {
 		// Ignore the error for now.
 		_ = b.di.RemoveFile(rspfile)
 	}
+	if edge.spilledCommand != "" {
+		if !Debug.KeepRsp {
+			_ = b.di.RemoveFile(autoRspfile(edge))
+		}
+		edge.spilledCommand = ""
+	}
 
 	if b.scan.buildLog != nil {
-		if err := b.scan.buildLog.RecordCommand(edge, startTimeMillis, endTimeMillis, outputMtime); err != nil {
+		if err := b.scan.buildLog.recordCommand(edge, b.scan.tools, startTimeMillis, endTimeMillis, outputMtime, &result.Usage); err != nil {
 			return fmt.Errorf("error writing to build log: %w", err)
 		}
 	}
@@ -1042,6 +1774,38 @@ func (b *Builder) finishCommand(result *Result) error {
 	return nil
 }
 
+// coarseMTimeMicros is the resolution of the mtimes on the file systems with
+// the coarsest one, FAT, in microseconds.
+const coarseMTimeMicros = 2 * 1000 * 1000
+
+// verifyOutputs returns an error if the command of edge didn't write one of
+// its outputs.
+//
+// The outputs were stat'ed when the edge was found dirty, so an output whose
+// mtime didn't change was not written. The stat cache is bypassed as it may
+// hold the mtime from before the command ran. An output written shortly
+// before the command started may keep its mtime on file systems with a coarse
+// resolution, so it is not checked.
+func (b *Builder) verifyOutputs(edge *Edge) error {
+	restat := edge.GetBinding("restat") != ""
+	started := TimeStamp((b.startTimeMillis + int64(b.runningEdges[edge])) * 1000)
+	for _, o := range edge.Outputs {
+		mtime, err := statUncached(b.di, o.Path)
+		if mtime == -1 {
+			return err
+		}
+		if mtime == 0 {
+			// TODO(maruel): Use %q for real quoting.
+			return fmt.Errorf("command succeeded but did not produce output '%s'", o.Path)
+		}
+		if !restat && mtime == o.MTime && o.MTime < started-coarseMTimeMicros {
+			// TODO(maruel): Use %q for real quoting.
+			return fmt.Errorf("command succeeded but did not update output '%s'", o.Path)
+		}
+	}
+	return nil
+}
+
 func (b *Builder) extractDeps(result *Result, depsType string, depsPrefix string) ([]*Node, error) {
 	switch depsType {
 	case "msvc":
@@ -1079,6 +1843,9 @@ func (b *Builder) extractDeps(result *Result, depsType string, depsPrefix string
 		if err := deps.Parse(content); err != nil {
 			return nil, err
 		}
+		if result.Edge.posixShell {
+			deps.translateMSYSPaths()
+		}
 
 		// XXX check depfile matches expected output.
 		depsNodes := make([]*Node, len(deps.ins))
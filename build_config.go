@@ -0,0 +1,221 @@
+// Copyright 2011 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+var verbosityNames = []string{"quiet", "no_status_update", "normal", "verbose", "terse"}
+
+var manifestChangeNames = []string{"ignore", "finish", "cancel"}
+
+var logSyncNames = []string{"none", "fsync", "full"}
+
+// String returns the name of the verbosity, e.g. "normal".
+func (v Verbosity) String() string {
+	if v < 0 || int(v) >= len(verbosityNames) {
+		return fmt.Sprintf("Verbosity(%d)", int32(v))
+	}
+	return verbosityNames[v]
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (v Verbosity) MarshalText() ([]byte, error) {
+	if v < 0 || int(v) >= len(verbosityNames) {
+		return nil, fmt.Errorf("invalid verbosity %d", int32(v))
+	}
+	return []byte(verbosityNames[v]), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (v *Verbosity) UnmarshalText(b []byte) error {
+	i, err := parseEnum("verbosity", string(b), verbosityNames)
+	if err == nil {
+		*v = Verbosity(i)
+	}
+	return err
+}
+
+// String returns the name of the policy, e.g. "finish".
+func (m ManifestChangePolicy) String() string {
+	if m < 0 || int(m) >= len(manifestChangeNames) {
+		return fmt.Sprintf("ManifestChangePolicy(%d)", int32(m))
+	}
+	return manifestChangeNames[m]
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (m ManifestChangePolicy) MarshalText() ([]byte, error) {
+	if m < 0 || int(m) >= len(manifestChangeNames) {
+		return nil, fmt.Errorf("invalid manifest change policy %d", int32(m))
+	}
+	return []byte(manifestChangeNames[m]), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (m *ManifestChangePolicy) UnmarshalText(b []byte) error {
+	i, err := parseEnum("manifest change policy", string(b), manifestChangeNames)
+	if err == nil {
+		*m = ManifestChangePolicy(i)
+	}
+	return err
+}
+
+// String returns the name of the policy, e.g. "fsync".
+func (l LogSyncPolicy) String() string {
+	if l < 0 || int(l) >= len(logSyncNames) {
+		return fmt.Sprintf("LogSyncPolicy(%d)", int32(l))
+	}
+	return logSyncNames[l]
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (l LogSyncPolicy) MarshalText() ([]byte, error) {
+	if l < 0 || int(l) >= len(logSyncNames) {
+		return nil, fmt.Errorf("invalid log sync policy %d", int32(l))
+	}
+	return []byte(logSyncNames[l]), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (l *LogSyncPolicy) UnmarshalText(b []byte) error {
+	i, err := ParseLogSyncPolicy(string(b))
+	if err == nil {
+		*l = i
+	}
+	return err
+}
+
+// parseEnum returns the index of s in names.
+func parseEnum(what, s string, names []string) (int, error) {
+	for i, n := range names {
+		if n == s {
+			return i, nil
+		}
+	}
+	last := len(names) - 1
+	return 0, fmt.Errorf("invalid %s %q; must be one of %s or %s", what, s, strings.Join(names[:last], ", "), names[last])
+}
+
+// jsonDuration is a time.Duration serialized as a string like "1.5s". A
+// number of nanoseconds is accepted too.
+type jsonDuration time.Duration
+
+func (d jsonDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *jsonDuration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		var i int64
+		if err := json.Unmarshal(b, &i); err != nil {
+			return fmt.Errorf("invalid duration %s", b)
+		}
+		*d = jsonDuration(i)
+		return nil
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = jsonDuration(v)
+	return nil
+}
+
+// buildConfigJSON is BuildConfig without its methods, so it can be encoded
+// with the durations overridden.
+type buildConfigJSON BuildConfig
+
+// buildConfigDurations shadows the durations of BuildConfig in its JSON
+// encoding.
+type buildConfigDurations struct {
+	*buildConfigJSON
+	ManifestPollInterval jsonDuration `json:"manifest_poll_interval,omitempty"`
+	ShuffleMaxDelay      jsonDuration `json:"shuffle_max_delay,omitempty"`
+	CancelGrace          jsonDuration `json:"cancel_grace,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (c BuildConfig) MarshalJSON() ([]byte, error) {
+	return json.Marshal(buildConfigDurations{
+		buildConfigJSON:      (*buildConfigJSON)(&c),
+		ManifestPollInterval: jsonDuration(c.ManifestPollInterval),
+		ShuffleMaxDelay:      jsonDuration(c.ShuffleMaxDelay),
+		CancelGrace:          jsonDuration(c.CancelGrace),
+	})
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+//
+// The fields missing in b are left as is.
+func (c *BuildConfig) UnmarshalJSON(b []byte) error {
+	d := buildConfigDurations{
+		buildConfigJSON:      (*buildConfigJSON)(c),
+		ManifestPollInterval: jsonDuration(c.ManifestPollInterval),
+		ShuffleMaxDelay:      jsonDuration(c.ShuffleMaxDelay),
+		CancelGrace:          jsonDuration(c.CancelGrace),
+	}
+	if err := json.Unmarshal(b, &d); err != nil {
+		return err
+	}
+	c.ManifestPollInterval = time.Duration(d.ManifestPollInterval)
+	c.ShuffleMaxDelay = time.Duration(d.ShuffleMaxDelay)
+	c.CancelGrace = time.Duration(d.CancelGrace)
+	return nil
+}
+
+// Validate returns an error if a field of the configuration is out of range
+// or inconsistent with another one.
+//
+// Unlike the command line flags, 0 doesn't mean infinity for Parallelism and
+// FailuresAllowed; use math.MaxInt32 instead.
+func (c *BuildConfig) Validate() error {
+	var errs []string
+	check := func(ok bool, format string, a ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Sprintf(format, a...))
+		}
+	}
+	check(c.Verbosity >= Quiet && c.Verbosity <= Terse, "invalid verbosity %d", int32(c.Verbosity))
+	check(c.Parallelism >= 1, "parallelism must be at least 1, got %d", c.Parallelism)
+	check(c.FailuresAllowed >= 1, "failures_allowed must be at least 1, got %d", c.FailuresAllowed)
+	check(c.RemoteParallelism >= 0, "remote_parallelism must not be negative, got %d", c.RemoteParallelism)
+	check(c.MemoryLimit >= 0, "memory_limit must not be negative, got %d", c.MemoryLimit)
+	check(!math.IsNaN(c.MaxLoadAvg) && !math.IsInf(c.MaxLoadAvg, 0), "max_load_avg must be finite, got %g", c.MaxLoadAvg)
+	check(!math.IsNaN(c.MaxSpawnRate) && !math.IsInf(c.MaxSpawnRate, 0), "max_spawn_rate must be finite, got %g", c.MaxSpawnRate)
+	check(c.SpawnBurst >= 0, "spawn_burst must not be negative, got %d", c.SpawnBurst)
+	check(c.DepfileWorkers >= 0, "depfile_workers must not be negative, got %d", c.DepfileWorkers)
+	check(c.PrefetchWorkers >= 0, "prefetch_workers must not be negative, got %d", c.PrefetchWorkers)
+	check(c.ManifestChange >= ManifestChangeIgnore && c.ManifestChange <= ManifestChangeCancel, "invalid manifest_change %d", int32(c.ManifestChange))
+	check(c.ManifestPollInterval >= 0, "manifest_poll_interval must not be negative, got %s", c.ManifestPollInterval)
+	check(c.ShuffleMaxDelay >= 0, "shuffle_max_delay must not be negative, got %s", c.ShuffleMaxDelay)
+	check(c.ShuffleMaxDelay == 0 || c.Shuffle, "shuffle_max_delay requires shuffle")
+	check(c.CancelGrace >= 0, "cancel_grace must not be negative, got %s", c.CancelGrace)
+	check(c.LogSync >= LogSyncNone && c.LogSync <= LogSyncFull, "invalid log_sync %d", int32(c.LogSync))
+	for r := range c.RemoteableRules {
+		check(r != "", "remoteable_rules must not contain an empty rule name")
+	}
+	if len(errs) != 0 {
+		return errors.New("invalid build config: " + strings.Join(errs, "; "))
+	}
+	return nil
+}
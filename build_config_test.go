@@ -0,0 +1,117 @@
+// Copyright 2011 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestBuildConfig_JSON(t *testing.T) {
+	c := NewBuildConfig()
+	c.Verbosity = Terse
+	c.Parallelism = 8
+	c.RemoteableRules = map[string]bool{"cc": true}
+	c.ManifestChange = ManifestChangeCancel
+	c.Shuffle = true
+	c.ShuffleMaxDelay = 1500 * time.Millisecond
+	c.CancelGrace = 10 * time.Second
+	c.LowMemory = true
+	c.TrackTools = true
+	c.PosixShell = "sh"
+	c.LogSync = LogSyncFull
+	b, err := json.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"verbosity":"terse","parallelism":8,"failures_allowed":1,"remoteable_rules":{"cc":true},"manifest_change":"cancel","shuffle":true,"low_memory":true,"track_tools":true,"posix_shell":"sh","log_sync":"full","shuffle_max_delay":"1.5s","cancel_grace":"10s"}`
+	if diff := cmp.Diff(want, string(b)); diff != "" {
+		t.Fatal(diff)
+	}
+	got := BuildConfig{}
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(c, got); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestBuildConfig_JSON_Defaults(t *testing.T) {
+	// The missing keys keep their default and a duration can be a number of
+	// nanoseconds.
+	got := NewBuildConfig()
+	if err := json.Unmarshal([]byte(`{"dry_run":true,"manifest_poll_interval":1000}`), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := NewBuildConfig()
+	want.DryRun = true
+	want.ManifestPollInterval = time.Microsecond
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatal(diff)
+	}
+	for _, s := range []string{`{"verbosity":"loud"}`, `{"manifest_change":3}`, `{"cancel_grace":"soon"}`, `{"log_sync":"always"}`} {
+		if err := json.Unmarshal([]byte(s), &got); err == nil {
+			t.Fatalf("%s: expected an error", s)
+		}
+	}
+}
+
+func TestVerbosity(t *testing.T) {
+	// The values are stable; new ones are appended.
+	for i, v := range []Verbosity{Quiet, NoStatusUpdate, Normal, Verbose, Terse} {
+		if int(v) != i {
+			t.Fatalf("%s = %d", v, v)
+		}
+	}
+}
+
+func TestBuildConfig_Validate(t *testing.T) {
+	c := NewBuildConfig()
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	data := []struct {
+		update func(c *BuildConfig)
+		want   string
+	}{
+		{func(c *BuildConfig) { c.Verbosity = Terse + 1 }, "invalid verbosity 5"},
+		{func(c *BuildConfig) { c.Parallelism = 0 }, "parallelism must be at least 1, got 0"},
+		{func(c *BuildConfig) { c.FailuresAllowed = -1 }, "failures_allowed must be at least 1, got -1"},
+		{func(c *BuildConfig) { c.MemoryLimit = -1 }, "memory_limit must not be negative, got -1"},
+		{func(c *BuildConfig) { c.ShuffleMaxDelay = time.Second }, "shuffle_max_delay requires shuffle"},
+		{func(c *BuildConfig) { c.CancelGrace = -time.Second }, "cancel_grace must not be negative, got -1s"},
+		{func(c *BuildConfig) { c.LogSync = LogSyncFull + 1 }, "invalid log_sync 3"},
+		{
+			func(c *BuildConfig) { c.Parallelism = -1; c.DepfileWorkers = -2 },
+			"parallelism must be at least 1, got -1; depfile_workers must not be negative, got -2",
+		},
+	}
+	for i, l := range data {
+		c := NewBuildConfig()
+		l.update(&c)
+		err := c.Validate()
+		if err == nil {
+			t.Fatalf("#%d: expected an error", i)
+		}
+		if got := strings.TrimPrefix(err.Error(), "invalid build config: "); got != l.want {
+			t.Fatalf("#%d: %q != %q", i, l.want, got)
+		}
+	}
+}
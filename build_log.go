@@ -16,12 +16,13 @@ package nin
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/bits"
 	"os"
-	"reflect"
 	"strconv"
 	"strings"
 	"unsafe"
@@ -29,26 +30,93 @@ import (
 
 // LogEntry is an entry in BuildLog.
 type LogEntry struct {
-	output      string
+	output string
+	// commandHash is the MurmurHash2 of the command, as recorded by version 5
+	// and older. It is only set when command is empty.
 	commandHash uint64
-	startTime   int32
-	endTime     int32
-	mtime       TimeStamp
+	// commandHash128 and command are recorded by version 6 and later. The
+	// command text is kept to detect hash collisions.
+	commandHash128 [2]uint64
+	command        string
+	startTime      int32
+	endTime        int32
+	mtime          TimeStamp
+	// usage is recorded by version 7 and later.
+	usage ResourceUsage
 }
 
 // Equal compares two LogEntry.
 func (l *LogEntry) Equal(r *LogEntry) bool {
 	return l.output == r.output && l.commandHash == r.commandHash &&
+		l.commandHash128 == r.commandHash128 && l.command == r.command &&
 		l.startTime == r.startTime && l.endTime == r.endTime &&
-		l.mtime == r.mtime
+		l.mtime == r.mtime && l.usage == r.usage
 }
 
 // Serialize writes an entry into a log file as a text form.
 func (l *LogEntry) Serialize(w io.Writer) error {
-	_, err := fmt.Fprintf(w, "%d\t%d\t%d\t%s\t%x\n", l.startTime, l.endTime, l.mtime, l.output, l.commandHash)
+	return l.serialize(w, buildLogCurrentVersion)
+}
+
+// serialize writes an entry in the format of the specified log version.
+//
+// Entries loaded from an older log don't have the command text and are
+// written in the version 5 form, which is still accepted in later versions.
+func (l *LogEntry) serialize(w io.Writer, version int) error {
+	if version >= 7 && l.hasCommand() {
+		_, err := fmt.Fprintf(w, "%d\t%d\t%d\t%s\t%016x%016x\t%s\t%s\n", l.startTime, l.endTime, l.mtime, l.output, l.commandHash128[0], l.commandHash128[1], l.usage.String(), logCommandEscaper.Replace(l.command))
+		return err
+	}
+	if version >= 6 && l.hasCommand() {
+		_, err := fmt.Fprintf(w, "%d\t%d\t%d\t%s\t%016x%016x\t%s\n", l.startTime, l.endTime, l.mtime, l.output, l.commandHash128[0], l.commandHash128[1], logCommandEscaper.Replace(l.command))
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%d\t%d\t%d\t%s\t%x\n", l.startTime, l.endTime, l.mtime, l.output, l.legacyHash())
 	return err
 }
 
+// legacyHash returns the version 5 hash of the command.
+func (l *LogEntry) legacyHash() uint64 {
+	if l.hasCommand() {
+		return HashCommand(l.command)
+	}
+	return l.commandHash
+}
+
+// hasCommand returns true if the entry was recorded in the version 6 form.
+// Usage returns the resources used by the command, as recorded by version 7
+// and later.
+func (l *LogEntry) Usage() ResourceUsage {
+	return l.usage
+}
+
+// Output returns the output path of the entry.
+func (l *LogEntry) Output() string {
+	return l.output
+}
+
+func (l *LogEntry) hasCommand() bool {
+	return l.commandHash128 != [2]uint64{}
+}
+
+// matchesCommand returns true if the entry was recorded for this command.
+//
+// hash must be HashCommand128(command). When the 128 bits hash matches, the
+// stored command text is compared to rule out a collision.
+func (l *LogEntry) matchesCommand(command string, hash [2]uint64) bool {
+	if l.hasCommand() {
+		return l.commandHash128 == hash && l.command == command
+	}
+	return l.commandHash == HashCommand(command)
+}
+
+// logCommandEscaper escapes the characters that would break the line based
+// log format. logCommandUnescaper reverts it.
+var (
+	logCommandEscaper   = strings.NewReplacer("\\", "\\\\", "\n", "\\n", "\r", "\\r")
+	logCommandUnescaper = strings.NewReplacer("\\\\", "\\", "\\n", "\n", "\\r", "\r")
+)
+
 // Implementation details:
 // Each run's log appends to the log file.
 // To load, we run through all log entries in series, throwing away
@@ -59,61 +127,49 @@ func (l *LogEntry) Serialize(w io.Writer) error {
 const (
 	buildLogFileSignature          = "# ninja log v%d\n"
 	buildLogOldestSupportedVersion = 4
-	buildLogCurrentVersion         = 5
+	buildLogCurrentVersion         = 7
 )
 
 // unsafeByteSlice converts string to a byte slice without memory allocation.
-func unsafeByteSlice(s string) (b []byte) {
-	/* #nosec G103 */
-	bh := (*reflect.SliceHeader)(unsafe.Pointer(&b))
-	/* #nosec G103 */
-	sh := *(*reflect.StringHeader)(unsafe.Pointer(&s))
-	bh.Data = sh.Data
-	bh.Len = sh.Len
-	bh.Cap = sh.Len
-	return
-}
-
-// unsafeUint64Slice converts string to a byte slice without memory allocation.
-func unsafeUint64Slice(s string) (b []uint64) {
-	/* #nosec G103 */
-	bh := (*reflect.SliceHeader)(unsafe.Pointer(&b))
+//
+// The returned slice must not be modified.
+func unsafeByteSlice(s string) []byte {
+	if s == "" {
+		return nil
+	}
+	// A string header followed by an int has the layout of a slice header.
 	/* #nosec G103 */
-	sh := *(*reflect.StringHeader)(unsafe.Pointer(&s))
-	bh.Data = sh.Data
-	bh.Len = sh.Len / 8
-	bh.Cap = sh.Len / 8
-	return
+	return *(*[]byte)(unsafe.Pointer(&struct {
+		string
+		int
+	}{s, len(s)}))
 }
 
 // HashCommand hashes a command using the MurmurHash2 algorithm by Austin
 // Appleby.
+//
+// The command is read as little endian 64 bits words independently of the
+// CPU so the hashes stored in the build log are the same on all
+// architectures.
 func HashCommand(command string) uint64 {
 	seed := uint64(0xDECAFBADDECAFBAD)
 	const m = 0xc6a4a7935bd1e995
 	r := 47
 	l := len(command)
 	h := seed ^ (uint64(l) * m)
+	data := unsafeByteSlice(command)
 	i := 0
-	if l > 7 {
-		// I tried a few combinations (data as []byte) and this one seemed to be the
-		// best. Feel free to micro-optimize.
-		//data := (*[0x7fff0000]uint64)(unsafe.Pointer((*reflect.StringHeader)(unsafe.Pointer(&command)).Data))[:l/8]
-		data := unsafeUint64Slice(command)
-		for ; i < len(data); i++ {
-			k := data[i]
-			k *= m
-			k ^= k >> r
-			k *= m
-			h ^= k
-			h *= m
-		}
-	}
-
-	//data2 := (*[0x7fff0000]byte)(unsafe.Pointer((*reflect.StringHeader)(unsafe.Pointer(&command)).Data))[8*i : 8*(i+1)]
-	data2 := unsafeByteSlice(command[i*8:])
-	//switch (l - 8*i) & 7 {
-	switch (l - 8*i) & 7 {
+	for ; i+8 <= l; i += 8 {
+		k := binary.LittleEndian.Uint64(data[i : i+8])
+		k *= m
+		k ^= k >> r
+		k *= m
+		h ^= k
+		h *= m
+	}
+
+	data2 := data[i:]
+	switch len(data2) {
 	case 7:
 		h ^= uint64(data2[6]) << 48
 		fallthrough
@@ -143,6 +199,124 @@ func HashCommand(command string) uint64 {
 	return h
 }
 
+// HashCommand128 hashes a command using the 128 bits x64 variant of the
+// MurmurHash3 algorithm by Austin Appleby.
+//
+// Like HashCommand, the result doesn't depend on the CPU architecture.
+//
+// It is used by build log version 6 and later. The larger hash makes
+// collisions much less likely than with HashCommand and the build log keeps
+// the command text to detect them anyway.
+func HashCommand128(command string) [2]uint64 {
+	return murmurHash3x64128(command, 0xDECAFBAD)
+}
+
+func murmurHash3x64128(s string, seed uint32) [2]uint64 {
+	const c1 = 0x87c37b91114253d5
+	const c2 = 0x4cf5ad432745937f
+	h1 := uint64(seed)
+	h2 := uint64(seed)
+	l := len(s)
+	data := unsafeByteSlice(s)
+	for ; len(data) >= 16; data = data[16:] {
+		k1 := binary.LittleEndian.Uint64(data)
+		k2 := binary.LittleEndian.Uint64(data[8:])
+
+		k1 *= c1
+		k1 = bits.RotateLeft64(k1, 31)
+		k1 *= c2
+		h1 ^= k1
+		h1 = bits.RotateLeft64(h1, 27)
+		h1 += h2
+		h1 = h1*5 + 0x52dce729
+
+		k2 *= c2
+		k2 = bits.RotateLeft64(k2, 33)
+		k2 *= c1
+		h2 ^= k2
+		h2 = bits.RotateLeft64(h2, 31)
+		h2 += h1
+		h2 = h2*5 + 0x38495ab5
+	}
+
+	tail := data
+	k1 := uint64(0)
+	k2 := uint64(0)
+	switch len(tail) {
+	case 15:
+		k2 ^= uint64(tail[14]) << 48
+		fallthrough
+	case 14:
+		k2 ^= uint64(tail[13]) << 40
+		fallthrough
+	case 13:
+		k2 ^= uint64(tail[12]) << 32
+		fallthrough
+	case 12:
+		k2 ^= uint64(tail[11]) << 24
+		fallthrough
+	case 11:
+		k2 ^= uint64(tail[10]) << 16
+		fallthrough
+	case 10:
+		k2 ^= uint64(tail[9]) << 8
+		fallthrough
+	case 9:
+		k2 ^= uint64(tail[8])
+		k2 *= c2
+		k2 = bits.RotateLeft64(k2, 33)
+		k2 *= c1
+		h2 ^= k2
+		fallthrough
+	case 8:
+		k1 ^= uint64(tail[7]) << 56
+		fallthrough
+	case 7:
+		k1 ^= uint64(tail[6]) << 48
+		fallthrough
+	case 6:
+		k1 ^= uint64(tail[5]) << 40
+		fallthrough
+	case 5:
+		k1 ^= uint64(tail[4]) << 32
+		fallthrough
+	case 4:
+		k1 ^= uint64(tail[3]) << 24
+		fallthrough
+	case 3:
+		k1 ^= uint64(tail[2]) << 16
+		fallthrough
+	case 2:
+		k1 ^= uint64(tail[1]) << 8
+		fallthrough
+	case 1:
+		k1 ^= uint64(tail[0])
+		k1 *= c1
+		k1 = bits.RotateLeft64(k1, 31)
+		k1 *= c2
+		h1 ^= k1
+	}
+
+	h1 ^= uint64(l)
+	h2 ^= uint64(l)
+	h1 += h2
+	h2 += h1
+	h1 = fmix64(h1)
+	h2 = fmix64(h2)
+	h1 += h2
+	h2 += h1
+	return [2]uint64{h1, h2}
+}
+
+func fmix64(k uint64) uint64 {
+	k ^= k >> 33
+	k *= 0xff51afd7ed558ccd
+	k ^= k >> 33
+	k *= 0xc4ceb9fe1a85ec53
+	k ^= k >> 33
+	return k
+}
+
 //
 
 // BuildLogUser answers questions about the manifest for the BuildLog.
@@ -161,10 +335,26 @@ type BuildLogUser interface {
 //
 // 3) restat information.
 type BuildLog struct {
-	Entries           map[string]*LogEntry
+	Entries map[string]*LogEntry
+	// Version is the log format version to write. 0 means the latest. Set it
+	// to 5 to keep the log readable by ninja 1.11. It must be set before Load
+	// so a log in another version is recompacted.
+	Version int
+	// ChecksumFS is the file system holding the checksum file of the log. nil
+	// means the local disk.
+	ChecksumFS FileSystem
+	// NoChecksum disables the checksum file so only the log is written, like
+	// ninja does.
+	NoChecksum bool
+	// Sync is how the log is flushed to the disk when closed.
+	Sync LogSyncPolicy
+
 	logFile           *os.File
+	logWriter         io.Writer
 	logFilePath       string
 	needsRecompaction bool
+	// sum is the checksum of the log file content as loaded and written.
+	sum logChecksum
 }
 
 // Note: the C++ version uses ExternalStringHashMap<LogEntry*> for
@@ -195,8 +385,24 @@ func (b *BuildLog) OpenForWrite(path string, user BuildLogUser) error {
 
 // RecordCommand records an edge.
 func (b *BuildLog) RecordCommand(edge *Edge, startTime, endTime int32, mtime TimeStamp) error {
-	command := edge.EvaluateCommand(true)
-	commandHash := HashCommand(command)
+	return b.RecordCommandUsage(edge, startTime, endTime, mtime, &ResourceUsage{})
+}
+
+// RecordCommandUsage is like RecordCommand and also records the resources
+// used by the command.
+func (b *BuildLog) RecordCommandUsage(edge *Edge, startTime, endTime int32, mtime TimeStamp, usage *ResourceUsage) error {
+	return b.recordCommand(edge, nil, startTime, endTime, mtime, usage)
+}
+
+// recordCommand is RecordCommandUsage with the programs of the commands
+// identified according to tools.
+func (b *BuildLog) recordCommand(edge *Edge, tools *toolTracker, startTime, endTime int32, mtime TimeStamp, usage *ResourceUsage) error {
+	version := b.writeVersion()
+	command, commandHash128 := edge.logCommand(tools)
+	commandHash := uint64(0)
+	if version < 6 {
+		commandHash = HashCommand(command)
+	}
 	for _, out := range edge.Outputs {
 		path := out.Path
 		i, ok := b.Entries[path]
@@ -207,16 +413,25 @@ func (b *BuildLog) RecordCommand(edge *Edge, startTime, endTime int32, mtime Tim
 			logEntry = &LogEntry{output: path}
 			b.Entries[logEntry.output] = logEntry
 		}
-		logEntry.commandHash = commandHash
+		if version < 6 {
+			logEntry.commandHash = commandHash
+			logEntry.commandHash128 = [2]uint64{}
+			logEntry.command = ""
+		} else {
+			logEntry.commandHash = 0
+			logEntry.commandHash128 = commandHash128
+			logEntry.command = command
+		}
 		logEntry.startTime = startTime
 		logEntry.endTime = endTime
 		logEntry.mtime = mtime
+		logEntry.usage = *usage
 
 		if err := b.openForWriteIfNeeded(); err != nil {
 			return err
 		}
 		if b.logFile != nil {
-			if err := logEntry.Serialize(b.logFile); err != nil {
+			if err := logEntry.serialize(b.logWriter, version); err != nil {
 				return err
 			}
 			// The C++ code does an fsync on the handle but the Go version doesn't
@@ -226,13 +441,34 @@ func (b *BuildLog) RecordCommand(edge *Edge, startTime, endTime int32, mtime Tim
 	return nil
 }
 
-// Close closes the file handle.
+// checksumFS returns the file system holding the checksum file, nil if
+// disabled.
+func (b *BuildLog) checksumFS() FileSystem {
+	return checksumFS(b.ChecksumFS, b.NoChecksum)
+}
+
+// writeVersion returns the log format version to write.
+func (b *BuildLog) writeVersion() int {
+	if b.Version == 0 {
+		return buildLogCurrentVersion
+	}
+	return b.Version
+}
+
+// Close closes the file handle and updates the checksum file.
 func (b *BuildLog) Close() error {
 	err := b.openForWriteIfNeeded() // create the file even if nothing has been recorded
 	if b.logFile != nil {
+		if err2 := syncLog(b.logFile, b.Sync); err == nil {
+			err = err2
+		}
 		_ = b.logFile.Close()
+		if err2 := b.sum.save(b.checksumFS(), b.logFilePath); err == nil {
+			err = err2
+		}
 	}
 	b.logFile = nil
+	b.logWriter = nil
 	return err
 }
 
@@ -259,9 +495,16 @@ func (b *BuildLog) openForWriteIfNeeded() error {
 	if err != nil {
 		return err
 	}
+	if p == 0 {
+		b.sum = logChecksum{valid: true}
+	} else if b.sum.size != p {
+		// The file was not loaded or was modified since.
+		b.sum.valid = false
+	}
+	b.logWriter = io.MultiWriter(b.logFile, &b.sum)
 	if p == 0 {
 		// If the file was empty, write the header.
-		if _, err := fmt.Fprintf(b.logFile, buildLogFileSignature, buildLogCurrentVersion); err != nil {
+		if _, err := fmt.Fprintf(b.logWriter, buildLogFileSignature, b.writeVersion()); err != nil {
 			return err
 		}
 	}
@@ -327,22 +570,24 @@ func (l *LineReader) ReadLine(lineStart *char*, lineEnd *char*) bool {
 
 // Load the on-disk log.
 //
-// It can return a warning with success and an error.
-//
-// LoadNotFound is only returned when os.IsNotExist(err) is true.
-func (b *BuildLog) Load(path string) (LoadStatus, error) {
+// When the log doesn't exist, the error wraps os.ErrNotExist. When the log is
+// unusable, e.g. it doesn't match its checksum, it is deleted and an
+// *ErrLogDiscarded is returned; the build can proceed.
+func (b *BuildLog) Load(path string) error {
 	defer metricRecord(".ninja_log load")()
+	b.sum = logChecksum{}
 	file, err := ioutil.ReadFile(path)
 	if file == nil {
-		if os.IsNotExist(err) {
-			return LoadNotFound, err
-		}
-		return LoadError, err
+		return err
+	}
+	if err := verifyLogChecksum(b.checksumFS(), path, file); err != nil {
+		removeLog(b.checksumFS(), path)
+		return &ErrLogDiscarded{Reason: err.Error() + "; starting over"}
 	}
 
 	if len(file) == 0 {
 		// File was empty.
-		return LoadSuccess, nil
+		return nil
 	}
 
 	logVersion := 0
@@ -362,10 +607,10 @@ func (b *BuildLog) Load(path string) (LoadStatus, error) {
 			_, _ = fmt.Sscanf(line, buildLogFileSignature, &logVersion)
 
 			if logVersion < buildLogOldestSupportedVersion {
-				_ = os.Remove(path)
+				removeLog(b.checksumFS(), path)
 				// Don't report this as a failure.  An empty build log will cause
 				// us to rebuild the outputs anyway.
-				return LoadSuccess, errors.New("build log version invalid, perhaps due to being too old; starting over")
+				return &ErrLogDiscarded{Reason: "build log version invalid, perhaps due to being too old; starting over"}
 			}
 		}
 		const fieldSeparator = byte('\t')
@@ -376,7 +621,7 @@ func (b *BuildLog) Load(path string) (LoadStatus, error) {
 
 		startTime, err := strconv.ParseInt(line[:end], 10, 32)
 		if err != nil {
-			return LoadError, fmt.Errorf("invalid build log: %w", err)
+			return fmt.Errorf("invalid build log: %w", err)
 		}
 		line = line[end+1:]
 		end = strings.IndexByte(line, fieldSeparator)
@@ -385,7 +630,7 @@ func (b *BuildLog) Load(path string) (LoadStatus, error) {
 		}
 		endTime, err := strconv.ParseInt(line[:end], 10, 32)
 		if err != nil {
-			return LoadError, fmt.Errorf("invalid build log: %w", err)
+			return fmt.Errorf("invalid build log: %w", err)
 		}
 		line = line[end+1:]
 		end = strings.IndexByte(line, fieldSeparator)
@@ -394,7 +639,7 @@ func (b *BuildLog) Load(path string) (LoadStatus, error) {
 		}
 		restatMtime, err := strconv.ParseInt(line[:end], 10, 64)
 		if err != nil {
-			return LoadError, fmt.Errorf("invalid build log: %w", err)
+			return fmt.Errorf("invalid build log: %w", err)
 		}
 		line = line[end+1:]
 		end = strings.IndexByte(line, fieldSeparator)
@@ -418,25 +663,213 @@ func (b *BuildLog) Load(path string) (LoadStatus, error) {
 		entry.startTime = int32(startTime)
 		entry.endTime = int32(endTime)
 		entry.mtime = TimeStamp(restatMtime)
+		entry.commandHash = 0
+		entry.commandHash128 = [2]uint64{}
+		entry.command = ""
+		entry.usage = ResourceUsage{}
+		if logVersion >= 6 {
+			// The version 5 form without the command text is accepted too, as
+			// entries upgraded from an older log are kept as is.
+			if end = strings.IndexByte(line, fieldSeparator); end != -1 {
+				if end != 32 {
+					return errors.New("invalid build log: bad command hash")
+				}
+				hash := line[:end]
+				line = line[end+1:]
+				if logVersion >= 7 {
+					if end = strings.IndexByte(line, fieldSeparator); end == -1 {
+						return errors.New("invalid build log: missing resource usage")
+					}
+					if entry.usage, err = parseResourceUsage(line[:end]); err != nil {
+						return fmt.Errorf("invalid build log: %w", err)
+					}
+					line = line[end+1:]
+				}
+				h1, err := strconv.ParseUint(hash[:16], 16, 64)
+				if err != nil {
+					return fmt.Errorf("invalid build log: %w", err)
+				}
+				h2, err := strconv.ParseUint(hash[16:32], 16, 64)
+				if err != nil {
+					return fmt.Errorf("invalid build log: %w", err)
+				}
+				entry.commandHash128 = [2]uint64{h1, h2}
+				entry.command = logCommandUnescaper.Replace(line)
+				continue
+			}
+		}
 		if logVersion >= 5 {
 			entry.commandHash, _ = strconv.ParseUint(line, 16, 64)
 		} else {
 			entry.commandHash = HashCommand(line)
 		}
 	}
+	b.sum.reset(file)
 
 	// Decide whether it's time to rebuild the log:
 	// - if we're upgrading versions
 	// - if it's getting large
 	const minCompactionEntryCount = 100
 	const compactionRatio = 3
-	if logVersion < buildLogCurrentVersion {
+	if logVersion != b.writeVersion() {
 		b.needsRecompaction = true
 	} else if totalEntryCount > minCompactionEntryCount && totalEntryCount > uniqueEntryCount*compactionRatio {
 		b.needsRecompaction = true
 	}
 
-	return LoadSuccess, nil
+	return nil
+}
+
+// readBuildLogVersion returns the version in the header of the build log
+// without loading it.
+//
+// Returns 0 if the file is empty.
+func readBuildLogVersion(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	buf := make([]byte, 64)
+	n, err := f.Read(buf)
+	if n == 0 {
+		if err == io.EOF {
+			return 0, nil
+		}
+		return 0, err
+	}
+	line := string(buf[:n])
+	if i := strings.IndexByte(line, '\n'); i != -1 {
+		line = line[:i+1]
+	}
+	version := 0
+	if _, err := fmt.Sscanf(line, buildLogFileSignature, &version); err != nil {
+		return 0, fmt.Errorf("invalid build log header %q", strings.TrimSpace(line))
+	}
+	return version, nil
+}
+
+// VerifyBuildLog validates the build log at path without modifying it.
+//
+// It checks the header, the checksum file and that every entry is well
+// formed. For version 6 and later entries, the command hash must match the
+// command.
+func VerifyBuildLog(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := verifyLogChecksum(&RealDiskInterface{}, path, data); err != nil {
+		return err
+	}
+	lines := strings.Split(string(data), "\n")
+	version := 0
+	if _, err := fmt.Sscanf(lines[0]+"\n", buildLogFileSignature, &version); err != nil {
+		return fmt.Errorf("%s: invalid header %q", path, lines[0])
+	}
+	if version < buildLogOldestSupportedVersion || version > buildLogCurrentVersion {
+		return fmt.Errorf("%s: unsupported version %d", path, version)
+	}
+	for i, line := range lines[1:] {
+		lineno := i + 2
+		if i == len(lines)-2 {
+			if line != "" {
+				return fmt.Errorf("%s:%d: incomplete last line", path, lineno)
+			}
+			break
+		}
+		if strings.HasPrefix(line, "# ninja log v") {
+			// Written by another process appending to an empty log concurrently.
+			continue
+		}
+		f := strings.SplitN(line, "\t", 5)
+		if len(f) != 5 {
+			return fmt.Errorf("%s:%d: expected 5 fields", path, lineno)
+		}
+		for j, bits := range []int{32, 32, 64} {
+			if _, err := strconv.ParseInt(f[j], 10, bits); err != nil {
+				return fmt.Errorf("%s:%d: %w", path, lineno, err)
+			}
+		}
+		if version < 5 {
+			continue
+		}
+		hash := f[4]
+		if version >= 6 {
+			if j := strings.IndexByte(hash, '\t'); j != -1 {
+				command := hash[j+1:]
+				if version >= 7 {
+					k := strings.IndexByte(command, '\t')
+					if k == -1 {
+						return fmt.Errorf("%s:%d: missing resource usage", path, lineno)
+					}
+					if _, err := parseResourceUsage(command[:k]); err != nil {
+						return fmt.Errorf("%s:%d: %w", path, lineno, err)
+					}
+					command = command[k+1:]
+				}
+				command = logCommandUnescaper.Replace(command)
+				h := HashCommand128(command)
+				if hash[:j] != fmt.Sprintf("%016x%016x", h[0], h[1]) {
+					return fmt.Errorf("%s:%d: command hash mismatch", path, lineno)
+				}
+				continue
+			}
+		}
+		if _, err := strconv.ParseUint(hash, 16, 64); err != nil {
+			return fmt.Errorf("%s:%d: %w", path, lineno, err)
+		}
+	}
+	return nil
+}
+
+// ReadLastBuild returns the entries of the last build recorded in the build
+// log at path, in the order they completed. Only the output, timing and mtime
+// fields are populated.
+//
+// Each build appends its entries to the log as edges complete. Since the
+// times are relative to the start of the build, a new build is detected when
+// the end time goes backward.
+func ReadLastBuild(path string) ([]*LogEntry, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return lastBuild(string(data))
+}
+
+// lastBuild returns the entries of the last build in the build log content.
+func lastBuild(data string) ([]*LogEntry, error) {
+	var entries []*LogEntry
+	lastEnd := int64(-1)
+	for i, line := range strings.Split(data, "\n") {
+		if i == 0 || line == "" {
+			// Skip the header.
+			continue
+		}
+		f := strings.SplitN(line, "\t", 5)
+		if len(f) != 5 {
+			continue
+		}
+		start, err := strconv.ParseInt(f[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid build log: %w", err)
+		}
+		end, err := strconv.ParseInt(f[1], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid build log: %w", err)
+		}
+		mtime, err := strconv.ParseInt(f[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid build log: %w", err)
+		}
+		if end < lastEnd {
+			entries = entries[:0]
+		}
+		lastEnd = end
+		entries = append(entries, &LogEntry{output: f[3], startTime: int32(start), endTime: int32(end), mtime: TimeStamp(mtime)})
+	}
+	return entries, nil
 }
 
 // Recompact rewrites the known log entries, throwing away old data.
@@ -450,8 +883,11 @@ func (b *BuildLog) Recompact(path string, user BuildLogUser) error {
 	if f == nil {
 		return err
 	}
+	sum := logChecksum{valid: true}
+	w := io.MultiWriter(f, &sum)
 
-	if _, err = fmt.Fprintf(f, buildLogFileSignature, buildLogCurrentVersion); err != nil {
+	version := b.writeVersion()
+	if _, err = fmt.Fprintf(w, buildLogFileSignature, version); err != nil {
 		_ = f.Close()
 		return err
 	}
@@ -464,7 +900,7 @@ func (b *BuildLog) Recompact(path string, user BuildLogUser) error {
 			continue
 		}
 
-		if err = entry.Serialize(f); err != nil {
+		if err = entry.serialize(w, version); err != nil {
 			_ = f.Close()
 			return err
 		}
@@ -482,20 +918,24 @@ func (b *BuildLog) Recompact(path string, user BuildLogUser) error {
 	if err = os.Rename(tempPath, path); err != nil {
 		return err
 	}
-	return err
+	b.sum = sum
+	return b.sum.save(b.checksumFS(), path)
 }
 
 // Restat recompacts but stat()'s all outputs in the log.
-func (b *BuildLog) Restat(path string, di DiskInterface, outputs []string) error {
+func (b *BuildLog) Restat(path string, di FileSystem, outputs []string) error {
 	defer metricRecord(".ninja_log restat")()
 	_ = b.Close()
 	tempPath := path + ".restat"
-	f, err := os.OpenFile(tempPath, os.O_CREATE|os.O_WRONLY, 0o666)
+	f, err := os.OpenFile(tempPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o666)
 	if f == nil {
 		return err
 	}
+	sum := logChecksum{valid: true}
+	w := io.MultiWriter(f, &sum)
 
-	if _, err := fmt.Fprintf(f, buildLogFileSignature, buildLogCurrentVersion); err != nil {
+	version := b.writeVersion()
+	if _, err := fmt.Fprintf(w, buildLogFileSignature, version); err != nil {
 		_ = f.Close()
 		return err
 	}
@@ -517,7 +957,7 @@ func (b *BuildLog) Restat(path string, di DiskInterface, outputs []string) error
 			i.mtime = mtime
 		}
 
-		if err := i.Serialize(f); err != nil {
+		if err := i.serialize(w, version); err != nil {
 			_ = f.Close()
 			return err
 		}
@@ -528,5 +968,9 @@ func (b *BuildLog) Restat(path string, di DiskInterface, outputs []string) error
 		return err
 	}
 
-	return os.Rename(tempPath, path)
+	if err := os.Rename(tempPath, path); err != nil {
+		return err
+	}
+	b.sum = sum
+	return b.sum.save(b.checksumFS(), path)
 }
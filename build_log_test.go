@@ -23,6 +23,7 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
 type BuildLogTest struct {
@@ -53,8 +54,8 @@ func TestBuildLogTest_WriteRead(t *testing.T) {
 
 	log2 := NewBuildLog()
 	defer log2.Close()
-	if s, err := log2.Load(testFilename); s != LoadSuccess && err != nil {
-		t.Fatal(s, err)
+	if err := log2.Load(testFilename); err != nil {
+		t.Fatal(err)
 	}
 
 	if 2 != len(log1.Entries) {
@@ -85,7 +86,7 @@ func TestBuildLogTest_WriteRead(t *testing.T) {
 func TestBuildLogTest_FirstWriteAddsSignature(t *testing.T) {
 	b := NewBuildLogTest(t)
 	// Bump when the version is changed.
-	expectedVersion := []byte("# ninja log v5\n")
+	expectedVersion := []byte("# ninja log v7\n")
 
 	log := NewBuildLog()
 	defer log.Close()
@@ -128,15 +129,15 @@ func TestBuildLogTest_DoubleEntry(t *testing.T) {
 
 	log := NewBuildLog()
 	defer log.Close()
-	if s, err := log.Load(testFilename); s != LoadSuccess && err != nil {
-		t.Fatal(s, err)
+	if err := log.Load(testFilename); err != nil {
+		t.Fatal(err)
 	}
 
 	e := log.Entries["out"]
 	if e == nil {
 		t.Fatal("expected true")
 	}
-	b.AssertHash("command def", e.commandHash)
+	b.AssertHash("command def", e)
 }
 
 func TestBuildLogTest_Truncate(t *testing.T) {
@@ -173,8 +174,8 @@ func TestBuildLogTest_Truncate(t *testing.T) {
 
 		log3 := NewBuildLog()
 		defer log3.Close()
-		if s, err := log3.Load(testFilename); s != LoadSuccess && err != nil {
-			t.Fatal(s, err)
+		if err := log3.Load(testFilename); err != nil {
+			t.Fatal(err)
 		}
 		log3.Close()
 	}
@@ -189,10 +190,10 @@ func TestBuildLogTest_ObsoleteOldVersion(t *testing.T) {
 
 	log := NewBuildLog()
 	defer log.Close()
-	if s, err := log.Load(testFilename); s != LoadSuccess && err == nil {
-		t.Fatal(s, err)
+	if err := log.Load(testFilename); !errors.Is(err, &ErrLogDiscarded{}) {
+		t.Fatal(err)
 	} else if !strings.Contains(err.Error(), "version") {
-		t.Fatal(s, err)
+		t.Fatal(err)
 	}
 }
 
@@ -206,8 +207,8 @@ func TestBuildLogTest_SpacesInOutputV4(t *testing.T) {
 
 	log := NewBuildLog()
 	defer log.Close()
-	if s, err := log.Load(testFilename); s != LoadSuccess && err != nil {
-		t.Fatal(s, err)
+	if err := log.Load(testFilename); err != nil {
+		t.Fatal(err)
 	}
 
 	e := log.Entries["out with space"]
@@ -223,7 +224,7 @@ func TestBuildLogTest_SpacesInOutputV4(t *testing.T) {
 	if 456 != e.mtime {
 		t.Fatal("expected equal")
 	}
-	b.AssertHash("command", e.commandHash)
+	b.AssertHash("command", e)
 }
 
 func TestBuildLogTest_DuplicateVersionHeader(t *testing.T) {
@@ -239,8 +240,8 @@ func TestBuildLogTest_DuplicateVersionHeader(t *testing.T) {
 
 	log := NewBuildLog()
 	defer log.Close()
-	if s, err := log.Load(testFilename); s != LoadSuccess && err != nil {
-		t.Fatal(s, err)
+	if err := log.Load(testFilename); err != nil {
+		t.Fatal(err)
 	}
 
 	e := log.Entries["out"]
@@ -256,7 +257,7 @@ func TestBuildLogTest_DuplicateVersionHeader(t *testing.T) {
 	if 456 != e.mtime {
 		t.Fatal("expected equal")
 	}
-	b.AssertHash("command", e.commandHash)
+	b.AssertHash("command", e)
 
 	e = log.Entries["out2"]
 	if e == nil {
@@ -271,7 +272,7 @@ func TestBuildLogTest_DuplicateVersionHeader(t *testing.T) {
 	if 789 != e.mtime {
 		t.Fatal("expected equal")
 	}
-	b.AssertHash("command2", e.commandHash)
+	b.AssertHash("command2", e)
 }
 
 type TestDiskInterface struct {
@@ -306,8 +307,8 @@ func TestBuildLogTest_Restat(t *testing.T) {
 	}
 	log := NewBuildLog()
 	defer log.Close()
-	if s, err := log.Load(testFilename); s != LoadSuccess && err != nil {
-		t.Fatal(s, err)
+	if err := log.Load(testFilename); err != nil {
+		t.Fatal(err)
 	}
 	e := log.Entries["out"]
 	if 3 != e.mtime {
@@ -353,8 +354,8 @@ func TestBuildLogTest_VeryLongInputLine(t *testing.T) {
 
 	log := NewBuildLog()
 	defer log.Close()
-	if s, err := log.Load(testFilename); s != LoadSuccess && err != nil {
-		t.Fatal(s, err)
+	if err := log.Load(testFilename); err != nil {
+		t.Fatal(err)
 	}
 
 	// Difference from C++ version!
@@ -377,7 +378,7 @@ func TestBuildLogTest_VeryLongInputLine(t *testing.T) {
 	if 789 != e.mtime {
 		t.Fatal("expected equal")
 	}
-	b.AssertHash("command2", e.commandHash)
+	b.AssertHash("command2", e)
 }
 
 func TestBuildLogTest_MultiTargetEdge(t *testing.T) {
@@ -455,8 +456,8 @@ func TestBuildLogRecompactTest_Recompact(t *testing.T) {
 	{
 		log2 := NewBuildLog()
 		defer log2.Close()
-		if s, err := log2.Load(testFilename); s != LoadSuccess && err != nil {
-			t.Fatal(s, err)
+		if err := log2.Load(testFilename); err != nil {
+			t.Fatal(err)
 		}
 		if 2 != len(log2.Entries) {
 			t.Fatal("expected equal")
@@ -478,8 +479,8 @@ func TestBuildLogRecompactTest_Recompact(t *testing.T) {
 	{
 		log3 := NewBuildLog()
 		defer log3.Close()
-		if s, err := log3.Load(testFilename); s != LoadSuccess && err != nil {
-			t.Fatal(s, err)
+		if err := log3.Load(testFilename); err != nil {
+			t.Fatal(err)
 		}
 		if 1 != len(log3.Entries) {
 			t.Fatalf("%#v", log3.Entries)
@@ -520,3 +521,273 @@ func BenchmarkHashCommand(b *testing.B) {
 	}
 	optGuardBenchmarkHashCommand = v
 }
+
+func TestHashCommand128(t *testing.T) {
+	// Reference values of MurmurHash3_x64_128 with a seed of 0.
+	data := []struct {
+		in   string
+		want [2]uint64
+	}{
+		{"", [2]uint64{0, 0}},
+		{"hello", [2]uint64{0xcbd8a7b341bd9b02, 0x5b1e906a48ae1d19}},
+		{"The quick brown fox jumps over the lazy dog", [2]uint64{0xe34bbc7bbc071b6c, 0x7a433ca9c49a9347}},
+	}
+	for i, l := range data {
+		if got := murmurHash3x64128(l.in, 0); got != l.want {
+			t.Fatalf("#%d: %x", i, got)
+		}
+	}
+	if HashCommand128(cmdHashCommand) == HashCommand128("short") {
+		t.Fatal("expected different hashes")
+	}
+}
+
+var optGuardBenchmarkHashCommand128 [2]uint64
+
+// BenchmarkHashCommand128 runs a benchmark against HashCommand128() with both
+// a large and a short string.
+func BenchmarkHashCommand128(b *testing.B) {
+	b.ReportAllocs()
+	v := optGuardBenchmarkHashCommand128
+	for i := 0; i < b.N; i++ {
+		h := HashCommand128(cmdHashCommand)
+		v[0] += h[0]
+		h = HashCommand128("short")
+		v[1] += h[1]
+	}
+	optGuardBenchmarkHashCommand128 = v
+}
+
+func TestBuildLogTest_CommandText(t *testing.T) {
+	b := NewBuildLogTest(t)
+	b.AssertParse(&b.state, "rule r\n  command = echo \"a\\b\" > $out\nbuild out: r\n", ParseManifestOpts{})
+	edge := b.state.Edges[0]
+	// Commands can't contain a new line from the manifest but a binding
+	// modified in memory can.
+	edge.Env.Bindings["command"] = "echo a\\nb\r\nc\tdone"
+
+	log1 := NewBuildLog()
+	defer log1.Close()
+	testFilename := filepath.Join(t.TempDir(), "BuildLogTest-tempfile")
+	if err := log1.OpenForWrite(testFilename, b); err != nil {
+		t.Fatal(err)
+	}
+	if err := log1.RecordCommand(edge, 1, 2, 3); err != nil {
+		t.Fatal(err)
+	}
+	log1.Close()
+
+	log2 := NewBuildLog()
+	defer log2.Close()
+	if err := log2.Load(testFilename); err != nil {
+		t.Fatal(err)
+	}
+	e := log2.Entries["out"]
+	if e == nil || !e.Equal(log1.Entries["out"]) {
+		t.Fatalf("%#v", e)
+	}
+	b.AssertHash("echo a\\nb\r\nc\tdone", e)
+
+	// A hash collision is detected by comparing the command text.
+	e.command = "echo other"
+	if e.matchesCommand("echo other", HashCommand128("echo other")) {
+		t.Fatal("expected collision to be detected")
+	}
+}
+
+func TestBuildLogTest_Version5(t *testing.T) {
+	b := NewBuildLogTest(t)
+	b.AssertParse(&b.state, "build out: cat in\n", ParseManifestOpts{})
+	testFilename := filepath.Join(t.TempDir(), "BuildLogTest-tempfile")
+
+	// A new log is written in version 5.
+	log1 := NewBuildLog()
+	defer log1.Close()
+	log1.Version = 5
+	if err := log1.OpenForWrite(testFilename, b); err != nil {
+		t.Fatal(err)
+	}
+	if err := log1.RecordCommand(b.state.Edges[0], 1, 2, 3); err != nil {
+		t.Fatal(err)
+	}
+	log1.Close()
+	contents, err := ioutil.ReadFile(testFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf("# ninja log v5\n1\t2\t3\tout\t%x\n", HashCommand("cat in > out"))
+	if got := string(contents); got != want {
+		t.Fatalf("want %q; got %q", want, got)
+	}
+
+	// Loading it back upgrades it; the entry stays in the version 5 form until
+	// the command is run again.
+	log2 := NewBuildLog()
+	defer log2.Close()
+	if err := log2.Load(testFilename); err != nil {
+		t.Fatal(err)
+	}
+	if err := log2.OpenForWrite(testFilename, b); err != nil {
+		t.Fatal(err)
+	}
+	log2.Close()
+	contents, err = ioutil.ReadFile(testFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = strings.Replace(want, "v5", "v7", 1)
+	if got := string(contents); got != want {
+		t.Fatalf("want %q; got %q", want, got)
+	}
+
+	// Loading it for writing version 5 downgrades it, so ninja 1.11 can read
+	// it.
+	log3 := NewBuildLog()
+	defer log3.Close()
+	log3.Version = 5
+	if err := log3.Load(testFilename); err != nil {
+		t.Fatal(err)
+	}
+	if err := log3.OpenForWrite(testFilename, b); err != nil {
+		t.Fatal(err)
+	}
+	if err := log3.RecordCommand(b.state.Edges[0], 4, 5, 6); err != nil {
+		t.Fatal(err)
+	}
+	log3.Close()
+	contents, err = ioutil.ReadFile(testFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = fmt.Sprintf("# ninja log v5\n1\t2\t3\tout\t%x\n4\t5\t6\tout\t%x\n", HashCommand("cat in > out"), HashCommand("cat in > out"))
+	if got := string(contents); got != want {
+		t.Fatalf("want %q; got %q", want, got)
+	}
+	log4 := NewBuildLog()
+	defer log4.Close()
+	if err := log4.Load(testFilename); err != nil {
+		t.Fatal(err)
+	}
+	b.AssertHash("cat in > out", log4.Entries["out"])
+}
+
+func TestBuildLogTest_Golden(t *testing.T) {
+	// The hashes must not depend on the architecture of the machine writing
+	// the log.
+	b := NewBuildLogTest(t)
+	b.AssertParse(&b.state, "build out: cat in\n", ParseManifestOpts{})
+	usage := ResourceUsage{UserTime: 3 * time.Millisecond, SystemTime: time.Millisecond, MaxRSS: 4096, ReadBytes: 512, WrittenBytes: 1024}
+	for _, version := range []int{5, 6, 7} {
+		testFilename := filepath.Join(t.TempDir(), "BuildLogTest-tempfile")
+		log := NewBuildLog()
+		log.Version = version
+		if err := log.OpenForWrite(testFilename, b); err != nil {
+			t.Fatal(err)
+		}
+		if err := log.RecordCommandUsage(b.state.Edges[0], 1, 2, 0x0102030405060708, &usage); err != nil {
+			t.Fatal(err)
+		}
+		log.Close()
+		got, err := ioutil.ReadFile(testFilename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "# ninja log v5\n1\t2\t72623859790382856\tout\t825e3d38f2a7975b\n"
+		if version == 6 {
+			want = "# ninja log v6\n1\t2\t72623859790382856\tout\t31073324752752b9c488d5726b3904d9\tcat in > out\n"
+		} else if version == 7 {
+			want = "# ninja log v7\n1\t2\t72623859790382856\tout\t31073324752752b9c488d5726b3904d9\t3000,1000,4096,512,1024\tcat in > out\n"
+		}
+		if string(got) != want {
+			t.Fatalf("want %q; got %q", want, got)
+		}
+		if err := VerifyBuildLog(testFilename); err != nil {
+			t.Fatal(err)
+		}
+		log2 := NewBuildLog()
+		if err := log2.Load(testFilename); err != nil {
+			t.Fatal(err)
+		}
+		if e := log2.Entries["out"]; version == 7 && e.Usage() != usage {
+			t.Fatal(e.Usage())
+		}
+	}
+}
+
+// BenchmarkNoopBuild measures the dependency scan of a build where nothing
+// needs to be rebuilt, with the command hashes recorded in each build log
+// version.
+func BenchmarkNoopBuild(b *testing.B) {
+	const edges = 1000
+	for _, version := range []int{5, 6} {
+		b.Run(fmt.Sprintf("v%d", version), func(b *testing.B) {
+			state := NewState()
+			var m strings.Builder
+			m.WriteString("rule r\n  command = " + cmdHashCommand + " $in -o $out\n")
+			for i := 0; i < edges; i++ {
+				fmt.Fprintf(&m, "build out%d: r in%d\n", i, i)
+			}
+			m.WriteByte(0)
+			if err := ParseManifest(&state, nil, ParseManifestOpts{}, "input", []byte(m.String())); err != nil {
+				b.Fatal(err)
+			}
+			fs := NewVirtualFileSystem()
+			for i := 0; i < edges; i++ {
+				fs.Create(fmt.Sprintf("in%d", i), "")
+			}
+			fs.Tick()
+			log := NewBuildLog()
+			log.Version = version
+			var outs []*Node
+			for _, e := range state.Edges {
+				o := e.Outputs[0]
+				fs.Create(o.Path, "")
+				if err := log.RecordCommand(e, 0, 1, fs.Now()); err != nil {
+					b.Fatal(err)
+				}
+				outs = append(outs, o)
+			}
+			scan := NewDependencyScan(&state, &log, nil, &fs)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				state.Reset()
+				for _, e := range state.Edges {
+					e.invalidateBindings()
+				}
+				for _, o := range outs {
+					if _, err := scan.RecomputeDirty(o); err != nil {
+						b.Fatal(err)
+					}
+					if o.Dirty {
+						b.Fatal(o.Path)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestBuildLogTest_ReadLastBuild(t *testing.T) {
+	testFilename := filepath.Join(t.TempDir(), "BuildLogTest-tempfile")
+	content := "# ninja log v5\n0\t10\t0\ta\t1\n5\t20\t0\tb\t1\n0\t3\t0\tc\t1\n1\t7\t0\ta\t1\n"
+	if err := ioutil.WriteFile(testFilename, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ReadLastBuild(testFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*LogEntry{
+		{output: "c", startTime: 0, endTime: 3},
+		{output: "a", startTime: 1, endTime: 7},
+	}
+	if len(entries) != len(want) {
+		t.Fatal(entries)
+	}
+	for i := range want {
+		if !want[i].Equal(entries[i]) {
+			t.Fatalf("%d: %+v", i, entries[i])
+		}
+	}
+}
@@ -15,15 +15,19 @@
 package nin
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"runtime"
+	"runtime/trace"
 	"sort"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 )
@@ -676,8 +680,8 @@ func (b *BuildTestBase) RebuildTarget(target, manifest, logPath, depsPath string
 	if logPath != "" {
 		buildLog := NewBuildLog()
 		defer buildLog.Close()
-		if s, err := buildLog.Load(logPath); !((s == LoadSuccess && err == nil) || (s == LoadNotFound && os.IsNotExist(err))) {
-			b.t.Fatalf("%s = %d: %s", logPath, s, err)
+		if err := buildLog.Load(logPath); err != nil && !os.IsNotExist(err) {
+			b.t.Fatalf("%s: %s", logPath, err)
 		}
 		if err := buildLog.OpenForWrite(logPath, b); err != nil {
 			b.t.Fatal(err)
@@ -689,8 +693,8 @@ func (b *BuildTestBase) RebuildTarget(target, manifest, logPath, depsPath string
 	if depsPath != "" {
 		pdepsLog = &DepsLog{}
 		defer pdepsLog.Close()
-		if s, err := pdepsLog.Load(depsPath, pstate); !((s == LoadSuccess && err == nil) || (s == LoadNotFound && os.IsNotExist(err))) {
-			b.t.Fatalf("%s = %d: %s", depsPath, s, err)
+		if err := pdepsLog.Load(depsPath, pstate); err != nil && !os.IsNotExist(err) {
+			b.t.Fatalf("%s: %s", depsPath, err)
 		}
 		if err := pdepsLog.OpenForWrite(depsPath); err != nil {
 			b.t.Fatal(err)
@@ -734,7 +738,13 @@ func (f *FakeCommandRunner) CanRunMore() bool {
 }
 
 func (f *FakeCommandRunner) StartCommand(edge *Edge) bool {
-	cmd := edge.EvaluateCommand(false)
+	cmd := edge.command
+	if cmd == "" {
+		cmd = edge.spilledCommand
+	}
+	if cmd == "" {
+		cmd = edge.EvaluateCommand(false)
+	}
 	//f.t.Logf("StartCommand(%s)", cmd)
 	if len(f.activeEdges) > int(f.maxActiveEdges) {
 		f.t.Fatal("oops")
@@ -754,6 +764,16 @@ func (f *FakeCommandRunner) StartCommand(edge *Edge) bool {
 		for _, out := range edge.Outputs {
 			f.fs.Create(out.Path, "")
 		}
+	} else if edge.Rule.Name == "cat_batch" {
+		batch := edge.batch
+		if batch == nil {
+			batch = []*Edge{edge}
+		}
+		for _, e := range batch {
+			for _, out := range e.Outputs {
+				f.fs.Create(out.Path, "")
+			}
+		}
 	} else if edge.Rule.Name == "true" || edge.Rule.Name == "fail" || edge.Rule.Name == "interrupt" || edge.Rule.Name == "console" {
 		// Don't do anything.
 	} else if edge.Rule.Name == "cp" {
@@ -847,6 +867,7 @@ func (f *FakeCommandRunner) WaitForCommand(result *Result) bool {
 
 	if edge.Rule.Name == "fail" || (edge.Rule.Name == "touch-fail-tick2" && f.fs.now == 2) {
 		result.ExitCode = ExitFailure
+		result.Output = edge.GetBinding("fail_output")
 	} else {
 		result.ExitCode = ExitSuccess
 	}
@@ -1742,6 +1763,51 @@ func TestBuildTest_SwallowFailuresPool(t *testing.T) {
 	}
 }
 
+func TestBuildTest_CancelGrace(t *testing.T) {
+	b := NewBuildTest(t)
+	b.AssertParse(&b.state, "rule fail\n  command = fail\nbuild out1: fail\nbuild out2: fail\nbuild out3: fail\nbuild all: phony out1 out2 out3\n", ParseManifestOpts{})
+
+	// The first failure stops the build even if more failures are allowed.
+	b.config.FailuresAllowed = 11
+	b.config.CancelGrace = time.Minute
+
+	if _, err := b.builder.addTargetName("all"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.builder.Build(); err == nil {
+		t.Fatal("expected error")
+	} else if err.Error() != "subcommands failed" {
+		t.Fatal(err)
+	}
+	if 1 != len(b.commandRunner.commandsRan) {
+		t.Fatal(b.commandRunner.commandsRan)
+	}
+}
+
+func TestBuildTest_Trace(t *testing.T) {
+	b := NewBuildTest(t)
+	buf := bytes.Buffer{}
+	if err := trace.Start(&buf); err != nil {
+		t.Skip(err)
+	}
+	if _, err := b.builder.addTargetName("cat12"); err != nil {
+		trace.Stop()
+		t.Fatal(err)
+	}
+	err := b.builder.Build()
+	trace.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b.builder.edgeTasks) != 0 {
+		t.Fatal(b.builder.edgeTasks)
+	}
+	if buf.Len() == 0 {
+		t.Fatal("expected a trace")
+	}
+}
+
 func TestBuildTest_PoolEdgesReadyButNotWanted(t *testing.T) {
 	b := NewBuildTest(t)
 	b.fs.Create("x", "")
@@ -2123,6 +2189,44 @@ func TestBuildWithLogTest_RestatSingleDependentOutputDirty(t *testing.T) {
 
 // Test scenario, in which an input file is removed, but output isn't changed
 // https://github.com/ninja-build/ninja/issues/295
+// The output of a restat edge may be older than its inputs when the command
+// preserves the mtime, e.g. an APFS clone made with "cp -c".
+func TestBuildWithLogTest_RestatPreservedMtime(t *testing.T) {
+	b := NewBuildWithLogTest(t)
+	b.AssertParse(&b.state, "rule touch-out-implicit-dep\n  command = cp -c $in $out\nbuild out1: touch-out-implicit-dep in1 | inimp\n  test_dependency = inimp\n  restat = 1\n", ParseManifestOpts{})
+	b.fs.Create("in1", "")
+	b.fs.Create("inimp", "")
+	b.fs.Tick()
+
+	if _, err := b.builder.addTargetName("out1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.builder.Build(); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.commandRunner.commandsRan) != 1 {
+		t.Fatal(b.commandRunner.commandsRan)
+	}
+	outMtime, _ := b.fs.Stat("out1")
+	inMtime, _ := b.fs.Stat("inimp")
+	if outMtime >= inMtime {
+		t.Fatal(outMtime, inMtime)
+	}
+	// The log records the mtime of the most recent input.
+	if e := b.buildLog.Entries["out1"]; e == nil || e.mtime != inMtime {
+		t.Fatal(e)
+	}
+
+	b.commandRunner.commandsRan = nil
+	b.state.Reset()
+	if _, err := b.builder.addTargetName("out1"); err != nil {
+		t.Fatal(err)
+	}
+	if !b.builder.AlreadyUpToDate() {
+		t.Fatal("expected up to date")
+	}
+}
+
 func TestBuildWithLogTest_RestatMissingInput(t *testing.T) {
 	b := NewBuildWithLogTest(t)
 	b.AssertParse(&b.state, "rule true\n  command = true\n  depfile = $out.d\n  restat = 1\nrule cc\n  command = cc\nbuild out1: true in\nbuild out2: cc out1\n", ParseManifestOpts{})
@@ -2311,6 +2415,442 @@ func TestBuildTest_RspFileSuccess(t *testing.T) {
 	}
 }
 
+func TestBuildTest_Batch(t *testing.T) {
+	b := NewBuildTest(t)
+	b.AssertParse(&b.state, "nin_features = batch\nrule cat_batch\n  command = cat $in_batch\n  batch = 2\nbuild out1: cat_batch in1\nbuild out2: cat_batch in2\nbuild out3: cat_batch in3\nbuild out4: cat_batch in4\n  extra = 1\nbuild all: phony out1 out2 out3 out4\n", ParseManifestOpts{})
+	b.fs.Create("in1", "")
+	b.fs.Create("in2", "")
+	b.fs.Create("in3", "")
+	b.fs.Create("in4", "")
+
+	if _, err := b.builder.addTargetName("all"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.builder.Build(); err != nil {
+		t.Fatal(err)
+	}
+	// out4 has its own binding so it is not batched.
+	want := []string{"cat in1 in2", "cat in3", "cat in4"}
+	if diff := cmp.Diff(want, b.commandRunner.commandsRan); diff != "" {
+		t.Fatal(diff)
+	}
+	for _, p := range []string{"out1", "out2", "out3", "out4"} {
+		if n := b.GetNode(p); n.InEdge.batch != nil || !n.InEdge.OutputsReady {
+			t.Fatalf("%s: %v", p, n.InEdge.batch)
+		}
+	}
+	if len(b.builder.runningEdges) != 0 {
+		t.Fatal(b.builder.runningEdges)
+	}
+}
+
+func TestBuilder_BatchEvaluatedEarly(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell loop")
+	}
+	CreateTempDirAndEnter(t)
+	s := NewStateTestWithBuiltinRules(t)
+	s.AssertParse(&s.state, "nin_features = batch\nrule gen\n  command = for i in $in_batch; do touch $$i.out; done\n  batch = 3\nbuild a.out: gen a\nbuild b.out: gen b\nbuild c.out: gen c\nbuild all: phony a.out b.out c.out\n", ParseManifestOpts{})
+	for _, p := range []string{"a", "b", "c"} {
+		if err := ioutil.WriteFile(p, nil, 0o666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Memoize the commands before the batch is known, like the estimate does.
+	for _, e := range s.state.Edges {
+		e.EvaluateCommand(false)
+	}
+	config := NewBuildConfig()
+	builder := NewBuilder(&s.state, &config, nil, nil, &RealDiskInterface{}, &statusFake{}, 0)
+	if _, err := builder.addTargetName("all"); err != nil {
+		t.Fatal(err)
+	}
+	if err := builder.Build(); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"a.out", "b.out", "c.out"} {
+		if _, err := os.Stat(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Each edge is back to its own command.
+	if got := s.state.Paths["b.out"].InEdge.EvaluateCommand(false); got != "for i in b; do touch $i.out; done" {
+		t.Fatal(got)
+	}
+}
+
+func TestBuildTest_Hooks(t *testing.T) {
+	b := NewBuildTest(t)
+	var finished []string
+	b.builder.Hooks = BuilderHooks{
+		BeforeEdge: func(edge *Edge) EdgeDecision {
+			switch edge.Outputs[0].Path {
+			case "cat1":
+				// Restored from a cache.
+				b.fs.Create("cat1", "")
+				return EdgeDecision{Skip: true}
+			case "cat2":
+				return EdgeDecision{Command: "cat in2 in1 > cat2"}
+			}
+			return EdgeDecision{}
+		},
+		AfterEdge: func(result *Result, startTimeMillis, endTimeMillis int32) {
+			if startTimeMillis > endTimeMillis {
+				t.Errorf("%d > %d", startTimeMillis, endTimeMillis)
+			}
+			finished = append(finished, result.Edge.Outputs[0].Path)
+		},
+	}
+	if _, err := b.builder.addTargetName("cat12"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.builder.Build(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"cat in2 in1 > cat2", "cat cat1 cat2 > cat12"}
+	if diff := cmp.Diff(want, b.commandRunner.commandsRan); diff != "" {
+		t.Fatal(diff)
+	}
+	sort.Strings(finished)
+	if diff := cmp.Diff([]string{"cat1", "cat12", "cat2"}, finished); diff != "" {
+		t.Fatal(diff)
+	}
+	if b.GetNode("cat2").InEdge.command != "" {
+		t.Fatal("command override was not cleared")
+	}
+	if p := b.builder.Progress(); p.Finished != 3 || p.Skipped != 1 {
+		t.Fatal(p)
+	}
+}
+
+func TestBuildTest_HooksVeto(t *testing.T) {
+	b := NewBuildTest(t)
+	output := ""
+	b.builder.Hooks = BuilderHooks{
+		BeforeEdge: func(edge *Edge) EdgeDecision {
+			return EdgeDecision{Err: errors.New("not allowed")}
+		},
+		AfterEdge: func(result *Result, startTimeMillis, endTimeMillis int32) {
+			if result.ExitCode != ExitFailure {
+				t.Errorf("unexpected exit code %d", result.ExitCode)
+			}
+			output = result.Output
+		},
+	}
+	if _, err := b.builder.addTargetName("cat1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.builder.Build(); err == nil || err.Error() != "subcommand failed" {
+		t.Fatal(err)
+	}
+	if len(b.commandRunner.commandsRan) != 0 {
+		t.Fatal(b.commandRunner.commandsRan)
+	}
+	if output != "not allowed" {
+		t.Fatal(output)
+	}
+}
+
+// statusProgress records the builder's progress as each edge finishes.
+type statusProgress struct {
+	statusFake
+	builder   *Builder
+	snapshots []ProgressSnapshot
+}
+
+func (s *statusProgress) BuildEdgeFinished(edge *Edge, endTimeMillis int32, success bool, output string) {
+	s.snapshots = append(s.snapshots, s.builder.Progress())
+}
+
+func TestBuildTest_Progress(t *testing.T) {
+	b := NewBuildTest(t)
+	b.AssertParse(&b.state, "pool link\n  depth = 1\nbuild cat12b: cat cat1 cat2\n  pool = link\nbuild all: phony cat12 cat12b\n", ParseManifestOpts{})
+	s := &statusProgress{builder: b.builder}
+	b.builder.status = s
+	if _, err := b.builder.addTargetName("all"); err != nil {
+		t.Fatal(err)
+	}
+	want := ProgressSnapshot{Total: 4, Ready: 2, Blocked: 2, Pools: []PoolProgress{{Name: "console", Depth: 1}, {Name: "link", Depth: 1}}}
+	if diff := cmp.Diff(want, b.builder.Progress()); diff != "" {
+		t.Fatal(diff)
+	}
+	if err := b.builder.Build(); err != nil {
+		t.Fatal(err)
+	}
+	// The fake command runner runs one command at a time. The status is
+	// updated before the dependents of the edge are made ready and before its
+	// pool is released.
+	linkInUse := []PoolProgress{{Name: "console", Depth: 1}, {Name: "link", Depth: 1, InUse: 1}}
+	want2 := []ProgressSnapshot{
+		{Total: 4, Finished: 1, Ready: 1, Blocked: 2, Pools: want.Pools},
+		{Total: 4, Finished: 2, Blocked: 2, Pools: want.Pools},
+		{Total: 4, Finished: 3, Ready: 1, Pools: linkInUse},
+		{Total: 4, Finished: 4, Pools: linkInUse},
+	}
+	if diff := cmp.Diff(want2, s.snapshots); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestBuildTest_Shuffle(t *testing.T) {
+	manifest := "build all: phony o0 o1 o2 o3 o4 o5 o6 o7\n"
+	for i := 0; i < 8; i++ {
+		manifest += fmt.Sprintf("build o%d: cat in1\n", i)
+	}
+	run := func(shuffle bool, seed int64) []string {
+		b := NewBuildTest(t)
+		b.AssertParse(&b.state, manifest, ParseManifestOpts{})
+		b.config.Shuffle = shuffle
+		b.config.ShuffleSeed = seed
+		b.builder = NewBuilder(&b.state, &b.config, nil, nil, &b.fs, b.status, 0)
+		b.builder.commandRunner = &b.commandRunner
+		if _, err := b.builder.addTargetName("all"); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.builder.Build(); err != nil {
+			t.Fatal(err)
+		}
+		return b.commandRunner.commandsRan
+	}
+	normal := run(false, 0)
+	first := run(true, 1)
+	if diff := cmp.Diff(first, run(true, 1)); diff != "" {
+		t.Fatalf("the same seed must give the same order:\n%s", diff)
+	}
+	if diff := cmp.Diff(normal, first); diff == "" {
+		t.Fatal("expected a different order")
+	}
+	sort.Strings(normal)
+	sort.Strings(first)
+	if diff := cmp.Diff(normal, first); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestBuildTest_RemoteParallelism(t *testing.T) {
+	b := NewBuildTest(t)
+	b.AssertParse(&b.state, "nin_features = remoteable\nrule cc\n  command = cc $in > $out\n  remoteable = 1\nbuild r1: cc in1\nbuild r2: cc in1\nbuild r3: cc in1\nbuild all: phony cat1 cat2 r1 r2 r3\n", ParseManifestOpts{})
+	b.config.Parallelism = 1
+	b.config.RemoteParallelism = 2
+	r := newRealCommandRunner(&b.config)
+	b.builder.commandRunner = r
+	if _, err := b.builder.addTargetName("all"); err != nil {
+		t.Fatal(err)
+	}
+	// Simulate starting the commands.
+	var started []string
+	for r.CanRunMore() {
+		e := b.builder.plan.findWork()
+		if e == nil {
+			t.Fatal("expected an edge")
+		}
+		started = append(started, e.Outputs[0].Path)
+		r.subprocToEdge[&subprocess{}] = e
+		if r.isRemoteable(e) {
+			r.remoteRunning++
+		}
+	}
+	if diff := cmp.Diff([]string{"cat1", "r1", "r2"}, started); diff != "" {
+		t.Fatal(diff)
+	}
+	// A local edge doesn't take a remote slot.
+	if e := b.builder.plan.findWork(); e != nil {
+		t.Fatal(e.Outputs[0].Path)
+	}
+	r.remoteRunning--
+	if e := b.builder.plan.findWork(); e == nil || e.Outputs[0].Path != "r3" {
+		t.Fatal(e)
+	}
+}
+
+func TestBuildTest_MemoryLimit(t *testing.T) {
+	b := NewBuildTest(t)
+	b.AssertParse(&b.state, "nin_features = mem\nrule link\n  command = link $in > $out\n  mem = 3G\nbuild l1: link in1\nbuild l2: link in1\nbuild small: link in1\n  mem = 512M\nbuild all: phony l1 l2 small\n", ParseManifestOpts{})
+	b.config.Parallelism = 10
+	b.config.MemoryLimit = 4 << 30
+	r := newRealCommandRunner(&b.config)
+	b.builder.commandRunner = r
+	if _, err := b.builder.addTargetName("all"); err != nil {
+		t.Fatal(err)
+	}
+	// Simulate starting the commands.
+	start := func(e *Edge) {
+		r.subprocToEdge[&subprocess{}] = e
+		r.memory[e] = r.edgeMemory(e)
+		r.memoryRunning += r.memory[e]
+	}
+	var started []string
+	for e := b.builder.plan.findWork(); e != nil; e = b.builder.plan.findWork() {
+		started = append(started, e.Outputs[0].Path)
+		start(e)
+	}
+	if diff := cmp.Diff([]string{"l1", "small"}, started); diff != "" {
+		t.Fatal(diff)
+	}
+	// l2 fits once l1 completed.
+	r.memoryRunning -= r.memory[b.GetNode("l1").InEdge]
+	if e := b.builder.plan.findWork(); e == nil || e.Outputs[0].Path != "l2" {
+		t.Fatal(e)
+	}
+}
+
+func TestBuildTest_MemoryLimit_Alone(t *testing.T) {
+	b := NewBuildTest(t)
+	b.AssertParse(&b.state, "nin_features = mem\nrule link\n  command = link $in > $out\n  mem = 16G\nbuild l1: link in1\n", ParseManifestOpts{})
+	b.config.MemoryLimit = 4 << 30
+	r := newRealCommandRunner(&b.config)
+	b.builder.commandRunner = r
+	if _, err := b.builder.addTargetName("l1"); err != nil {
+		t.Fatal(err)
+	}
+	// An edge larger than the limit runs when nothing else runs.
+	if e := b.builder.plan.findWork(); e == nil {
+		t.Fatal("expected l1")
+	}
+}
+
+func TestBuildTest_VerifyOutputs(t *testing.T) {
+	// build builds target and returns the output of the failed edges.
+	build := func(target string, setup func(b *BuildTest)) []string {
+		b := NewBuildTest(t)
+		b.AssertParse(&b.state, "rule true\n  command = true\nbuild out1: true in1\nbuild out2: cat out1\nbuild out3: true in1\n  restat = 1\n", ParseManifestOpts{})
+		b.config.VerifyOutputs = true
+		setup(b)
+		b.fs.Tick()
+		b.fs.Create("in1", "")
+		var failed []string
+		b.builder.Hooks.AfterEdge = func(r *Result, start, end int32) {
+			if r.ExitCode != ExitSuccess {
+				failed = append(failed, r.Output)
+			}
+		}
+		if _, err := b.builder.addTargetName(target); err != nil {
+			t.Fatal(err)
+		}
+		err := b.builder.Build()
+		if (err != nil) != (len(failed) != 0) {
+			t.Fatal(err, failed)
+		}
+		// The edges depending on the failed one didn't run.
+		if diff := cmp.Diff([]string{"true"}, b.commandRunner.commandsRan); len(failed) != 0 && diff != "" {
+			t.Fatal(diff)
+		}
+		return failed
+	}
+
+	// The output is missing.
+	failed := build("out2", func(b *BuildTest) {})
+	if diff := cmp.Diff([]string{"command succeeded but did not produce output 'out1'"}, failed); diff != "" {
+		t.Fatal(diff)
+	}
+	// The output is stale.
+	failed = build("out2", func(b *BuildTest) { b.fs.Create("out1", "") })
+	if diff := cmp.Diff([]string{"command succeeded but did not update output 'out1'"}, failed); diff != "" {
+		t.Fatal(diff)
+	}
+	// Edges with restat only need their outputs to exist.
+	if failed = build("out3", func(b *BuildTest) { b.fs.Create("out3", "") }); len(failed) != 0 {
+		t.Fatal(failed)
+	}
+	// An output written just before the command started may keep its mtime
+	// with a coarse resolution.
+	failed = build("out2", func(b *BuildTest) {
+		b.fs.now = TimeStamp(time.Now().UnixMicro())
+		b.fs.Create("out1", "")
+	})
+	if len(failed) != 0 {
+		t.Fatal(failed)
+	}
+}
+
+func TestBuilder_VerifyOutputsDisk(t *testing.T) {
+	CreateTempDirAndEnter(t)
+	s := NewStateTestWithBuiltinRules(t)
+	cmd := "touch out"
+	if runtime.GOOS == "windows" {
+		cmd = "cmd /c echo > out"
+	}
+	s.AssertParse(&s.state, "rule w\n  command = "+cmd+"\nbuild out: w in\n", ParseManifestOpts{})
+	if err := ioutil.WriteFile("out", nil, 0o666); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes("out", old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile("in", nil, 0o666); err != nil {
+		t.Fatal(err)
+	}
+	di := &RealDiskInterface{}
+	// The stat cache holds the mtime of out from before the command ran.
+	di.AllowStatCache(true)
+	config := NewBuildConfig()
+	config.VerifyOutputs = true
+	builder := NewBuilder(&s.state, &config, nil, nil, di, &statusFake{}, time.Now().UnixMilli())
+	if _, err := builder.addTargetName("out"); err != nil {
+		t.Fatal(err)
+	}
+	if err := builder.Build(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBuildTest_QueueTarget(t *testing.T) {
+	b := NewBuildTest(t)
+	b.AssertParse(&b.state, "build cat3: cat in1\n", ParseManifestOpts{})
+	for _, n := range []string{"cat1", "cat2", "cat3"} {
+		if err := b.builder.QueueTarget(b.GetNode(n)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if b.builder.AlreadyUpToDate() {
+		t.Fatal("queued targets must be scanned")
+	}
+	if err := b.builder.Build(); err != nil {
+		t.Fatal(err)
+	}
+	// Each target is scanned once the command of the previous one started.
+	want := []string{"cat in1 > cat1", "cat in1 in2 > cat2", "cat in1 > cat3"}
+	if diff := cmp.Diff(want, b.commandRunner.commandsRan); diff != "" {
+		t.Fatal(diff)
+	}
+	if b.builder.Progress().Total != 3 {
+		t.Fatal(b.builder.Progress())
+	}
+}
+
+func TestBuildTest_QueueTargetError(t *testing.T) {
+	b := NewBuildTest(t)
+	b.Dirty("in1")
+	if err := b.builder.QueueTarget(b.GetNode("cat1")); err != nil {
+		t.Fatal(err)
+	}
+	var missing *ErrMissingInput
+	if err := b.builder.Build(); !errors.As(err, &missing) {
+		t.Fatal(err)
+	}
+	if len(b.commandRunner.commandsRan) != 0 {
+		t.Fatal(b.commandRunner.commandsRan)
+	}
+}
+
+func TestBuilder_QueueTargetStatCache(t *testing.T) {
+	s := NewStateTestWithBuiltinRules(t)
+	s.AssertParse(&s.state, "build out: cat in\n", ParseManifestOpts{})
+	config := NewBuildConfig()
+	di := &RealDiskInterface{}
+	// Only Windows has a stat cache.
+	di.useCache = true
+	builder := NewBuilder(&s.state, &config, nil, nil, di, &statusFake{}, 0)
+	if err := builder.QueueTarget(s.state.Paths["out"]); err == nil || err.Error() != "the stat cache must be disabled to queue targets" {
+		t.Fatal(err)
+	}
+	di.useCache = false
+	if err := builder.QueueTarget(s.state.Paths["out"]); err != nil {
+		t.Fatal(err)
+	}
+}
+
 // Test that RSP file is created but not removed for commands, which fail
 func TestBuildTest_RspFileFailure(t *testing.T) {
 	b := NewBuildTest(t)
@@ -2404,8 +2944,8 @@ func TestBuildWithLogTest_RspFileCmdLineChange(t *testing.T) {
 	if nil == logEntry {
 		t.Fatal("expected true")
 	}
-	b.AssertHash("cat out.rsp > out;rspfile=Original very long command", logEntry.commandHash)
-	logEntry.commandHash++ // Change the command hash to something else.
+	b.AssertHash("cat out.rsp > out;rspfile=Original very long command", logEntry)
+	logEntry.commandHash128[0]++ // Change the command hash to something else.
 	// Now expect the target to be rebuilt
 	b.commandRunner.commandsRan = nil
 	b.state.Reset()
@@ -2466,10 +3006,7 @@ func TestBuildTest_StatFailureAbortsBuild(t *testing.T) {
 	b.fs.Create("in", "")
 
 	// This simulates a stat failure:
-	b.fs.files[tooLongToStat] = Entry{
-		mtime:     -1,
-		statError: errors.New("stat failed"),
-	}
+	b.fs.SetStatError(tooLongToStat, errors.New("stat failed"))
 
 	if _, err := b.builder.addTargetName(tooLongToStat); err == nil {
 		t.Fatal("expected false")
@@ -2878,8 +3415,8 @@ func TestBuildWithDepsLogTest_Straightforward(t *testing.T) {
 		// Run the build again.
 		depsLog := DepsLog{}
 		defer depsLog.Close()
-		if s, err := depsLog.Load("ninja_deps", &state); s != LoadSuccess || err != nil {
-			t.Fatal(s, err)
+		if err := depsLog.Load("ninja_deps", &state); err != nil {
+			t.Fatal(err)
 		}
 		if err := depsLog.OpenForWrite("ninja_deps"); err != nil {
 			t.Fatal(err)
@@ -2959,8 +3496,8 @@ func TestBuildWithDepsLogTest_ObsoleteDeps(t *testing.T) {
 
 		depsLog := DepsLog{}
 		defer depsLog.Close()
-		if s, err := depsLog.Load("ninja_deps", &state); s != LoadSuccess || err != nil {
-			t.Fatal(s, err)
+		if err := depsLog.Load("ninja_deps", &state); err != nil {
+			t.Fatal(err)
 		}
 		if err := depsLog.OpenForWrite("ninja_deps"); err != nil {
 			t.Fatal(err)
@@ -3083,8 +3620,8 @@ func TestBuildWithDepsLogTest_RestatDepfileDependencyDepsLog(t *testing.T) {
 		// Run the build again.
 		depsLog := DepsLog{}
 		defer depsLog.Close()
-		if s, err := depsLog.Load("ninja_deps", &state); s != LoadSuccess || err != nil {
-			t.Fatal(s, err)
+		if err := depsLog.Load("ninja_deps", &state); err != nil {
+			t.Fatal(err)
 		}
 		if err := depsLog.OpenForWrite("ninja_deps"); err != nil {
 			t.Fatal(err)
@@ -3147,8 +3684,8 @@ func TestBuildWithDepsLogTest_DepFileOKDepsLog(t *testing.T) {
 
 		depsLog := DepsLog{}
 		defer depsLog.Close()
-		if s, err := depsLog.Load("ninja_deps", &state); s != LoadSuccess || err != nil {
-			t.Fatal(s, err)
+		if err := depsLog.Load("ninja_deps", &state); err != nil {
+			t.Fatal(err)
 		}
 		if err := depsLog.OpenForWrite("ninja_deps"); err != nil {
 			t.Fatal(err)
@@ -3233,8 +3770,8 @@ func TestBuildWithDepsLogTest_DiscoveredDepDuringBuildChanged(t *testing.T) {
 
 		depsLog := DepsLog{}
 		defer depsLog.Close()
-		if s, err := depsLog.Load("ninja_deps", &state); s != LoadSuccess || err != nil {
-			t.Fatal(s, err)
+		if err := depsLog.Load("ninja_deps", &state); err != nil {
+			t.Fatal(err)
 		}
 		if err := depsLog.OpenForWrite("ninja_deps"); err != nil {
 			t.Fatal(err)
@@ -3268,8 +3805,8 @@ func TestBuildWithDepsLogTest_DiscoveredDepDuringBuildChanged(t *testing.T) {
 
 		depsLog := DepsLog{}
 		defer depsLog.Close()
-		if s, err := depsLog.Load("ninja_deps", &state); s != LoadSuccess || err != nil {
-			t.Fatal(s, err)
+		if err := depsLog.Load("ninja_deps", &state); err != nil {
+			t.Fatal(err)
 		}
 		if err := depsLog.OpenForWrite("ninja_deps"); err != nil {
 			t.Fatal(err)
@@ -3330,8 +3867,8 @@ func TestBuildWithDepsLogTest_DepFileDepsLogCanonicalize(t *testing.T) {
 
 		depsLog := DepsLog{}
 		defer depsLog.Close()
-		if s, err := depsLog.Load("ninja_deps", &state); s != LoadSuccess || err != nil {
-			t.Fatal(s, err)
+		if err := depsLog.Load("ninja_deps", &state); err != nil {
+			t.Fatal(err)
 		}
 		if err := depsLog.OpenForWrite("ninja_deps"); err != nil {
 			t.Fatal(err)
@@ -4278,8 +4815,8 @@ func TestBuildWithDepsLogTest_ValidationThroughDepfile(t *testing.T) {
 		b.AssertParse(&state, manifest, ParseManifestOpts{})
 
 		depsLog := DepsLog{}
-		if s, err := depsLog.Load("ninja_deps", &state); s != LoadSuccess || err != nil {
-			t.Fatal(s, err)
+		if err := depsLog.Load("ninja_deps", &state); err != nil {
+			t.Fatal(err)
 		}
 		if err := depsLog.OpenForWrite("ninja_deps"); err != nil {
 			t.Fatal(err)
@@ -4378,3 +4915,34 @@ func TestBuildTest_ValidationWithCircularDependency(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestBuilder_CancelGraceExpired(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses sleep")
+	}
+	CreateTempDirAndEnter(t)
+	s := NewStateTestWithBuiltinRules(t)
+	s.AssertParse(&s.state, "rule fail\n  command = false\nrule slow\n  command = sleep 20 && touch $out\nbuild out1: fail\nbuild out2: slow\nbuild all: phony out1 out2\n", ParseManifestOpts{})
+	config := NewBuildConfig()
+	config.Parallelism = 2
+	config.CancelGrace = 100 * time.Millisecond
+	var finished []string
+	builder := NewBuilder(&s.state, &config, nil, nil, &RealDiskInterface{}, &statusFake{}, 0)
+	builder.Hooks.AfterEdge = func(r *Result, start, end int32) {
+		finished = append(finished, fmt.Sprintf("%s %d", r.Edge.Outputs[0].Path, r.ExitCode))
+	}
+	if _, err := builder.addTargetName("all"); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	err := builder.Build()
+	if d := time.Since(start); d > 10*time.Second {
+		t.Fatalf("the slow command wasn't canceled: %s", d)
+	}
+	if err == nil || err.Error() != "subcommand failed; canceled the commands still running 100ms after the failure" {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"out1 1"}, finished); diff != "" {
+		t.Fatal(diff)
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"context"
+	"errors"
+)
+
+// EdgeResult is an item streamed by Builder.Run.
+type EdgeResult struct {
+	// Edge is the edge that completed. It is nil for the last item.
+	Edge            *Edge
+	ExitCode        ExitStatus
+	Output          string
+	StartTimeMillis int32
+	EndTimeMillis   int32
+	// Progress is the progress of the build once Edge completed.
+	Progress ProgressSnapshot
+	// Err is the error returned by the build. It is only set on the last item.
+	Err error
+}
+
+// Run starts the build in a new goroutine and streams the result of each
+// edge as it completes.
+//
+// The results are sent between the steps of the build, with the state
+// unlocked so the consumer can call State.View. The build blocks
+// until they are received, so a slow consumer slows down the build instead of
+// buffering results. The last item has a nil Edge,
+// the final progress and the build error, if any; the channel is closed
+// afterward. The caller must receive from the channel until it is closed.
+//
+// Cancelling ctx interrupts the running commands and no new command is
+// started; the last item's Err is then ctx.Err().
+//
+// Run wraps Hooks and the Status; they must not be modified until the channel
+// is closed. It is an error to call this function when AlreadyUpToDate() is
+// true.
+func (b *Builder) Run(ctx context.Context) (<-chan EdgeResult, error) {
+	if b.AlreadyUpToDate() {
+		return nil, errors.New("already up to date")
+	}
+	ch := make(chan EdgeResult)
+	s := &runStatus{Status: b.status, b: b, ch: ch}
+	b.status = s
+	hooks := b.Hooks
+	b.Hooks.BeforeEdge = func(edge *Edge) EdgeDecision {
+		if err := ctx.Err(); err != nil {
+			return EdgeDecision{Err: err}
+		}
+		if hooks.BeforeEdge != nil {
+			return hooks.BeforeEdge(edge)
+		}
+		return EdgeDecision{}
+	}
+	b.Hooks.AfterEdge = func(result *Result, startTimeMillis, endTimeMillis int32) {
+		if hooks.AfterEdge != nil {
+			hooks.AfterEdge(result, startTimeMillis, endTimeMillis)
+		}
+		s.pending = EdgeResult{
+			Edge:            result.Edge,
+			ExitCode:        result.ExitCode,
+			Output:          result.Output,
+			StartTimeMillis: startTimeMillis,
+			EndTimeMillis:   endTimeMillis,
+		}
+	}
+
+	b.unlocked = s.flush
+
+	b.setupCommandRunner()
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			if r, ok := b.commandRunner.(*realCommandRunner); ok {
+				r.subprocs.cancel()
+			}
+		case <-done:
+		}
+	}()
+	go func() {
+		err := b.Build()
+		close(done)
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		s.flush()
+		ch <- EdgeResult{Progress: b.Progress(), Err: err}
+		b.status = s.Status
+		b.Hooks = hooks
+		b.unlocked = nil
+		close(ch)
+	}()
+	return ch, nil
+}
+
+// runStatus queues the result recorded by Hooks.AfterEdge once the builder
+// updated its progress. The queue is sent by flush, as the state is locked
+// while the status is called.
+type runStatus struct {
+	Status
+	b       *Builder
+	ch      chan<- EdgeResult
+	pending EdgeResult
+	queue   []EdgeResult
+}
+
+func (r *runStatus) BuildEdgeFinished(edge *Edge, endTimeMillis int32, success bool, output string) {
+	r.Status.BuildEdgeFinished(edge, endTimeMillis, success, output)
+	res := r.pending
+	r.pending = EdgeResult{}
+	res.Progress = r.b.Progress()
+	r.queue = append(r.queue, res)
+}
+
+// flush sends the queued results. It must be called with the state unlocked.
+func (r *runStatus) flush() {
+	for _, res := range r.queue {
+		r.ch <- res
+	}
+	r.queue = r.queue[:0]
+}
@@ -0,0 +1,125 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestBuildTest_Run(t *testing.T) {
+	b := NewBuildTest(t)
+	afterEdge := 0
+	b.builder.Hooks.AfterEdge = func(result *Result, startTimeMillis, endTimeMillis int32) {
+		afterEdge++
+	}
+	if _, err := b.builder.addTargetName("cat12"); err != nil {
+		t.Fatal(err)
+	}
+	ch, err := b.builder.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	var last EdgeResult
+	for r := range ch {
+		if r.Edge == nil {
+			last = r
+			continue
+		}
+		if r.ExitCode != ExitSuccess || r.Err != nil {
+			t.Fatal(r)
+		}
+		got = append(got, r.Edge.Outputs[0].Path)
+		if r.Progress.Finished != len(got) || r.Progress.Total != 3 {
+			t.Fatal(r.Progress)
+		}
+	}
+	if diff := cmp.Diff([]string{"cat1", "cat2", "cat12"}, got); diff != "" {
+		t.Fatal(diff)
+	}
+	if last.Err != nil || last.Progress.Finished != 3 {
+		t.Fatal(last)
+	}
+	if afterEdge != 3 {
+		t.Fatal(afterEdge)
+	}
+	if b.builder.Hooks.BeforeEdge != nil || b.builder.status != b.status {
+		t.Fatal("Run didn't restore the hooks and the status")
+	}
+}
+
+func TestBuildTest_RunCancel(t *testing.T) {
+	b := NewBuildTest(t)
+	if _, err := b.builder.addTargetName("cat12"); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, err := b.builder.Run(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var last EdgeResult
+	for r := range ch {
+		// Cancel as soon as the first edge completed.
+		cancel()
+		last = r
+	}
+	if last.Edge != nil || last.Err != context.Canceled {
+		t.Fatal(last)
+	}
+	if len(b.commandRunner.commandsRan) == 3 {
+		t.Fatal(b.commandRunner.commandsRan)
+	}
+}
+
+func TestBuildTest_RunView(t *testing.T) {
+	b := NewBuildTest(t)
+	if _, err := b.builder.addTargetName("cat12"); err != nil {
+		t.Fatal(err)
+	}
+	ch, err := b.builder.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	var got []string
+	go func() {
+		defer close(done)
+		for r := range ch {
+			if r.Edge == nil {
+				continue
+			}
+			// The state must not be locked while the result is received.
+			b.state.View(func() {
+				if r.Edge.OutputsReady {
+					got = append(got, r.Edge.Outputs[0].Path)
+				}
+			})
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("deadlock")
+	}
+	if diff := cmp.Diff([]string{"cat1", "cat2", "cat12"}, got); diff != "" {
+		t.Fatal(diff)
+	}
+}
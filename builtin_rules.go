@@ -0,0 +1,208 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Builtin rules are run by the builder itself through its FileSystem instead
+// of spawning a process, which matters in graphs with many of them, e.g.
+// stamp files or copied assets.
+//
+// A builtin rule is used by the edges referring to its name when the manifest
+// doesn't define a rule with the same name, so the manifests defining their
+// own, like the ones generated by GN, keep using theirs. The command of a
+// builtin rule is only used for display and for the build log.
+var (
+	// StampRule groups its inputs like phony, but it also writes its outputs
+	// as empty files.
+	StampRule = newBuiltinRule("stamp", "touch", false)
+	// CopyRule copies each explicit input to the corresponding explicit
+	// output, preserving the file mode. The outputs get a new mtime.
+	CopyRule = newBuiltinRule("copy", "cp", false)
+	// HardlinkRule hard links each explicit input to the corresponding
+	// explicit output. It falls back to copying when the link fails, e.g.
+	// across devices.
+	//
+	// The outputs have the mtime of their input, so the rule has restat set
+	// and relinking an unchanged input doesn't rebuild the dependent edges.
+	HardlinkRule = newBuiltinRule("hardlink", "ln -f", true)
+	// SymlinkRule creates each explicit output as a relative symbolic link to
+	// the corresponding explicit input. It falls back to copying when
+	// symbolic links are not supported, like HardlinkRule.
+	SymlinkRule = newBuiltinRule("symlink", "ln -sf", true)
+)
+
+var builtinRules = map[string]*Rule{
+	StampRule.Name:    StampRule,
+	CopyRule.Name:     CopyRule,
+	HardlinkRule.Name: HardlinkRule,
+	SymlinkRule.Name:  SymlinkRule,
+}
+
+func newBuiltinRule(name, program string, restat bool) *Rule {
+	r := NewRule(name)
+	if name == "stamp" {
+		r.Bindings["command"] = &EvalString{Parsed: []EvalStringToken{{Value: program + " "}, {Value: "out", IsSpecial: true}}}
+	} else {
+		r.Bindings["command"] = &EvalString{Parsed: []EvalStringToken{{Value: program + " "}, {Value: "in", IsSpecial: true}, {Value: " "}, {Value: "out", IsSpecial: true}}}
+	}
+	if restat {
+		r.Bindings["restat"] = &EvalString{Parsed: []EvalStringToken{{Value: "1"}}}
+	}
+	return r
+}
+
+// lookupRule returns the rule name in env, or the builtin rule with this name
+// if not defined and the extensions are enabled.
+func lookupRule(env *BindingEnv, name string, disableExtensions bool) *Rule {
+	r := env.LookupRule(name)
+	if r == nil && !disableExtensions {
+		r = builtinRules[name]
+	}
+	return r
+}
+
+// isBuiltinRule returns true if r is run by the builder.
+func isBuiltinRule(r *Rule) bool {
+	return builtinRules[r.Name] == r
+}
+
+// fileCopier is implemented by the FileSystem supporting links and copying
+// files along their mode. The builtin rules fall back to ReadFile and
+// WriteFile otherwise.
+type fileCopier interface {
+	Link(oldname, newname string) error
+	Symlink(oldname, newname string) error
+	CopyFile(src, dst string) error
+}
+
+// runBuiltin runs the builtin rule of edge and returns its result.
+func (b *Builder) runBuiltin(edge *Edge) Result {
+	r := Result{Edge: edge}
+	if b.config.DryRun {
+		return r
+	}
+	defer metricRecord("builtin " + edge.Rule.Name)()
+	if err := runBuiltinRule(b.di, edge); err != nil {
+		r.ExitCode = ExitFailure
+		r.Output = err.Error()
+	}
+	return r
+}
+
+// runBuiltinRule writes the outputs of edge, which uses a builtin rule.
+func runBuiltinRule(di FileSystem, edge *Edge) error {
+	for _, o := range edge.Outputs {
+		if err := MakeDirs(di, o.Path); err != nil {
+			return err
+		}
+	}
+	if edge.Rule == StampRule {
+		for _, o := range edge.Outputs {
+			if err := di.WriteFile(o.Path, ""); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	explicitIns := len(edge.Inputs) - int(edge.ImplicitDeps) - int(edge.OrderOnlyDeps)
+	explicitOuts := len(edge.Outputs) - int(edge.ImplicitOuts)
+	if explicitIns != explicitOuts {
+		return fmt.Errorf("%s needs as many explicit inputs as explicit outputs, got %d and %d", edge.Rule.Name, explicitIns, explicitOuts)
+	}
+	c, _ := di.(fileCopier)
+	for i, o := range edge.Outputs[:explicitOuts] {
+		src := edge.Inputs[i].Path
+		// Replace the previous output, which may be a link to the input.
+		if err := di.RemoveFile(o.Path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if c != nil {
+			var err error
+			switch edge.Rule {
+			case HardlinkRule:
+				err = c.Link(src, o.Path)
+			case SymlinkRule:
+				target, err2 := filepath.Rel(filepath.Dir(o.Path), src)
+				if err2 != nil {
+					target = src
+				}
+				err = c.Symlink(target, o.Path)
+			default:
+				err = c.CopyFile(src, o.Path)
+			}
+			if err == nil {
+				continue
+			}
+			if edge.Rule == CopyRule {
+				return err
+			}
+			// Fall back to a copy.
+			if err := c.CopyFile(src, o.Path); err != nil {
+				return err
+			}
+			continue
+		}
+		content, err := di.ReadFile(src)
+		if err != nil {
+			return err
+		}
+		if len(content) != 0 {
+			// Strip the trailing zero byte.
+			content = content[:len(content)-1]
+		}
+		if err := di.WriteFile(o.Path, string(content)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Link implements fileCopier.
+func (r *RealDiskInterface) Link(oldname, newname string) error {
+	return os.Link(oldname, newname)
+}
+
+// Symlink implements fileCopier.
+func (r *RealDiskInterface) Symlink(oldname, newname string) error {
+	return os.Symlink(oldname, newname)
+}
+
+// CopyFile implements fileCopier. It copies the file mode.
+func (r *RealDiskInterface) CopyFile(src, dst string) error {
+	s, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	fi, err := s.Stat()
+	if err != nil {
+		return err
+	}
+	d, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(d, s)
+	if err2 := d.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
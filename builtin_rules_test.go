@@ -0,0 +1,147 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestBuiltinRules_Parse(t *testing.T) {
+	s := NewStateTestWithBuiltinRules(t)
+	s.AssertParse(&s.state, "nin_features = stamp\nbuild a.stamp: stamp in\n", ParseManifestOpts{})
+	e := s.state.Edges[0]
+	if e.Rule != StampRule {
+		t.Fatal(e.Rule.Name)
+	}
+	if got := e.EvaluateCommand(false); got != "touch a.stamp" {
+		t.Fatal(got)
+	}
+	s.AssertParse(&s.state, "nin_features = hardlink\nbuild b: hardlink a\n", ParseManifestOpts{})
+	if e := s.state.Edges[1]; e.Rule != HardlinkRule || e.EvaluateCommand(false) != "ln -f a b" || e.GetBinding("restat") == "" {
+		t.Fatal(e.EvaluateCommand(false))
+	}
+
+	// A rule defined by the manifest has precedence.
+	s = NewStateTestWithBuiltinRules(t)
+	s.AssertParse(&s.state, "rule stamp\n  command = touch $out\nbuild a.stamp: stamp in\n", ParseManifestOpts{})
+	if s.state.Edges[0].Rule == StampRule {
+		t.Fatal("expected the manifest's rule")
+	}
+
+	for _, c := range []ParseManifestConcurrency{ParseManifestSerial, ParseManifestConcurrentParsing} {
+		state := NewState()
+		fs := NewVirtualFileSystem()
+		err := ParseManifest(&state, &fs, ParseManifestOpts{DisableExtensions: true, Concurrency: c}, "build.ninja", []byte("build a.stamp: stamp in\n\x00"))
+		if err == nil || !strings.Contains(err.Error(), "unknown build rule 'stamp'") {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestBuildTest_Stamp(t *testing.T) {
+	b := NewBuildTest(t)
+	b.AssertParse(&b.state, "nin_features = stamp\nbuild dir/a.stamp: stamp in1\nbuild out: cat dir/a.stamp\n", ParseManifestOpts{})
+	b.fs.Create("in1", "")
+	if _, err := b.builder.addTargetName("out"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.builder.Build(); err != nil {
+		t.Fatal(err)
+	}
+	// No command was spawned for the stamp.
+	if len(b.commandRunner.commandsRan) != 1 || b.commandRunner.commandsRan[0] != "cat dir/a.stamp > out" {
+		t.Fatal(b.commandRunner.commandsRan)
+	}
+	if mtime, _ := b.fs.Stat("dir/a.stamp"); mtime <= 0 {
+		t.Fatal(mtime)
+	}
+	if b.builder.Progress().Finished != 2 {
+		t.Fatal(b.builder.Progress())
+	}
+}
+
+func TestBuildTest_Copy(t *testing.T) {
+	b := NewBuildTest(t)
+	b.AssertParse(&b.state, "nin_features = copy\nbuild out/a out/b: copy in1 in2 | in3\nbuild bad: copy in1 in2\n", ParseManifestOpts{})
+	b.fs.Create("in1", "one")
+	b.fs.Create("in2", "two")
+	b.fs.Create("in3", "")
+	if _, err := b.builder.addTargetName("out/a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.builder.Build(); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.commandRunner.commandsRan) != 0 {
+		t.Fatal(b.commandRunner.commandsRan)
+	}
+	for p, want := range map[string]string{"out/a": "one", "out/b": "two"} {
+		if c, err := b.fs.ReadFile(p); err != nil || string(c[:len(c)-1]) != want {
+			t.Fatal(p, string(c), err)
+		}
+	}
+
+	e := b.state.Paths["bad"].InEdge
+	if err := runBuiltinRule(&b.fs, e); err == nil || err.Error() != "copy needs as many explicit inputs as explicit outputs, got 2 and 1" {
+		t.Fatal(err)
+	}
+}
+
+func TestBuiltinRules_Disk(t *testing.T) {
+	CreateTempDirAndEnter(t)
+	if err := ioutil.WriteFile("src", []byte("content"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	s := NewStateTestWithBuiltinRules(t)
+	s.AssertParse(&s.state, "nin_features = copy hardlink symlink\nbuild out/c: copy src\nbuild out/h: hardlink src\nbuild out/s: symlink src\n", ParseManifestOpts{})
+	di := RealDiskInterface{}
+	for _, e := range s.state.Edges {
+		// Twice, to replace the previous output.
+		for i := 0; i < 2; i++ {
+			if err := runBuiltinRule(&di, e); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if c, err := ioutil.ReadFile(e.Outputs[0].Path); err != nil || string(c) != "content" {
+			t.Fatal(e.Outputs[0].Path, string(c), err)
+		}
+	}
+	src, err := os.Stat("src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat("out/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if os.SameFile(src, fi) {
+		t.Fatal("expected a copy")
+	}
+	if runtime.GOOS != "windows" && fi.Mode() != src.Mode() {
+		t.Fatal(fi.Mode())
+	}
+	if fi, err = os.Stat("out/h"); err != nil || !os.SameFile(src, fi) {
+		t.Fatal("expected a hard link", err)
+	}
+	if runtime.GOOS != "windows" {
+		if l, err := os.Readlink("out/s"); err != nil || l != "../src" {
+			t.Fatal(l, err)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// InputClosure returns the source files needed to build targets, sorted.
+//
+// These are the inputs not generated by any edge, including the implicit and
+// order-only ones and the dependencies recorded in depsLog, e.g. the headers
+// discovered by the compiler, plus the manifest files. depsLog may be nil.
+//
+// The dependencies only listed in depfiles not yet loaded in the deps log are
+// not included, so build the targets once before bundling them. Call
+// LoadScannedIncludes() first to include the headers of the edges with
+// "scan = cpp".
+func (s *State) InputClosure(targets []*Node, depsLog *DepsLog) []string {
+	seen := map[*Node]struct{}{}
+	files := map[string]struct{}{}
+	var visit func(n *Node)
+	visit = func(n *Node) {
+		if _, ok := seen[n]; ok {
+			return
+		}
+		seen[n] = struct{}{}
+		if n.InEdge == nil {
+			files[n.Path] = struct{}{}
+			return
+		}
+		for _, in := range n.InEdge.Inputs {
+			visit(in)
+		}
+		if depsLog != nil {
+			for _, o := range n.InEdge.Outputs {
+				if deps := depsLog.GetDeps(o); deps != nil {
+					for _, d := range deps.Nodes {
+						visit(d)
+					}
+				}
+			}
+		}
+	}
+	for _, t := range targets {
+		visit(t)
+	}
+	for _, m := range s.ManifestFiles {
+		files[m] = struct{}{}
+	}
+	out := make([]string, 0, len(files))
+	for f := range files {
+		out = append(out, f)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// WriteBundle writes the files in paths to w as a tar archive.
+//
+// The missing files are skipped and returned, e.g. the phony inputs that are
+// not files. Symlinks are archived as such.
+func WriteBundle(w io.Writer, paths []string) ([]string, error) {
+	var missing []string
+	t := tar.NewWriter(w)
+	for _, p := range paths {
+		fi, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			missing = append(missing, p)
+			continue
+		} else if err != nil {
+			return missing, err
+		}
+		link := ""
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return missing, err
+			}
+		} else if !fi.Mode().IsRegular() {
+			// Directories are created implicitly by the files in them.
+			continue
+		}
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return missing, err
+		}
+		hdr.Name = filepath.ToSlash(p)
+		if err := t.WriteHeader(hdr); err != nil {
+			return missing, err
+		}
+		if link != "" {
+			continue
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return missing, err
+		}
+		_, err = io.Copy(t, f)
+		_ = f.Close()
+		if err != nil {
+			return missing, err
+		}
+	}
+	return missing, t.Close()
+}
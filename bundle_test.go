@@ -0,0 +1,76 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestState_InputClosure(t *testing.T) {
+	s := NewStateTestWithBuiltinRules(t)
+	s.AssertParse(&s.state,
+		"build gen.h: cat gen.in\n"+
+			"build a.o: cat a.c | b.h || gen.h\n"+
+			"build other: cat o\n"+
+			"build all: phony a.o\n",
+		ParseManifestOpts{})
+	s.state.ManifestFiles = []string{"sub.ninja"}
+	d := DepsLog{}
+	if err := d.OpenForWrite(filepath.Join(t.TempDir(), ".ninja_deps")); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if err := d.recordDeps(s.state.Paths["a.o"], 1, []*Node{s.state.GetNode("h.h", 0), s.state.Paths["gen.h"]}); err != nil {
+		t.Fatal(err)
+	}
+	got := s.state.InputClosure([]*Node{s.state.Paths["all"]}, &d)
+	want := []string{"a.c", "b.h", "gen.in", "h.h", "sub.ninja"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestWriteBundle(t *testing.T) {
+	CreateTempDirAndEnter(t)
+	if err := ioutil.WriteFile("a.c", []byte("int a;\n"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	missing, err := WriteBundle(&b, []string{"a.c", "missing.h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"missing.h"}, missing); diff != "" {
+		t.Fatal(diff)
+	}
+	r := tar.NewReader(&b)
+	hdr, err := r.Next()
+	if err != nil || hdr.Name != "a.c" {
+		t.Fatal(hdr, err)
+	}
+	if c, err := ioutil.ReadAll(r); err != nil || string(c) != "int a;\n" {
+		t.Fatal(string(c), err)
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"os"
+)
+
+// logChecksumSignature is the content of the checksum file of a log.
+const logChecksumSignature = "# nin checksum v1\n%d %08x\n"
+
+// logChecksum is the CRC-32 of a log when it was last closed.
+//
+// The checksum is stored in a separate file, see checksumPath, so the logs
+// stay readable by ninja. Since the logs are append-only, it covers the first
+// size bytes of the log; anything appended afterward, e.g. by an interrupted
+// build, is only validated by parsing it.
+type logChecksum struct {
+	size int64
+	crc  uint32
+	// valid is false when the content of the log is not fully known, e.g. it
+	// was appended to without being loaded first.
+	valid bool
+}
+
+// reset sets the checksum to the one of data.
+func (c *logChecksum) reset(data []byte) {
+	c.size = int64(len(data))
+	c.crc = crc32.ChecksumIEEE(data)
+	c.valid = true
+}
+
+// Write updates the checksum with data appended to the log.
+func (c *logChecksum) Write(p []byte) (int, error) {
+	c.size += int64(len(p))
+	c.crc = crc32.Update(c.crc, crc32.IEEETable, p)
+	return len(p), nil
+}
+
+// save writes the checksum file for the log at path, or removes it when the
+// checksum is not valid. It does nothing when fs is nil.
+func (c *logChecksum) save(fs FileSystem, path string) error {
+	if fs == nil {
+		return nil
+	}
+	p := checksumPath(path)
+	if !c.valid {
+		if err := fs.RemoveFile(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return fs.WriteFile(p, fmt.Sprintf(logChecksumSignature, c.size, c.crc))
+}
+
+// checksumFS returns the file system to use for the checksum file of a log,
+// or nil when the checksum file is disabled.
+func checksumFS(fs FileSystem, disabled bool) FileSystem {
+	if disabled {
+		return nil
+	}
+	if fs == nil {
+		return &RealDiskInterface{}
+	}
+	return fs
+}
+
+// checksumPath returns the path of the checksum file of the log at path.
+func checksumPath(path string) string {
+	return path + ".sum"
+}
+
+// verifyLogChecksum verifies that data, the content of the log at path,
+// matches its checksum file.
+//
+// It is not an error if there's no checksum file or if fs is nil. If the log
+// was modified after the checksum file was written, the log was rewritten by
+// another tool, e.g. a ninja recompaction, and a mismatch is ignored.
+func verifyLogChecksum(fs FileSystem, path string, data []byte) error {
+	if fs == nil {
+		return nil
+	}
+	p := checksumPath(path)
+	raw, err := fs.ReadFile(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	c := logChecksum{}
+	if _, err := fmt.Sscanf(string(bytes.TrimRight(raw, "\x00")), logChecksumSignature, &c.size, &c.crc); err != nil {
+		return fmt.Errorf("%s: invalid checksum file", p)
+	}
+	if c.size <= int64(len(data)) && crc32.ChecksumIEEE(data[:c.size]) == c.crc {
+		return nil
+	}
+	if rewrittenAfter(fs, path, p) {
+		return nil
+	}
+	if c.size > int64(len(data)) {
+		return fmt.Errorf("%s: truncated to %d bytes, expected at least %d", path, len(data), c.size)
+	}
+	return fmt.Errorf("%s: checksum mismatch, the file is corrupted", path)
+}
+
+// rewrittenAfter returns true if the file at path was modified after the
+// one at ref.
+func rewrittenAfter(fs FileSystem, path, ref string) bool {
+	t1, err1 := fs.Stat(path)
+	t2, err2 := fs.Stat(ref)
+	return err1 == nil && err2 == nil && t1 > 0 && t2 > 0 && t1 > t2
+}
+
+// removeLog removes a log and its checksum file, if fs is not nil.
+func removeLog(fs FileSystem, path string) {
+	_ = os.Remove(path)
+	if fs != nil {
+		_ = fs.RemoveFile(checksumPath(path))
+	}
+}
@@ -0,0 +1,285 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// corruptLog flips a byte of the file at path without changing its
+// modification time, like a disk error would.
+func corruptLog(t *testing.T, path string, offset int) {
+	s, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[offset] ^= 0x40
+	if err := ioutil.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, s.ModTime(), s.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChecksum_BuildLog(t *testing.T) {
+	b := NewBuildLogTest(t)
+	b.AssertParse(&b.state, "build out: cat in\nbuild out2: cat in\n", ParseManifestOpts{})
+	testFilename := filepath.Join(t.TempDir(), "BuildLogTest-tempfile")
+
+	log1 := NewBuildLog()
+	if err := log1.OpenForWrite(testFilename, b); err != nil {
+		t.Fatal(err)
+	}
+	if err := log1.RecordCommand(b.state.Edges[0], 1, 2, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := log1.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyBuildLog(testFilename); err != nil {
+		t.Fatal(err)
+	}
+
+	// Appending keeps the checksum valid.
+	log2 := NewBuildLog()
+	if err := log2.Load(testFilename); err != nil {
+		t.Fatal(err)
+	}
+	if err := log2.OpenForWrite(testFilename, b); err != nil {
+		t.Fatal(err)
+	}
+	if err := log2.RecordCommand(b.state.Edges[1], 4, 5, 6); err != nil {
+		t.Fatal(err)
+	}
+	if err := log2.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyBuildLog(testFilename); err != nil {
+		t.Fatal(err)
+	}
+
+	// A corrupted log is detected and discarded.
+	corruptLog(t, testFilename, 20)
+	if err := VerifyBuildLog(testFilename); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatal(err)
+	}
+	log3 := NewBuildLog()
+	if err := log3.Load(testFilename); !errors.Is(err, &ErrLogDiscarded{}) {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(testFilename); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(checksumPath(testFilename)); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+}
+
+func TestChecksum_RewrittenByAnotherTool(t *testing.T) {
+	testFilename := filepath.Join(t.TempDir(), "BuildLogTest-tempfile")
+	if err := ioutil.WriteFile(testFilename, []byte("# ninja log v5\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	sum := logChecksum{}
+	sum.reset([]byte("# ninja log v5\n1\t2\t3\tout\t1\n"))
+	if err := sum.save(&RealDiskInterface{}, testFilename); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyBuildLog(testFilename); err == nil || !strings.Contains(err.Error(), "truncated") {
+		t.Fatal(err)
+	}
+	// If the log was modified after the checksum file, it was rewritten and
+	// the checksum is ignored.
+	s, err := os.Stat(checksumPath(testFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	later := s.ModTime().Add(time.Second)
+	if err := os.Chtimes(testFilename, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyBuildLog(testFilename); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChecksum_VerifyBuildLog(t *testing.T) {
+	testFilename := filepath.Join(t.TempDir(), "BuildLogTest-tempfile")
+	data := []struct {
+		content string
+		err     string
+	}{
+		{"# ninja log v4\n1\t2\t3\tout\tcommand\n", ""},
+		{"# ninja log v6\n1\t2\t3\tout\t31073324752752b9c488d5726b3904d9\tcat in > out\n", ""},
+		{"# ninja log v6\n1\t2\t3\tout\t31073324752752b9c488d5726b3904d9\tcat in > out2\n", ":2: command hash mismatch"},
+		{"# ninja log v5\n1\t2\t3\tout\t1\n4\t5\t6", ":3: incomplete last line"},
+		{"# ninja log v5\n1\t2\tout\t1\n", ":2: expected 5 fields"},
+		{"# ninja log v9\n", "unsupported version 9"},
+		{"garbage\n", "invalid header"},
+	}
+	for i, l := range data {
+		if err := ioutil.WriteFile(testFilename, []byte(l.content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		err := VerifyBuildLog(testFilename)
+		if l.err == "" {
+			if err != nil {
+				t.Fatalf("#%d: %s", i, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), l.err) {
+			t.Fatalf("#%d: want %q; got %v", i, l.err, err)
+		}
+	}
+}
+
+func TestChecksum_DepsLog(t *testing.T) {
+	testFilename := filepath.Join(t.TempDir(), "DepsLogTest-tempfile")
+	state1 := NewState()
+	log1 := DepsLog{}
+	if err := log1.OpenForWrite(testFilename); err != nil {
+		t.Fatal(err)
+	}
+	if err := log1.recordDeps(state1.GetNode("out", 0), 1, []*Node{state1.GetNode("in", 0)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := log1.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyDepsLog(testFilename); err != nil {
+		t.Fatal(err)
+	}
+
+	// Recompaction keeps the checksum valid.
+	state2 := NewState()
+	log2 := DepsLog{}
+	if err := log2.Load(testFilename, &state2); err != nil {
+		t.Fatal(err)
+	}
+	if err := log2.Recompact(testFilename); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyDepsLog(testFilename); err != nil {
+		t.Fatal(err)
+	}
+
+	corruptLog(t, testFilename, 3)
+	if err := VerifyDepsLog(testFilename); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatal(err)
+	}
+	state3 := NewState()
+	log3 := DepsLog{}
+	if err := log3.Load(testFilename, &state3); !errors.Is(err, &ErrLogDiscarded{}) {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(testFilename); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+}
+
+func TestChecksum_VerifyDepsLog(t *testing.T) {
+	testFilename := filepath.Join(t.TempDir(), "DepsLogTest-tempfile")
+	if err := ioutil.WriteFile(testFilename, depsLogGolden, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyDepsLog(testFilename); err != nil {
+		t.Fatal(err)
+	}
+	data := append([]byte{}, depsLogGolden...)
+	copy(data[len(data)-4:], "\x07\x00\x00\x00")
+	if err := ioutil.WriteFile(testFilename, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyDepsLog(testFilename); err == nil || !strings.Contains(err.Error(), "deps input id 7 is out of bounds") {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(testFilename, data[:len(data)-2], 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyDepsLog(testFilename); err == nil || !strings.Contains(err.Error(), "premature end of file") {
+		t.Fatal(err)
+	}
+}
+
+func TestChecksum_NoChecksum(t *testing.T) {
+	b := NewBuildLogTest(t)
+	b.AssertParse(&b.state, "build out: cat in\n", ParseManifestOpts{})
+	testFilename := filepath.Join(t.TempDir(), "BuildLogTest-tempfile")
+
+	log1 := NewBuildLog()
+	log1.NoChecksum = true
+	if err := log1.OpenForWrite(testFilename, b); err != nil {
+		t.Fatal(err)
+	}
+	if err := log1.RecordCommand(b.state.Edges[0], 1, 2, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := log1.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := log1.Recompact(testFilename, b); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(checksumPath(testFilename)); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+
+	// A checksum file left by a previous run is ignored.
+	if err := ioutil.WriteFile(checksumPath(testFilename), []byte("# nin checksum v1\n1 00000000\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	log2 := NewBuildLog()
+	log2.NoChecksum = true
+	if err := log2.Load(testFilename); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChecksum_ChecksumFS(t *testing.T) {
+	state := NewState()
+	testFilename := filepath.Join(t.TempDir(), "DepsLogTest-tempfile")
+	fs := NewVirtualFileSystem()
+	log1 := DepsLog{ChecksumFS: &fs}
+	if err := log1.OpenForWrite(testFilename); err != nil {
+		t.Fatal(err)
+	}
+	if err := log1.recordDeps(state.GetNode("out", 0), 1, []*Node{state.GetNode("in", 0)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := log1.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(checksumPath(testFilename)); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	if got := fs.FilesCreated(); len(got) != 1 || got[0] != checksumPath(testFilename) {
+		t.Fatal(got)
+	}
+	state2 := NewState()
+	log2 := DepsLog{ChecksumFS: &fs}
+	if err := log2.Load(testFilename, &state2); err != nil {
+		t.Fatal(err)
+	}
+}
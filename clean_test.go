@@ -670,8 +670,8 @@ func TestCleanDeadTest_CleanDead(t *testing.T) {
 	log1.Close()
 
 	log2 := NewBuildLog()
-	if s, err := log2.Load(testFilename); s != LoadSuccess || err != nil {
-		t.Fatal(s, err)
+	if err := log2.Load(testFilename); err != nil {
+		t.Fatal(err)
 	}
 	if 2 != len(log2.Entries) {
 		t.Fatal("expected equal")
@@ -772,8 +772,8 @@ func TestCleanDeadTest_CleanDeadPreservesInputs(t *testing.T) {
 	log1.Close()
 
 	log2 := NewBuildLog()
-	if s, err := log2.Load(testFilename); s != LoadSuccess || err != nil {
-		t.Fatal(s, err)
+	if err := log2.Load(testFilename); err != nil {
+		t.Fatal(err)
 	}
 	if 2 != len(log2.Entries) {
 		t.Fatal("expected equal")
@@ -848,3 +848,27 @@ func TestCleanDeadTest_CleanDeadPreservesInputs(t *testing.T) {
 	}
 	log2.Close()
 }
+
+func TestCleanTest_CleanedFiles(t *testing.T) {
+	c := NewCleanTest(t)
+	c.AssertParse(&c.state, "build in1: cat src1\nbuild out1: cat in1\n", ParseManifestOpts{})
+	c.fs.Create("in1", "")
+	c.fs.Create("out1", "")
+
+	c.config.DryRun = true
+	cleaner := NewCleaner(&c.state, &c.config, &c.fs)
+	if 0 != cleaner.CleanAll(false) {
+		t.Fatal("expected equal")
+	}
+	if diff := cmp.Diff([]string{"in1", "out1"}, cleaner.CleanedFiles()); diff != "" {
+		t.Fatalf("+want, -got: %s", diff)
+	}
+	if 0 != len(c.fs.filesRemoved) {
+		t.Fatal("expected equal")
+	}
+
+	cleaner.Reset()
+	if cleaner.CleanedFiles() != nil {
+		t.Fatal("expected nil")
+	}
+}
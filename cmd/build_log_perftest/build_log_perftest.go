@@ -103,7 +103,7 @@ func mainImpl() error {
 	{
 		// Read once to warm up disk cache.
 		log := nin.NewBuildLog()
-		if s, err := log.Load(testFilename); s == nin.LoadError {
+		if err := log.Load(testFilename); err != nil {
 			return fmt.Errorf("failed to read test data: %s", err)
 		}
 	}
@@ -114,7 +114,7 @@ func mainImpl() error {
 	for i := 0; i < kNumRepetitions; i++ {
 		start := time.Now()
 		log := nin.NewBuildLog()
-		if s, err := log.Load(testFilename); s == nin.LoadError {
+		if err := log.Load(testFilename); err != nil {
 			return fmt.Errorf("failed to read test data: %s", err)
 		}
 		delta := time.Since(start)
@@ -0,0 +1,255 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/maruel/nin"
+)
+
+// targetCachePath is the file caching the targets for the shell completion.
+// It is in the working directory since the build directory is only known
+// once the manifest is parsed.
+const targetCachePath = ".ninja_targets"
+
+// completionLimit is the number of targets above which the completion lists
+// the subdirectories instead of all the targets they contain.
+const completionLimit = 100
+
+// completionWords are the words completed by the shell scripts.
+type completionWords struct {
+	// tools are the visible tools.
+	tools []string
+	flags []completionFlag
+}
+
+// completionFlag is a command line flag.
+type completionFlag struct {
+	name  string
+	usage string
+	// isBool is true if the flag doesn't take a value.
+	isBool bool
+}
+
+func getCompletionWords(fs *flag.FlagSet) *completionWords {
+	w := &completionWords{}
+	for _, t := range allTools() {
+		if t.desc != "" {
+			w.tools = append(w.tools, t.name)
+		}
+	}
+	fs.VisitAll(func(f *flag.Flag) {
+		b, ok := f.Value.(interface{ IsBoolFlag() bool })
+		w.flags = append(w.flags, completionFlag{name: f.Name, usage: f.Usage, isBool: ok && b.IsBoolFlag()})
+	})
+	return w
+}
+
+// flagNames returns the flags prefixed with a dash, separated by spaces.
+func (w *completionWords) flagNames() string {
+	names := make([]string, 0, len(w.flags))
+	for _, f := range w.flags {
+		names = append(names, "-"+f.name)
+	}
+	return strings.Join(names, " ")
+}
+
+// toolCompletion prints the completion script of the shell in args.
+func toolCompletion(n *ninjaMain, opts *options, args []string) int {
+	shells := []string{"bash", "zsh", "fish"}
+	if len(args) != 1 {
+		errorf("usage: %s -t completion %s", nin.ProgramName, strings.Join(shells, "|"))
+		return 1
+	}
+	w := getCompletionWords(flag.CommandLine)
+	switch args[0] {
+	case "bash":
+		writeBashCompletion(os.Stdout, w)
+	case "zsh":
+		writeZshCompletion(os.Stdout, w)
+	case "fish":
+		writeFishCompletion(os.Stdout, w)
+	default:
+		if suggestions := nin.SpellcheckStrings(args[0], shells...); len(suggestions) != 0 {
+			errorf("unknown shell '%s', did you mean %s?", args[0], nin.SuggestionText(suggestions))
+		} else {
+			errorf("unknown shell '%s'; supported are %s", args[0], strings.Join(shells, ", "))
+		}
+		return 1
+	}
+	return 0
+}
+
+// toolComplete prints the targets starting with args[0], one per line, for
+// the completion scripts.
+//
+// The targets are cached in targetCachePath while the manifests are not
+// modified, so the completion stays interactive on large builds.
+func toolComplete(n *ninjaMain, opts *options, args []string) int {
+	prefix := ""
+	if len(args) != 0 {
+		prefix = args[0]
+	}
+	targets, ok := nin.ReadTargetCache(&n.di, targetCachePath, opts.inputFile)
+	if !ok {
+		input, err := n.di.ReadFile(opts.inputFile)
+		if err != nil {
+			errorf("%s", err)
+			return 1
+		}
+		if err := nin.ParseManifest(&n.state, &n.di, opts.parserOpts, opts.inputFile, input); err != nil {
+			errorf("%s", err)
+			return 1
+		}
+		targets = n.state.CompletionTargets()
+		// The cache is best effort.
+		_ = nin.WriteTargetCache(&n.di, targetCachePath, append([]string{opts.inputFile}, n.state.ManifestFiles...), targets)
+	}
+	for _, t := range nin.CompleteTargets(targets, prefix, completionLimit) {
+		fmt.Println(t)
+	}
+	return 0
+}
+
+// The scripts pass -C and -f along to -t _complete, so the targets come from
+// the right manifest.
+
+func writeBashCompletion(w io.Writer, c *completionWords) {
+	p := nin.ProgramName
+	fmt.Fprintf(w, `# bash completion for %[1]s, generated by: %[1]s -t completion bash
+_%[1]s() {
+	local cur="${COMP_WORDS[COMP_CWORD]}" prev="${COMP_WORDS[COMP_CWORD-1]}"
+	local args=() i
+	for ((i = 1; i < COMP_CWORD; i++)); do
+		case "${COMP_WORDS[i]}" in
+		-C|-f) args+=("${COMP_WORDS[i]}" "${COMP_WORDS[i+1]}") ;;
+		esac
+	done
+	case "$prev" in
+	-t) COMPREPLY=($(compgen -W "%[2]s" -- "$cur")); return ;;
+	-d) COMPREPLY=($(compgen -W "list %[3]s" -- "$cur")); return ;;
+	-w) COMPREPLY=($(compgen -W "list %[4]s" -- "$cur")); return ;;
+	-C) COMPREPLY=($(compgen -d -- "$cur")); return ;;
+	-f) COMPREPLY=($(compgen -f -- "$cur")); return ;;
+	esac
+	if [[ "$prev" == -* && " %[5]s " == *" $prev "* ]]; then
+		# The value of a flag.
+		return
+	fi
+	if [[ "$cur" == -* ]]; then
+		COMPREPLY=($(compgen -W "%[6]s" -- "$cur"))
+		return
+	fi
+	COMPREPLY=($(%[1]s "${args[@]}" -t _complete "$cur" 2>/dev/null))
+	if [[ ${#COMPREPLY[@]} -eq 1 && "${COMPREPLY[0]}" == */ ]]; then
+		compopt -o nospace
+	fi
+}
+complete -F _%[1]s %[1]s
+`, p, strings.Join(c.tools, " "), strings.Join(entryNames(debugModes), " "), strings.Join(warningFlags(), " "), strings.Join(valueFlags(c), " "), c.flagNames())
+}
+
+func writeZshCompletion(w io.Writer, c *completionWords) {
+	p := nin.ProgramName
+	fmt.Fprintf(w, `#compdef %[1]s
+# zsh completion for %[1]s, generated by: %[1]s -t completion zsh
+_%[1]s() {
+	local -a args targets
+	local i
+	for ((i = 2; i < CURRENT; i++)); do
+		case "${words[i]}" in
+		-C|-f) args+=("${words[i]}" "${words[i+1]}") ;;
+		esac
+	done
+	case "${words[CURRENT-1]}" in
+	-t) compadd -- %[2]s; return ;;
+	-d) compadd -- list %[3]s; return ;;
+	-w) compadd -- list %[4]s; return ;;
+	-C) _directories; return ;;
+	-f) _files; return ;;
+	%[5]s) return ;;
+	esac
+	if [[ "$PREFIX" == -* ]]; then
+		compadd -- %[6]s
+		return
+	fi
+	targets=(${(f)"$(%[1]s "${args[@]}" -t _complete "$PREFIX" 2>/dev/null)"})
+	# The directories are completed without a trailing space.
+	compadd -S '' -- ${(M)targets:#*/}
+	compadd -- ${targets:#*/}
+}
+compdef _%[1]s %[1]s
+`, p, strings.Join(c.tools, " "), strings.Join(entryNames(debugModes), " "), strings.Join(warningFlags(), " "), strings.Join(valueFlags(c), "|"), c.flagNames())
+}
+
+func writeFishCompletion(w io.Writer, c *completionWords) {
+	p := nin.ProgramName
+	fmt.Fprintf(w, `# fish completion for %[1]s, generated by: %[1]s -t completion fish
+function __%[1]s_args
+	set -l words (commandline -opc)
+	for i in (seq 2 (count $words))
+		switch $words[$i]
+			case -C -f
+				printf '%%s\n' $words[$i] $words[(math $i + 1)]
+		end
+	end
+end
+complete -c %[1]s -f
+complete -c %[1]s -n 'not string match -q -- "-*" (commandline -ct)' -a '(%[1]s (__%[1]s_args) -t _complete (commandline -ct) 2>/dev/null)'
+`, p)
+	for _, f := range c.flags {
+		opt := "-o " + f.name
+		if len(f.name) == 1 {
+			opt = "-s " + f.name
+		}
+		args := ""
+		switch {
+		case f.name == "t":
+			args = " -x -a '" + strings.Join(c.tools, " ") + "'"
+		case f.name == "d":
+			args = " -x -a 'list " + strings.Join(entryNames(debugModes), " ") + "'"
+		case f.name == "w":
+			args = " -x -a 'list " + strings.Join(warningFlags(), " ") + "'"
+		case f.name == "C":
+			args = " -x -a '(__fish_complete_directories)'"
+		case f.name == "f":
+			args = " -r -F"
+		case !f.isBool:
+			args = " -x"
+		}
+		fmt.Fprintf(w, "complete -c %s %s%s -d %s\n", p, opt, args, fishQuote(f.usage))
+	}
+}
+
+// valueFlags returns the flags taking a value, prefixed with a dash.
+func valueFlags(c *completionWords) []string {
+	var out []string
+	for _, f := range c.flags {
+		if !f.isBool {
+			out = append(out, "-"+f.name)
+		}
+	}
+	return out
+}
+
+// fishQuote quotes s as a single quoted fish string.
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
@@ -0,0 +1,61 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestCompletionScripts(t *testing.T) {
+	fs := flag.NewFlagSet("nin", flag.ContinueOnError)
+	fs.String("C", "", "change to DIR")
+	fs.Bool("v", false, "show all command lines while building")
+	fs.Int("j", 0, "run N jobs in parallel")
+	w := getCompletionWords(fs)
+	if got := strings.Join(valueFlags(w), " "); got != "-C -j" {
+		t.Fatal(got)
+	}
+	data := []struct {
+		shell string
+		write func(io.Writer, *completionWords)
+		want  []string
+	}{
+		{"bash", writeBashCompletion, []string{"complete -F _nin nin", "-C -j -v", "compdb"}},
+		{"zsh", writeZshCompletion, []string{"compdef _nin nin", "-C|-j) return", "compdb"}},
+		{"fish", writeFishCompletion, []string{"complete -c nin -s v -d 'show all command lines while building'", "complete -c nin -s j -x -d"}},
+	}
+	for _, l := range data {
+		var b bytes.Buffer
+		l.write(&b, w)
+		for _, want := range l.want {
+			if !strings.Contains(b.String(), want) {
+				t.Fatalf("%s: missing %q\n%s", l.shell, want, b.String())
+			}
+		}
+		if p, err := exec.LookPath(l.shell); err == nil {
+			// Check the syntax.
+			cmd := exec.Command(p, "-n")
+			cmd.Stdin = &b
+			if out, err := cmd.CombinedOutput(); err != nil {
+				t.Fatalf("%s: %s\n%s", l.shell, err, out)
+			}
+		}
+	}
+}
@@ -0,0 +1,289 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/maruel/nin"
+)
+
+// helpEntry documents a name, e.g. a debug mode or an environment variable.
+//
+// The same entries are used by the help topics, the lists printed by -d list
+// and -w list, the spellcheck of the flags and the shell completion.
+type helpEntry struct {
+	name string
+	desc string
+	// ninOnly is set for the entries that ninja doesn't have. They are hidden
+	// with -compat.
+	ninOnly bool
+}
+
+// debugModes are the values accepted by -d, besides list.
+var debugModes = []helpEntry{
+	{"stats", "print operation counts/timing info", false},
+	{"explain", "explain what caused a command to execute", false},
+	{"keepdepfile", "don't delete depfiles after they're read by ninja", false},
+	{"keeprsp", "don't delete @response files on success", false},
+	{"nostatcache", "don't batch stat() calls per directory and cache them", false},
+}
+
+// warnings are the values accepted by -w, suffixed with =err or =warn.
+var warnings = []helpEntry{
+	{"phonycycle", "phony build statement references itself", false},
+	{"outputcase", "outputs differ only by case", true},
+	{"outputpath", "outputs outside of the build directory or tracked by git", true},
+}
+
+// envVars are the environment variables used by nin.
+var envVars = []helpEntry{
+	{"NINJA_STATUS", "format of the progress status, \"[%f/%t] \" by default; see the manual of ninja for the placeholders", false},
+	{"CLICOLOR_FORCE", "set to 1 to force the colors even when the output is not a terminal", false},
+	{"TERM", "set to dumb to disable the smart terminal output", false},
+	{"NIN_TELEMETRY", "set to 1 to opt in the telemetry configured in " + projectConfigFile + ", like -telemetry", true},
+	{"RUSTC_WRAPPER", "a compiler cache, e.g. sccache, whose statistics are reported", true},
+	{"NIN_EVENT", "set by nin for the hook commands of " + projectConfigFile + " to the event that fired", true},
+}
+
+// helpTopics are the topics of "nin help", besides the tool names.
+var helpTopics = []helpEntry{
+	{"manifest", "the syntax of build.ninja and the nin extensions", false},
+	{"tools", "the tools run with -t", false},
+	{"flags", "the command line flags", false},
+	{"debug", "the debugging modes enabled with -d", false},
+	{"warnings", "the warnings configured with -w", false},
+	{"env", "the environment variables", false},
+	{"config", "the project configuration file " + projectConfigFile, false},
+	{"man", "all the topics as a man page, e.g. nin help man | man -l -", false},
+}
+
+// entryNames returns the names of the entries.
+func entryNames(entries []helpEntry) []string {
+	out := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if !e.ninOnly || !compatNinja {
+			out = append(out, e.name)
+		}
+	}
+	return out
+}
+
+// warningFlags returns the values accepted by -w, besides list.
+func warningFlags() []string {
+	// dupbuild is accepted for compatibility but not documented, like ninja.
+	out := []string{"dupbuild=err", "dupbuild=warn"}
+	for _, w := range entryNames(warnings) {
+		out = append(out, w+"=err", w+"=warn")
+	}
+	return out
+}
+
+// printEntries prints the entries in two columns, the names in a column of
+// width characters.
+func printEntries(w io.Writer, entries []helpEntry, width int, suffix string) {
+	for _, e := range entries {
+		if !e.ninOnly || !compatNinja {
+			fmt.Fprintf(w, "  %-*s%s\n", width, e.name+suffix, e.desc)
+		}
+	}
+}
+
+// wantsHelp returns true if the command line is "nin help [topic]".
+func wantsHelp(opts *options, args []string) bool {
+	return opts.tool == nil && !compatNinja && len(args) != 0 && args[0] == "help"
+}
+
+// runHelp prints the help topic in args, or the list of topics.
+func runHelp(args []string) int {
+	w := os.Stdout
+	topic := ""
+	if len(args) != 0 {
+		topic = args[0]
+	}
+	switch topic {
+	case "":
+		fmt.Fprintf(w, "usage: %s help TOPIC\n\ntopics:\n", nin.ProgramName)
+		printEntries(w, helpTopics, 10, "")
+		fmt.Fprintf(w, "  %-10s%s\n", "TOOL", "the description of a tool, e.g. "+nin.ProgramName+" help compdb")
+	case "manifest":
+		io.WriteString(w, helpManifest)
+	case "tools":
+		fmt.Fprintf(w, "tools, run with -t TOOL:\n")
+		printTools(w, allTools())
+	case "flags":
+		printUsage(w)
+	case "debug":
+		fmt.Fprintf(w, "debugging modes, enabled with -d MODE:\n")
+		printEntries(w, debugModes, 13, "")
+		fmt.Fprintf(w, "multiple modes can be enabled via -d FOO -d BAR\n")
+	case "warnings":
+		fmt.Fprintf(w, "warning flags, set with -w FLAG:\n")
+		printEntries(w, warnings, 23, "={err,warn}")
+	case "env":
+		fmt.Fprintf(w, "environment variables:\n")
+		printEntries(w, envVars, 16, "")
+	case "config":
+		io.WriteString(w, helpConfig)
+	case "man":
+		writeManPage(w, flag.CommandLine)
+	default:
+		for _, t := range allTools() {
+			if t.name == topic && t.desc != "" {
+				fmt.Fprintf(w, "%s -t %s: %s\n", nin.ProgramName, t.name, t.desc)
+				return 0
+			}
+		}
+		words := entryNames(helpTopics)
+		for _, t := range allTools() {
+			if t.desc != "" {
+				words = append(words, t.name)
+			}
+		}
+		if suggestions := nin.SpellcheckStrings(topic, words...); len(suggestions) != 0 {
+			errorf("unknown help topic '%s', did you mean %s?", topic, nin.SuggestionText(suggestions))
+		} else {
+			errorf("unknown help topic '%s'; run '%s help' for the list", topic, nin.ProgramName)
+		}
+		return 1
+	}
+	return 0
+}
+
+// printTools prints the visible tools, as for -t list.
+func printTools(w io.Writer, tools []*tool) {
+	for _, t := range tools {
+		if t.desc != "" {
+			fmt.Fprintf(w, "%11s  %s\n", t.name, t.desc)
+		}
+	}
+}
+
+// writeManPage writes all the topics as a man page in roff format.
+func writeManPage(w io.Writer, fs *flag.FlagSet) {
+	esc := strings.NewReplacer(`\`, `\e`, "-", `\-`, "\n.", "\n\\&.", "\n'", "\n\\&'")
+	p := nin.ProgramName
+	fmt.Fprintf(w, ".TH %s 1 \"\" \"%s %s\" \"User Commands\"\n", strings.ToUpper(p), p, nin.NinVersion)
+	fmt.Fprintf(w, ".SH NAME\n%s \\- a small build system with a focus on speed\n", p)
+	fmt.Fprintf(w, ".SH SYNOPSIS\n.B %s\n[\\fIoptions\\fR] [\\fItargets\\fR...]\n", p)
+	fmt.Fprintf(w, ".SH DESCRIPTION\nBuilds the targets, or the default ones, of the manifest build.ninja.\n")
+	fmt.Fprintf(w, ".SH OPTIONS\n")
+	fs.VisitAll(func(f *flag.Flag) {
+		fmt.Fprintf(w, ".TP\n.B \\-%s\n%s\n", esc.Replace(f.Name), esc.Replace(f.Usage))
+	})
+	section := func(title string, entries []helpEntry, suffix string) {
+		fmt.Fprintf(w, ".SH %s\n", title)
+		for _, e := range entries {
+			if !e.ninOnly || !compatNinja {
+				fmt.Fprintf(w, ".TP\n.B %s\n%s\n", esc.Replace(e.name+suffix), esc.Replace(e.desc))
+			}
+		}
+	}
+	var tools []helpEntry
+	for _, t := range allTools() {
+		if t.desc != "" {
+			tools = append(tools, helpEntry{name: t.name, desc: t.desc, ninOnly: ninOnlyTools[t.name]})
+		}
+	}
+	section("TOOLS", tools, "")
+	section("DEBUGGING MODES", debugModes, "")
+	section("WARNINGS", warnings, "={err,warn}")
+	section("ENVIRONMENT", envVars, "")
+	for _, s := range []struct {
+		title, text string
+	}{{"MANIFEST", helpManifest}, {"CONFIGURATION", helpConfig}} {
+		fmt.Fprintf(w, ".SH %s\n.nf\n%s.fi\n", s.title, esc.Replace(s.text))
+	}
+}
+
+const helpManifest = `The manifest, build.ninja by default, declares the rules and the build
+edges using them. A line ending with $ continues on the next one. Indented
+lines are the bindings of the statement above.
+
+  rule NAME          a command template, with its bindings
+  build OUTS: RULE INS | IMPLICIT || ORDER-ONLY |@ VALIDATIONS
+                     an edge building OUTS from INS
+  default TARGETS    the targets built when none is given
+  pool NAME          limits the concurrency of its edges with depth = N
+  include FILE       parses FILE in the current scope
+  subninja FILE      parses FILE in a child scope
+  VAR = VALUE        a variable, expanded with $VAR or ${VAR}
+
+Rule bindings, also settable per edge:
+  command            the command to run
+  description        shown instead of the command
+  depfile, deps      the dependencies discovered by the command (gcc, msvc)
+  msvc_deps_prefix   the prefix of the /showIncludes lines
+  dyndep             a file with dependencies discovered at build time
+  generator          the edge regenerates the manifest
+  restat             re-stat the outputs after the command ran
+  rspfile, rspfile_content
+                     a response file written before the command runs
+  pool               the pool of the edge; console runs it on the terminal
+
+Variables available in the bindings of a rule:
+  $in, $out          the explicit inputs and outputs
+  $in_newline        the explicit inputs, one per line
+
+nin extensions, enabled with nin_required_version = 1.0 or listed in
+nin_features:
+  cwd                the directory the command runs in; $in, $out, $depfile
+                     and $rspfile are rewritten relative to it
+  sort_inputs        expand $in sorted by path
+  skip               remove the edge at parse time when the condition is true,
+                     e.g. skip = $nin_host_os == windows
+  toolchain          the directories the program of the command is found in
+  worker             run the command in a persistent worker; the arguments
+                     from the first @flagfile are sent as the request
+  batch              run several edges of the rule in a single command
+  remoteable         the edge can run on a remote executor
+  mem                the memory used by the command, for -mem-limit
+  scan               scan the includes of the sources instead of a depfile
+  test               the edge is a test whose result is cached by -t test
+  rspfile_auto       move $in to a response file when the command is too long
+  meta.KEY           metadata reported in the status and the tools
+  $in_sorted         the explicit inputs sorted by path
+  $in_short, $out_short, $in_count, $out_count
+                     short forms for the descriptions
+  $in_batch          the inputs of all the edges of a batch
+  $nin_host_os, $nin_host_arch
+                     the platform nin runs on, e.g. linux and amd64
+  outroot = DIR      remap the outputs under DIR
+  defaultgroup NAME: TARGETS
+                     a group of targets built with nin :NAME
+  builtin rules      stamp, copy, hardlink and symlink run without a process
+`
+
+const helpConfig = `The optional file ` + projectConfigFile + ` in the working directory configures the
+project. All the sections are optional:
+
+  {
+    "profiles": {"ci": {"k": 10, "log-sync": "fsync"}},
+    "hooks": [{"events": ["failure"], "url": "https://chat.example.com/hook"}],
+    "telemetry": {"url": "https://metrics.example.com/nin", "slowest": 10},
+    "redact": {"env": ["SIGNING_KEY"], "patterns": ["--token[= ](\\S+)"]}
+  }
+
+  profiles           named bundles of flags selected with -profile
+  hooks              run on the events start, success, failure and
+                     edge-failure, posting to url or piping into command
+  telemetry          the endpoint receiving an anonymized report of each
+                     build, for the users opting in with -telemetry
+  redact             the secrets masked in the status, summaries and logs
+`
@@ -0,0 +1,57 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestWarningFlags(t *testing.T) {
+	want := []string{"dupbuild=err", "dupbuild=warn", "phonycycle=err", "phonycycle=warn", "outputcase=err", "outputcase=warn", "outputpath=err", "outputpath=warn"}
+	if diff := cmp.Diff(want, warningFlags()); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestPrintEntries(t *testing.T) {
+	var b bytes.Buffer
+	printEntries(&b, warnings[:1], 23, "={err,warn}")
+	if got := b.String(); got != "  phonycycle={err,warn}  phony build statement references itself\n" {
+		t.Fatalf("%q", got)
+	}
+}
+
+func TestWriteManPage(t *testing.T) {
+	fs := flag.NewFlagSet("nin", flag.ContinueOnError)
+	fs.Int("k", 1, "keep going until N jobs fail")
+	var b bytes.Buffer
+	writeManPage(&b, fs)
+	for _, want := range []string{".TH NIN 1", ".B \\-k\nkeep going", ".SH TOOLS", ".B compdb\n", ".B nostatcache\n", ".B NINJA_STATUS\n", ".SH MANIFEST\n.nf\n"} {
+		if !strings.Contains(b.String(), want) {
+			t.Fatalf("missing %q\n%s", want, b.String())
+		}
+	}
+	// A line starting with a dot would be a roff request.
+	for _, l := range strings.Split(b.String(), "\n") {
+		if strings.HasPrefix(l, ".") && !strings.HasPrefix(l, ".TH ") && !strings.HasPrefix(l, ".SH ") && !strings.HasPrefix(l, ".B ") && l != ".TP" && l != ".nf" && l != ".fi" {
+			t.Fatalf("unexpected request %q", l)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/maruel/nin"
+)
+
+// The events reported to the hooks.
+var hookEvents = []string{"start", "success", "failure", "edge-failure"}
+
+// hookConfig is a hook in the projectConfigFile, e.g.
+// {"events": ["failure"], "url": "https://chat.example.com/webhook"}.
+type hookConfig struct {
+	// Events are the events triggering the hook; all of them if empty.
+	Events []string `json:"events"`
+	// URL receives the payload in a POST request.
+	URL string `json:"url"`
+	// Command is run by the shell with the payload on stdin and the event in
+	// the NIN_EVENT environment variable.
+	Command string `json:"command"`
+}
+
+// hookPayload is the JSON payload sent to the hooks.
+type hookPayload struct {
+	Event string `json:"event"`
+	Time  string `json:"time"`
+	Dir   string `json:"dir"`
+	// Set for edge-failure.
+	Rule    string   `json:"rule,omitempty"`
+	Outputs []string `json:"outputs,omitempty"`
+	Output  string   `json:"output,omitempty"`
+	// Set for success and failure.
+	ExitCode int `json:"exit_code,omitempty"`
+	Finished int `json:"finished,omitempty"`
+	Failed   int `json:"failed,omitempty"`
+}
+
+// buildHooks is a nin.Status that runs the hooks asynchronously on the build
+// lifecycle events. Call finished once the build completed, then wait before
+// exiting.
+type buildHooks struct {
+	hooks   []hookConfig
+	timeout time.Duration
+	dir     string
+	started bool
+	// finishedEdges and failedEdges count the edges of all the builds, e.g.
+	// including the rebuild of the manifest.
+	finishedEdges, failedEdges int
+	wg                         sync.WaitGroup
+}
+
+// newBuildHooks validates the hooks. It returns nil when there's none.
+func newBuildHooks(hooks []hookConfig) (*buildHooks, error) {
+	if len(hooks) == 0 {
+		return nil, nil
+	}
+	for i, h := range hooks {
+		if (h.URL == "") == (h.Command == "") {
+			return nil, fmt.Errorf("hook #%d: exactly one of url or command must be set", i+1)
+		}
+		for _, e := range h.Events {
+			if !validHookEvent(e) {
+				return nil, fmt.Errorf("hook #%d: unknown event %q; must be one of start, success, failure or edge-failure", i+1, e)
+			}
+		}
+	}
+	return &buildHooks{hooks: hooks, timeout: 10 * time.Second}, nil
+}
+
+func validHookEvent(e string) bool {
+	return hasEvent(hookEvents, e)
+}
+
+func hasEvent(events []string, e string) bool {
+	for _, v := range events {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+// fire runs the hooks registered for p.Event in the background.
+func (b *buildHooks) fire(p *hookPayload) {
+	if b.dir == "" {
+		b.dir, _ = os.Getwd()
+	}
+	p.Time = time.Now().UTC().Format(time.RFC3339)
+	p.Dir = b.dir
+	data, err := json.Marshal(p)
+	if err != nil {
+		return
+	}
+	for i := range b.hooks {
+		h := &b.hooks[i]
+		if len(h.Events) != 0 && !hasEvent(h.Events, p.Event) {
+			continue
+		}
+		b.wg.Add(1)
+		go func() {
+			defer b.wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), b.timeout)
+			defer cancel()
+			if err := runHook(ctx, h, p.Event, data); err != nil {
+				warningf("hook %s: %s", p.Event, err)
+			}
+		}()
+	}
+}
+
+// finished fires success or failure depending on the exit code of the build.
+func (b *buildHooks) finished(exitCode int) {
+	payload := &hookPayload{Event: "success", ExitCode: exitCode, Finished: b.finishedEdges, Failed: b.failedEdges}
+	if exitCode != 0 {
+		payload.Event = "failure"
+	}
+	b.fire(payload)
+}
+
+// wait waits for the hooks still running. Each hook is bounded by the
+// timeout.
+func (b *buildHooks) wait() {
+	b.wg.Wait()
+}
+
+// runHook posts data to the URL of h or pipes it into its command.
+func runHook(ctx context.Context, h *hookConfig, event string, data []byte) error {
+	if h.URL != "" {
+		req, err := http.NewRequestWithContext(ctx, "POST", h.URL, bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			return fmt.Errorf("%s: %s", h.URL, resp.Status)
+		}
+		return nil
+	}
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd.exe", "/c", h.Command)
+	} else {
+		cmd = exec.CommandContext(ctx, "/bin/sh", "-c", h.Command)
+	}
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Env = append(os.Environ(), "NIN_EVENT="+event)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %w\n%s", h.Command, err, out)
+	}
+	return nil
+}
+
+func (b *buildHooks) PlanHasTotalEdges(total int) {
+}
+
+func (b *buildHooks) BuildEdgeStarted(edge *nin.Edge, startTimeMillis int32) {
+}
+
+func (b *buildHooks) BuildEdgeFinished(edge *nin.Edge, endTimeMillis int32, success bool, output string) {
+	b.finishedEdges++
+	if !success {
+		b.failedEdges++
+		b.fire(&hookPayload{Event: "edge-failure", Rule: edge.Rule.Name, Outputs: edgeOutputs(edge), Output: output})
+	}
+}
+
+func (b *buildHooks) BuildLoadDyndeps() {
+}
+
+// BuildStarted fires start once, even if the manifest is rebuilt first.
+func (b *buildHooks) BuildStarted() {
+	if !b.started {
+		b.started = true
+		b.fire(&hookPayload{Event: "start"})
+	}
+}
+
+func (b *buildHooks) BuildFinished() {
+}
+
+func (b *buildHooks) Info(msg string, i ...interface{}) {
+}
+
+func (b *buildHooks) Warning(msg string, i ...interface{}) {
+}
+
+func (b *buildHooks) Error(msg string, i ...interface{}) {
+}
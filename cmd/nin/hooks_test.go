@@ -0,0 +1,78 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/maruel/nin"
+)
+
+func TestBuildHooks(t *testing.T) {
+	var mu sync.Mutex
+	var got []hookPayload
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p hookPayload
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		got = append(got, hookPayload{Event: p.Event, Outputs: p.Outputs, ExitCode: p.ExitCode, Finished: p.Finished, Failed: p.Failed})
+		mu.Unlock()
+	}))
+	defer ts.Close()
+
+	h, err := newBuildHooks([]hookConfig{{Events: []string{"edge-failure", "failure"}, URL: ts.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := nin.NewState()
+	if err := nin.ParseManifest(&state, nil, nin.ParseManifestOpts{}, "build.ninja", []byte("rule r\n  command = r\nbuild a: r\nbuild b: r\n\x00")); err != nil {
+		t.Fatal(err)
+	}
+	h.BuildStarted()
+	h.BuildEdgeFinished(state.Edges[0], 1, false, "error\n")
+	h.BuildEdgeFinished(state.Edges[1], 2, true, "")
+	h.BuildFinished()
+	h.finished(1)
+	h.wait()
+
+	sort.Slice(got, func(i, j int) bool { return got[i].Event < got[j].Event })
+	want := []hookPayload{
+		{Event: "edge-failure", Outputs: []string{"a"}},
+		{Event: "failure", ExitCode: 1, Finished: 2, Failed: 1},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestNewBuildHooks_Invalid(t *testing.T) {
+	if _, err := newBuildHooks([]hookConfig{{URL: "http://localhost", Command: "true"}}); err == nil {
+		t.Fatal("expected error")
+	}
+	if _, err := newBuildHooks([]hookConfig{{Events: []string{"finish"}, Command: "true"}}); err == nil || err.Error() != `hook #1: unknown event "finish"; must be one of start, success, failure or edge-failure` {
+		t.Fatal(err)
+	}
+	if h, err := newBuildHooks(nil); h != nil || err != nil {
+		t.Fatal(h, err)
+	}
+}
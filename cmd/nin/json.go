@@ -15,6 +15,7 @@
 package main
 
 import (
+	"encoding/json"
 	"os"
 )
 
@@ -57,3 +58,373 @@ func printJSONString(in string) {
 	b := encodeJSONString(in)
 	_, _ = os.Stdout.WriteString(b)
 }
+
+// The types below define the schemas used by the subtools when -format=json
+// is specified. They are stable: fields may be added but are never renamed or
+// removed.
+//
+// Each tool prints a single JSON object followed by a new line.
+
+// jsonTarget is a node as printed by "-t targets", "-t commands" and
+// "-t graph".
+type jsonTarget struct {
+	// Path is the canonicalized path of the node.
+	Path string `json:"path"`
+	// Rule is the name of the rule generating this node. It is empty for source
+	// files.
+	Rule string `json:"rule,omitempty"`
+	// MTime is the modification time of the file in microseconds since the
+	// epoch and Size its size in bytes. They are only set if the file exists,
+	// so tools can compute e.g. the bytes rebuilt without a stat pass.
+	MTime int64  `json:"mtime,omitempty"`
+	Size  *int64 `json:"size,omitempty"`
+	// Height is the length of the longest path down to a source file. It is
+	// only set in "-t targets leafdepth" mode.
+	Height *int `json:"height,omitempty"`
+	// Inputs is only set in "-t targets depth" mode.
+	Inputs []jsonTarget `json:"inputs,omitempty"`
+	// Skipped is the condition of the skip binding that removed the edge
+	// generating the target. It is only set in "-t targets all" and "-t
+	// targets rule" modes.
+	Skipped string `json:"skipped,omitempty"`
+}
+
+// jsonTargets is the output of "-t targets".
+type jsonTargets struct {
+	Targets []jsonTarget `json:"targets"`
+}
+
+// jsonBinding is a rule binding as printed by "-t rules".
+type jsonBinding struct {
+	// Unparsed is the binding as written in the manifest.
+	Unparsed string `json:"unparsed"`
+	// Example is the binding evaluated for the first edge using the rule. It is
+	// empty if the rule is unused.
+	Example string `json:"example,omitempty"`
+}
+
+// jsonRule is a rule as printed by "-t rules".
+type jsonRule struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	// Filename is the manifest file that defined the rule. It is empty for
+	// builtin rules.
+	Filename string `json:"filename,omitempty"`
+	// Edges is the number of edges using this rule.
+	Edges int `json:"edges"`
+	// Bindings contains the "command", "description" and "deps" bindings, when
+	// set.
+	Bindings map[string]jsonBinding `json:"bindings"`
+}
+
+// jsonRules is the output of "-t rules".
+type jsonRules struct {
+	Rules []jsonRule `json:"rules"`
+}
+
+// jsonDeps is a deps log entry as printed by "-t deps".
+type jsonDeps struct {
+	Path string `json:"path"`
+	// Found is false if the deps log has no entry for this path.
+	Found bool `json:"found"`
+	// MTime is the mtime recorded in the deps log, in microseconds since epoch.
+	MTime int64 `json:"mtime"`
+	// Valid is false if the output is older than the deps entry.
+	Valid bool     `json:"valid"`
+	Deps  []string `json:"deps"`
+}
+
+// jsonDepsList is the output of "-t deps".
+type jsonDepsList struct {
+	Deps []jsonDeps `json:"deps"`
+}
+
+// jsonQueryInput is an input of a node as printed by "-t query".
+type jsonQueryInput struct {
+	Path string `json:"path"`
+	// Kind is one of "explicit", "implicit" or "order_only".
+	Kind string `json:"kind"`
+}
+
+// jsonQuery is a node as printed by "-t query".
+type jsonQuery struct {
+	Path string `json:"path"`
+	// Rule is empty if the node is a source file.
+	Rule          string           `json:"rule,omitempty"`
+	Inputs        []jsonQueryInput `json:"inputs"`
+	Validations   []string         `json:"validations"`
+	Outputs       []string         `json:"outputs"`
+	ValidationFor []string         `json:"validation_for"`
+}
+
+// jsonQueries is the output of "-t query".
+type jsonQueries struct {
+	Nodes []jsonQuery `json:"nodes"`
+}
+
+// jsonCommand is a command as printed by "-t commands".
+type jsonCommand struct {
+	Rule    string   `json:"rule"`
+	Outputs []string `json:"outputs"`
+	Command string   `json:"command"`
+	// Cwd is the directory the command runs in, if not the build directory.
+	Cwd string `json:"cwd,omitempty"`
+}
+
+// jsonCommands is the output of "-t commands", in execution order.
+type jsonCommands struct {
+	Commands []jsonCommand `json:"commands"`
+}
+
+// jsonGraphEdge is an edge as printed by "-t graph".
+type jsonGraphEdge struct {
+	Rule    string            `json:"rule"`
+	Inputs  []string          `json:"inputs"`
+	Outputs []string          `json:"outputs"`
+	Meta    map[string]string `json:"meta,omitempty"`
+}
+
+// jsonGraph is the output of "-t graph".
+type jsonGraph struct {
+	Nodes []jsonTarget    `json:"nodes"`
+	Edges []jsonGraphEdge `json:"edges"`
+}
+
+// jsonPool is a pool as printed by "-t pools".
+type jsonPool struct {
+	Name string `json:"name"`
+	// Depth is 0 for pools with an infinite depth.
+	Depth int `json:"depth"`
+	// Edges is the number of edges assigned to this pool.
+	Edges int `json:"edges"`
+	// Ran is the number of edges of this pool that ran in the last build.
+	Ran int `json:"ran"`
+	// BusyMS is the sum of the duration of the edges of this pool in the last
+	// build, in milliseconds.
+	BusyMS int64 `json:"busy_ms"`
+	// SaturatedMS is the wall time during which the pool was full in the last
+	// build, in milliseconds. Edges of this pool waited during this time.
+	SaturatedMS int64 `json:"saturated_ms"`
+}
+
+// jsonPools is the output of "-t pools".
+type jsonPools struct {
+	Pools []jsonPool `json:"pools"`
+}
+
+// jsonAlias is a phony alias as printed by "-t aliases".
+type jsonAlias struct {
+	Name    string   `json:"name"`
+	Targets []string `json:"targets"`
+}
+
+// jsonAliasShadow is an alias conflicting with a real file.
+type jsonAliasShadow struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+// jsonAliases is the output of "-t aliases".
+type jsonAliases struct {
+	Aliases []jsonAlias       `json:"aliases"`
+	Shadows []jsonAliasShadow `json:"shadows"`
+}
+
+// jsonGroup is a target group as printed by "-t groups".
+type jsonGroup struct {
+	Name    string   `json:"name"`
+	Targets []string `json:"targets"`
+}
+
+// jsonGroups is the output of "-t groups".
+type jsonGroups struct {
+	Groups []jsonGroup `json:"groups"`
+}
+
+// jsonSelftest is the output of "-t selftest".
+type jsonSelftest struct {
+	// ExitCode is the exit code of the build with nin.
+	ExitCode    int      `json:"exit_code"`
+	Differences []string `json:"differences"`
+}
+
+// jsonClean is the output of "-t clean".
+type jsonClean struct {
+	// Removed is the list of files removed, or that would have been removed
+	// with -n.
+	Removed []string `json:"removed"`
+	DryRun  bool     `json:"dry_run"`
+}
+
+// jsonVerifyLog is a log as checked by "-t verifylogs".
+type jsonVerifyLog struct {
+	Path string `json:"path"`
+	// Status is one of "ok", "missing" or "invalid".
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// jsonVerifyLogs is the output of "-t verifylogs".
+type jsonVerifyLogs struct {
+	Logs []jsonVerifyLog `json:"logs"`
+}
+
+// jsonDeterminismOutput is an output that differed between two runs.
+type jsonDeterminismOutput struct {
+	Path string `json:"path"`
+	// Digests are the SHA-256 of the output after each run.
+	Digests [2]string `json:"digests"`
+	// Ranges are the [start, end) byte ranges that differ.
+	Ranges [][2]int64 `json:"ranges"`
+}
+
+// jsonDeterminismEdge is an edge that is nondeterministic or that failed.
+type jsonDeterminismEdge struct {
+	Rule    string                  `json:"rule"`
+	Outputs []jsonDeterminismOutput `json:"outputs"`
+	Error   string                  `json:"error,omitempty"`
+}
+
+// jsonDeterminism is the output of "-t determinism".
+type jsonDeterminism struct {
+	// Checked is the number of edges that were run twice.
+	Checked int                   `json:"checked"`
+	Edges   []jsonDeterminismEdge `json:"edges"`
+}
+
+// jsonScopeShadow is a rule or a variable shadowing one of a parent scope.
+type jsonScopeShadow struct {
+	Name string `json:"name"`
+	// File is the file of the parent scope declaring the shadowed one.
+	File string `json:"file"`
+}
+
+// jsonScope is a scope as listed by "-t scopes".
+type jsonScope struct {
+	File string `json:"file"`
+	// Parent is the file of the parent scope, empty for the main manifest.
+	Parent            string            `json:"parent,omitempty"`
+	Depth             int               `json:"depth"`
+	Edges             int               `json:"edges"`
+	ShadowedRules     []jsonScopeShadow `json:"shadowed_rules"`
+	ShadowedVariables []jsonScopeShadow `json:"shadowed_variables"`
+}
+
+// jsonScopes is the output of "-t scopes".
+type jsonScopes struct {
+	Scopes []jsonScope `json:"scopes"`
+}
+
+// jsonBundle is the output of "-t bundle".
+type jsonBundle struct {
+	Files []string `json:"files"`
+	// Missing are the files that were not found when writing an archive.
+	Missing []string `json:"missing,omitempty"`
+}
+
+// jsonRuleUsage is the resources used by the edges of a rule.
+type jsonRuleUsage struct {
+	Rule         string `json:"rule"`
+	Edges        int    `json:"edges"`
+	UserMS       int64  `json:"user_ms"`
+	SystemMS     int64  `json:"system_ms"`
+	MaxRSS       int64  `json:"max_rss"`
+	ReadBytes    int64  `json:"read_bytes"`
+	WrittenBytes int64  `json:"written_bytes"`
+}
+
+// jsonRusage is the output of "-t rusage".
+type jsonRusage struct {
+	Rules []jsonRuleUsage `json:"rules"`
+}
+
+// jsonEdgeStability is an edge reported by "-t flaky".
+type jsonEdgeStability struct {
+	Output   string `json:"output"`
+	Runs     int    `json:"runs"`
+	Failures int    `json:"failures"`
+	Flaps    int    `json:"flaps"`
+	MeanMS   int64  `json:"mean_ms"`
+	StdDevMS int64  `json:"stddev_ms"`
+}
+
+// jsonFlaky is the output of "-t flaky".
+type jsonFlaky struct {
+	Builds int                 `json:"builds"`
+	Edges  []jsonEdgeStability `json:"edges"`
+}
+
+// jsonHistoryBuild is a build listed by "-t history".
+type jsonHistoryBuild struct {
+	Seq    int    `json:"seq"`
+	Time   string `json:"time"`
+	Edges  int    `json:"edges"`
+	WallMS int64  `json:"wall_ms"`
+}
+
+// jsonHistoryOutput is the durations of an output across the archived builds.
+type jsonHistoryOutput struct {
+	Output    string  `json:"output"`
+	SamplesMS []int64 `json:"samples_ms"`
+	MedianMS  int64   `json:"median_ms"`
+}
+
+// jsonHistory is the output of "-t history".
+type jsonHistory struct {
+	Builds  []jsonHistoryBuild  `json:"builds,omitempty"`
+	Outputs []jsonHistoryOutput `json:"outputs,omitempty"`
+}
+
+// jsonSnapshot is a graph snapshot listed by "-t statediff".
+type jsonSnapshot struct {
+	Seq       int    `json:"seq"`
+	Time      string `json:"time"`
+	Succeeded bool   `json:"succeeded"`
+	Nodes     int    `json:"nodes"`
+}
+
+// jsonSnapshotChange is a node that differs between two snapshots.
+type jsonSnapshotChange struct {
+	Path string `json:"path"`
+	// Changes are among added, removed, modified, rebuilt, command, dirty
+	// and clean.
+	Changes []string `json:"changes"`
+}
+
+// jsonStatediff is the output of "-t statediff".
+type jsonStatediff struct {
+	Snapshots []jsonSnapshot       `json:"snapshots,omitempty"`
+	From      *jsonSnapshot        `json:"from,omitempty"`
+	To        *jsonSnapshot        `json:"to,omitempty"`
+	Changes   []jsonSnapshotChange `json:"changes,omitempty"`
+}
+
+// jsonPoolSuggestion is a pool suggested by "-t tune".
+type jsonPoolSuggestion struct {
+	Name    string   `json:"name"`
+	Depth   int      `json:"depth"`
+	Rules   []string `json:"rules"`
+	Reasons []string `json:"reasons"`
+}
+
+// jsonTune is the output of "-t tune".
+type jsonTune struct {
+	Pools []jsonPoolSuggestion `json:"pools"`
+}
+
+// jsonGeneratedHeaders is the output of "-t generated-headers".
+type jsonGeneratedHeaders struct {
+	Files []string `json:"files"`
+}
+
+// printJSON prints v as indented JSON to stdout.
+func printJSON(v interface{}) int {
+	e := json.NewEncoder(os.Stdout)
+	e.SetEscapeHTML(false)
+	e.SetIndent("", "  ")
+	if err := e.Encode(v); err != nil {
+		errorf("%s", err)
+		return 1
+	}
+	return 0
+}
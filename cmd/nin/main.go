@@ -35,7 +35,7 @@ func (m *missingDependencyPrinter) OnMissingDep(node *nin.Node, path string, gen
 
 // Log a fatalf message and exit.
 func fatalf(msg string, s ...interface{}) {
-	fmt.Fprintf(os.Stderr, "nin: fatal: ")
+	fmt.Fprintf(os.Stderr, "%s: fatal: ", nin.ProgramName)
 	fmt.Fprintf(os.Stderr, msg, s...)
 	fmt.Fprintf(os.Stderr, "\n")
 	// On Windows, some tools may inject extra threads.
@@ -47,21 +47,21 @@ func fatalf(msg string, s ...interface{}) {
 
 // Log a warning message.
 func warningf(msg string, s ...interface{}) {
-	fmt.Fprintf(os.Stderr, "nin: warning: ")
+	fmt.Fprintf(os.Stderr, "%s: warning: ", nin.ProgramName)
 	fmt.Fprintf(os.Stderr, msg, s...)
 	fmt.Fprintf(os.Stderr, "\n")
 }
 
 // Log an error message.
 func errorf(msg string, s ...interface{}) {
-	fmt.Fprintf(os.Stderr, "nin: error: ")
+	fmt.Fprintf(os.Stderr, "%s: error: ", nin.ProgramName)
 	fmt.Fprintf(os.Stderr, msg, s...)
 	fmt.Fprintf(os.Stderr, "\n")
 }
 
 // Log an informational message.
 func infof(msg string, s ...interface{}) {
-	fmt.Fprintf(os.Stdout, "nin: ")
+	fmt.Fprintf(os.Stdout, "%s: ", nin.ProgramName)
 	fmt.Fprintf(os.Stdout, msg, s...)
 	fmt.Fprintf(os.Stdout, "\n")
 }
@@ -15,11 +15,23 @@
 package main
 
 import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"math"
+	"net"
+	"net/http"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"runtime"
 	"runtime/debug"
@@ -28,6 +40,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/maruel/nin"
 )
@@ -45,10 +58,87 @@ type options struct {
 
 	// build.ninja parsing options.
 	parserOpts nin.ParseManifestOpts
+	// Only warn about outputs that differ only by case.
+	warnOutputCase bool
+	// Only warn about outputs outside of the build directory or that are
+	// source files.
+	warnOutputPath bool
 
 	cpuprofile string
 	memprofile string
 	trace      string
+
+	// Output format of the subtools, either "text" or "json".
+	format string
+
+	// File to write the JSON lines build events to, if any.
+	statusJSON string
+
+	// Trade speed for a smaller memory footprint.
+	lowMemory bool
+
+	// Do not run the commands, record the files they would write instead.
+	sandboxOutputs bool
+
+	// Stop at the first failure and print the failures at the end.
+	focus bool
+
+	// Number of lines of output to print per failed edge in the summary at the
+	// end of the build; 0 disables the summary.
+	failureSummary int
+	// Directory to write the full output of the failed edges to.
+	failureLogs string
+
+	// Print the resources used per rule at the end of the build.
+	rusage bool
+
+	// Build the edges that failed in the last build.
+	retryFailed bool
+
+	// Number of builds to archive in .ninja_history, for -t history and -t
+	// flaky.
+	keepHistory int
+
+	// Number of graph snapshots to keep in .ninja_history, for -t statediff.
+	keepSnapshots int
+
+	// Build only the edges compiling the source files given as targets.
+	single bool
+
+	// Scan the targets and hash the sources without running any command.
+	prime bool
+
+	// Ask for confirmation before running more than this number of edges.
+	confirm int
+
+	// Fail the commands modifying the files tracked by git.
+	readOnlySources bool
+
+	// JSON file configuring the launchers that wrap the commands of some
+	// rules.
+	launchers string
+
+	// Directory to remap the outputs under, overriding the manifest's outroot.
+	outputPrefix string
+
+	// Show the progress in the terminal title and taskbar.
+	title bool
+
+	// Hooks run on the build lifecycle events, from projectConfigFile.
+	hooks *buildHooks
+
+	// Endpoint receiving the build reports, from projectConfigFile, when
+	// opted in with -telemetry.
+	telemetry *telemetryConfig
+
+	// Masks the secrets in the status, summaries and logs, from
+	// projectConfigFile.
+	redactor *nin.Redactor
+
+	// Control how the commands are printed.
+	commandWidth int
+	showCommand  multi
+	showRspfile  multi
 }
 
 // The Ninja main() loads up a series of data structures; various tools need
@@ -66,12 +156,61 @@ type ninjaMain struct {
 	// Functions for accessing the disk.
 	di nin.RealDiskInterface
 
+	// overlay is set with -sandbox-outputs. The builder writes to it instead of
+	// the disk.
+	overlay *nin.OverlayFileSystem
+
+	// failureSummary and failureLogs are set with -failure-summary and
+	// -failure-logs.
+	failureSummary int
+	failureLogs    string
+	// rusage is set with -rusage.
+	rusage bool
+	// retryFailed is set with -retry-failed.
+	retryFailed bool
+	// keepHistory is set with -keep-history.
+	keepHistory int
+	// keepSnapshots is set with -keep-snapshots.
+	keepSnapshots int
+	// single is set with -single.
+	single bool
+	// confirm is set with -confirm.
+	confirm int
+	// readOnlySources is set with -readonly-sources.
+	readOnlySources bool
+	// telemetry is set with -telemetry.
+	telemetry *telemetryConfig
+	// redactor masks the secrets in the output of the commands.
+	redactor *nin.Redactor
+	// replay is set by -t replay to start the edges in the recorded order.
+	replay *nin.ReplaySchedule
+	// tests is set by -t test to reuse the cached test results.
+	tests *nin.TestCache
+	// launchers is loaded from -launchers.
+	launchers *nin.LauncherConfig
+	// statusJSON is set with -statusjson.
+	statusJSON *statusJSON
+	// outputPrefix is the directory the outputs were remapped under, set with
+	// -output-prefix or the manifest's outroot.
+	outputPrefix string
+
 	// The build directory, used for storing the build log etc.
 	buildDir string
 
 	buildLog nin.BuildLog
 	depsLog  nin.DepsLog
 
+	// printer is the terminal status printer, which is told about the builder
+	// of the build so it can render the plan's progress.
+	printer *statusPrinter
+
+	// manifestFiles are the files watched during the build, as per
+	// BuildConfig.ManifestChange.
+	manifestFiles []string
+	// manifestChanged is set when the build stopped because a manifest file
+	// changed.
+	manifestChanged bool
+
 	// The type of functions that are the entry points to tools (subcommands).
 
 	startTimeMillis int64
@@ -151,9 +290,62 @@ const (
 
 // Print usage information.
 func usage() {
-	fmt.Fprintf(os.Stderr, "usage: nin [options] [targets...]\n\n")
-	fmt.Fprintf(os.Stderr, "if targets are unspecified, builds the 'default' target (see manual).\n\n")
+	printUsage(os.Stderr)
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintf(w, "usage: nin [options] [targets...]\n\n")
+	fmt.Fprintf(w, "if targets are unspecified, builds the 'default' target (see manual).\n")
+	fmt.Fprintf(w, "@file reads additional targets from file, one per line.\n")
+	fmt.Fprintf(w, ":group builds the targets of a defaultgroup, see -t groups.\n")
+	if !compatNinja {
+		fmt.Fprintf(w, "nin help [topic] documents the manifest, tools, flags and environment.\n")
+	}
+	fmt.Fprintf(w, "\n")
+	out := flag.CommandLine.Output()
+	flag.CommandLine.SetOutput(w)
 	flag.PrintDefaults()
+	flag.CommandLine.SetOutput(out)
+}
+
+// unknownFlag returns an error with the closest flags for the first flag of
+// args not defined in fs. The flag package prints the whole usage instead.
+func unknownFlag(fs *flag.FlagSet, args []string) error {
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		if a == "--" || len(a) < 2 || a[0] != '-' {
+			return nil
+		}
+		name := strings.TrimPrefix(a[1:], "-")
+		hasValue := false
+		if j := strings.IndexByte(name, '='); j != -1 {
+			name, hasValue = name[:j], true
+		}
+		f := fs.Lookup(name)
+		if f == nil {
+			if name == "h" || name == "help" || name == "" || name[0] == '-' {
+				// Let the flag package handle them.
+				return nil
+			}
+			var names []string
+			fs.VisitAll(func(f *flag.Flag) {
+				names = append(names, f.Name)
+			})
+			suggestions := suggest(name, names...)
+			if len(suggestions) == 0 {
+				return fmt.Errorf("flag provided but not defined: -%s", name)
+			}
+			for j := range suggestions {
+				suggestions[j] = "-" + suggestions[j]
+			}
+			return fmt.Errorf("flag provided but not defined: -%s, did you mean %s?", name, nin.SuggestionText(suggestions))
+		}
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); !hasValue && (!ok || !b.IsBoolFlag()) {
+			// Skip the value.
+			i++
+		}
+	}
+	return nil
 }
 
 // Choose a default value for the -j (parallelism) flag.
@@ -169,6 +361,25 @@ func guessParallelism() int {
 }
 
 // Rebuild the build manifest, if necessary.
+// newBuilder returns a Builder for the loaded state.
+func (n *ninjaMain) newBuilder(status nin.Status) *nin.Builder {
+	var fs nin.FileSystem = &n.di
+	if n.overlay != nil {
+		fs = n.overlay
+	}
+	builder := nin.NewBuilder(&n.state, n.config, &n.buildLog, &n.depsLog, fs, status, n.startTimeMillis)
+	if n.overlay != nil {
+		builder.SandboxOutputs(n.overlay)
+	}
+	if n.replay != nil {
+		builder.Replay(n.replay)
+	}
+	if n.printer != nil {
+		n.printer.progress = builder.Progress
+	}
+	return builder
+}
+
 // Returns true if the manifest was rebuilt.
 // Rebuild the manifest, if necessary.
 // Fills in \a err on error.
@@ -180,10 +391,14 @@ func (n *ninjaMain) RebuildManifest(inputFile string, status nin.Status) (bool,
 	}
 	node := n.state.Paths[nin.CanonicalizePath(path)]
 	if node == nil {
-		return false, errors.New("path not found")
+		// The manifest is not generated by the build.
+		return false, nil
+	}
+	if !compatNinja {
+		n.state.AddGeneratorDeps(path)
 	}
 
-	builder := nin.NewBuilder(&n.state, n.config, &n.buildLog, &n.depsLog, &n.di, status, n.startTimeMillis)
+	builder := n.newBuilder(status)
 	if dirty, err := builder.AddTarget(node); !dirty {
 		return false, err
 	}
@@ -197,8 +412,9 @@ func (n *ninjaMain) RebuildManifest(inputFile string, status nin.Status) (bool,
 	}
 
 	// The manifest was only rebuilt if it is now dirty (it may have been cleaned
-	// by a restat).
-	if !node.Dirty {
+	// by a restat). A generator may write several files; any of them changing
+	// requires reloading.
+	if !node.Dirty && (compatNinja || !anyOutputDirty(node.InEdge)) {
 		// Reset the state to prevent problems like
 		// https://github.com/ninja-build/ninja/issues/874
 		n.state.Reset()
@@ -208,6 +424,19 @@ func (n *ninjaMain) RebuildManifest(inputFile string, status nin.Status) (bool,
 	return true, nil
 }
 
+// anyOutputDirty returns true if any output of edge is dirty.
+func anyOutputDirty(edge *nin.Edge) bool {
+	if edge == nil {
+		return false
+	}
+	for _, o := range edge.Outputs {
+		if o.Dirty {
+			return true
+		}
+	}
+	return false
+}
+
 // collectTarget gets the Node for a given command-line path, handling features
 // like spell correction.
 func (n *ninjaMain) collectTarget(cpath string) (*nin.Node, error) {
@@ -245,23 +474,80 @@ func (n *ninjaMain) collectTarget(cpath string) (*nin.Node, error) {
 		}
 		return node, nil
 	}
-	// TODO(maruel): Use %q for real quoting.
-	err := fmt.Sprintf("unknown target '%s'", nin.PathDecanonicalized(path, slashBits))
+	if n.outputPrefix != "" {
+		// Permit naming an output by its path before the remapping.
+		if node := n.state.Paths[n.outputPrefix+"/"+path]; node != nil && !firstDependent {
+			return node, nil
+		}
+	}
+	err := &nin.ErrUnknownTarget{Target: nin.PathDecanonicalized(path, slashBits)}
 	if path == "clean" {
-		err += ", did you mean 'nin -t clean'?"
+		err.Suggestion = nin.ProgramName + " -t clean"
 	} else if path == "help" {
-		err += ", did you mean 'nin -h'?"
-	} else {
-		suggestion := n.state.SpellcheckNode(path)
-		if suggestion != nil {
-			// TODO(maruel): Use %q for real quoting.
-			err += fmt.Sprintf(", did you mean '%s'?", suggestion.Path)
+		err.Suggestion = nin.ProgramName + " -h"
+	} else if compatNinja {
+		if node := n.state.SpellcheckNode(path); node != nil {
+			err.Suggestion = node.Path
+		}
+	} else if suggestions := n.state.SpellcheckNodes(path); len(suggestions) != 0 {
+		err.Suggestion = suggestions[0].Path
+		for _, s := range suggestions[1:] {
+			err.Alternatives = append(err.Alternatives, s.Path)
+		}
+	}
+	return nil, err
+}
+
+// suggest returns the closest matches to a misspelled text, best first. With
+// -compat, it is ninja's single suggestion.
+func suggest(text string, words ...string) []string {
+	if compatNinja {
+		if s := nin.SpellcheckString(text, words...); s != "" {
+			return []string{s}
+		}
+		return nil
+	}
+	return nin.SpellcheckStrings(text, words...)
+}
+
+// expandArgFiles replaces the arguments of the form "@file" with the targets
+// listed in file, one per line. Empty lines and lines starting with '#' are
+// ignored.
+func expandArgFiles(args []string) ([]string, error) {
+	var out []string
+	for _, a := range args {
+		if !strings.HasPrefix(a, "@") || len(a) == 1 {
+			out = append(out, a)
+			continue
+		}
+		targets, err := readTargetsFile(a[1:])
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, targets...)
+	}
+	return out, nil
+}
+
+// readTargetsFile returns the targets listed in a file, one per line.
+func readTargetsFile(path string) ([]string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, l := range strings.Split(string(b), "\n") {
+		if l = strings.TrimSpace(l); l != "" && l[0] != '#' {
+			out = append(out, l)
 		}
 	}
-	return nil, errors.New(err)
+	return out, nil
 }
 
 // collectTargetsFromArgs calls collectTarget for all command-line arguments.
+//
+// Arguments of the form ":group" are expanded to the targets of the
+// corresponding "defaultgroup" statement.
 func (n *ninjaMain) collectTargetsFromArgs(args []string) ([]*nin.Node, error) {
 	var targets []*nin.Node
 	if len(args) == 0 {
@@ -273,6 +559,15 @@ func (n *ninjaMain) collectTargetsFromArgs(args []string) ([]*nin.Node, error) {
 	}
 
 	for i := 0; i < len(args); i++ {
+		if !compatNinja && strings.HasPrefix(args[i], ":") && n.state.Paths[args[i]] == nil {
+			group, ok := n.state.Groups[args[i][1:]]
+			if !ok {
+				// TODO(maruel): Use %q for real quoting.
+				return targets, fmt.Errorf("unknown group '%s', see 'nin -t groups'", args[i][1:])
+			}
+			targets = append(targets, group...)
+			continue
+		}
 		node, err := n.collectTarget(args[i])
 		if node == nil {
 			return targets, err
@@ -290,6 +585,11 @@ func toolGraph(n *ninjaMain, opts *options, args []string) int {
 		return 1
 	}
 
+	if opts.format == "json" {
+		n.di.AllowStatCache(!disableExperimentalStatcache)
+		return printJSON(graphJSON(&n.di, nodes))
+	}
+
 	graph := nin.NewGraphViz(&n.state, &n.di)
 	graph.Start()
 	for _, n := range nodes {
@@ -299,6 +599,64 @@ func toolGraph(n *ninjaMain, opts *options, args []string) int {
 	return 0
 }
 
+// newJSONTarget returns node as printed in JSON, with the on-disk mtime and
+// size of its file if it exists.
+func newJSONTarget(fs nin.FileSystem, node *nin.Node) jsonTarget {
+	t := jsonTarget{Path: node.Path}
+	if node.InEdge != nil {
+		t.Rule = node.InEdge.Rule.Name
+	}
+	if mtime, size, err := nin.StatSize(fs, node.Path); err == nil && mtime > 0 {
+		t.MTime = int64(mtime)
+		if size >= 0 {
+			t.Size = &size
+		}
+	}
+	return t
+}
+
+// newSkippedJSONTarget returns the output p of an edge removed by its skip
+// binding.
+func newSkippedJSONTarget(p string, e *nin.SkippedEdge) jsonTarget {
+	return jsonTarget{Path: p, Rule: e.Rule.Name, Skipped: e.Condition}
+}
+
+// graphJSON returns the subgraph needed to build nodes.
+func graphJSON(fs nin.FileSystem, nodes []*nin.Node) jsonGraph {
+	out := jsonGraph{Nodes: []jsonTarget{}, Edges: []jsonGraphEdge{}}
+	seenNodes := map[*nin.Node]struct{}{}
+	seenEdges := map[*nin.Edge]struct{}{}
+	stack := append([]*nin.Node{}, nodes...)
+	for len(stack) != 0 {
+		node := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if _, ok := seenNodes[node]; ok {
+			continue
+		}
+		seenNodes[node] = struct{}{}
+		out.Nodes = append(out.Nodes, newJSONTarget(fs, node))
+		e := node.InEdge
+		if e == nil {
+			continue
+		}
+		if _, ok := seenEdges[e]; ok {
+			continue
+		}
+		seenEdges[e] = struct{}{}
+		j := jsonGraphEdge{Rule: e.Rule.Name, Inputs: make([]string, 0, len(e.Inputs)), Outputs: make([]string, 0, len(e.Outputs)), Meta: e.Meta()}
+		for _, i := range e.Inputs {
+			j.Inputs = append(j.Inputs, i.Path)
+			stack = append(stack, i)
+		}
+		for _, o := range e.Outputs {
+			j.Outputs = append(j.Outputs, o.Path)
+		}
+		out.Edges = append(out.Edges, j)
+	}
+	sort.Slice(out.Nodes, func(i, j int) bool { return out.Nodes[i].Path < out.Nodes[j].Path })
+	return out
+}
+
 func toolQuery(n *ninjaMain, opts *options, args []string) int {
 	if len(args) == 0 {
 		errorf("expected a target to query")
@@ -307,6 +665,8 @@ func toolQuery(n *ninjaMain, opts *options, args []string) int {
 
 	dyndepLoader := nin.NewDyndepLoader(&n.state, &n.di)
 
+	asJSON := opts.format == "json"
+	out := []jsonQuery{}
 	for i := 0; i < len(args); i++ {
 		node, err := n.collectTarget(args[i])
 		if err != nil {
@@ -314,13 +674,20 @@ func toolQuery(n *ninjaMain, opts *options, args []string) int {
 			return 1
 		}
 
-		fmt.Printf("%s:\n", node.Path)
 		if edge := node.InEdge; edge != nil {
 			if edge.Dyndep != nil && edge.Dyndep.DyndepPending {
 				if err := dyndepLoader.LoadDyndeps(edge.Dyndep, nin.DyndepFile{}); err != nil {
 					warningf("%s\n", err)
 				}
 			}
+		}
+		if asJSON {
+			out = append(out, queryJSON(node))
+			continue
+		}
+
+		fmt.Printf("%s:\n", node.Path)
+		if edge := node.InEdge; edge != nil {
 			fmt.Printf("  input: %s\n", edge.Rule.Name)
 			for in := 0; in < len(edge.Inputs); in++ {
 				label := ""
@@ -354,9 +721,48 @@ func toolQuery(n *ninjaMain, opts *options, args []string) int {
 			}
 		}
 	}
+	if asJSON {
+		return printJSON(jsonQueries{Nodes: out})
+	}
 	return 0
 }
 
+func queryJSON(node *nin.Node) jsonQuery {
+	q := jsonQuery{
+		Path:          node.Path,
+		Inputs:        []jsonQueryInput{},
+		Validations:   []string{},
+		Outputs:       []string{},
+		ValidationFor: []string{},
+	}
+	if edge := node.InEdge; edge != nil {
+		q.Rule = edge.Rule.Name
+		for in := 0; in < len(edge.Inputs); in++ {
+			kind := "explicit"
+			if edge.IsImplicit(in) {
+				kind = "implicit"
+			} else if edge.IsOrderOnly(in) {
+				kind = "order_only"
+			}
+			q.Inputs = append(q.Inputs, jsonQueryInput{Path: edge.Inputs[in].Path, Kind: kind})
+		}
+		for _, validation := range edge.Validations {
+			q.Validations = append(q.Validations, validation.Path)
+		}
+	}
+	for _, edge := range node.OutEdges {
+		for _, out := range edge.Outputs {
+			q.Outputs = append(q.Outputs, out.Path)
+		}
+	}
+	for _, edge := range node.ValidationOutEdges {
+		for _, out := range edge.Outputs {
+			q.ValidationFor = append(q.ValidationFor, out.Path)
+		}
+	}
+	return q
+}
+
 func toolBrowse(n *ninjaMain, opts *options, args []string) int {
 	runBrowsePython(&n.state, n.ninjaCommand, opts.inputFile, args)
 	return 0
@@ -390,18 +796,38 @@ func toolTargetsListNodes(nodes []*nin.Node, depth int, indent int) int {
 	return 0
 }
 
-func toolTargetsSourceList(state *nin.State) int {
+func toolTargetsListNodesJSON(fs nin.FileSystem, nodes []*nin.Node, depth int) []jsonTarget {
+	out := make([]jsonTarget, 0, len(nodes))
+	for _, n := range nodes {
+		t := newJSONTarget(fs, n)
+		if n.InEdge != nil && (depth > 1 || depth <= 0) {
+			t.Inputs = toolTargetsListNodesJSON(fs, n.InEdge.Inputs, depth-1)
+		}
+		out = append(out, t)
+	}
+	return out
+}
+
+func toolTargetsSourceList(state *nin.State, fs nin.FileSystem, asJSON bool) int {
+	out := []jsonTarget{}
 	for _, e := range state.Edges {
 		for _, inps := range e.Inputs {
 			if inps.InEdge == nil {
-				fmt.Printf("%s\n", inps.Path)
+				if asJSON {
+					out = append(out, newJSONTarget(fs, inps))
+				} else {
+					fmt.Printf("%s\n", inps.Path)
+				}
 			}
 		}
 	}
+	if asJSON {
+		return printJSON(jsonTargets{Targets: out})
+	}
 	return 0
 }
 
-func toolTargetsListRule(state *nin.State, ruleName string) int {
+func toolTargetsListRule(state *nin.State, fs nin.FileSystem, ruleName string, asJSON bool) int {
 	rules := map[string]struct{}{}
 
 	// Gather the outputs.
@@ -412,24 +838,182 @@ func toolTargetsListRule(state *nin.State, ruleName string) int {
 			}
 		}
 	}
+	// The outputs of the skipped edges, unless another edge generates them.
+	skipped := map[string]*nin.SkippedEdge{}
+	for i, e := range state.Skipped {
+		if e.Rule.Name == ruleName {
+			for _, o := range e.Outputs {
+				if _, ok := rules[o]; !ok {
+					skipped[o] = &state.Skipped[i]
+				}
+			}
+		}
+	}
 
-	names := make([]string, 0, len(rules))
+	names := make([]string, 0, len(rules)+len(skipped))
 	for n := range rules {
 		names = append(names, n)
 	}
+	for n := range skipped {
+		names = append(names, n)
+	}
 	sort.Strings(names)
+	if asJSON {
+		out := make([]jsonTarget, 0, len(names))
+		for _, i := range names {
+			if e := skipped[i]; e != nil {
+				out = append(out, newSkippedJSONTarget(i, e))
+			} else {
+				out = append(out, newJSONTarget(fs, state.Paths[i]))
+			}
+		}
+		return printJSON(jsonTargets{Targets: out})
+	}
 	// Print them.
 	for _, i := range names {
-		fmt.Printf("%s\n", i)
+		if skipped[i] != nil {
+			fmt.Printf("%s (skipped)\n", i)
+		} else {
+			fmt.Printf("%s\n", i)
+		}
 	}
 	return 0
 }
 
-func toolTargetsList(state *nin.State) int {
+func toolTargetsList(state *nin.State, fs nin.FileSystem, asJSON bool) int {
+	out := []jsonTarget{}
 	for _, e := range state.Edges {
 		for _, outNode := range e.Outputs {
-			fmt.Printf("%s: %s\n", outNode.Path, e.Rule.Name)
+			if asJSON {
+				out = append(out, newJSONTarget(fs, outNode))
+			} else {
+				fmt.Printf("%s: %s\n", outNode.Path, e.Rule.Name)
+			}
+		}
+	}
+	for i, e := range state.Skipped {
+		for _, o := range e.Outputs {
+			if asJSON {
+				out = append(out, newSkippedJSONTarget(o, &state.Skipped[i]))
+			} else {
+				fmt.Printf("%s: %s (skipped: %s)\n", o, e.Rule.Name, e.Condition)
+			}
+		}
+	}
+	if asJSON {
+		return printJSON(jsonTargets{Targets: out})
+	}
+	return 0
+}
+
+// toolTargetsRdeps lists all the outputs that transitively depend on node.
+func toolTargetsRdeps(fs nin.FileSystem, node *nin.Node, depsLog *nin.DepsLog, asJSON bool) int {
+	nodes := targetsRdeps(node, depsLog)
+	if asJSON {
+		out := make([]jsonTarget, 0, len(nodes))
+		for _, n := range nodes {
+			out = append(out, newJSONTarget(fs, n))
+		}
+		return printJSON(jsonTargets{Targets: out})
+	}
+	for _, n := range nodes {
+		fmt.Printf("%s\n", n.Path)
+	}
+	return 0
+}
+
+// targetsRdeps returns the outputs that transitively depend on node, sorted,
+// following both the manifest and the dependencies recorded in depsLog, e.g.
+// the headers discovered with deps = gcc.
+func targetsRdeps(node *nin.Node, depsLog *nin.DepsLog) []*nin.Node {
+	revDeps := map[*nin.Node][]*nin.Node{}
+	for id, deps := range depsLog.Deps {
+		if deps == nil {
+			continue
+		}
+		for _, i := range deps.Nodes {
+			revDeps[i] = append(revDeps[i], depsLog.Nodes[id])
+		}
+	}
+	seen := map[*nin.Node]struct{}{node: {}}
+	stack := []*nin.Node{node}
+	var nodes []*nin.Node
+	visit := func(o *nin.Node) {
+		if _, ok := seen[o]; !ok {
+			seen[o] = struct{}{}
+			nodes = append(nodes, o)
+			stack = append(stack, o)
+		}
+	}
+	for len(stack) != 0 {
+		n := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for _, e := range n.OutEdges {
+			for _, o := range e.Outputs {
+				visit(o)
+			}
+		}
+		for _, o := range revDeps[n] {
+			visit(o)
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Path < nodes[j].Path })
+	return nodes
+}
+
+// toolTargetsLeafDepth prints the height of each target in the DAG, that is
+// the length of the longest path down to a source file.
+func toolTargetsLeafDepth(state *nin.State, fs nin.FileSystem, asJSON bool) int {
+	// heights is -1 while a node is being visited to not loop forever on
+	// cycles.
+	heights := map[*nin.Node]int{}
+	var height func(n *nin.Node) int
+	height = func(n *nin.Node) int {
+		if h, ok := heights[n]; ok {
+			if h < 0 {
+				return 0
+			}
+			return h
 		}
+		h := 0
+		if n.InEdge != nil {
+			heights[n] = -1
+			for _, i := range n.InEdge.Inputs {
+				if c := height(i) + 1; c > h {
+					h = c
+				}
+			}
+		}
+		heights[n] = h
+		return h
+	}
+
+	var targets []*nin.Node
+	for _, e := range state.Edges {
+		targets = append(targets, e.Outputs...)
+	}
+	for _, t := range targets {
+		height(t)
+	}
+	// Highest first.
+	sort.Slice(targets, func(i, j int) bool {
+		if hi, hj := heights[targets[i]], heights[targets[j]]; hi != hj {
+			return hi > hj
+		}
+		return targets[i].Path < targets[j].Path
+	})
+	if asJSON {
+		out := make([]jsonTarget, 0, len(targets))
+		for _, t := range targets {
+			h := heights[t]
+			j := newJSONTarget(fs, t)
+			j.Height = &h
+			out = append(out, j)
+		}
+		return printJSON(jsonTargets{Targets: out})
+	}
+	for _, t := range targets {
+		fmt.Printf("%d %s\n", heights[t], t.Path)
 	}
 	return 0
 }
@@ -451,11 +1035,17 @@ func toolDeps(n *ninjaMain, opts *options, args []string) int {
 		}
 	}
 
+	asJSON := opts.format == "json"
+	out := []jsonDeps{}
 	di := nin.RealDiskInterface{}
 	for _, it := range nodes {
 		deps := n.depsLog.GetDeps(it)
 		if deps == nil {
-			fmt.Printf("%s: deps not found\n", it.Path)
+			if asJSON {
+				out = append(out, jsonDeps{Path: it.Path, Deps: []string{}})
+			} else {
+				fmt.Printf("%s: deps not found\n", it.Path)
+			}
 			continue
 		}
 
@@ -463,8 +1053,17 @@ func toolDeps(n *ninjaMain, opts *options, args []string) int {
 		if mtime == -1 {
 			errorf("%s", err) // Log and ignore Stat() errors;
 		}
+		valid := !(mtime == 0 || mtime > deps.MTime)
+		if asJSON {
+			d := jsonDeps{Path: it.Path, Found: true, MTime: int64(deps.MTime), Valid: valid, Deps: make([]string, 0, len(deps.Nodes))}
+			for _, n := range deps.Nodes {
+				d.Deps = append(d.Deps, n.Path)
+			}
+			out = append(out, d)
+			continue
+		}
 		s := "VALID"
-		if mtime == 0 || mtime > deps.MTime {
+		if !valid {
 			s = "STALE"
 		}
 		fmt.Printf("%s: #deps %d, deps mtime %d (%s)\n", it.Path, len(deps.Nodes), deps.MTime, s)
@@ -473,6 +1072,9 @@ func toolDeps(n *ninjaMain, opts *options, args []string) int {
 		}
 		fmt.Printf("\n")
 	}
+	if asJSON {
+		return printJSON(jsonDepsList{Deps: out})
+	}
 	return 0
 }
 
@@ -495,6 +1097,10 @@ func toolMissingDeps(n *ninjaMain, opts *options, args []string) int {
 }
 
 func toolTargets(n *ninjaMain, opts *options, args []string) int {
+	asJSON := opts.format == "json"
+	if asJSON {
+		n.di.AllowStatCache(!disableExperimentalStatcache)
+	}
 	depth := 1
 	if len(args) >= 1 {
 		mode := args[0]
@@ -504,9 +1110,9 @@ func toolTargets(n *ninjaMain, opts *options, args []string) int {
 				rule = args[1]
 			}
 			if len(rule) == 0 {
-				return toolTargetsSourceList(&n.state)
+				return toolTargetsSourceList(&n.state, &n.di, asJSON)
 			}
-			return toolTargetsListRule(&n.state, rule)
+			return toolTargetsListRule(&n.state, &n.di, rule, asJSON)
 		}
 		if mode == "depth" {
 			if len(args) > 1 {
@@ -514,11 +1120,33 @@ func toolTargets(n *ninjaMain, opts *options, args []string) int {
 				depth, _ = strconv.Atoi(args[1])
 			}
 		} else if mode == "all" {
-			return toolTargetsList(&n.state)
+			return toolTargetsList(&n.state, &n.di, asJSON)
+		} else if mode == "rdeps" {
+			if len(args) != 2 {
+				errorf("usage: nin -t targets rdeps <path>")
+				return 1
+			}
+			// Load the deps log so the dependencies discovered while building,
+			// e.g. the headers, are known.
+			depsPath := ".ninja_deps"
+			if buildDir := n.state.Bindings.LookupVariable("builddir"); buildDir != "" {
+				depsPath = filepath.Join(buildDir, depsPath)
+			}
+			if err := n.depsLog.Load(depsPath, &n.state); err != nil && !os.IsNotExist(err) {
+				warningf("loading deps log %s: %s", depsPath, err)
+			}
+			node, err := n.collectTarget(args[1])
+			if node == nil {
+				errorf("%s", err)
+				return 1
+			}
+			return toolTargetsRdeps(&n.di, node, &n.depsLog, asJSON)
+		} else if mode == "leafdepth" {
+			return toolTargetsLeafDepth(&n.state, &n.di, asJSON)
 		} else {
-			suggestion := nin.SpellcheckString(mode, "rule", "depth", "all")
-			if suggestion != "" {
-				errorf("unknown target tool mode '%s', did you mean '%s'?", mode, suggestion)
+			suggestions := suggest(mode, "rule", "depth", "all", "rdeps", "leafdepth")
+			if len(suggestions) != 0 {
+				errorf("unknown target tool mode '%s', did you mean %s?", mode, nin.SuggestionText(suggestions))
 			} else {
 				errorf("unknown target tool mode '%s'", mode)
 			}
@@ -527,12 +1155,18 @@ func toolTargets(n *ninjaMain, opts *options, args []string) int {
 	}
 
 	if rootNodes := n.state.RootNodes(); len(rootNodes) != 0 {
+		if asJSON {
+			return printJSON(jsonTargets{Targets: toolTargetsListNodesJSON(&n.di, rootNodes, depth)})
+		}
 		return toolTargetsListNodes(rootNodes, depth, 0)
 	}
 	errorf("could not determine root nodes of build graph")
 	return 1
 }
 
+// ruleDetailsBindings are the bindings printed by "nin -v -t rules".
+var ruleDetailsBindings = []string{"command", "description", "deps"}
+
 func toolRules(n *ninjaMain, opts *options, args []string) int {
 	// HACK: parse one additional flag.
 	//fmt.Printf("usage: nin -t rules [options]\n\noptions:\n  -d     also print the description of the rule\n  -h     print this message\n")
@@ -554,11 +1188,47 @@ func toolRules(n *ninjaMain, opts *options, args []string) int {
 	}
 	sort.Strings(names)
 
+	// Count the usage of each rule and keep the first edge as an example to
+	// expand the bindings.
+	uses := map[*nin.Rule]int{}
+	examples := map[*nin.Rule]*nin.Edge{}
+	for _, e := range n.state.Edges {
+		if uses[e.Rule]++; examples[e.Rule] == nil {
+			examples[e.Rule] = e
+		}
+	}
+
+	if opts.format == "json" {
+		out := make([]jsonRule, 0, len(names))
+		for _, name := range names {
+			rule := rules[name]
+			r := jsonRule{Name: name, Filename: rule.Filename, Edges: uses[rule], Bindings: map[string]jsonBinding{}}
+			if description := rule.Bindings["description"]; description != nil {
+				r.Description = description.Unparse()
+			}
+			for _, key := range ruleDetailsBindings {
+				if b := rule.Bindings[key]; b != nil {
+					j := jsonBinding{Unparsed: b.Unparse()}
+					if e := examples[rule]; e != nil {
+						j.Example = e.GetBinding(key)
+					}
+					r.Bindings[key] = j
+				}
+			}
+			out = append(out, r)
+		}
+		return printJSON(jsonRules{Rules: out})
+	}
+
 	// Print rules
 	for _, name := range names {
+		rule := rules[name]
+		if n.config.Verbosity == nin.Verbose {
+			printRuleDetails(rule, uses[rule], examples[rule])
+			continue
+		}
 		fmt.Printf("%s", name)
 		if printDescription {
-			rule := rules[name]
 			description := rule.Bindings["description"]
 			if description != nil {
 				fmt.Printf(": %s", description.Unparse())
@@ -569,6 +1239,26 @@ func toolRules(n *ninjaMain, opts *options, args []string) int {
 	return 0
 }
 
+// printRuleDetails prints the bindings of a rule, and an example expansion
+// using one of the edges using this rule.
+func printRuleDetails(rule *nin.Rule, uses int, example *nin.Edge) {
+	filename := rule.Filename
+	if filename == "" {
+		filename = "builtin"
+	}
+	fmt.Printf("%s: %d edges, defined in %s\n", rule.Name, uses, filename)
+	for _, key := range ruleDetailsBindings {
+		b := rule.Bindings[key]
+		if b == nil {
+			continue
+		}
+		fmt.Printf("  %s = %s\n", key, b.Unparse())
+		if example != nil {
+			fmt.Printf("    e.g. %s\n", example.GetBinding(key))
+		}
+	}
+}
+
 func toolWinCodePage(n *ninjaMain, opts *options, args []string) int {
 	panic("TODO") // Windows only
 	/*
@@ -592,7 +1282,7 @@ const (
 	pcmAll    printCommandMode = true
 )
 
-func printCommands(edge *nin.Edge, seen map[*nin.Edge]struct{}, mode printCommandMode) {
+func printCommands(edge *nin.Edge, seen map[*nin.Edge]struct{}, mode printCommandMode, out *[]jsonCommand) {
 	if edge == nil {
 		return
 	}
@@ -603,12 +1293,25 @@ func printCommands(edge *nin.Edge, seen map[*nin.Edge]struct{}, mode printComman
 
 	if mode == pcmAll {
 		for _, in := range edge.Inputs {
-			printCommands(in.InEdge, seen, mode)
+			printCommands(in.InEdge, seen, mode, out)
 		}
 	}
 
 	if edge.Rule != nin.PhonyRule {
-		fmt.Printf("%s\n", (edge.EvaluateCommand(false)))
+		if out == nil {
+			if cwd := edge.Cwd(); cwd != "" {
+				// Keep the commands runnable from the build directory.
+				fmt.Printf("(cd %s && %s)\n", cwd, edge.EvaluateCommand(false))
+				return
+			}
+			fmt.Printf("%s\n", (edge.EvaluateCommand(false)))
+			return
+		}
+		c := jsonCommand{Rule: edge.Rule.Name, Outputs: make([]string, 0, len(edge.Outputs)), Command: edge.EvaluateCommand(false), Cwd: edge.Cwd()}
+		for _, o := range edge.Outputs {
+			c.Outputs = append(c.Outputs, o.Path)
+		}
+		*out = append(*out, c)
 	}
 }
 
@@ -633,8 +1336,15 @@ func toolCommands(n *ninjaMain, opts *options, args []string) int {
 	}
 
 	seen := map[*nin.Edge]struct{}{}
+	if opts.format == "json" {
+		out := []jsonCommand{}
+		for _, in := range nodes {
+			printCommands(in.InEdge, seen, mode, &out)
+		}
+		return printJSON(jsonCommands{Commands: out})
+	}
 	for _, in := range nodes {
-		printCommands(in.InEdge, seen, mode)
+		printCommands(in.InEdge, seen, mode, nil)
 	}
 	return 0
 }
@@ -665,14 +1375,34 @@ func toolClean(n *ninjaMain, opts *options, args []string) int {
 		return 1
 	}
 
-	cleaner := nin.NewCleaner(&n.state, n.config, &n.di)
+	config := n.config
+	if opts.format == "json" {
+		// Silence the text output.
+		c := *n.config
+		c.Verbosity = nin.Quiet
+		config = &c
+	}
+	cleaner := nin.NewCleaner(&n.state, config, &n.di)
+	ret := 0
 	if len(args) >= 1 {
 		if cleanRules {
-			return cleaner.CleanRules(args)
+			ret = cleaner.CleanRules(args)
+		} else {
+			ret = cleaner.CleanTargets(args)
+		}
+	} else {
+		ret = cleaner.CleanAll(generator)
+	}
+	if opts.format == "json" {
+		removed := cleaner.CleanedFiles()
+		if removed == nil {
+			removed = []string{}
+		}
+		if r := printJSON(jsonClean{Removed: removed, DryRun: config.DryRun}); ret == 0 {
+			ret = r
 		}
-		return cleaner.CleanTargets(args)
 	}
-	return cleaner.CleanAll(generator)
+	return ret
 }
 
 func toolCleanDead(n *ninjaMain, opts *options, args []string) int {
@@ -717,17 +1447,50 @@ func evaluateCommandWithRspfile(edge *nin.Edge, mode evaluateCommandMode) string
 }
 
 func printCompdb(directory string, edge *nin.Edge, evalMode evaluateCommandMode) {
+	file, output := edge.Inputs[0].Path, edge.Outputs[0].Path
+	if cwd := edge.Cwd(); cwd != "" {
+		// The paths are relative to the directory the command runs in.
+		if !filepath.IsAbs(cwd) {
+			cwd = filepath.Join(directory, cwd)
+		}
+		file, output = relTo(cwd, filepath.Join(directory, file)), relTo(cwd, filepath.Join(directory, output))
+		directory = cwd
+	}
 	fmt.Printf("\n  {\n    \"directory\": \"")
 	printJSONString(directory)
 	fmt.Printf("\",\n    \"command\": \"")
 	printJSONString(evaluateCommandWithRspfile(edge, evalMode))
 	fmt.Printf("\",\n    \"file\": \"")
-	printJSONString(edge.Inputs[0].Path)
+	printJSONString(file)
 	fmt.Printf("\",\n    \"output\": \"")
-	printJSONString(edge.Outputs[0].Path)
+	printJSONString(output)
+	if meta := edge.Meta(); len(meta) != 0 && !compatNinja {
+		fmt.Printf("\",\n    \"meta\": {")
+		keys := make([]string, 0, len(meta))
+		for k := range meta {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for i, k := range keys {
+			if i != 0 {
+				fmt.Printf(", ")
+			}
+			fmt.Printf("\"%s\": \"%s\"", encodeJSONString(k), encodeJSONString(meta[k]))
+		}
+		fmt.Printf("}\n  }")
+		return
+	}
 	fmt.Printf("\"\n  }")
 }
 
+// relTo returns the absolute path p relative to dir, or p if it can't be.
+func relTo(dir, p string) string {
+	if r, err := filepath.Rel(dir, p); err == nil {
+		return r
+	}
+	return p
+}
+
 func toolCompilationDatabase(n *ninjaMain, opts *options, args []string) int {
 	// HACK: parse one additional flag.
 	// fmt.Printf( "usage: nin -t compdb [options] [rules]\n\noptions:\n  -x     expand @rspfile style response file invocations\n" )
@@ -788,28 +1551,135 @@ func toolRecompact(n *ninjaMain, opts *options, args []string) int {
 	return 0
 }
 
-func toolRestat(n *ninjaMain, opts *options, args []string) int {
-	if !n.EnsureBuildDirExists() {
-		return 1
+func toolBundle(n *ninjaMain, opts *options, args []string) int {
+	// HACK: parse an additional flag.
+	output := ""
+	for i := 0; i < len(args); i++ {
+		if args[i] == "-o" {
+			if i == len(args)-1 {
+				errorf("usage: -t bundle [targets] -o FILE")
+				return 1
+			}
+			output = args[i+1]
+			args = append(args[:i], args[i+2:]...)
+			break
+		}
 	}
-
+	targets, err := n.collectTargetsFromArgs(args)
+	if err != nil {
+		errorf("%s", err)
+		return 1
+	}
+	if err := n.state.LoadScannedIncludes(&n.di); err != nil {
+		errorf("%s", err)
+		return 1
+	}
+	files := n.state.InputClosure(targets, &n.depsLog)
+	// The main manifest is not loaded via an include statement.
+	if i := sort.SearchStrings(files, opts.inputFile); i == len(files) || files[i] != opts.inputFile {
+		files = append(files, opts.inputFile)
+		sort.Strings(files)
+	}
+	result := jsonBundle{Files: files}
+	switch {
+	case output == "":
+	case strings.HasSuffix(output, ".tar"), strings.HasSuffix(output, ".tar.gz"), strings.HasSuffix(output, ".tgz"):
+		f, err := os.Create(output)
+		if err != nil {
+			errorf("%s", err)
+			return 1
+		}
+		var w io.WriteCloser = f
+		if !strings.HasSuffix(output, ".tar") {
+			w = gzip.NewWriter(f)
+		}
+		result.Missing, err = nin.WriteBundle(w, files)
+		if err == nil && w != f {
+			err = w.Close()
+		}
+		if err2 := f.Close(); err == nil {
+			err = err2
+		}
+		if err != nil {
+			errorf("writing %s: %s", output, err)
+			return 1
+		}
+	default:
+		if err := ioutil.WriteFile(output, []byte(strings.Join(files, "\n")+"\n"), 0o666); err != nil {
+			errorf("%s", err)
+			return 1
+		}
+	}
+	if opts.format == "json" {
+		return printJSON(result)
+	}
+	if output == "" {
+		for _, f := range files {
+			fmt.Printf("%s\n", f)
+		}
+	} else {
+		for _, m := range result.Missing {
+			warningf("%s not found", m)
+		}
+		fmt.Printf("wrote %d files to %s\n", len(files)-len(result.Missing), output)
+	}
+	return 0
+}
+
+func toolRelocate(n *ninjaMain, opts *options, args []string) int {
+	if len(args) != 2 {
+		errorf("usage: -t relocate OLD NEW")
+		return 1
+	}
+	r, err := nin.NewRelocation(args[0], args[1])
+	if err != nil {
+		errorf("%s", err)
+		return 1
+	}
+	if !n.EnsureBuildDirExists() {
+		return 1
+	}
+	depsPath := ".ninja_deps"
+	if n.buildDir != "" {
+		depsPath = filepath.Join(n.buildDir, depsPath)
+	}
+	for _, l := range []struct {
+		path     string
+		relocate func(string, nin.Relocation) (int, error)
+	}{
+		{n.buildLogPath(), nin.RelocateBuildLog},
+		{depsPath, nin.RelocateDepsLog},
+	} {
+		changed, err := l.relocate(l.path, r)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			errorf("relocating %s: %s", l.path, err)
+			return 1
+		}
+		fmt.Printf("%s: relocated %d paths\n", l.path, changed)
+	}
+	return 0
+}
+
+func toolRestat(n *ninjaMain, opts *options, args []string) int {
+	if !n.EnsureBuildDirExists() {
+		return 1
+	}
+
 	logPath := ".ninja_log"
 	if n.buildDir != "" {
 		logPath = filepath.Join(n.buildDir, logPath)
 	}
 
-	status, err := n.buildLog.Load(logPath)
-	if status == nin.LoadError {
-		errorf("loading build log %s: %s", logPath, err)
-		return nin.ExitFailure
-	}
-	if status == nin.LoadNotFound {
+	if err := n.buildLog.Load(logPath); os.IsNotExist(err) {
 		// Nothing to restat, ignore this
 		return nin.ExitSuccess
-	}
-	if err != nil {
-		// Hack: Load() can return a warning via err by returning LOAD_SUCCESS.
+	} else if errors.Is(err, &nin.ErrLogDiscarded{}) {
 		warningf("%s", err)
+	} else if err != nil {
+		errorf("loading build log %s: %s", logPath, err)
+		return nin.ExitFailure
 	}
 
 	if err := n.buildLog.Restat(logPath, &n.di, args); err != nil {
@@ -827,271 +1697,2170 @@ func toolRestat(n *ninjaMain, opts *options, args []string) int {
 	return nin.ExitSuccess
 }
 
-// Find the function to execute for \a toolName and return it via \a func.
-// Returns a Tool, or NULL if Ninja should exit.
-func chooseTool(toolName string) *tool {
-	tools := []*tool{
-		{"browse", "browse dependency graph in a web browser", runAfterLoad, toolBrowse},
-		//{"msvc", "build helper for MSVC cl.exe (EXPERIMENTAL)",runAfterFlags, toolMSVC},
-		{"clean", "clean built files", runAfterLoad, toolClean},
-		{"commands", "list all commands required to rebuild given targets", runAfterLoad, toolCommands},
-		{"deps", "show dependencies stored in the deps log", runAfterLogs, toolDeps},
-		{"missingdeps", "check deps log dependencies on generated files", runAfterLogs, toolMissingDeps},
-		{"graph", "output graphviz dot file for targets", runAfterLoad, toolGraph},
-		{"query", "show inputs/outputs for a path", runAfterLogs, toolQuery},
-		{"targets", "list targets by their rule or depth in the DAG", runAfterLoad, toolTargets},
-		{"compdb", "dump JSON compilation database to stdout", runAfterLoad, toolCompilationDatabase},
-		{"recompact", "recompacts ninja-internal data structures", runAfterLoad, toolRecompact},
-		{"restat", "restats all outputs in the build log", runAfterFlags, toolRestat},
-		{"rules", "list all rules", runAfterLoad, toolRules},
-		{"cleandead", "clean built files that are no longer produced by the manifest", runAfterLogs, toolCleanDead},
-		//{"wincodepage", "print the Windows code page used by nin", runAfterFlags, toolWinCodePage},
+// toolRusage prints the resources used per rule as recorded in the build log.
+func toolRusage(n *ninjaMain, opts *options, args []string) int {
+	usage := nin.UsageSummary{}
+	usage.RecordBuildLog(&n.state, &n.buildLog)
+	rules := usage.Rules()
+	if opts.format == "json" {
+		out := make([]jsonRuleUsage, 0, len(rules))
+		for _, r := range rules {
+			out = append(out, jsonRuleUsage{
+				Rule:         r.Rule,
+				Edges:        r.Edges,
+				UserMS:       r.UserTime.Milliseconds(),
+				SystemMS:     r.SystemTime.Milliseconds(),
+				MaxRSS:       r.MaxRSS,
+				ReadBytes:    r.ReadBytes,
+				WrittenBytes: r.WrittenBytes,
+			})
+		}
+		return printJSON(jsonRusage{Rules: out})
 	}
-	if toolName == "list" {
-		fmt.Printf("nin subtools:\n")
-		for _, t := range tools {
-			if t.desc != "" {
-				fmt.Printf("%11s  %s\n", t.name, t.desc)
+	printRuleUsage(rules)
+	return 0
+}
+
+func toolAnalyze(n *ninjaMain, opts *options, args []string) int {
+	// HACK: parse an additional flag.
+	config := nin.AnalyzerConfig{Command: "clang-tidy --quiet $in -- $flags > $out", Dir: ".nin_analysis"}
+	if len(args) >= 2 && args[0] == "-command" {
+		config.Command = args[1]
+		args = args[2:]
+	}
+	if buildDir := n.state.Bindings.LookupVariable("builddir"); buildDir != "" {
+		config.Dir = filepath.Join(buildDir, config.Dir)
+	}
+	nodes, err := nin.AddAnalyzerEdges(&n.state, &n.depsLog, &config)
+	if err != nil {
+		errorf("%s", err)
+		return 1
+	}
+	// Only analyze the source files listed, if any.
+	if len(args) != 0 {
+		sources := map[string]struct{}{}
+		for _, a := range args {
+			p, _ := nin.CanonicalizePathBits(a)
+			sources[p] = struct{}{}
+		}
+		j := 0
+		for _, node := range nodes {
+			if _, ok := sources[node.InEdge.Inputs[0].Path]; ok {
+				nodes[j] = node
+				j++
+			}
+		}
+		nodes = nodes[:j]
+	}
+	if len(nodes) == 0 {
+		errorf("no source file to analyze")
+		return 1
+	}
+	targets := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		targets = append(targets, node.Path)
+	}
+	ret := n.RunBuild(targets, n.printer)
+	if n.config.DryRun {
+		return ret
+	}
+	// Print the results, including the ones of the previous runs.
+	for _, node := range nodes {
+		if c, err := ioutil.ReadFile(node.Path); err == nil && len(c) != 0 {
+			fmt.Printf("%s:\n%s", node.InEdge.Inputs[0].Path, c)
+			if c[len(c)-1] != '\n' {
+				fmt.Println()
 			}
 		}
-		return nil
 	}
+	return ret
+}
 
-	for _, t := range tools {
-		if t.name == toolName {
-			return t
+func toolGeneratedHeaders(n *ninjaMain, opts *options, args []string) int {
+	// HACK: parse an additional flag.
+	build := false
+	if len(args) == 1 && args[0] == "-build" {
+		build = true
+	} else if len(args) != 0 {
+		errorf("usage: -t generated-headers [-- -build]")
+		return 1
+	}
+	nodes := nin.GeneratedHeaders(&n.state, &n.depsLog)
+	if build {
+		if len(nodes) == 0 {
+			infof("no generated header")
+			return 0
+		}
+		targets := make([]string, 0, len(nodes))
+		for _, node := range nodes {
+			targets = append(targets, node.Path)
+		}
+		return n.RunBuild(targets, n.printer)
+	}
+	if opts.format == "json" {
+		out := jsonGeneratedHeaders{Files: make([]string, 0, len(nodes))}
+		for _, node := range nodes {
+			out.Files = append(out.Files, node.Path)
 		}
+		return printJSON(out)
 	}
+	for _, node := range nodes {
+		fmt.Println(node.Path)
+	}
+	return 0
+}
 
-	var words []string
-	for _, t := range tools {
-		words = append(words, t.name)
+func toolSandboxProfile(n *ninjaMain, opts *options, args []string) int {
+	// HACK: parse an additional flag.
+	denyNetwork := false
+	if len(args) != 0 && args[0] == "-deny-network" {
+		denyNetwork = true
+		args = args[1:]
 	}
-	suggestion := nin.SpellcheckString(toolName, words...)
-	if suggestion != "" {
-		fatalf("unknown tool '%s', did you mean '%s'?", toolName, suggestion)
-	} else {
-		fatalf("unknown tool '%s'", toolName)
+	if len(args) != 1 {
+		errorf("usage: -t sandbox-profile [-- -deny-network] target")
+		return 1
 	}
-	return nil // Not reached.
+	node, err := n.collectTarget(args[0])
+	if err != nil {
+		errorf("%s", err)
+		return 1
+	}
+	if node.InEdge == nil || node.InEdge.Rule == nin.PhonyRule {
+		errorf("%s is not built by a command", node.Path)
+		return 1
+	}
+	wd, err := os.Getwd()
+	if err == nil {
+		// The sandbox sees the resolved paths, e.g. /private/tmp for /tmp.
+		wd, err = filepath.EvalSymlinks(wd)
+	}
+	if err != nil {
+		errorf("%s", err)
+		return 1
+	}
+	fmt.Print(nin.SandboxProfile(node.InEdge, wd, denyNetwork))
+	return 0
 }
 
-var (
-	disableExperimentalStatcache bool
-	metricsEnabled               bool
-)
+func toolTune(n *ninjaMain, opts *options, args []string) int {
+	// HACK: parse an additional flag.
+	output := ""
+	if len(args) == 2 && args[0] == "-o" {
+		output = args[1]
+	} else if len(args) != 0 {
+		errorf("usage: -t tune [-- -o FILE]")
+		return 1
+	}
+	memory := n.config.MemoryLimit
+	if memory == 0 {
+		memory = physicalMemory()
+	}
+	pools := nin.SuggestPools(&n.state, &n.buildLog, memory, n.config.Parallelism)
+	if output != "" {
+		f, err := os.Create(output)
+		if err != nil {
+			errorf("%s", err)
+			return 1
+		}
+		err = nin.WritePoolSuggestions(f, pools)
+		if err2 := f.Close(); err == nil {
+			err = err2
+		}
+		if err != nil {
+			errorf("%s", err)
+			return 1
+		}
+	}
+	if opts.format == "json" {
+		out := make([]jsonPoolSuggestion, 0, len(pools))
+		for _, p := range pools {
+			out = append(out, jsonPoolSuggestion{Name: p.Name, Depth: p.Depth, Rules: p.Rules, Reasons: p.Reasons})
+		}
+		return printJSON(jsonTune{Pools: out})
+	}
+	if len(pools) == 0 {
+		fmt.Printf("no pool to suggest at -j %d\n", n.config.Parallelism)
+		return 0
+	}
+	for _, p := range pools {
+		fmt.Printf("create %s depth %d; assign rules %s\n", p.Name, p.Depth, strings.Join(p.Rules, ", "))
+		for _, r := range p.Reasons {
+			fmt.Printf("  %s\n", r)
+		}
+	}
+	if output != "" {
+		fmt.Printf("wrote %s; include it in the manifest and add \"pool = <name>\" to the rules\n", output)
+	}
+	return 0
+}
 
-// debugEnable enables debugging modes.
-//
-// Returns false if Ninja should exit instead of continuing.
-func debugEnable(values []string) bool {
-	for _, name := range values {
-		switch name {
-		case "list":
-			// TODO(maruel): Generate?
-			fmt.Printf("debugging modes:\n  stats        print operation counts/timing info\n  explain      explain what caused a command to execute\n  keepdepfile  don't delete depfiles after they're read by ninja\n  keeprsp      don't delete @response files on success\n  nostatcache  don't batch stat() calls per directory and cache them\nmultiple modes can be enabled via -d FOO -d BAR\n")
-			//#ifdef _WIN32//#endif
-			return false
-		case "stats":
-			metricsEnabled = true
-			nin.Metrics.Enable()
-		case "explain":
-			nin.Debug.Explaining = true
-		case "keepdepfile":
-			nin.Debug.KeepDepfile = true
-		case "keeprsp":
-			nin.Debug.KeepRsp = true
-		case "nostatcache":
-			disableExperimentalStatcache = true
-		default:
-			suggestion := nin.SpellcheckString(name, "stats", "explain", "keepdepfile", "keeprsp", "nostatcache")
-			if suggestion != "" {
-				errorf("unknown debug setting '%s', did you mean '%s'?", name, suggestion)
-			} else {
-				errorf("unknown debug setting '%s'", name)
-			}
-			return false
+// printRuleUsage prints the resources used per rule as a table.
+func printRuleUsage(rules []nin.RuleUsage) {
+	const mib = 1024 * 1024
+	fmt.Printf("%-24s %7s %10s %10s %10s %10s\n", "rule", "edges", "cpu", "max RSS", "read", "written")
+	for _, r := range rules {
+		fmt.Printf("%-24s %7d %10s %9.1fM %9.1fM %9.1fM\n", r.Rule, r.Edges, (r.UserTime + r.SystemTime).Round(time.Millisecond), float64(r.MaxRSS)/mib, float64(r.ReadBytes)/mib, float64(r.WrittenBytes)/mib)
+	}
+}
+
+func toolFlaky(n *ninjaMain, opts *options, args []string) int {
+	// HACK: parse an additional flag.
+	minRuns := 3
+	if len(args) == 2 && args[0] == "-min-runs" {
+		var err error
+		if minRuns, err = strconv.Atoi(args[1]); err != nil || minRuns < 2 {
+			errorf("-min-runs must be at least 2")
+			return 1
 		}
+		args = args[2:]
 	}
-	return true
+	if len(args) != 0 {
+		errorf("flaky doesn't take targets")
+		return 1
+	}
+	builds, err := nin.ReadHistory(n.historyPath())
+	if err != nil {
+		errorf("%s", err)
+		return 1
+	}
+	runs := nin.RunRecords(builds)
+	var report []nin.EdgeStability
+	for _, e := range nin.FlakinessReport(runs, minRuns) {
+		if e.Flaky() || e.Noisy() {
+			report = append(report, e)
+		}
+	}
+	if opts.format == "json" {
+		out := jsonFlaky{Builds: len(runs), Edges: make([]jsonEdgeStability, 0, len(report))}
+		for _, e := range report {
+			out.Edges = append(out.Edges, jsonEdgeStability{
+				Output:   e.Output,
+				Runs:     e.Runs,
+				Failures: e.Failures,
+				Flaps:    e.Flaps,
+				MeanMS:   e.Mean.Milliseconds(),
+				StdDevMS: e.StdDev.Milliseconds(),
+			})
+		}
+		return printJSON(out)
+	}
+	if len(runs) < minRuns {
+		infof("only %d builds recorded in %s; need %d", len(runs), n.historyPath(), minRuns)
+		return 0
+	}
+	if len(report) == 0 {
+		infof("no flaky edge in the last %d builds", len(runs))
+		return 0
+	}
+	fmt.Printf("%-40s %5s %8s %5s %10s %10s\n", "output", "runs", "failures", "flaps", "mean", "stddev")
+	for _, e := range report {
+		fmt.Printf("%-40s %5d %8d %5d %10s %10s\n", e.Output, e.Runs, e.Failures, e.Flaps, e.Mean.Round(time.Millisecond), e.StdDev.Round(time.Millisecond))
+	}
+	return 0
 }
 
-// Set a warning flag.  Returns false if Ninja should exit instead of
-// continuing.
-func warningEnable(name string, opts *options) bool {
-	if name == "list" {
-		fmt.Printf("warning flags:\n  phonycycle={err,warn}  phony build statement references itself\n")
-		return false
-	} else if name == "dupbuild=err" {
-		opts.parserOpts.ErrOnDupeEdge = true
-		return true
-	} else if name == "dupbuild=warn" {
-		opts.parserOpts.ErrOnDupeEdge = false
-		return true
-	} else if name == "phonycycle=err" {
-		opts.parserOpts.ErrOnPhonyCycle = true
-		return true
-	} else if name == "phonycycle=warn" {
-		opts.parserOpts.ErrOnPhonyCycle = false
-		return true
-	} else if name == "depfilemulti=err" || name == "depfilemulti=warn" {
-		warningf("deprecated warning 'depfilemulti'")
-		return true
-	} else {
-		suggestion := nin.SpellcheckString(name, "dupbuild=err", "dupbuild=warn", "phonycycle=err", "phonycycle=warn")
-		if suggestion != "" {
-			errorf("unknown warning flag '%s', did you mean '%s'?", name, suggestion)
-		} else {
-			errorf("unknown warning flag '%s'", name)
+// toolHistory lists the archived builds, or compares the duration of the
+// outputs given as arguments across them.
+func toolHistory(n *ninjaMain, opts *options, args []string) int {
+	builds, err := nin.ReadHistory(n.historyPath())
+	if err != nil {
+		errorf("%s", err)
+		return 1
+	}
+	if len(builds) == 0 {
+		infof("no build archived in %s; see -keep-history", n.historyPath())
+		return 0
+	}
+	if len(args) == 0 {
+		if opts.format == "json" {
+			out := jsonHistory{Builds: make([]jsonHistoryBuild, 0, len(builds))}
+			for _, b := range builds {
+				out.Builds = append(out.Builds, jsonHistoryBuild{Seq: b.Seq, Time: b.Time.UTC().Format(time.RFC3339), Edges: len(b.Entries), WallMS: b.Wall().Milliseconds()})
+			}
+			return printJSON(out)
 		}
-		return false
+		fmt.Printf("%6s  %-20s %7s %10s\n", "build", "time", "edges", "wall")
+		for _, b := range builds {
+			fmt.Printf("%6d  %-20s %7d %10s\n", b.Seq, b.Time.Format("2006-01-02 15:04:05"), len(b.Entries), b.Wall().Round(time.Millisecond))
+		}
+		return 0
+	}
+	samples := nin.DurationSamples(builds)
+	if opts.format == "json" {
+		out := jsonHistory{Outputs: make([]jsonHistoryOutput, 0, len(args))}
+		for _, a := range args {
+			s := samples[a]
+			j := jsonHistoryOutput{Output: a, SamplesMS: make([]int64, 0, len(s)), MedianMS: nin.MedianDuration(s).Milliseconds()}
+			for _, d := range s {
+				j.SamplesMS = append(j.SamplesMS, d.Milliseconds())
+			}
+			out.Outputs = append(out.Outputs, j)
+		}
+		return printJSON(out)
+	}
+	for _, a := range args {
+		s := samples[a]
+		if len(s) == 0 {
+			fmt.Printf("%s: not built in the last %d builds\n", a, len(builds))
+			continue
+		}
+		d := make([]string, 0, len(s))
+		for _, v := range s {
+			d = append(d, v.Round(time.Millisecond).String())
+		}
+		fmt.Printf("%s: median %s over %d builds: %s\n", a, nin.MedianDuration(s).Round(time.Millisecond), len(s), strings.Join(d, " "))
 	}
+	return 0
 }
 
-// Open the build log.
-// @return false on error.
-func (n *ninjaMain) OpenBuildLog(recompactOnly bool) bool {
-	logPath := ".ninja_log"
-	if n.buildDir != "" {
-		logPath = n.buildDir + "/" + logPath
+// toolStatediff lists the graph snapshots or compares two of them.
+func toolStatediff(n *ninjaMain, opts *options, args []string) int {
+	dir := n.historyPath()
+	seqs, err := nin.SnapshotSeqs(dir)
+	if err != nil {
+		errorf("%s", err)
+		return 1
+	}
+	if len(args) > 2 {
+		errorf("usage: %s -t statediff [list | FROM [TO]]", nin.ProgramName)
+		return 1
+	}
+	if len(args) == 1 && args[0] == "list" {
+		snapshots := make([]*nin.Snapshot, 0, len(seqs))
+		for _, seq := range seqs {
+			s, err := nin.ReadSnapshot(dir, seq)
+			if err != nil {
+				errorf("%s", err)
+				return 1
+			}
+			snapshots = append(snapshots, s)
+		}
+		if opts.format == "json" {
+			out := jsonStatediff{Snapshots: make([]jsonSnapshot, 0, len(snapshots))}
+			for _, s := range snapshots {
+				out.Snapshots = append(out.Snapshots, newJSONSnapshot(s))
+			}
+			return printJSON(out)
+		}
+		if len(seqs) == 0 {
+			infof("no snapshot in %s; see -keep-snapshots", dir)
+			return 0
+		}
+		fmt.Printf("%8s  %-20s %-9s %7s\n", "snapshot", "time", "status", "nodes")
+		for _, s := range snapshots {
+			fmt.Printf("%8d  %-20s %-9s %7d\n", s.Seq, s.Time.Local().Format("2006-01-02 15:04:05"), snapshotStatus(s.Succeeded), len(s.Nodes))
+		}
+		return 0
+	}
+	if len(seqs) < 2 && len(args) < 2 {
+		errorf("need two snapshots in %s to compare, found %d; see -keep-snapshots", dir, len(seqs))
+		return 1
+	}
+	to := seqs[len(seqs)-1]
+	if len(args) == 2 {
+		if to, err = resolveSnapshot(dir, seqs, args[1], 0); err != nil {
+			errorf("%s", err)
+			return 1
+		}
+	}
+	from := -1
+	for _, seq := range seqs {
+		if seq < to {
+			from = seq
+		}
+	}
+	if len(args) != 0 {
+		if from, err = resolveSnapshot(dir, seqs, args[0], to); err != nil {
+			errorf("%s", err)
+			return 1
+		}
+	}
+	if from == -1 {
+		errorf("no snapshot before %d", to)
+		return 1
+	}
+	a, err := nin.ReadSnapshot(dir, from)
+	if err != nil {
+		errorf("%s", err)
+		return 1
+	}
+	b, err := nin.ReadSnapshot(dir, to)
+	if err != nil {
+		errorf("%s", err)
+		return 1
+	}
+	changes := nin.DiffSnapshots(a, b)
+	if opts.format == "json" {
+		ja, jb := newJSONSnapshot(a), newJSONSnapshot(b)
+		out := jsonStatediff{From: &ja, To: &jb, Changes: make([]jsonSnapshotChange, 0, len(changes))}
+		for i := range changes {
+			out.Changes = append(out.Changes, jsonSnapshotChange{Path: changes[i].Path, Changes: snapshotChangeKinds(&changes[i])})
+		}
+		return printJSON(out)
+	}
+	fmt.Printf("snapshot %d (%s, %s) -> %d (%s, %s)\n", a.Seq, a.Time.Local().Format("2006-01-02 15:04:05"), snapshotStatus(a.Succeeded), b.Seq, b.Time.Local().Format("2006-01-02 15:04:05"), snapshotStatus(b.Succeeded))
+	if len(changes) == 0 {
+		fmt.Printf("no change\n")
+		return 0
+	}
+	// Print the changes by kind, the causes first.
+	for _, kind := range []struct{ name, title string }{
+		{"modified", "modified sources"},
+		{"added", "added"},
+		{"removed", "removed"},
+		{"command", "new commands"},
+		{"rebuilt", "rebuilt outputs"},
+		{"dirty", "became dirty"},
+		{"clean", "became clean"},
+	} {
+		var paths []string
+		for i := range changes {
+			for _, k := range snapshotChangeKinds(&changes[i]) {
+				if k == kind.name {
+					paths = append(paths, changes[i].Path)
+				}
+			}
+		}
+		if len(paths) != 0 {
+			fmt.Printf("%s (%d):\n", kind.title, len(paths))
+			for _, p := range paths {
+				fmt.Printf("  %s\n", p)
+			}
+		}
+	}
+	return 0
+}
+
+// resolveSnapshot returns the snapshot selected by arg: its number, "last",
+// or "green" for the last successful build before the snapshot before, or
+// the last one if before is 0.
+func resolveSnapshot(dir string, seqs []int, arg string, before int) (int, error) {
+	switch arg {
+	case "last":
+		return seqs[len(seqs)-1], nil
+	case "green":
+		for i := len(seqs) - 1; i >= 0; i-- {
+			if before != 0 && seqs[i] >= before {
+				continue
+			}
+			s, err := nin.ReadSnapshot(dir, seqs[i])
+			if err != nil {
+				return 0, err
+			}
+			if s.Succeeded {
+				return seqs[i], nil
+			}
+		}
+		return 0, errors.New("no snapshot of a successful build")
+	}
+	seq, err := strconv.Atoi(arg)
+	if err == nil {
+		for _, s := range seqs {
+			if s == seq {
+				return seq, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("unknown snapshot '%s'; see -t statediff list", arg)
+}
+
+func newJSONSnapshot(s *nin.Snapshot) jsonSnapshot {
+	return jsonSnapshot{Seq: s.Seq, Time: s.Time.UTC().Format(time.RFC3339), Succeeded: s.Succeeded, Nodes: len(s.Nodes)}
+}
+
+func snapshotStatus(succeeded bool) string {
+	if succeeded {
+		return "succeeded"
+	}
+	return "failed"
+}
+
+// snapshotChangeKinds returns the kinds of change of a node between two
+// snapshots, as listed by jsonSnapshotChange.
+func snapshotChangeKinds(c *nin.SnapshotChange) []string {
+	switch {
+	case c.Old == nil:
+		return []string{"added"}
+	case c.New == nil:
+		return []string{"removed"}
+	}
+	var out []string
+	if c.MTimeChanged() {
+		if c.New.Output {
+			out = append(out, "rebuilt")
+		} else {
+			out = append(out, "modified")
+		}
+	}
+	if c.CommandChanged() {
+		out = append(out, "command")
+	}
+	if c.DirtyChanged() {
+		if c.New.Dirty {
+			out = append(out, "dirty")
+		} else {
+			out = append(out, "clean")
+		}
+	}
+	return out
+}
+
+func toolPools(n *ninjaMain, opts *options, args []string) int {
+	logPath := n.buildLogPath()
+	entries, err := nin.ReadLastBuild(logPath)
+	if err != nil && !os.IsNotExist(err) {
+		errorf("loading build log %s: %s", logPath, err)
+		return 1
+	}
+	usage := nin.ComputePoolUsage(&n.state, entries)
+
+	if opts.format == "json" {
+		out := make([]jsonPool, 0, len(usage))
+		for _, u := range usage {
+			out = append(out, jsonPool{
+				Name:        u.Pool.Name,
+				Depth:       u.Pool.Depth(),
+				Edges:       u.Edges,
+				Ran:         u.Ran,
+				BusyMS:      u.Busy.Milliseconds(),
+				SaturatedMS: u.Saturated.Milliseconds(),
+			})
+		}
+		return printJSON(jsonPools{Pools: out})
+	}
+
+	fmt.Printf("%-16s %6s %7s %7s %10s %10s\n", "pool", "depth", "edges", "ran", "busy", "saturated")
+	for _, u := range usage {
+		name := u.Pool.Name
+		if name == "" {
+			name = "(default)"
+		}
+		depth := "inf"
+		if d := u.Pool.Depth(); d != 0 {
+			depth = strconv.Itoa(d)
+		}
+		fmt.Printf("%-16s %6s %7d %7d %10s %10s\n", name, depth, u.Edges, u.Ran, u.Busy.Round(time.Millisecond), u.Saturated.Round(time.Millisecond))
+	}
+	return 0
+}
+
+// toolTimeline prints the edges that ran in the last build in a format
+// understood by the profiling UIs.
+func toolTimeline(n *ninjaMain, opts *options, args []string) int {
+	format := "chrome"
+	if len(args) == 1 {
+		format = args[0]
+	} else if len(args) != 0 {
+		errorf("usage: -t timeline [-- chrome|speedscope|folded]")
+		return 1
+	}
+	logPath := n.buildLogPath()
+	entries, err := nin.ReadLastBuild(logPath)
+	if err != nil && !os.IsNotExist(err) {
+		errorf("loading build log %s: %s", logPath, err)
+		return 1
+	}
+	events := nin.Timeline(&n.state, entries)
+	switch format {
+	case "chrome":
+		err = nin.WriteChromeTrace(os.Stdout, events)
+	case "speedscope":
+		err = nin.WriteSpeedscope(os.Stdout, n.ninjaCommand+" "+opts.inputFile, events)
+	case "folded":
+		err = nin.WriteFoldedStacks(os.Stdout, events)
+	default:
+		errorf("unknown timeline format %q; must be one of chrome, speedscope or folded", format)
+		return 1
+	}
+	if err != nil {
+		errorf("%s", err)
+		return 1
+	}
+	return 0
+}
+
+// toolPlan prints the edges that would be run to build the targets, to be run
+// later with -t execute or by another executor.
+func toolPlan(n *ninjaMain, opts *options, args []string) int {
+	targets, err := n.collectTargetsFromArgs(args)
+	if err != nil {
+		errorf("%s", err)
+		return 1
+	}
+	builder := n.newBuilder(nin.NewMultiStatus())
+	for _, t := range targets {
+		if _, err := builder.AddTarget(t); err != nil {
+			errorf("%s", err)
+			return 1
+		}
+	}
+	p, err := builder.ExportPlan()
+	if err != nil {
+		errorf("%s", err)
+		return 1
+	}
+	return printJSON(p)
+}
+
+// toolExecute runs a plan file written by -t plan.
+func toolExecute(n *ninjaMain, opts *options, args []string) int {
+	if len(args) != 1 {
+		errorf("usage: nin -t execute <plan file>")
+		return 1
+	}
+	raw, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		errorf("%s", err)
+		return 1
+	}
+	p := &nin.PlanFile{}
+	if err := json.Unmarshal(raw, p); err != nil {
+		errorf("%s: %s", args[0], err)
+		return 1
+	}
+	finished := 0
+	err = nin.ExecutePlan(context.Background(), p, n.config, func(e *nin.PlanEdge, exitCode nin.ExitStatus, output string) {
+		finished++
+		desc := e.Description
+		if desc == "" || n.config.Verbosity == nin.Verbose {
+			desc = e.Command
+		}
+		if n.config.Verbosity != nin.Quiet {
+			fmt.Printf("[%d/%d] %s\n", finished, len(p.Edges), desc)
+		}
+		if exitCode != nin.ExitSuccess {
+			fmt.Printf("FAILED: %s\n%s\n", strings.Join(e.Outputs, " "), e.Command)
+		}
+		if output != "" {
+			fmt.Print(output)
+		}
+	})
+	if err != nil {
+		infof("build stopped: %s.", err)
+		return 1
+	}
+	return 0
+}
+
+// toolReplay rebuilds the edges of the last build recorded in the build log
+// with the same schedule, to reproduce a failure that depends on the order
+// of the commands.
+func toolReplay(n *ninjaMain, opts *options, args []string) int {
+	if len(args) != 0 {
+		errorf("replay doesn't take targets")
+		return 1
+	}
+	logPath := n.buildLogPath()
+	entries, err := nin.ReadLastBuild(logPath)
+	if err != nil && !os.IsNotExist(err) {
+		errorf("loading build log %s: %s", logPath, err)
+		return 1
+	}
+	schedule := nin.NewReplaySchedule(&n.state, entries)
+	edges := schedule.Edges()
+	if len(edges) == 0 {
+		errorf("no build recorded in %s", logPath)
+		return 1
+	}
+	// Remove the outputs so every recorded edge runs again.
+	for _, e := range edges {
+		args = append(args, e.Outputs[0].Path)
+		if n.config.DryRun {
+			continue
+		}
+		for _, o := range e.Outputs {
+			if err := n.di.RemoveFile(o.Path); err != nil && !os.IsNotExist(err) {
+				errorf("%s", err)
+				return 1
+			}
+		}
+	}
+	n.config.Parallelism = schedule.Parallelism()
+	n.replay = schedule
+	infof("replaying %d edges with -j %d", len(edges), n.config.Parallelism)
+	return n.RunBuild(args, n.printer)
+}
+
+// toolTest runs the test edges, i.e. the edges with "test = 1", that are
+// affected by the changes since their last run.
+func toolTest(n *ninjaMain, opts *options, args []string) int {
+	var tests []*nin.Edge
+	if len(args) == 0 {
+		tests = nin.TestEdges(&n.state)
+	} else {
+		targets, err := n.collectTargetsFromArgs(args)
+		if err != nil {
+			errorf("%s", err)
+			return 1
+		}
+		// Select the tests in the dependencies of the targets.
+		seen := map[*nin.Edge]struct{}{}
+		var visit func(node *nin.Node)
+		visit = func(node *nin.Node) {
+			e := node.InEdge
+			if e == nil {
+				return
+			}
+			if _, ok := seen[e]; ok {
+				return
+			}
+			seen[e] = struct{}{}
+			if nin.IsTestEdge(e) {
+				tests = append(tests, e)
+			}
+			for _, in := range e.Inputs {
+				visit(in)
+			}
+		}
+		for _, t := range targets {
+			visit(t)
+		}
+	}
+	if len(tests) == 0 {
+		errorf("no test edge; mark them with \"test = 1\"")
+		return 1
+	}
+	cache := nin.NewTestCache(&n.di, n.config.ToolDigests)
+	path := n.testsPath()
+	if err := cache.Load(path); err != nil {
+		warningf("%s; starting over", err)
+		cache = nin.NewTestCache(&n.di, n.config.ToolDigests)
+	}
+	cache.TrackTools = n.config.TrackTools
+	n.tests = cache
+	targets := make([]string, 0, len(tests))
+	for _, e := range tests {
+		targets = append(targets, e.Outputs[0].Path)
+	}
+	ret := n.RunBuild(targets, n.printer)
+	if !n.readOnly() {
+		if err := n.config.ToolDigests.Save(n.digestsPath()); err != nil {
+			warningf("%s", err)
+		}
+		if err := cache.Save(path); err != nil {
+			errorf("%s", err)
+			return 1
+		}
+	}
+	s := cache.Stats()
+	if s.Passed+s.Failed != 0 {
+		infof("tests: %d passed, %d failed, %d cached", s.Passed, s.Failed, s.Cached)
+	}
+	return ret
+}
+
+func toolAliases(n *ninjaMain, opts *options, args []string) int {
+	aliases := n.state.Aliases()
+	shadows, err := n.state.ShadowedAliases(&n.di)
+	if err != nil {
+		errorf("%s", err)
+		return 1
+	}
+
+	if opts.format == "json" {
+		out := jsonAliases{Aliases: make([]jsonAlias, 0, len(aliases)), Shadows: make([]jsonAliasShadow, 0, len(shadows))}
+		for _, a := range aliases {
+			j := jsonAlias{Name: a.Node.Path, Targets: make([]string, 0, len(a.Targets))}
+			for _, t := range a.Targets {
+				j.Targets = append(j.Targets, t.Path)
+			}
+			out.Aliases = append(out.Aliases, j)
+		}
+		for _, s := range shadows {
+			out.Shadows = append(out.Shadows, jsonAliasShadow{Name: s.Path, Reason: s.Reason})
+		}
+		return printJSON(out)
+	}
+
+	for _, a := range aliases {
+		fmt.Printf("%s:", a.Node.Path)
+		for _, t := range a.Targets {
+			fmt.Printf(" %s", t.Path)
+		}
+		fmt.Printf("\n")
+	}
+	for _, s := range shadows {
+		warningf("%s: %s", s.Path, s.Reason)
+	}
+	return 0
+}
+
+func toolGroups(n *ninjaMain, opts *options, args []string) int {
+	names := make([]string, 0, len(n.state.Groups))
+	for name := range n.state.Groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if opts.format == "json" {
+		out := jsonGroups{Groups: make([]jsonGroup, 0, len(names))}
+		for _, name := range names {
+			g := jsonGroup{Name: name, Targets: []string{}}
+			for _, t := range n.state.Groups[name] {
+				g.Targets = append(g.Targets, t.Path)
+			}
+			out.Groups = append(out.Groups, g)
+		}
+		return printJSON(out)
+	}
+
+	for _, name := range names {
+		fmt.Printf(":%s:", name)
+		for _, t := range n.state.Groups[name] {
+			fmt.Printf(" %s", t.Path)
+		}
+		fmt.Printf("\n")
+	}
+	return 0
+}
+
+func toolSelftest(n *ninjaMain, opts *options, args []string) int {
+	if len(args) == 0 {
+		errorf("usage: nin -t selftest <path to ninja> [targets...]")
+		return 1
+	}
+	self, err := os.Executable()
+	if err != nil {
+		errorf("%s", err)
+		return 1
+	}
+	cfg := nin.CompatTestConfig{
+		Dir:     ".",
+		Nin:     self,
+		Ninja:   args[0],
+		NinArgs: []string{"-compat", "ninja-1.11"},
+	}
+	if opts.inputFile != "build.ninja" {
+		cfg.Args = append(cfg.Args, "-f", opts.inputFile)
+	}
+	cfg.Args = append(cfg.Args, args[1:]...)
+	r, err := nin.RunCompatTest(context.Background(), &cfg)
+	if err != nil {
+		errorf("%s", err)
+		return 1
+	}
+
+	if opts.format == "json" {
+		out := jsonSelftest{ExitCode: r.NinExitCode, Differences: r.Differences}
+		if out.Differences == nil {
+			out.Differences = []string{}
+		}
+		if printJSON(out) != 0 {
+			return 1
+		}
+	} else {
+		for _, d := range r.Differences {
+			fmt.Printf("%s\n", d)
+		}
+		if len(r.Differences) == 0 {
+			fmt.Printf("nin and %s behaved the same\n", args[0])
+		}
+	}
+	if len(r.Differences) != 0 {
+		return 1
+	}
+	return 0
+}
+
+func toolDoctor(n *ninjaMain, opts *options, args []string) int {
+	if !n.EnsureBuildDirExists() {
+		return 1
+	}
+	dir := n.buildDir
+	if dir == "" {
+		dir = "."
+	}
+	logPath := filepath.Join(dir, ".ninja_log")
+	depsPath := filepath.Join(dir, ".ninja_deps")
+
+	d := nin.NewDoctor(&n.state, &n.buildLog, &n.depsLog, &n.di)
+	// Only load the logs when their version is valid, since loading an invalid
+	// log deletes it.
+	if d.CheckBuildLogVersion(logPath) {
+		if err := n.buildLog.Load(logPath); err != nil {
+			errorf("loading build log %s: %s", logPath, err)
+			return 1
+		}
+	}
+	if d.CheckDepsLogVersion(depsPath) {
+		if err := n.depsLog.Load(depsPath, &n.state); err != nil {
+			errorf("loading deps log %s: %s", depsPath, err)
+			return 1
+		}
+	}
+	d.CheckDanglingDeps()
+	d.CheckOrphanOutputs()
+	d.CheckClockSkew(dir)
+	d.CheckPaths()
+
+	if len(d.Findings) == 0 {
+		fmt.Printf("nin: no problem found\n")
+		return 0
+	}
+	for _, f := range d.Findings {
+		fmt.Printf("%s: %s\n", f.Check, f.Message)
+		fmt.Printf("  fix: %s\n", f.Remediation)
+	}
+	return 1
+}
+
+func toolVerifyLogs(n *ninjaMain, opts *options, args []string) int {
+	dir := n.buildDir
+	if dir == "" {
+		dir = "."
+	}
+	logs := []struct {
+		path   string
+		verify func(string) error
+	}{
+		{filepath.Join(dir, ".ninja_log"), nin.VerifyBuildLog},
+		{filepath.Join(dir, ".ninja_deps"), nin.VerifyDepsLog},
+	}
+	out := jsonVerifyLogs{Logs: []jsonVerifyLog{}}
+	ret := 0
+	for _, l := range logs {
+		j := jsonVerifyLog{Path: l.path, Status: "ok"}
+		if err := l.verify(l.path); os.IsNotExist(err) {
+			j.Status = "missing"
+		} else if err != nil {
+			j.Status = "invalid"
+			j.Error = err.Error()
+			ret = 1
+		}
+		out.Logs = append(out.Logs, j)
+	}
+	if opts.format == "json" {
+		if printJSON(out) != 0 {
+			return 1
+		}
+		return ret
+	}
+	for _, j := range out.Logs {
+		if j.Error != "" {
+			fmt.Printf("%s: %s\n", j.Path, j.Error)
+		} else {
+			fmt.Printf("%s: %s\n", j.Path, j.Status)
+		}
+	}
+	return ret
+}
+
+// collectEdges appends the non-phony edges needed to build node, in
+// dependency order.
+func collectEdges(node *nin.Node, seen map[*nin.Edge]struct{}, out []*nin.Edge) []*nin.Edge {
+	edge := node.InEdge
+	if edge == nil {
+		return out
+	}
+	if _, ok := seen[edge]; ok {
+		return out
+	}
+	seen[edge] = struct{}{}
+	for _, in := range edge.Inputs {
+		out = collectEdges(in, seen, out)
+	}
+	if edge.Rule != nin.PhonyRule {
+		out = append(out, edge)
+	}
+	return out
+}
+
+// toolDeterminism builds the targets, then runs the commands of their edges
+// twice and reports the outputs that differ.
+func toolDeterminism(n *ninjaMain, opts *options, args []string) int {
+	// HACK: parse two additional flags.
+	cfg := nin.DeterminismConfig{Seed: time.Now().UnixNano(), PosixShell: n.config.PosixShell}
+	for i := 0; i < len(args); {
+		if (args[i] != "-sample" && args[i] != "-seed") || i == len(args)-1 {
+			i++
+			continue
+		}
+		v, err := strconv.ParseInt(args[i+1], 10, 64)
+		if err != nil || v < 0 {
+			errorf("invalid value for %s: %q", args[i], args[i+1])
+			return 1
+		}
+		if args[i] == "-sample" {
+			cfg.Sample = int(v)
+		} else {
+			cfg.Seed = v
+		}
+		args = append(args[:i], args[i+2:]...)
+	}
+
+	targets, err := n.collectTargetsFromArgs(args)
+	if err != nil {
+		errorf("%s", err)
+		return 1
+	}
+	var status nin.Status = n.printer
+	if opts.format == "json" {
+		// Keep stdout clean; the build output is not part of the report.
+		status = nin.NewMultiStatus()
+	}
+	if ret := n.RunBuild(args, status); ret != 0 {
+		if opts.format == "json" {
+			errorf("build failed; run without -format json for details")
+		}
+		return ret
+	}
+	seen := map[*nin.Edge]struct{}{}
+	var edges []*nin.Edge
+	for _, t := range targets {
+		edges = collectEdges(t, seen, edges)
+	}
+
+	dir := n.buildDir
+	if dir == "" {
+		dir = "."
+	}
+	cfg.ScratchDir = filepath.Join(dir, ".nin_determinism")
+	digestsPath := filepath.Join(dir, ".ninja_digests")
+	cfg.Digests = nin.NewDigestStore()
+	if err := cfg.Digests.Load(digestsPath); err != nil {
+		warningf("%s", err)
+	}
+	results := nin.CheckDeterminism(context.Background(), &n.di, edges, &cfg)
+	if err := cfg.Digests.Save(digestsPath); err != nil {
+		warningf("%s", err)
+	}
+	_ = os.Remove(cfg.ScratchDir)
+
+	ret := 0
+	out := jsonDeterminism{Checked: len(results), Edges: []jsonDeterminismEdge{}}
+	for _, r := range results {
+		if r.Err == nil && len(r.Outputs) == 0 {
+			continue
+		}
+		ret = 1
+		e := jsonDeterminismEdge{Rule: r.Edge.Rule.Name, Outputs: []jsonDeterminismOutput{}}
+		if r.Err != nil {
+			e.Error = r.Err.Error()
+		}
+		for _, o := range r.Outputs {
+			j := jsonDeterminismOutput{
+				Path:    o.Path,
+				Digests: [2]string{o.Digests[0].String(), o.Digests[1].String()},
+				Ranges:  make([][2]int64, 0, len(o.Ranges)),
+			}
+			for _, b := range o.Ranges {
+				j.Ranges = append(j.Ranges, [2]int64{b.Start, b.End})
+			}
+			e.Outputs = append(e.Outputs, j)
+		}
+		out.Edges = append(out.Edges, e)
+	}
+	if opts.format == "json" {
+		if printJSON(out) != 0 {
+			return 1
+		}
+		return ret
+	}
+	for _, e := range out.Edges {
+		if e.Error != "" {
+			fmt.Printf("%s: %s\n", e.Rule, e.Error)
+		}
+		for _, o := range e.Outputs {
+			fmt.Printf("%s: %s is nondeterministic; bytes", e.Rule, o.Path)
+			for _, b := range o.Ranges {
+				fmt.Printf(" [%d,%d)", b[0], b[1])
+			}
+			fmt.Printf("\n")
+		}
+	}
+	fmt.Printf("checked %d edges, %d nondeterministic or failed\n", out.Checked, len(out.Edges))
+	return ret
+}
+
+// toolScopes lists the scopes created by the manifest and its subninjas, and
+// the rules and variables shadowing the ones of a parent scope.
+func toolScopes(n *ninjaMain, opts *options, args []string) int {
+	scopes := n.state.Scopes()
+	if opts.format == "json" {
+		out := jsonScopes{Scopes: make([]jsonScope, 0, len(scopes))}
+		for _, s := range scopes {
+			j := jsonScope{
+				File:              s.Filename,
+				Depth:             s.Depth(),
+				Edges:             s.Edges,
+				ShadowedRules:     make([]jsonScopeShadow, 0, len(s.ShadowedRules)),
+				ShadowedVariables: make([]jsonScopeShadow, 0, len(s.ShadowedVariables)),
+			}
+			if s.Parent != nil {
+				j.Parent = s.Parent.Filename
+			}
+			for _, r := range s.ShadowedRules {
+				j.ShadowedRules = append(j.ShadowedRules, jsonScopeShadow{Name: r.Name, File: r.Filename})
+			}
+			for _, v := range s.ShadowedVariables {
+				j.ShadowedVariables = append(j.ShadowedVariables, jsonScopeShadow{Name: v.Name, File: v.Filename})
+			}
+			out.Scopes = append(out.Scopes, j)
+		}
+		return printJSON(out)
+	}
+
+	// Print as a tree.
+	children := map[*nin.Scope][]*nin.Scope{}
+	for _, s := range scopes {
+		if s.Parent != nil {
+			children[s.Parent] = append(children[s.Parent], s)
+		}
+	}
+	var printScope func(s *nin.Scope, indent string)
+	printScope = func(s *nin.Scope, indent string) {
+		fmt.Printf("%s%s (%d edges)\n", indent, s.Filename, s.Edges)
+		for _, r := range s.ShadowedRules {
+			fmt.Printf("%s  rule %s shadows the one from %s\n", indent, r.Name, r.Filename)
+		}
+		for _, v := range s.ShadowedVariables {
+			fmt.Printf("%s  variable %s shadows the one from %s\n", indent, v.Name, v.Filename)
+		}
+		for _, c := range children[s] {
+			printScope(c, indent+"  ")
+		}
+	}
+	if len(scopes) != 0 {
+		printScope(scopes[0], "")
+	}
+	return 0
+}
+
+// toolServeFS serves the current directory to nin.RemoteFileSystem clients.
+func toolServeFS(n *ninjaMain, opts *options, args []string) int {
+	if len(args) != 1 {
+		fmt.Printf("usage: %s -t servefs [host]:port\n", nin.ProgramName)
+		return 1
+	}
+	host, port, err := net.SplitHostPort(args[0])
+	if err != nil {
+		errorf("servefs: %s", err)
+		return 1
+	}
+	if host == "" {
+		// Only serve to other hosts when explicitly asked to.
+		host = "127.0.0.1"
+	}
+	root, err := os.Getwd()
+	if err != nil {
+		errorf("servefs: %s", err)
+		return 1
+	}
+	token := os.Getenv("NIN_SERVEFS_TOKEN")
+	printToken := token == ""
+	if printToken {
+		var b [16]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			errorf("servefs: %s", err)
+			return 1
+		}
+		token = hex.EncodeToString(b[:])
+	}
+	l, err := net.Listen("tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		errorf("servefs: %s", err)
+		return 1
+	}
+	fmt.Printf("%s: serving %s on http://%s\n", nin.ProgramName, root, l.Addr())
+	if printToken {
+		fmt.Printf("%s: token %s\n", nin.ProgramName, token)
+	}
+	if err := http.Serve(l, nin.NewRemoteFileSystemHandler(&nin.RealDiskInterface{}, root, token)); err != nil {
+		errorf("servefs: %s", err)
+		return 1
+	}
+	return 0
+}
+
+// allTools returns the tools. The ones without a description are hidden.
+func allTools() []*tool {
+	return []*tool{
+		{"aliases", "list phony aliases and the targets they build", runAfterLoad, toolAliases},
+		{"analyze", "run a static analyzer, clang-tidy by default, on the sources that changed; use -- -command CMD to use another one", runAfterLogs, toolAnalyze},
+		{"browse", "browse dependency graph in a web browser", runAfterLoad, toolBrowse},
+		{"bundle", "list the source files needed to build the targets, or archive them with: -- -o FILE.tar[.gz]", runAfterLogs, toolBundle},
+		//{"msvc", "build helper for MSVC cl.exe (EXPERIMENTAL)",runAfterFlags, toolMSVC},
+		{"clean", "clean built files", runAfterLoad, toolClean},
+		{"commands", "list all commands required to rebuild given targets", runAfterLoad, toolCommands},
+		{"deps", "show dependencies stored in the deps log", runAfterLogs, toolDeps},
+		{"flaky", "list the edges whose outcome or duration varied in the last builds; see -keep-history", runAfterLoad, toolFlaky},
+		{"determinism", "rebuild edges twice and report nondeterministic outputs", runAfterLogs, toolDeterminism},
+		{"plan", "print the edges to run for the targets as a JSON plan file", runAfterLogs, toolPlan},
+		{"execute", "run the edges of a plan file written by -t plan", runAfterFlags, toolExecute},
+		{"test", "run the test edges affected by the changes, reusing the cached results", runAfterLogs, toolTest},
+		{"replay", "rebuild the edges of the last build in the same order and parallelism", runAfterLogs, toolReplay},
+		{"doctor", "check the build directory for common problems", runAfterLoad, toolDoctor},
+		{"missingdeps", "check deps log dependencies on generated files", runAfterLogs, toolMissingDeps},
+		{"generated-headers", "list the generated files, e.g. headers, needed before indexing the sources, or build them with: -- -build", runAfterLogs, toolGeneratedHeaders},
+		{"history", "list the builds archived in .ninja_history, or compare the durations of the outputs given across them", runAfterLoad, toolHistory},
+		{"statediff", "compare the graph at the end of two builds: statediff [list | FROM [TO]], FROM and TO being a snapshot number, last or green", runAfterLoad, toolStatediff},
+		{"groups", "list the target groups declared with defaultgroup", runAfterLoad, toolGroups},
+		{"graph", "output graphviz dot file for targets", runAfterLoad, toolGraph},
+		{"query", "show inputs/outputs for a path", runAfterLogs, toolQuery},
+		{"pools", "list pools and their utilization in the last build", runAfterLoad, toolPools},
+		{"timeline", "export the last build as a Chrome trace, or with -- speedscope|folded as a speedscope profile or flamegraph folded stacks", runAfterLoad, toolTimeline},
+		{"targets", "list targets by their rule or depth in the DAG", runAfterLoad, toolTargets},
+		{"compdb", "dump JSON compilation database to stdout", runAfterLoad, toolCompilationDatabase},
+		{"recompact", "recompacts ninja-internal data structures", runAfterLoad, toolRecompact},
+		{"relocate", "replace directory OLD with NEW in the logs after moving the tree", runAfterLoad, toolRelocate},
+		{"restat", "restats all outputs in the build log", runAfterFlags, toolRestat},
+		{"rules", "list all rules", runAfterLoad, toolRules},
+		{"rusage", "list the CPU time, max RSS and I/O used per rule in the last builds", runAfterLogs, toolRusage},
+		{"sandbox-profile", "print a macOS sandbox-exec profile that only permits the command of a target to write its outputs", runAfterLoad, toolSandboxProfile},
+		{"tune", "suggest pools from the recorded memory and CPU usage, or write them with: -- -o FILE", runAfterLogs, toolTune},
+		{"verifylogs", "validate the build and deps logs against their checksums", runAfterLoad, toolVerifyLogs},
+		{"servefs", "serve the tree to a remote planner over HTTP on [host]:port, loopback by default; the clients must present the token printed or set in NIN_SERVEFS_TOKEN", runAfterFlags, toolServeFS},
+		{"scopes", "list the subninja scopes and the rules and variables they shadow", runAfterLoad, toolScopes},
+		{"selftest", "compare the build with the one of a ninja binary", runAfterFlags, toolSelftest},
+		{"cleandead", "clean built files that are no longer produced by the manifest", runAfterLogs, toolCleanDead},
+		{"completion", "print the shell completion script: -t completion bash|zsh|fish", runAfterFlags, toolCompletion},
+		{"_complete", "", runAfterFlags, toolComplete},
+		//{"wincodepage", "print the Windows code page used by nin", runAfterFlags, toolWinCodePage},
+	}
+}
+
+// Find the function to execute for \a toolName and return it via \a func.
+// Returns a Tool, or NULL if Ninja should exit.
+func chooseTool(toolName string) *tool {
+	tools := allTools()
+	if compatNinja {
+		j := 0
+		for _, t := range tools {
+			if !ninOnlyTools[t.name] {
+				tools[j] = t
+				j++
+			}
+		}
+		tools = tools[:j]
+	}
+	if toolName == "list" {
+		fmt.Printf("%s subtools:\n", nin.ProgramName)
+		printTools(os.Stdout, tools)
+		return nil
+	}
+
+	for _, t := range tools {
+		if t.name == toolName {
+			return t
+		}
+	}
+
+	var words []string
+	for _, t := range tools {
+		words = append(words, t.name)
+	}
+	suggestions := suggest(toolName, words...)
+	if len(suggestions) != 0 {
+		fatalf("unknown tool '%s', did you mean %s?", toolName, nin.SuggestionText(suggestions))
+	} else {
+		fatalf("unknown tool '%s'", toolName)
+	}
+	return nil // Not reached.
+}
+
+var (
+	disableExperimentalStatcache bool
+	metricsEnabled               bool
+	// compatNinja disables the behaviors that differ from ninja 1.11, e.g.
+	// the manifest extensions or the schedule hints. Set with -compat.
+	compatNinja bool
+)
+
+// ninOnlyTools are the tools that do not exist in ninja, which are disabled
+// with -compat.
+var ninOnlyTools = map[string]bool{
+	"aliases":           true,
+	"analyze":           true,
+	"bundle":            true,
+	"determinism":       true,
+	"doctor":            true,
+	"execute":           true,
+	"generated-headers": true,
+	"groups":            true,
+	"plan":              true,
+	"pools":             true,
+	"relocate":          true,
+	"replay":            true,
+	"flaky":             true,
+	"history":           true,
+	"test":              true,
+	"rusage":            true,
+	"sandbox-profile":   true,
+	"scopes":            true,
+	"selftest":          true,
+	"servefs":           true,
+	"timeline":          true,
+	"tune":              true,
+	"verifylogs":        true,
+	"completion":        true,
+	"_complete":         true,
+}
+
+// debugEnable enables debugging modes.
+//
+// Returns false if Ninja should exit instead of continuing.
+func debugEnable(values []string) bool {
+	for _, name := range values {
+		switch name {
+		case "list":
+			fmt.Printf("debugging modes:\n")
+			printEntries(os.Stdout, debugModes, 13, "")
+			fmt.Printf("multiple modes can be enabled via -d FOO -d BAR\n")
+			//#ifdef _WIN32//#endif
+			return false
+		case "stats":
+			metricsEnabled = true
+			nin.Metrics.Enable()
+		case "explain":
+			nin.Debug.Explaining = true
+		case "keepdepfile":
+			nin.Debug.KeepDepfile = true
+		case "keeprsp":
+			nin.Debug.KeepRsp = true
+		case "nostatcache":
+			disableExperimentalStatcache = true
+		default:
+			suggestions := suggest(name, entryNames(debugModes)...)
+			if len(suggestions) != 0 {
+				errorf("unknown debug setting '%s', did you mean %s?", name, nin.SuggestionText(suggestions))
+			} else {
+				errorf("unknown debug setting '%s'", name)
+			}
+			return false
+		}
+	}
+	return true
+}
+
+// Set a warning flag.  Returns false if Ninja should exit instead of
+// continuing.
+func warningEnable(name string, opts *options) bool {
+	if name == "list" {
+		fmt.Printf("warning flags:\n")
+		printEntries(os.Stdout, warnings, 23, "={err,warn}")
+		return false
+	} else if name == "dupbuild=err" {
+		opts.parserOpts.ErrOnDupeEdge = true
+		return true
+	} else if name == "dupbuild=warn" {
+		opts.parserOpts.ErrOnDupeEdge = false
+		return true
+	} else if name == "phonycycle=err" {
+		opts.parserOpts.ErrOnPhonyCycle = true
+		return true
+	} else if name == "phonycycle=warn" {
+		opts.parserOpts.ErrOnPhonyCycle = false
+		return true
+	} else if name == "outputcase=err" && !compatNinja {
+		opts.warnOutputCase = false
+		return true
+	} else if name == "outputcase=warn" && !compatNinja {
+		opts.warnOutputCase = true
+		return true
+	} else if name == "outputpath=err" && !compatNinja {
+		opts.warnOutputPath = false
+		return true
+	} else if name == "outputpath=warn" && !compatNinja {
+		opts.warnOutputPath = true
+		return true
+	} else if name == "depfilemulti=err" || name == "depfilemulti=warn" {
+		warningf("deprecated warning 'depfilemulti'")
+		return true
+	} else {
+		suggestions := suggest(name, warningFlags()...)
+		if len(suggestions) != 0 {
+			errorf("unknown warning flag '%s', did you mean %s?", name, nin.SuggestionText(suggestions))
+		} else {
+			errorf("unknown warning flag '%s'", name)
+		}
+		return false
+	}
+}
+
+// buildLogPath returns the path to the build log.
+func (n *ninjaMain) buildLogPath() string {
+	logPath := ".ninja_log"
+	if buildDir := n.state.Bindings.LookupVariable("builddir"); buildDir != "" {
+		logPath = filepath.Join(buildDir, logPath)
+	}
+	return logPath
+}
+
+// manifestDepsPath returns the path of the list of files loaded via include
+// and subninja statements.
+func (n *ninjaMain) manifestDepsPath() string {
+	p := ".ninja_manifest_deps"
+	if buildDir := n.state.Bindings.LookupVariable("builddir"); buildDir != "" {
+		p = filepath.Join(buildDir, p)
+	}
+	return p
+}
+
+// digestsPath returns the path of the digests of the files, e.g. the programs
+// of the commands.
+func (n *ninjaMain) digestsPath() string {
+	p := ".ninja_digests"
+	if buildDir := n.state.Bindings.LookupVariable("builddir"); buildDir != "" {
+		p = filepath.Join(buildDir, p)
+	}
+	return p
+}
+
+// historyPath returns the directory of the archived builds.
+func (n *ninjaMain) historyPath() string {
+	p := ".ninja_history"
+	if buildDir := n.state.Bindings.LookupVariable("builddir"); buildDir != "" {
+		p = filepath.Join(buildDir, p)
+	}
+	return p
+}
+
+// writeSnapshot records the state of the graph at the end of the build for
+// -t statediff.
+func (n *ninjaMain) writeSnapshot(succeeded bool, status nin.Status) {
+	if n.keepSnapshots <= 0 {
+		return
+	}
+	if err := nin.WriteSnapshot(n.historyPath(), nin.TakeSnapshot(&n.state, &n.buildLog, succeeded), n.keepSnapshots); err != nil {
+		status.Warning("%s", err)
+	}
+}
+
+// testsPath returns the path of the cached results of the test edges.
+func (n *ninjaMain) testsPath() string {
+	p := ".nin_tests"
+	if buildDir := n.state.Bindings.LookupVariable("builddir"); buildDir != "" {
+		p = filepath.Join(buildDir, p)
+	}
+	return p
+}
+
+// gitFilesPath returns the path of the cached list of the files tracked by
+// git.
+func (n *ninjaMain) gitFilesPath() string {
+	p := ".nin_gitfiles"
+	if buildDir := n.state.Bindings.LookupVariable("builddir"); buildDir != "" {
+		p = filepath.Join(buildDir, p)
+	}
+	return p
+}
+
+// failedEdgesPath returns the path of the list of the edges that failed in
+// the last build.
+func (n *ninjaMain) failedEdgesPath() string {
+	p := ".ninja_failed"
+	if buildDir := n.state.Bindings.LookupVariable("builddir"); buildDir != "" {
+		p = filepath.Join(buildDir, p)
+	}
+	return p
+}
+
+// checkOutputs fails when outputs of the manifest overlap each other or the
+// files nin writes in the build directory, or when they would overwrite files
+// outside of the build directory or tracked by git.
+// @return false on error.
+func (n *ninjaMain) checkOutputs(opts *options, status nin.Status) bool {
+	var reserved []string
+	depsPath := ".ninja_deps"
+	if buildDir := n.state.Bindings.LookupVariable("builddir"); buildDir != "" {
+		reserved = append(reserved, buildDir)
+		depsPath = filepath.Join(buildDir, depsPath)
+	}
+	reserved = append(reserved, n.buildLogPath(), depsPath, n.manifestDepsPath(), n.failedEdgesPath(), n.digestsPath(), n.testsPath(), n.historyPath(), n.gitFilesPath())
+	ok := true
+	for _, c := range n.state.CheckOutputs(reserved) {
+		if c.Kind == nin.OutputCase && opts.warnOutputCase {
+			status.Warning("%s", &c)
+			continue
+		}
+		status.Error("%s", &c)
+		ok = false
+	}
+	for _, c := range n.state.CheckOutputPaths(n.gitTrackedFiles()) {
+		if opts.warnOutputPath {
+			status.Warning("%s", &c)
+			continue
+		}
+		status.Error("%s (override with -w outputpath=warn)", &c)
+		ok = false
+	}
+	return ok
+}
+
+// gitTrackedFiles returns the files tracked by git under the current
+// directory, relative to it. It returns nothing when not in a git checkout.
+//
+// The list only changes with the git index, so it is cached in the build
+// directory keyed on the index's mtime and size, so git is not run on every
+// build.
+func (n *ninjaMain) gitTrackedFiles() []string {
+	fi, err := os.Stat(gitIndexPath())
+	if err != nil {
+		// Not in a checkout, or one git knows about through the environment.
+		out, _ := exec.Command("git", "ls-files", "-z").Output()
+		return splitGitFiles(out)
+	}
+	key := fmt.Sprintf("%d %d\n", fi.ModTime().UnixNano(), fi.Size())
+	cache := n.gitFilesPath()
+	if b, err := ioutil.ReadFile(cache); err == nil && strings.HasPrefix(string(b), key) {
+		return splitGitFiles(b[len(key):])
+	}
+	out, err := exec.Command("git", "ls-files", "-z").Output()
+	if err != nil {
+		return nil
+	}
+	// The cache is best effort.
+	if err := os.MkdirAll(filepath.Dir(cache), 0o777); err == nil {
+		_ = ioutil.WriteFile(cache, append([]byte(key), out...), 0o666)
+	}
+	return splitGitFiles(out)
+}
+
+// splitGitFiles splits the output of git ls-files -z.
+func splitGitFiles(out []byte) []string {
+	if len(out) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(out), "\x00"), "\x00")
+}
+
+// gitIndexPath returns the path of the git index of the checkout containing
+// the current directory, or "" if none is found. A .git file, as used by
+// worktrees and submodules, points to the git directory.
+func gitIndexPath() string {
+	dir, err := os.Getwd()
+	if err != nil {
+		return ""
+	}
+	for {
+		p := filepath.Join(dir, ".git")
+		if fi, err := os.Stat(p); err == nil {
+			if fi.IsDir() {
+				return filepath.Join(p, "index")
+			}
+			b, err := ioutil.ReadFile(p)
+			if err != nil || !strings.HasPrefix(string(b), "gitdir: ") {
+				return ""
+			}
+			gitDir := strings.TrimSpace(string(b[len("gitdir: "):]))
+			if !filepath.IsAbs(gitDir) {
+				gitDir = filepath.Join(dir, gitDir)
+			}
+			return filepath.Join(gitDir, "index")
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// Open the build log.
+// @return false on error.
+func (n *ninjaMain) OpenBuildLog(recompactOnly bool) bool {
+	logPath := ".ninja_log"
+	if n.buildDir != "" {
+		logPath = n.buildDir + "/" + logPath
+	}
+
+	if compatNinja {
+		// ninja 1.11 can't read the command hashes of newer versions. A log
+		// upgraded by a previous run is downgraded.
+		n.buildLog.Version = 5
+	}
+	// ninja doesn't know about the checksum file.
+	n.buildLog.NoChecksum = compatNinja
+	n.buildLog.Sync = n.config.LogSync
+	err := n.buildLog.Load(logPath)
+	notFound := os.IsNotExist(err)
+	if errors.Is(err, &nin.ErrLogDiscarded{}) {
+		warningf("%s", err)
+	} else if err != nil && !notFound {
+		errorf("loading build log %s: %s", logPath, err)
+		return false
+	}
+
+	if recompactOnly {
+		if notFound {
+			return true
+		}
+
+		if err = n.buildLog.Recompact(logPath, n); err != nil {
+			errorf("failed recompaction: %s", err)
+			return false
+		}
+		return true
+	}
+
+	if !n.readOnly() {
+		if err = n.buildLog.OpenForWrite(logPath, n); err != nil {
+			errorf("opening build log: %s", err)
+			return false
+		}
+	}
+
+	return true
+}
+
+// Open the deps log: load it, then open for writing.
+// @return false on error.
+// Open the deps log: load it, then open for writing.
+// @return false on error.
+func (n *ninjaMain) OpenDepsLog(recompactOnly bool) bool {
+	path := ".ninja_deps"
+	if n.buildDir != "" {
+		path = n.buildDir + "/" + path
+	}
+
+	// ninja doesn't know about the checksum file.
+	n.depsLog.NoChecksum = compatNinja
+	n.depsLog.Sync = n.config.LogSync
+	err := n.depsLog.Load(path, &n.state)
+	notFound := os.IsNotExist(err)
+	if errors.Is(err, &nin.ErrLogDiscarded{}) {
+		warningf("%s", err)
+	} else if err != nil && !notFound {
+		errorf("loading deps log %s: %s", path, err)
+		return false
+	}
+
+	if recompactOnly {
+		if notFound {
+			return true
+		}
+		if err := n.depsLog.Recompact(path); err != nil {
+			errorf("failed recompaction: %s", err)
+			return false
+		}
+		return true
+	}
+
+	if !n.readOnly() {
+		if err := n.depsLog.OpenForWrite(path); err != nil {
+			errorf("opening deps log: %s", err)
+			return false
+		}
+	}
+
+	return true
+}
+
+// Dump the output requested by '-d stats'.
+func (n *ninjaMain) DumpMetrics() {
+	nin.Metrics.Report()
+
+	fmt.Printf("\n")
+	// There's no such concept in Go's map.
+	//count := len(n.state.paths)
+	//buckets := len(n.state.paths)
+	//fmt.Printf("path.node hash load %.2f (%d entries / %d buckets)\n", count/float64(buckets), count, buckets)
+}
+
+// Ensure the build directory exists, creating it if necessary.
+// @return false on error.
+func (n *ninjaMain) EnsureBuildDirExists() bool {
+	n.buildDir = n.state.Bindings.LookupVariable("builddir")
+	if n.buildDir != "" && !n.readOnly() {
+		if err := nin.MakeDirs(&n.di, n.buildDir+"/."); err != nil {
+			errorf("creating build directory %s", n.buildDir)
+			return false
+		}
+	}
+	return true
+}
+
+// readOnly returns true when the build must not modify the build directory,
+// i.e. with -n or -sandbox-outputs.
+func (n *ninjaMain) readOnly() bool {
+	return n.config.DryRun || n.overlay != nil
+}
+
+// printSandboxChanges prints the changes the build would have done to the
+// tree with -sandbox-outputs.
+func (n *ninjaMain) printSandboxChanges() {
+	for _, c := range n.overlay.Changes() {
+		fmt.Printf("%s %s\n", c.Op, c.Path)
+	}
+}
+
+// Prime does the work of a build of the targets listed on the command line up
+// to running the first command.
+// @return an exit code.
+func (n *ninjaMain) Prime(args []string, status nin.Status) int {
+	targets, err := n.collectTargetsFromArgs(args)
+	if err != nil {
+		status.Error("%s", err)
+		return 1
+	}
+	n.di.AllowStatCache(!disableExperimentalStatcache)
+	s, err := n.newBuilder(status).Prime(targets, n.config.ToolDigests, n.config.Parallelism)
+	if err != nil {
+		status.Error("%s", err)
+		return 1
+	}
+	if !n.readOnly() {
+		if err := n.config.ToolDigests.Save(n.digestsPath()); err != nil {
+			status.Warning("%s", err)
+		}
+	}
+	status.Info("primed: %d edges to run, %d source files, %d newly hashed", s.Edges, s.Sources, s.Hashed)
+	return 0
+}
+
+// Build the targets listed on the command line.
+// @return an exit code.
+func (n *ninjaMain) RunBuild(args []string, status nin.Status) int {
+	if n.retryFailed {
+		if len(args) != 0 {
+			status.Error("-retry-failed can't be used with targets")
+			return 1
+		}
+		failed, err := readTargetsFile(n.failedEdgesPath())
+		if err != nil && !os.IsNotExist(err) {
+			status.Error("%s", err)
+			return 1
+		}
+		// Skip the outputs that were removed from the manifest since.
+		for _, f := range failed {
+			if n.state.Paths[f] != nil {
+				args = append(args, f)
+			}
+		}
+		if len(args) == 0 {
+			status.Info("no failed edges to retry.")
+			return 0
+		}
+	}
+	var restrict []*nin.Edge
+	if n.single {
+		if len(args) == 0 {
+			status.Error("-single requires source files")
+			return 1
+		}
+		sources := args
+		args = make([]string, 0, len(sources))
+		for _, s := range sources {
+			p, _ := nin.CanonicalizePathBits(s)
+			edge, err := n.state.CompileEdge(p, &n.depsLog)
+			if err != nil {
+				status.Error("%s", err)
+				return 1
+			}
+			edges, err := nin.SingleFileEdges(edge, &n.di)
+			if err != nil {
+				status.Error("%s", err)
+				return 1
+			}
+			restrict = append(restrict, edges...)
+			args = append(args, edge.Outputs[0].Path)
+		}
+	}
+	targets, err := n.collectTargetsFromArgs(args)
+	if err != nil {
+		status.Error("%s", err)
+		return 1
+	}
+
+	n.di.AllowStatCache(!disableExperimentalStatcache)
+
+	builder := n.newBuilder(status)
+	if restrict != nil {
+		builder.RestrictTo(restrict)
+	}
+	if n.launchers != nil {
+		builder.Hooks.BeforeEdge = n.launchers.BeforeEdge
+	}
+	if tests := n.tests; tests != nil {
+		launch := builder.Hooks.BeforeEdge
+		builder.Hooks.BeforeEdge = func(edge *nin.Edge) nin.EdgeDecision {
+			if d := tests.BeforeEdge(edge); d.Skip || d.Err != nil || launch == nil {
+				return d
+			}
+			return launch(edge)
+		}
+	}
+	failures := &nin.FailureSummary{Redactor: n.redactor}
+	usage := &nin.UsageSummary{}
+	runs := &nin.RunRecord{}
+	var report *telemetryCollector
+	if n.telemetry != nil {
+		report = &telemetryCollector{}
+	}
+	builder.Hooks.AfterEdge = func(result *nin.Result, startTimeMillis, endTimeMillis int32) {
+		// Mask the secrets before the output is printed or recorded.
+		result.Output = n.redactor.Redact(result.Output)
+		failures.Record(result)
+		if report != nil {
+			report.record(result, startTimeMillis, endTimeMillis)
+		}
+		if n.keepHistory > 0 {
+			runs.Record(result, startTimeMillis, endTimeMillis)
+		}
+		if n.tests != nil {
+			n.tests.Record(result)
+		}
+		if result.Usage != (nin.ResourceUsage{}) {
+			usage.Record(result.Edge.Rule.Name, &result.Usage)
+		}
+	}
+	if n.config.ManifestChange != nin.ManifestChangeIgnore && len(n.manifestFiles) != 0 {
+		if err := builder.WatchManifest(n.manifestFiles); err != nil {
+			status.Error("%s", err)
+			return 1
+		}
+	}
+	// Scan the other targets while the commands of the first one run, unless
+	// the estimate of the whole build is printed.
+	queue := len(targets) > 1 && !compatNinja && !nin.Debug.Explaining && !n.printsEstimate()
+	scanned := targets
+	if queue {
+		scanned = targets[:1]
+	}
+	for _, t := range scanned {
+		if dirty, err := builder.AddTarget(t); !dirty {
+			if err != nil {
+				status.Error("%s", err)
+				return 1
+			}
+			// Added a target that is already up-to-date; not really
+			// an error.
+		}
+	}
+
+	// Make sure restat rules and the queued targets do not see stale
+	// timestamps.
+	n.di.AllowStatCache(false)
+	if queue {
+		for _, t := range targets[1:] {
+			if err := builder.QueueTarget(t); err != nil {
+				status.Error("%s", err)
+				return 1
+			}
+		}
+	}
+
+	if builder.AlreadyUpToDate() {
+		if n.retryFailed && !n.readOnly() {
+			// All the failed edges are up to date, e.g. they were built in
+			// another way.
+			_ = os.Remove(n.failedEdgesPath())
+		}
+		if !n.readOnly() && !compatNinja {
+			n.writeSnapshot(true, status)
+		}
+		status.Info("no work to do.")
+		return 0
+	}
+	if !n.confirmBuild(builder, status) {
+		return 1
+	}
+	var guard *nin.SourceGuard
+	if n.readOnlySources {
+		if guard, err = n.guardSources(builder); err != nil {
+			status.Error("-readonly-sources: %s", err)
+			return 1
+		}
+	}
+
+	if n.config.Shuffle {
+		status.Info("shuffling the edges; reproduce with -shuffle=%d", n.config.ShuffleSeed)
+	}
+	var caches []nin.CompilerCacheStats
+	if !n.readOnly() && !compatNinja {
+		caches = n.compilerCacheStats(builder, nil, status)
+	}
+	var logOffset int64
+	if fi, err2 := os.Stat(n.buildLogPath()); err2 == nil {
+		logOffset = fi.Size()
+	}
+	start := time.Now()
+	err = builder.Build()
+	if guard != nil {
+		for _, c := range guard.Check() {
+			status.Error("%s", &c)
+			if err == nil {
+				err = errors.New("source files were modified")
+			}
+		}
+	}
+	if report != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err2 := n.telemetry.upload(ctx, report.report(n.telemetry, err == nil, n.config.Parallelism, time.Since(start)))
+		cancel()
+		if err2 != nil {
+			status.Warning("telemetry: %s", err2)
+		}
+	}
+	if len(caches) != 0 {
+		caches = n.compilerCacheStats(builder, caches, status)
+		for i := range caches {
+			if n.statusJSON != nil {
+				n.statusJSON.compilerCache(&caches[i])
+			}
+			if c := &caches[i]; c.Hits+c.Misses != 0 && n.config.Verbosity != nin.Quiet && n.config.Verbosity != nin.Terse {
+				status.Info("%s: %d hits, %d misses (%.0f%% hit rate)", c.Tool, c.Hits, c.Misses, 100*c.HitRate())
+			}
+		}
+	}
+	if n.config.Verbosity == nin.Terse {
+		defer n.printStats(builder.Progress(), caches, status)
+	}
+	if !n.readOnly() && !compatNinja {
+		// Remember the failed edges for -retry-failed.
+		if err2 := failures.SaveTargets(n.failedEdgesPath()); err2 != nil {
+			status.Warning("%s", err2)
+		}
+		if builder.Progress().Finished != 0 {
+			if err2 := nin.ArchiveBuild(n.historyPath(), n.buildLogPath(), logOffset, runs, n.keepHistory); err2 != nil {
+				status.Warning("%s", err2)
+			}
+		}
+		n.writeSnapshot(err == nil, status)
+	}
+	if err == nil && builder.Progress().Total == 0 {
+		// All the queued targets were up to date.
+		status.Info("no work to do.")
+		return 0
+	}
+	if !n.readOnly() && n.config.Verbosity != nin.Quiet && !compatNinja {
+		n.printScheduleHints(status)
+	}
+	if n.rusage {
+		printRuleUsage(usage.Rules())
+	}
+	if err != nil {
+		if len(failures.Failures) != 0 && (n.failureSummary > 0 || n.failureLogs != "") {
+			n.printFailureSummary(failures, status)
+		} else if !compatNinja {
+			// Without the summary, still tell which failures are consequences
+			// of an earlier one.
+			for _, f := range failures.Failures {
+				if chain := failures.Chain(f); len(chain) != 0 {
+					status.Info("%s", failureChainText(f.Edge, chain))
+				}
+			}
+		}
+		status.Info("build stopped: %s.", err)
+		if errors.Is(err, &nin.ErrManifestChanged{}) {
+			n.manifestChanged = true
+		}
+		if errors.Is(err, nin.ErrInterrupted) {
+			return 2
+		}
+		return 1
 	}
+	return 0
+}
 
-	status, err := n.buildLog.Load(logPath)
-	if status == nin.LoadError {
-		errorf("loading build log %s: %s", logPath, err)
-		return false
+// guardSources hooks a SourceGuard to the builder to detect the commands
+// modifying the files tracked by git that are not outputs.
+func (n *ninjaMain) guardSources(builder *nin.Builder) (*nin.SourceGuard, error) {
+	var sources []string
+	for _, f := range n.gitTrackedFiles() {
+		if node := n.state.Paths[nin.CanonicalizePath(f)]; node == nil || node.InEdge == nil {
+			sources = append(sources, f)
+		}
+	}
+	if len(sources) == 0 {
+		return nil, errors.New("no source file tracked by git")
 	}
+	guard, err := nin.NewSourceGuard(&n.di, sources)
 	if err != nil {
-		// Hack: Load() can return a warning via err by returning LOAD_SUCCESS.
-		warningf("%s", err)
+		return nil, err
 	}
-
-	if recompactOnly {
-		if status == nin.LoadNotFound {
-			return true
-		}
-
-		if err = n.buildLog.Recompact(logPath, n); err != nil {
-			errorf("failed recompaction: %s", err)
-			return false
+	guard.Interval = time.Second
+	before, after := builder.Hooks.BeforeEdge, builder.Hooks.AfterEdge
+	builder.Hooks.BeforeEdge = func(edge *nin.Edge) nin.EdgeDecision {
+		guard.BeforeEdge(edge)
+		if before == nil {
+			return nin.EdgeDecision{}
 		}
-		return true
+		return before(edge)
 	}
-
-	if !n.config.DryRun {
-		if err = n.buildLog.OpenForWrite(logPath, n); err != nil {
-			errorf("opening build log: %s", err)
-			return false
-		}
+	builder.Hooks.AfterEdge = func(result *nin.Result, startTimeMillis, endTimeMillis int32) {
+		guard.AfterEdge(result, startTimeMillis, endTimeMillis)
+		after(result, startTimeMillis, endTimeMillis)
 	}
-
-	return true
+	return guard, nil
 }
 
-// Open the deps log: load it, then open for writing.
-// @return false on error.
-// Open the deps log: load it, then open for writing.
-// @return false on error.
-func (n *ninjaMain) OpenDepsLog(recompactOnly bool) bool {
-	path := ".ninja_deps"
-	if n.buildDir != "" {
-		path = n.buildDir + "/" + path
-	}
+// printsEstimate returns true when confirmBuild prints the work estimate.
+func (n *ninjaMain) printsEstimate() bool {
+	return !compatNinja && (n.confirm != 0 || n.config.Verbosity == nin.Verbose)
+}
 
-	status, err := n.depsLog.Load(path, &n.state)
-	if status == nin.LoadError {
-		errorf("loading deps log %s: %s", path, err)
-		return false
+// confirmBuild prints the work estimate with -v or -confirm and, when more
+// edges than -confirm are to run, asks the user to confirm.
+func (n *ninjaMain) confirmBuild(builder *nin.Builder, status nin.Status) bool {
+	if !n.printsEstimate() {
+		return true
 	}
-	if err != nil {
-		// Load() can return a warning via err by returning LOAD_SUCCESS.
-		warningf("%s", err)
+	w := builder.Estimate()
+	if w.Known == 0 {
+		status.Info("%d edges to run, %d cache-eligible, duration unknown", w.Edges, w.CacheEligible)
+	} else {
+		status.Info("%d edges to run, %d cache-eligible, estimated %s (%s of CPU, %d edges never built)", w.Edges, w.CacheEligible, w.Wall.Round(time.Second), w.CPU.Round(time.Second), w.Edges-w.Known)
 	}
-
-	if recompactOnly {
-		if status == nin.LoadNotFound {
-			return true
-		}
-		if err := n.depsLog.Recompact(path); err != nil {
-			errorf("failed recompaction: %s", err)
-			return false
-		}
+	if n.confirm == 0 || w.Edges <= n.confirm {
 		return true
 	}
-
-	if !n.config.DryRun {
-		if err := n.depsLog.OpenForWrite(path); err != nil {
-			errorf("opening deps log: %s", err)
-			return false
-		}
+	if fi, err := os.Stdin.Stat(); err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		status.Error("more than %d edges to run and stdin is not a terminal; rerun with a higher -confirm", n.confirm)
+		return false
+	}
+	fmt.Fprintf(os.Stderr, "more than %d edges to run; continue? [y/N] ", n.confirm)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	if a := strings.TrimSpace(strings.ToLower(answer)); a != "y" && a != "yes" {
+		status.Info("build canceled.")
+		return false
 	}
-
 	return true
 }
 
-// Dump the output requested by '-d stats'.
-func (n *ninjaMain) DumpMetrics() {
-	nin.Metrics.Report()
-
-	fmt.Printf("\n")
-	// There's no such concept in Go's map.
-	//count := len(n.state.paths)
-	//buckets := len(n.state.paths)
-	//fmt.Printf("path.node hash load %.2f (%d entries / %d buckets)\n", count/float64(buckets), count, buckets)
+// formatMeta returns the edge metadata as ", key=value" pairs sorted by key.
+func formatMeta(meta map[string]string) string {
+	keys := make([]string, 0, len(meta))
+	for k := range meta {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	out := ""
+	for _, k := range keys {
+		out += ", " + k + "=" + meta[k]
+	}
+	return out
 }
 
-// Ensure the build directory exists, creating it if necessary.
-// @return false on error.
-func (n *ninjaMain) EnsureBuildDirExists() bool {
-	n.buildDir = n.state.Bindings.LookupVariable("builddir")
-	if n.buildDir != "" && !n.config.DryRun {
-		if err := nin.MakeDirs(&n.di, filepath.Join(n.buildDir, ".")); err != nil {
-			errorf("creating build directory %s", n.buildDir)
-			return false
+// compilerCacheStats returns the statistics of the compiler caches used by
+// the commands planned by builder. With before, it returns the statistics
+// accumulated since.
+func (n *ninjaMain) compilerCacheStats(builder *nin.Builder, before []nin.CompilerCacheStats, status nin.Status) []nin.CompilerCacheStats {
+	var tools []string
+	if before == nil {
+		extra := []string{os.Getenv("RUSTC_WRAPPER")}
+		if n.launchers != nil {
+			for _, l := range n.launchers.Launchers {
+				extra = append(extra, l.Command)
+			}
+		}
+		tools = builder.CompilerCaches(extra...)
+	} else {
+		for _, b := range before {
+			tools = append(tools, b.Tool)
 		}
 	}
-	return true
+	var out []nin.CompilerCacheStats
+	for i, t := range tools {
+		s, err := nin.QueryCompilerCacheStats(context.Background(), t)
+		if err != nil {
+			status.Warning("%s statistics unavailable: %s", t, err)
+			continue
+		}
+		if before != nil {
+			s = s.Sub(&before[i])
+		}
+		out = append(out, s)
+	}
+	return out
 }
 
-// Build the targets listed on the command line.
-// @return an exit code.
-func (n *ninjaMain) RunBuild(args []string, status nin.Status) int {
-	targets, err := n.collectTargetsFromArgs(args)
-	if err != nil {
-		status.Error("%s", err)
-		return 1
+// printStats prints the one-line statistics summary of -terse.
+func (n *ninjaMain) printStats(p nin.ProgressSnapshot, caches []nin.CompilerCacheStats, status nin.Status) {
+	msg := fmt.Sprintf("%d edges run", p.Finished-p.Skipped)
+	if p.Failed != 0 {
+		msg += fmt.Sprintf(", %d failed", p.Failed)
 	}
+	if p.Skipped != 0 {
+		msg += fmt.Sprintf(", %d cache hits", p.Skipped)
+	}
+	msg += fmt.Sprintf(" in %s", time.Duration(nin.GetTimeMillis()-n.startTimeMillis)*time.Millisecond)
+	if rss := childrenMaxRSS(); rss != 0 {
+		msg += fmt.Sprintf(", max RSS %.1fMiB", float64(rss)/(1024*1024))
+	}
+	for i := range caches {
+		if c := &caches[i]; c.Hits+c.Misses != 0 {
+			msg += fmt.Sprintf(", %s %.0f%% hits", c.Tool, 100*c.HitRate())
+		}
+	}
+	status.Info("%s", msg)
+}
 
-	n.di.AllowStatCache(!disableExperimentalStatcache)
-
-	builder := nin.NewBuilder(&n.state, n.config, &n.buildLog, &n.depsLog, &n.di, status, n.startTimeMillis)
-	for i := 0; i < len(targets); i++ {
-		if dirty, err := builder.AddTarget(targets[i]); !dirty {
-			if err != nil {
-				status.Error("%s", err)
-				return 1
+// printFailureSummary prints the failed edges, with the first lines of their
+// output, and writes their full output to files if requested.
+func (n *ninjaMain) printFailureSummary(failures *nin.FailureSummary, status nin.Status) {
+	color := n.printer != nil && n.printer.printer.supportsColor
+	if n.failureSummary > 0 {
+		if color {
+			fmt.Printf("\x1B[31mFAILED targets:\x1B[0m\n")
+		} else {
+			fmt.Printf("FAILED targets:\n")
+		}
+		for _, g := range failures.Grouped() {
+			for _, f := range g {
+				outputs := make([]string, 0, len(f.Edge.Outputs))
+				for _, o := range f.Edge.Outputs {
+					outputs = append(outputs, o.Path)
+				}
+				fmt.Printf("  %s (%s, exit code %d%s)\n", strings.Join(outputs, " "), f.Edge.Rule.Name, f.ExitCode, formatMeta(f.Edge.Meta()))
+				if chain := failures.Chain(f); len(chain) != 0 {
+					fmt.Printf("    %s\n", failureChainText(f.Edge, chain))
+				}
+			}
+			// The output is printed once for the whole group.
+			output := g[0].Output
+			if !color {
+				output = stripAnsiEscapeCodes(output)
+			}
+			lines := strings.Split(strings.TrimRight(output, "\n"), "\n")
+			if len(lines) == 1 && lines[0] == "" {
+				continue
+			}
+			for i, l := range lines {
+				if i == n.failureSummary {
+					fmt.Printf("      ... (%d more lines)\n", len(lines)-i)
+					break
+				}
+				fmt.Printf("      %s\n", l)
 			}
-			// Added a target that is already up-to-date; not really
-			// an error.
 		}
 	}
-
-	// Make sure restat rules do not see stale timestamps.
-	n.di.AllowStatCache(false)
-
-	if builder.AlreadyUpToDate() {
-		status.Info("no work to do.")
-		return 0
+	if n.failureLogs != "" {
+		if _, err := failures.WriteLogs(n.failureLogs); err != nil {
+			status.Warning("writing failure logs: %s", err)
+		} else {
+			status.Info("the output of the %d failed edges was written to %s", len(failures.Failures), n.failureLogs)
+		}
 	}
+}
 
-	if err := builder.Build(); err != nil {
-		status.Info("build stopped: %s.", err)
-		if strings.Contains(err.Error(), "interrupted by user") {
-			return 2
+// failureChainText returns the causal chain of the failure of edge, e.g.
+// "foo.o failed because gen/foo.h failed".
+func failureChainText(edge *nin.Edge, chain []*nin.Edge) string {
+	name := func(e *nin.Edge) string {
+		if len(e.Outputs) != 0 {
+			return e.Outputs[0].Path
 		}
-		return 1
+		return e.Rule.Name
+	}
+	out := name(edge) + " failed"
+	for _, e := range chain {
+		out += " because " + name(e) + " failed"
+	}
+	return out
+}
+
+// printScheduleHints prints hints about what limited the parallelism of the
+// build that just completed.
+func (n *ninjaMain) printScheduleHints(status nin.Status) {
+	entries, err := nin.ReadLastBuild(n.buildLogPath())
+	if err != nil {
+		return
+	}
+	for _, h := range nin.AnalyzeSchedule(&n.state, entries, n.config.Parallelism) {
+		status.Info("hint: %s", h)
 	}
-	return 0
 }
 
 /*
@@ -1129,6 +3898,54 @@ func (m *multi) Set(s string) error {
 	return nil
 }
 
+// shuffleFlag is -shuffle, which is a boolean flag that optionally takes the
+// seed as its value.
+type shuffleFlag struct {
+	config *nin.BuildConfig
+}
+
+func (s *shuffleFlag) String() string {
+	if s.config == nil || !s.config.Shuffle {
+		return ""
+	}
+	return strconv.FormatInt(s.config.ShuffleSeed, 10)
+}
+
+func (s *shuffleFlag) IsBoolFlag() bool {
+	return true
+}
+
+func (s *shuffleFlag) Set(v string) error {
+	switch v {
+	case "false":
+		s.config.Shuffle = false
+	case "true":
+		s.config.Shuffle = true
+		s.config.ShuffleSeed = time.Now().UnixNano()
+	default:
+		seed, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return errors.New("invalid seed")
+		}
+		s.config.Shuffle = true
+		s.config.ShuffleSeed = seed
+	}
+	return nil
+}
+
+// ruleSet returns the rule names in values, which can be comma separated.
+func ruleSet(values []string) map[string]bool {
+	out := map[string]bool{}
+	for _, v := range values {
+		for _, r := range strings.Split(v, ",") {
+			if r != "" {
+				out[r] = true
+			}
+		}
+	}
+	return out
+}
+
 // Parse args for command-line options.
 // Returns an exit code, or -1 if Ninja should continue.
 func readFlags(opts *options, config *nin.BuildConfig) int {
@@ -1161,21 +3978,111 @@ func readFlags(opts *options, config *nin.BuildConfig) int {
 	// Flags that do not exist in the C++ code:
 	serial := flag.Bool("serial", false, "parse subninja files serially; default is concurrent")
 	noprewarm := flag.Bool("noprewarm", false, "do not prewarm subninja files; instead process them in order")
+	flag.Float64Var(&config.MaxSpawnRate, "spawnrate", 0, "do not start more than N processes per second on average (0 means infinity)")
+	memLimit := flag.String("mem-limit", "", "do not start commands whose expected memory, from their mem binding or the previous build, would exceed SIZE in total, e.g. 32G; auto uses the physical memory")
+	flag.IntVar(&config.RemoteParallelism, "remote-jobs", 0, "run N edges of the rules with remoteable = 1 in parallel, e.g. with distcc; -j then only limits the other edges (0 means -j limits all edges)")
+	flag.BoolVar(&config.VerifyOutputs, "verify-outputs", false, "fail the edges whose command succeeded but did not write all their outputs")
+	flag.BoolVar(&config.DedupCommands, "dedup", false, "run the edges with an identical command and identical inputs only once; see -d stats for the count")
+	flag.StringVar(&opts.launchers, "launchers", "", "JSON file listing launchers, e.g. gomacc or rewrapper, to prepend to the commands of some rules")
+	flag.StringVar(&opts.outputPrefix, "output-prefix", "", "build the outputs under this directory, to have multiple output trees for one manifest; overrides the manifest's outroot variable")
+	flag.IntVar(&config.SpawnBurst, "spawnburst", 0, "number of processes that can be started at once despite -spawnrate")
+	flag.StringVar(&opts.format, "format", "text", "output format of the subtools; one of text or json")
+	flag.StringVar(&opts.statusJSON, "statusjson", "", "write build events as JSON lines to this file")
+	flag.IntVar(&config.PrefetchWorkers, "prefetch", 0, "read ahead the source files of the edges about to run with N goroutines (0 disables)")
+	flag.StringVar(&config.PosixShell, "posix-shell", "", "on Windows, run the commands with this shell, e.g. the sh.exe of MSYS2 or Cygwin, instead of directly; the paths are quoted and translated for it")
+	flag.BoolVar(&config.TrackTools, "track-tools", false, "record the digest of the program of each command, e.g. the compiler, so replacing it rebuilds the edges that used it; toggling it rebuilds everything once")
+	flag.BoolVar(&opts.lowMemory, "low-memory", false, "reduce the memory usage at the expense of speed, e.g. in constrained CI containers")
+	flag.IntVar(&opts.failureSummary, "failure-summary", 0, "at the end of a failed build, summarize the failed edges with the first N lines of their output (0 disables)")
+	flag.BoolVar(&opts.rusage, "rusage", false, "at the end of the build, print the CPU time, max RSS and I/O used per rule; see also -t rusage")
+	flag.StringVar(&opts.failureLogs, "failure-logs", "", "write the full output of each failed edge to a file in this directory")
+	flag.BoolVar(&opts.prime, "prime", false, "scan the targets, stat the files and hash the sources the build would read without running any command, so the next build starts with warm caches, e.g. after a reboot")
+	flag.BoolVar(&opts.single, "single", false, "treat the targets as source files and only build the edge compiling each of them, plus the generated inputs that don't exist yet; e.g. for an IDE")
+	flag.BoolVar(&opts.retryFailed, "retry-failed", false, "only build the edges that failed in the last build, and their dirty dependencies")
+	flag.IntVar(&opts.keepHistory, "keep-history", 10, "archive the build log entries and the outcome of the edges of the last N builds compressed in .ninja_history for -t history and -t flaky (0 disables)")
+	flag.IntVar(&opts.keepSnapshots, "keep-snapshots", 10, "keep a snapshot of the graph at the end of the last N builds in .ninja_history for -t statediff (0 disables)")
+	flag.DurationVar(&config.CancelGrace, "cancel-grace", 0, "on the first failure, stop starting commands whatever -k is, and cancel the ones still running after this duration, e.g. 30s (0 disables)")
+	telemetry := flag.Bool("telemetry", os.Getenv("NIN_TELEMETRY") == "1", "opt in to send an anonymized report of the duration of each build to the telemetry endpoint of "+projectConfigFile+"; defaults to true when NIN_TELEMETRY=1")
+	flag.BoolVar(&opts.readOnlySources, "readonly-sources", false, "fail the build when a command modifies a file tracked by git, checked at most every second")
+	flag.IntVar(&opts.confirm, "confirm", 0, "print the estimated work and ask for confirmation before running more than N edges, to guard against accidental full rebuilds (0 disables)")
+	flag.BoolVar(&opts.focus, "focus", false, "on the first failure, stop starting commands, let the running ones finish, then print all the failures with their output; implies -k 1")
+	terse := flag.Bool("terse", false, "like -quiet, and print a one-line statistics summary at the end; for CI logs")
+	flag.BoolVar(&opts.title, "title", false, "show the percentage done and the failures in the terminal title and, with the OSC 9;4 sequence, in the taskbar of Windows Terminal, ConEmu or iTerm2; only when stdout is a terminal")
+	flag.IntVar(&opts.commandWidth, "command-width", 0, "with -v, shorten the commands longer than N characters (0 means no limit)")
+	flag.Var(&opts.showCommand, "show-command", "always print the full command of the edges of this rule; can be repeated")
+	flag.Var(&opts.showRspfile, "show-rspfile", "print the response file content along the command of the edges of this rule; can be repeated")
+	flag.Var(&shuffleFlag{config}, "shuffle", "start the ready edges in a random order to find missing dependencies; use -shuffle=SEED to reproduce a previous order")
+	flag.DurationVar(&config.ShuffleMaxDelay, "shuffle-delay", 0, "with -shuffle, delay the start of each command by a random duration up to this value")
+	flag.BoolVar(&opts.sandboxOutputs, "sandbox-outputs", false, "do not run the commands nor modify the tree; print the files the build would write instead")
+	profile := flag.String("profile", "", "apply a named bundle of flags; one of fast, safe, ci or a profile defined in "+projectConfigFile+"; the flags on the command line take precedence")
+	logSync := flag.String("log-sync", "none", "how to flush the build and deps logs to the disk when closing them; one of none, fsync or full (F_FULLFSYNC on macOS)")
+	manifestChange := flag.String("manifestchange", "ignore", "what to do when the manifest changes during the build; one of ignore, finish (the running commands) or cancel, then reload")
+	compat := flag.String("compat", "", "disable nin specific behaviors to match ninja's output; only ninja-1.11 is supported")
 	opts.parserOpts.Concurrency = nin.ParseManifestConcurrentParsing
 
 	flag.Usage = usage
+	if err := unknownFlag(flag.CommandLine, os.Args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 2
+	}
 	flag.Parse()
 
+	// -compat changes how the other flags are handled, e.g. the warnings
+	// listed, so it is applied first.
+	switch *compat {
+	case "":
+	case "ninja-1.11":
+		compatNinja = true
+		nin.ProgramName = "ninja"
+	default:
+		fmt.Fprintf(os.Stderr, "invalid -compat %q; must be ninja-1.11\n", *compat)
+		return 2
+	}
+
+	c, err := loadProjectConfig(opts.workingDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 2
+	}
+	if *profile != "" {
+		if err := applyProfile(flag.CommandLine, *profile, c); err != nil {
+			fmt.Fprintf(os.Stderr, "-profile: %s\n", err)
+			return 2
+		}
+	}
+	if opts.hooks, err = newBuildHooks(c.Hooks); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", projectConfigFile, err)
+		return 2
+	}
+	if *telemetry && c.Telemetry != nil && !compatNinja {
+		if err := c.Telemetry.validate(); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", projectConfigFile, err)
+			return 2
+		}
+		opts.telemetry = c.Telemetry
+	}
+	if r := c.Redact; r != nil {
+		if opts.redactor, err = nin.NewRedactor(r.Patterns, r.Env); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", projectConfigFile, err)
+			return 2
+		}
+	}
 	if *verbose && *quiet {
 		fmt.Fprintf(os.Stderr, "can't use both -v and --quiet\n")
 		return 2
 	}
+	if *terse && (*verbose || *quiet) {
+		fmt.Fprintf(os.Stderr, "can't use -terse with -v or --quiet\n")
+		return 2
+	}
 	if *verbose {
 		config.Verbosity = nin.Verbose
 	}
 	if *quiet {
 		config.Verbosity = nin.NoStatusUpdate
 	}
+	if *terse {
+		config.Verbosity = nin.Terse
+	}
 	if *warning != "" {
 		if !warningEnable(*warning, opts) {
 			return 1
@@ -1186,8 +4093,61 @@ func readFlags(opts *options, config *nin.BuildConfig) int {
 	}
 	if *version {
 		fmt.Printf("%s\n", nin.NinjaVersion)
+		if *verbose {
+			features := make([]string, 0, len(nin.NinFeatures))
+			for f := range nin.NinFeatures {
+				features = append(features, f)
+			}
+			sort.Strings(features)
+			fmt.Printf("nin_required_version: %s\nnin_features: %s\n", nin.NinVersion, strings.Join(features, " "))
+		}
 		return 0
 	}
+	if opts.format != "text" && opts.format != "json" {
+		fmt.Fprintf(os.Stderr, "invalid -format %q; must be one of text or json\n", opts.format)
+		return 2
+	}
+	policy, err := nin.ParseLogSyncPolicy(*logSync)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "-log-sync: %s\n", err)
+		return 2
+	}
+	config.LogSync = policy
+	if err := config.ManifestChange.UnmarshalText([]byte(*manifestChange)); err != nil {
+		fmt.Fprintf(os.Stderr, "-manifestchange: %s\n", err)
+		return 2
+	}
+	if *memLimit == "auto" {
+		if config.MemoryLimit = physicalMemory(); config.MemoryLimit == 0 {
+			fmt.Fprintf(os.Stderr, "-mem-limit=auto: the physical memory is unknown on this OS\n")
+			return 2
+		}
+	} else if *memLimit != "" {
+		var err error
+		if config.MemoryLimit, err = nin.ParseMemorySize(*memLimit); err != nil {
+			fmt.Fprintf(os.Stderr, "-mem-limit: %s\n", err)
+			return 2
+		}
+	}
+	if config.Parallelism == 0 {
+		// 0 means infinity.
+		config.Parallelism = math.MaxInt32
+	}
+	if config.FailuresAllowed <= 0 {
+		// 0 means infinity.
+		config.FailuresAllowed = math.MaxInt32
+	}
+	if opts.focus {
+		config.FailuresAllowed = 1
+	}
+	if config.ShuffleMaxDelay != 0 && !config.Shuffle {
+		fmt.Fprintf(os.Stderr, "-shuffle-delay requires -shuffle\n")
+		return 2
+	}
+	if err := config.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 2
+	}
 	if *t != "" {
 		opts.tool = chooseTool(*t)
 		if opts.tool == nil {
@@ -1212,8 +4172,21 @@ func readFlags(opts *options, config *nin.BuildConfig) int {
 	if *serial {
 		opts.parserOpts.Concurrency = nin.ParseManifestPrewarmSubninja
 	}
-	if *noprewarm {
+	if *noprewarm || compatNinja {
+		opts.parserOpts.Concurrency = nin.ParseManifestSerial
+	}
+	if compatNinja {
+		opts.parserOpts.DisableExtensions = true
+		// The commands recorded in the build log must be the ones of ninja.
+		config.TrackTools = false
+		config.PosixShell = ""
+	}
+	if opts.lowMemory {
+		// Parse the manifests one at a time and don't memoize the evaluated
+		// bindings.
+		config.LowMemory = true
 		opts.parserOpts.Concurrency = nin.ParseManifestSerial
+		config.DepfileWorkers = 1
 	}
 
 	/*
@@ -1313,10 +4286,34 @@ func readFlags(opts *options, config *nin.BuildConfig) int {
 	return -1
 }
 
+// releaseMemoryPeriodically returns the memory freed by the GC to the OS
+// every period until the returned function is called.
+func releaseMemoryPeriodically(period time.Duration) func() {
+	done := make(chan struct{})
+	go func() {
+		t := time.NewTicker(period)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				debug.FreeOSMemory()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
+
 func mainImpl() int {
 	// Use exit() instead of return in this function to avoid potentially
 	// expensive cleanup when destructing ninjaMain.
 	config := nin.NewBuildConfig()
+	config.DepfileWorkers = runtime.NumCPU()
+	// Shared by the builds, including the one after the manifest is rebuilt.
+	config.ToolDigests = nin.NewDigestStore()
 	opts := options{}
 
 	//setvbuf(stdout, nil, _IOLBF, BUFSIZ)
@@ -1327,8 +4324,14 @@ func mainImpl() int {
 	}
 	// TODO(maruel): Handle os.Interrupt and cancel the context cleanly.
 
-	// Disable GC (TODO: unless running a stateful server).
-	debug.SetGCPercent(-1)
+	if opts.lowMemory {
+		// Keep the GC enabled and return the freed memory to the OS regularly.
+		debug.SetGCPercent(50)
+		defer releaseMemoryPeriodically(5 * time.Second)()
+	} else {
+		// Disable GC (TODO: unless running a stateful server).
+		debug.SetGCPercent(-1)
+	}
 
 	if opts.cpuprofile != "" {
 		f, err := os.Create(opts.cpuprofile)
@@ -1365,7 +4368,7 @@ func mainImpl() int {
 			log.Fatal("could not create trace: ", err)
 		}
 		defer f.Close()
-		// TODO(maruel): Use regions.
+		// The package records regions around its phases and a task per edge.
 		if err := trace.Start(f); err != nil {
 			log.Fatal("could not start trace: ", err)
 		}
@@ -1374,14 +4377,38 @@ func mainImpl() int {
 
 	args := flag.Args()
 
-	status := newStatusPrinter(&config)
+	printer := newStatusPrinter(&config)
+	printer.deferFailures = opts.focus
+	printer.commandWidth = opts.commandWidth
+	printer.showCommand = ruleSet(opts.showCommand)
+	printer.showRspfile = ruleSet(opts.showRspfile)
+	printer.redactor = opts.redactor
+	if fi, err := os.Stdout.Stat(); opts.title && err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+		printer.title = &terminalProgress{w: os.Stdout, percent: -1}
+	}
+	var status nin.Status = printer
+	var sj *statusJSON
+	if opts.statusJSON != "" {
+		f, err := os.Create(opts.statusJSON)
+		if err != nil {
+			fatalf("%s", err)
+		}
+		defer f.Close()
+		sj = newStatusJSON(f)
+		sj.redactor = opts.redactor
+		status = nin.NewMultiStatus(status, sj)
+	}
+	if opts.hooks != nil && opts.tool == nil {
+		status = nin.NewMultiStatus(status, opts.hooks)
+		defer opts.hooks.wait()
+	}
 	if opts.workingDir != "" {
 		// The formatting of this string, complete with funny quotes, is
 		// so Emacs can properly identify that the cwd has changed for
 		// subsequent commands.
 		// Don't print this if a tool is being used, so that tool output
 		// can be piped into a file without this string showing up.
-		if opts.tool == nil && config.Verbosity != nin.NoStatusUpdate {
+		if opts.tool == nil && config.Verbosity != nin.NoStatusUpdate && config.Verbosity != nin.Terse {
 			status.Info("Entering directory `%s'", opts.workingDir)
 		}
 		if err := os.Chdir(opts.workingDir); err != nil {
@@ -1389,12 +4416,42 @@ func mainImpl() int {
 		}
 	}
 
+	var launchers *nin.LauncherConfig
+	if opts.launchers != "" {
+		var err error
+		if launchers, err = nin.LoadLauncherConfig(opts.launchers); err != nil {
+			fatalf("%s", err)
+		}
+		launchers.Configure(&config)
+		for _, kv := range launchers.Environ() {
+			i := strings.IndexByte(kv, '=')
+			if err := os.Setenv(kv[:i], kv[i+1:]); err != nil {
+				fatalf("%s", err)
+			}
+		}
+	}
+
 	if opts.tool != nil && opts.tool.when == runAfterFlags {
 		// None of the runAfterFlags actually use a ninjaMain, but it's needed
 		// by other tools.
 		ninja := newNinjaMain(ninjaCommand, &config)
 		return opts.tool.tool(&ninja, &opts, args)
 	}
+	if wantsHelp(&opts, args) {
+		// A target named help takes precedence, so only skip loading the
+		// manifest when there is none.
+		if _, err := os.Stat(opts.inputFile); err != nil {
+			return runHelp(args[1:])
+		}
+	}
+
+	if !compatNinja {
+		var err error
+		if args, err = expandArgFiles(args); err != nil {
+			status.Error("%s", err)
+			return 1
+		}
+	}
 
 	// TODO(maruel): Let's wrap stdout/stderr with our own buffer?
 
@@ -1413,6 +4470,23 @@ func mainImpl() int {
 	const cycleLimit = 100
 	for cycle := 1; cycle <= cycleLimit; cycle++ {
 		ninja := newNinjaMain(ninjaCommand, &config)
+		ninja.printer = printer
+		ninja.failureSummary = opts.failureSummary
+		ninja.rusage = opts.rusage
+		ninja.failureLogs = opts.failureLogs
+		ninja.retryFailed = opts.retryFailed
+		ninja.keepHistory = opts.keepHistory
+		ninja.keepSnapshots = opts.keepSnapshots
+		ninja.single = opts.single
+		ninja.confirm = opts.confirm
+		ninja.readOnlySources = opts.readOnlySources
+		ninja.telemetry = opts.telemetry
+		ninja.redactor = opts.redactor
+		ninja.launchers = launchers
+		ninja.statusJSON = sj
+		if opts.sandboxOutputs {
+			ninja.overlay = nin.NewOverlayFileSystem(&ninja.di)
+		}
 		input, err2 := ninja.di.ReadFile(opts.inputFile)
 		if err2 != nil {
 			status.Error("%s", err2)
@@ -1422,10 +4496,39 @@ func mainImpl() int {
 			status.Error("%s", err)
 			return 1
 		}
+		if !compatNinja {
+			prefix := opts.outputPrefix
+			if prefix == "" {
+				prefix = ninja.state.Bindings.LookupVariable("outroot")
+			}
+			if err := ninja.state.RemapOutputs(prefix); err != nil {
+				status.Error("%s", err)
+				return 1
+			}
+			if prefix = nin.CanonicalizePath(filepath.ToSlash(prefix)); prefix != "." {
+				ninja.outputPrefix = prefix
+			}
+		}
+		// The tools don't create a Builder.
+		if config.PosixShell != "" {
+			ninja.state.UsePosixShell()
+		}
+		if opts.lowMemory {
+			ninja.state.DisableMemoization()
+			ninja.state.Compact()
+			debug.FreeOSMemory()
+		}
 
 		if opts.tool != nil && opts.tool.when == runAfterLoad {
 			return opts.tool.tool(&ninja, &opts, args)
 		}
+		if wantsHelp(&opts, args) && ninja.state.Paths["help"] == nil {
+			return runHelp(args[1:])
+		}
+
+		if !compatNinja && !ninja.checkOutputs(&opts, status) {
+			return 1
+		}
 
 		if !ninja.EnsureBuildDirExists() {
 			return 1
@@ -1434,10 +4537,24 @@ func mainImpl() int {
 		if !ninja.OpenBuildLog(false) || !ninja.OpenDepsLog(false) {
 			return 1
 		}
+		if !compatNinja {
+			if err := config.ToolDigests.Load(ninja.digestsPath()); err != nil {
+				status.Warning("%s", err)
+			}
+		}
+		if !compatNinja && !ninja.readOnly() {
+			if err := ninja.state.WriteManifestDeps(ninja.manifestDepsPath()); err != nil {
+				status.Warning("%s", err)
+			}
+		}
 
 		if opts.tool != nil && opts.tool.when == runAfterLogs {
 			return opts.tool.tool(&ninja, &opts, args)
 		}
+		if opts.prime && !compatNinja {
+			// Don't regenerate the manifest, that would run a command.
+			return ninja.Prime(args, status)
+		}
 
 		// Attempt to rebuild the manifest before building anything else
 		if rebuilt, err := ninja.RebuildManifest(opts.inputFile, status); rebuilt {
@@ -1446,17 +4563,44 @@ func mainImpl() int {
 			if config.DryRun {
 				return 0
 			}
+			if ninja.overlay != nil {
+				ninja.printSandboxChanges()
+				return 0
+			}
 			// Start the build over with the new manifest.
+			if !compatNinja {
+				if cycle == 1 {
+					status.Info("%s was regenerated, reloading", opts.inputFile)
+				} else {
+					status.Warning("%s was regenerated %d times in a row; the generator may not update all its outputs", opts.inputFile, cycle)
+				}
+			}
 			continue
 		} else if err != nil {
 			status.Error("rebuilding '%s': %s", opts.inputFile, err)
 			return 1
 		}
 
+		ninja.manifestFiles = append([]string{opts.inputFile}, ninja.state.ManifestFiles...)
 		result := ninja.RunBuild(args, status)
+		if !compatNinja && !ninja.readOnly() {
+			if err := config.ToolDigests.Save(ninja.digestsPath()); err != nil {
+				status.Warning("%s", err)
+			}
+		}
+		if ninja.overlay != nil {
+			ninja.printSandboxChanges()
+		}
+		if ninja.manifestChanged {
+			status.Info("reloading %s", opts.inputFile)
+			continue
+		}
 		if metricsEnabled {
 			ninja.DumpMetrics()
 		}
+		if opts.hooks != nil {
+			opts.hooks.finished(result)
+		}
 		return result
 	}
 
@@ -0,0 +1,153 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/maruel/nin"
+)
+
+func TestTargetsRdeps(t *testing.T) {
+	state := nin.NewState()
+	manifest := "rule cc\n  command = cc $in\n  deps = gcc\nrule link\n  command = link $in\nbuild foo.o: cc foo.c\nbuild bar.o: cc bar.c\nbuild app: link foo.o bar.o\n\x00"
+	if err := nin.ParseManifest(&state, nil, nin.ParseManifestOpts{}, "build.ninja", []byte(manifest)); err != nil {
+		t.Fatal(err)
+	}
+	// foo.h is only known through the deps log.
+	header := state.GetNode("foo.h", 0)
+	depsLog := nin.DepsLog{
+		Nodes: []*nin.Node{state.Paths["foo.o"], header},
+		Deps:  []*nin.Deps{{MTime: 1, Nodes: []*nin.Node{header}}},
+	}
+	var got []string
+	for _, n := range targetsRdeps(header, &depsLog) {
+		got = append(got, n.Path)
+	}
+	if len(got) != 2 || got[0] != "app" || got[1] != "foo.o" {
+		t.Fatal(got)
+	}
+}
+
+func TestSuggest(t *testing.T) {
+	tools := []string{"clean", "plan", "compdb"}
+	if got := nin.SuggestionText(suggest("lan", tools...)); got != "'plan' or 'clean'" {
+		t.Fatal(got)
+	}
+	compatNinja = true
+	defer func() { compatNinja = false }()
+	if got := nin.SuggestionText(suggest("lan", tools...)); got != "'plan'" {
+		t.Fatal(got)
+	}
+	if got := suggest("CLEAN", tools...); got != nil {
+		t.Fatal(got)
+	}
+}
+
+// chdirTemp changes the current directory to a temporary one for the
+// duration of the test.
+func chdirTemp(t *testing.T) string {
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := os.Chdir(wd); err != nil {
+			t.Error(err)
+		}
+	})
+	return dir
+}
+
+// infoStatus records the messages passed to Info.
+type infoStatus struct {
+	infos []string
+}
+
+func (s *infoStatus) PlanHasTotalEdges(total int)                                    {}
+func (s *infoStatus) BuildEdgeStarted(edge *nin.Edge, startTimeMillis int32)         {}
+func (s *infoStatus) BuildEdgeFinished(edge *nin.Edge, end int32, ok bool, o string) {}
+func (s *infoStatus) BuildLoadDyndeps()                                              {}
+func (s *infoStatus) BuildStarted()                                                  {}
+func (s *infoStatus) BuildFinished()                                                 {}
+func (s *infoStatus) Info(msg string, i ...interface{}) {
+	s.infos = append(s.infos, fmt.Sprintf(msg, i...))
+}
+func (s *infoStatus) Warning(msg string, i ...interface{}) {}
+func (s *infoStatus) Error(msg string, i ...interface{})   {}
+
+func TestRunBuild_EstimateAllTargets(t *testing.T) {
+	chdirTemp(t)
+	config := nin.NewBuildConfig()
+	config.Verbosity = nin.Verbose
+	n := newNinjaMain("nin", &config)
+	manifest := "rule touch\n  command = touch $out\nbuild a: touch\nbuild b: touch\nbuild c: touch\n\x00"
+	if err := nin.ParseManifest(&n.state, nil, nin.ParseManifestOpts{}, "build.ninja", []byte(manifest)); err != nil {
+		t.Fatal(err)
+	}
+	if !n.OpenBuildLog(false) || !n.OpenDepsLog(false) {
+		t.Fatal("failed to open the logs")
+	}
+	defer n.Close()
+	status := &infoStatus{}
+	if code := n.RunBuild([]string{"a", "b", "c"}, status); code != 0 {
+		t.Fatal(code)
+	}
+	if len(status.infos) == 0 || status.infos[0] != "3 edges to run, 0 cache-eligible, duration unknown" {
+		t.Fatal(status.infos)
+	}
+}
+
+func TestGitTrackedFiles_Cache(t *testing.T) {
+	dir := chdirTemp(t)
+	// A fake checkout; git can't read it and must not look further up.
+	t.Setenv("GIT_CEILING_DIRECTORIES", filepath.Dir(dir))
+	index := filepath.Join(dir, ".git", "index")
+	if err := os.MkdirAll(filepath.Dir(index), 0o777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(index, []byte("index"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := ninjaMain{state: nin.NewState()}
+	key := fmt.Sprintf("%d %d\n", fi.ModTime().UnixNano(), fi.Size())
+	if err := ioutil.WriteFile(n.gitFilesPath(), []byte(key+"a\x00b c\x00"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	if got := n.gitTrackedFiles(); len(got) != 2 || got[0] != "a" || got[1] != "b c" {
+		t.Fatal(got)
+	}
+	// The index changed so git is run again.
+	future := fi.ModTime().Add(time.Second)
+	if err := os.Chtimes(index, future, future); err != nil {
+		t.Fatal(err)
+	}
+	if got := n.gitTrackedFiles(); len(got) != 0 {
+		t.Fatal(got)
+	}
+}
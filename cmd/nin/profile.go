@@ -0,0 +1,143 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// projectConfigFile is the name of the optional per project configuration
+// file, looked up in the directory nin runs in, i.e. after -C.
+const projectConfigFile = ".nin.json"
+
+// projectConfig is the content of projectConfigFile.
+type projectConfig struct {
+	// Profiles are named bundles of flags selected with -profile. The keys are
+	// the flag names without the dash and the values are the flag values, e.g.
+	// {"ci": {"k": 10, "log-sync": "fsync"}}. A profile replaces the built-in
+	// one with the same name.
+	Profiles map[string]map[string]interface{} `json:"profiles"`
+	// Hooks are run asynchronously on the build lifecycle events, e.g. to
+	// post a chat notification on failure.
+	Hooks []hookConfig `json:"hooks"`
+	// Telemetry is the endpoint receiving a report of each build, for the
+	// users who opt in.
+	Telemetry *telemetryConfig `json:"telemetry"`
+	// Redact masks the secrets in the commands and their output, e.g.
+	// {"env": ["SIGNING_KEY"], "patterns": ["--token[= ](\\S+)"]}.
+	Redact *redactConfig `json:"redact"`
+}
+
+// redactConfig is the "redact" section of the projectConfigFile.
+type redactConfig struct {
+	// Patterns are regexps. When one has a group, only the group is masked.
+	Patterns []string `json:"patterns"`
+	// Env are the names of the environment variables whose value is masked.
+	Env []string `json:"env"`
+}
+
+// builtinProfiles are the profiles available without a configuration file.
+var builtinProfiles = map[string]map[string]interface{}{
+	// fast trades the safety nets for speed, e.g. for local iteration.
+	"fast": {
+		"log-sync":       "none",
+		"track-tools":    false,
+		"verify-outputs": false,
+		"keep-history":   0,
+	},
+	// safe catches as many problems as possible.
+	"safe": {
+		"d":              "nostatcache",
+		"log-sync":       "fsync",
+		"track-tools":    true,
+		"verify-outputs": true,
+	},
+	// ci keeps the logs short and the failures readable.
+	"ci": {
+		"terse":           true,
+		"log-sync":        "fsync",
+		"track-tools":     true,
+		"verify-outputs":  true,
+		"failure-summary": 20,
+		"keep-history":    0,
+	},
+}
+
+// loadProjectConfig loads the projectConfigFile in dir, if any.
+func loadProjectConfig(dir string) (*projectConfig, error) {
+	p := filepath.Join(dir, projectConfigFile)
+	c := &projectConfig{}
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return c, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("%s: %w", p, err)
+	}
+	return c, nil
+}
+
+// applyProfile sets the flags of the profile name that were not set
+// explicitly on the command line, so the command line always wins.
+func applyProfile(fs *flag.FlagSet, name string, c *projectConfig) error {
+	profile, ok := c.Profiles[name]
+	if !ok {
+		if profile, ok = builtinProfiles[name]; !ok {
+			var names []string
+			for n := range builtinProfiles {
+				names = append(names, n)
+			}
+			for n := range c.Profiles {
+				if _, ok := builtinProfiles[n]; !ok {
+					names = append(names, n)
+				}
+			}
+			sort.Strings(names)
+			return fmt.Errorf("unknown profile %q; must be one of %s", name, strings.Join(names, ", "))
+		}
+	}
+	explicit := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	keys := make([]string, 0, len(profile))
+	for k := range profile {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		// -compat is applied before the profile is loaded.
+		if k == "profile" || k == "compat" || fs.Lookup(k) == nil {
+			return fmt.Errorf("profile %s: unknown flag -%s", name, k)
+		}
+		if explicit[k] {
+			continue
+		}
+		if err := fs.Set(k, fmt.Sprint(profile[k])); err != nil {
+			return fmt.Errorf("profile %s: -%s: %w", name, k, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestApplyProfile(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, projectConfigFile), []byte(`{"profiles": {"mine": {"k": 10, "log-sync": "full"}, "bad": {"nope": 1}, "compat": {"compat": "ninja-1.11"}}}`), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	c, err := loadProjectConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newFlags := func() (*flag.FlagSet, *int, *string) {
+		fs := flag.NewFlagSet("nin", flag.ContinueOnError)
+		k := fs.Int("k", 1, "")
+		logSync := fs.String("log-sync", "none", "")
+		fs.Bool("track-tools", false, "")
+		fs.String("compat", "", "")
+		return fs, k, logSync
+	}
+
+	fs, k, logSync := newFlags()
+	if err := fs.Parse([]string{"-log-sync", "fsync"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyProfile(fs, "mine", c); err != nil {
+		t.Fatal(err)
+	}
+	// The command line takes precedence.
+	if *k != 10 || *logSync != "fsync" {
+		t.Fatal(*k, *logSync)
+	}
+
+	fs, _, _ = newFlags()
+	if err := applyProfile(fs, "bad", c); err == nil || err.Error() != "profile bad: unknown flag -nope" {
+		t.Fatal(err)
+	}
+	if err := applyProfile(fs, "compat", c); err == nil || err.Error() != "profile compat: unknown flag -compat" {
+		t.Fatal(err)
+	}
+	if err := applyProfile(fs, "foo", c); err == nil || err.Error() != `unknown profile "foo"; must be one of bad, ci, compat, fast, mine, safe` {
+		t.Fatal(err)
+	}
+	if c, err = loadProjectConfig(filepath.Join(dir, "missing")); err != nil || len(c.Profiles) != 0 {
+		t.Fatal(c, err)
+	}
+}
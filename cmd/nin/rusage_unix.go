@@ -0,0 +1,57 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"io/ioutil"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// childrenMaxRSS returns the maximum resident set size in bytes of the
+// largest child process that completed, or 0 if unknown.
+func childrenMaxRSS() int64 {
+	var r syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_CHILDREN, &r); err != nil {
+		return 0
+	}
+	if runtime.GOOS == "darwin" {
+		// It is in bytes on macOS.
+		return int64(r.Maxrss)
+	}
+	return int64(r.Maxrss) * 1024
+}
+
+// physicalMemory returns the total physical memory in bytes, or 0 if
+// unknown. It is only known on Linux.
+func physicalMemory() int64 {
+	b, err := ioutil.ReadFile("/proc/meminfo")
+	if err != nil {
+		return 0
+	}
+	for _, l := range strings.Split(string(b), "\n") {
+		// MemTotal:       16314484 kB
+		if f := strings.Fields(l); len(f) == 3 && f[0] == "MemTotal:" && f[2] == "kB" {
+			v, _ := strconv.ParseInt(f[1], 10, 64)
+			return v * 1024
+		}
+	}
+	return 0
+}
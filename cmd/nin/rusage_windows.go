@@ -0,0 +1,31 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// childrenMaxRSS returns the maximum resident set size in bytes of the
+// largest child process that completed, or 0 if unknown.
+//
+// TODO(maruel): Use GetProcessMemoryInfo() on the job object.
+func childrenMaxRSS() int64 {
+	return 0
+}
+
+// physicalMemory returns the total physical memory in bytes, or 0 if
+// unknown.
+//
+// TODO(maruel): Use GlobalMemoryStatusEx().
+func physicalMemory() int64 {
+	return 0
+}
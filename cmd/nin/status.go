@@ -16,8 +16,10 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"strconv"
+	"unicode/utf8"
 
 	"github.com/maruel/nin"
 )
@@ -36,6 +38,74 @@ type statusPrinter struct {
 	// The custom progress status format to use.
 	progressStatusFormat string
 	currentRate          slidingRateInfo
+
+	// progress returns the state of the plan of the running build, if any.
+	progress func() nin.ProgressSnapshot
+
+	// deferFailures holds the output of the failed edges until the end of the
+	// build, so it is not interleaved with the output of the edges still
+	// running.
+	deferFailures bool
+	failures      []failedEdge
+
+	// commandWidth is the length above which the commands are shortened in
+	// verbose mode. 0 means no limit.
+	commandWidth int
+	// showCommand are the rules whose commands are always printed in full.
+	showCommand map[string]bool
+	// showRspfile are the rules whose response file content is printed along
+	// their command.
+	showRspfile map[string]bool
+
+	// title, if set, reports the progress in the terminal title and taskbar.
+	title *terminalProgress
+
+	// redactor masks the secrets in the commands printed.
+	redactor *nin.Redactor
+}
+
+// terminalProgress reports the progress of the build with escape sequences:
+// the percentage in the terminal title, and the OSC 9;4 sequence understood by
+// Windows Terminal, ConEmu and iTerm2 to show it in the tab or taskbar.
+type terminalProgress struct {
+	w io.Writer
+	// percent is the last percentage written, -1 if none.
+	percent int
+	failed  bool
+}
+
+// update writes the progress if it changed since the last call.
+func (t *terminalProgress) update(finished, total int, failed bool) {
+	percent := 0
+	if total > 0 {
+		percent = 100 * finished / total
+	}
+	if percent == t.percent && failed == t.failed {
+		return
+	}
+	t.percent = percent
+	t.failed = failed
+	// State 1 is the normal progress, 2 is the error state.
+	state, suffix := 1, ""
+	if failed {
+		state, suffix = 2, " FAILED"
+	}
+	fmt.Fprintf(t.w, "\x1B]0;nin: %d%% [%d/%d]%s\x07\x1B]9;4;%d;%d\x07", percent, finished, total, suffix, state, percent)
+}
+
+// clear removes the progress and resets the title.
+func (t *terminalProgress) clear() {
+	if t.percent != -1 {
+		t.percent = -1
+		t.failed = false
+		fmt.Fprintf(t.w, "\x1B]0;\x07\x1B]9;4;0;0\x07")
+	}
+}
+
+// failedEdge is a failure held until the end of the build.
+type failedEdge struct {
+	edge   *nin.Edge
+	output string
 }
 
 type slidingRateInfo struct {
@@ -104,6 +174,9 @@ func (s *statusPrinter) BuildEdgeStarted(edge *nin.Edge, startTimeMillis int32)
 func (s *statusPrinter) BuildEdgeFinished(edge *nin.Edge, endTimeMillis int32, success bool, output string) {
 	s.timeMillis = endTimeMillis
 	s.finishedEdges++
+	if s.title != nil {
+		s.title.update(s.finishedEdges, s.totalEdges, !success || s.title.failed)
+	}
 
 	if edge.Pool == nin.ConsolePool {
 		s.printer.SetConsoleLocked(false)
@@ -119,20 +192,33 @@ func (s *statusPrinter) BuildEdgeFinished(edge *nin.Edge, endTimeMillis int32, s
 
 	s.runningEdges--
 
-	// Print the command that is spewing before printing its output.
 	if !success {
-		outputs := ""
-		for _, o := range edge.Outputs {
-			outputs += o.Path + " "
+		if s.deferFailures {
+			s.failures = append(s.failures, failedEdge{edge: edge, output: output})
+			return
 		}
-		if s.printer.supportsColor {
-			s.printer.PrintOnNewLine("\x1B[31mFAILED: \x1B[0m" + outputs + "\n")
-		} else {
-			s.printer.PrintOnNewLine("FAILED: " + outputs + "\n")
-		}
-		s.printer.PrintOnNewLine(edge.EvaluateCommand(false) + "\n")
+		s.printFailure(edge)
 	}
+	s.printOutput(output)
+}
 
+// printFailure prints the command that is spewing before printing its
+// output.
+func (s *statusPrinter) printFailure(edge *nin.Edge) {
+	outputs := ""
+	for _, o := range edge.Outputs {
+		outputs += o.Path + " "
+	}
+	if s.printer.supportsColor {
+		s.printer.PrintOnNewLine("\x1B[31mFAILED: \x1B[0m" + outputs + "\n")
+	} else {
+		s.printer.PrintOnNewLine("FAILED: " + outputs + "\n")
+	}
+	s.printer.PrintOnNewLine(s.redactor.Redact(edge.EvaluateCommand(false)) + "\n")
+}
+
+// printOutput prints the output of a command.
+func (s *statusPrinter) printOutput(output string) {
 	if len(output) != 0 {
 		// ninja sets stdout and stderr of subprocesses to a pipe, to be able to
 		// check if the output is empty. Some compilers, e.g. clang, check
@@ -182,11 +268,22 @@ func (s *statusPrinter) BuildStarted() {
 	s.startedEdges = 0
 	s.finishedEdges = 0
 	s.runningEdges = 0
+	if s.title != nil {
+		s.title.update(0, s.totalEdges, false)
+	}
 }
 
 func (s *statusPrinter) BuildFinished() {
+	if s.title != nil {
+		s.title.clear()
+	}
 	s.printer.SetConsoleLocked(false)
 	s.printer.PrintOnNewLine("")
+	for _, f := range s.failures {
+		s.printFailure(f.edge)
+		s.printOutput(f.output)
+	}
+	s.failures = nil
 }
 
 // Format the progress status string by replacing the placeholders.
@@ -227,6 +324,14 @@ func (s *statusPrinter) formatProgressStatus(progressStatusFormat string, timeMi
 			case 'f':
 				out += strconv.Itoa(s.finishedEdges)
 
+				// Edges waiting on their inputs or on a pool.
+			case 'b':
+				blocked := 0
+				if s.progress != nil {
+					blocked = s.progress().Blocked
+				}
+				out += strconv.Itoa(blocked)
+
 				// Overall finished edges per second.
 			case 'o':
 				rate := float64(s.finishedEdges) / float64(s.timeMillis) * 1000.
@@ -266,19 +371,51 @@ func (s *statusPrinter) formatProgressStatus(progressStatusFormat string, timeMi
 }
 
 func (s *statusPrinter) PrintStatus(edge *nin.Edge, timeMillis int32) {
-	if s.config.Verbosity == nin.Quiet || s.config.Verbosity == nin.NoStatusUpdate {
+	if s.config.Verbosity == nin.Quiet || s.config.Verbosity == nin.NoStatusUpdate || s.config.Verbosity == nin.Terse {
 		return
 	}
 
-	forceFullCommand := s.config.Verbosity == nin.Verbose
+	rule := edge.Rule.Name
+	forceFullCommand := s.config.Verbosity == nin.Verbose || s.showCommand[rule]
 
 	toPrint := edge.GetBinding("description")
 	if toPrint == "" || forceFullCommand {
-		toPrint = edge.GetBinding("command")
+		toPrint = s.redactor.Redact(edge.GetBinding("command"))
+		if s.config.Verbosity == nin.Verbose && s.commandWidth > 0 && !s.showCommand[rule] {
+			toPrint = shortenCommand(toPrint, s.commandWidth, rule)
+		}
 	}
 
 	toPrint = s.formatProgressStatus(s.progressStatusFormat, timeMillis) + toPrint
 	s.printer.Print(toPrint, !forceFullCommand)
+	if forceFullCommand && s.showRspfile[rule] {
+		if rspfile := edge.GetUnescapedRspfile(); rspfile != "" {
+			s.printer.PrintOrBuffer(fmt.Sprintf("  %s:\n%s\n", rspfile, s.redactor.Redact(edge.GetBinding("rspfile_content"))))
+		}
+	}
+	if forceFullCommand && !compatNinja {
+		if p := edge.Pool; p != nil && p.Depth() != 0 {
+			// Help tuning the pool depths.
+			s.printer.PrintOrBuffer(fmt.Sprintf("  pool %s: %d/%d in use, %d waiting\n", p.Name, p.CurrentUse(), p.Depth(), p.DelayedEdges()))
+		}
+	}
+}
+
+// shortenCommand keeps the start and the end of a command longer than width,
+// with a marker telling how to see it in full.
+func shortenCommand(cmd string, width int, rule string) string {
+	if len(cmd) <= width {
+		return cmd
+	}
+	head := width * 2 / 3
+	for head > 0 && !utf8.RuneStart(cmd[head]) {
+		head--
+	}
+	tail := len(cmd) - (width - head)
+	for tail < len(cmd) && !utf8.RuneStart(cmd[tail]) {
+		tail++
+	}
+	return fmt.Sprintf("%s ...[%d more chars, see -show-command %s]... %s", cmd[:head], tail-head, rule, cmd[tail:])
 }
 
 func (s *statusPrinter) Warning(msg string, i ...interface{}) {
@@ -0,0 +1,136 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/maruel/nin"
+)
+
+// jsonEvent is one line written by statusJSON.
+type jsonEvent struct {
+	Event   string   `json:"event"`
+	Time    int32    `json:"time_ms"`
+	Total   int      `json:"total,omitempty"`
+	ID      int32    `json:"id"`
+	Outputs []string `json:"outputs,omitempty"`
+	Command string   `json:"command,omitempty"`
+	Success *bool    `json:"success,omitempty"`
+	Output  string   `json:"output,omitempty"`
+	Message string   `json:"message,omitempty"`
+	// Meta is the edge metadata, see nin.MetaPrefix.
+	Meta map[string]string `json:"meta,omitempty"`
+	// CompilerCache is the statistics of a compiler cache during the build.
+	CompilerCache *jsonCompilerCache `json:"compiler_cache,omitempty"`
+}
+
+// jsonCompilerCache is the statistics of ccache or sccache.
+type jsonCompilerCache struct {
+	Tool   string `json:"tool"`
+	Hits   int64  `json:"hits"`
+	Misses int64  `json:"misses"`
+}
+
+// statusJSON is a nin.Status that writes one JSON object per line for each
+// event, for consumption by other programs.
+type statusJSON struct {
+	enc *json.Encoder
+	// redactor masks the secrets in the commands and their output.
+	redactor *nin.Redactor
+}
+
+func newStatusJSON(w io.Writer) *statusJSON {
+	enc := json.NewEncoder(w)
+	// Keep the commands readable, e.g. "a > b" instead of "a \u003e b".
+	enc.SetEscapeHTML(false)
+	return &statusJSON{enc: enc}
+}
+
+func (s *statusJSON) write(e *jsonEvent) {
+	e.Command = s.redactor.Redact(e.Command)
+	e.Output = s.redactor.Redact(e.Output)
+	e.Message = s.redactor.Redact(e.Message)
+	// Errors are ignored, the build must not fail because the consumer went
+	// away.
+	_ = s.enc.Encode(e)
+}
+
+func (s *statusJSON) PlanHasTotalEdges(total int) {
+	s.write(&jsonEvent{Event: "total", Total: total})
+}
+
+func (s *statusJSON) BuildEdgeStarted(edge *nin.Edge, startTimeMillis int32) {
+	s.write(&jsonEvent{
+		Event:   "edge_started",
+		Time:    startTimeMillis,
+		ID:      edge.ID,
+		Outputs: edgeOutputs(edge),
+		Command: edge.EvaluateCommand(false),
+		Meta:    edge.Meta(),
+	})
+}
+
+func (s *statusJSON) BuildEdgeFinished(edge *nin.Edge, endTimeMillis int32, success bool, output string) {
+	s.write(&jsonEvent{
+		Event:   "edge_finished",
+		Time:    endTimeMillis,
+		ID:      edge.ID,
+		Outputs: edgeOutputs(edge),
+		Success: &success,
+		Output:  output,
+		Meta:    edge.Meta(),
+	})
+}
+
+func (s *statusJSON) BuildLoadDyndeps() {
+	s.write(&jsonEvent{Event: "load_dyndeps"})
+}
+
+func (s *statusJSON) BuildStarted() {
+	s.write(&jsonEvent{Event: "build_started"})
+}
+
+func (s *statusJSON) BuildFinished() {
+	s.write(&jsonEvent{Event: "build_finished"})
+}
+
+func (s *statusJSON) Info(msg string, i ...interface{}) {
+	s.write(&jsonEvent{Event: "info", Message: fmt.Sprintf(msg, i...)})
+}
+
+func (s *statusJSON) Warning(msg string, i ...interface{}) {
+	s.write(&jsonEvent{Event: "warning", Message: fmt.Sprintf(msg, i...)})
+}
+
+func (s *statusJSON) Error(msg string, i ...interface{}) {
+	s.write(&jsonEvent{Event: "error", Message: fmt.Sprintf(msg, i...)})
+}
+
+// compilerCache writes the statistics of a compiler cache. It is not part of
+// nin.Status.
+func (s *statusJSON) compilerCache(c *nin.CompilerCacheStats) {
+	s.write(&jsonEvent{Event: "compiler_cache", CompilerCache: &jsonCompilerCache{Tool: c.Tool, Hits: c.Hits, Misses: c.Misses}})
+}
+
+func edgeOutputs(edge *nin.Edge) []string {
+	out := make([]string, len(edge.Outputs))
+	for i, o := range edge.Outputs {
+		out[i] = o.Path
+	}
+	return out
+}
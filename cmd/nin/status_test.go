@@ -15,6 +15,7 @@
 package main
 
 import (
+	"bytes"
 	"testing"
 
 	"github.com/maruel/nin"
@@ -39,3 +40,100 @@ func TestStatusTest_StatusFormatReplacePlaceholder(t *testing.T) {
 		t.Fatal("expected equal")
 	}
 }
+
+func TestStatusTest_StatusFormatBlocked(t *testing.T) {
+	cfg := nin.NewBuildConfig()
+	status := newStatusPrinter(&cfg)
+
+	if "[b0]" != status.formatProgressStatus("[b%b]", 0) {
+		t.Fatal("expected equal")
+	}
+	status.progress = func() nin.ProgressSnapshot {
+		return nin.ProgressSnapshot{Total: 10, Blocked: 7}
+	}
+	if "[b7]" != status.formatProgressStatus("[b%b]", 0) {
+		t.Fatal("expected equal")
+	}
+}
+
+func TestStatusTest_DeferFailures(t *testing.T) {
+	cfg := nin.NewBuildConfig()
+	cfg.Verbosity = nin.NoStatusUpdate
+	status := newStatusPrinter(&cfg)
+	status.deferFailures = true
+	state := nin.NewState()
+	if err := nin.ParseManifest(&state, nil, nin.ParseManifestOpts{}, "build.ninja", []byte("rule r\n  command = r\nbuild a: r\nbuild b: r\n\x00")); err != nil {
+		t.Fatal(err)
+	}
+	status.BuildStarted()
+	status.BuildEdgeStarted(state.Edges[0], 0)
+	status.BuildEdgeStarted(state.Edges[1], 0)
+	status.BuildEdgeFinished(state.Edges[0], 1, false, "error\n")
+	status.BuildEdgeFinished(state.Edges[1], 2, true, "")
+	if len(status.failures) != 1 || status.failures[0].edge != state.Edges[0] || status.failures[0].output != "error\n" {
+		t.Fatal(status.failures)
+	}
+	status.BuildFinished()
+	if len(status.failures) != 0 {
+		t.Fatal(status.failures)
+	}
+}
+
+func TestShortenCommand(t *testing.T) {
+	data := []struct {
+		cmd, want string
+	}{
+		{"cc -c a.c", "cc -c a.c"},
+		{"cc -Ifoo -Ibar -Ibaz -c a.c -o a.o", "cc -Ifoo - ...[19 more chars, see -show-command cc]... o a.o"},
+		// Multi-byte runes are not split.
+		{"échoéééééééééééééé ok", "échoéé ...[22 more chars, see -show-command cc]... é ok"},
+	}
+	for i, l := range data {
+		if got := shortenCommand(l.cmd, 15, "cc"); got != l.want {
+			t.Errorf("%d: %q", i, got)
+		}
+	}
+}
+
+func TestStatusTest_Title(t *testing.T) {
+	cfg := nin.NewBuildConfig()
+	cfg.Verbosity = nin.Quiet
+	status := newStatusPrinter(&cfg)
+	buf := bytes.Buffer{}
+	status.title = &terminalProgress{w: &buf, percent: -1}
+	state := nin.NewState()
+	if err := nin.ParseManifest(&state, nil, nin.ParseManifestOpts{}, "build.ninja", []byte("rule r\n  command = r\nbuild a: r\nbuild b: r\n\x00")); err != nil {
+		t.Fatal(err)
+	}
+	status.PlanHasTotalEdges(2)
+	status.BuildStarted()
+	status.BuildEdgeStarted(state.Edges[0], 0)
+	status.BuildEdgeFinished(state.Edges[0], 1, false, "error\n")
+	status.BuildEdgeStarted(state.Edges[1], 1)
+	status.BuildEdgeFinished(state.Edges[1], 2, true, "")
+	status.BuildFinished()
+	want := "\x1B]0;nin: 0% [0/2]\x07\x1B]9;4;1;0\x07" +
+		"\x1B]0;nin: 50% [1/2] FAILED\x07\x1B]9;4;2;50\x07" +
+		"\x1B]0;nin: 100% [2/2] FAILED\x07\x1B]9;4;2;100\x07" +
+		"\x1B]0;\x07\x1B]9;4;0;0\x07"
+	if got := buf.String(); got != want {
+		t.Fatalf("%q", got)
+	}
+}
+
+func TestStatusJSON(t *testing.T) {
+	state := nin.NewState()
+	if err := nin.ParseManifest(&state, nil, nin.ParseManifestOpts{}, "build.ninja", []byte("rule r\n  command = r > $out\nbuild a: r\n\x00")); err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.Buffer{}
+	status := newStatusJSON(&buf)
+	status.BuildEdgeStarted(state.Edges[0], 0)
+	status.BuildEdgeFinished(state.Edges[0], 0, true, "")
+	// The first edge has the ID 0 and starts at 0 ms; both are kept.
+	want := `{"event":"edge_started","time_ms":0,"id":0,"outputs":["a"],"command":"r > a"}` + "\n" +
+		`{"event":"edge_finished","time_ms":0,"id":0,"outputs":["a"],"success":true}` + "\n"
+	if got := buf.String(); got != want {
+		t.Fatalf("want %q; got %q", want, got)
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"runtime"
+	"sort"
+	"time"
+
+	"github.com/maruel/nin"
+)
+
+// telemetryConfig is the "telemetry" section of the projectConfigFile. The
+// report is only sent when the user opts in with -telemetry.
+type telemetryConfig struct {
+	// URL receives the report of each build in a POST request. It must be
+	// https, except for the loopback addresses.
+	URL string `json:"url"`
+	// Redact are regexps; the rule names and the outputs they match are
+	// replaced by a hash in the report.
+	Redact []string `json:"redact"`
+	// Slowest is the number of slowest edges to report with their output. By
+	// default only the aggregates per rule are reported.
+	Slowest int `json:"slowest"`
+
+	redact []*regexp.Regexp
+}
+
+// validate checks the URL and compiles the redaction rules.
+func (t *telemetryConfig) validate() error {
+	u, err := url.Parse(t.URL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "https" {
+		ip := net.ParseIP(u.Hostname())
+		if u.Scheme != "http" || (u.Hostname() != "localhost" && (ip == nil || !ip.IsLoopback())) {
+			return fmt.Errorf("telemetry url %q must be https", t.URL)
+		}
+	}
+	t.redact = nil
+	for _, r := range t.Redact {
+		re, err := regexp.Compile(r)
+		if err != nil {
+			return fmt.Errorf("telemetry redact: %w", err)
+		}
+		t.redact = append(t.redact, re)
+	}
+	return nil
+}
+
+// anonymize returns s, or a hash of it if it matches a redaction rule. The
+// hash is stable so the reports can still be aggregated.
+func (t *telemetryConfig) anonymize(s string) string {
+	for _, re := range t.redact {
+		if re.MatchString(s) {
+			h := sha256.Sum256([]byte(s))
+			return "redacted-" + hex.EncodeToString(h[:6])
+		}
+	}
+	return s
+}
+
+// telemetryReport is the JSON payload sent at the end of a build. It
+// contains no command, no environment and no machine identity.
+type telemetryReport struct {
+	Version     string          `json:"version"`
+	OS          string          `json:"os"`
+	Arch        string          `json:"arch"`
+	CPUs        int             `json:"cpus"`
+	Parallelism int             `json:"parallelism"`
+	Success     bool            `json:"success"`
+	WallMS      int64           `json:"wall_ms"`
+	Edges       int             `json:"edges"`
+	Failed      int             `json:"failed"`
+	Rules       []telemetryRule `json:"rules"`
+	Slowest     []telemetryEdge `json:"slowest,omitempty"`
+}
+
+// telemetryRule aggregates the edges of a rule.
+type telemetryRule struct {
+	Name    string `json:"name"`
+	Edges   int    `json:"edges"`
+	TotalMS int64  `json:"total_ms"`
+	MaxMS   int64  `json:"max_ms"`
+}
+
+// telemetryEdge is one of the slowest edges.
+type telemetryEdge struct {
+	Rule   string `json:"rule"`
+	Output string `json:"output"`
+	MS     int64  `json:"ms"`
+}
+
+// telemetryCollector records the edges as they complete.
+type telemetryCollector struct {
+	edges  []telemetryEdge
+	failed int
+}
+
+// record implements nin.BuilderHooks.AfterEdge.
+func (c *telemetryCollector) record(result *nin.Result, startTimeMillis, endTimeMillis int32) {
+	c.edges = append(c.edges, telemetryEdge{Rule: result.Edge.Rule.Name, Output: result.Edge.Outputs[0].Path, MS: int64(endTimeMillis - startTimeMillis)})
+	if result.ExitCode != nin.ExitSuccess {
+		c.failed++
+	}
+}
+
+// report returns the anonymized report of the build.
+func (c *telemetryCollector) report(t *telemetryConfig, success bool, parallelism int, wall time.Duration) *telemetryReport {
+	r := &telemetryReport{
+		Version:     nin.NinjaVersion,
+		OS:          runtime.GOOS,
+		Arch:        runtime.GOARCH,
+		CPUs:        runtime.NumCPU(),
+		Parallelism: parallelism,
+		Success:     success,
+		WallMS:      wall.Milliseconds(),
+		Edges:       len(c.edges),
+		Failed:      c.failed,
+		Rules:       []telemetryRule{},
+	}
+	rules := map[string]*telemetryRule{}
+	for _, e := range c.edges {
+		name := t.anonymize(e.Rule)
+		rule := rules[name]
+		if rule == nil {
+			rule = &telemetryRule{Name: name}
+			rules[name] = rule
+		}
+		rule.Edges++
+		rule.TotalMS += e.MS
+		if e.MS > rule.MaxMS {
+			rule.MaxMS = e.MS
+		}
+	}
+	for _, rule := range rules {
+		r.Rules = append(r.Rules, *rule)
+	}
+	sort.Slice(r.Rules, func(i, j int) bool { return r.Rules[i].Name < r.Rules[j].Name })
+	if t.Slowest > 0 {
+		sorted := make([]telemetryEdge, len(c.edges))
+		copy(sorted, c.edges)
+		sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].MS > sorted[j].MS })
+		if len(sorted) > t.Slowest {
+			sorted = sorted[:t.Slowest]
+		}
+		for _, e := range sorted {
+			r.Slowest = append(r.Slowest, telemetryEdge{Rule: t.anonymize(e.Rule), Output: t.anonymize(e.Output), MS: e.MS})
+		}
+	}
+	return r
+}
+
+// upload posts the report to the endpoint.
+func (t *telemetryConfig) upload(ctx context.Context, r *telemetryReport) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", t.URL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
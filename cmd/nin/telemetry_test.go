@@ -0,0 +1,90 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/maruel/nin"
+)
+
+func TestTelemetry(t *testing.T) {
+	var got telemetryReport
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer ts.Close()
+
+	conf := &telemetryConfig{URL: ts.URL, Redact: []string{"^secret/"}, Slowest: 2}
+	if err := conf.validate(); err != nil {
+		t.Fatal(err)
+	}
+	state := nin.NewState()
+	if err := nin.ParseManifest(&state, nil, nin.ParseManifestOpts{}, "build.ninja", []byte("rule cc\n  command = cc\nrule link\n  command = link\nbuild a.o: cc\nbuild secret/b.o: cc\nbuild c: link\n\x00")); err != nil {
+		t.Fatal(err)
+	}
+	c := &telemetryCollector{}
+	c.record(&nin.Result{Edge: state.Edges[0]}, 0, 100)
+	c.record(&nin.Result{Edge: state.Edges[1]}, 0, 300)
+	c.record(&nin.Result{Edge: state.Edges[2], ExitCode: nin.ExitFailure}, 300, 350)
+	if err := conf.upload(context.Background(), c.report(conf, false, 4, time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	want := telemetryReport{
+		Version:     got.Version,
+		OS:          got.OS,
+		Arch:        got.Arch,
+		CPUs:        got.CPUs,
+		Parallelism: 4,
+		WallMS:      1000,
+		Edges:       3,
+		Failed:      1,
+		Rules: []telemetryRule{
+			{Name: "cc", Edges: 2, TotalMS: 400, MaxMS: 300},
+			{Name: "link", Edges: 1, TotalMS: 50, MaxMS: 50},
+		},
+		Slowest: []telemetryEdge{
+			{Rule: "cc", Output: conf.anonymize("secret/b.o"), MS: 300},
+			{Rule: "cc", Output: "a.o", MS: 100},
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatal(diff)
+	}
+	if want.Slowest[0].Output == "secret/b.o" {
+		t.Fatal("not redacted")
+	}
+}
+
+func TestTelemetryConfig_Validate(t *testing.T) {
+	for _, u := range []string{"http://example.com/report", "ftp://localhost/report"} {
+		conf := &telemetryConfig{URL: u}
+		if err := conf.validate(); err == nil {
+			t.Fatal(u)
+		}
+	}
+	conf := &telemetryConfig{URL: "https://example.com/report", Redact: []string{"("}}
+	if err := conf.validate(); err == nil {
+		t.Fatal("expected error")
+	}
+}
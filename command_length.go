@@ -0,0 +1,61 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"fmt"
+)
+
+// autoRspfile returns the response file $in is written to when the command
+// of edge is too long.
+func autoRspfile(edge *Edge) string {
+	return edge.Outputs[0].Path + ".in.rsp"
+}
+
+// fitCommand makes sure the command of edge can be run by the OS.
+//
+// When the command is longer than maxCommandLength and the rule has
+// "rspfile_auto = 1", $in is written to a response file and replaced by
+// "@file" in the command, which most compilers and linkers accept. Otherwise
+// an error describing the problem is returned, instead of the opaque failure
+// of exec.
+func (b *Builder) fitCommand(edge *Edge) error {
+	edge.spilledCommand = ""
+	command := edge.command
+	if command == "" {
+		command = edge.EvaluateCommand(false)
+	}
+	if len(command) <= maxCommandLength {
+		return nil
+	}
+	if edge.command != "" || len(edge.batch) != 0 || edge.GetBinding("rspfile_auto") == "" || len(edge.Outputs) == 0 {
+		return fmt.Errorf("command is %d bytes long, more than the %d bytes supported by the OS; use a rspfile or set rspfile_auto = 1 on rule %s if the program accepts @file arguments", len(command), maxCommandLength, edge.Rule.Name)
+	}
+	rspfile := autoRspfile(edge)
+	cwd := edge.Cwd()
+	in := edgeEnv{edge: edge, escapeInOut: edge.shellEscape(), cwd: cwd}
+	if err := b.di.WriteFile(rspfile, in.LookupVariable("in")); err != nil {
+		return err
+	}
+	kind := edge.commandEscape()
+	spilled := edgeEnv{edge: edge, escapeInOut: kind, in: "@" + escapePath(rebasePath(cwd, rspfile), kind), cwd: cwd}
+	command = spilled.LookupVariable("command")
+	if len(command) > maxCommandLength {
+		_ = b.di.RemoveFile(rspfile)
+		return fmt.Errorf("command is %d bytes long even with $in in %s, more than the %d bytes supported by the OS", len(command), rspfile, maxCommandLength)
+	}
+	edge.spilledCommand = command
+	return nil
+}
@@ -0,0 +1,103 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBuildTest_RspfileAuto(t *testing.T) {
+	old := maxCommandLength
+	defer func() {
+		maxCommandLength = old
+	}()
+	maxCommandLength = 30
+
+	b := NewBuildTest(t)
+	b.AssertParse(&b.state, "nin_features = rspfile_auto\nbuild out: cat in1 in2 in3 in4 in5 in6 in7 in8\n  rspfile_auto = 1\n", ParseManifestOpts{})
+	for _, p := range []string{"in1", "in2", "in3", "in4", "in5", "in6", "in7", "in8"} {
+		b.fs.Create(p, "")
+	}
+	if _, err := b.builder.addTargetName("out"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.builder.Build(); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.commandRunner.commandsRan) != 1 || b.commandRunner.commandsRan[0] != "cat @out.in.rsp > out" {
+		t.Fatal(b.commandRunner.commandsRan)
+	}
+	// The response file was removed once the command completed.
+	if _, ok := b.fs.files["out.in.rsp"]; ok {
+		t.Fatal("expected out.in.rsp to be removed")
+	}
+	if _, ok := b.fs.filesRemoved["out.in.rsp"]; !ok {
+		t.Fatal("expected out.in.rsp to have been written")
+	}
+}
+
+func TestBuildTest_CommandTooLong(t *testing.T) {
+	old := maxCommandLength
+	defer func() {
+		maxCommandLength = old
+	}()
+	maxCommandLength = 30
+
+	b := NewBuildTest(t)
+	b.AssertParse(&b.state, "build out: cat in1 in2 in3 in4 in5 in6 in7 in8\n", ParseManifestOpts{})
+	for _, p := range []string{"in1", "in2", "in3", "in4", "in5", "in6", "in7", "in8"} {
+		b.fs.Create(p, "")
+	}
+	if _, err := b.builder.addTargetName("out"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.builder.Build(); err == nil || err.Error() != "subcommand failed" {
+		t.Fatal(err)
+	}
+	if len(b.commandRunner.commandsRan) != 0 {
+		t.Fatal(b.commandRunner.commandsRan)
+	}
+	if _, ok := b.fs.files["out.in.rsp"]; ok {
+		t.Fatal("unexpected response file")
+	}
+}
+
+func TestFitCommand(t *testing.T) {
+	old := maxCommandLength
+	defer func() {
+		maxCommandLength = old
+	}()
+	maxCommandLength = 30
+
+	b := NewBuildTest(t)
+	b.AssertParse(&b.state, "nin_features = rspfile_auto\nbuild out: cat in1 in2 in3 in4 in5 in6 in7 in8\n  rspfile_auto = 1\n", ParseManifestOpts{})
+	edge := b.state.Paths["out"].InEdge
+	if err := b.builder.fitCommand(edge); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := b.fs.ReadFile("out.in.rsp"); !strings.HasPrefix(string(got), "in1 in2 in3 in4 in5 in6 in7 in8") {
+		t.Fatalf("%q", got)
+	}
+
+	// Even the spilled command is too long.
+	maxCommandLength = 10
+	if err := b.builder.fitCommand(edge); err == nil || !strings.Contains(err.Error(), "even with $in in out.in.rsp") {
+		t.Fatal(err)
+	}
+	if edge.spilledCommand != "" {
+		t.Fatal(edge.spilledCommand)
+	}
+}
@@ -0,0 +1,323 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// CompatTestConfig is the configuration of RunCompatTest.
+type CompatTestConfig struct {
+	// Dir is the directory containing the manifest. It is copied twice and is
+	// not modified.
+	Dir string
+	// Nin is the path to the nin binary to test.
+	Nin string
+	// Ninja is the path to the reference ninja binary.
+	Ninja string
+	// Args are the arguments passed to both binaries, e.g. the targets to
+	// build. "-j 1" is always prepended so the command sequences are
+	// deterministic.
+	Args []string
+	// NinArgs are additional arguments only passed to nin, e.g.
+	// "-compat ninja-1.11".
+	NinArgs []string
+}
+
+// CompatTestReport is the result of RunCompatTest.
+type CompatTestReport struct {
+	// NinOutput and NinjaOutput are the stdout of each binary.
+	NinOutput, NinjaOutput string
+	// NinExitCode and NinjaExitCode are the exit codes of each binary.
+	NinExitCode, NinjaExitCode int
+	// Differences lists the differences found, if any.
+	Differences []string
+}
+
+// RunCompatTest runs the same build with nin and ninja, each in its own copy
+// of the directory, and reports the differences in the console output, the
+// exit code, the build and deps logs and the resulting files.
+//
+// Timing information, like the mtimes recorded in the logs, is ignored.
+// Paths outside of Dir are not copied, so both binaries share them.
+func RunCompatTest(ctx context.Context, cfg *CompatTestConfig) (*CompatTestReport, error) {
+	tmp, err := ioutil.TempDir("", "nin_compat")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	ninDir := filepath.Join(tmp, "nin")
+	ninjaDir := filepath.Join(tmp, "ninja")
+	if err := copyTree(cfg.Dir, ninDir); err != nil {
+		return nil, err
+	}
+	if err := copyTree(cfg.Dir, ninjaDir); err != nil {
+		return nil, err
+	}
+
+	args := append([]string{"-j", "1"}, cfg.Args...)
+	r := &CompatTestReport{}
+	if r.NinOutput, r.NinExitCode, err = runCompat(ctx, cfg.Nin, ninDir, append(append([]string{}, cfg.NinArgs...), args...)); err != nil {
+		return nil, err
+	}
+	if r.NinjaOutput, r.NinjaExitCode, err = runCompat(ctx, cfg.Ninja, ninjaDir, args); err != nil {
+		return nil, err
+	}
+
+	if r.NinExitCode != r.NinjaExitCode {
+		r.Differences = append(r.Differences, fmt.Sprintf("exit code: nin %d, ninja %d", r.NinExitCode, r.NinjaExitCode))
+	}
+	r.Differences = append(r.Differences, diffLines("output", r.NinOutput, r.NinjaOutput)...)
+	d, err := diffBuildLogs(filepath.Join(ninDir, ".ninja_log"), filepath.Join(ninjaDir, ".ninja_log"))
+	if err != nil {
+		return nil, err
+	}
+	r.Differences = append(r.Differences, d...)
+	if d, err = diffDepsLogs(filepath.Join(ninDir, ".ninja_deps"), filepath.Join(ninjaDir, ".ninja_deps")); err != nil {
+		return nil, err
+	}
+	r.Differences = append(r.Differences, d...)
+	if d, err = diffTrees(ninDir, ninjaDir); err != nil {
+		return nil, err
+	}
+	r.Differences = append(r.Differences, d...)
+	return r, nil
+}
+
+// runCompat runs a binary in dir and returns its stdout and exit code.
+func runCompat(ctx context.Context, bin, dir string, args []string) (string, int, error) {
+	cmd := exec.CommandContext(ctx, bin, args...)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return string(out), exitErr.ExitCode(), nil
+	}
+	return string(out), 0, err
+}
+
+// copyTree copies the directory src as dst, preserving the modes and the
+// modification times so that both copies have the same dirty state.
+func copyTree(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		switch {
+		case info.IsDir():
+			if err := os.MkdirAll(target, info.Mode().Perm()|0o700); err != nil {
+				return err
+			}
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		default:
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(target, b, info.Mode().Perm()); err != nil {
+				return err
+			}
+		}
+		return os.Chtimes(target, info.ModTime(), info.ModTime())
+	})
+}
+
+// diffLines reports the first line that differs between two outputs.
+func diffLines(name, nin, ninja string) []string {
+	a := strings.Split(nin, "\n")
+	b := strings.Split(ninja, "\n")
+	for i := 0; i < len(a) || i < len(b); i++ {
+		l1, l2 := "<none>", "<none>"
+		if i < len(a) {
+			l1 = a[i]
+		}
+		if i < len(b) {
+			l2 = b[i]
+		}
+		if l1 != l2 {
+			return []string{fmt.Sprintf("%s line %d: nin %q, ninja %q", name, i+1, l1, l2)}
+		}
+	}
+	return nil
+}
+
+// diffBuildLogs compares the outputs and command hashes recorded in two build
+// logs.
+func diffBuildLogs(nin, ninja string) ([]string, error) {
+	a := NewBuildLog()
+	if err := a.Load(nin); err != nil && !os.IsNotExist(err) && !errors.Is(err, &ErrLogDiscarded{}) {
+		return nil, err
+	}
+	b := NewBuildLog()
+	if err := b.Load(ninja); err != nil && !os.IsNotExist(err) && !errors.Is(err, &ErrLogDiscarded{}) {
+		return nil, err
+	}
+	var out []string
+	for _, p := range unionKeys(a.Entries, b.Entries) {
+		e1, e2 := a.Entries[p], b.Entries[p]
+		switch {
+		case e2 == nil:
+			out = append(out, fmt.Sprintf("build log: %s only recorded by nin", p))
+		case e1 == nil:
+			out = append(out, fmt.Sprintf("build log: %s only recorded by ninja", p))
+		case e1.legacyHash() != e2.legacyHash():
+			out = append(out, fmt.Sprintf("build log: %s has a different command hash", p))
+		}
+	}
+	return out, nil
+}
+
+// diffDepsLogs compares the dependencies recorded in two deps logs.
+func diffDepsLogs(nin, ninja string) ([]string, error) {
+	load := func(path string) (map[string]string, error) {
+		state := NewState()
+		d := DepsLog{}
+		if err := d.Load(path, &state); err != nil && !os.IsNotExist(err) && !errors.Is(err, &ErrLogDiscarded{}) {
+			return nil, err
+		}
+		m := map[string]string{}
+		for id, deps := range d.Deps {
+			if deps == nil || id >= len(d.Nodes) {
+				continue
+			}
+			paths := make([]string, 0, len(deps.Nodes))
+			for _, n := range deps.Nodes {
+				paths = append(paths, n.Path)
+			}
+			m[d.Nodes[id].Path] = strings.Join(paths, " ")
+		}
+		return m, nil
+	}
+	a, err := load(nin)
+	if err != nil {
+		return nil, err
+	}
+	b, err := load(ninja)
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, p := range unionKeys(a, b) {
+		d1, ok1 := a[p]
+		d2, ok2 := b[p]
+		switch {
+		case !ok2:
+			out = append(out, fmt.Sprintf("deps log: %s only recorded by nin", p))
+		case !ok1:
+			out = append(out, fmt.Sprintf("deps log: %s only recorded by ninja", p))
+		case d1 != d2:
+			out = append(out, fmt.Sprintf("deps log: %s: nin %q, ninja %q", p, d1, d2))
+		}
+	}
+	return out, nil
+}
+
+// diffTrees compares the files in two directories, ignoring the logs.
+func diffTrees(nin, ninja string) ([]string, error) {
+	list := func(root string) (map[string]os.FileInfo, error) {
+		m := map[string]os.FileInfo{}
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(root, path)
+			if err != nil || rel == "." || rel == ".ninja_log" || rel == ".ninja_deps" {
+				return err
+			}
+			m[filepath.ToSlash(rel)] = info
+			return nil
+		})
+		return m, err
+	}
+	a, err := list(nin)
+	if err != nil {
+		return nil, err
+	}
+	b, err := list(ninja)
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, p := range unionKeys(a, b) {
+		i1, i2 := a[p], b[p]
+		switch {
+		case i2 == nil:
+			out = append(out, fmt.Sprintf("file %s only exists with nin", p))
+		case i1 == nil:
+			out = append(out, fmt.Sprintf("file %s only exists with ninja", p))
+		case i1.IsDir() != i2.IsDir():
+			out = append(out, fmt.Sprintf("file %s has a different type", p))
+		case !i1.IsDir() && i1.Mode()&os.ModeSymlink == 0:
+			c1, err := ioutil.ReadFile(filepath.Join(nin, p))
+			if err != nil {
+				return nil, err
+			}
+			c2, err := ioutil.ReadFile(filepath.Join(ninja, p))
+			if err != nil {
+				return nil, err
+			}
+			if !bytes.Equal(c1, c2) {
+				out = append(out, fmt.Sprintf("file %s has different content", p))
+			}
+		}
+	}
+	return out, nil
+}
+
+// unionKeys returns the sorted keys present in either map.
+func unionKeys(a, b interface{}) []string {
+	seen := map[string]struct{}{}
+	for _, m := range []interface{}{a, b} {
+		switch m := m.(type) {
+		case map[string]*LogEntry:
+			for k := range m {
+				seen[k] = struct{}{}
+			}
+		case map[string]string:
+			for k := range m {
+				seen[k] = struct{}{}
+			}
+		case map[string]os.FileInfo:
+			for k := range m {
+				seen[k] = struct{}{}
+			}
+		}
+	}
+	out := make([]string, 0, len(seen))
+	for k := range seen {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,121 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// fakeBuildMain is a fake ninja used by TestRunCompatTest. It behaves
+// differently when passed -variant.
+func fakeBuildMain() int {
+	variant := len(os.Args) > 3 && os.Args[1] == "-variant"
+	content := "hello"
+	hash := "1"
+	if variant {
+		content = "world"
+		hash = "2"
+	}
+	if err := ioutil.WriteFile("out", []byte(content), 0o600); err != nil {
+		return 1
+	}
+	if err := ioutil.WriteFile(".ninja_log", []byte("# ninja log v5\n0\t1\t0\tout\t"+hash+"\n"), 0o600); err != nil {
+		return 1
+	}
+	fmt.Printf("[1/1] echo %s > out\n", content)
+	if variant {
+		return 1
+	}
+	return 0
+}
+
+func TestRunCompatTest(t *testing.T) {
+	t.Setenv("NIN_TEST_COMPAT", "1")
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "build.ninja"), []byte("# unused\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "src"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "src", "in"), []byte("in"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := CompatTestConfig{
+		Dir:     dir,
+		Nin:     os.Args[0],
+		Ninja:   os.Args[0],
+		NinArgs: []string{"-variant"},
+	}
+	r, err := RunCompatTest(context.Background(), &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"exit code: nin 1, ninja 0",
+		"output line 1: nin \"[1/1] echo world > out\", ninja \"[1/1] echo hello > out\"",
+		"build log: out has a different command hash",
+		"file out has different content",
+	}
+	if diff := cmp.Diff(want, r.Differences); diff != "" {
+		t.Fatal(diff)
+	}
+
+	// Without the variant, both runs are the same.
+	cfg.NinArgs = nil
+	if r, err = RunCompatTest(context.Background(), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Differences) != 0 {
+		t.Fatal(r.Differences)
+	}
+}
+
+func TestDiffTrees(t *testing.T) {
+	a := t.TempDir()
+	b := t.TempDir()
+	for _, f := range []struct{ dir, path, content string }{
+		{a, "same", "x"},
+		{b, "same", "x"},
+		{a, "diff", "x"},
+		{b, "diff", "y"},
+		{a, "onlynin", ""},
+		{b, "onlyninja", ""},
+		{a, ".ninja_log", "ignored"},
+	} {
+		if err := ioutil.WriteFile(filepath.Join(f.dir, f.path), []byte(f.content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := diffTrees(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"file diff has different content",
+		"file onlynin only exists with nin",
+		"file onlyninja only exists with ninja",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatal(diff)
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// CompilerCacheStats are the statistics of a compiler cache, ccache or
+// sccache.
+type CompilerCacheStats struct {
+	// Tool is "ccache" or "sccache".
+	Tool   string
+	Hits   int64
+	Misses int64
+}
+
+// HitRate returns the ratio of hits, between 0 and 1.
+func (c *CompilerCacheStats) HitRate() float64 {
+	if c.Hits+c.Misses == 0 {
+		return 0
+	}
+	return float64(c.Hits) / float64(c.Hits+c.Misses)
+}
+
+// Sub returns the statistics accumulated since before.
+func (c *CompilerCacheStats) Sub(before *CompilerCacheStats) CompilerCacheStats {
+	return CompilerCacheStats{Tool: c.Tool, Hits: c.Hits - before.Hits, Misses: c.Misses - before.Misses}
+}
+
+// CompilerCaches returns the compiler caches used by the commands planned so
+// far, sorted.
+//
+// One command per rule is looked at. The commands are not memoized, as the
+// edges may still be batched. extra are other commands to look at, e.g. the
+// launchers or the value of RUSTC_WRAPPER.
+func (b *Builder) CompilerCaches(extra ...string) []string {
+	found := map[string]struct{}{}
+	check := func(command string) {
+		for _, f := range strings.Fields(command) {
+			name := strings.TrimSuffix(filepath.Base(f), ".exe")
+			if name == "ccache" || name == "sccache" {
+				found[name] = struct{}{}
+			}
+		}
+	}
+	seen := map[*Rule]struct{}{}
+	for e, want := range b.plan.want {
+		if _, ok := seen[e.Rule]; ok || want == WantNothing || e.Rule == PhonyRule {
+			continue
+		}
+		seen[e.Rule] = struct{}{}
+		check(e.evalBinding("command"))
+	}
+	for _, c := range extra {
+		check(c)
+	}
+	out := make([]string, 0, len(found))
+	for t := range found {
+		out = append(out, t)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// QueryCompilerCacheStats runs the compiler cache tool to retrieve its
+// current statistics.
+func QueryCompilerCacheStats(ctx context.Context, tool string) (CompilerCacheStats, error) {
+	switch tool {
+	case "ccache":
+		out, err := exec.CommandContext(ctx, "ccache", "--print-stats").Output()
+		if err != nil {
+			return CompilerCacheStats{}, err
+		}
+		return parseCcacheStats(out)
+	case "sccache":
+		out, err := exec.CommandContext(ctx, "sccache", "--show-stats", "--stats-format=json").Output()
+		if err != nil {
+			return CompilerCacheStats{}, err
+		}
+		return parseSccacheStats(out)
+	default:
+		return CompilerCacheStats{}, errors.New("unknown compiler cache " + tool)
+	}
+}
+
+// parseCcacheStats parses the tab separated output of ccache --print-stats.
+func parseCcacheStats(out []byte) (CompilerCacheStats, error) {
+	s := CompilerCacheStats{Tool: "ccache"}
+	found := false
+	for _, l := range strings.Split(string(out), "\n") {
+		f := strings.Split(strings.TrimSpace(l), "\t")
+		if len(f) != 2 {
+			continue
+		}
+		v, err := strconv.ParseInt(f[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		switch f[0] {
+		case "direct_cache_hit", "preprocessed_cache_hit":
+			s.Hits += v
+			found = true
+		case "cache_miss":
+			s.Misses += v
+			found = true
+		}
+	}
+	if !found {
+		return s, errors.New("unexpected ccache --print-stats output")
+	}
+	return s, nil
+}
+
+// parseSccacheStats parses the output of sccache --show-stats
+// --stats-format=json.
+func parseSccacheStats(out []byte) (CompilerCacheStats, error) {
+	var raw struct {
+		Stats struct {
+			CacheHits struct {
+				Counts map[string]int64 `json:"counts"`
+			} `json:"cache_hits"`
+			CacheMisses struct {
+				Counts map[string]int64 `json:"counts"`
+			} `json:"cache_misses"`
+		} `json:"stats"`
+	}
+	s := CompilerCacheStats{Tool: "sccache"}
+	if err := json.Unmarshal(out, &raw); err != nil {
+		return s, err
+	}
+	for _, v := range raw.Stats.CacheHits.Counts {
+		s.Hits += v
+	}
+	for _, v := range raw.Stats.CacheMisses.Counts {
+		s.Misses += v
+	}
+	return s, nil
+}
@@ -0,0 +1,76 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestBuilder_CompilerCaches(t *testing.T) {
+	b := NewBuildTest(t)
+	b.AssertParse(&b.state, "cc = /usr/bin/ccache gcc\nrule cc\n  command = $cc -c $in -o $out\nrule link\n  command = gcc $in -o $out\nrule rust\n  command = sccache rustc $in\nbuild a.o: cc a.c\nbuild a: link a.o\nbuild b: rust b.rs\n", ParseManifestOpts{})
+	b.fs.Create("a.c", "")
+	b.fs.Create("b.rs", "")
+	if _, err := b.builder.addTargetName("a"); err != nil {
+		t.Fatal(err)
+	}
+	// b is not planned.
+	if diff := cmp.Diff([]string{"ccache"}, b.builder.CompilerCaches()); diff != "" {
+		t.Fatal(diff)
+	}
+	if diff := cmp.Diff([]string{"ccache", "sccache"}, b.builder.CompilerCaches("", "sccache.exe")); diff != "" {
+		t.Fatal(diff)
+	}
+	// The commands are not memoized.
+	if e := b.GetNode("a.o").InEdge; e.bindings["command"] != "" {
+		t.Fatal(e.bindings)
+	}
+}
+
+func TestParseCcacheStats(t *testing.T) {
+	out := "stats_updated_timestamp\t1650000000\ndirect_cache_hit\t10\npreprocessed_cache_hit\t2\ncache_miss\t4\nfiles_in_cache\t100\n"
+	got, err := parseCcacheStats([]byte(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := CompilerCacheStats{Tool: "ccache", Hits: 12, Misses: 4}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatal(diff)
+	}
+	if r := got.HitRate(); r != 0.75 {
+		t.Fatal(r)
+	}
+	before := CompilerCacheStats{Tool: "ccache", Hits: 2, Misses: 4}
+	if diff := cmp.Diff(CompilerCacheStats{Tool: "ccache", Hits: 10}, got.Sub(&before)); diff != "" {
+		t.Fatal(diff)
+	}
+	if _, err := parseCcacheStats([]byte("Usage: ccache\n")); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestParseSccacheStats(t *testing.T) {
+	out := `{"stats":{"compile_requests":10,"cache_hits":{"counts":{"C/C++":3,"Rust":2}},"cache_misses":{"counts":{"C/C++":5}}}}`
+	got, err := parseSccacheStats([]byte(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := CompilerCacheStats{Tool: "sccache", Hits: 5, Misses: 5}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatal(diff)
+	}
+}
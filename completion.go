@@ -0,0 +1,132 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// targetCacheHeader is the first line of a target cache.
+const targetCacheHeader = "# nin targets v1"
+
+// CompletionTargets returns the targets that can be built, sorted: the
+// outputs and the groups declared with defaultgroup, prefixed with ':'.
+func (s *State) CompletionTargets() []string {
+	out := make([]string, 0, len(s.Paths)/2+len(s.Groups))
+	for p, n := range s.Paths {
+		if n != nil && n.InEdge != nil {
+			out = append(out, p)
+		}
+	}
+	for name := range s.Groups {
+		out = append(out, ":"+name)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// WriteTargetCache writes targets to path along the mtime of the manifests,
+// so ReadTargetCache can return them without parsing the manifest while it
+// didn't change. manifests[0] is the main manifest.
+//
+// It is used for the shell completion, which needs to be interactive even for
+// manifests that take seconds to load.
+func WriteTargetCache(fs FileSystem, path string, manifests, targets []string) error {
+	var b strings.Builder
+	b.WriteString(targetCacheHeader + "\n")
+	for _, m := range manifests {
+		mtime, err := fs.Stat(m)
+		if mtime <= 0 {
+			if err == nil {
+				err = errors.New("not found")
+			}
+			return err
+		}
+		b.WriteString(strconv.FormatInt(int64(mtime), 10) + " " + m + "\n")
+	}
+	b.WriteString("\n")
+	for _, t := range targets {
+		b.WriteString(t + "\n")
+	}
+	return fs.WriteFile(path, b.String())
+}
+
+// ReadTargetCache returns the targets written by WriteTargetCache for the
+// main manifest. It returns false if the cache is missing or stale.
+func ReadTargetCache(fs FileSystem, path, manifest string) ([]string, bool) {
+	b, err := fs.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	lines := strings.Split(strings.TrimRight(unsafeString(b), "\x00"), "\n")
+	if len(lines) < 3 || lines[0] != targetCacheHeader {
+		return nil, false
+	}
+	i := 1
+	for ; i < len(lines) && lines[i] != ""; i++ {
+		j := strings.IndexByte(lines[i], ' ')
+		if j == -1 {
+			return nil, false
+		}
+		if i == 1 && lines[i][j+1:] != manifest {
+			return nil, false
+		}
+		want, err := strconv.ParseInt(lines[i][:j], 10, 64)
+		if err != nil {
+			return nil, false
+		}
+		if mtime, _ := fs.Stat(lines[i][j+1:]); int64(mtime) != want {
+			return nil, false
+		}
+	}
+	if i == 1 || i == len(lines) {
+		return nil, false
+	}
+	out := lines[i+1:]
+	if len(out) != 0 && out[len(out)-1] == "" {
+		out = out[:len(out)-1]
+	}
+	return out, true
+}
+
+// CompleteTargets returns the targets starting with prefix. When there are
+// more than limit, the ones in a subdirectory are folded into the
+// subdirectory, e.g. "out/gen/" for "out/gen/a.h" and "out/gen/b.h", so the
+// shell can complete one directory at a time. limit <= 0 means no limit.
+//
+// targets must be sorted.
+func CompleteTargets(targets []string, prefix string, limit int) []string {
+	start := sort.SearchStrings(targets, prefix)
+	end := start
+	for ; end < len(targets) && strings.HasPrefix(targets[end], prefix); end++ {
+	}
+	matches := targets[start:end]
+	if limit <= 0 || len(matches) <= limit {
+		return matches
+	}
+	var out []string
+	for _, t := range matches {
+		if i := strings.IndexByte(t[len(prefix):], '/'); i != -1 {
+			t = t[:len(prefix)+i+1]
+		}
+		if len(out) == 0 || out[len(out)-1] != t {
+			out = append(out, t)
+		}
+	}
+	return out
+}
@@ -0,0 +1,75 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestTargetCache(t *testing.T) {
+	s := NewStateTestWithBuiltinRules(t)
+	s.AssertParse(&s.state, "nin_features = defaultgroup\nbuild out/a.o: cat a.c\nbuild out/b.o: cat b.c\nbuild all: phony out/a.o out/b.o\ndefaultgroup tests: all\n", ParseManifestOpts{})
+	targets := s.state.CompletionTargets()
+	if diff := cmp.Diff([]string{":tests", "all", "out/a.o", "out/b.o"}, targets); diff != "" {
+		t.Fatal(diff)
+	}
+
+	fs := NewVirtualFileSystem()
+	if _, ok := ReadTargetCache(&fs, ".ninja_targets", "build.ninja"); ok {
+		t.Fatal("expected missing")
+	}
+	if err := WriteTargetCache(&fs, ".ninja_targets", []string{"build.ninja"}, targets); err == nil {
+		t.Fatal("expected error for a missing manifest")
+	}
+	fs.Create("build.ninja", "")
+	fs.Create("sub.ninja", "")
+	if err := WriteTargetCache(&fs, ".ninja_targets", []string{"build.ninja", "sub.ninja"}, targets); err != nil {
+		t.Fatal(err)
+	}
+	got, ok := ReadTargetCache(&fs, ".ninja_targets", "build.ninja")
+	if !ok {
+		t.Fatal("expected cache hit")
+	}
+	if diff := cmp.Diff(targets, got); diff != "" {
+		t.Fatal(diff)
+	}
+	if _, ok := ReadTargetCache(&fs, ".ninja_targets", "other.ninja"); ok {
+		t.Fatal("expected miss for another manifest")
+	}
+	fs.Tick()
+	fs.Create("sub.ninja", "")
+	if _, ok := ReadTargetCache(&fs, ".ninja_targets", "build.ninja"); ok {
+		t.Fatal("expected stale cache")
+	}
+}
+
+func TestCompleteTargets(t *testing.T) {
+	targets := []string{"all", "out/gen.txt", "out/gen/a.h", "out/gen/b.h", "out/lib.a", "test"}
+	if diff := cmp.Diff([]string{"out/gen.txt", "out/gen/a.h", "out/gen/b.h", "out/lib.a"}, CompleteTargets(targets, "out/", 0)); diff != "" {
+		t.Fatal(diff)
+	}
+	// Too many; fold the subdirectories.
+	if diff := cmp.Diff([]string{"out/gen.txt", "out/gen/", "out/lib.a"}, CompleteTargets(targets, "out/", 3)); diff != "" {
+		t.Fatal(diff)
+	}
+	if diff := cmp.Diff([]string{"out/"}, CompleteTargets(targets, "o", 3)); diff != "" {
+		t.Fatal(diff)
+	}
+	if got := CompleteTargets(targets, "x", 3); len(got) != 0 {
+		t.Fatal(got)
+	}
+}
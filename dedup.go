@@ -0,0 +1,98 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import "strings"
+
+// dedupState tracks the commands run during a build to run identical ones
+// only once. See BuildConfig.DedupCommands.
+type dedupState struct {
+	// running maps the key of a running command to its edge.
+	running map[string]*Edge
+	keys    map[*Edge]string
+	// followers are the edges waiting on the running edge with the same key.
+	followers map[*Edge][]*Edge
+	// succeeded are the keys of the commands that succeeded.
+	succeeded map[string]struct{}
+}
+
+// dedupKey returns the key identifying the command of edge and its inputs.
+func dedupKey(edge *Edge) string {
+	var k strings.Builder
+	k.WriteString(edge.EvaluateCommand(true))
+	for _, i := range edge.Inputs {
+		k.WriteByte(0)
+		k.WriteString(i.Path)
+	}
+	return k.String()
+}
+
+// start returns true if edge doesn't need to run its command because an
+// identical one is running or succeeded. Otherwise edge is recorded as
+// running.
+func (d *dedupState) start(b *Builder, edge *Edge, startTimeMillis int32) bool {
+	if edge.GetBinding("deps") != "" {
+		// The deps are extracted from a depfile that is removed once read, or
+		// from the output.
+		return false
+	}
+	if d.running == nil {
+		d.running = map[string]*Edge{}
+		d.keys = map[*Edge]string{}
+		d.followers = map[*Edge][]*Edge{}
+		d.succeeded = map[string]struct{}{}
+	}
+	key := dedupKey(edge)
+	_, done := d.succeeded[key]
+	leader := d.running[key]
+	if !done && leader == nil {
+		d.running[key] = edge
+		d.keys[edge] = key
+		return false
+	}
+	defer metricRecord("DedupedEdge")()
+	b.runningEdges[edge] = startTimeMillis
+	b.status.BuildEdgeStarted(edge, startTimeMillis)
+	if done {
+		b.hookResults = append(b.hookResults, Result{Edge: edge, notRun: true})
+	} else {
+		d.followers[leader] = append(d.followers[leader], edge)
+	}
+	return true
+}
+
+// finished queues the results of the edges that waited on result.Edge.
+//
+// They share its exit code. The output is only repeated on failure.
+func (d *dedupState) finished(b *Builder, result *Result) {
+	edge := result.Edge
+	key, ok := d.keys[edge]
+	if !ok {
+		return
+	}
+	delete(d.keys, edge)
+	delete(d.running, key)
+	if result.ExitCode == ExitSuccess {
+		d.succeeded[key] = struct{}{}
+	}
+	for _, f := range d.followers[edge] {
+		r := Result{Edge: f, ExitCode: result.ExitCode, notRun: true}
+		if result.ExitCode != ExitSuccess {
+			r.Output = result.Output
+		}
+		b.hookResults = append(b.hookResults, r)
+	}
+	delete(d.followers, edge)
+}
@@ -0,0 +1,55 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestBuildTest_DedupCommands(t *testing.T) {
+	for _, parallelism := range []uint{1, 2} {
+		b := NewBuildTest(t)
+		b.AssertParse(&b.state, "rule touch\n  command = gen $idl\nbuild a.h: touch in1\n  idl = x.idl\nbuild b.h: touch in1\n  idl = x.idl\nbuild c.h: touch in1\n  idl = y.idl\nbuild d.h: touch in2\n  idl = x.idl\nbuild all: phony a.h b.h c.h d.h\n", ParseManifestOpts{})
+		b.commandRunner.maxActiveEdges = parallelism
+		b.config.DedupCommands = true
+		var finished []string
+		b.builder.Hooks.AfterEdge = func(result *Result, startTimeMillis, endTimeMillis int32) {
+			if result.ExitCode != ExitSuccess {
+				t.Errorf("%s: %d", result.Edge.Outputs[0].Path, result.ExitCode)
+			}
+			finished = append(finished, result.Edge.Outputs[0].Path)
+		}
+		if _, err := b.builder.addTargetName("all"); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.builder.Build(); err != nil {
+			t.Fatal(err)
+		}
+		// b.h has the same command and inputs as a.h, d.h has different
+		// inputs.
+		want := []string{"gen x.idl", "gen y.idl", "gen x.idl"}
+		if diff := cmp.Diff(want, b.commandRunner.commandsRan); diff != "" {
+			t.Fatalf("-j %d: %s", parallelism, diff)
+		}
+		if len(finished) != 4 {
+			t.Fatalf("-j %d: %v", parallelism, finished)
+		}
+		if p := b.builder.Progress(); p.Finished != 4 {
+			t.Fatalf("-j %d: %v", parallelism, p)
+		}
+	}
+}
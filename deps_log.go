@@ -20,6 +20,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 )
@@ -80,6 +81,10 @@ func NewDeps(mtime TimeStamp, nodeCount int) *Deps {
 //       input path id, input path id...]
 //      (The mtime is compared against the on-disk output path mtime
 //      to verify the stored data is up-to-date.)
+// All the integers are little endian, independently of the CPU architecture,
+// so a log written on one machine can be read on another one, e.g. in a build
+// directory on a network share.
+//
 // If two records reference the same output the latter one in the file
 // wins, allowing updates to just be appended to the file.  A separate
 // repacking step can run occasionally to remove dead records.
@@ -88,11 +93,23 @@ type DepsLog struct {
 	Nodes []*Node
 	// Maps id -> Deps of that id.
 	Deps []*Deps
+	// ChecksumFS is the file system holding the checksum file of the log. nil
+	// means the local disk.
+	ChecksumFS FileSystem
+	// NoChecksum disables the checksum file so only the log is written, like
+	// ninja does.
+	NoChecksum bool
+	// Sync is how the log is flushed to the disk when closed.
+	Sync LogSyncPolicy
 
 	filePath          string
 	file              *os.File
 	buf               *bufio.Writer
 	needsRecompaction bool
+	// sum is the checksum of the log file content as loaded and written, and
+	// sumPath the path of the log opened for writing.
+	sum     logChecksum
+	sumPath string
 }
 
 // The version is stored as 4 bytes after the signature and also serves as a
@@ -213,9 +230,15 @@ func (d *DepsLog) Close() error {
 		if err2 := d.buf.Flush(); err2 != nil {
 			err = err2
 		}
+		if err2 := syncLog(d.file, d.Sync); err2 != nil && err == nil {
+			err = err2
+		}
 		if err2 := d.file.Close(); err2 != nil {
 			err = err2
 		}
+		if err2 := d.sum.save(d.checksumFS(), d.sumPath); err2 != nil && err == nil {
+			err = err2
+		}
 	}
 	d.buf = nil
 	d.file = nil
@@ -229,22 +252,30 @@ func (d *DepsLog) Close() error {
 // don't migrate v1 to v3 to force a rebuild. (v2 only existed for a few days,
 // and there was no release with it, so pretend that it never happened.)
 //
+// When the log doesn't exist, the error wraps os.ErrNotExist. When the log is
+// partially or completely unusable, e.g. it doesn't match its checksum, the
+// invalid part is discarded and an *ErrLogDiscarded is returned; the build
+// can proceed.
+//
 // Warning: the whole file content is kept alive.
 //
 // TODO(maruel): Make it an option so that when used as a library it doesn't
 // become a memory bloat. This is especially important when recompacting.
-func (d *DepsLog) Load(path string, state *State) (LoadStatus, error) {
+func (d *DepsLog) Load(path string, state *State) error {
 	defer metricRecord(".ninja_deps load")()
 	// Read the file all at once. The drawback is that it will fail hard on 32
 	// bits OS on large builds. This should be rare in 2022. For small builds, it
 	// will be fine (and faster).
+	d.sum = logChecksum{}
 	data, err := ioutil.ReadFile(path)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return LoadNotFound, err
-		}
-		return LoadError, err
+		return err
+	}
+	if err := verifyLogChecksum(d.checksumFS(), path, data); err != nil {
+		removeLog(d.checksumFS(), path)
+		return &ErrLogDiscarded{Reason: err.Error() + "; starting over"}
 	}
+	file := data
 
 	// Validate header.
 	validHeader := false
@@ -256,15 +287,15 @@ func (d *DepsLog) Load(path string, state *State) (LoadStatus, error) {
 	if !validHeader {
 		// Don't report this as a failure.  An empty deps log will cause
 		// us to rebuild the outputs anyway.
-		_ = os.Remove(path)
+		removeLog(d.checksumFS(), path)
 		if version == 1 {
-			return LoadSuccess, errors.New("deps log version change; rebuilding")
+			return &ErrLogDiscarded{Reason: "deps log version change; rebuilding"}
 		}
 		l := bytes.IndexByte(data[:], 0)
 		if l <= 0 {
-			return LoadSuccess, errors.New("bad deps log signature or version; starting over")
+			return &ErrLogDiscarded{Reason: "bad deps log signature or version; starting over"}
 		}
-		return LoadSuccess, fmt.Errorf("bad deps log signature %q or version %d; starting over", data[:l], version)
+		return &ErrLogDiscarded{Reason: fmt.Sprintf("bad deps log signature %q or version %d; starting over", data[:l], version)}
 	}
 
 	// Skip the header.
@@ -318,13 +349,16 @@ func (d *DepsLog) Load(path string, state *State) (LoadStatus, error) {
 			x := 12
 			for i := 0; i < depsCount; i++ {
 				v := binary.LittleEndian.Uint32(data[x : x+4])
-				if int(v) >= len(d.Nodes) || d.Nodes[v] == nil {
+				if v >= uint32(len(d.Nodes)) || d.Nodes[v] == nil {
 					err = errors.New("record deps node id is out of bounds")
 					break
 				}
 				deps.Nodes[i] = d.Nodes[v]
 				x += 4
 			}
+			if err != nil {
+				break
+			}
 
 			totalDepRecordCount++
 			if !d.updateDeps(outID, deps) {
@@ -385,13 +419,13 @@ func (d *DepsLog) Load(path string, state *State) (LoadStatus, error) {
 		// An error occurred while loading; try to recover by truncating the
 		// file to the last fully-read record.
 		if err2 := os.Truncate(path, offset); err2 != nil {
-			return LoadError, fmt.Errorf("truncating failed while parsing error %q: %w", err, err2)
+			return fmt.Errorf("truncating failed while parsing error %q: %w", err, err2)
 		}
 
 		// The truncate succeeded; we'll just report the load error as a
 		// warning because the build can proceed.
-		err = errors.New(err.Error() + "; recovering")
-		return LoadSuccess, err
+		d.sum.reset(file[:offset])
+		return &ErrLogDiscarded{Reason: err.Error() + "; recovering"}
 	}
 
 	// Rebuild the log if there are too many dead records.
@@ -400,7 +434,8 @@ func (d *DepsLog) Load(path string, state *State) (LoadStatus, error) {
 	if totalDepRecordCount > minCompactionEntryCount && totalDepRecordCount > uniqueDepRecordCount*kCompactionRatio {
 		d.needsRecompaction = true
 	}
-	return LoadSuccess, nil
+	d.sum.reset(file)
+	return nil
 }
 
 // GetDeps returns the Deps for this node ID.
@@ -433,6 +468,78 @@ func (d *DepsLog) GetFirstReverseDepsNode(node *Node) *Node {
 	return nil
 }
 
+// readDepsLogVersion returns the version in the header of the deps log
+// without loading it.
+func readDepsLogVersion(path string) (uint32, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	data := make([]byte, len(depsLogFileSignature)+4)
+	if _, err := io.ReadFull(f, data); err != nil || unsafeString(data[:len(depsLogFileSignature)]) != depsLogFileSignature {
+		return 0, errors.New("invalid deps log header")
+	}
+	return binary.LittleEndian.Uint32(data[len(depsLogFileSignature):]), nil
+}
+
+// VerifyDepsLog validates the deps log at path without modifying it.
+//
+// It checks the header, the checksum file and the consistency of every
+// record.
+func VerifyDepsLog(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := verifyLogChecksum(&RealDiskInterface{}, path, data); err != nil {
+		return err
+	}
+	if len(data) < len(depsLogFileSignature)+4 || unsafeString(data[:len(depsLogFileSignature)]) != depsLogFileSignature {
+		return fmt.Errorf("%s: invalid header", path)
+	}
+	if version := binary.LittleEndian.Uint32(data[len(depsLogFileSignature):]); version != depsLogCurrentVersion {
+		return fmt.Errorf("%s: unsupported version %d", path, version)
+	}
+	offset := len(depsLogFileSignature) + 4
+	nodes := uint32(0)
+	for offset != len(data) {
+		if len(data)-offset < 4 {
+			return fmt.Errorf("%s: offset %d: premature end of file", path, offset)
+		}
+		size := binary.LittleEndian.Uint32(data[offset:])
+		isDeps := size&0x80000000 != 0
+		size &= ^uint32(0x80000000)
+		if size%4 != 0 || size < 8 || size > maxRecordSize {
+			return fmt.Errorf("%s: offset %d: record size %d is out of bounds", path, offset, size)
+		}
+		if len(data)-offset-4 < int(size) {
+			return fmt.Errorf("%s: offset %d: premature end of file", path, offset)
+		}
+		record := data[offset+4 : offset+4+int(size)]
+		if isDeps {
+			if size < 12 {
+				return fmt.Errorf("%s: offset %d: record size is too small for deps", path, offset)
+			}
+			if id := binary.LittleEndian.Uint32(record); id >= nodes {
+				return fmt.Errorf("%s: offset %d: deps output id %d is out of bounds", path, offset, id)
+			}
+			for x := 12; x < len(record); x += 4 {
+				if id := binary.LittleEndian.Uint32(record[x:]); id >= nodes {
+					return fmt.Errorf("%s: offset %d: deps input id %d is out of bounds", path, offset, id)
+				}
+			}
+		} else {
+			if ^binary.LittleEndian.Uint32(record[size-4:]) != nodes {
+				return fmt.Errorf("%s: offset %d: node id checksum is invalid", path, offset)
+			}
+			nodes++
+		}
+		offset += 4 + int(size)
+	}
+	return nil
+}
+
 // Recompact rewrites the known log entries, throwing away old data.
 func (d *DepsLog) Recompact(path string) error {
 	defer metricRecord(".ninja_deps recompact")()
@@ -448,8 +555,9 @@ func (d *DepsLog) Recompact(path string) error {
 		return err
 	}
 
-	// Create a new temporary log to regenerate everything.
-	newLog := DepsLog{}
+	// Create a new temporary log to regenerate everything. Its checksum is
+	// written once it replaced the log.
+	newLog := DepsLog{NoChecksum: true, Sync: d.Sync}
 	if err := newLog.OpenForWrite(tempPath); err != nil {
 		return err
 	}
@@ -484,11 +592,21 @@ func (d *DepsLog) Recompact(path string) error {
 	// All nodes now have ids that refer to newLog, so steal its data.
 	d.Deps = newLog.Deps
 	d.Nodes = newLog.Nodes
+	d.sum = newLog.sum
 
 	if err := os.Remove(path); err != nil {
 		return err
 	}
-	return os.Rename(tempPath, path)
+	if err := os.Rename(tempPath, path); err != nil {
+		return err
+	}
+	return d.sum.save(d.checksumFS(), path)
+}
+
+// checksumFS returns the file system holding the checksum file, nil if
+// disabled.
+func (d *DepsLog) checksumFS() FileSystem {
+	return checksumFS(d.ChecksumFS, d.NoChecksum)
 }
 
 // IsDepsEntryLiveFor returns if the deps entry for a node is still reachable
@@ -573,9 +691,6 @@ func (d *DepsLog) openForWriteIfNeeded() error {
 	if err != nil {
 		return err
 	}
-	// Set the buffer size large and flush the file buffer after every record to
-	// make sure records aren't written partially.
-	d.buf = bufio.NewWriterSize(d.file, maxRecordSize+1)
 
 	// Opening a file in append mode doesn't set the file pointer to the file's
 	// end on Windows. Do that explicitly.
@@ -583,6 +698,17 @@ func (d *DepsLog) openForWriteIfNeeded() error {
 	if err != nil {
 		return err
 	}
+	if offset == 0 {
+		d.sum = logChecksum{valid: true}
+	} else if d.sum.size != offset {
+		// The file was not loaded or was modified since.
+		d.sum.valid = false
+	}
+	d.sumPath = d.filePath
+
+	// Set the buffer size large and flush the file buffer after every record to
+	// make sure records aren't written partially.
+	d.buf = bufio.NewWriterSize(io.MultiWriter(d.file, &d.sum), maxRecordSize+1)
 
 	if offset == 0 {
 		if _, err = d.buf.WriteString(depsLogFileSignature); err != nil {
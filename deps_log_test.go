@@ -15,7 +15,10 @@
 package nin
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
@@ -69,8 +72,8 @@ func TestDepsLogTest_WriteRead(t *testing.T) {
 
 	state2 := NewState()
 	log2 := DepsLog{}
-	if s, err := log2.Load(testFilename, &state2); s != LoadSuccess || err != nil {
-		t.Fatal(s, err)
+	if err := log2.Load(testFilename, &state2); err != nil {
+		t.Fatal(err)
 	}
 
 	if len(log1.Nodes) != len(log2.Nodes) {
@@ -138,8 +141,8 @@ func TestDepsLogTest_LotsOfDeps(t *testing.T) {
 
 	state2 := NewState()
 	log2 := DepsLog{}
-	if s, err := log2.Load(testFilename, &state2); s != LoadSuccess || err != nil {
-		t.Fatal(s, err)
+	if err := log2.Load(testFilename, &state2); err != nil {
+		t.Fatal(err)
 	}
 
 	logDeps := log2.GetDeps(state2.GetNode("out.o", 0))
@@ -188,8 +191,8 @@ func TestDepsLogTest_DoubleEntry(t *testing.T) {
 	{
 		state := NewState()
 		log := DepsLog{}
-		if s, err := log.Load(testFilename, &state); s != LoadSuccess || err != nil {
-			t.Fatal(s, err)
+		if err := log.Load(testFilename, &state); err != nil {
+			t.Fatal(err)
 		}
 
 		if err := log.OpenForWrite(testFilename); err != nil {
@@ -257,8 +260,8 @@ func TestDepsLogTest_Recompact(t *testing.T) {
 		state := NewState()
 		assertParseManifest(t, manifest, &state)
 		log := DepsLog{}
-		if s, err := log.Load(testFilename, &state); s != LoadSuccess || err != nil {
-			t.Fatal(s, err)
+		if err := log.Load(testFilename, &state); err != nil {
+			t.Fatal(err)
 		}
 
 		if err := log.OpenForWrite(testFilename); err != nil {
@@ -288,8 +291,8 @@ func TestDepsLogTest_Recompact(t *testing.T) {
 		state := NewState()
 		assertParseManifest(t, manifest, &state)
 		log := DepsLog{}
-		if s, err := log.Load(testFilename, &state); s != LoadSuccess || err != nil {
-			t.Fatal(s, err)
+		if err := log.Load(testFilename, &state); err != nil {
+			t.Fatal(err)
 		}
 
 		out := state.GetNode("out.o", 0)
@@ -380,8 +383,8 @@ func TestDepsLogTest_Recompact(t *testing.T) {
 		state := NewState()
 		// Intentionally not parsing manifest here.
 		log := DepsLog{}
-		if s, err := log.Load(testFilename, &state); s != LoadSuccess || err != nil {
-			t.Fatal(s, err)
+		if err := log.Load(testFilename, &state); err != nil {
+			t.Fatal(err)
 		}
 
 		out := state.GetNode("out.o", 0)
@@ -471,8 +474,8 @@ func TestDepsLogTest_InvalidHeader(t *testing.T) {
 
 		log := DepsLog{}
 		state := NewState()
-		if s, err := log.Load(testFilename, &state); s != LoadSuccess || err == nil {
-			t.Fatal(s, err)
+		if err := log.Load(testFilename, &state); !errors.Is(err, &ErrLogDiscarded{}) {
+			t.Fatal(err)
 		} else if !strings.HasPrefix(err.Error(), "bad deps log signature ") {
 			t.Fatalf("%q", err)
 		}
@@ -526,9 +529,9 @@ func TestDepsLogTest_Truncated(t *testing.T) {
 		state := NewState()
 		log := DepsLog{}
 		// At some point the log will be so short as to be unparsable.
-		s, err := log.Load(testFilename, &state)
-		if s != LoadSuccess {
-			t.Fatal(s, err)
+		err := log.Load(testFilename, &state)
+		if err != nil && !errors.Is(err, &ErrLogDiscarded{}) {
+			t.Fatal(err)
 		}
 		if err != nil {
 			if strings.HasSuffix(err.Error(), "; starting over") {
@@ -606,8 +609,8 @@ func TestDepsLogTest_TruncatedRecovery(t *testing.T) {
 	{
 		state := NewState()
 		log := DepsLog{}
-		if s, err := log.Load(testFilename, &state); s != LoadSuccess || err == nil {
-			t.Fatal(s, err)
+		if err := log.Load(testFilename, &state); !errors.Is(err, &ErrLogDiscarded{}) {
+			t.Fatal(err)
 		} else if !strings.HasPrefix(err.Error(), "premature end of file after") {
 			t.Fatal(err)
 		}
@@ -639,8 +642,8 @@ func TestDepsLogTest_TruncatedRecovery(t *testing.T) {
 	{
 		state := NewState()
 		log := DepsLog{}
-		if s, err := log.Load(testFilename, &state); s != LoadSuccess || err != nil {
-			t.Fatal(s, err)
+		if err := log.Load(testFilename, &state); err != nil {
+			t.Fatal(err)
 		}
 
 		// The truncated entry should exist.
@@ -687,3 +690,67 @@ func TestDepsLogTest_ReverseDepsNodes(t *testing.T) {
 		t.Fatal("expected true")
 	}
 }
+
+// depsLogGolden is the deps log written by TestDepsLogTest_Golden. It must
+// not depend on the architecture of the machine writing it.
+var depsLogGolden = []byte("# ninjadeps\n\x04\x00\x00\x00" +
+	// Path records: size, path padded to 4 bytes, one's complement of the id.
+	"\x08\x00\x00\x00out\x00\xff\xff\xff\xff" +
+	"\x08\x00\x00\x00in1\x00\xfe\xff\xff\xff" +
+	"\x08\x00\x00\x00in22\xfd\xff\xff\xff" +
+	// Deps record: size with the high bit set, output id, 64 bits mtime, input
+	// ids.
+	"\x14\x00\x00\x80\x00\x00\x00\x00\x08\x07\x06\x05\x04\x03\x02\x01\x01\x00\x00\x00\x02\x00\x00\x00")
+
+func TestDepsLogTest_Golden(t *testing.T) {
+	testFilename := filepath.Join(t.TempDir(), "DepsLogTest-tempfile")
+	state1 := NewState()
+	log1 := DepsLog{}
+	if err := log1.OpenForWrite(testFilename); err != nil {
+		t.Fatal(err)
+	}
+	deps := []*Node{state1.GetNode("in1", 0), state1.GetNode("in22", 0)}
+	if err := log1.recordDeps(state1.GetNode("out", 0), 0x0102030405060708, deps); err != nil {
+		t.Fatal(err)
+	}
+	if err := log1.Close(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(testFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(depsLogGolden, got) {
+		t.Fatalf("%q", got)
+	}
+
+	state2 := NewState()
+	log2 := DepsLog{}
+	if err := log2.Load(testFilename, &state2); err != nil {
+		t.Fatal(err)
+	}
+	d := log2.GetDeps(state2.GetNode("out", 0))
+	if d == nil || d.MTime != 0x0102030405060708 || len(d.Nodes) != 2 || d.Nodes[0].Path != "in1" || d.Nodes[1].Path != "in22" {
+		t.Fatalf("%#v", d)
+	}
+}
+
+func TestDepsLogTest_BadNodeID(t *testing.T) {
+	testFilename := filepath.Join(t.TempDir(), "DepsLogTest-tempfile")
+	// The last input id has the high bit set, which is negative as an int on
+	// 32 bits platforms.
+	data := append([]byte{}, depsLogGolden...)
+	copy(data[len(data)-4:], "\x00\x00\x00\x90")
+	if err := ioutil.WriteFile(testFilename, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	state := NewState()
+	log := DepsLog{}
+	if err := log.Load(testFilename, &state); err == nil || err.Error() != "record deps node id is out of bounds; recovering" {
+		t.Fatal(err)
+	}
+	// The bad record is truncated away.
+	if d := log.GetDeps(state.GetNode("out", 0)); d != nil {
+		t.Fatalf("%#v", d)
+	}
+}
@@ -0,0 +1,265 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// DeterminismConfig configures CheckDeterminism.
+type DeterminismConfig struct {
+	// ScratchDir is where the outputs of the first run are copied to be
+	// compared with the ones of the second run.
+	ScratchDir string
+	// Sample is the number of edges to check, selected at random. 0 means all
+	// of them.
+	Sample int
+	// Seed seeds the selection of the sample.
+	Seed int64
+	// MaxRanges is the maximum number of differing byte ranges reported per
+	// output. 0 means 8.
+	MaxRanges int
+	// Digests is used to hash the outputs. It ends up with the digests of the
+	// outputs of the second run. A temporary store is used if nil.
+	Digests *DigestStore
+	// Run runs a command. It defaults to running it through the shell.
+	Run func(ctx context.Context, edge *Edge, command string) error
+	// PosixShell is the shell running the commands on Windows by default. See
+	// BuildConfig.PosixShell.
+	PosixShell string
+}
+
+// ByteRange is a range of bytes in a file, End is exclusive.
+type ByteRange struct {
+	Start int64
+	End   int64
+}
+
+// NondeterministicOutput is an output that differed between two runs of the
+// same command.
+type NondeterministicOutput struct {
+	Path string
+	// Digests are the digests of the first and the second run.
+	Digests [2]Digest
+	// Ranges are the byte ranges that differ, capped to
+	// DeterminismConfig.MaxRanges.
+	Ranges []ByteRange
+}
+
+// DeterminismResult is the result of checking one edge.
+type DeterminismResult struct {
+	Edge *Edge
+	// Outputs lists the outputs that differ, it is empty when the edge is
+	// deterministic.
+	Outputs []NondeterministicOutput
+	// Err is set when the edge couldn't be checked, e.g. its command failed.
+	Err error
+}
+
+// CheckDeterminism runs the command of each edge twice and compares the
+// digests of their outputs.
+//
+// The edges must be in dependency order and their inputs must be up to date,
+// e.g. by building the targets first. The outputs of the second run are left
+// in place.
+func CheckDeterminism(ctx context.Context, fs FileSystem, edges []*Edge, cfg *DeterminismConfig) []DeterminismResult {
+	edges = sampleEdges(edges, cfg.Sample, cfg.Seed)
+	digests := cfg.Digests
+	if digests == nil {
+		digests = NewDigestStore()
+	}
+	maxRanges := cfg.MaxRanges
+	if maxRanges == 0 {
+		maxRanges = 8
+	}
+	run := cfg.Run
+	if run == nil {
+		run = func(ctx context.Context, edge *Edge, command string) error {
+			return runEdgeCommand(ctx, edge, command, cfg.PosixShell)
+		}
+	}
+	out := make([]DeterminismResult, 0, len(edges))
+	for _, edge := range edges {
+		if err := ctx.Err(); err != nil {
+			break
+		}
+		r := DeterminismResult{Edge: edge}
+		r.Outputs, r.Err = checkEdgeDeterminism(ctx, fs, edge, cfg.ScratchDir, digests, maxRanges, run)
+		out = append(out, r)
+	}
+	return out
+}
+
+// sampleEdges returns n edges selected at random, in their original order.
+func sampleEdges(edges []*Edge, n int, seed int64) []*Edge {
+	if n <= 0 || n >= len(edges) {
+		return edges
+	}
+	idx := rand.New(rand.NewSource(seed)).Perm(len(edges))[:n]
+	sort.Ints(idx)
+	out := make([]*Edge, n)
+	for i, j := range idx {
+		out[i] = edges[j]
+	}
+	return out
+}
+
+func checkEdgeDeterminism(ctx context.Context, fs FileSystem, edge *Edge, scratch string, digests *DigestStore, maxRanges int, run func(ctx context.Context, edge *Edge, command string) error) ([]NondeterministicOutput, error) {
+	first, err := runAndDigest(ctx, fs, edge, digests, run)
+	if err != nil {
+		return nil, err
+	}
+	// Keep a copy of the first run since the second one overwrites it.
+	copies := make([]string, 0, len(edge.Outputs))
+	defer func() {
+		for _, c := range copies {
+			_ = fs.RemoveFile(c)
+		}
+	}()
+	for i, o := range edge.Outputs {
+		c, err := readFileContent(fs, o.Path)
+		if err != nil {
+			return nil, err
+		}
+		p := filepath.Join(scratch, strconv.Itoa(i))
+		if err := MakeDirs(fs, p); err != nil {
+			return nil, err
+		}
+		if err := fs.WriteFile(p, unsafeString(c)); err != nil {
+			return nil, err
+		}
+		copies = append(copies, p)
+	}
+	second, err := runAndDigest(ctx, fs, edge, digests, run)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []NondeterministicOutput
+	for i, o := range edge.Outputs {
+		if first[i].Hash == second[i].Hash {
+			continue
+		}
+		a, err := readFileContent(fs, copies[i])
+		if err != nil {
+			return nil, err
+		}
+		b, err := readFileContent(fs, o.Path)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, NondeterministicOutput{
+			Path:    o.Path,
+			Digests: [2]Digest{first[i], second[i]},
+			Ranges:  diffRanges(a, b, maxRanges),
+		})
+	}
+	return out, nil
+}
+
+// runAndDigest runs the edge's command and returns the digests of its
+// outputs.
+func runAndDigest(ctx context.Context, fs FileSystem, edge *Edge, digests *DigestStore, run func(ctx context.Context, edge *Edge, command string) error) ([]Digest, error) {
+	for _, o := range edge.Outputs {
+		if err := MakeDirs(fs, o.Path); err != nil {
+			return nil, err
+		}
+	}
+	rspfile := edge.GetUnescapedRspfile()
+	if rspfile != "" {
+		if err := fs.WriteFile(rspfile, edge.GetBinding("rspfile_content")); err != nil {
+			return nil, err
+		}
+		defer fs.RemoveFile(rspfile)
+	}
+	if err := run(ctx, edge, edge.EvaluateCommand(false)); err != nil {
+		return nil, err
+	}
+	out := make([]Digest, len(edge.Outputs))
+	for i, o := range edge.Outputs {
+		// The file may have been rewritten within the mtime resolution.
+		digests.Forget(o.Path)
+		d, err := digests.Get(fs, o.Path)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = d
+	}
+	return out, nil
+}
+
+// runEdgeCommand runs command through the shell.
+func runEdgeCommand(ctx context.Context, edge *Edge, command, shell string) error {
+	cmd := createCmd(ctx, command, shell, false, false)
+	cmd.Dir = edge.Cwd()
+	var buf bytes.Buffer
+	cmd.Stdout = &buf
+	cmd.Stderr = &buf
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("command '%s' failed: %w\n%s", command, err, buf.Bytes())
+	}
+	return nil
+}
+
+// readFileContent returns the content of the file without the trailing zero
+// byte added by FileReader.
+func readFileContent(fs FileSystem, path string) ([]byte, error) {
+	c, err := fs.ReadFile(path)
+	if len(c) != 0 {
+		c = c[:len(c)-1]
+	}
+	return c, err
+}
+
+// diffRanges returns up to max ranges of bytes that differ between a and b.
+//
+// When the sizes differ, the extra bytes are reported as a differing range.
+func diffRanges(a, b []byte, max int) []ByteRange {
+	var out []ByteRange
+	l := len(a)
+	if len(b) < l {
+		l = len(b)
+	}
+	for i := 0; i < l && len(out) < max; i++ {
+		if a[i] == b[i] {
+			continue
+		}
+		j := i + 1
+		for j < l && a[j] != b[j] {
+			j++
+		}
+		out = append(out, ByteRange{Start: int64(i), End: int64(j)})
+		i = j
+	}
+	if len(a) != len(b) && len(out) < max {
+		end := len(a)
+		if len(b) > end {
+			end = len(b)
+		}
+		// Merge with a range ending right at the common length.
+		if n := len(out); n != 0 && out[n-1].End == int64(l) {
+			out[n-1].End = int64(end)
+		} else {
+			out = append(out, ByteRange{Start: int64(l), End: int64(end)})
+		}
+	}
+	return out
+}
@@ -0,0 +1,124 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"strconv"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCheckDeterminism(t *testing.T) {
+	s := NewStateTestWithBuiltinRules(t)
+	s.AssertParse(&s.state, "build stable: cat in\nbuild unstable: cat in\nbuild fail: cat in\n", ParseManifestOpts{})
+	fs := NewVirtualFileSystem()
+	fs.Create("in", "")
+	runs := 0
+	cfg := DeterminismConfig{
+		ScratchDir: "scratch",
+		Run: func(ctx context.Context, edge *Edge, command string) error {
+			runs++
+			switch o := edge.Outputs[0].Path; o {
+			case "stable":
+				fs.Create(o, "same content")
+			case "unstable":
+				fs.Create(o, "built "+strconv.Itoa(runs)+" times, ok")
+			default:
+				return errors.New("failed")
+			}
+			return nil
+		},
+	}
+	edges := []*Edge{s.GetNode("stable").InEdge, s.GetNode("unstable").InEdge, s.GetNode("fail").InEdge}
+	r := CheckDeterminism(context.Background(), &fs, edges, &cfg)
+	if len(r) != 3 {
+		t.Fatal(len(r))
+	}
+	if len(r[0].Outputs) != 0 || r[0].Err != nil {
+		t.Fatal(r[0])
+	}
+	if r[1].Err != nil || len(r[1].Outputs) != 1 {
+		t.Fatal(r[1])
+	}
+	if diff := cmp.Diff([]ByteRange{{6, 7}}, r[1].Outputs[0].Ranges); diff != "" {
+		t.Fatal(diff)
+	}
+	if r[2].Err == nil || r[2].Err.Error() != "failed" {
+		t.Fatal(r[2].Err)
+	}
+	if b, _ := fs.ReadFile("unstable"); string(b) != "built 4 times, ok\x00" {
+		t.Fatalf("%q", b)
+	}
+	if diff := cmp.Diff([]string{"scratch/0"}, fs.FilesRemoved()); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestCheckDeterminism_Shell(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses posix shell")
+	}
+	CreateTempDirAndEnter(t)
+	s := NewStateTestWithBuiltinRules(t)
+	s.AssertParse(&s.state, "rule pid\n  command = echo $$$$ > $out\nbuild out/pid: pid\n", ParseManifestOpts{})
+	cfg := DeterminismConfig{ScratchDir: "scratch"}
+	r := CheckDeterminism(context.Background(), &RealDiskInterface{}, []*Edge{s.state.Edges[0]}, &cfg)
+	if len(r) != 1 || r[0].Err != nil || len(r[0].Outputs) != 1 || len(r[0].Outputs[0].Ranges) == 0 {
+		t.Fatalf("%+v", r)
+	}
+}
+
+func TestSampleEdges(t *testing.T) {
+	edges := make([]*Edge, 10)
+	for i := range edges {
+		edges[i] = &Edge{ID: int32(i)}
+	}
+	got := sampleEdges(edges, 3, 1)
+	if len(got) != 3 {
+		t.Fatal(len(got))
+	}
+	for i := 1; i < len(got); i++ {
+		if got[i-1].ID >= got[i].ID {
+			t.Fatal("expected edges in their original order")
+		}
+	}
+	if len(sampleEdges(edges, 0, 1)) != 10 {
+		t.Fatal("expected all edges")
+	}
+}
+
+func TestDiffRanges(t *testing.T) {
+	data := []struct {
+		a, b string
+		max  int
+		want []ByteRange
+	}{
+		{"abc", "abc", 8, nil},
+		{"abcdef", "aXcdYY", 8, []ByteRange{{1, 2}, {4, 6}}},
+		{"abcdef", "aXcdYY", 1, []ByteRange{{1, 2}}},
+		{"abc", "abcdef", 8, []ByteRange{{3, 6}}},
+		{"abX", "abcdef", 8, []ByteRange{{2, 6}}},
+		{"abcdef", "", 8, []ByteRange{{0, 6}}},
+	}
+	for i, l := range data {
+		if diff := cmp.Diff(l.want, diffRanges([]byte(l.a), []byte(l.b), l.max)); diff != "" {
+			t.Errorf("#%d: %s", i, diff)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+const digestStoreSignature = "# nin digests v1\n"
+
+// Digest is the content hash of a file along with the metadata that was
+// current when it was computed.
+type Digest struct {
+	Size  int64
+	MTime TimeStamp
+	Hash  [sha256.Size]byte
+}
+
+// String returns the hash as hex.
+func (d *Digest) String() string {
+	return hex.EncodeToString(d.Hash[:])
+}
+
+// DigestStore is a database of file digests maintained incrementally across
+// builds.
+//
+// A file is only hashed again when its mtime changed since the last time it
+// was hashed, so the subsystems needing content hashes don't each re-hash the
+// same headers. It is safe for concurrent use.
+type DigestStore struct {
+	mu      sync.Mutex
+	entries map[string]Digest
+	dirty   bool
+	hashed  int
+}
+
+// NewDigestStore returns an empty DigestStore.
+func NewDigestStore() *DigestStore {
+	return &DigestStore{entries: map[string]Digest{}}
+}
+
+// Get returns the digest of the file at path, hashing it if it is not known
+// or if it changed.
+//
+// Returns an error that matches os.IsNotExist() if the file is missing.
+func (d *DigestStore) Get(fs FileSystem, path string) (Digest, error) {
+	mtime, err := fs.Stat(path)
+	if mtime < 0 {
+		return Digest{}, err
+	}
+	if mtime == 0 {
+		d.Forget(path)
+		return Digest{}, &os.PathError{Op: "digest", Path: path, Err: os.ErrNotExist}
+	}
+	d.mu.Lock()
+	e, ok := d.entries[path]
+	d.mu.Unlock()
+	if ok && e.MTime == mtime {
+		return e, nil
+	}
+
+	// Stat before reading so a file modified while being read is hashed again
+	// on the next call.
+	defer metricRecord("digest")()
+	c, err := fs.ReadFile(path)
+	if err != nil {
+		return Digest{}, err
+	}
+	if len(c) != 0 {
+		// Strip the trailing zero byte.
+		c = c[:len(c)-1]
+	}
+	e = Digest{Size: int64(len(c)), MTime: mtime, Hash: sha256.Sum256(c)}
+	d.mu.Lock()
+	d.entries[path] = e
+	d.dirty = true
+	d.hashed++
+	d.mu.Unlock()
+	return e, nil
+}
+
+// Forget removes the digest of path, e.g. when the file is known to have been
+// rewritten.
+func (d *DigestStore) Forget(path string) {
+	d.mu.Lock()
+	if _, ok := d.entries[path]; ok {
+		delete(d.entries, path)
+		d.dirty = true
+	}
+	d.mu.Unlock()
+}
+
+// Hashed returns the number of files hashed since the store was created.
+func (d *DigestStore) Hashed() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.hashed
+}
+
+// Len returns the number of digests in the store.
+func (d *DigestStore) Len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.entries)
+}
+
+// Load loads the digests from the file at path.
+//
+// It is not an error if the file doesn't exist. On a parse error, the store is
+// left empty so all the files get hashed again.
+func (d *DigestStore) Load(path string) error {
+	defer metricRecord(".ninja_digests load")()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	entries := map[string]Digest{}
+	if !bytes.HasPrefix(data, []byte(digestStoreSignature)) {
+		return fmt.Errorf("%s: invalid signature", path)
+	}
+	data = data[len(digestStoreSignature):]
+	for lineno := 2; len(data) != 0; lineno++ {
+		i := bytes.IndexByte(data, '\n')
+		if i == -1 {
+			// Truncated by an interrupted write.
+			break
+		}
+		line := data[:i]
+		data = data[i+1:]
+		f := bytes.SplitN(line, []byte{'\t'}, 4)
+		if len(f) != 4 {
+			return fmt.Errorf("%s:%d: expected 4 fields", path, lineno)
+		}
+		size, err1 := strconv.ParseInt(string(f[0]), 10, 64)
+		mtime, err2 := strconv.ParseInt(string(f[1]), 10, 64)
+		var e Digest
+		n, err3 := hex.Decode(e.Hash[:], f[2])
+		if err1 != nil || err2 != nil || err3 != nil || n != len(e.Hash) {
+			return fmt.Errorf("%s:%d: invalid entry", path, lineno)
+		}
+		e.Size = size
+		e.MTime = TimeStamp(mtime)
+		entries[string(f[3])] = e
+	}
+	d.mu.Lock()
+	d.entries = entries
+	d.dirty = false
+	d.mu.Unlock()
+	return nil
+}
+
+// Save writes the digests to the file at path if they changed since the last
+// Load or Save.
+func (d *DigestStore) Save(path string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.dirty {
+		return nil
+	}
+	defer metricRecord(".ninja_digests save")()
+	paths := make([]string, 0, len(d.entries))
+	for p := range d.entries {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o666)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	_, _ = w.WriteString(digestStoreSignature)
+	for _, p := range paths {
+		e := d.entries[p]
+		_, _ = fmt.Fprintf(w, "%d\t%d\t%x\t%s\n", e.Size, e.MTime, e.Hash, p)
+	}
+	err = w.Flush()
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	d.dirty = false
+	return nil
+}
@@ -0,0 +1,127 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestDigestStore_Get(t *testing.T) {
+	fs := NewVirtualFileSystem()
+	fs.Create("in", "hello")
+	d := NewDigestStore()
+
+	e, err := d.Get(&fs, "in")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"; e.String() != want || e.Size != 5 || e.MTime != 1 {
+		t.Fatal(e.String(), e.Size, e.MTime)
+	}
+	if _, err := d.Get(&fs, "in"); err != nil {
+		t.Fatal(err)
+	}
+	if d.Hashed() != 1 || len(fs.FilesRead()) != 1 {
+		t.Fatal("expected the digest to be cached")
+	}
+
+	// A new mtime causes the file to be hashed again.
+	fs.Tick()
+	fs.Create("in", "")
+	e, err = d.Get(&fs, "in")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"; e.String() != want || e.Size != 0 || e.MTime != 2 {
+		t.Fatal(e.String(), e.Size, e.MTime)
+	}
+	if d.Hashed() != 2 {
+		t.Fatal(d.Hashed())
+	}
+
+	if _, err := d.Get(&fs, "missing"); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	if err := fs.RemoveFile("in"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Get(&fs, "in"); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	if d.Len() != 0 {
+		t.Fatal(d.Len())
+	}
+}
+
+func TestDigestStore_LoadSave(t *testing.T) {
+	CreateTempDirAndEnter(t)
+	fs := NewVirtualFileSystem()
+	fs.Create("a", "a")
+	fs.Create("b\tc", "b")
+	d := NewDigestStore()
+	if err := d.Load(".ninja_digests"); err != nil {
+		t.Fatal(err)
+	}
+	a, _ := d.Get(&fs, "a")
+	b, _ := d.Get(&fs, "b\tc")
+	if err := d.Save(".ninja_digests"); err != nil {
+		t.Fatal(err)
+	}
+
+	d = NewDigestStore()
+	if err := d.Load(".ninja_digests"); err != nil {
+		t.Fatal(err)
+	}
+	if d.Len() != 2 {
+		t.Fatal(d.Len())
+	}
+	if a2, _ := d.Get(&fs, "a"); a2 != a {
+		t.Fatal(a2, a)
+	}
+	if b2, _ := d.Get(&fs, "b\tc"); b2 != b {
+		t.Fatal(b2, b)
+	}
+	if d.Hashed() != 0 {
+		t.Fatal("expected loaded digests to be reused")
+	}
+
+	// Nothing changed, the file is not rewritten.
+	if err := os.Remove(".ninja_digests"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Save(".ninja_digests"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(".ninja_digests"); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+}
+
+func TestDigestStore_LoadInvalid(t *testing.T) {
+	CreateTempDirAndEnter(t)
+	data := digestStoreSignature + "1\t1\tzz\ta\n"
+	if err := ioutil.WriteFile(".ninja_digests", []byte(data), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	d := NewDigestStore()
+	if err := d.Load(".ninja_digests"); err == nil || err.Error() != ".ninja_digests:2: invalid entry" {
+		t.Fatal(err)
+	}
+	if d.Len() != 0 {
+		t.Fatal(d.Len())
+	}
+}
@@ -27,7 +27,7 @@ import (
 
 // FileReader is an interface for reading files from disk.
 //
-// See DiskInterface for details. This base offers the minimum interface needed
+// See FileSystem for details. This base offers the minimum interface needed
 // just to read files.
 type FileReader interface {
 	// ReadFile reads a file and returns its content.
@@ -37,20 +37,29 @@ type FileReader interface {
 	ReadFile(path string) ([]byte, error)
 }
 
-// DiskInterface is an interface for accessing the disk.
+// FileSystem is an interface for accessing the disk.
 //
-// Abstract so it can be mocked out for tests. The real implementation is
-// RealDiskInterface.
-type DiskInterface interface {
+// All the disk accesses done by the parser and the builder go through this
+// interface, so builds can run against a custom file system, e.g. an overlay
+// or a remote file system. Paths are relative to the build directory and use
+// forward slashes.
+//
+// Implementations must be safe for concurrent use: the parser reads the
+// subninja files concurrently and the depfiles are loaded by worker
+// goroutines.
+//
+// RealDiskInterface is the implementation using the OS. VirtualFileSystem is
+// an in-memory implementation for tests.
+type FileSystem interface {
 	FileReader
 	// Stat stat()'s a file, returning the mtime, or 0 if missing and -1 on
 	// other errors.
 	Stat(path string) (TimeStamp, error)
 
-	// MakeDir creates a directory, returning false on failure.
+	// MakeDir creates a directory. The parent directory is expected to exist.
 	MakeDir(path string) error
 
-	// WriteFile creates a file, with the specified name and contents
+	// WriteFile creates a file, with the specified name and contents.
 	WriteFile(path, contents string) error
 
 	// RemoveFile removes the file named path.
@@ -60,7 +69,52 @@ type DiskInterface interface {
 	RemoveFile(path string) error
 }
 
-type dirCache map[string]TimeStamp
+// DiskInterface is the former name of FileSystem.
+//
+// Deprecated: use FileSystem.
+type DiskInterface = FileSystem
+
+// FileSizer is implemented by the FileSystem that can return the size of a
+// file along with its mtime.
+type FileSizer interface {
+	// StatSize is like Stat and also returns the size of the file, 0 if it is
+	// missing.
+	StatSize(path string) (TimeStamp, int64, error)
+}
+
+// StatSize returns the mtime and the size of the file at path. The size is -1
+// if fs doesn't implement FileSizer.
+func StatSize(fs FileSystem, path string) (TimeStamp, int64, error) {
+	if s, ok := fs.(FileSizer); ok {
+		return s.StatSize(path)
+	}
+	mtime, err := fs.Stat(path)
+	return mtime, -1, err
+}
+
+// uncachedStater is implemented by the FileSystem that can cache stat
+// information.
+type uncachedStater interface {
+	// statUncached is like Stat but never uses the cache.
+	statUncached(path string) (TimeStamp, error)
+}
+
+// statUncached returns the mtime of the file at path, bypassing the stat cache
+// of fs if it has one.
+func statUncached(fs FileSystem, path string) (TimeStamp, error) {
+	if s, ok := fs.(uncachedStater); ok {
+		return s.statUncached(path)
+	}
+	return fs.Stat(path)
+}
+
+// fileStat is the information cached about a file.
+type fileStat struct {
+	mtime TimeStamp
+	size  int64
+}
+
+type dirCache map[string]fileStat
 type cache map[string]dirCache
 
 func dirName(path string) string {
@@ -80,20 +134,20 @@ func dirName(path string) string {
 	*/
 }
 
-func statSingleFile(path string) (TimeStamp, error) {
+func statSingleFile(path string) (TimeStamp, int64, error) {
 	s, err := os.Stat(path)
 	if err != nil {
 		// See TestDiskInterfaceTest_StatMissingFile for rationale for ENOTDIR
 		// check.
 		if os.IsNotExist(err) || errors.Unwrap(err) == syscall.ENOTDIR {
-			return 0, nil
+			return 0, 0, nil
 		}
-		return -1, err
+		return -1, 0, err
 	}
-	return TimeStamp(s.ModTime().UnixMicro()), nil
+	return TimeStamp(s.ModTime().UnixMicro()), s.Size(), nil
 }
 
-func statAllFilesInDir(dir string, stamps map[string]TimeStamp) error {
+func statAllFilesInDir(dir string, stamps dirCache) error {
 	f, err := os.Open(dir)
 	if err != nil {
 		return err
@@ -105,7 +159,7 @@ func statAllFilesInDir(dir string, stamps map[string]TimeStamp) error {
 	}
 	for _, i := range d {
 		if !i.IsDir() {
-			stamps[i.Name()] = TimeStamp(i.ModTime().UnixMicro())
+			stamps[i.Name()] = fileStat{TimeStamp(i.ModTime().UnixMicro()), i.Size()}
 		}
 	}
 	return f.Close()
@@ -113,7 +167,7 @@ func statAllFilesInDir(dir string, stamps map[string]TimeStamp) error {
 
 // MakeDirs create all the parent directories for path; like mkdir -p
 // `basename path`.
-func MakeDirs(d DiskInterface, path string) error {
+func MakeDirs(d FileSystem, path string) error {
 	dir := dirName(path)
 	if dir == path || dir == "." || dir == "" {
 		return nil // Reached root; assume it's there.
@@ -150,12 +204,18 @@ type RealDiskInterface struct {
 // http://msdn.microsoft.com/en-us/library/windows/desktop/aa365247(v=vs.85).aspx
 const maxPath = 260
 
-// Stat implements DiskInterface.
+// Stat implements FileSystem.
 func (r *RealDiskInterface) Stat(path string) (TimeStamp, error) {
+	mtime, _, err := r.StatSize(path)
+	return mtime, err
+}
+
+// StatSize implements FileSizer.
+func (r *RealDiskInterface) StatSize(path string) (TimeStamp, int64, error) {
 	defer metricRecord("node stat")()
 	if runtime.GOOS == "windows" {
 		if path != "" && path[0] != '\\' && len(path) >= maxPath {
-			return -1, fmt.Errorf("Stat(%s): Filename longer than %d characters", path, maxPath)
+			return -1, 0, fmt.Errorf("Stat(%s): Filename longer than %d characters", path, maxPath)
 		}
 		if !r.useCache {
 			return statSingleFile(path)
@@ -186,25 +246,32 @@ func (r *RealDiskInterface) Stat(path string) (TimeStamp, error) {
 			}
 			if err := statAllFilesInDir(s, ci); err != nil {
 				delete(r.cache, dir)
-				return -1, err
+				return -1, 0, err
 			}
 		}
-		return ci[base], nil
+		f := ci[base]
+		return f.mtime, f.size, nil
 	}
 	return statSingleFile(path)
 }
 
-// WriteFile implements DiskInterface.
+func (r *RealDiskInterface) statUncached(path string) (TimeStamp, error) {
+	defer metricRecord("node stat")()
+	mtime, _, err := statSingleFile(path)
+	return mtime, err
+}
+
+// WriteFile implements FileSystem.
 func (r *RealDiskInterface) WriteFile(path string, contents string) error {
 	return ioutil.WriteFile(path, unsafeByteSlice(contents), 0o666)
 }
 
-// MakeDir implements DiskInterface.
+// MakeDir implements FileSystem.
 func (r *RealDiskInterface) MakeDir(path string) error {
 	return os.Mkdir(path, 0o777)
 }
 
-// ReadFile implements DiskInterface.
+// ReadFile implements FileSystem.
 func (r *RealDiskInterface) ReadFile(path string) ([]byte, error) {
 	c, err := ioutil.ReadFile(path)
 	if err == nil {
@@ -218,11 +285,15 @@ func (r *RealDiskInterface) ReadFile(path string) ([]byte, error) {
 	return nil, err
 }
 
-// RemoveFile implements DiskInterface.
+// RemoveFile implements FileSystem.
 func (r *RealDiskInterface) RemoveFile(path string) error {
 	return os.Remove(path)
 }
 
+func (r *RealDiskInterface) statCacheEnabled() bool {
+	return r.useCache
+}
+
 // AllowStatCache sets whether stat information can be cached.
 //
 // Only has an effect on Windows.
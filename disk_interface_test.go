@@ -58,6 +58,32 @@ func TestDiskInterfaceTest_StatMissingFile(t *testing.T) {
 	}
 }
 
+func TestDiskInterfaceTest_StatSize(t *testing.T) {
+	disk := DiskInterfaceTest(t)
+	if err := disk.WriteFile("file", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	for _, cache := range []bool{false, true} {
+		disk.AllowStatCache(cache)
+		mtime, size, err := StatSize(&disk, "file")
+		if mtime <= 0 || size != 5 || err != nil {
+			t.Fatal(cache, mtime, size, err)
+		}
+		if mtime, size, err := StatSize(&disk, "nosuchfile"); mtime != 0 || size != 0 || err != nil {
+			t.Fatal(cache, mtime, size, err)
+		}
+	}
+	// The size is unknown when the FileSystem doesn't implement FileSizer.
+	if _, size, err := StatSize(statOnly{&disk}, "file"); size != -1 || err != nil {
+		t.Fatal(size, err)
+	}
+}
+
+// statOnly hides the FileSizer implementation of a FileSystem.
+type statOnly struct {
+	FileSystem
+}
+
 func TestDiskInterfaceTest_StatBadPath(t *testing.T) {
 	disk := DiskInterfaceTest(t)
 	badPath := strings.Repeat("x", 512)
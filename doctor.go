@@ -0,0 +1,273 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DoctorFinding is one problem found by Doctor.
+type DoctorFinding struct {
+	// Check is the name of the check that found the problem.
+	Check string
+	// Message describes the problem.
+	Message string
+	// Remediation describes how to fix the problem.
+	Remediation string
+}
+
+// Doctor verifies the health of a build directory.
+//
+// Each Check* method appends to Findings. The methods are independent and
+// can be called in any order.
+type Doctor struct {
+	state    *State
+	buildLog *BuildLog
+	depsLog  *DepsLog
+	di       FileSystem
+
+	// Findings is the list of problems found so far.
+	Findings []DoctorFinding
+
+	// now is overridden in unit tests.
+	now func() time.Time
+}
+
+// NewDoctor returns an initialized Doctor.
+//
+// buildLog and depsLog are expected to be already loaded; either can be nil.
+func NewDoctor(state *State, buildLog *BuildLog, depsLog *DepsLog, di FileSystem) *Doctor {
+	return &Doctor{
+		state:    state,
+		buildLog: buildLog,
+		depsLog:  depsLog,
+		di:       di,
+		now:      time.Now,
+	}
+}
+
+func (d *Doctor) add(check, remediation, msg string, i ...interface{}) {
+	d.Findings = append(d.Findings, DoctorFinding{
+		Check:       check,
+		Message:     fmt.Sprintf(msg, i...),
+		Remediation: remediation,
+	})
+}
+
+// CheckBuildLogVersion verifies that the build log at path can be loaded
+// without being discarded or upgraded.
+//
+// It must be called before BuildLog.Load(), which deletes logs that are too
+// old. Returns false if the log should not be loaded.
+func (d *Doctor) CheckBuildLogVersion(path string) bool {
+	version, err := readBuildLogVersion(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false
+		}
+		d.add("buildlog", "delete the file; the next build will recreate it", "%s: %s", path, err)
+		return false
+	}
+	if version == 0 {
+		// Empty file.
+		return true
+	}
+	if version < buildLogOldestSupportedVersion {
+		d.add("buildlog", "delete the file; the next build will recreate it", "%s: version %d is too old, oldest supported is %d", path, version, buildLogOldestSupportedVersion)
+		return false
+	}
+	if version > buildLogCurrentVersion {
+		d.add("buildlog", "use a newer nin or delete the file", "%s: version %d is newer than supported version %d", path, version, buildLogCurrentVersion)
+		return false
+	}
+	if version != buildLogCurrentVersion {
+		d.add("buildlog", "run 'nin -t recompact'", "%s: version %d will be upgraded to %d", path, version, buildLogCurrentVersion)
+	}
+	return true
+}
+
+// CheckDepsLogVersion verifies that the deps log at path can be loaded without
+// being discarded.
+//
+// It must be called before DepsLog.Load(), which deletes logs with an invalid
+// header. Returns false if the log should not be loaded.
+func (d *Doctor) CheckDepsLogVersion(path string) bool {
+	version, err := readDepsLogVersion(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false
+		}
+		d.add("depslog", "delete the file; the next build will recreate it", "%s: %s", path, err)
+		return false
+	}
+	if version != depsLogCurrentVersion {
+		d.add("depslog", "delete the file; the next build will recreate it", "%s: version %d is not supported, want %d", path, version, depsLogCurrentVersion)
+		return false
+	}
+	return true
+}
+
+// CheckDanglingDeps reports deps log entries for outputs that are not
+// produced by an edge with a "deps" binding anymore.
+func (d *Doctor) CheckDanglingDeps() {
+	if d.depsLog == nil {
+		return
+	}
+	count := 0
+	first := ""
+	for id, deps := range d.depsLog.Deps {
+		if deps == nil || id >= len(d.depsLog.Nodes) {
+			continue
+		}
+		node := d.depsLog.Nodes[id]
+		if d.depsLog.IsDepsEntryLiveFor(node) {
+			continue
+		}
+		if count == 0 {
+			first = node.Path
+		}
+		count++
+	}
+	if count != 0 {
+		d.add("deps", "run 'nin -t recompact'", "%d dangling deps log entries, e.g. %s", count, first)
+	}
+}
+
+// CheckOrphanOutputs reports files recorded in the build log that still exist
+// on disk but are not produced by any edge in the manifest anymore.
+func (d *Doctor) CheckOrphanOutputs() {
+	if d.buildLog == nil {
+		return
+	}
+	var orphans []string
+	for path := range d.buildLog.Entries {
+		if n := d.state.Paths[path]; n != nil && n.InEdge != nil {
+			continue
+		}
+		mtime, err := d.di.Stat(path)
+		if mtime == -1 {
+			d.add("outputs", "check the file permissions", "%s", err)
+			continue
+		}
+		if mtime > 0 {
+			orphans = append(orphans, path)
+		}
+	}
+	if len(orphans) == 0 {
+		return
+	}
+	sort.Strings(orphans)
+	d.add("outputs", "run 'nin -t cleandead'", "%d files exist but are not produced by the manifest anymore: %s", len(orphans), summarizePaths(orphans))
+}
+
+// CheckClockSkew writes a temporary file in dir and compares its mtime with
+// the system time. It also reports build log entries with mtimes in the
+// future, which cause the outputs to be rebuilt on every build.
+func (d *Doctor) CheckClockSkew(dir string) {
+	const maxSkew = 2 * time.Second
+	path := filepath.Join(dir, ".ninja_doctor")
+	before := d.now()
+	if err := d.di.WriteFile(path, ""); err != nil {
+		d.add("clock", "check the permissions of the build directory", "%s", err)
+		return
+	}
+	mtime, err := d.di.Stat(path)
+	after := d.now()
+	if err2 := d.di.RemoveFile(path); err == nil && err2 != nil {
+		err = err2
+	}
+	if mtime <= 0 {
+		d.add("clock", "check the permissions of the build directory", "failed to stat %s: %v", path, err)
+		return
+	}
+	fileTime := time.UnixMicro(int64(mtime))
+	if skew := fileTime.Sub(after); skew > maxSkew {
+		d.add("clock", "synchronize the clock of the file server and this machine (e.g. NTP)", "file system time is %s ahead of system time", skew.Round(time.Millisecond))
+	} else if skew := before.Sub(fileTime); skew > maxSkew {
+		d.add("clock", "synchronize the clock of the file server and this machine (e.g. NTP)", "file system time is %s behind system time", skew.Round(time.Millisecond))
+	}
+
+	if d.buildLog == nil {
+		return
+	}
+	limit := TimeStamp(after.Add(maxSkew).UnixMicro())
+	var future []string
+	for path, e := range d.buildLog.Entries {
+		if e.mtime > limit {
+			future = append(future, path)
+		}
+	}
+	if len(future) != 0 {
+		sort.Strings(future)
+		d.add("clock", "run 'nin -t restat' once the clock is fixed", "%d build log entries have an mtime in the future: %s", len(future), summarizePaths(future))
+	}
+}
+
+// CheckPaths reports paths in the logs that are not canonical, and nodes
+// whose paths only differ by case, which refer to the same file on case
+// insensitive file systems.
+func (d *Doctor) CheckPaths() {
+	var bad []string
+	if d.buildLog != nil {
+		for path := range d.buildLog.Entries {
+			if CanonicalizePath(path) != path {
+				bad = append(bad, path)
+			}
+		}
+	}
+	if d.depsLog != nil {
+		for _, n := range d.depsLog.Nodes {
+			if n != nil && CanonicalizePath(n.Path) != n.Path {
+				bad = append(bad, n.Path)
+			}
+		}
+	}
+	if len(bad) != 0 {
+		sort.Strings(bad)
+		d.add("paths", "run 'nin -t recompact'", "%d non canonical paths in the logs: %s", len(bad), summarizePaths(bad))
+	}
+
+	lower := make(map[string]string, len(d.state.Paths))
+	var dupes []string
+	for path := range d.state.Paths {
+		l := strings.ToLower(path)
+		if other, ok := lower[l]; ok {
+			if other > path {
+				other, path = path, other
+			}
+			dupes = append(dupes, other+" vs "+path)
+			continue
+		}
+		lower[l] = path
+	}
+	if len(dupes) != 0 {
+		sort.Strings(dupes)
+		d.add("paths", "use consistent casing in the generator", "%d paths only differ by case: %s", len(dupes), summarizePaths(dupes))
+	}
+}
+
+// summarizePaths returns the first few items of a list of paths.
+func summarizePaths(paths []string) string {
+	const max = 3
+	if len(paths) <= max {
+		return strings.Join(paths, ", ")
+	}
+	return strings.Join(paths[:max], ", ") + fmt.Sprintf(" and %d more", len(paths)-max)
+}
@@ -0,0 +1,150 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func checks(findings []DoctorFinding) []string {
+	var out []string
+	for _, f := range findings {
+		out = append(out, f.Check)
+	}
+	return out
+}
+
+func TestDoctor_LogVersions(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, ".ninja_log")
+	depsPath := filepath.Join(dir, ".ninja_deps")
+	state := NewState()
+	fs := NewVirtualFileSystem()
+	d := NewDoctor(&state, nil, nil, &fs)
+
+	// Missing files are fine.
+	if d.CheckBuildLogVersion(logPath) || d.CheckDepsLogVersion(depsPath) {
+		t.Fatal("expected missing logs to not be loaded")
+	}
+	if len(d.Findings) != 0 {
+		t.Fatal(d.Findings)
+	}
+
+	if err := ioutil.WriteFile(logPath, []byte("# ninja log v7\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if !d.CheckBuildLogVersion(logPath) || len(d.Findings) != 0 {
+		t.Fatal(d.Findings)
+	}
+
+	if err := ioutil.WriteFile(logPath, []byte("# ninja log v3\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if d.CheckBuildLogVersion(logPath) {
+		t.Fatal("expected old log to not be loaded")
+	}
+	if err := ioutil.WriteFile(depsPath, []byte("# ninjadeps\n\x01\x00\x00\x00"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if d.CheckDepsLogVersion(depsPath) {
+		t.Fatal("expected old log to not be loaded")
+	}
+	if got := checks(d.Findings); len(got) != 2 || got[0] != "buildlog" || got[1] != "depslog" {
+		t.Fatal(got)
+	}
+}
+
+func TestDoctor_DanglingDeps(t *testing.T) {
+	s := NewStateTestWithBuiltinRules(t)
+	s.AssertParse(&s.state, "rule cc\n  command = cc $in\n  deps = gcc\nbuild out.o: cc in.c\n", ParseManifestOpts{})
+	fs := NewVirtualFileSystem()
+	depsLog := DepsLog{}
+	live := s.state.Paths["out.o"]
+	dead := s.GetNode("gone.o")
+	depsLog.Nodes = []*Node{live, dead}
+	depsLog.Deps = []*Deps{NewDeps(0, 0), NewDeps(0, 0)}
+	d := NewDoctor(&s.state, nil, &depsLog, &fs)
+	d.CheckDanglingDeps()
+	if len(d.Findings) != 1 || d.Findings[0].Message != "1 dangling deps log entries, e.g. gone.o" {
+		t.Fatal(d.Findings)
+	}
+}
+
+func TestDoctor_OrphanOutputs(t *testing.T) {
+	s := NewStateTestWithBuiltinRules(t)
+	s.AssertParse(&s.state, "build out: cat in\n", ParseManifestOpts{})
+	fs := NewVirtualFileSystem()
+	fs.Create("out", "")
+	fs.Create("old", "")
+	buildLog := NewBuildLog()
+	buildLog.Entries["out"] = &LogEntry{output: "out"}
+	buildLog.Entries["old"] = &LogEntry{output: "old"}
+	buildLog.Entries["deleted"] = &LogEntry{output: "deleted"}
+	d := NewDoctor(&s.state, &buildLog, nil, &fs)
+	d.CheckOrphanOutputs()
+	want := "1 files exist but are not produced by the manifest anymore: old"
+	if len(d.Findings) != 1 || d.Findings[0].Message != want {
+		t.Fatal(d.Findings)
+	}
+}
+
+func TestDoctor_ClockSkew(t *testing.T) {
+	state := NewState()
+	fs := NewVirtualFileSystem()
+	buildLog := NewBuildLog()
+	d := NewDoctor(&state, &buildLog, nil, &fs)
+	now := time.UnixMicro(int64(fs.now))
+	d.now = func() time.Time { return now }
+
+	d.CheckClockSkew("build")
+	if len(d.Findings) != 0 {
+		t.Fatal(d.Findings)
+	}
+	if _, ok := fs.files["build/.ninja_doctor"]; ok {
+		t.Fatal("temporary file not removed")
+	}
+
+	now = now.Add(-time.Minute)
+	buildLog.Entries["out"] = &LogEntry{output: "out", mtime: fs.now}
+	d.CheckClockSkew("build")
+	if got := checks(d.Findings); len(got) != 2 || got[0] != "clock" || got[1] != "clock" {
+		t.Fatal(d.Findings)
+	}
+	if d.Findings[0].Message != "file system time is 1m0s ahead of system time" {
+		t.Fatal(d.Findings[0].Message)
+	}
+}
+
+func TestDoctor_Paths(t *testing.T) {
+	s := NewStateTestWithBuiltinRules(t)
+	s.AssertParse(&s.state, "build Out: cat in\nbuild out: cat in\n", ParseManifestOpts{})
+	fs := NewVirtualFileSystem()
+	buildLog := NewBuildLog()
+	buildLog.Entries["./out"] = &LogEntry{output: "./out"}
+	d := NewDoctor(&s.state, &buildLog, nil, &fs)
+	d.CheckPaths()
+	if len(d.Findings) != 2 {
+		t.Fatal(d.Findings)
+	}
+	if d.Findings[0].Message != "1 non canonical paths in the logs: ./out" {
+		t.Fatal(d.Findings[0].Message)
+	}
+	if d.Findings[1].Message != "1 paths only differ by case: Out vs out" {
+		t.Fatal(d.Findings[1].Message)
+	}
+}
@@ -54,11 +54,11 @@ type DyndepFile map[*Edge]*Dyndeps
 // referenced via the "dyndep" attribute in build files.
 type DyndepLoader struct {
 	state *State
-	di    DiskInterface
+	di    FileSystem
 }
 
 // NewDyndepLoader returns an initialized DyndepLoader.
-func NewDyndepLoader(state *State, di DiskInterface) DyndepLoader {
+func NewDyndepLoader(state *State, di FileSystem) DyndepLoader {
 	return DyndepLoader{
 		state: state,
 		di:    di,
@@ -112,6 +112,8 @@ func (d *DyndepLoader) LoadDyndeps(node *Node, ddf DyndepFile) error {
 }
 
 func (d *DyndepLoader) updateEdge(edge *Edge, dyndeps *Dyndeps) error {
+	edge.invalidateBindings()
+
 	// Add dyndep-discovered bindings to the edge.
 	// We know the edge already has its own binding
 	// scope because it has a "dyndep" binding.
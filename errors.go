@@ -0,0 +1,160 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrInterrupted is returned by Builder.Build when the build was interrupted,
+// e.g. by the user pressing Ctrl-C.
+var ErrInterrupted = errors.New("interrupted by user")
+
+// ErrLogDiscarded is returned by BuildLog.Load and DepsLog.Load when the log
+// was invalid and was partially or completely discarded. It is not fatal, the
+// build can proceed and will rebuild the outputs as needed.
+type ErrLogDiscarded struct {
+	// Reason describes why the log was discarded.
+	Reason string
+}
+
+func (e *ErrLogDiscarded) Error() string {
+	return e.Reason
+}
+
+// Is returns true if target is an *ErrLogDiscarded.
+func (e *ErrLogDiscarded) Is(target error) bool {
+	_, ok := target.(*ErrLogDiscarded)
+	return ok
+}
+
+// ErrMissingInput is returned when a dirty input doesn't exist and no edge
+// generates it.
+//
+// Use errors.As to retrieve the details, or errors.Is(err,
+// &ErrMissingInput{}) to only check the kind of error.
+type ErrMissingInput struct {
+	// Path is the missing input.
+	Path string
+	// Dependent is the path of the node needing the input, if known.
+	Dependent string
+	// Skipped is the condition of the "skip" binding that removed the edge
+	// generating the input, if any.
+	Skipped string
+}
+
+func (e *ErrMissingInput) Error() string {
+	// TODO(maruel): Use %q for real quoting.
+	if e.Skipped != "" {
+		if e.Dependent != "" {
+			return fmt.Sprintf("'%s', needed by '%s', missing and its edge is skipped (skip = %s)", e.Path, e.Dependent, e.Skipped)
+		}
+		return fmt.Sprintf("'%s' missing and its edge is skipped (skip = %s)", e.Path, e.Skipped)
+	}
+	if e.Dependent != "" {
+		return fmt.Sprintf("'%s', needed by '%s', missing and no known rule to make it", e.Path, e.Dependent)
+	}
+	return fmt.Sprintf("'%s' missing and no known rule to make it", e.Path)
+}
+
+// Is returns true if target is an *ErrMissingInput.
+func (e *ErrMissingInput) Is(target error) bool {
+	_, ok := target.(*ErrMissingInput)
+	return ok
+}
+
+// ErrCycle is returned when the build graph has a dependency cycle.
+//
+// Use errors.As to retrieve the details, or errors.Is(err, &ErrCycle{}) to
+// only check the kind of error.
+type ErrCycle struct {
+	// Path is the nodes forming the cycle. The first and the last items are
+	// the same node.
+	Path []string
+	// PhonyCycle is true when the cycle is a phony edge referencing itself,
+	// which is only an error with -w phonycycle=err.
+	PhonyCycle bool
+}
+
+func (e *ErrCycle) Error() string {
+	s := "dependency cycle: " + strings.Join(e.Path, " -> ")
+	if e.PhonyCycle {
+		s += " [-w phonycycle=err]"
+	}
+	return s
+}
+
+// Is returns true if target is an *ErrCycle.
+func (e *ErrCycle) Is(target error) bool {
+	_, ok := target.(*ErrCycle)
+	return ok
+}
+
+// ErrUnknownTarget is returned when a target requested by the user is not in
+// the build graph.
+//
+// Use errors.As to retrieve the details, or errors.Is(err,
+// &ErrUnknownTarget{}) to only check the kind of error.
+type ErrUnknownTarget struct {
+	// Target is the path as specified by the user.
+	Target string
+	// Suggestion is what the user likely meant, if anything.
+	Suggestion string
+	// Alternatives are the other plausible targets, best first.
+	Alternatives []string
+}
+
+func (e *ErrUnknownTarget) Error() string {
+	// TODO(maruel): Use %q for real quoting.
+	if e.Suggestion != "" {
+		return fmt.Sprintf("unknown target '%s', did you mean %s?", e.Target, SuggestionText(append([]string{e.Suggestion}, e.Alternatives...)))
+	}
+	return fmt.Sprintf("unknown target '%s'", e.Target)
+}
+
+// Is returns true if target is an *ErrUnknownTarget.
+func (e *ErrUnknownTarget) Is(target error) bool {
+	_, ok := target.(*ErrUnknownTarget)
+	return ok
+}
+
+// ErrManifestChanged is returned by Builder.Build when a file watched with
+// Builder.WatchManifest changed or disappeared during the build and
+// BuildConfig.ManifestChange is not ManifestChangeIgnore. The manifest should
+// be reloaded before building again.
+//
+// Use errors.As to retrieve the details, or errors.Is(err,
+// &ErrManifestChanged{}) to only check the kind of error.
+type ErrManifestChanged struct {
+	// Path is the file that changed.
+	Path string
+	// Removed is true if the file disappeared.
+	Removed bool
+}
+
+func (e *ErrManifestChanged) Error() string {
+	if e.Removed {
+		return fmt.Sprintf("'%s' was removed during the build", e.Path)
+	}
+	return fmt.Sprintf("'%s' changed during the build", e.Path)
+}
+
+// Is returns true if target is an *ErrManifestChanged.
+func (e *ErrManifestChanged) Is(target error) bool {
+	_, ok := target.(*ErrManifestChanged)
+	return ok
+}
@@ -0,0 +1,86 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestErrors_Cycle(t *testing.T) {
+	g := NewGraphTest(t)
+	g.AssertParse(&g.state, "build a: cat c\nbuild c: cat a\n", ParseManifestOpts{})
+	_, err := g.scan.RecomputeDirty(g.GetNode("a"))
+	var cycle *ErrCycle
+	if !errors.As(err, &cycle) {
+		t.Fatalf("%T: %v", err, err)
+	}
+	if diff := cmp.Diff([]string{"a", "c", "a"}, cycle.Path); diff != "" {
+		t.Fatal(diff)
+	}
+	if !errors.Is(fmt.Errorf("wrapped: %w", err), &ErrCycle{}) {
+		t.Fatal("expected errors.Is to match")
+	}
+	if errors.Is(err, &ErrMissingInput{}) {
+		t.Fatal("unexpected match")
+	}
+}
+
+func TestErrors_MissingInput(t *testing.T) {
+	b := NewBuildTest(t)
+	b.Dirty("in1")
+	_, err := b.builder.addTargetName("cat1")
+	var missing *ErrMissingInput
+	if !errors.As(err, &missing) {
+		t.Fatalf("%T: %v", err, err)
+	}
+	if diff := cmp.Diff(&ErrMissingInput{Path: "in1", Dependent: "cat1"}, missing); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestErrors_UnknownTarget(t *testing.T) {
+	state := NewState()
+	err := state.addDefault("foo")
+	if !errors.Is(err, &ErrUnknownTarget{}) {
+		t.Fatalf("%T: %v", err, err)
+	}
+	err = &ErrUnknownTarget{Target: "fo", Suggestion: "foo"}
+	if s := err.Error(); s != "unknown target 'fo', did you mean 'foo'?" {
+		t.Fatal(s)
+	}
+	err = &ErrUnknownTarget{Target: "fo", Suggestion: "foo", Alternatives: []string{"fob", "for"}}
+	if s := err.Error(); s != "unknown target 'fo', did you mean 'foo', 'fob' or 'for'?" {
+		t.Fatal(s)
+	}
+}
+
+func TestErrors_LogNotFound(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "missing")
+	b := NewBuildLog()
+	if err := b.Load(p); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	state := NewState()
+	d := DepsLog{}
+	if err := d.Load(p, &state); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal(err)
+	}
+}
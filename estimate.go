@@ -0,0 +1,139 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// WorkEstimate is the work planned by a Builder, as known before the first
+// command is started.
+type WorkEstimate struct {
+	// Edges is the number of edges with a command to run.
+	Edges int
+	// CacheEligible is the number of Edges whose result may come from a cache
+	// instead of running the command: the test edges and the commands run
+	// through ccache or sccache.
+	CacheEligible int
+	// Known is the number of Edges with a duration in the build log. The
+	// other ones are assumed to take the average duration of the known ones.
+	Known int
+	// CPU is the sum of the predicted durations of the Edges.
+	CPU time.Duration
+	// Wall is the predicted duration of the build, the longest of the
+	// critical path and CPU divided by the parallelism.
+	Wall time.Duration
+}
+
+// Estimate returns the work planned so far.
+//
+// The targets passed to QueueTarget are not scanned yet so they are not
+// accounted for.
+func (b *Builder) Estimate() WorkEstimate {
+	var w WorkEstimate
+	durations := map[*Edge]time.Duration{}
+	var unknown []*Edge
+	for e, want := range b.plan.want {
+		if want == WantNothing || e.Rule == PhonyRule {
+			continue
+		}
+		w.Edges++
+		if IsTestEdge(e) || usesCompilerCache(e.EvaluateCommand(false)) {
+			w.CacheEligible++
+		}
+		if d, ok := b.previousDuration(e); ok {
+			w.Known++
+			w.CPU += d
+			durations[e] = d
+		} else {
+			unknown = append(unknown, e)
+		}
+	}
+	if w.Known != 0 {
+		avg := w.CPU / time.Duration(w.Known)
+		for _, e := range unknown {
+			durations[e] = avg
+		}
+		w.CPU += avg * time.Duration(len(unknown))
+	}
+
+	// The critical path only goes through the edges to run.
+	path := map[*Edge]time.Duration{}
+	var longest func(e *Edge) time.Duration
+	longest = func(e *Edge) time.Duration {
+		if d, ok := path[e]; ok {
+			return d
+		}
+		// Break cycles, if any.
+		path[e] = 0
+		var deps time.Duration
+		for _, in := range e.Inputs {
+			if in.InEdge == nil {
+				continue
+			}
+			if want, ok := b.plan.want[in.InEdge]; !ok || want == WantNothing {
+				continue
+			}
+			if d := longest(in.InEdge); d > deps {
+				deps = d
+			}
+		}
+		d := deps + durations[e]
+		path[e] = d
+		return d
+	}
+	for e, want := range b.plan.want {
+		if want == WantNothing {
+			continue
+		}
+		if d := longest(e); d > w.Wall {
+			w.Wall = d
+		}
+	}
+	if p := b.config.Parallelism; p > 0 {
+		if d := w.CPU / time.Duration(p); d > w.Wall {
+			w.Wall = d
+		}
+	}
+	return w
+}
+
+// previousDuration returns the duration of the command of e in the last
+// build that ran it.
+func (b *Builder) previousDuration(e *Edge) (time.Duration, bool) {
+	if b.scan.buildLog == nil {
+		return 0, false
+	}
+	for _, o := range e.Outputs {
+		if entry := b.scan.buildLog.Entries[o.Path]; entry != nil {
+			return time.Duration(entry.endTime-entry.startTime) * time.Millisecond, true
+		}
+	}
+	return 0, false
+}
+
+// usesCompilerCache returns true if the command is run through ccache or
+// sccache.
+func usesCompilerCache(command string) bool {
+	for _, f := range strings.Fields(command) {
+		name := strings.TrimSuffix(filepath.Base(f), ".exe")
+		if name == "ccache" || name == "sccache" {
+			return true
+		}
+	}
+	return false
+}
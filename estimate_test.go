@@ -0,0 +1,49 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBuilderEstimate(t *testing.T) {
+	b := NewBuildTest(t)
+	b.AssertParse(&b.state, "rule cc\n  command = ccache cc -c $in -o $out\nbuild a.o: cc a.c\nbuild b.o: cc b.c\nbuild out: cat a.o b.o\nbuild all: phony out\n", ParseManifestOpts{})
+	b.fs.Create("a.c", "")
+	b.fs.Create("b.c", "")
+	log := NewBuildLog()
+	log.Entries["a.o"] = &LogEntry{output: "a.o", startTime: 0, endTime: 4000}
+	log.Entries["b.o"] = &LogEntry{output: "b.o", startTime: 1000, endTime: 3000}
+	b.config.Parallelism = 4
+	builder := NewBuilder(&b.state, &b.config, &log, nil, &b.fs, b.status, 0)
+	if _, err := builder.AddTarget(b.GetNode("all")); err != nil {
+		t.Fatal(err)
+	}
+
+	got := builder.Estimate()
+	// out was never built, it is assumed to take the average of 3s.
+	want := WorkEstimate{Edges: 3, CacheEligible: 2, Known: 2, CPU: 9 * time.Second, Wall: 7 * time.Second}
+	if got != want {
+		t.Fatalf("%+v", got)
+	}
+
+	// With a single job, the edges run one after the other.
+	b.config.Parallelism = 1
+	want.Wall = 9 * time.Second
+	if got := builder.Estimate(); got != want {
+		t.Fatalf("%+v", got)
+	}
+}
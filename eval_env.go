@@ -17,6 +17,7 @@ package nin
 import (
 	"fmt"
 	"sort"
+	"strings"
 )
 
 // Env is an interface for a scope for variable (e.g. "$foo") lookups.
@@ -141,7 +142,25 @@ func IsReservedBinding(v string) bool {
 		v == "restat" ||
 		v == "rspfile" ||
 		v == "rspfile_content" ||
-		v == "msvc_deps_prefix"
+		v == "rspfile_auto" ||
+		v == "msvc_deps_prefix" ||
+		v == "worker" ||
+		v == "batch" ||
+		v == "remoteable" ||
+		v == "mem" ||
+		v == "toolchain" ||
+		v == "scan" ||
+		v == "test" ||
+		v == "cwd" ||
+		v == "sort_inputs" ||
+		v == "skip" ||
+		strings.HasPrefix(v, MetaPrefix)
+}
+
+// isNinBinding returns true if the binding name is a nin specific extension
+// that ninja doesn't support.
+func isNinBinding(v string) bool {
+	return v == "worker" || v == "batch" || v == "remoteable" || v == "mem" || v == "toolchain" || v == "scan" || v == "rspfile_auto" || v == "test" || v == "cwd" || v == "sort_inputs" || v == "skip" || strings.HasPrefix(v, MetaPrefix)
 }
 
 // Rule is an invocable build command and associated metadata (description,
@@ -149,6 +168,9 @@ func IsReservedBinding(v string) bool {
 type Rule struct {
 	Name     string
 	Bindings map[string]*EvalString
+	// Filename is the manifest file that defined this rule. It is empty for
+	// builtin rules.
+	Filename string
 }
 
 // NewRule returns an initialized Rule.
@@ -184,6 +206,12 @@ type BindingEnv struct {
 	Bindings map[string]string
 	Rules    map[string]*Rule
 	Parent   *BindingEnv
+	// Filename is the manifest file that created this scope, i.e. the main
+	// manifest or a subninja. It is empty for the environment of an edge.
+	Filename string
+	// Pools are the pools declared in this scope. It is nil until a pool is
+	// declared. See Scope for the semantics.
+	Pools map[string]*Pool
 }
 
 // NewBindingEnv returns an initialized BindingEnv.
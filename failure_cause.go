@@ -0,0 +1,95 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"path"
+	"strings"
+)
+
+// With -k, an edge may fail because an earlier failed edge didn't generate
+// one of its inputs, e.g. a compile failing on a missing generated header
+// that is not declared as an input. Reported independently, the second
+// failure hides the first one, which is the one to fix. So the plan tracks
+// the failed edges and, for each new failure, the earlier failed edge whose
+// output it needed.
+
+// edgeFailed records the failure of edge, whose command printed output, and
+// returns the earlier failed edge that likely caused it, or nil.
+func (p *plan) edgeFailed(edge *Edge, output string) *Edge {
+	cause := failureCause(p.failed, edge, output)
+	p.failed = append(p.failed, edge)
+	return cause
+}
+
+// failureCause returns the first edge of failed whose outputs are inputs of
+// edge or are mentioned in its output, or nil.
+//
+// The full paths are looked up first, then the base names, since the
+// compilers print the includes as written in the source.
+func failureCause(failed []*Edge, edge *Edge, output string) *Edge {
+	if len(failed) == 0 {
+		return nil
+	}
+	for _, f := range failed {
+		for _, o := range f.Outputs {
+			for _, i := range edge.Inputs {
+				if i == o {
+					return f
+				}
+			}
+			if output == "" {
+				continue
+			}
+			if mentionsPath(output, o.Path) || mentionsPath(output, rebasePath(edge.Cwd(), o.Path)) {
+				return f
+			}
+		}
+	}
+	if output == "" {
+		return nil
+	}
+	for _, f := range failed {
+		for _, o := range f.Outputs {
+			if b := path.Base(o.Path); b != o.Path && mentionsPath(output, b) {
+				return f
+			}
+		}
+	}
+	return nil
+}
+
+// mentionsPath returns true if p is in s as a whole path, or as the end of a
+// longer one, e.g. "gen/a.h" in "/src/out/gen/a.h: No such file" but not in
+// "gen/a.hpp".
+func mentionsPath(s, p string) bool {
+	for i := 0; ; {
+		j := strings.Index(s[i:], p)
+		if j == -1 {
+			return false
+		}
+		start, end := i+j, i+j+len(p)
+		if start == 0 || !isPathChar(s[start-1]) {
+			// A trailing dot ends a sentence.
+			if end < len(s) && s[end] == '.' {
+				end++
+			}
+			if end == len(s) || (!isPathChar(s[end]) && s[end] != '/') {
+				return true
+			}
+		}
+		i = start + 1
+	}
+}
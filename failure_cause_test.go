@@ -0,0 +1,76 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMentionsPath(t *testing.T) {
+	data := []struct {
+		s    string
+		p    string
+		want bool
+	}{
+		{"gen/a.h: No such file or directory", "gen/a.h", true},
+		{"fatal error: '/src/out/gen/a.h' file not found", "gen/a.h", true},
+		{"cannot open gen/a.h.", "gen/a.h", true},
+		{"gen/a.hpp: No such file or directory", "gen/a.h", false},
+		{"xgen/a.h: No such file or directory", "gen/a.h", false},
+		{"gen/a.h.in: No such file or directory", "gen/a.h", false},
+		{"gen/a.h/b: No such file or directory", "gen/a.h", false},
+		{"a.hpp and then a.h", "a.h", true},
+	}
+	for i, l := range data {
+		if got := mentionsPath(l.s, l.p); got != l.want {
+			t.Errorf("#%d: mentionsPath(%q, %q) = %t", i, l.s, l.p, got)
+		}
+	}
+}
+
+func TestBuildTest_FailureCause(t *testing.T) {
+	b := NewBuildTest(t)
+	b.AssertParse(&b.state, "rule fail\n  command = fail\nbuild gen/proto.h: fail\nbuild gen/foo.h: fail\n  fail_output = protoc: gen/proto.h: No such file\nbuild foo.o: fail\n  fail_output = foo.c:1:10: fatal error: foo.h: No such file or directory\nbuild bar.o: fail\n  fail_output = bar.c:1:1: error: expected ';'\nbuild all: phony gen/proto.h gen/foo.h foo.o bar.o\n", ParseManifestOpts{})
+	b.config.FailuresAllowed = 10
+	failures := &FailureSummary{}
+	b.builder.Hooks.AfterEdge = func(result *Result, startTimeMillis, endTimeMillis int32) {
+		failures.Record(result)
+	}
+	if _, err := b.builder.addTargetName("all"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.builder.Build(); err == nil {
+		t.Fatal("expected failure")
+	}
+	causes := map[string][]string{}
+	for _, f := range failures.Failures {
+		var chain []string
+		for _, e := range failures.Chain(f) {
+			chain = append(chain, e.Outputs[0].Path)
+		}
+		causes[f.Edge.Outputs[0].Path] = chain
+	}
+	want := map[string][]string{
+		"gen/proto.h": nil,
+		"gen/foo.h":   {"gen/proto.h"},
+		"foo.o":       {"gen/foo.h", "gen/proto.h"},
+		"bar.o":       nil,
+	}
+	if diff := cmp.Diff(want, causes); diff != "" {
+		t.Fatal(diff)
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// FailedEdge is an edge whose command failed.
+type FailedEdge struct {
+	Edge     *Edge
+	ExitCode ExitStatus
+	Output   string
+	// Cause is the earlier failed edge that likely caused this failure, if
+	// any. See Result.Cause.
+	Cause *Edge
+}
+
+// FailureSummary collects the failed edges of a build so they can be
+// summarized once the build is done, instead of being lost in the log when
+// many edges are allowed to fail with -k.
+//
+// Call Record from BuilderHooks.AfterEdge.
+type FailureSummary struct {
+	Failures []FailedEdge
+	// Redactor masks the secrets in the commands written by WriteLogs.
+	Redactor *Redactor
+
+	// succeeded are the first outputs of the edges that succeeded.
+	succeeded map[string]struct{}
+}
+
+// Record records the result of an edge.
+func (f *FailureSummary) Record(result *Result) {
+	if result.ExitCode != ExitSuccess {
+		f.Failures = append(f.Failures, FailedEdge{Edge: result.Edge, ExitCode: result.ExitCode, Output: result.Output, Cause: result.Cause})
+	} else if len(result.Edge.Outputs) != 0 {
+		if f.succeeded == nil {
+			f.succeeded = map[string]struct{}{}
+		}
+		f.succeeded[result.Edge.Outputs[0].Path] = struct{}{}
+	}
+}
+
+// Chain returns the failed edges that caused the failure of e, from the
+// direct cause to the root cause, e.g. [gen_header, protoc] when e failed
+// because gen_header failed because protoc failed.
+func (f *FailureSummary) Chain(e FailedEdge) []*Edge {
+	var out []*Edge
+	seen := map[*Edge]struct{}{e.Edge: {}}
+	for cause := e.Cause; cause != nil; {
+		if _, ok := seen[cause]; ok {
+			break
+		}
+		seen[cause] = struct{}{}
+		out = append(out, cause)
+		next := cause
+		cause = nil
+		for _, x := range f.Failures {
+			if x.Edge == next {
+				cause = x.Cause
+				break
+			}
+		}
+	}
+	return out
+}
+
+// Grouped returns the failures grouped by identical output, in the order of
+// the first failure of each group.
+//
+// Compilers often report the same error for many edges, e.g. when it is in a
+// header included by all of them.
+func (f *FailureSummary) Grouped() [][]FailedEdge {
+	var out [][]FailedEdge
+	index := map[string]int{}
+	for _, e := range f.Failures {
+		if i, ok := index[e.Output]; ok && e.Output != "" {
+			out[i] = append(out[i], e)
+			continue
+		}
+		index[e.Output] = len(out)
+		out = append(out, []FailedEdge{e})
+	}
+	return out
+}
+
+// SaveTargets updates the list of failed edges in path, as the first output
+// of each edge, one per line, so they can be built again directly.
+//
+// The edges that failed are added and the ones that succeeded are removed.
+// The edges not built, e.g. because the build stopped at the first failure,
+// are kept. The file is removed once empty.
+func (f *FailureSummary) SaveTargets(path string) error {
+	var targets []string
+	seen := map[string]struct{}{}
+	add := func(t string) {
+		if _, ok := seen[t]; !ok {
+			seen[t] = struct{}{}
+			targets = append(targets, t)
+		}
+	}
+	if c, err := ioutil.ReadFile(path); err == nil {
+		for _, l := range strings.Split(string(c), "\n") {
+			if l != "" && l[0] != '#' {
+				if _, ok := f.succeeded[l]; !ok {
+					add(l)
+				}
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	for _, e := range f.Failures {
+		if len(e.Edge.Outputs) != 0 {
+			add(e.Edge.Outputs[0].Path)
+		}
+	}
+	if len(targets) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return ioutil.WriteFile(path, []byte("# nin failed edges\n"+strings.Join(targets, "\n")+"\n"), 0o666)
+}
+
+// WriteLogs writes the full output of each failed edge in dir, one file per
+// edge named after its first output. It returns the files written, in the
+// order of the failures.
+func (f *FailureSummary) WriteLogs(dir string) ([]string, error) {
+	if err := os.MkdirAll(dir, 0o777); err != nil {
+		return nil, err
+	}
+	out := make([]string, 0, len(f.Failures))
+	seen := map[string]struct{}{}
+	for _, e := range f.Failures {
+		name := "edge"
+		if len(e.Edge.Outputs) != 0 {
+			name = strings.NewReplacer("/", "_", "\\", "_", ":", "_").Replace(e.Edge.Outputs[0].Path)
+		}
+		p := filepath.Join(dir, name+".log")
+		for i := 2; ; i++ {
+			if _, ok := seen[p]; !ok {
+				break
+			}
+			p = filepath.Join(dir, name+"."+strconv.Itoa(i)+".log")
+		}
+		seen[p] = struct{}{}
+		if err := ioutil.WriteFile(p, []byte(f.Redactor.Redact(e.Edge.EvaluateCommand(false))+"\n\n"+f.Redactor.Redact(e.Output)), 0o666); err != nil {
+			return out, err
+		}
+		out = append(out, p)
+	}
+	return out, nil
+}
@@ -0,0 +1,87 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestFailureSummary(t *testing.T) {
+	s := NewStateTestWithBuiltinRules(t)
+	s.AssertParse(&s.state, "build out/a: cat in\nbuild out/b: cat in\nbuild c: cat in\nbuild d: cat in\n", ParseManifestOpts{})
+	f := FailureSummary{}
+	f.Record(&Result{Edge: s.state.Edges[0], ExitCode: ExitFailure, Output: "in.h:1: error\n"})
+	f.Record(&Result{Edge: s.state.Edges[1], ExitCode: ExitFailure, Output: "other\n"})
+	f.Record(&Result{Edge: s.state.Edges[2], ExitCode: ExitFailure, Output: "in.h:1: error\n"})
+	f.Record(&Result{Edge: s.state.Edges[3], ExitCode: ExitSuccess, Output: "warning\n"})
+
+	var got [][]string
+	for _, g := range f.Grouped() {
+		var paths []string
+		for _, e := range g {
+			paths = append(paths, e.Edge.Outputs[0].Path)
+		}
+		got = append(got, paths)
+	}
+	want := [][]string{{"out/a", "c"}, {"out/b"}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatal(diff)
+	}
+
+	dir := filepath.Join(CreateTempDirAndEnter(t), "logs")
+	if err := f.SaveTargets("failed"); err != nil {
+		t.Fatal(err)
+	}
+	if c, err := ioutil.ReadFile("failed"); err != nil || string(c) != "# nin failed edges\nout/a\nout/b\nc\n" {
+		t.Fatal(string(c), err)
+	}
+	// out/a succeeded, c was not built.
+	f2 := FailureSummary{}
+	f2.Record(&Result{Edge: s.state.Edges[0], ExitCode: ExitSuccess})
+	f2.Record(&Result{Edge: s.state.Edges[3], ExitCode: ExitFailure})
+	if err := f2.SaveTargets("failed"); err != nil {
+		t.Fatal(err)
+	}
+	if c, err := ioutil.ReadFile("failed"); err != nil || string(c) != "# nin failed edges\nout/b\nc\nd\n" {
+		t.Fatal(string(c), err)
+	}
+	f3 := FailureSummary{}
+	for _, e := range s.state.Edges {
+		f3.Record(&Result{Edge: e, ExitCode: ExitSuccess})
+	}
+	if err := f3.SaveTargets("failed"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat("failed"); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+
+	files, err := f.WriteLogs(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantFiles := []string{filepath.Join(dir, "out_a.log"), filepath.Join(dir, "out_b.log"), filepath.Join(dir, "c.log")}
+	if diff := cmp.Diff(wantFiles, files); diff != "" {
+		t.Fatal(diff)
+	}
+	if c, err := ioutil.ReadFile(files[0]); err != nil || string(c) != "cat in > out/a\n\nin.h:1: error\n" {
+		t.Fatal(string(c), err)
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const runRecordSignature = "# nin run v1\n"
+
+// RunEdge is the outcome of an edge in a build.
+type RunEdge struct {
+	// Output is the first output of the edge.
+	Output   string
+	Duration time.Duration
+	ExitCode ExitStatus
+	// CommandHash and InputsHash identify the command and the mtimes of the
+	// inputs, so a change in the outcome of an edge can be told apart from a
+	// change of what it was asked to do.
+	CommandHash [2]uint64
+	InputsHash  [2]uint64
+}
+
+// RunRecord records the outcome of every edge that ran in a build.
+//
+// Contrary to the build log, it keeps the failed edges. Archiving the records
+// of the last builds with ArchiveBuild lets FlakinessReport find the flaky
+// edges.
+//
+// Call Record from BuilderHooks.AfterEdge.
+type RunRecord struct {
+	Edges []RunEdge
+}
+
+// Record records the result of an edge. The edges that were not run, e.g.
+// skipped by a cache, are ignored.
+func (r *RunRecord) Record(result *Result, startTimeMillis, endTimeMillis int32) {
+	e := result.Edge
+	if result.notRun || result.ExitCode == ExitInterrupted || len(e.Outputs) == 0 {
+		return
+	}
+	var b bytes.Buffer
+	for _, n := range e.Inputs[:len(e.Inputs)-int(e.OrderOnlyDeps)] {
+		b.WriteString(n.Path)
+		b.WriteByte(0)
+		b.WriteString(strconv.FormatInt(int64(n.MTime), 10))
+		b.WriteByte(0)
+	}
+	r.Edges = append(r.Edges, RunEdge{
+		Output:      e.Outputs[0].Path,
+		Duration:    time.Duration(endTimeMillis-startTimeMillis) * time.Millisecond,
+		ExitCode:    result.ExitCode,
+		CommandHash: HashCommand128(e.EvaluateCommand(true)),
+		InputsHash:  HashCommand128(b.String()),
+	})
+}
+
+// serialize writes the record in the format read by parseRunRecord.
+func (r *RunRecord) serialize() []byte {
+	var b bytes.Buffer
+	b.WriteString(runRecordSignature)
+	for _, e := range r.Edges {
+		fmt.Fprintf(&b, "%d\t%d\t%016x%016x\t%016x%016x\t%s\n", e.Duration.Milliseconds(), e.ExitCode, e.CommandHash[0], e.CommandHash[1], e.InputsHash[0], e.InputsHash[1], e.Output)
+	}
+	return b.Bytes()
+}
+
+// parseRunRecord parses a record written by serialize. path is only used
+// in the errors.
+func parseRunRecord(path string, rd io.Reader) (*RunRecord, error) {
+	s := bufio.NewScanner(rd)
+	s.Buffer(nil, 1<<20)
+	if !s.Scan() || s.Text()+"\n" != runRecordSignature {
+		return nil, fmt.Errorf("%s: invalid signature", path)
+	}
+	r := &RunRecord{}
+	for lineno := 2; s.Scan(); lineno++ {
+		f := bytes.SplitN(s.Bytes(), []byte{'\t'}, 5)
+		if len(f) != 5 {
+			return nil, fmt.Errorf("%s:%d: expected 5 fields", path, lineno)
+		}
+		ms, err1 := strconv.ParseInt(string(f[0]), 10, 64)
+		code, err2 := strconv.Atoi(string(f[1]))
+		cmd, err3 := parseHash128(f[2])
+		inputs, err4 := parseHash128(f[3])
+		if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+			return nil, fmt.Errorf("%s:%d: invalid entry", path, lineno)
+		}
+		r.Edges = append(r.Edges, RunEdge{
+			Output:      string(f[4]),
+			Duration:    time.Duration(ms) * time.Millisecond,
+			ExitCode:    ExitStatus(code),
+			CommandHash: cmd,
+			InputsHash:  inputs,
+		})
+	}
+	return r, s.Err()
+}
+
+func parseHash128(b []byte) ([2]uint64, error) {
+	if len(b) != 32 {
+		return [2]uint64{}, strconv.ErrSyntax
+	}
+	h, err := strconv.ParseUint(string(b[:16]), 16, 64)
+	if err != nil {
+		return [2]uint64{}, err
+	}
+	l, err := strconv.ParseUint(string(b[16:]), 16, 64)
+	return [2]uint64{h, l}, err
+}
+
+// EdgeStability summarizes the outcomes of an edge across builds.
+type EdgeStability struct {
+	// Output is the first output of the edge.
+	Output string
+	// Runs is the number of builds that ran the edge and Failures how many of
+	// them failed.
+	Runs     int
+	Failures int
+	// Flaps is the number of times the edge succeeded after failing, or the
+	// reverse, while its command and inputs were unchanged.
+	Flaps int
+	// Mean and StdDev are computed over the successful runs with the most
+	// recent command.
+	Mean   time.Duration
+	StdDev time.Duration
+}
+
+// Flaky returns true if the edge had a different outcome with the same
+// command and inputs.
+func (e *EdgeStability) Flaky() bool {
+	return e.Flaps != 0
+}
+
+// Noisy returns true if the duration of the edge varies by more than half of
+// its mean, ignoring the edges too short to be measured reliably.
+func (e *EdgeStability) Noisy() bool {
+	return e.Mean >= 100*time.Millisecond && 2*e.StdDev > e.Mean
+}
+
+// FlakinessReport returns the edges that ran in at least minRuns of the
+// builds recorded in runs, most recent first, as returned by RunRecords.
+//
+// The flaky edges are first, then the ones by decreasing relative duration
+// variance.
+func FlakinessReport(runs []*RunRecord, minRuns int) []EdgeStability {
+	// Iterate from the oldest build.
+	history := map[string][]RunEdge{}
+	for i := len(runs) - 1; i >= 0; i-- {
+		for _, e := range runs[i].Edges {
+			history[e.Output] = append(history[e.Output], e)
+		}
+	}
+	var out []EdgeStability
+	for output, h := range history {
+		if len(h) < minRuns {
+			continue
+		}
+		s := EdgeStability{Output: output, Runs: len(h)}
+		for i, e := range h {
+			if e.ExitCode != ExitSuccess {
+				s.Failures++
+			}
+			if i != 0 {
+				p := h[i-1]
+				if p.CommandHash == e.CommandHash && p.InputsHash == e.InputsHash && (p.ExitCode == ExitSuccess) != (e.ExitCode == ExitSuccess) {
+					s.Flaps++
+				}
+			}
+		}
+		last := h[len(h)-1].CommandHash
+		var sum, sum2 float64
+		n := 0
+		for _, e := range h {
+			if e.CommandHash == last && e.ExitCode == ExitSuccess {
+				d := float64(e.Duration)
+				sum += d
+				sum2 += d * d
+				n++
+			}
+		}
+		if n != 0 {
+			mean := sum / float64(n)
+			s.Mean = time.Duration(mean)
+			if v := sum2/float64(n) - mean*mean; v > 0 {
+				s.StdDev = time.Duration(math.Sqrt(v))
+			}
+		}
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Flaps != out[j].Flaps {
+			return out[i].Flaps > out[j].Flaps
+		}
+		ri, rj := out[i].relStdDev(), out[j].relStdDev()
+		if ri != rj {
+			return ri > rj
+		}
+		return out[i].Output < out[j].Output
+	})
+	return out
+}
+
+func (e *EdgeStability) relStdDev() float64 {
+	if e.Mean == 0 {
+		return 0
+	}
+	return float64(e.StdDev) / float64(e.Mean)
+}
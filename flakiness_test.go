@@ -0,0 +1,111 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRunRecord(t *testing.T) {
+	CreateTempDirAndEnter(t)
+	if err := ioutil.WriteFile("log", []byte("# ninja log v7\n"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		r := &RunRecord{Edges: []RunEdge{{Output: "a", Duration: time.Duration(i) * time.Second, CommandHash: [2]uint64{1, 2}}}}
+		if err := ArchiveBuild("history", "log", 0, r, 3); err != nil {
+			t.Fatal(err)
+		}
+	}
+	builds, err := ReadHistory("history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	runs := RunRecords(builds)
+	var got []time.Duration
+	for _, r := range runs {
+		got = append(got, r.Edges[0].Duration)
+	}
+	// Only the last 3 are kept, the most recent first.
+	if diff := cmp.Diff([]time.Duration{3 * time.Second, 2 * time.Second, time.Second}, got); diff != "" {
+		t.Fatal(diff)
+	}
+	if diff := cmp.Diff(RunEdge{Output: "a", Duration: 3 * time.Second, CommandHash: [2]uint64{1, 2}}, runs[0].Edges[0]); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestBuildTest_RunRecord(t *testing.T) {
+	b := NewBuildTest(t)
+	b.AssertParse(&b.state, "rule fail\n  command = fail\nbuild f1: fail in1\n", ParseManifestOpts{})
+	r := &RunRecord{}
+	b.builder.Hooks.AfterEdge = r.Record
+	b.config.FailuresAllowed = 10
+	for _, target := range []string{"cat1", "f1"} {
+		if _, err := b.builder.addTargetName(target); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.builder.Build(); err == nil {
+		t.Fatal("expected failure")
+	}
+	if len(r.Edges) != 2 || r.Edges[0].Output != "cat1" || r.Edges[0].ExitCode != ExitSuccess || r.Edges[1].Output != "f1" || r.Edges[1].ExitCode != ExitFailure {
+		t.Fatal(r.Edges)
+	}
+	if r.Edges[0].CommandHash != HashCommand128("cat in1 > cat1") {
+		t.Fatal("unexpected command hash")
+	}
+}
+
+func TestFlakinessReport(t *testing.T) {
+	cmd := [2]uint64{1, 1}
+	edge := func(output string, d time.Duration, code ExitStatus, inputs uint64) RunEdge {
+		return RunEdge{Output: output, Duration: d, ExitCode: code, CommandHash: cmd, InputsHash: [2]uint64{inputs}}
+	}
+	// Most recent first.
+	runs := []*RunRecord{
+		{Edges: []RunEdge{edge("flaky", time.Second, ExitSuccess, 1), edge("fixed", time.Second, ExitSuccess, 2), edge("noisy", 3*time.Second, ExitSuccess, 1), edge("stable", time.Second, ExitSuccess, 1)}},
+		{Edges: []RunEdge{edge("flaky", time.Second, ExitFailure, 1), edge("fixed", time.Second, ExitFailure, 1), edge("noisy", 100*time.Millisecond, ExitSuccess, 1), edge("stable", time.Second, ExitSuccess, 1)}},
+		{Edges: []RunEdge{edge("flaky", time.Second, ExitSuccess, 1), edge("noisy", 100*time.Millisecond, ExitSuccess, 1)}},
+	}
+	got := FlakinessReport(runs, 2)
+	var outputs []string
+	for _, e := range got {
+		outputs = append(outputs, e.Output)
+	}
+	if diff := cmp.Diff([]string{"flaky", "noisy", "fixed", "stable"}, outputs); diff != "" {
+		t.Fatal(diff)
+	}
+	if e := got[0]; e.Runs != 3 || e.Failures != 1 || e.Flaps != 2 || !e.Flaky() || e.Mean != time.Second || e.Noisy() {
+		t.Fatalf("%+v", e)
+	}
+	if e := got[1]; e.Flaky() || !e.Noisy() || e.Mean != 1066666666 {
+		t.Fatalf("%+v", e)
+	}
+	// The inputs changed, so the failure was fixed.
+	if e := got[2]; e.Flaky() || e.Failures != 1 || e.Noisy() {
+		t.Fatalf("%+v", e)
+	}
+	if e := got[3]; e.Flaky() || e.Noisy() || e.StdDev != 0 {
+		t.Fatalf("%+v", e)
+	}
+	if got := FlakinessReport(runs, 3); len(got) != 2 {
+		t.Fatal(got)
+	}
+}
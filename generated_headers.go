@@ -0,0 +1,65 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"sort"
+)
+
+// isCompileEdge returns true if the edge compiles source files, which is
+// guessed from the edge declaring its header dependencies.
+func isCompileEdge(e *Edge) bool {
+	return e.Rule != PhonyRule && (e.GetBinding("deps") != "" || e.GetBinding("depfile") != "" || e.GetBinding("scan") != "")
+}
+
+// GeneratedHeaders returns the generated files the compile edges depend on,
+// e.g. headers and protos, sorted by path.
+//
+// These files must exist before the sources can be indexed by an IDE or
+// analyzed by a tool like clang-tidy. The compile edges are the ones with a
+// depfile, deps or scan binding. Their inputs are looked at, including the
+// dependencies recorded in depsLog, which may be nil. The outputs of other
+// compile edges, e.g. precompiled headers, are not included.
+func GeneratedHeaders(state *State, depsLog *DepsLog) []*Node {
+	seen := map[*Node]struct{}{}
+	var out []*Node
+	add := func(n *Node) {
+		in := n.InEdge
+		if in == nil || in.Rule == PhonyRule || isCompileEdge(in) {
+			return
+		}
+		if _, ok := seen[n]; !ok {
+			seen[n] = struct{}{}
+			out = append(out, n)
+		}
+	}
+	for _, e := range state.Edges {
+		if !isCompileEdge(e) {
+			continue
+		}
+		for _, n := range e.Inputs {
+			add(n)
+		}
+		if depsLog != nil && len(e.Outputs) != 0 {
+			if deps := depsLog.GetDeps(e.Outputs[0]); deps != nil {
+				for _, n := range deps.Nodes {
+					add(n)
+				}
+			}
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Path < out[j].Path })
+	return out
+}
@@ -0,0 +1,61 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestGeneratedHeaders(t *testing.T) {
+	s := NewStateTestWithBuiltinRules(t)
+	s.AssertParse(&s.state, "rule cc\n  command = cc $in -o $out\n  depfile = $out.d\n"+
+		"build gen.h: cat gen.in\n"+
+		"build proto.pb.h: cat a.proto\n"+
+		"build dep.h: cat dep.in\n"+
+		"build pch.gch: cc pch.h\n"+
+		"build a.o: cc a.cc | pch.gch || gen.h\n"+
+		"build b.o: cc b.cc\n"+
+		"build lib.a: cat a.o b.o proto.pb.h\n"+
+		"build all: phony lib.a\n", ParseManifestOpts{})
+
+	// Without the deps log.
+	got := []string{}
+	for _, n := range GeneratedHeaders(&s.state, nil) {
+		got = append(got, n.Path)
+	}
+	if diff := cmp.Diff([]string{"gen.h"}, got); diff != "" {
+		t.Fatal(diff)
+	}
+
+	// dep.h was found in the depfile of b.o.
+	log := DepsLog{}
+	if err := log.OpenForWrite(filepath.Join(t.TempDir(), "deps")); err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	if err := log.recordDeps(s.state.Paths["b.o"], 1, []*Node{s.state.Paths["dep.h"], s.state.GetNode("b.h", 0)}); err != nil {
+		t.Fatal(err)
+	}
+	got = []string{}
+	for _, n := range GeneratedHeaders(&s.state, &log) {
+		got = append(got, n.Path)
+	}
+	if diff := cmp.Diff([]string{"dep.h", "gen.h"}, got); diff != "" {
+		t.Fatal(diff)
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// GeneratorDepsVariable is the top level variable listing extra files whose
+// change requires the manifest to be regenerated, e.g. the generator's
+// configuration files that the generator doesn't declare as inputs itself.
+const GeneratorDepsVariable = "ninja_generator_deps"
+
+// AddGeneratorDeps adds the files listed in the top level
+// ninja_generator_deps variable and the files in ManifestFiles as implicit
+// inputs of the edge generating the manifest at path.
+//
+// The files generated by the edge itself are skipped.
+//
+// Returns the edge generating the manifest, or nil if the manifest is not
+// generated by the build.
+func (s *State) AddGeneratorDeps(manifest string) *Edge {
+	node := s.Paths[CanonicalizePath(manifest)]
+	if node == nil || node.InEdge == nil {
+		return nil
+	}
+	edge := node.InEdge
+	paths := append(strings.Fields(s.Bindings.LookupVariable(GeneratorDepsVariable)), s.ManifestFiles...)
+	var deps []*Node
+	for _, p := range paths {
+		p, slashBits := CanonicalizePathBits(p)
+		n := s.GetNode(p, slashBits)
+		if n.InEdge == edge || edgeHasInput(edge, n) || nodeIn(deps, n) {
+			continue
+		}
+		deps = append(deps, n)
+	}
+	if len(deps) == 0 {
+		return edge
+	}
+
+	// Add the deps as implicit inputs, before the order-only ones.
+	old := edge.Inputs
+	offset := len(edge.Inputs) - int(edge.OrderOnlyDeps)
+	edge.Inputs = make([]*Node, len(edge.Inputs)+len(deps))
+	copy(edge.Inputs, old[:offset])
+	copy(edge.Inputs[offset:], deps)
+	copy(edge.Inputs[offset+len(deps):], old[offset:])
+	edge.ImplicitDeps += int32(len(deps))
+	for _, n := range deps {
+		n.OutEdges = append(n.OutEdges, edge)
+	}
+	edge.invalidateBindings()
+	return edge
+}
+
+func edgeHasInput(edge *Edge, n *Node) bool {
+	return nodeIn(edge.Inputs, n)
+}
+
+func nodeIn(nodes []*Node, n *Node) bool {
+	for _, i := range nodes {
+		if i == n {
+			return true
+		}
+	}
+	return false
+}
+
+// addManifestFiles adds paths to ManifestFiles, keeping it sorted and
+// deduplicated.
+func (s *State) addManifestFiles(paths []string) {
+	if len(paths) == 0 {
+		return
+	}
+	all := append(s.ManifestFiles, paths...)
+	sort.Strings(all)
+	out := all[:0]
+	for i, p := range all {
+		if i == 0 || p != all[i-1] {
+			out = append(out, p)
+		}
+	}
+	s.ManifestFiles = out
+}
+
+// WriteManifestDeps writes ManifestFiles to the file at path, one per line,
+// so it can be used by external tools, e.g. the generator.
+//
+// The file is only written if its content changed.
+func (s *State) WriteManifestDeps(path string) error {
+	var b bytes.Buffer
+	for _, p := range s.ManifestFiles {
+		b.WriteString(p)
+		b.WriteByte('\n')
+	}
+	if old, err := ioutil.ReadFile(path); err == nil && bytes.Equal(old, b.Bytes()) {
+		return nil
+	} else if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return ioutil.WriteFile(path, b.Bytes(), 0o666)
+}
+
+// ReadManifestDeps reads a file written by WriteManifestDeps.
+func ReadManifestDeps(path string) ([]string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, l := range strings.Split(string(b), "\n") {
+		if l != "" {
+			out = append(out, l)
+		}
+	}
+	return out, nil
+}
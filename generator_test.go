@@ -0,0 +1,130 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestState_AddGeneratorDeps(t *testing.T) {
+	g := NewGraphTest(t)
+	g.AssertParse(&g.state, "ninja_generator_deps = config.json ./tools/gen.py in\nrule gen\n  command = gen\n  generator = 1\nbuild build.ninja: gen in || oo\n", ParseManifestOpts{})
+	edge := g.state.AddGeneratorDeps("./build.ninja")
+	if edge == nil {
+		t.Fatal("expected the generator edge")
+	}
+	var got []string
+	for _, n := range edge.Inputs {
+		got = append(got, n.Path)
+	}
+	if diff := cmp.Diff([]string{"in", "config.json", "tools/gen.py", "oo"}, got); diff != "" {
+		t.Fatal(diff)
+	}
+	if edge.ImplicitDeps != 2 || edge.OrderOnlyDeps != 1 {
+		t.Fatal(edge.ImplicitDeps, edge.OrderOnlyDeps)
+	}
+	if n := g.GetNode("config.json"); len(n.OutEdges) != 1 || n.OutEdges[0] != edge {
+		t.Fatal(n.OutEdges)
+	}
+	// Calling it again is a no-op.
+	g.state.AddGeneratorDeps("build.ninja")
+	if len(edge.Inputs) != 4 {
+		t.Fatal(len(edge.Inputs))
+	}
+
+	// A change in a generator dep makes the manifest dirty.
+	g.fs.Create("in", "")
+	g.fs.Create("config.json", "")
+	g.fs.Create("tools/gen.py", "")
+	g.fs.Create("build.ninja", "")
+	if _, err := g.scan.RecomputeDirty(g.GetNode("build.ninja")); err != nil {
+		t.Fatal(err)
+	}
+	if g.GetNode("build.ninja").Dirty {
+		t.Fatal("expected clean")
+	}
+	g.state.Reset()
+	g.fs.Tick()
+	g.fs.Create("config.json", "")
+	if _, err := g.scan.RecomputeDirty(g.GetNode("build.ninja")); err != nil {
+		t.Fatal(err)
+	}
+	if !g.GetNode("build.ninja").Dirty {
+		t.Fatal("expected dirty")
+	}
+}
+
+func TestState_AddGeneratorDeps_NotGenerated(t *testing.T) {
+	g := NewGraphTest(t)
+	g.AssertParse(&g.state, "ninja_generator_deps = config.json\n", ParseManifestOpts{})
+	if g.state.AddGeneratorDeps("build.ninja") != nil {
+		t.Fatal("expected nil")
+	}
+	g.AssertParse(&g.state, "build out: cat in\n", ParseManifestOpts{})
+	if g.state.AddGeneratorDeps("in") != nil {
+		t.Fatal("expected nil")
+	}
+}
+
+func TestParseManifest_ManifestFiles(t *testing.T) {
+	for _, c := range []ParseManifestConcurrency{ParseManifestSerial, ParseManifestPrewarmSubninja, ParseManifestConcurrentParsing} {
+		fs := NewVirtualFileSystem()
+		fs.Create("rules.ninja", "rule cat\n  command = cat $in > $out\n")
+		fs.Create("sub/a.ninja", "build a: cat in\ninclude sub/inc.ninja\n")
+		fs.Create("sub/inc.ninja", "")
+		fs.Create("b.ninja", "build b: cat in\n")
+		state := NewState()
+		input := []byte("include rules.ninja\nsubninja sub/a.ninja\nsubninja b.ninja\nsubninja b.ninja\n\x00")
+		if err := ParseManifest(&state, &fs, ParseManifestOpts{Concurrency: c}, "build.ninja", input); err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff([]string{"b.ninja", "rules.ninja", "sub/a.ninja", "sub/inc.ninja"}, state.ManifestFiles); diff != "" {
+			t.Fatalf("%d: %s", c, diff)
+		}
+	}
+}
+
+func TestState_AddGeneratorDeps_ManifestFiles(t *testing.T) {
+	g := NewGraphTest(t)
+	g.AssertParse(&g.state, "rule gen\n  command = gen\n  generator = 1\nbuild build.ninja | gen.ninja: gen in\n", ParseManifestOpts{})
+	g.state.addManifestFiles([]string{"rules.ninja", "gen.ninja"})
+	edge := g.state.AddGeneratorDeps("build.ninja")
+	var got []string
+	for _, n := range edge.Inputs {
+		got = append(got, n.Path)
+	}
+	// gen.ninja is an output of the generator, it is not added.
+	if diff := cmp.Diff([]string{"in", "rules.ninja"}, got); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestState_WriteManifestDeps(t *testing.T) {
+	CreateTempDirAndEnter(t)
+	state := NewState()
+	state.addManifestFiles([]string{"b c.ninja", "a.ninja", "b c.ninja"})
+	if err := state.WriteManifestDeps(".ninja_manifest_deps"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadManifestDeps(".ninja_manifest_deps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"a.ninja", "b c.ninja"}, got); diff != "" {
+		t.Fatal(diff)
+	}
+}
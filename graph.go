@@ -21,6 +21,9 @@ import (
 	"os"
 	"runtime"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
 )
 
 // ExistenceStatus represents the knowledge of the file's existence.
@@ -82,7 +85,7 @@ type Node struct {
 	DyndepPending bool
 }
 
-func (n *Node) statIfNecessary(di DiskInterface) error {
+func (n *Node) statIfNecessary(di FileSystem) error {
 	if n.Exists != ExistenceStatusUnknown {
 		return nil
 	}
@@ -96,7 +99,7 @@ func (n *Node) PathDecanonicalized() string {
 }
 
 // Stat stat's the file.
-func (n *Node) Stat(di DiskInterface) error {
+func (n *Node) Stat(di FileSystem) error {
 	defer metricRecord("node stat")()
 	mtime, err := di.Stat(n.Path)
 	n.MTime = mtime
@@ -197,6 +200,37 @@ type Edge struct {
 	DepsLoaded           bool
 	DepsMissing          bool
 	GeneratedByDepLoader bool
+
+	// batch is the list of edges run along this edge in a single command when
+	// the rule has a "batch" binding. It starts with the edge itself and is
+	// only set while the command is being started.
+	batch []*Edge
+
+	// command, when not empty, is the command to run instead of the evaluated
+	// one. It is set by BuilderHooks.BeforeEdge and is not recorded in the
+	// build log.
+	command string
+	// spilledCommand, when not empty, is the command to run with $in written
+	// to a response file. It is set by the builder for rules with
+	// rspfile_auto whose command is too long for the OS.
+	spilledCommand string
+
+	// mu protects bindings and the logCmd fields, as the graph may be read
+	// concurrently via State.View.
+	mu sync.Mutex
+	// bindings memoizes GetBinding. It is reset by invalidateBindings when
+	// loading a depfile or a dyndep file modifies the edge.
+	bindings map[string]string
+	// logCmd and logCmdHash cache EvaluateCommand(true) and its
+	// HashCommand128, as used by the build log.
+	logCmd      string
+	logCmdHash  [2]uint64
+	logCmdValid bool
+	// noMemoize disables the memoization above. See State.DisableMemoization.
+	noMemoize bool
+	// posixShell is set when the command is run by a POSIX shell on Windows.
+	// See State.UsePosixShell.
+	posixShell bool
 }
 
 // If this ever gets changed, update DelayedEdgesSet to take this into account.
@@ -236,15 +270,134 @@ func (e *Edge) EvaluateCommand(inclRspFile bool) string {
 	return command
 }
 
+// logCommand returns the command as recorded in the build log and its hash.
+func (e *Edge) logCommand(tools *toolTracker) (string, [2]uint64) {
+	if e.noMemoize {
+		command := e.EvaluateCommand(true)
+		command += e.toolSuffix(command, tools) + e.cwdSuffix()
+		return command, HashCommand128(command)
+	}
+	e.mu.Lock()
+	if e.logCmdValid {
+		defer e.mu.Unlock()
+		return e.logCmd, e.logCmdHash
+	}
+	e.mu.Unlock()
+	command := e.EvaluateCommand(true)
+	command += e.toolSuffix(command, tools) + e.cwdSuffix()
+	hash := HashCommand128(command)
+	e.mu.Lock()
+	e.logCmd = command
+	e.logCmdHash = hash
+	e.logCmdValid = true
+	e.mu.Unlock()
+	return command, hash
+}
+
+// invalidateBindings discards the memoized bindings. It must be called when
+// the edge inputs, outputs or bindings are modified after the manifest is
+// parsed.
+func (e *Edge) invalidateBindings() {
+	e.mu.Lock()
+	e.bindings = nil
+	e.logCmd = ""
+	e.logCmdHash = [2]uint64{}
+	e.logCmdValid = false
+	e.mu.Unlock()
+}
+
 // GetBinding returns the shell-escaped value of |key|.
+//
+// The value is memoized unless State.DisableMemoization was called, so status
+// lines, the build log and tools like compdb don't expand the same strings
+// repeatedly.
 func (e *Edge) GetBinding(key string) string {
+	if e.noMemoize {
+		return e.evalBinding(key)
+	}
+	e.mu.Lock()
+	v, ok := e.bindings[key]
+	e.mu.Unlock()
+	if ok {
+		return v
+	}
+	v = e.evalBinding(key)
+	e.mu.Lock()
+	if e.bindings == nil {
+		e.bindings = map[string]string{}
+	}
+	e.bindings[key] = v
+	e.mu.Unlock()
+	return v
+}
+
+// MetaPrefix is the prefix of the bindings annotating an edge with arbitrary
+// metadata, e.g. "meta.owner = team-foo". They can be set on the edge, its
+// rule or the enclosing scope. They are not used to run the command, so they
+// don't affect the build; they are carried through the JSON status, the
+// failure summary, the graph export and the compilation database.
+const MetaPrefix = "meta."
+
+// Meta returns the metadata of the edge, keyed by the name of the binding
+// without MetaPrefix. It returns nil if there is none.
+func (e *Edge) Meta() map[string]string {
+	var out map[string]string
+	add := func(key string) {
+		if !strings.HasPrefix(key, MetaPrefix) {
+			return
+		}
+		if _, ok := out[key[len(MetaPrefix):]]; ok {
+			return
+		}
+		if out == nil {
+			out = map[string]string{}
+		}
+		out[key[len(MetaPrefix):]] = e.GetBinding(key)
+	}
+	for key := range e.Rule.Bindings {
+		add(key)
+	}
+	for env := e.Env; env != nil; env = env.Parent {
+		for key := range env.Bindings {
+			add(key)
+		}
+	}
+	return out
+}
+
+// evalBinding is GetBinding without memoization. It is used while the edge
+// is being constructed.
+func (e *Edge) evalBinding(key string) string {
 	env := edgeEnv{
 		edge:        e,
-		escapeInOut: shellEscape,
+		escapeInOut: e.shellEscape(),
+	}
+	if key == "command" {
+		env.escapeInOut = e.commandEscape()
+	}
+	if key == "command" || key == "rspfile_content" {
+		env.cwd = e.Cwd()
 	}
 	return env.LookupVariable(key)
 }
 
+// commandEscape returns how the paths are escaped in the command.
+func (e *Edge) commandEscape() escapeKind {
+	if runtime.GOOS == "windows" && !e.posixShell && e.Rule.usesCmd() {
+		return cmdEscape
+	}
+	return e.shellEscape()
+}
+
+// shellEscape returns how the paths are escaped for the shell running the
+// command.
+func (e *Edge) shellEscape() escapeKind {
+	if e.posixShell {
+		return msysEscape
+	}
+	return shellEscape
+}
+
 // GetUnescapedDepfile returns like GetBinding("depfile"), but without shell
 // escaping.
 func (e *Edge) GetUnescapedDepfile() string {
@@ -361,6 +514,29 @@ func (e *EdgeSet) Pop() *Edge {
 	return ed
 }
 
+// popMatching removes and returns up to max edges for which match returns
+// true, lowest ID first.
+func (e *EdgeSet) popMatching(max int, match func(*Edge) bool) []*Edge {
+	e.recreate()
+	var out []*Edge
+	for i := len(e.sorted) - 1; i >= 0 && len(out) < max; i-- {
+		if ed := e.sorted[i]; match(ed) {
+			out = append(out, ed)
+			delete(e.edges, ed)
+		}
+	}
+	if len(out) != 0 {
+		kept := e.sorted[:0]
+		for _, ed := range e.sorted {
+			if _, ok := e.edges[ed]; ok {
+				kept = append(kept, ed)
+			}
+		}
+		e.sorted = kept
+	}
+	return out
+}
+
 func (e *EdgeSet) recreate() {
 	if !e.dirty {
 		return
@@ -401,11 +577,16 @@ func (e *EdgeSet) recreate() {
 
 //
 
-type escapeKind bool
+type escapeKind int8
 
 const (
-	shellEscape escapeKind = false
-	doNotEscape escapeKind = true
+	shellEscape escapeKind = iota
+	doNotEscape
+	// cmdEscape escapes for a command line interpreted by cmd.exe.
+	cmdEscape
+	// msysEscape escapes for a POSIX shell on Windows, with the paths
+	// translated to MSYS paths.
+	msysEscape
 )
 
 // An Env for an Edge, providing $in and $out.
@@ -414,46 +595,171 @@ type edgeEnv struct {
 	edge        *Edge
 	escapeInOut escapeKind
 	recursive   bool
+	// in, when not empty, replaces the value of $in.
+	in string
+	// cwd, when not empty, is the directory the command runs in. The paths
+	// are rewritten relative to it.
+	cwd string
+}
+
+// explicitInputs returns the explicit inputs as expanded in $in.
+//
+// They are in the order of the manifest, which is stable across builds.
+// When "sort_inputs" is set, they are sorted by path instead, so the
+// arguments of an archive or a link don't depend on the order the generator
+// wrote them in. $in_sorted is always sorted.
+func (e *Edge) explicitInputs() []*Node {
+	explicitDepsCount := len(e.Inputs) - int(e.ImplicitDeps) - int(e.OrderOnlyDeps)
+	if e.GetBinding("sort_inputs") != "" {
+		return sortedNodes(e.Inputs[:explicitDepsCount])
+	}
+	return e.Inputs[:explicitDepsCount]
+}
+
+// sortedNodes returns a copy of nodes sorted by path.
+func sortedNodes(nodes []*Node) []*Node {
+	out := make([]*Node, len(nodes))
+	copy(out, nodes)
+	sort.Slice(out, func(i, j int) bool { return out[i].Path < out[j].Path })
+	return out
+}
+
+// pathList returns the paths of span, separated by sep.
+func (e *edgeEnv) pathList(span []*Node, sep byte) string {
+	if e.cwd != "" {
+		return makeRebasedPathList(span, sep, e.escapeInOut, e.cwd)
+	}
+	return makePathList(span, sep, e.escapeInOut)
 }
 
 func (e *edgeEnv) LookupVariable(v string) string {
 	edge := e.edge
 	switch v {
 	case "in":
-		explicitDepsCount := len(edge.Inputs) - int(edge.ImplicitDeps) - int(edge.OrderOnlyDeps)
-		return makePathList(edge.Inputs[:explicitDepsCount], ' ', e.escapeInOut)
+		if e.in != "" {
+			return e.in
+		}
+		return e.pathList(edge.explicitInputs(), ' ')
 	case "in_newline":
+		return e.pathList(edge.explicitInputs(), '\n')
+	case "in_sorted":
 		explicitDepsCount := len(edge.Inputs) - int(edge.ImplicitDeps) - int(edge.OrderOnlyDeps)
-		return makePathList(edge.Inputs[:explicitDepsCount], '\n', e.escapeInOut)
+		return e.pathList(sortedNodes(edge.Inputs[:explicitDepsCount]), ' ')
+	case "in_batch":
+		if len(edge.batch) == 0 {
+			explicitDepsCount := len(edge.Inputs) - int(edge.ImplicitDeps) - int(edge.OrderOnlyDeps)
+			return e.pathList(edge.Inputs[:explicitDepsCount], ' ')
+		}
+		var inputs []*Node
+		for _, b := range edge.batch {
+			explicitDepsCount := len(b.Inputs) - int(b.ImplicitDeps) - int(b.OrderOnlyDeps)
+			inputs = append(inputs, b.Inputs[:explicitDepsCount]...)
+		}
+		return e.pathList(inputs, ' ')
 	case "out":
 		explicitOutsCount := len(edge.Outputs) - int(edge.ImplicitOuts)
-		return makePathList(edge.Outputs[:explicitOutsCount], ' ', e.escapeInOut)
+		return e.pathList(edge.Outputs[:explicitOutsCount], ' ')
+	case "depfile", "rspfile":
+		if e.cwd != "" {
+			// nin reads and writes them relative to the build directory, the
+			// command relative to cwd.
+			inner := edgeEnv{edge: edge, escapeInOut: doNotEscape, lookups: e.lookups, recursive: e.recursive}
+			return escapePath(rebasePath(e.cwd, inner.LookupVariable(v)), e.escapeInOut)
+		}
+		return e.lookupBinding(v)
+	// The following are meant to render short descriptions, e.g.
+	// "CXX $in_count files -> $out_short".
+	case "in_count":
+		return strconv.Itoa(len(edge.Inputs) - int(edge.ImplicitDeps) - int(edge.OrderOnlyDeps))
+	case "out_count":
+		return strconv.Itoa(len(edge.Outputs) - int(edge.ImplicitOuts))
+	case "in_short":
+		explicitDepsCount := len(edge.Inputs) - int(edge.ImplicitDeps) - int(edge.OrderOnlyDeps)
+		return summarizePathList(edge.Inputs[:explicitDepsCount], e.escapeInOut)
+	case "out_short":
+		explicitOutsCount := len(edge.Outputs) - int(edge.ImplicitOuts)
+		return summarizePathList(edge.Outputs[:explicitOutsCount], e.escapeInOut)
 	default:
-		// TODO(maruel): Remove here and move to a post parsing evaluation in a
-		// separate goroutine.
-		for i := 0; i < len(e.lookups); i++ {
-			if e.lookups[i] == v {
-				cycle := ""
-				for ; i < len(e.lookups); i++ {
-					cycle += e.lookups[i] + " -> "
-				}
-				cycle += v
-				fatalf("cycle in rule variables: " + cycle)
+		return e.lookupBinding(v)
+	}
+}
+
+// lookupBinding returns the value of the binding v of the edge, its rule or
+// its scope.
+func (e *edgeEnv) lookupBinding(v string) string {
+	edge := e.edge
+	// TODO(maruel): Remove here and move to a post parsing evaluation in a
+	// separate goroutine.
+	for i := 0; i < len(e.lookups); i++ {
+		if e.lookups[i] == v {
+			cycle := ""
+			for ; i < len(e.lookups); i++ {
+				cycle += e.lookups[i] + " -> "
 			}
+			cycle += v
+			fatalf("cycle in rule variables: " + cycle)
 		}
+	}
 
-		// See notes on BindingEnv.lookupWithFallback.
-		eval := edge.Rule.Bindings[v]
-		if e.recursive {
-			if eval != nil {
-				e.lookups = append(e.lookups, v)
-			}
-		} else {
-			// In practice, variables defined on rules never use another rule variable.
-			e.recursive = true
+	// See notes on BindingEnv.lookupWithFallback.
+	eval := edge.Rule.Bindings[v]
+	if e.recursive {
+		if eval != nil {
+			e.lookups = append(e.lookups, v)
 		}
-		return edge.Env.lookupWithFallback(v, eval, e)
+	} else {
+		// In practice, variables defined on rules never use another rule variable.
+		e.recursive = true
 	}
+	return edge.Env.lookupWithFallback(v, eval, e)
+}
+
+// summarizePathList returns the base name of the first path of span,
+// followed by the number of other paths if any, e.g. "foo.cc (+3 more)".
+func summarizePathList(span []*Node, escapeInOut escapeKind) string {
+	if len(span) == 0 {
+		return ""
+	}
+	p := span[0].PathDecanonicalized()
+	if i := strings.LastIndexAny(p, "/\\"); i != -1 {
+		p = p[i+1:]
+	}
+	s := escapePath(p, escapeInOut)
+	if len(span) > 1 {
+		s += " (+" + strconv.Itoa(len(span)-1) + " more)"
+	}
+	return s
+}
+
+// escapePath escapes path for use on a command line, if requested.
+func escapePath(path string, escapeInOut escapeKind) string {
+	switch escapeInOut {
+	case shellEscape:
+		if runtime.GOOS == "windows" {
+			return getWin32EscapedString(path)
+		}
+		return getShellEscapedString(path)
+	case cmdEscape:
+		return getCmdEscapedString(path)
+	case msysEscape:
+		return getShellEscapedString(WindowsToMSYSPath(path))
+	default:
+		return path
+	}
+}
+
+// usesCmd returns true if the command of the rule is run via cmd.exe, e.g.
+// "cmd /c copy $in $out".
+func (r *Rule) usesCmd() bool {
+	c := r.Bindings["command"]
+	if c == nil || len(c.Parsed) == 0 || c.Parsed[0].IsSpecial {
+		return false
+	}
+	p := strings.ToLower(win32Program(c.Parsed[0].Value))
+	if i := strings.LastIndexAny(p, "/\\"); i != -1 {
+		p = p[i+1:]
+	}
+	return p == "cmd" || p == "cmd.exe"
 }
 
 // Given a span of Nodes, construct a list of paths suitable for a command
@@ -469,14 +775,7 @@ func makePathList(span []*Node, sep byte, escapeInOut escapeKind) string {
 	total := 0
 	first := false
 	for i, x := range span {
-		path := x.PathDecanonicalized()
-		if escapeInOut == shellEscape {
-			if runtime.GOOS == "windows" {
-				path = getWin32EscapedString(path)
-			} else {
-				path = getShellEscapedString(path)
-			}
-		}
+		path := escapePath(x.PathDecanonicalized(), escapeInOut)
 		l := len(path)
 		if !first {
 			if l != 0 {
@@ -533,13 +832,16 @@ func PathDecanonicalized(path string, slashBits uint64) string {
 // and updating the dirty/outputsReady state of all the nodes and edges.
 type DependencyScan struct {
 	buildLog     *BuildLog
-	di           DiskInterface
+	di           FileSystem
 	depLoader    implicitDepLoader
 	dyndepLoader DyndepLoader
+	// tools is how the programs of the commands recorded in the build log are
+	// identified. It is set by NewBuilder.
+	tools *toolTracker
 }
 
 // NewDependencyScan returns an initialized DependencyScan.
-func NewDependencyScan(state *State, buildLog *BuildLog, depsLog *DepsLog, di DiskInterface) DependencyScan {
+func NewDependencyScan(state *State, buildLog *BuildLog, depsLog *DepsLog, di FileSystem) DependencyScan {
 	return DependencyScan{
 		buildLog:     buildLog,
 		di:           di,
@@ -565,6 +867,14 @@ func (d *DependencyScan) RecomputeDirty(initialNode *Node) ([]*Node, error) {
 	// The C++ code uses a dequeue.
 	nodes := []*Node{initialNode}
 
+	if d.depLoader.workers > 1 {
+		d.depLoader.prefetch(initialNode)
+		// Discard the depfiles that were not needed, e.g. on error.
+		defer func() {
+			d.depLoader.prefetched = nil
+		}()
+	}
+
 	// recomputeNodeDirty might return new validation nodes that need to be
 	// checked for dirty state, keep a queue of nodes to visit.
 	for len(nodes) != 0 {
@@ -767,29 +1077,25 @@ func (d *DependencyScan) verifyDAG(node *Node, stack []*Node) error {
 	// should report a -> c -> a instead of b -> c -> a.
 	stack[start] = node
 
-	// Construct the error message rejecting the cycle.
-	err := "dependency cycle: "
+	// Construct the error rejecting the cycle.
+	err := &ErrCycle{Path: make([]string, 0, len(stack)-start+1)}
 	for i := start; i != len(stack); i++ {
-		err += stack[i].Path
-		err += " -> "
+		err.Path = append(err.Path, stack[i].Path)
 	}
-	err += stack[start].Path
+	err.Path = append(err.Path, stack[start].Path)
 
-	if (start+1) == len(stack) && edge.maybePhonycycleDiagnostic() {
-		// The manifest parser would have filtered out the self-referencing
-		// input if it were not configured to allow the error.
-		err += " [-w phonycycle=err]"
-	}
-	return errors.New(err)
+	// The manifest parser would have filtered out the self-referencing input
+	// if it were not configured to allow the error.
+	err.PhonyCycle = (start+1) == len(stack) && edge.maybePhonycycleDiagnostic()
+	return err
 }
 
 // recomputeOutputsDirty recomputes whether any output of the edge is dirty.
 //
 // Returns true if dirty.
 func (d *DependencyScan) recomputeOutputsDirty(edge *Edge, mostRecentInput *Node) bool {
-	command := edge.EvaluateCommand(true) // inclRspFile=
 	for _, o := range edge.Outputs {
-		if d.recomputeOutputDirty(edge, mostRecentInput, command, o) {
+		if d.recomputeOutputDirty(edge, mostRecentInput, o) {
 			return true
 		}
 	}
@@ -800,7 +1106,7 @@ func (d *DependencyScan) recomputeOutputsDirty(edge *Edge, mostRecentInput *Node
 // marked dirty.
 //
 // Returns true if so.
-func (d *DependencyScan) recomputeOutputDirty(edge *Edge, mostRecentInput *Node, command string, output *Node) bool {
+func (d *DependencyScan) recomputeOutputDirty(edge *Edge, mostRecentInput *Node, output *Node) bool {
 	if edge.Rule == PhonyRule {
 		// Phony edges don't write any output.  Outputs are only dirty if
 		// there are no inputs and we're missing the output.
@@ -859,7 +1165,7 @@ func (d *DependencyScan) recomputeOutputDirty(edge *Edge, mostRecentInput *Node,
 			entry = d.buildLog.Entries[output.Path]
 		}
 		if entry != nil {
-			if !generator && HashCommand(command) != entry.commandHash {
+			if !generator && !entry.matchesCommand(edge.logCommand(d.tools)) {
 				// May also be dirty due to the command changing since the last build.
 				// But if this is a generator rule, the command changing does not make us
 				// dirty.
@@ -897,11 +1203,27 @@ func (d *DependencyScan) LoadDyndeps(node *Node, ddf DyndepFile) error {
 // "depfile" attribute in build files.
 type implicitDepLoader struct {
 	state   *State
-	di      DiskInterface
+	di      FileSystem
 	depsLog *DepsLog
+
+	// workers is the number of goroutines reading depfiles concurrently in
+	// prefetch. See BuildConfig.DepfileWorkers.
+	workers int
+	// prefetched are the depfiles read by prefetch and not yet processed.
+	prefetched map[string]depfileResult
+	// scanner finds the headers of the edges with a scan binding. It is
+	// created on first use.
+	scanner *includeScanner
 }
 
-func newImplicitDepLoader(state *State, depsLog *DepsLog, di DiskInterface) implicitDepLoader {
+// depfileResult is a read and parsed depfile.
+type depfileResult struct {
+	// depfile is nil if the depfile is missing or empty.
+	depfile *DepfileParser
+	err     error
+}
+
+func newImplicitDepLoader(state *State, depsLog *DepsLog, di FileSystem) implicitDepLoader {
 	return implicitDepLoader{
 		state:   state,
 		di:      di,
@@ -923,6 +1245,17 @@ func (i *implicitDepLoader) loadDeps(edge *Edge) (bool, error) {
 		return i.loadDepFile(edge, depfile)
 	}
 
+	if edge.GetBinding("scan") != "" {
+		if i.scanner == nil {
+			i.scanner = newIncludeScanner(i.state, i.di)
+		}
+		headers, err := i.scanner.scanEdge(edge)
+		if err != nil {
+			return false, err
+		}
+		return i.processDepfileDeps(edge, headers), nil
+	}
+
 	// No deps to load.
 	return true, nil
 }
@@ -932,23 +1265,25 @@ func (i *implicitDepLoader) loadDeps(edge *Edge) (bool, error) {
 // Returns false if info is just missing or on error.
 func (i *implicitDepLoader) loadDepFile(edge *Edge, path string) (bool, error) {
 	defer metricRecord("depfile load")()
-	// Read depfile content.  Treat a missing depfile as empty.
-	content, err := i.di.ReadFile(path)
-	if err != nil && !os.IsNotExist(err) {
-		// TODO(maruel): Use %q for real quoting.
-		return false, fmt.Errorf("loading '%s': %w", path, err)
+	r, ok := i.prefetched[path]
+	if ok {
+		delete(i.prefetched, path)
+	} else {
+		r = readDepfile(i.di, path)
+	}
+	if r.err != nil {
+		return false, r.err
 	}
 	// On a missing depfile: return false and empty error.
-	if len(content) == 0 {
+	if r.depfile == nil {
 		// TODO(maruel): Use %q for real quoting.
 		explain("depfile '%s' is missing", path)
 		return false, nil
 	}
-
-	depfile := DepfileParser{}
-	if err := depfile.Parse(content); err != nil {
-		return false, fmt.Errorf("%s: %w", path, err)
+	if edge.posixShell {
+		r.depfile.translateMSYSPaths()
 	}
+	depfile := r.depfile
 
 	if len(depfile.outs) == 0 {
 		return false, errors.New(path + ": no outputs declared")
@@ -979,6 +1314,84 @@ func (i *implicitDepLoader) loadDepFile(edge *Edge, path string) (bool, error) {
 	return i.processDepfileDeps(edge, depfile.ins), nil
 }
 
+// readDepfile reads and parses a depfile. A missing depfile is treated as
+// empty.
+//
+// It doesn't modify the graph, so it is safe to call concurrently.
+func readDepfile(di FileSystem, path string) depfileResult {
+	content, err := di.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		// TODO(maruel): Use %q for real quoting.
+		return depfileResult{err: fmt.Errorf("loading '%s': %w", path, err)}
+	}
+	if len(content) == 0 {
+		return depfileResult{}
+	}
+	depfile := &DepfileParser{}
+	if err := depfile.Parse(content); err != nil {
+		return depfileResult{err: fmt.Errorf("%s: %w", path, err)}
+	}
+	return depfileResult{depfile: depfile}
+}
+
+// prefetch reads and parses concurrently the depfiles of the edges that will
+// be visited when scanning node, so that loadDepFile doesn't wait on I/O.
+func (i *implicitDepLoader) prefetch(node *Node) {
+	defer metricRecord("depfile prefetch")()
+	var paths []string
+	seen := map[*Edge]struct{}{}
+	nodes := []*Node{node}
+	for len(nodes) != 0 {
+		n := nodes[len(nodes)-1]
+		nodes = nodes[:len(nodes)-1]
+		e := n.InEdge
+		if e == nil || e.Mark != VisitNone || e.DepsLoaded {
+			continue
+		}
+		if _, ok := seen[e]; ok {
+			continue
+		}
+		seen[e] = struct{}{}
+		if e.GetBinding("deps") == "" {
+			if p := e.GetUnescapedDepfile(); p != "" {
+				paths = append(paths, p)
+			}
+		}
+		nodes = append(nodes, e.Inputs...)
+		nodes = append(nodes, e.Validations...)
+	}
+	if len(paths) < 2 {
+		return
+	}
+
+	results := make([]depfileResult, len(paths))
+	ch := make(chan int)
+	var wg sync.WaitGroup
+	workers := i.workers
+	if workers > len(paths) {
+		workers = len(paths)
+	}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range ch {
+				results[j] = readDepfile(i.di, paths[j])
+			}
+		}()
+	}
+	for j := range paths {
+		ch <- j
+	}
+	close(ch)
+	wg.Wait()
+
+	i.prefetched = make(map[string]depfileResult, len(paths))
+	for j, p := range paths {
+		i.prefetched[p] = results[j]
+	}
+}
+
 // processDepfileDeps processes loaded implicit dependencies for edge and
 // update the graph.
 //
@@ -1038,6 +1451,7 @@ func (i *implicitDepLoader) preallocateSpace(edge *Edge, count int) int {
 	copy(edge.Inputs, old[:offset])
 	copy(edge.Inputs[offset+count:], old[offset:])
 	edge.ImplicitDeps += int32(count)
+	edge.invalidateBindings()
 	return len(edge.Inputs) - int(edge.OrderOnlyDeps) - count
 }
 
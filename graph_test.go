@@ -15,8 +15,14 @@
 package nin
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
 	"runtime"
 	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
 )
 
 type GraphTest struct {
@@ -25,8 +31,8 @@ type GraphTest struct {
 	scan DependencyScan
 }
 
-func NewGraphTest(t *testing.T) GraphTest {
-	g := GraphTest{
+func NewGraphTest(t *testing.T) *GraphTest {
+	g := &GraphTest{
 		StateTestWithBuiltinRules: NewStateTestWithBuiltinRules(t),
 		fs:                        NewVirtualFileSystem(),
 	}
@@ -267,6 +273,94 @@ func TestGraphTest_VarInOutPathEscaping(t *testing.T) {
 	}
 }
 
+func TestGraphTest_VarInOutCmdEscaping(t *testing.T) {
+	g := NewGraphTest(t)
+	g.AssertParse(&g.state, "rule cmdcopy\n  command = cmd /c copy $in $out\n  rspfile = $out.rsp\n  rspfile_content = $in\nbuild a$ b: cmdcopy 50%&c\n", ParseManifestOpts{})
+
+	edge := g.GetNode("a b").InEdge
+	if !edge.Rule.usesCmd() {
+		t.Fatal("expected cmd")
+	}
+	want := "cmd /c copy '50%&c' 'a b'"
+	if runtime.GOOS == "windows" {
+		want = "cmd /c copy 50^%^&c ^\"a b^\""
+	}
+	if got := edge.EvaluateCommand(false); want != got {
+		t.Fatalf("want %q, got %q", want, got)
+	}
+	// The response file is not read by cmd.exe.
+	want = "'50%&c'"
+	if runtime.GOOS == "windows" {
+		want = "50%&c"
+	}
+	if got := edge.GetBinding("rspfile_content"); want != got {
+		t.Fatalf("want %q, got %q", want, got)
+	}
+	if g.state.Bindings.Rules["cat"].usesCmd() {
+		t.Fatal("unexpected cmd")
+	}
+}
+
+func TestGraphTest_VarInOutSummary(t *testing.T) {
+	g := NewGraphTest(t)
+	g.AssertParse(&g.state, "rule ar\n  command = ar $out $in\n  description = AR $in_count files ($in_short) -> $out_short\nbuild lib/libfoo.a lib/libfoo.map | lib/libfoo.d: ar src/a.o src/b.o src/c.o | dep\nbuild lib/libbar.a: ar src/a.o\n", ParseManifestOpts{})
+
+	edge := g.state.Paths["lib/libfoo.a"].InEdge
+	if got := edge.GetBinding("description"); got != "AR 3 files (a.o (+2 more)) -> libfoo.a (+1 more)" {
+		t.Fatal(got)
+	}
+	if got := edge.GetBinding("out_count"); got != "2" {
+		t.Fatal(got)
+	}
+	edge = g.state.Paths["lib/libbar.a"].InEdge
+	if got := edge.GetBinding("description"); got != "AR 1 files (a.o) -> libbar.a" {
+		t.Fatal(got)
+	}
+}
+
+func TestGraphTest_VarInSorted(t *testing.T) {
+	g := NewGraphTest(t)
+	g.AssertParse(&g.state, "nin_features = sort_inputs\nrule ar\n  command = ar $out $in\nrule ld\n  command = ld -o $out $in_sorted\nrule rsp\n  command = ar @$out.rsp\n  rspfile = $out.rsp\n  rspfile_content = $in_newline\n  description = $in\n  sort_inputs = 1\nbuild a.a: ar c.o a.o b.o | z.h\nbuild a: ld c.o a.o b.o\nbuild b.a: rsp c.o a.o b.o\n", ParseManifestOpts{})
+
+	// $in keeps the order of the manifest.
+	if got := g.GetNode("a.a").InEdge.EvaluateCommand(false); got != "ar a.a c.o a.o b.o" {
+		t.Fatal(got)
+	}
+	if got := g.GetNode("a").InEdge.EvaluateCommand(false); got != "ld -o a a.o b.o c.o" {
+		t.Fatal(got)
+	}
+	edge := g.GetNode("b.a").InEdge
+	if got := edge.GetBinding("rspfile_content"); got != "a.o\nb.o\nc.o" {
+		t.Fatal(got)
+	}
+	if got := edge.GetBinding("description"); got != "a.o b.o c.o" {
+		t.Fatal(got)
+	}
+	// The edge itself is unchanged.
+	if edge.Inputs[0].Path != "c.o" {
+		t.Fatal(edge.Inputs[0].Path)
+	}
+}
+
+func TestGraphTest_Meta(t *testing.T) {
+	g := NewGraphTest(t)
+	g.AssertParse(&g.state, "meta.module = base\nrule cc\n  command = cc $in\n  meta.owner = team-a\nbuild a: cc in\n  meta.owner = team-b\n  meta.cost = 3\nbuild b: cc in\n", ParseManifestOpts{})
+	want := map[string]string{"module": "base", "owner": "team-b", "cost": "3"}
+	if diff := cmp.Diff(want, g.GetNode("a").InEdge.Meta()); diff != "" {
+		t.Fatal(diff)
+	}
+	want = map[string]string{"module": "base", "owner": "team-a"}
+	if diff := cmp.Diff(want, g.GetNode("b").InEdge.Meta()); diff != "" {
+		t.Fatal(diff)
+	}
+	// Metadata is not allowed on rules in ninja compatibility mode.
+	state := NewState()
+	opts := ParseManifestOpts{DisableExtensions: true, Quiet: true}
+	if err := ParseManifest(&state, nil, opts, "input", []byte("rule cc\n  command = cc\n  meta.owner = a\n\x00")); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
 // Regression test for https://github.com/ninja-build/ninja/issues/380
 func TestGraphTest_DepfileWithCanonicalizablePath(t *testing.T) {
 	g := NewGraphTest(t)
@@ -579,6 +673,38 @@ func TestGraphTest_DyndepLoadTrivial(t *testing.T) {
 	}
 }
 
+func TestGraphTest_BindingsMemoized(t *testing.T) {
+	g := NewGraphTest(t)
+	g.AssertParse(&g.state, "rule r\n  command = cat $in > $out\nbuild out: r in || dd\n  dyndep = dd\n", ParseManifestOpts{})
+	g.fs.Create("dd", "ninja_dyndep_version = 1\nbuild out: dyndep | in2\n  restat = 1\n")
+
+	edge := g.GetNode("out").InEdge
+	if got := edge.GetBinding("restat"); got != "" {
+		t.Fatal(got)
+	}
+	if got := edge.EvaluateCommand(false); got != "cat in > out" {
+		t.Fatal(got)
+	}
+	if got := edge.bindings["command"]; got != "cat in > out" {
+		t.Fatal(got)
+	}
+
+	// Loading the dyndep file modifies the edge, which discards the memoized
+	// bindings.
+	if err := g.scan.LoadDyndeps(g.GetNode("dd"), DyndepFile{}); err != nil {
+		t.Fatal(err)
+	}
+	if edge.bindings != nil {
+		t.Fatal(edge.bindings)
+	}
+	if got := edge.GetBinding("restat"); got != "1" {
+		t.Fatal(got)
+	}
+	if got := edge.EvaluateCommand(false); got != "cat in > out" {
+		t.Fatal(got)
+	}
+}
+
 func TestGraphTest_DyndepLoadImplicit(t *testing.T) {
 	g := NewGraphTest(t)
 	g.AssertParse(&g.state, "rule r\n  command = unused\nbuild out1: r in || dd\n  dyndep = dd\nbuild out2: r in\n", ParseManifestOpts{})
@@ -1078,3 +1204,49 @@ func TestGraphTest_PhonyDepsMtimes(t *testing.T) {
 		t.Fatal("expected true")
 	}
 }
+
+func TestGraphTest_DepfilePrefetch(t *testing.T) {
+	CreateTempDirAndEnter(t)
+	s := NewStateTestWithBuiltinRules(t)
+	s.AssertParse(&s.state, "rule catdep\n  depfile = $out.d\n  command = cat $in > $out\nbuild out1.o: catdep foo1.cc\nbuild out2.o: catdep foo2.cc\nbuild out3.o: catdep foo3.cc\nbuild all: phony out1.o out2.o out3.o\n", ParseManifestOpts{})
+	old := time.Now().Add(-time.Hour)
+	for i := 1; i <= 3; i++ {
+		files := map[string]string{
+			fmt.Sprintf("foo%d.cc", i):  "",
+			fmt.Sprintf("foo%d.h", i):   "",
+			fmt.Sprintf("out%d.o", i):   "",
+			fmt.Sprintf("out%d.o.d", i): fmt.Sprintf("out%d.o: foo%d.h\n", i, i),
+		}
+		for p, c := range files {
+			if err := ioutil.WriteFile(p, []byte(c), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(p, old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// Only foo2.h is newer than its output.
+	if err := os.Chtimes("foo2.h", time.Now(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	di := RealDiskInterface{}
+	scan := NewDependencyScan(&s.state, nil, nil, &di)
+	scan.depLoader.workers = 4
+	if _, err := scan.RecomputeDirty(s.GetNode("all")); err != nil {
+		t.Fatal(err)
+	}
+	if scan.depLoader.prefetched != nil {
+		t.Fatal(scan.depLoader.prefetched)
+	}
+	for i, want := range []bool{false, true, false} {
+		e := s.GetNode(fmt.Sprintf("out%d.o", i+1)).InEdge
+		if got := e.Outputs[0].Dirty; got != want {
+			t.Fatalf("out%d.o: %t", i+1, got)
+		}
+		if len(e.Inputs) != 2 || e.Inputs[1].Path != fmt.Sprintf("foo%d.h", i+1) {
+			t.Fatalf("out%d.o: %v", i+1, e.Inputs)
+		}
+	}
+}
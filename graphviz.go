@@ -31,7 +31,7 @@ type GraphViz struct {
 }
 
 // NewGraphViz returns an initialized GraphViz.
-func NewGraphViz(state *State, di DiskInterface) GraphViz {
+func NewGraphViz(state *State, di FileSystem) GraphViz {
 	return GraphViz{
 		out:          os.Stdout,
 		dyndepLoader: NewDyndepLoader(state, di),
@@ -0,0 +1,251 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HistoryBuild is a build archived by ArchiveBuild.
+type HistoryBuild struct {
+	// Seq is the sequence number of the build, increasing with each build.
+	Seq int
+	// Time is when the build was archived.
+	Time time.Time
+	// Entries are the build log entries of the build. Only the output, timing
+	// and mtime fields are populated.
+	Entries []*LogEntry
+	// Runs is the outcome of the edges of the build, if it was recorded.
+	Runs *RunRecord
+}
+
+// Wall returns the duration of the build, up to the end of its last edge.
+func (h *HistoryBuild) Wall() time.Duration {
+	var end int32
+	for _, e := range h.Entries {
+		if e.endTime > end {
+			end = e.endTime
+		}
+	}
+	return time.Duration(end) * time.Millisecond
+}
+
+// ArchiveBuild compresses the entries appended to the build log at logPath
+// after offset, i.e. its size before the build started, and the outcome of
+// the edges in runs, if not nil, into dir. Only the last keep builds are kept
+// in dir.
+//
+// The build log only keeps the last entry of each output; the archive keeps a
+// sample per build so the duration of the edges can be compared across
+// builds.
+func ArchiveBuild(dir, logPath string, offset int64, runs *RunRecord, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+	data, err := ioutil.ReadFile(logPath)
+	if err != nil {
+		return err
+	}
+	if offset > int64(len(data)) {
+		// The log was recompacted or replaced.
+		offset = 0
+	}
+	header := string(data)
+	if i := strings.IndexByte(header, '\n'); i != -1 {
+		header = header[:i]
+	}
+	if offset == 0 {
+		offset = int64(len(header))
+	}
+	added := strings.Trim(string(data[offset:]), "\n")
+	hasRuns := runs != nil && len(runs.Edges) != 0
+	if added == "" && !hasRuns {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0o777); err != nil {
+		return err
+	}
+	seqs, err := historySeqs(dir, ".log.gz")
+	if err != nil {
+		return err
+	}
+	seq := 1
+	if len(seqs) != 0 {
+		seq = seqs[len(seqs)-1] + 1
+	}
+	// The log is archived even if empty, e.g. when all the edges failed, as
+	// the builds are listed by their log.
+	content := header + "\n"
+	if added != "" {
+		content += added + "\n"
+	}
+	if err := writeGzip(filepath.Join(dir, fmt.Sprintf("%06d.log.gz", seq)), []byte(content)); err != nil {
+		return err
+	}
+	if hasRuns {
+		if err := writeGzip(filepath.Join(dir, fmt.Sprintf("%06d.runs.gz", seq)), runs.serialize()); err != nil {
+			return err
+		}
+	}
+	// Remove the oldest builds.
+	seqs = append(seqs, seq)
+	for len(seqs) > keep {
+		for _, ext := range []string{".log.gz", ".runs.gz"} {
+			if err := os.Remove(filepath.Join(dir, fmt.Sprintf("%06d", seqs[0])+ext)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		seqs = seqs[1:]
+	}
+	return nil
+}
+
+// ReadHistory returns the builds archived in dir by ArchiveBuild, the oldest
+// first.
+//
+// It is not an error if dir doesn't exist.
+func ReadHistory(dir string) ([]*HistoryBuild, error) {
+	seqs, err := historySeqs(dir, ".log.gz")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	out := make([]*HistoryBuild, 0, len(seqs))
+	for _, seq := range seqs {
+		p := filepath.Join(dir, fmt.Sprintf("%06d.log.gz", seq))
+		fi, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		data, err := readGzip(p)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", p, err)
+		}
+		h := &HistoryBuild{Seq: seq, Time: fi.ModTime()}
+		if h.Entries, err = lastBuild(string(data)); err != nil {
+			return nil, fmt.Errorf("%s: %w", p, err)
+		}
+		p = filepath.Join(dir, fmt.Sprintf("%06d.runs.gz", seq))
+		if data, err = readGzip(p); err == nil {
+			if h.Runs, err = parseRunRecord(p, bytes.NewReader(data)); err != nil {
+				return nil, err
+			}
+		} else if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("%s: %w", p, err)
+		}
+		out = append(out, h)
+	}
+	return out, nil
+}
+
+// RunRecords returns the outcome of the edges of the builds that recorded
+// it, the most recent first, as expected by FlakinessReport.
+func RunRecords(builds []*HistoryBuild) []*RunRecord {
+	var out []*RunRecord
+	for i := len(builds) - 1; i >= 0; i-- {
+		if builds[i].Runs != nil {
+			out = append(out, builds[i].Runs)
+		}
+	}
+	return out
+}
+
+// DurationSamples returns the durations of each output in the builds, the
+// oldest first.
+//
+// Contrary to the build log, it provides more than one sample per edge to
+// estimate how long it will take.
+func DurationSamples(builds []*HistoryBuild) map[string][]time.Duration {
+	out := map[string][]time.Duration{}
+	for _, b := range builds {
+		for _, e := range b.Entries {
+			out[e.output] = append(out[e.output], time.Duration(e.endTime-e.startTime)*time.Millisecond)
+		}
+	}
+	return out
+}
+
+// MedianDuration returns the median of the samples, which is less sensitive
+// than the mean to a build slowed down by an unrelated load on the machine.
+func MedianDuration(samples []time.Duration) time.Duration {
+	if len(samples) == 0 {
+		return 0
+	}
+	s := append([]time.Duration(nil), samples...)
+	sort.Slice(s, func(i, j int) bool { return s[i] < s[j] })
+	if len(s)%2 == 1 {
+		return s[len(s)/2]
+	}
+	return (s[len(s)/2-1] + s[len(s)/2]) / 2
+}
+
+// historySeqs returns the sequence numbers of the builds in dir, sorted. The
+// files are named after the sequence number followed by suffix.
+func historySeqs(dir, suffix string) ([]int, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var seqs []int
+	for _, f := range files {
+		if name := f.Name(); strings.HasSuffix(name, suffix) {
+			if seq, err := strconv.Atoi(strings.TrimSuffix(name, suffix)); err == nil {
+				seqs = append(seqs, seq)
+			}
+		}
+	}
+	sort.Ints(seqs)
+	return seqs, nil
+}
+
+func writeGzip(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o666)
+	if err != nil {
+		return err
+	}
+	w := gzip.NewWriter(f)
+	_, err = w.Write(data)
+	if err2 := w.Close(); err == nil {
+		err = err2
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+func readGzip(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
@@ -0,0 +1,91 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestArchiveBuild(t *testing.T) {
+	CreateTempDirAndEnter(t)
+	if err := ArchiveBuild("history", "missing", 0, nil, 2); err == nil {
+		t.Fatal("expected error")
+	}
+	builds := []string{
+		"0\t10\t1\tout1\tcmd\n10\t30\t1\tout2\tcmd\n",
+		"0\t20\t2\tout1\tcmd\n",
+		"0\t25\t3\tout1\tcmd\n20\t50\t3\tout2\tcmd\n",
+	}
+	log := "# ninja log v7\n"
+	for i, b := range builds {
+		offset := int64(len(log))
+		if i == 0 {
+			// The log didn't exist.
+			offset = 0
+		}
+		log += b
+		if err := ioutil.WriteFile("log", []byte(log), 0o666); err != nil {
+			t.Fatal(err)
+		}
+		var r *RunRecord
+		if i == 2 {
+			r = &RunRecord{Edges: []RunEdge{{Output: "out1", Duration: 40 * time.Millisecond}}}
+		}
+		if err := ArchiveBuild("history", "log", offset, r, 2); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h, err := ReadHistory("history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first build was removed.
+	if len(h) != 2 || h[0].Seq != 2 || h[1].Seq != 3 || h[0].Runs != nil || h[1].Runs == nil {
+		t.Fatal(h)
+	}
+	if h[1].Wall() != 50*time.Millisecond || len(h[1].Entries) != 2 {
+		t.Fatal(h[1])
+	}
+	want := map[string][]time.Duration{
+		"out1": {20 * time.Millisecond, 25 * time.Millisecond},
+		"out2": {30 * time.Millisecond},
+	}
+	if diff := cmp.Diff(want, DurationSamples(h)); diff != "" {
+		t.Fatal(diff)
+	}
+	if h, err := ReadHistory("missing"); h != nil || err != nil {
+		t.Fatal(h, err)
+	}
+}
+
+func TestMedianDuration(t *testing.T) {
+	data := []struct {
+		in   []time.Duration
+		want time.Duration
+	}{
+		{nil, 0},
+		{[]time.Duration{3, 1, 2}, 2},
+		{[]time.Duration{4, 1, 2, 100}, 3},
+	}
+	for i, l := range data {
+		if got := MedianDuration(l.in); got != l.want {
+			t.Fatalf("%d: %v", i, got)
+		}
+	}
+}
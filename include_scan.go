@@ -0,0 +1,240 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+)
+
+// The "scan = cpp" binding makes nin find the headers included by the
+// sources of an edge that has neither depfile nor deps, e.g. a legacy rule
+// whose compiler can't write a depfile.
+//
+// The scan is approximate: the #include and #import directives are followed
+// regardless of the preprocessor conditions, so it finds a superset of the
+// headers, and the includes of a macro are ignored. The headers are looked up
+// in the directory of the including file for the quoted includes, then in the
+// -I, -iquote, -isystem and /I directories of the command. The headers not
+// found, e.g. the ones of the system, are skipped.
+
+// cppInclude is an #include directive.
+type cppInclude struct {
+	name string
+	// quoted is true for #include "foo.h" and false for #include <foo.h>.
+	quoted bool
+}
+
+// parseIncludes returns the #include and #import directives in content.
+func parseIncludes(content []byte) []cppInclude {
+	var out []cppInclude
+	for len(content) != 0 {
+		line := content
+		if i := bytes.IndexByte(content, '\n'); i != -1 {
+			line = content[:i]
+			content = content[i+1:]
+		} else {
+			content = nil
+		}
+		line = bytes.TrimLeft(line, " \t")
+		if len(line) == 0 || line[0] != '#' {
+			continue
+		}
+		line = bytes.TrimLeft(line[1:], " \t")
+		if bytes.HasPrefix(line, []byte("include")) {
+			line = line[len("include"):]
+		} else if bytes.HasPrefix(line, []byte("import")) {
+			line = line[len("import"):]
+		} else {
+			continue
+		}
+		line = bytes.TrimLeft(line, " \t")
+		if len(line) < 2 {
+			continue
+		}
+		end := byte('"')
+		if line[0] == '<' {
+			end = '>'
+		} else if line[0] != '"' {
+			// #include MACRO or #include_next.
+			continue
+		}
+		if i := bytes.IndexByte(line[1:], end); i > 0 {
+			out = append(out, cppInclude{name: string(line[1 : i+1]), quoted: end == '"'})
+		}
+	}
+	return out
+}
+
+// includeDirs returns the include directories passed to the compiler in
+// command.
+func includeDirs(command string) []string {
+	var out []string
+	f := strings.Fields(command)
+	for i := 0; i < len(f); i++ {
+		for _, flag := range []string{"-I", "-iquote", "-isystem", "/I"} {
+			if !strings.HasPrefix(f[i], flag) {
+				continue
+			}
+			d := f[i][len(flag):]
+			if d == "" && i+1 < len(f) {
+				i++
+				d = f[i]
+			}
+			if d = strings.Trim(d, "\"'"); d != "" {
+				out = append(out, d)
+			}
+			break
+		}
+	}
+	return out
+}
+
+// includeScanner finds the headers included by sources, caching the
+// directives of each file.
+type includeScanner struct {
+	state *State
+	di    FileSystem
+
+	mu       sync.Mutex
+	includes map[string][]cppInclude
+}
+
+func newIncludeScanner(state *State, di FileSystem) *includeScanner {
+	return &includeScanner{state: state, di: di, includes: map[string][]cppInclude{}}
+}
+
+// scanEdge returns the headers included directly or indirectly by the
+// explicit inputs of edge, sorted as they are found.
+func (s *includeScanner) scanEdge(edge *Edge) ([]string, error) {
+	switch scan := edge.GetBinding("scan"); scan {
+	case "cpp":
+	default:
+		// TODO(maruel): Use %q for real quoting.
+		return nil, fmt.Errorf("%s: unknown scan '%s'; only cpp is supported", edge.Outputs[0].Path, scan)
+	}
+	dirs := includeDirs(edge.EvaluateCommand(false))
+	for i, d := range dirs {
+		dirs[i] = CanonicalizePath(d)
+	}
+	explicit := len(edge.Inputs) - int(edge.ImplicitDeps) - int(edge.OrderOnlyDeps)
+	seen := map[string]struct{}{}
+	var out []string
+	var queue []string
+	for _, n := range edge.Inputs[:explicit] {
+		seen[n.Path] = struct{}{}
+		queue = append(queue, n.Path)
+	}
+	for len(queue) != 0 {
+		p := queue[0]
+		queue = queue[1:]
+		includes, err := s.fileIncludes(p)
+		if err != nil {
+			return nil, err
+		}
+		for _, inc := range includes {
+			h := s.resolve(inc, path.Dir(p), dirs)
+			if h == "" {
+				continue
+			}
+			if _, ok := seen[h]; ok {
+				continue
+			}
+			seen[h] = struct{}{}
+			out = append(out, h)
+			queue = append(queue, h)
+		}
+	}
+	return out, nil
+}
+
+// fileIncludes returns the directives of the file at p. A missing file, e.g.
+// a generated header not yet built, has none.
+func (s *includeScanner) fileIncludes(p string) ([]cppInclude, error) {
+	s.mu.Lock()
+	includes, ok := s.includes[p]
+	s.mu.Unlock()
+	if ok {
+		return includes, nil
+	}
+	defer metricRecord("include scan")()
+	mtime, err := s.di.Stat(p)
+	if mtime < 0 {
+		return nil, err
+	}
+	if mtime > 0 {
+		content, err := s.di.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		includes = parseIncludes(content)
+	}
+	s.mu.Lock()
+	s.includes[p] = includes
+	s.mu.Unlock()
+	return includes, nil
+}
+
+// resolve returns the path of the header inc included from a file in dir, or
+// "" if not found.
+func (s *includeScanner) resolve(inc cppInclude, dir string, dirs []string) string {
+	if path.IsAbs(inc.name) {
+		return s.exists(CanonicalizePath(inc.name))
+	}
+	if inc.quoted {
+		if p := s.exists(CanonicalizePath(path.Join(dir, inc.name))); p != "" {
+			return p
+		}
+	}
+	for _, d := range dirs {
+		if p := s.exists(CanonicalizePath(path.Join(d, inc.name))); p != "" {
+			return p
+		}
+	}
+	return ""
+}
+
+// exists returns p if it is a file or the output of an edge.
+func (s *includeScanner) exists(p string) string {
+	if n := s.state.Paths[p]; n != nil && n.InEdge != nil {
+		return p
+	}
+	if mtime, _ := s.di.Stat(p); mtime > 0 {
+		return p
+	}
+	return ""
+}
+
+// LoadScannedIncludes adds the headers found by scanning the sources of the
+// edges with "scan = cpp" as their implicit dependencies, so tools see them
+// without building, e.g. InputClosure().
+//
+// The build does the same as it visits the edges.
+func (s *State) LoadScannedIncludes(di FileSystem) error {
+	i := newImplicitDepLoader(s, nil, di)
+	for _, e := range s.Edges {
+		if e.DepsLoaded || e.GetBinding("scan") == "" || e.GetBinding("deps") != "" || e.GetUnescapedDepfile() != "" {
+			continue
+		}
+		e.DepsLoaded = true
+		if _, err := i.loadDeps(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseIncludes(t *testing.T) {
+	content := "#include \"a.h\"\n  #  include <b/c.h>\n#import \"d.h\"\n#include MACRO\n#include_next <e.h>\n#define X\nint i; // #include \"f.h\"\n#include \"g.h\" // comment"
+	want := []cppInclude{{"a.h", true}, {"b/c.h", false}, {"d.h", true}, {"g.h", true}}
+	if diff := cmp.Diff(want, parseIncludes([]byte(content)), cmp.AllowUnexported(cppInclude{})); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestIncludeDirs(t *testing.T) {
+	got := includeDirs("cc -Iinc -I other -isystem sys -iquote q /I\"win\" -DX -c a.c")
+	if diff := cmp.Diff([]string{"inc", "other", "sys", "q", "win"}, got); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestBuildTest_ScanIncludes(t *testing.T) {
+	b := NewBuildTest(t)
+	b.AssertParse(&b.state, "nin_features = scan\nrule cc\n  command = cc -Iinc -c $in -o $out\n  scan = cpp\nrule gen\n  command = gen $out\nbuild a.o: cc src/a.c\nbuild inc/gen.h: gen\n", ParseManifestOpts{})
+	b.fs.Create("src/a.c", "#include \"a.h\"\n#include <b.h>\n#include <stdio.h>\n#include \"gen.h\"\n")
+	b.fs.Create("src/a.h", "#include \"b.h\"\n")
+	b.fs.Create("inc/b.h", "#include \"a.h\"\n")
+	b.fs.Create("a.o", "")
+
+	if err := b.state.LoadScannedIncludes(&b.fs); err != nil {
+		t.Fatal(err)
+	}
+	e := b.state.Paths["a.o"].InEdge
+	var got []string
+	for _, n := range e.Inputs {
+		got = append(got, n.Path)
+	}
+	// stdio.h is not found. gen.h is not built yet but is an output.
+	want := []string{"src/a.c", "src/a.h", "inc/b.h", "inc/gen.h"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatal(diff)
+	}
+	if e.ImplicitDeps != 3 {
+		t.Fatal(e.ImplicitDeps)
+	}
+}
+
+func TestBuildTest_ScanIncludesRebuild(t *testing.T) {
+	b := NewBuildTest(t)
+	manifest := "nin_features = scan\nrule cc\n  command = cat $in > $out\n  scan = cpp\nbuild a.o: cc a.c\n"
+	b.fs.Create("a.c", "#include \"a.h\"\n")
+	b.fs.Create("a.h", "")
+	b.fs.Tick()
+	b.fs.Create("a.o", "")
+	b.RebuildTarget("a.o", manifest, "", "", nil)
+	if len(b.commandRunner.commandsRan) != 0 {
+		t.Fatal(b.commandRunner.commandsRan)
+	}
+
+	// Touching the header rebuilds.
+	b.fs.Tick()
+	b.fs.Create("a.h", "")
+	b.RebuildTarget("a.o", manifest, "", "", nil)
+	if diff := cmp.Diff([]string{"cat a.c > a.o"}, b.commandRunner.commandsRan); diff != "" {
+		t.Fatal(diff)
+	}
+}
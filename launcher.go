@@ -0,0 +1,134 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// LauncherConfig wraps the commands of some rules with a launcher, e.g.
+// gomacc or rewrapper, without changes to the manifest generator.
+//
+// It is read from a JSON file, e.g.:
+//
+//	{
+//	  "launchers": [
+//	    {
+//	      "rules": ["cc", "cxx"],
+//	      "command": "rewrapper -cfg=rewrapper.cfg",
+//	      "env": {"RBE_server_address": "unix:///tmp/reproxy.sock"},
+//	      "jobs": 200
+//	    }
+//	  ]
+//	}
+type LauncherConfig struct {
+	Launchers []Launcher `json:"launchers"`
+}
+
+// Launcher is a command prepended to the commands of a set of rules.
+type Launcher struct {
+	// Rules are the names of the rules whose commands are wrapped.
+	Rules []string `json:"rules"`
+	// Command is prepended to the commands. The commands of the rules must
+	// start with the program to run, e.g. the compiler.
+	Command string `json:"command"`
+	// Env are environment variables the launcher needs.
+	Env map[string]string `json:"env,omitempty"`
+	// Jobs, if not 0, is the number of wrapped commands that can run
+	// concurrently, independently of the local parallelism. See
+	// BuildConfig.RemoteParallelism.
+	Jobs int `json:"jobs,omitempty"`
+}
+
+// LoadLauncherConfig reads a LauncherConfig from a JSON file.
+func LoadLauncherConfig(path string) (*LauncherConfig, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	l := &LauncherConfig{}
+	if err := json.Unmarshal(raw, l); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	seen := map[string]struct{}{}
+	for i, launcher := range l.Launchers {
+		if strings.TrimSpace(launcher.Command) == "" {
+			return nil, fmt.Errorf("%s: launcher %d has no command", path, i)
+		}
+		for _, r := range launcher.Rules {
+			if _, ok := seen[r]; ok {
+				return nil, fmt.Errorf("%s: rule %s has multiple launchers", path, r)
+			}
+			seen[r] = struct{}{}
+		}
+	}
+	return l, nil
+}
+
+// Configure raises the parallelism of config for the launchers with Jobs
+// set, by making their rules remoteable.
+func (l *LauncherConfig) Configure(config *BuildConfig) {
+	for _, launcher := range l.Launchers {
+		if launcher.Jobs <= 0 {
+			continue
+		}
+		if config.RemoteableRules == nil {
+			config.RemoteableRules = map[string]bool{}
+		}
+		for _, r := range launcher.Rules {
+			config.RemoteableRules[r] = true
+		}
+		config.RemoteParallelism += launcher.Jobs
+	}
+}
+
+// Environ returns the environment variables of all the launchers as
+// "key=value" strings.
+func (l *LauncherConfig) Environ() []string {
+	var out []string
+	for _, launcher := range l.Launchers {
+		for k, v := range launcher.Env {
+			out = append(out, k+"="+v)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// BeforeEdge implements BuilderHooks.BeforeEdge. It wraps the command of the
+// edges of the configured rules.
+//
+// The commands recorded in the build log are the original ones, so adding or
+// removing a launcher doesn't rebuild anything.
+func (l *LauncherConfig) BeforeEdge(edge *Edge) EdgeDecision {
+	for _, launcher := range l.Launchers {
+		for _, r := range launcher.Rules {
+			if r != edge.Rule.Name {
+				continue
+			}
+			command := edge.EvaluateCommand(false)
+			if strings.HasPrefix(command, launcher.Command+" ") {
+				// The generator already wrapped the command.
+				return EdgeDecision{}
+			}
+			return EdgeDecision{Command: launcher.Command + " " + command}
+		}
+	}
+	return EdgeDecision{}
+}
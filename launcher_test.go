@@ -0,0 +1,75 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestBuildTest_Launchers(t *testing.T) {
+	b := NewBuildTest(t)
+	b.AssertParse(&b.state, "rule cc\n  command = cc $in > $out\nbuild cc1: cc in1\nbuild cc2: cc in2\n  command = wrap cc in2 > cc2\n", ParseManifestOpts{})
+	if err := ioutil.WriteFile("launchers.json", []byte(`{"launchers": [{"rules": ["cc"], "command": "wrap", "env": {"B": "2", "A": "1"}, "jobs": 100}]}`), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	l, err := LoadLauncherConfig("launchers.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"A=1", "B=2"}, l.Environ()); diff != "" {
+		t.Fatal(diff)
+	}
+	l.Configure(&b.config)
+	if b.config.RemoteParallelism != 100 || !b.config.RemoteableRules["cc"] {
+		t.Fatal(b.config)
+	}
+
+	b.builder.Hooks.BeforeEdge = l.BeforeEdge
+	for _, target := range []string{"cat1", "cc1", "cc2"} {
+		if _, err := b.builder.addTargetName(target); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.builder.Build(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"cat in1 > cat1", "wrap cc in1 > cc1", "wrap cc in2 > cc2"}
+	if diff := cmp.Diff(want, b.commandRunner.commandsRan); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestLoadLauncherConfig_Errors(t *testing.T) {
+	CreateTempDirAndEnter(t)
+	data := []struct {
+		in   string
+		want string
+	}{
+		{`{"launchers": [{"rules": ["cc"]}]}`, "l.json: launcher 0 has no command"},
+		{`{"launchers": [{"rules": ["cc"], "command": "a"}, {"rules": ["cc"], "command": "b"}]}`, "l.json: rule cc has multiple launchers"},
+		{`{`, "l.json: unexpected end of JSON input"},
+	}
+	for i, l := range data {
+		if err := ioutil.WriteFile("l.json", []byte(l.in), 0o666); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadLauncherConfig("l.json"); err == nil || err.Error() != l.want {
+			t.Fatalf("%d: %v", i, err)
+		}
+	}
+}
@@ -109,14 +109,7 @@ type lexerState struct {
 // error constructs an error message with context.
 func (l *lexerState) error(message, filename string, input []byte) error {
 	// Compute line/column.
-	line := lexerOffset(1)
-	lineStart := lexerOffset(0)
-	for p := lexerOffset(0); p < l.lastToken; p++ {
-		if input[p] == '\n' {
-			line++
-			lineStart = p + 1
-		}
-	}
+	line, lineStart := l.line(input)
 	col := lexerOffset(0)
 	if l.lastToken != -1 {
 		col = l.lastToken - lineStart
@@ -146,6 +139,20 @@ func (l *lexerState) error(message, filename string, input []byte) error {
 	return fmt.Errorf("%s:%d: %s\n%s", filename, line, message, c)
 }
 
+// line returns the line number of the last token and the offset of the
+// start of this line.
+func (l *lexerState) line(input []byte) (int, lexerOffset) {
+	line := 1
+	lineStart := lexerOffset(0)
+	for p := lexerOffset(0); p < l.lastToken; p++ {
+		if input[p] == '\n' {
+			line++
+			lineStart = p + 1
+		}
+	}
+	return line, lineStart
+}
+
 type lexer struct {
 	// Immutable.
 	filename string
@@ -163,6 +170,10 @@ func (l *lexer) Error(message string) error {
 // Start parsing some input.
 func (l *lexer) Start(filename string, input []byte) error {
 	l.filename = filename
+	if len(input) == 0 {
+		// FileReader.ReadFile doesn't add the trailing 0 byte to empty files.
+		input = []byte{0}
+	}
 	if input[len(input)-1] != 0 {
 		panic("Requires hack with a trailing 0 byte")
 	}
@@ -0,0 +1,53 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"os"
+)
+
+// LogSyncPolicy defines how the build log and the deps log are flushed to
+// the disk when closed.
+type LogSyncPolicy int32
+
+const (
+	// LogSyncNone leaves it to the OS to write the logs. This is what ninja
+	// does.
+	LogSyncNone LogSyncPolicy = iota
+	// LogSyncFsync calls fsync(). On macOS, the drive may still lose the data
+	// on power loss as its cache isn't flushed.
+	LogSyncFsync
+	// LogSyncFull also flushes the cache of the drive, with fcntl(F_FULLFSYNC)
+	// on macOS. It is the same as LogSyncFsync on other OSes.
+	LogSyncFull
+)
+
+// ParseLogSyncPolicy parses "none", "fsync" or "full".
+func ParseLogSyncPolicy(s string) (LogSyncPolicy, error) {
+	i, err := parseEnum("log sync policy", s, logSyncNames)
+	return LogSyncPolicy(i), err
+}
+
+// syncLog flushes f to the disk according to policy.
+func syncLog(f *os.File, policy LogSyncPolicy) error {
+	switch policy {
+	case LogSyncFsync:
+		return f.Sync()
+	case LogSyncFull:
+		return fullFsync(f)
+	default:
+		return nil
+	}
+}
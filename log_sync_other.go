@@ -1,10 +1,10 @@
-// Copyright 2019 Google Inc. All Rights Reserved.
+// Copyright 2022 Google LLC
 //
 // Licensed under the Apache License, Version 2.0 (the "License");
 // you may not use this file except in compliance with the License.
 // You may obtain a copy of the License at
 //
-//     http://www.apache.org/licenses/LICENSE-2.0
+//      http://www.apache.org/licenses/LICENSE-2.0
 //
 // Unless required by applicable law or agreed to in writing, software
 // distributed under the License is distributed on an "AS IS" BASIS,
@@ -12,14 +12,14 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
+//go:build !darwin
+// +build !darwin
+
 package nin
 
-// LoadStatus is the return code when loading a build log or a deps log.
-type LoadStatus int32
+import "os"
 
-// Valid LoadStatus values.
-const (
-	LoadError LoadStatus = iota
-	LoadSuccess
-	LoadNotFound
-)
+// fullFsync flushes f. fsync() already flushes the cache of the drive.
+func fullFsync(f *os.File) error {
+	return f.Sync()
+}
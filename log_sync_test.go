@@ -0,0 +1,53 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestParseLogSyncPolicy(t *testing.T) {
+	for s, want := range map[string]LogSyncPolicy{"none": LogSyncNone, "fsync": LogSyncFsync, "full": LogSyncFull} {
+		if got, err := ParseLogSyncPolicy(s); err != nil || got != want {
+			t.Fatal(s, got, err)
+		}
+	}
+	if _, err := ParseLogSyncPolicy("always"); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestLogSync(t *testing.T) {
+	b := NewBuildLogTest(t)
+	dir := t.TempDir()
+	for _, p := range []LogSyncPolicy{LogSyncFsync, LogSyncFull} {
+		log := NewBuildLog()
+		log.Sync = p
+		if err := log.OpenForWrite(filepath.Join(dir, ".ninja_log"), b); err != nil {
+			t.Fatal(err)
+		}
+		if err := log.Close(); err != nil {
+			t.Fatal(err)
+		}
+		deps := DepsLog{Sync: p}
+		if err := deps.OpenForWrite(filepath.Join(dir, ".ninja_deps")); err != nil {
+			t.Fatal(err)
+		}
+		if err := deps.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
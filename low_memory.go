@@ -0,0 +1,82 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+// DisableMemoization trades speed for a smaller memory footprint: the
+// evaluated bindings and commands of the edges are not memoized and are
+// instead evaluated every time they are needed.
+//
+// It is called by NewBuilder when BuildConfig.LowMemory is set.
+func (s *State) DisableMemoization() {
+	s.noMemoize = true
+	for _, e := range s.Edges {
+		e.invalidateBindings()
+		e.noMemoize = true
+	}
+}
+
+// Compact reduces the memory used by the graph once the manifest is loaded.
+//
+// The input, output and validation slices of all the edges are moved into a
+// single array, and the same is done for the out edges of the nodes. This
+// removes the spare capacity left by the appends while parsing and the
+// per-slice allocation overhead. The slices have no spare capacity, so
+// appending to them later, e.g. when loading a dyndep file, reallocates them.
+func (s *State) Compact() {
+	if cap(s.Edges) != len(s.Edges) {
+		s.Edges = append(make([]*Edge, 0, len(s.Edges)), s.Edges...)
+	}
+	total := 0
+	for _, e := range s.Edges {
+		total += len(e.Inputs) + len(e.Outputs) + len(e.Validations)
+	}
+	nodes := make([]*Node, 0, total)
+	for _, e := range s.Edges {
+		e.Inputs, nodes = compactNodes(e.Inputs, nodes)
+		e.Outputs, nodes = compactNodes(e.Outputs, nodes)
+		e.Validations, nodes = compactNodes(e.Validations, nodes)
+	}
+
+	total = 0
+	for _, n := range s.Paths {
+		total += len(n.OutEdges) + len(n.ValidationOutEdges)
+	}
+	edges := make([]*Edge, 0, total)
+	for _, n := range s.Paths {
+		n.OutEdges, edges = compactEdges(n.OutEdges, edges)
+		n.ValidationOutEdges, edges = compactEdges(n.ValidationOutEdges, edges)
+	}
+}
+
+// compactNodes copies src at the end of arena and returns the copy, with no
+// spare capacity, and the grown arena.
+func compactNodes(src, arena []*Node) ([]*Node, []*Node) {
+	if len(src) == 0 {
+		return nil, arena
+	}
+	start := len(arena)
+	arena = append(arena, src...)
+	return arena[start:len(arena):len(arena)], arena
+}
+
+// compactEdges is compactNodes for edges.
+func compactEdges(src, arena []*Edge) ([]*Edge, []*Edge) {
+	if len(src) == 0 {
+		return nil, arena
+	}
+	start := len(arena)
+	arena = append(arena, src...)
+	return arena[start:len(arena):len(arena)], arena
+}
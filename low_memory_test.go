@@ -0,0 +1,63 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import "testing"
+
+func TestState_Compact(t *testing.T) {
+	s := NewStateTestWithBuiltinRules(t)
+	s.AssertParse(&s.state, "build a b: cat in1 in2 | imp || oo\nbuild c: cat a in1 |@ b\nbuild d: cat c\n", ParseManifestOpts{})
+	s.state.Compact()
+	verifyGraph(t, &s.state)
+
+	e := s.GetNode("a").InEdge
+	if len(e.Inputs) != 4 || cap(e.Inputs) != 4 || len(e.Outputs) != 2 || cap(e.Outputs) != 2 {
+		t.Fatal(e.Inputs, e.Outputs)
+	}
+	if got := e.EvaluateCommand(false); got != "cat in1 in2 > a b" {
+		t.Fatal(got)
+	}
+	// Appending must not overwrite the slice of another edge.
+	c := s.GetNode("c").InEdge
+	e.Inputs = append(e.Inputs, s.GetNode("x"))
+	if c.Inputs[0] != s.GetNode("a") || c.Inputs[1] != s.GetNode("in1") {
+		t.Fatal(c.Inputs)
+	}
+	if n := s.GetNode("in1"); len(n.OutEdges) != 2 || cap(n.OutEdges) != 2 {
+		t.Fatal(n.OutEdges)
+	}
+	if n := s.GetNode("b"); len(n.ValidationOutEdges) != 1 || n.ValidationOutEdges[0] != c {
+		t.Fatal(n.ValidationOutEdges)
+	}
+}
+
+func TestLowMemory(t *testing.T) {
+	s := NewStateTestWithBuiltinRules(t)
+	s.AssertParse(&s.state, "build out: cat in\n", ParseManifestOpts{})
+	e := s.state.Edges[0]
+	e.GetBinding("command")
+	config := NewBuildConfig()
+	config.LowMemory = true
+	NewBuilder(&s.state, &config, nil, nil, nil, &statusFake{}, 0)
+	if got := e.EvaluateCommand(false); got != "cat in > out" {
+		t.Fatal(got)
+	}
+	if cmd, _ := e.logCommand(nil); cmd != "cat in > out" {
+		t.Fatal(cmd)
+	}
+	if e.bindings != nil || e.logCmdValid {
+		t.Fatal("expected no memoization")
+	}
+}
@@ -14,6 +14,8 @@
 
 package nin
 
+import "sync"
+
 // ParseManifestConcurrency defines the concurrency parameters when parsing
 // manifest (build.ninja files).
 type ParseManifestConcurrency int32
@@ -58,12 +60,34 @@ type ParseManifestOpts struct {
 	Quiet bool
 	// Concurrency defines the parsing concurrency.
 	Concurrency ParseManifestConcurrency
+	// DisableExtensions rejects the nin specific syntax, e.g. "defaultgroup"
+	// or the "batch" rule binding, the same way ninja does.
+	DisableExtensions bool
 }
 
 // ParseManifest parses a manifest file (i.e. build.ninja).
 //
 // The input must contain a trailing terminating zero byte.
+//
+// The files loaded via include and subninja statements are recorded in
+// state.ManifestFiles.
 func ParseManifest(state *State, fr FileReader, options ParseManifestOpts, filename string, input []byte) error {
+	if state.Bindings.Filename == "" {
+		state.Bindings.Filename = filename
+	}
+	if fr == nil {
+		return parseManifest(state, fr, options, filename, input)
+	}
+	r := manifestFilesRecorder{fr: fr}
+	err := parseManifest(state, &r, options, filename, input)
+	state.addManifestFiles(r.paths)
+	return err
+}
+
+func parseManifest(state *State, fr FileReader, options ParseManifestOpts, filename string, input []byte) error {
+	if !options.DisableExtensions {
+		addHostBindings(state.Bindings)
+	}
 	if options.Concurrency != ParseManifestConcurrentParsing {
 		m := manifestParserSerial{
 			fr:      fr,
@@ -75,6 +99,7 @@ func ParseManifest(state *State, fr FileReader, options ParseManifestOpts, filen
 	}
 	m := manifestParserConcurrent{
 		manifestParserRoutine: manifestParserRoutine{
+			disableExtensions: options.DisableExtensions,
 			manifestParserContext: manifestParserContext{
 				env: state.Bindings,
 				doneParsing: barrier{
@@ -91,6 +116,29 @@ func ParseManifest(state *State, fr FileReader, options ParseManifestOpts, filen
 	return m.parseMain(filename, input)
 }
 
+// newScope returns the environment of a subninja.
+func newScope(parent *BindingEnv, filename string) *BindingEnv {
+	env := NewBindingEnv(parent)
+	env.Filename = filename
+	return env
+}
+
+// manifestFilesRecorder is a FileReader recording the files read.
+//
+// It is safe for concurrent use, as subninja files may be read concurrently.
+type manifestFilesRecorder struct {
+	fr    FileReader
+	mu    sync.Mutex
+	paths []string
+}
+
+func (m *manifestFilesRecorder) ReadFile(path string) ([]byte, error) {
+	m.mu.Lock()
+	m.paths = append(m.paths, path)
+	m.mu.Unlock()
+	return m.fr.ReadFile(path)
+}
+
 // subninja is a struct used to manage parallel reading of subninja files.
 type subninja struct {
 	filename string
@@ -112,3 +160,19 @@ func readSubninjaAsync(fr FileReader, filename string, ch chan<- subninja, ls le
 		env:      env,
 	}
 }
+
+// readDefaultGroup returns true if the IDENT token that was just read starts a
+// "defaultgroup" statement, in which case the lexer is positioned after the
+// keyword. Otherwise the lexer is left untouched.
+//
+// "defaultgroup" is not a keyword of the lexer so that it can still be used as
+// a variable name.
+func (l *lexer) readDefaultGroup() bool {
+	saved := l.lexerState
+	l.UnreadToken()
+	if l.readIdent() == "defaultgroup" && !l.PeekToken(EQUALS) {
+		return true
+	}
+	l.lexerState = saved
+	return false
+}
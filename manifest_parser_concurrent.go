@@ -27,6 +27,9 @@ type manifestParserConcurrent struct {
 
 // manifestParserRoutine is the state of the parsing goroutine.
 type manifestParserRoutine struct {
+	// Immutable.
+	disableExtensions bool
+
 	// Mutable.
 	lexer lexer
 	manifestParserContext
@@ -220,7 +223,11 @@ loop:
 			array[index], err = m.parseDefault()
 			index++
 		case IDENT:
-			array[index], err = m.parseIdent()
+			if !m.disableExtensions && m.lexer.readDefaultGroup() {
+				array[index], err = m.parseDefaultGroup()
+			} else {
+				array[index], err = m.parseIdent()
+			}
 			index++
 		case INCLUDE:
 			array[index], err = m.parseInclude()
@@ -296,6 +303,8 @@ func (m *manifestParserState) process(actions chan actionBatch) error {
 				err = m.processRule(d)
 			case dataDefault:
 				err = m.processDefault(d)
+			case dataDefaultGroup:
+				err = m.processDefaultGroup(d)
 			case dataIdent:
 				err = m.processIdent(d)
 			case dataInclude:
@@ -329,7 +338,7 @@ func (m *manifestParserRoutine) parsePool() (dataPool, error) {
 	if err := m.expectToken(NEWLINE); err != nil {
 		return d, err
 	}
-	d.ls = m.lexer.lexerState
+	d.ls = m.lexer
 	for m.lexer.PeekToken(INDENT) {
 		key := ""
 		var err error
@@ -351,16 +360,20 @@ func (m *manifestParserRoutine) parsePool() (dataPool, error) {
 
 // processPool updates m.state with a parsed pool statement.
 func (m *manifestParserState) processPool(d dataPool) error {
-	if m.state.Pools[d.name] != nil {
-		// TODO(maruel): Use %q for real quoting.
-		return m.error(fmt.Sprintf("duplicate pool '%s'", d.name), d.ls)
+	// The pool may have been declared in an included or subninja file, so use
+	// its own lexer for errors.
+	if c := m.state.poolConflict(d.env, d.name, !m.options.DisableExtensions); c != nil {
+		return d.ls.Error(duplicatePoolMessage(d.name, c, m.options.DisableExtensions))
 	}
 	// TODO(maruel): Do we want to use ParseInt() here? Aka support hex.
 	depth, err := strconv.Atoi(d.eval.Evaluate(d.env))
 	if depth < 0 || err != nil {
-		return m.error("invalid pool depth", d.dls)
+		return d.dls.error("invalid pool depth", d.ls.filename, d.ls.input)
 	}
-	m.state.Pools[d.name] = NewPool(d.name, depth)
+	pool := NewPool(d.name, depth)
+	pool.Filename = d.ls.filename
+	pool.Line, _ = d.ls.line(d.ls.input)
+	m.state.addPool(d.env, pool)
 	return nil
 }
 
@@ -376,13 +389,19 @@ func (m *manifestParserRoutine) parseRule() (dataRule, error) {
 	}
 	d.ls = m.lexer
 	d.rule = NewRule(name)
+	d.rule.Filename = m.lexer.filename
 	for m.lexer.PeekToken(INDENT) {
+		// Point at the binding's name.
+		ls := m.lexer.lexerState
+		ls.lastToken = ls.ofs
 		key, value, err := m.parseLet()
 		if err != nil {
 			return d, err
 		}
+		d.names = append(d.names, key)
+		d.lets = append(d.lets, ls)
 
-		if !IsReservedBinding(key) {
+		if !IsReservedBinding(key) || (m.disableExtensions && isNinBinding(key)) {
 			// Die on other keyvals for now; revisit if we want to add a
 			// scope here.
 			// TODO(maruel): Use %q for real quoting.
@@ -410,6 +429,11 @@ func (m *manifestParserState) processRule(d dataRule) error {
 		// TODO(maruel): Use %q for real quoting.
 		return d.ls.Error(fmt.Sprintf("duplicate rule '%s'", d.rule.Name))
 	}
+	if !m.options.DisableExtensions {
+		if i, err := requireNinBindings(d.env, d.names); err != nil {
+			return d.lets[i].error(err.Error(), d.ls.filename, d.ls.input)
+		}
+	}
 	d.env.Rules[d.rule.Name] = d.rule
 	return nil
 }
@@ -452,6 +476,51 @@ func (m *manifestParserState) processDefault(d dataDefault) error {
 	return nil
 }
 
+// parseDefaultGroup parses a "defaultgroup" statement.
+func (m *manifestParserRoutine) parseDefaultGroup() (dataDefaultGroup, error) {
+	d := dataDefaultGroup{env: m.env, ls: m.lexer}
+	d.name = m.lexer.readIdent()
+	if d.name == "" {
+		return d, m.lexer.Error("expected group name")
+	}
+	if err := m.expectToken(COLON); err != nil {
+		return d, err
+	}
+	for {
+		eval, err := m.lexer.readEvalString(true)
+		if err != nil {
+			return d, err
+		}
+		if len(eval.Parsed) == 0 {
+			break
+		}
+		d.evals = append(d.evals, &parsedEval{eval, m.lexer})
+	}
+	if len(d.evals) == 0 {
+		return d, m.lexer.Error("expected target name")
+	}
+	return d, m.expectToken(NEWLINE)
+}
+
+// processDefaultGroup updates m.state with a parsed defaultgroup statement.
+func (m *manifestParserState) processDefaultGroup(d dataDefaultGroup) error {
+	if err := requireNinFeature(d.env, "defaultgroup"); err != nil {
+		return d.ls.Error(err.Error())
+	}
+	paths := make([]string, 0, len(d.evals))
+	for _, e := range d.evals {
+		path := e.eval.Evaluate(d.env)
+		if len(path) == 0 {
+			return e.ls.Error("empty path")
+		}
+		paths = append(paths, CanonicalizePath(path))
+	}
+	if err := m.state.addDefaultGroup(d.name, paths); err != nil {
+		return d.evals[len(d.evals)-1].ls.Error(err.Error())
+	}
+	return nil
+}
+
 // parseIdent parses a generic statement as a fallback.
 func (m *manifestParserRoutine) parseIdent() (dataIdent, error) {
 	d := dataIdent{env: m.env}
@@ -470,6 +539,18 @@ func (m *manifestParserState) processIdent(d dataIdent) error {
 		if err := checkNinjaVersion(value); err != nil {
 			return err
 		}
+	} else if d.name == "nin_required_version" && !m.options.DisableExtensions {
+		if err := checkNinVersion(value); err != nil {
+			return err
+		}
+	} else if d.name == "nin_features" && !m.options.DisableExtensions {
+		if err := checkNinFeatures(value); err != nil {
+			return err
+		}
+	} else if d.name == "outroot" && !m.options.DisableExtensions {
+		if err := requireNinFeature(d.env, d.name); err != nil {
+			return err
+		}
 	}
 	d.env.Bindings[d.name] = value
 	return nil
@@ -585,11 +666,14 @@ func (m *manifestParserRoutine) parseEdge() (dataEdge, error) {
 	d.hadIndentToken = m.lexer.PeekToken(INDENT)
 	// Accumulate the bindings for now, will process them later.
 	for h := d.hadIndentToken; h; h = m.lexer.PeekToken(INDENT) {
+		// Point at the binding's name.
+		ls := m.lexer.lexerState
+		ls.lastToken = ls.ofs
 		key, val, err := m.parseLet()
 		if err != nil {
 			return d, err
 		}
-		d.bindings = append(d.bindings, &keyEval{key, val})
+		d.bindings = append(d.bindings, &keyEval{key, val, ls})
 	}
 	d.lsEnd = m.lexer.lexerState
 	return d, nil
@@ -597,24 +681,39 @@ func (m *manifestParserRoutine) parseEdge() (dataEdge, error) {
 
 // processEdge updates m.state with a parsed edge statement.
 func (m *manifestParserState) processEdge(d dataEdge) error {
-	rule := d.env.LookupRule(d.ruleName)
+	rule := lookupRule(d.env, d.ruleName, m.options.DisableExtensions)
 	if rule == nil {
 		// TODO(maruel): Use %q for real quoting.
 		return d.lsRule.Error(fmt.Sprintf("unknown build rule '%s'", d.ruleName))
 	}
+	if isBuiltinRule(rule) {
+		if err := requireNinFeature(d.env, rule.Name); err != nil {
+			return d.lsRule.Error(err.Error())
+		}
+	}
 	env := d.env
 	if d.hadIndentToken {
 		env = NewBindingEnv(d.env)
 	}
+	names := make([]string, 0, len(d.bindings))
 	for _, i := range d.bindings {
 		env.Bindings[i.key] = i.eval.Evaluate(d.env)
+		names = append(names, i.key)
+	}
+	if !m.options.DisableExtensions {
+		if i, err := requireNinBindings(d.env, names); err != nil {
+			return d.bindings[i].ls.error(err.Error(), d.lsRule.filename, d.lsRule.input)
+		}
 	}
 
 	edge := m.state.addEdge(rule)
 	edge.Env = env
+	if !m.options.DisableExtensions && m.state.skipEdge(edge, d.outs, env) {
+		return nil
+	}
 
-	if poolName := edge.GetBinding("pool"); poolName != "" {
-		pool := m.state.Pools[poolName]
+	if poolName := edge.evalBinding("pool"); poolName != "" {
+		pool := m.state.lookupPool(d.env, poolName)
 		if pool == nil {
 			// TODO(maruel): Use %q for real quoting.
 			return d.lsEnd.error(fmt.Sprintf("unknown pool name '%s'", poolName), d.lsRule.filename, d.lsRule.input)
@@ -743,6 +842,7 @@ func (m *manifestParserState) processInclude(d dataInclude) error {
 	// statement is inside a subninja.
 	subparser := manifestParserConcurrent{
 		manifestParserRoutine: manifestParserRoutine{
+			disableExtensions: m.options.DisableExtensions,
 			manifestParserContext: manifestParserContext{
 				env: d.env,
 				doneParsing: barrier{
@@ -811,10 +911,11 @@ func (m *manifestParserState) processSubninjaReal(filename string, d dataSubninj
 	if err == nil {
 		subparser := manifestParserConcurrent{
 			manifestParserRoutine: manifestParserRoutine{
+				disableExtensions: m.options.DisableExtensions,
 				manifestParserContext: manifestParserContext{
 					// Reset the binding fresh with a temporary one that will not affect the
 					// root one.
-					env: NewBindingEnv(d.context.env),
+					env: newScope(d.context.env, filename),
 					doneParsing: barrier{
 						want: make(chan struct{}),
 					},
@@ -863,10 +964,11 @@ func (m *manifestParserState) error(msg string, ls lexerState) error {
 }
 
 type dataPool struct {
-	env     *BindingEnv
-	name    string
-	eval    EvalString
-	ls, dls lexerState
+	env  *BindingEnv
+	name string
+	eval EvalString
+	ls   lexer
+	dls  lexerState
 }
 
 type dataEdge struct {
@@ -885,6 +987,9 @@ type dataRule struct {
 	env  *BindingEnv
 	rule *Rule
 	ls   lexer
+	// names and lets are the bindings in order and their position.
+	names []string
+	lets  []lexerState
 }
 
 type dataDefault struct {
@@ -892,6 +997,13 @@ type dataDefault struct {
 	evals []*parsedEval
 }
 
+type dataDefaultGroup struct {
+	env   *BindingEnv
+	name  string
+	evals []*parsedEval
+	ls    lexer
+}
+
 type dataIdent struct {
 	env  *BindingEnv
 	name string
@@ -918,4 +1030,5 @@ type parsedEval struct {
 type keyEval struct {
 	key  string
 	eval EvalString
+	ls   lexerState
 }
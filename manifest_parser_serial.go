@@ -59,7 +59,11 @@ loop:
 		case DEFAULT:
 			err = m.parseDefault()
 		case IDENT:
-			err = m.parseIdent()
+			if !m.options.DisableExtensions && m.lexer.readDefaultGroup() {
+				err = m.parseDefaultGroup()
+			} else {
+				err = m.parseIdent()
+			}
 		case INCLUDE:
 			err = m.parseInclude()
 		case SUBNINJA:
@@ -100,10 +104,10 @@ func (m *manifestParserSerial) parsePool() error {
 	if err := m.expectToken(NEWLINE); err != nil {
 		return err
 	}
+	line, _ := m.lexer.line(m.lexer.input)
 
-	if m.state.Pools[name] != nil {
-		// TODO(maruel): Use %q for real quoting.
-		return m.lexer.Error(fmt.Sprintf("duplicate pool '%s'", name))
+	if c := m.state.poolConflict(m.env, name, !m.options.DisableExtensions); c != nil {
+		return m.lexer.Error(duplicatePoolMessage(name, c, m.options.DisableExtensions))
 	}
 
 	depth := -1
@@ -127,7 +131,10 @@ func (m *manifestParserSerial) parsePool() error {
 		return m.lexer.Error("expected 'depth =' line")
 	}
 
-	m.state.Pools[name] = NewPool(name, depth)
+	pool := NewPool(name, depth)
+	pool.Filename = m.lexer.filename
+	pool.Line = line
+	m.state.addPool(m.env, pool)
 	return nil
 }
 
@@ -148,19 +155,28 @@ func (m *manifestParserSerial) parseRule() error {
 	}
 
 	rule := NewRule(name)
+	rule.Filename = m.lexer.filename
+	// The position of each binding, to report the nin extensions not opted in.
+	var names []string
+	var lets []lexer
 	for m.lexer.PeekToken(INDENT) {
+		// Point at the binding's name.
+		let := m.lexer
+		let.lastToken = let.ofs
+		lets = append(lets, let)
 		key, value, err := m.parseLet()
 		if err != nil {
 			return err
 		}
 
-		if !IsReservedBinding(key) {
+		if !IsReservedBinding(key) || (m.options.DisableExtensions && isNinBinding(key)) {
 			// Die on other keyvals for now; revisit if we want to add a
 			// scope here.
 			// TODO(maruel): Use %q for real quoting.
 			return m.lexer.Error(fmt.Sprintf("unexpected variable '%s'", key))
 		}
 		rule.Bindings[key] = &value
+		names = append(names, key)
 	}
 
 	b1, ok1 := rule.Bindings["rspfile"]
@@ -173,6 +189,11 @@ func (m *manifestParserSerial) parseRule() error {
 	if !ok || len(b.Parsed) == 0 {
 		return m.lexer.Error("expected 'command =' line")
 	}
+	if !m.options.DisableExtensions {
+		if i, err := requireNinBindings(m.env, names); err != nil {
+			return lets[i].Error(err.Error())
+		}
+	}
 	m.env.Rules[rule.Name] = rule
 	return nil
 }
@@ -209,6 +230,42 @@ func (m *manifestParserSerial) parseDefault() error {
 	return m.expectToken(NEWLINE)
 }
 
+// parseDefaultGroup parses a "defaultgroup" statement.
+func (m *manifestParserSerial) parseDefaultGroup() error {
+	if err := requireNinFeature(m.env, "defaultgroup"); err != nil {
+		return m.lexer.Error(err.Error())
+	}
+	name := m.lexer.readIdent()
+	if name == "" {
+		return m.lexer.Error("expected group name")
+	}
+	if err := m.expectToken(COLON); err != nil {
+		return err
+	}
+	var paths []string
+	for {
+		eval, err := m.lexer.readEvalString(true)
+		if err != nil {
+			return err
+		}
+		if len(eval.Parsed) == 0 {
+			break
+		}
+		path := eval.Evaluate(m.env)
+		if len(path) == 0 {
+			return m.lexer.Error("empty path")
+		}
+		paths = append(paths, CanonicalizePath(path))
+	}
+	if len(paths) == 0 {
+		return m.lexer.Error("expected target name")
+	}
+	if err := m.state.addDefaultGroup(name, paths); err != nil {
+		return m.lexer.Error(err.Error())
+	}
+	return m.expectToken(NEWLINE)
+}
+
 // parseIdent parses a generic statement as a fallback.
 func (m *manifestParserSerial) parseIdent() error {
 	m.lexer.UnreadToken()
@@ -223,6 +280,18 @@ func (m *manifestParserSerial) parseIdent() error {
 		if err := checkNinjaVersion(value); err != nil {
 			return err
 		}
+	} else if name == "nin_required_version" && !m.options.DisableExtensions {
+		if err := checkNinVersion(value); err != nil {
+			return err
+		}
+	} else if name == "nin_features" && !m.options.DisableExtensions {
+		if err := checkNinFeatures(value); err != nil {
+			return err
+		}
+	} else if name == "outroot" && !m.options.DisableExtensions {
+		if err := requireNinFeature(m.env, name); err != nil {
+			return err
+		}
 	}
 	m.env.Bindings[name] = value
 	return nil
@@ -272,11 +341,16 @@ func (m *manifestParserSerial) parseEdge() error {
 		return m.lexer.Error("expected build command name")
 	}
 
-	rule := m.env.LookupRule(ruleName)
+	rule := lookupRule(m.env, ruleName, m.options.DisableExtensions)
 	if rule == nil {
 		// TODO(maruel): Use %q for real quoting.
 		return m.lexer.Error(fmt.Sprintf("unknown build rule '%s'", ruleName))
 	}
+	if isBuiltinRule(rule) {
+		if err := requireNinFeature(m.env, rule.Name); err != nil {
+			return m.lexer.Error(err.Error())
+		}
+	}
 
 	var ins []EvalString
 	for {
@@ -348,22 +422,37 @@ func (m *manifestParserSerial) parseEdge() error {
 	if hasIndentToken {
 		env = NewBindingEnv(m.env)
 	}
+	var names []string
+	var lets []lexer
 	for hasIndentToken {
+		// Point at the binding's name.
+		let := m.lexer
+		let.lastToken = let.ofs
+		lets = append(lets, let)
 		key, val, err := m.parseLet()
 		if err != nil {
 			return err
 		}
 
 		env.Bindings[key] = val.Evaluate(m.env)
+		names = append(names, key)
 		hasIndentToken = m.lexer.PeekToken(INDENT)
 	}
+	if !m.options.DisableExtensions {
+		if i, err := requireNinBindings(m.env, names); err != nil {
+			return lets[i].Error(err.Error())
+		}
+	}
 
 	edge := m.state.addEdge(rule)
 	edge.Env = env
+	if !m.options.DisableExtensions && m.state.skipEdge(edge, outs, env) {
+		return nil
+	}
 
-	poolName := edge.GetBinding("pool")
+	poolName := edge.evalBinding("pool")
 	if poolName != "" {
-		pool := m.state.Pools[poolName]
+		pool := m.state.lookupPool(m.env, poolName)
 		if pool == nil {
 			// TODO(maruel): Use %q for real quoting.
 			return m.lexer.Error(fmt.Sprintf("unknown pool name '%s'", poolName))
@@ -559,7 +648,7 @@ func (m *manifestParserSerial) processOneSubninja(filename string, input []byte,
 		state:   m.state,
 		// Reset the binding fresh with a temporary one that will not affect the
 		// root one.
-		env: NewBindingEnv(env),
+		env: newScope(env, filename),
 	}
 	// Do not wrap error inside the subninja.
 	return subparser.parse(filename, input)
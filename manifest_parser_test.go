@@ -21,6 +21,7 @@ import (
 	"runtime"
 	"sort"
 	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
@@ -96,6 +97,26 @@ func TestParserTest_Rules(t *testing.T) {
 	}
 }
 
+func TestParserTest_RuleFilename(t *testing.T) {
+	for _, c := range concurrencyVals {
+		t.Run(c.String(), func(t *testing.T) {
+			p := NewParserTest(t, c)
+			p.fs.Create("sub.ninja", "rule sub\n  command = sub\nbuild out: sub\n")
+			p.assertParse("rule cat\n  command = cat $in > $out\nsubninja sub.ninja\n")
+
+			if got := p.state.Bindings.Rules["cat"].Filename; got != "input" {
+				t.Fatal(got)
+			}
+			if got := p.state.Bindings.Rules["phony"].Filename; got != "" {
+				t.Fatal(got)
+			}
+			if got := p.state.Paths["out"].InEdge.Rule.Filename; got != "sub.ninja" {
+				t.Fatal(got)
+			}
+		})
+	}
+}
+
 func TestParserTest_RuleAttributes(t *testing.T) {
 	for _, c := range concurrencyVals {
 		t.Run(c.String(), func(t *testing.T) {
@@ -745,6 +766,46 @@ func TestParserTest_Errors(t *testing.T) {
 			"rule touch\n  command = touch $out\nbuild result: touch\n  dyndep = notin\n",
 			"input:5: dyndep 'notin' is not an input\n",
 		},
+		{
+			"rule r\n  command = r\nbuild b: r\ndefaultgroup g: b\n",
+			"input:4: defaultgroup requires 'nin_features = defaultgroup' or nin_required_version = 1.0 or later\ndefaultgroup g: b\n             ^ near here",
+		},
+		{
+			"rule r\n  command = r\n  batch = 2\nbuild b: r\n",
+			"input:3: batch requires 'nin_features = batch' or nin_required_version = 1.0 or later\n  batch = 2\n  ^ near here",
+		},
+		{
+			"rule r\n  command = r\nbuild b: r\n  cwd = src\n",
+			"input:4: cwd requires 'nin_features = cwd' or nin_required_version = 1.0 or later\n  cwd = src\n  ^ near here",
+		},
+		{
+			"build b: copy a\n",
+			"input:1: copy requires 'nin_features = copy' or nin_required_version = 1.0 or later\nbuild b: copy a\n         ^ near here",
+		},
+		{
+			"outroot = out\n",
+			"outroot requires 'nin_features = outroot' or nin_required_version = 1.0 or later",
+		},
+		{
+			"nin_required_version = 1.0\ndefaultgroup g: nonexistent\n",
+			"input:2: unknown target 'nonexistent'\ndefaultgroup g: nonexistent\n                           ^ near here",
+		},
+		{
+			"nin_required_version = 1.0\nrule r\n  command = r\nbuild b: r\ndefaultgroup g: b\ndefaultgroup g: b\n",
+			"input:6: duplicate defaultgroup 'g'\ndefaultgroup g: b\n                 ^ near here",
+		},
+		{
+			"nin_required_version = 99.0\n",
+			"nin version (1.0) incompatible with build file nin_required_version version (99.0)",
+		},
+		{
+			"nin_features = defaultgroup teleport\n",
+			"nin version (1.0) doesn't support build file nin_features: teleport; please update nin",
+		},
+		{
+			"ninja_required_version = 99.0\n",
+			"ninja version (" + NinjaVersion + ") incompatible with build file ninja_required_version version (99.0)",
+		},
 	}
 	for i, line := range data {
 		t.Run(strconv.Itoa(i), func(t *testing.T) {
@@ -777,7 +838,7 @@ func TestParserTest_Errors(t *testing.T) {
 				if c == ParseManifestConcurrentParsing {
 					in = "pool foo\n  depth = 4\npool foo\n  depth = 4\n"
 				}
-				want := "input:3: duplicate pool 'foo'\npool foo\n        ^ near here"
+				want := "input:3: duplicate pool 'foo', previously declared at input:1\npool foo\n        ^ near here"
 				if err := p.parseTest(in, opts); err == nil {
 					t.Fatal("expected error")
 				} else if err.Error() != want {
@@ -1189,6 +1250,122 @@ func TestParserTest_DefaultStatements(t *testing.T) {
 	}
 }
 
+func TestParserTest_DefaultGroup(t *testing.T) {
+	for _, c := range concurrencyVals {
+		t.Run(c.String(), func(t *testing.T) {
+			p := NewParserTest(t, c)
+			p.assertParse("nin_required_version = 1.0\nrule cat\n  command = cat $in > $out\nbuild a: cat foo\nbuild b: cat foo\nbuild c: cat foo\ndefaultgroup = c\ndefaultgroup presubmit: a $defaultgroup\ndefault b\n")
+
+			var got []string
+			for _, n := range p.state.Groups["presubmit"] {
+				got = append(got, n.Path)
+			}
+			if diff := cmp.Diff([]string{"a", "c"}, got); diff != "" {
+				t.Fatal(diff)
+			}
+			if len(p.state.DefaultNodes()) != 1 {
+				t.Fatal("expected the group to not change the defaults")
+			}
+		})
+	}
+}
+
+func TestParserTest_NinjaRequiredVersionNotNumeric(t *testing.T) {
+	// Like ninja, it is parsed as 0.0 and only warns.
+	for _, c := range concurrencyVals {
+		t.Run(c.String(), func(t *testing.T) {
+			p := NewParserTest(t, c)
+			p.assertParse("ninja_required_version = latest\n")
+		})
+	}
+}
+
+func TestParserTest_NinFeatures(t *testing.T) {
+	for _, c := range concurrencyVals {
+		t.Run(c.String(), func(t *testing.T) {
+			p := NewParserTest(t, c)
+			p.assertParse("ninja_required_version = 1.10\nnin_features = defaultgroup\nrule cat\n  command = cat $in > $out\nbuild a: cat foo\ndefaultgroup g: a\n")
+			if len(p.state.Groups["g"]) != 1 {
+				t.Fatal(p.state.Groups)
+			}
+		})
+	}
+}
+
+func TestParserTest_RequireNinFeatures(t *testing.T) {
+	// manifest returns a manifest using the feature.
+	manifest := func(feature string) []string {
+		switch feature {
+		case "defaultgroup":
+			return []string{"build b: phony\ndefaultgroup g: b\n"}
+		case "outroot":
+			return []string{"outroot = out\n"}
+		}
+		if builtinRules[feature] != nil {
+			return []string{"build b: " + feature + " a\n"}
+		}
+		if !isNinBinding(feature) {
+			t.Fatalf("unknown feature %q", feature)
+		}
+		return []string{
+			"rule r\n  command = r\n  " + feature + " = 0\nbuild b: r\n",
+			"rule r\n  command = r\nbuild b: r\n  " + feature + " = 0\n",
+		}
+	}
+	for feature := range NinFeatures {
+		feature := feature
+		t.Run(feature, func(t *testing.T) {
+			for _, m := range manifest(feature) {
+				for _, c := range concurrencyVals {
+					p := NewParserTest(t, c)
+					want := feature + " requires 'nin_features = " + feature + "'"
+					if err := p.parseTest(m, ParseManifestOpts{Concurrency: c}); err == nil || !strings.Contains(err.Error(), want) {
+						t.Fatalf("%s: %q: %v", c, m, err)
+					}
+					p = NewParserTest(t, c)
+					p.assertParse("nin_features = " + feature + "\n" + m)
+					p = NewParserTest(t, c)
+					p.assertParse("nin_required_version = 1.0\n" + m)
+				}
+			}
+		})
+	}
+}
+
+func TestParserTest_DisableExtensions(t *testing.T) {
+	data := []struct {
+		in   string
+		want string
+	}{
+		{
+			"nin_features = defaultgroup\nrule r\n  command = r\nbuild b: r\ndefaultgroup g: b\n",
+			"input:5: expected '=', got identifier\ndefaultgroup g: b\n             ^ near here",
+		},
+		{
+			"rule r\n  command = r\n  batch = 2\n",
+			"input:3: unexpected variable 'batch'\n  batch = 2\n           ^ near here",
+		},
+	}
+	for i, line := range data {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			for _, c := range concurrencyVals {
+				t.Run(c.String(), func(t *testing.T) {
+					p := NewParserTest(t, c)
+					opts := ParseManifestOpts{
+						Concurrency:       p.Concurrency,
+						DisableExtensions: true,
+					}
+					if err := p.parseTest(line.in, opts); err == nil {
+						t.Fatal("expected error")
+					} else if err.Error() != line.want {
+						t.Fatal(cmp.Diff(line.want, err.Error()))
+					}
+				})
+			}
+		})
+	}
+}
+
 func TestParserTest_UTF8(t *testing.T) {
 	for _, c := range concurrencyVals {
 		t.Run(c.String(), func(t *testing.T) {
@@ -0,0 +1,139 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"sync"
+	"time"
+)
+
+// ManifestChangePolicy defines what Builder.Build does when a manifest file
+// changes while the build runs.
+type ManifestChangePolicy int32
+
+const (
+	// ManifestChangeIgnore keeps building with the graph as loaded. This is
+	// what ninja does.
+	ManifestChangeIgnore ManifestChangePolicy = iota
+	// ManifestChangeFinish lets the running commands complete, starts no new
+	// ones and returns an *ErrManifestChanged.
+	ManifestChangeFinish
+	// ManifestChangeCancel interrupts the running commands and returns an
+	// *ErrManifestChanged.
+	ManifestChangeCancel
+)
+
+// manifestWatcher polls the files of the manifest while a build runs.
+type manifestWatcher struct {
+	fs       FileSystem
+	files    []string
+	stamps   []TimeStamp
+	interval time.Duration
+
+	// onChange is called once from the polling goroutine when a change is
+	// detected.
+	onChange func()
+
+	mu      sync.Mutex
+	changed *ErrManifestChanged
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// WatchManifest records the current mtime of the files, usually the manifest
+// and ManifestFiles, so that Build can detect if they change while it runs.
+//
+// It has no effect when BuildConfig.ManifestChange is ManifestChangeIgnore.
+// The FileSystem must be safe for concurrent use.
+func (b *Builder) WatchManifest(files []string) error {
+	w := &manifestWatcher{
+		fs:       b.di,
+		files:    files,
+		stamps:   make([]TimeStamp, len(files)),
+		interval: b.config.ManifestPollInterval,
+	}
+	if w.interval <= 0 {
+		w.interval = time.Second
+	}
+	for i, f := range files {
+		mtime, err := b.di.Stat(f)
+		if mtime < 0 {
+			return err
+		}
+		w.stamps[i] = mtime
+	}
+	b.watch = w
+	return nil
+}
+
+// start starts polling.
+func (w *manifestWatcher) start() {
+	w.stop = make(chan struct{})
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		t := time.NewTicker(w.interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-w.stop:
+				return
+			case <-t.C:
+				if w.poll() {
+					if w.onChange != nil {
+						w.onChange()
+					}
+					return
+				}
+			}
+		}
+	}()
+}
+
+// shutdown stops polling.
+func (w *manifestWatcher) shutdown() {
+	close(w.stop)
+	w.wg.Wait()
+}
+
+// poll returns true if a file changed.
+func (w *manifestWatcher) poll() bool {
+	for i, f := range w.files {
+		mtime, _ := w.fs.Stat(f)
+		if mtime < 0 || mtime == w.stamps[i] {
+			// Transient errors are ignored.
+			continue
+		}
+		w.mu.Lock()
+		w.changed = &ErrManifestChanged{Path: f, Removed: mtime == 0}
+		w.mu.Unlock()
+		return true
+	}
+	return false
+}
+
+// err returns the change detected, if any.
+func (w *manifestWatcher) err() error {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.changed == nil {
+		return nil
+	}
+	return w.changed
+}
@@ -0,0 +1,98 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestManifestWatcher_Poll(t *testing.T) {
+	b := NewBuildTest(t)
+	b.fs.Create("build.ninja", "")
+	b.fs.Create("sub.ninja", "")
+	if err := b.builder.WatchManifest([]string{"build.ninja", "sub.ninja"}); err != nil {
+		t.Fatal(err)
+	}
+	w := b.builder.watch
+	if w.poll() || w.err() != nil {
+		t.Fatal("expected no change")
+	}
+	if err := b.fs.RemoveFile("sub.ninja"); err != nil {
+		t.Fatal(err)
+	}
+	if !w.poll() {
+		t.Fatal("expected a change")
+	}
+	var err *ErrManifestChanged
+	if !errors.As(w.err(), &err) || err.Path != "sub.ninja" || !err.Removed {
+		t.Fatal(w.err())
+	}
+	if w.err().Error() != "'sub.ninja' was removed during the build" {
+		t.Fatal(w.err())
+	}
+}
+
+func TestBuildTest_ManifestChange(t *testing.T) {
+	data := []struct {
+		policy ManifestChangePolicy
+		err    bool
+		want   []string
+	}{
+		// The graph is kept as is.
+		{ManifestChangeIgnore, false, []string{"cat in1 > cat1", "cat in1 in2 > cat2", "cat cat1 cat2 > cat12"}},
+		// The running command completes.
+		{ManifestChangeFinish, true, []string{"cat in1 > cat1"}},
+		// The running command is interrupted.
+		{ManifestChangeCancel, true, []string{"cat in1 > cat1"}},
+	}
+	for i, l := range data {
+		b := NewBuildTest(t)
+		b.config.ManifestChange = l.policy
+		// Only poll from the test.
+		b.config.ManifestPollInterval = time.Hour
+		b.fs.Create("build.ninja", "")
+		if err := b.builder.WatchManifest([]string{"build.ninja"}); err != nil {
+			t.Fatal(err)
+		}
+		b.builder.Hooks.BeforeEdge = func(edge *Edge) EdgeDecision {
+			if edge.Outputs[0].Path == "cat1" {
+				b.fs.Tick()
+				b.fs.Create("build.ninja", "")
+				if b.builder.watch != nil {
+					b.builder.watch.poll()
+				}
+			}
+			return EdgeDecision{}
+		}
+		if _, err := b.builder.addTargetName("cat12"); err != nil {
+			t.Fatal(err)
+		}
+		err := b.builder.Build()
+		if l.err != errors.Is(err, &ErrManifestChanged{}) {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if diff := cmp.Diff(l.want, b.commandRunner.commandsRan); diff != "" {
+			t.Fatalf("#%d: %s", i, diff)
+		}
+		finished := b.GetNode("cat1").InEdge.OutputsReady
+		if finished != (l.policy != ManifestChangeCancel) {
+			t.Fatalf("#%d: %t", i, finished)
+		}
+	}
+}
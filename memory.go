@@ -0,0 +1,77 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ParseMemorySize parses a size in bytes with an optional K, M, G or T
+// suffix in powers of 1024, e.g. "4G" or "512M".
+func ParseMemorySize(s string) (int64, error) {
+	t := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	mult := int64(1)
+	if t != "" {
+		switch t[len(t)-1] {
+		case 'K':
+			mult = 1 << 10
+		case 'M':
+			mult = 1 << 20
+		case 'G':
+			mult = 1 << 30
+		case 'T':
+			mult = 1 << 40
+		}
+		if mult != 1 {
+			t = t[:len(t)-1]
+		}
+	}
+	v, err := strconv.ParseFloat(t, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid memory size %q", s)
+	}
+	return int64(v * float64(mult)), nil
+}
+
+// edgeMemory returns the memory the command of edge is expected to use, from
+// its "mem" binding or else from the max RSS recorded in the build log by the
+// previous build. It returns 0 when unknown.
+func (r *realCommandRunner) edgeMemory(edge *Edge) int64 {
+	if m := edge.GetBinding("mem"); m != "" {
+		// An invalid value is ignored, like for "batch".
+		v, _ := ParseMemorySize(m)
+		return v
+	}
+	if r.buildLog != nil && len(edge.Outputs) != 0 {
+		if e := r.buildLog.Entries[edge.Outputs[0].Path]; e != nil {
+			return e.usage.MaxRSS
+		}
+	}
+	return 0
+}
+
+// fitsInMemory returns true if edge can start without the expected memory
+// of the running commands exceeding BuildConfig.MemoryLimit.
+//
+// An edge is always permitted to start when nothing else runs, so an edge
+// expected to use more than the limit still runs, alone.
+func (r *realCommandRunner) fitsInMemory(edge *Edge) bool {
+	if r.config.MemoryLimit <= 0 || len(r.subprocToEdge) == 0 {
+		return true
+	}
+	return r.memoryRunning+r.edgeMemory(edge) <= r.config.MemoryLimit
+}
@@ -0,0 +1,44 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import "testing"
+
+func TestParseMemorySize(t *testing.T) {
+	for in, want := range map[string]int64{"0": 0, "1024": 1024, "4G": 4 << 30, "1.5k": 1536, "512MB": 512 << 20} {
+		if got, err := ParseMemorySize(in); err != nil || got != want {
+			t.Fatal(in, got, err)
+		}
+	}
+	if _, err := ParseMemorySize("lots"); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestEdgeMemory(t *testing.T) {
+	s := NewStateTestWithBuiltinRules(t)
+	s.AssertParse(&s.state, "nin_features = mem\nbuild a: cat in\nbuild b: cat in\n  mem = 1M\nbuild c: cat in\n", ParseManifestOpts{})
+	l := NewBuildLog()
+	l.Entries["a"] = &LogEntry{output: "a", usage: ResourceUsage{MaxRSS: 1000}}
+	l.Entries["b"] = &LogEntry{output: "b", usage: ResourceUsage{MaxRSS: 1000}}
+	r := newRealCommandRunner(&BuildConfig{})
+	r.buildLog = &l
+	// The binding has precedence over the build log.
+	for i, want := range []int64{1000, 1 << 20, 0} {
+		if got := r.edgeMemory(s.state.Edges[i]); got != want {
+			t.Fatal(i, got)
+		}
+	}
+}
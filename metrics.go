@@ -15,7 +15,9 @@
 package nin
 
 import (
+	"context"
 	"fmt"
+	"runtime/trace"
 	"sort"
 	"sync"
 	"time"
@@ -28,17 +30,32 @@ func emptyFunc() {
 //
 // Use defer metricRecord("foobar")() at the top of a function to get timing
 // stats recorded for each call of the function.
+//
+// It also records a runtime/trace region when a trace is being captured.
 func metricRecord(name string) func() {
-	// TODO(maruel): Use runtime/trace.StartRegion() instead.
+	end := traceRegion(name)
 	if Metrics.metrics == nil {
-		return emptyFunc
+		return end
 	}
 	m := Metrics.getMetric(name)
 	start := time.Now()
 	return func() {
 		m.count++
 		m.sum += time.Since(start)
+		end()
+	}
+}
+
+// traceRegion starts a runtime/trace region when a trace is being captured,
+// e.g. with -trace, and returns the function to end it.
+//
+// Use defer traceRegion("foobar")() at the top of a function. The region must
+// end on the same goroutine.
+func traceRegion(name string) func() {
+	if !trace.IsEnabled() {
+		return emptyFunc
 	}
+	return trace.StartRegion(context.Background(), name).End
 }
 
 // A single metrics we're tracking, like "depfile load time".
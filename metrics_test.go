@@ -18,10 +18,17 @@ import (
 	"flag"
 	"io/ioutil"
 	"log"
+	"os"
 	"testing"
 )
 
 func TestMain(m *testing.M) {
+	if os.Getenv("NIN_TEST_WORKER") != "" {
+		os.Exit(fakeWorkerMain())
+	}
+	if os.Getenv("NIN_TEST_COMPAT") != "" {
+		os.Exit(fakeBuildMain())
+	}
 	log.SetFlags(log.Lshortfile)
 	flag.Parse()
 	if !testing.Verbose() {
@@ -27,7 +27,7 @@ type MissingDependencyScanner struct {
 	delegate            MissingDependencyScannerDelegate
 	depsLog             *DepsLog
 	state               *State
-	di                  DiskInterface
+	di                  FileSystem
 	seen                map[*Node]struct{}
 	nodesMissingDeps    map[*Node]struct{}
 	generatedNodes      map[*Node]struct{}
@@ -52,7 +52,7 @@ type nodeStoringImplicitDepLoader struct {
 	depNodesOutput []*Node
 }
 
-func newNodeStoringImplicitDepLoader(state *State, depsLog *DepsLog, di DiskInterface, depNodesOutput []*Node) nodeStoringImplicitDepLoader {
+func newNodeStoringImplicitDepLoader(state *State, depsLog *DepsLog, di FileSystem, depNodesOutput []*Node) nodeStoringImplicitDepLoader {
 	return nodeStoringImplicitDepLoader{
 		implicitDepLoader: newImplicitDepLoader(state, depsLog, di),
 		depNodesOutput:    depNodesOutput,
@@ -70,7 +70,7 @@ func (n *nodeStoringImplicitDepLoader) processDepfileDeps(edge *Edge, depfileIns
 //
 
 // NewMissingDependencyScanner returns an initialized MissingDependencyScanner.
-func NewMissingDependencyScanner(delegate MissingDependencyScannerDelegate, depsLog *DepsLog, state *State, di DiskInterface) MissingDependencyScanner {
+func NewMissingDependencyScanner(delegate MissingDependencyScannerDelegate, depsLog *DepsLog, state *State, di FileSystem) MissingDependencyScanner {
 	return MissingDependencyScanner{
 		delegate:         delegate,
 		depsLog:          depsLog,
@@ -0,0 +1,76 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"runtime"
+	"strings"
+)
+
+// UsePosixShell makes the edges quote the paths in their commands for a
+// POSIX shell and translate them to MSYS paths, e.g. "C:\src\foo.cc" becomes
+// "/c/src/foo.cc". Conversely, the MSYS and Cygwin paths in their depfiles are
+// translated to Windows paths.
+//
+// It is called by NewBuilder when BuildConfig.PosixShell is set. It has no
+// effect on other operating systems than Windows.
+func (s *State) UsePosixShell() {
+	if runtime.GOOS != "windows" {
+		return
+	}
+	s.posixShell = true
+	for _, e := range s.Edges {
+		e.invalidateBindings()
+		e.posixShell = true
+	}
+}
+
+// MSYSToWindowsPath translates a MSYS or Cygwin absolute path to a Windows
+// path, e.g. "/c/src/foo.h" or "/cygdrive/c/src/foo.h" to "C:/src/foo.h".
+//
+// Other paths are returned as is.
+func MSYSToWindowsPath(p string) string {
+	rest := strings.TrimPrefix(p, "/cygdrive")
+	if len(rest) < 2 || rest[0] != '/' || !islatinalpha(rest[1]) || (len(rest) > 2 && rest[2] != '/') {
+		return p
+	}
+	drive := strings.ToUpper(rest[1:2]) + ":"
+	if len(rest) == 2 {
+		return drive + "/"
+	}
+	return drive + rest[2:]
+}
+
+// WindowsToMSYSPath translates a Windows absolute path to a MSYS path, e.g.
+// "C:\src\foo.h" to "/c/src/foo.h".
+//
+// Other paths are returned with forward slashes.
+func WindowsToMSYSPath(p string) string {
+	p = strings.ReplaceAll(p, "\\", "/")
+	if len(p) < 2 || !islatinalpha(p[0]) || p[1] != ':' || (len(p) > 2 && p[2] != '/') {
+		return p
+	}
+	return "/" + strings.ToLower(p[:1]) + p[2:]
+}
+
+// translateMSYSPaths translates the paths of the depfile to Windows paths.
+func (d *DepfileParser) translateMSYSPaths() {
+	for i := range d.outs {
+		d.outs[i] = MSYSToWindowsPath(d.outs[i])
+	}
+	for i := range d.ins {
+		d.ins[i] = MSYSToWindowsPath(d.ins[i])
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMSYSToWindowsPath(t *testing.T) {
+	data := []struct {
+		in   string
+		want string
+	}{
+		{"/c/src/foo.h", "C:/src/foo.h"},
+		{"/cygdrive/d/src/foo.h", "D:/src/foo.h"},
+		{"/c", "C:/"},
+		{"/usr/include/stdio.h", "/usr/include/stdio.h"},
+		{"/c2/foo.h", "/c2/foo.h"},
+		{"foo.h", "foo.h"},
+		{"C:/src/foo.h", "C:/src/foo.h"},
+	}
+	for i, l := range data {
+		if got := MSYSToWindowsPath(l.in); got != l.want {
+			t.Errorf("#%d: %q: want %q, got %q", i, l.in, l.want, got)
+		}
+	}
+}
+
+func TestWindowsToMSYSPath(t *testing.T) {
+	data := []struct {
+		in   string
+		want string
+	}{
+		{"C:\\src\\foo.cc", "/c/src/foo.cc"},
+		{"d:/src/foo.cc", "/d/src/foo.cc"},
+		{"src\\foo.cc", "src/foo.cc"},
+		{"foo.cc", "foo.cc"},
+		{"C:foo.cc", "C:foo.cc"},
+	}
+	for i, l := range data {
+		if got := WindowsToMSYSPath(l.in); got != l.want {
+			t.Errorf("#%d: %q: want %q, got %q", i, l.in, l.want, got)
+		}
+	}
+}
+
+func TestDepfileParser_TranslateMSYSPaths(t *testing.T) {
+	d := DepfileParser{}
+	if err := d.Parse([]byte("/c/out/foo.o: /c/src/foo.cc /usr/include/stdio.h rel.h\n\x00")); err != nil {
+		t.Fatal(err)
+	}
+	d.translateMSYSPaths()
+	if diff := cmp.Diff([]string{"C:/out/foo.o"}, d.outs); diff != "" {
+		t.Fatal(diff)
+	}
+	if diff := cmp.Diff([]string{"C:/src/foo.cc", "/usr/include/stdio.h", "rel.h"}, d.ins); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestState_UsePosixShell(t *testing.T) {
+	s := NewStateTestWithBuiltinRules(t)
+	s.AssertParse(&s.state, "build out: cat C$:/src/a$ b.c\n", ParseManifestOpts{})
+	e := s.state.Edges[0]
+	want := "cat 'C:/src/a b.c' > out"
+	if runtime.GOOS == "windows" {
+		want = "cat \"C:/src/a b.c\" > out"
+	}
+	if got := e.EvaluateCommand(false); got != want {
+		t.Fatal(got)
+	}
+	config := NewBuildConfig()
+	config.PosixShell = "sh"
+	NewBuilder(&s.state, &config, nil, nil, nil, &statusFake{}, 0)
+	if runtime.GOOS == "windows" {
+		// The memoized command is discarded.
+		want = "cat '/c/src/a b.c' > out"
+	}
+	if got := e.EvaluateCommand(false); got != want {
+		t.Fatal(got)
+	}
+}
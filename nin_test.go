@@ -15,7 +15,6 @@
 package nin
 
 import (
-	"errors"
 	"os"
 	"strings"
 	"testing"
@@ -62,10 +61,10 @@ func (s *StateTestWithBuiltinRules) AssertParse(state *State, input string, opts
 	verifyGraph(s.t, state)
 }
 
-func (s *StateTestWithBuiltinRules) AssertHash(expected string, actual uint64) {
-	if HashCommand(expected) != actual {
+func (s *StateTestWithBuiltinRules) AssertHash(expected string, actual *LogEntry) {
+	if !actual.matchesCommand(expected, HashCommand128(expected)) {
 		s.t.Helper()
-		s.t.Fatalf("want %08x; got %08x", expected, actual)
+		s.t.Fatalf("want %q; got %#v", expected, actual)
 	}
 }
 
@@ -117,105 +116,6 @@ func verifyGraph(t *testing.T, state *State) {
 	}
 }
 
-// An implementation of DiskInterface that uses an in-memory representation
-// of disk state.  It also logs file accesses and directory creations
-// so it can be used by tests to verify disk access patterns.
-type VirtualFileSystem struct {
-	// In the C++ code, it's an ordered set. The only test cases that depends on
-	// this is TestBuildTest_MakeDirs.
-	directoriesMade map[string]struct{}
-	filesRead       []string
-	files           FileMap
-	filesRemoved    map[string]struct{}
-	filesCreated    map[string]struct{}
-
-	// A simple fake timestamp for file operations.
-	now TimeStamp
-}
-
-// An entry for a single in-memory file.
-type Entry struct {
-	mtime     TimeStamp
-	statError error // If mtime is -1.
-	contents  []byte
-}
-type FileMap map[string]Entry
-
-func NewVirtualFileSystem() VirtualFileSystem {
-	return VirtualFileSystem{
-		directoriesMade: map[string]struct{}{},
-		files:           FileMap{},
-		filesRemoved:    map[string]struct{}{},
-		filesCreated:    map[string]struct{}{},
-		now:             1,
-	}
-}
-
-// Tick "time" forwards; subsequent file operations will be newer than
-// previous ones.
-func (v *VirtualFileSystem) Tick() TimeStamp {
-	v.now++
-	return v.now
-}
-
-// "Create" a file with contents.
-func (v *VirtualFileSystem) Create(path string, contents string) {
-	f := v.files[path]
-	f.mtime = v.now
-	// Make a copy in case it's a unsafeString() to a buffer that could be
-	// mutated later.
-	f.contents = []byte(contents)
-	v.files[path] = f
-	v.filesCreated[path] = struct{}{}
-}
-
-// DiskInterface
-func (v *VirtualFileSystem) Stat(path string) (TimeStamp, error) {
-	i, ok := v.files[path]
-	if ok {
-		return i.mtime, i.statError
-	}
-	return 0, nil
-}
-
-func (v *VirtualFileSystem) WriteFile(path string, contents string) error {
-	v.Create(path, contents)
-	return nil
-}
-
-func (v *VirtualFileSystem) MakeDir(path string) error {
-	// Should check if a file exists with the same name.
-	v.directoriesMade[path] = struct{}{}
-	return nil
-}
-
-func (v *VirtualFileSystem) ReadFile(path string) ([]byte, error) {
-	v.filesRead = append(v.filesRead, path)
-	i, ok := v.files[path]
-	if ok {
-		if len(i.contents) == 0 {
-			return nil, nil
-		}
-		// Return a copy since a lot of the code modify the buffer in-place.
-		n := make([]byte, len(i.contents)+1)
-		copy(n, i.contents)
-		return n, nil
-	}
-	return nil, os.ErrNotExist
-}
-
-func (v *VirtualFileSystem) RemoveFile(path string) error {
-	if _, ok := v.directoriesMade[path]; ok {
-		return errors.New("can't remove directory in unit tests; not true in practice")
-	}
-	if _, ok := v.files[path]; ok {
-		delete(v.files, path)
-		v.filesRemoved[path] = struct{}{}
-		return nil
-	}
-	return os.ErrNotExist
-}
-
 // CreateTempDirAndEnter creates a temporary directory and "cd" into it.
 func CreateTempDirAndEnter(t *testing.T) string {
 	old, err := os.Getwd()
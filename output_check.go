@@ -0,0 +1,208 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// OutputConflictKind is the kind of an OutputConflict.
+type OutputConflictKind int32
+
+const (
+	// OutputCase means two outputs differ only by case. They are the same file
+	// on a case insensitive file system, e.g. on Windows and macOS.
+	OutputCase OutputConflictKind = iota
+	// OutputAlias means an absolute output path and a relative output path are
+	// the same file.
+	OutputAlias
+	// OutputReserved means an output is a path used by nin itself, e.g. the
+	// build directory or the build log, or a directory containing one.
+	OutputReserved
+	// OutputOutside means an output resolves to a path outside of the build
+	// directory, following the symlinks.
+	OutputOutside
+	// OutputSource means an output is a source file, e.g. a file tracked by
+	// the version control system.
+	OutputSource
+)
+
+// OutputConflict is an output whose path overlaps another path.
+//
+// Outputs with the same canonical path, e.g. "foo//bar" and "foo/bar", are
+// reported by the manifest parser as a duplicate edge.
+type OutputConflict struct {
+	Kind OutputConflictKind
+	// Path is the output.
+	Path string
+	// Other is the other output, the reserved path, the resolved path for
+	// OutputOutside or the source file for OutputSource.
+	Other string
+	// Rule is the rule of the edge writing Path. It is only set for
+	// OutputOutside and OutputSource.
+	Rule string
+}
+
+func (o *OutputConflict) Error() string {
+	switch o.Kind {
+	case OutputCase:
+		return fmt.Sprintf("outputs '%s' and '%s' differ only by case; they are the same file on a case insensitive file system", o.Other, o.Path)
+	case OutputAlias:
+		return fmt.Sprintf("outputs '%s' and '%s' are the same file", o.Path, o.Other)
+	case OutputOutside:
+		return fmt.Sprintf("output '%s' of rule '%s' resolves to '%s', outside of the build directory", o.Path, o.Rule, o.Other)
+	case OutputSource:
+		return fmt.Sprintf("output '%s' of rule '%s' is the source file '%s'", o.Path, o.Rule, o.Other)
+	default:
+		if o.Path == o.Other {
+			return fmt.Sprintf("output '%s' is used by nin itself", o.Path)
+		}
+		return fmt.Sprintf("output '%s' is a parent directory of '%s' used by nin itself", o.Path, o.Other)
+	}
+}
+
+// CheckOutputs returns the outputs overlapping another output or one of the
+// reserved paths, sorted by path.
+//
+// reserved are the paths the build must not write to, e.g. the build
+// directory and the logs in it. Each output is reported at most once for the
+// reserved paths, so list the most relevant ones first. Outputs of phony edges are not files and are
+// ignored. Relative paths are relative to the current working directory.
+//
+// Such outputs corrupt the incremental state: the build log records two
+// entries for the same file, or the build overwrites its own logs.
+func (s *State) CheckOutputs(reserved []string) []OutputConflict {
+	defer metricRecord("CheckOutputs")()
+	var out []OutputConflict
+	isOutput := func(n *Node) bool {
+		return n != nil && n.InEdge != nil && n.InEdge.Rule != PhonyRule
+	}
+	cwd, _ := os.Getwd()
+	lower := map[string]string{}
+	for _, e := range s.Edges {
+		if e.Rule == PhonyRule {
+			continue
+		}
+		for _, o := range e.Outputs {
+			k := strings.ToLower(o.Path)
+			if other, ok := lower[k]; ok {
+				out = append(out, OutputConflict{Kind: OutputCase, Path: o.Path, Other: other})
+			} else {
+				lower[k] = o.Path
+			}
+			if cwd == "" || !filepath.IsAbs(o.Path) {
+				continue
+			}
+			rel, err := filepath.Rel(cwd, o.Path)
+			if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				continue
+			}
+			rel = CanonicalizePath(filepath.ToSlash(rel))
+			if isOutput(s.Paths[rel]) {
+				out = append(out, OutputConflict{Kind: OutputAlias, Path: o.Path, Other: rel})
+			}
+		}
+	}
+	// Report each output once, for the first reserved path it overlaps.
+	seen := map[string]struct{}{}
+	for _, r := range reserved {
+		r = CanonicalizePath(r)
+		for p := r; p != "" && p != "." && p != "/"; {
+			if _, ok := seen[p]; !ok && isOutput(s.Paths[p]) {
+				seen[p] = struct{}{}
+				out = append(out, OutputConflict{Kind: OutputReserved, Path: p, Other: r})
+			}
+			i := strings.LastIndexByte(p, '/')
+			if i == -1 {
+				break
+			}
+			p = p[:i]
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Path < out[j].Path })
+	return out
+}
+
+// CheckOutputPaths returns the outputs that resolve outside of the build
+// directory or that are one of sources, sorted by path.
+//
+// The build directory is the current working directory. sources are the
+// source files relative to it, e.g. the files tracked by git. Outputs of phony
+// edges are not files and are ignored.
+//
+// Such outputs are usually a bug in the generator of the manifest; building
+// them would overwrite files of the user.
+func (s *State) CheckOutputPaths(sources []string) []OutputConflict {
+	defer metricRecord("CheckOutputPaths")()
+	var out []OutputConflict
+	tracked := make(map[string]struct{}, len(sources))
+	for _, p := range sources {
+		tracked[CanonicalizePath(filepath.ToSlash(p))] = struct{}{}
+	}
+	cwd, err := os.Getwd()
+	if err == nil {
+		cwd, err = filepath.EvalSymlinks(cwd)
+	}
+	if err != nil {
+		cwd = ""
+	}
+	dirs := map[string]string{}
+	for _, e := range s.Edges {
+		if e.Rule == PhonyRule {
+			continue
+		}
+		for _, o := range e.Outputs {
+			if _, ok := tracked[o.Path]; ok {
+				out = append(out, OutputConflict{Kind: OutputSource, Path: o.Path, Other: o.Path, Rule: e.Rule.Name})
+				continue
+			}
+			if cwd == "" {
+				continue
+			}
+			p := filepath.FromSlash(o.Path)
+			if !filepath.IsAbs(p) {
+				p = filepath.Join(cwd, p)
+			}
+			p = filepath.Join(resolveDir(dirs, filepath.Dir(p)), filepath.Base(p))
+			if rel, err := filepath.Rel(cwd, p); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				out = append(out, OutputConflict{Kind: OutputOutside, Path: o.Path, Other: p, Rule: e.Rule.Name})
+			}
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Path < out[j].Path })
+	return out
+}
+
+// resolveDir returns the absolute directory dir with its symlinks evaluated.
+// The directories that do not exist yet are kept as is.
+func resolveDir(cache map[string]string, dir string) string {
+	if r, ok := cache[dir]; ok {
+		return r
+	}
+	r, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		if parent := filepath.Dir(dir); parent != dir {
+			r = filepath.Join(resolveDir(cache, parent), filepath.Base(dir))
+		} else {
+			r = dir
+		}
+	}
+	cache[dir] = r
+	return r
+}
@@ -0,0 +1,104 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestState_CheckOutputs(t *testing.T) {
+	s := NewStateTestWithBuiltinRules(t)
+	s.AssertParse(&s.state,
+		"build out/Foo.o: cat in\n"+
+			"build out/foo.o: cat in\n"+
+			"build out/bar.o: cat in\n"+
+			"build all: phony out/bar.o\n"+
+			"build ALL: cat in\n"+
+			"build out: cat in\n"+
+			"build log/.ninja_log: cat in\n",
+		ParseManifestOpts{})
+	got := s.state.CheckOutputs([]string{"out/obj", "out/obj/.ninja_log", "log/.ninja_log"})
+	want := []OutputConflict{
+		{Kind: OutputReserved, Path: "log/.ninja_log", Other: "log/.ninja_log"},
+		{Kind: OutputReserved, Path: "out", Other: "out/obj"},
+		{Kind: OutputCase, Path: "out/foo.o", Other: "out/Foo.o"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatal(diff)
+	}
+	if s := got[2].Error(); s != "outputs 'out/Foo.o' and 'out/foo.o' differ only by case; they are the same file on a case insensitive file system" {
+		t.Fatal(s)
+	}
+	if s := got[1].Error(); s != "output 'out' is a parent directory of 'out/obj' used by nin itself" {
+		t.Fatal(s)
+	}
+}
+
+func TestState_CheckOutputs_Alias(t *testing.T) {
+	CreateTempDirAndEnter(t)
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	abs := strings.Replace(filepath.ToSlash(cwd), ":", "$:", -1) + "/out/a"
+	s := NewStateTestWithBuiltinRules(t)
+	s.AssertParse(&s.state, "build out/a: cat in\nbuild "+abs+": cat in\nbuild out/b: cat in\n", ParseManifestOpts{})
+	got := s.state.CheckOutputs(nil)
+	if len(got) != 1 || got[0].Kind != OutputAlias || got[0].Other != "out/a" {
+		t.Fatal(got)
+	}
+}
+
+func TestState_CheckOutputPaths(t *testing.T) {
+	dir := CreateTempDirAndEnter(t)
+	if err := os.Mkdir("build", 0o777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir("build"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(dir, "gen"); err != nil {
+		t.Skip(err)
+	}
+	s := NewStateTestWithBuiltinRules(t)
+	s.AssertParse(&s.state,
+		"build out/a: cat in\n"+
+			"build ../b: cat in\n"+
+			"build gen/c: cat in\n"+
+			"build src/d.c: cat in\n"+
+			"build all: phony ../e\n",
+		ParseManifestOpts{})
+	got := s.state.CheckOutputPaths([]string{"src/d.c", "in"})
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []OutputConflict{
+		{Kind: OutputOutside, Path: "../b", Other: filepath.Join(root, "b"), Rule: "cat"},
+		{Kind: OutputOutside, Path: "gen/c", Other: filepath.Join(root, "c"), Rule: "cat"},
+		{Kind: OutputSource, Path: "src/d.c", Other: "src/d.c", Rule: "cat"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatal(diff)
+	}
+	if s := got[2].Error(); s != "output 'src/d.c' of rule 'cat' is the source file 'src/d.c'" {
+		t.Fatal(s)
+	}
+}
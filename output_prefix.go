@@ -0,0 +1,71 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// RemapOutputs moves the relative outputs of the manifest under the directory
+// prefix, so several output trees can be built from a single manifest.
+//
+// The inputs referring to a remapped output follow it since they are the same
+// node, and so do $out and $in in the commands. Outputs outside the tree,
+// i.e. absolute or starting with "..", the outputs of phony edges, which are
+// aliases, and the outputs of generator edges, e.g. the manifest itself, are
+// kept in place.
+//
+// The builddir variable is remapped too, or set to prefix when unset, so each
+// output tree has its own logs.
+//
+// Paths written literally in the commands or in the edge bindings are not
+// remapped. The State must not be used when an error is returned.
+func (s *State) RemapOutputs(prefix string) error {
+	prefix = CanonicalizePath(filepath.ToSlash(prefix))
+	if prefix == "" || prefix == "." {
+		return nil
+	}
+	shift := uint(strings.Count(prefix, "/") + 1)
+	var nodes []*Node
+	for _, e := range s.Edges {
+		if e.Rule == PhonyRule || e.GetBinding("generator") != "" {
+			continue
+		}
+		for _, o := range e.Outputs {
+			if filepath.IsAbs(o.Path) || o.Path == ".." || strings.HasPrefix(o.Path, "../") {
+				continue
+			}
+			nodes = append(nodes, o)
+			delete(s.Paths, o.Path)
+		}
+	}
+	for _, n := range nodes {
+		p := prefix + "/" + n.Path
+		if _, ok := s.Paths[p]; ok {
+			return fmt.Errorf("can't remap output '%s' to '%s' which is already used", n.Path, p)
+		}
+		n.Path = p
+		n.SlashBits <<= shift
+		s.Paths[p] = n
+	}
+	if buildDir := s.Bindings.LookupVariable("builddir"); buildDir == "" {
+		s.Bindings.Bindings["builddir"] = prefix
+	} else if !filepath.IsAbs(buildDir) {
+		s.Bindings.Bindings["builddir"] = prefix + "/" + buildDir
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestState_RemapOutputs(t *testing.T) {
+	s := NewStateTestWithBuiltinRules(t)
+	s.AssertParse(&s.state,
+		"builddir = bd\n"+
+			"rule gen\n"+
+			"  command = gen\n"+
+			"  generator = 1\n"+
+			"build build.ninja: gen\n"+
+			"build a: cat in\n"+
+			"build b: cat a\n"+
+			"build ../up: cat in\n"+
+			"build all: phony b\n",
+		ParseManifestOpts{})
+	if err := s.state.RemapOutputs("out//x"); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for p := range s.state.Paths {
+		got = append(got, p)
+	}
+	sort.Strings(got)
+	want := []string{"../up", "all", "build.ninja", "in", "out/x/a", "out/x/b"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatal(diff)
+	}
+	if c := s.state.Edges[2].EvaluateCommand(false); c != "cat out/x/a > out/x/b" {
+		t.Fatal(c)
+	}
+	if b := s.state.Bindings.LookupVariable("builddir"); b != "out/x/bd" {
+		t.Fatal(b)
+	}
+}
+
+func TestState_RemapOutputs_Conflict(t *testing.T) {
+	s := NewStateTestWithBuiltinRules(t)
+	s.AssertParse(&s.state, "build a: cat out/a\n", ParseManifestOpts{})
+	if err := s.state.RemapOutputs("out"); err == nil || err.Error() != "can't remap output 'a' to 'out/a' which is already used" {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,245 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"sync"
+)
+
+// OverlayOp is a change recorded by OverlayFileSystem.
+type OverlayOp int32
+
+const (
+	// OverlayWrite means the file was written.
+	OverlayWrite OverlayOp = iota
+	// OverlayMakeDir means the directory was created.
+	OverlayMakeDir
+	// OverlayRemove means the file was removed.
+	OverlayRemove
+)
+
+func (o OverlayOp) String() string {
+	switch o {
+	case OverlayWrite:
+		return "write"
+	case OverlayMakeDir:
+		return "mkdir"
+	case OverlayRemove:
+		return "remove"
+	default:
+		return "unknown"
+	}
+}
+
+// OverlayChange is a change that would have been done to the underlying file
+// system.
+type OverlayChange struct {
+	Op   OverlayOp
+	Path string
+}
+
+// OverlayFileSystem is a copy-on-write FileSystem layered over another one.
+//
+// Reads fall through to Base unless the path was written or removed through
+// the overlay. Writes are kept in memory and never reach Base, so a
+// speculative build can run against the real tree without modifying it. It is
+// safe for concurrent use.
+//
+// Files written through the overlay are given a modification time newer than
+// any file seen so far in Base, so the build considers them up to date.
+type OverlayFileSystem struct {
+	Base FileSystem
+
+	mu      sync.Mutex
+	entries map[string]*overlayEntry
+	// latest is the most recent modification time seen.
+	latest TimeStamp
+}
+
+type overlayEntry struct {
+	op       OverlayOp
+	mtime    TimeStamp
+	contents []byte
+	// touched is set when the content is the one in Base.
+	touched bool
+}
+
+// NewOverlayFileSystem returns an OverlayFileSystem on top of base.
+func NewOverlayFileSystem(base FileSystem) *OverlayFileSystem {
+	return &OverlayFileSystem{Base: base, entries: map[string]*overlayEntry{}}
+}
+
+// Stat implements FileSystem.
+func (o *OverlayFileSystem) Stat(path string) (TimeStamp, error) {
+	o.mu.Lock()
+	e := o.entries[path]
+	o.mu.Unlock()
+	if e != nil {
+		if e.op == OverlayRemove {
+			return 0, nil
+		}
+		return e.mtime, nil
+	}
+	return o.statBase(path)
+}
+
+// WriteFile implements FileSystem.
+func (o *OverlayFileSystem) WriteFile(path, contents string) error {
+	// Make sure the file is newer than its previous version.
+	_, _ = o.statBase(path)
+	o.set(path, OverlayWrite, []byte(contents))
+	return nil
+}
+
+// MakeDir implements FileSystem.
+func (o *OverlayFileSystem) MakeDir(path string) error {
+	if mtime, err := o.Stat(path); mtime == -1 {
+		return err
+	} else if mtime != 0 {
+		return &os.PathError{Op: "mkdir", Path: path, Err: os.ErrExist}
+	}
+	o.set(path, OverlayMakeDir, nil)
+	return nil
+}
+
+// ReadFile implements FileSystem.
+func (o *OverlayFileSystem) ReadFile(path string) ([]byte, error) {
+	o.mu.Lock()
+	e := o.entries[path]
+	o.mu.Unlock()
+	if e == nil || e.touched {
+		return o.Base.ReadFile(path)
+	}
+	switch e.op {
+	case OverlayWrite:
+		if len(e.contents) == 0 {
+			return nil, nil
+		}
+		// Return a copy with the trailing zero byte, see FileReader.
+		c := make([]byte, len(e.contents)+1)
+		copy(c, e.contents)
+		return c, nil
+	case OverlayMakeDir:
+		return nil, &os.PathError{Op: "read", Path: path, Err: errors.New("is a directory")}
+	default:
+		return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+	}
+}
+
+// RemoveFile implements FileSystem.
+func (o *OverlayFileSystem) RemoveFile(path string) error {
+	o.mu.Lock()
+	e := o.entries[path]
+	o.mu.Unlock()
+	if e != nil && e.op == OverlayRemove {
+		return &os.PathError{Op: "remove", Path: path, Err: os.ErrNotExist}
+	}
+	mtime, err := o.Base.Stat(path)
+	if mtime == -1 {
+		return err
+	}
+	if mtime == 0 {
+		if e == nil {
+			return &os.PathError{Op: "remove", Path: path, Err: os.ErrNotExist}
+		}
+		// The file only ever existed in the overlay.
+		o.mu.Lock()
+		delete(o.entries, path)
+		o.mu.Unlock()
+		return nil
+	}
+	o.set(path, OverlayRemove, nil)
+	return nil
+}
+
+// Touch records path as written without changing its content as seen through
+// the overlay.
+//
+// It is used to record the outputs a command would have written.
+func (o *OverlayFileSystem) Touch(path string) {
+	_, _ = o.statBase(path)
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.latest++
+	if e := o.entries[path]; e != nil {
+		// Keep the content written through the overlay. A removed file is
+		// recreated empty.
+		e.op = OverlayWrite
+		e.mtime = o.latest
+		return
+	}
+	o.entries[path] = &overlayEntry{op: OverlayWrite, mtime: o.latest, touched: true}
+}
+
+// Changes returns the changes recorded so far, sorted by path.
+func (o *OverlayFileSystem) Changes() []OverlayChange {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	out := make([]OverlayChange, 0, len(o.entries))
+	for p, e := range o.entries {
+		out = append(out, OverlayChange{Op: e.op, Path: p})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Path < out[j].Path })
+	return out
+}
+
+// statBase stats path in Base and keeps track of the most recent
+// modification time.
+func (o *OverlayFileSystem) statBase(path string) (TimeStamp, error) {
+	mtime, err := o.Base.Stat(path)
+	if mtime > 0 {
+		o.mu.Lock()
+		if mtime > o.latest {
+			o.latest = mtime
+		}
+		o.mu.Unlock()
+	}
+	return mtime, err
+}
+
+func (o *OverlayFileSystem) set(path string, op OverlayOp, contents []byte) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.latest++
+	o.entries[path] = &overlayEntry{op: op, mtime: o.latest, contents: contents}
+}
+
+// SandboxOutputs makes the builder record the outputs of the commands as
+// written into o instead of running them.
+//
+// The builder must have been created with o as its FileSystem. This permits
+// a "what-if" build to go through the whole build logic, including the
+// creation of the output directories and the response files, without
+// touching the output tree. Use o.Changes() to get the intended writes.
+func (b *Builder) SandboxOutputs(o *OverlayFileSystem) {
+	b.commandRunner = &sandboxCommandRunner{fs: o}
+}
+
+// sandboxCommandRunner is a CommandRunner that doesn't actually run the
+// commands but touches their outputs in an overlay.
+type sandboxCommandRunner struct {
+	dryRunCommandRunner
+	fs *OverlayFileSystem
+}
+
+func (s *sandboxCommandRunner) StartCommand(edge *Edge) bool {
+	for _, o := range edge.Outputs {
+		s.fs.Touch(o.Path)
+	}
+	return s.dryRunCommandRunner.StartCommand(edge)
+}
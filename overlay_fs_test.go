@@ -0,0 +1,135 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"os"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestOverlayFileSystem(t *testing.T) {
+	base := NewVirtualFileSystem()
+	base.Create("a", "base")
+	base.Create("b", "base")
+	base.Tick()
+	o := NewOverlayFileSystem(&base)
+
+	if c, err := o.ReadFile("a"); err != nil || string(c) != "base\x00" {
+		t.Fatal(string(c), err)
+	}
+	if err := o.WriteFile("a", "overlay"); err != nil {
+		t.Fatal(err)
+	}
+	if c, err := o.ReadFile("a"); err != nil || string(c) != "overlay\x00" {
+		t.Fatal(string(c), err)
+	}
+	if mtime, err := o.Stat("a"); mtime <= 1 || err != nil {
+		t.Fatal(mtime, err)
+	}
+	if err := o.RemoveFile("b"); err != nil {
+		t.Fatal(err)
+	}
+	if mtime, err := o.Stat("b"); mtime != 0 || err != nil {
+		t.Fatal(mtime, err)
+	}
+	if _, err := o.ReadFile("b"); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	if err := o.RemoveFile("b"); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	if err := o.MakeDir("d"); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.MakeDir("d"); !os.IsExist(err) {
+		t.Fatal(err)
+	}
+	// A file only written in the overlay vanishes once removed.
+	if err := o.WriteFile("tmp", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.RemoveFile("tmp"); err != nil {
+		t.Fatal(err)
+	}
+	// Touch keeps the content of the file in the base.
+	base.Create("c", "base")
+	o.Touch("c")
+	if c, err := o.ReadFile("c"); err != nil || string(c) != "base\x00" {
+		t.Fatal(string(c), err)
+	}
+
+	want := []OverlayChange{
+		{Op: OverlayWrite, Path: "a"},
+		{Op: OverlayRemove, Path: "b"},
+		{Op: OverlayWrite, Path: "c"},
+		{Op: OverlayMakeDir, Path: "d"},
+	}
+	if diff := cmp.Diff(want, o.Changes()); diff != "" {
+		t.Fatal(diff)
+	}
+	// The base is untouched.
+	if c, err := base.ReadFile("a"); err != nil || string(c) != "base\x00" {
+		t.Fatal(string(c), err)
+	}
+	if mtime, _ := base.Stat("b"); mtime != 1 {
+		t.Fatal(mtime)
+	}
+	if got := base.DirectoriesMade(); len(got) != 0 {
+		t.Fatal(got)
+	}
+}
+
+func TestBuildTest_SandboxOutputs(t *testing.T) {
+	b := NewBuildTest(t)
+	b.AssertParse(&b.state, "rule cat_rsp\n  command = cat $rspfile > $out\n  rspfile = $out.rsp\n  rspfile_content = $in\nbuild out/cat3: cat_rsp cat12\n", ParseManifestOpts{})
+	o := NewOverlayFileSystem(&b.fs)
+	builder := NewBuilder(&b.state, &b.config, nil, nil, o, b.status, 0)
+	builder.SandboxOutputs(o)
+	if _, err := builder.addTargetName("out/cat3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := builder.Build(); err != nil {
+		t.Fatal(err)
+	}
+	want := []OverlayChange{
+		{Op: OverlayWrite, Path: "cat1"},
+		{Op: OverlayWrite, Path: "cat12"},
+		{Op: OverlayWrite, Path: "cat2"},
+		{Op: OverlayMakeDir, Path: "out"},
+		{Op: OverlayWrite, Path: "out/cat3"},
+	}
+	if diff := cmp.Diff(want, o.Changes()); diff != "" {
+		t.Fatal(diff)
+	}
+	if len(b.commandRunner.commandsRan) != 0 {
+		t.Fatal(b.commandRunner.commandsRan)
+	}
+	if got := b.fs.FilesCreated(); len(got) != 2 {
+		t.Fatal(got)
+	}
+
+	// As seen through the overlay, everything is up to date.
+	b.state.Reset()
+	builder = NewBuilder(&b.state, &b.config, nil, nil, o, b.status, 0)
+	builder.SandboxOutputs(o)
+	if _, err := builder.addTargetName("out/cat3"); err != nil {
+		t.Fatal(err)
+	}
+	if !builder.AlreadyUpToDate() {
+		t.Fatal("expected up to date")
+	}
+}
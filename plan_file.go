@@ -0,0 +1,299 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// PlanFileVersion is the version of the PlanFile format.
+const PlanFileVersion = 1
+
+// PlanFile is the concrete set of edges a build would run, so the planning
+// done by nin can be executed by another tool, e.g. a distributed executor.
+//
+// It is serialized as JSON. Fields may be added but are never renamed or
+// removed.
+type PlanFile struct {
+	Version int        `json:"version"`
+	Pools   []PlanPool `json:"pools"`
+	// Edges are sorted so that each edge comes after the edges it depends on.
+	Edges []PlanEdge `json:"edges"`
+}
+
+// PlanPool is a pool with a limited depth used by the edges of a PlanFile.
+type PlanPool struct {
+	Name  string `json:"name"`
+	Depth int    `json:"depth"`
+}
+
+// PlanEdge is an edge to run in a PlanFile.
+type PlanEdge struct {
+	ID          int    `json:"id"`
+	Rule        string `json:"rule"`
+	Command     string `json:"command"`
+	Description string `json:"description,omitempty"`
+	// Inputs are all the inputs of the edge, including the implicit and
+	// order-only ones.
+	Inputs  []string `json:"inputs"`
+	Outputs []string `json:"outputs"`
+	Pool    string   `json:"pool,omitempty"`
+	// Cwd is the directory the command runs in, if not the build directory.
+	Cwd string `json:"cwd,omitempty"`
+	// After lists the IDs of the edges that must complete before this one is
+	// started.
+	After          []int  `json:"after,omitempty"`
+	Rspfile        string `json:"rspfile,omitempty"`
+	RspfileContent string `json:"rspfile_content,omitempty"`
+}
+
+// ExportPlan returns the edges the builder would run for the targets added,
+// without running them.
+//
+// Edges depending on a dyndep file that is not yet built can't be planned
+// ahead and return an error.
+func (b *Builder) ExportPlan() (*PlanFile, error) {
+	p := &PlanFile{Version: PlanFileVersion, Pools: []PlanPool{}, Edges: []PlanEdge{}}
+	edges := make([]*Edge, 0, len(b.plan.want))
+	for e, w := range b.plan.want {
+		if w != WantNothing && e.Rule != PhonyRule {
+			edges = append(edges, e)
+		}
+	}
+	sort.Slice(edges, func(i, j int) bool { return edges[i].ID < edges[j].ID })
+
+	ids := map[*Edge]int{}
+	// visit adds edge after the planned edges it depends on.
+	var visit func(e *Edge) error
+	visit = func(e *Edge) error {
+		if _, ok := ids[e]; ok {
+			return nil
+		}
+		if e.Dyndep != nil && e.Dyndep.DyndepPending {
+			return fmt.Errorf("%s depends on dyndep file %s which is not built yet", e.Outputs[0].Path, e.Dyndep.Path)
+		}
+		// Mark the edge as visited; the graph was already checked for cycles.
+		ids[e] = -1
+		after := planDependencies(e, b.plan.want, map[*Edge]struct{}{}, nil)
+		out := PlanEdge{
+			Rule:           e.Rule.Name,
+			Command:        e.EvaluateCommand(false),
+			Description:    e.GetBinding("description"),
+			Inputs:         make([]string, 0, len(e.Inputs)),
+			Outputs:        make([]string, 0, len(e.Outputs)),
+			Pool:           e.Pool.Name,
+			Cwd:            e.Cwd(),
+			Rspfile:        e.GetUnescapedRspfile(),
+			RspfileContent: e.GetBinding("rspfile_content"),
+		}
+		for _, d := range after {
+			if err := visit(d); err != nil {
+				return err
+			}
+			out.After = append(out.After, ids[d])
+		}
+		sort.Ints(out.After)
+		for _, n := range e.Inputs {
+			out.Inputs = append(out.Inputs, n.Path)
+		}
+		for _, n := range e.Outputs {
+			out.Outputs = append(out.Outputs, n.Path)
+		}
+		out.ID = len(p.Edges)
+		ids[e] = out.ID
+		p.Edges = append(p.Edges, out)
+		return nil
+	}
+	pools := map[*Pool]struct{}{}
+	for _, e := range edges {
+		if err := visit(e); err != nil {
+			return nil, err
+		}
+		if e.Pool.Depth() != 0 {
+			pools[e.Pool] = struct{}{}
+		}
+	}
+	for pool := range pools {
+		p.Pools = append(p.Pools, PlanPool{Name: pool.Name, Depth: pool.Depth()})
+	}
+	sort.Slice(p.Pools, func(i, j int) bool { return p.Pools[i].Name < p.Pools[j].Name })
+	return p, nil
+}
+
+// planDependencies appends to out the planned edges producing the inputs of
+// e, looking through the phony edges and the edges that are up to date.
+func planDependencies(e *Edge, want map[*Edge]Want, seen map[*Edge]struct{}, out []*Edge) []*Edge {
+	for _, n := range e.Inputs {
+		in := n.InEdge
+		if in == nil {
+			continue
+		}
+		if _, ok := seen[in]; ok {
+			continue
+		}
+		seen[in] = struct{}{}
+		if w, ok := want[in]; ok && w != WantNothing && in.Rule != PhonyRule {
+			out = append(out, in)
+			continue
+		}
+		out = planDependencies(in, want, seen, out)
+	}
+	return out
+}
+
+// ExecutePlan runs the edges of p, honoring the dependencies between them,
+// their pools and config.Parallelism and config.FailuresAllowed.
+//
+// Every edge is run, independently of the state of its outputs. The build
+// log and the deps log are not updated. onFinish, if not nil, is called as
+// each edge completes.
+func ExecutePlan(ctx context.Context, p *PlanFile, config *BuildConfig, onFinish func(e *PlanEdge, exitCode ExitStatus, output string)) error {
+	if p.Version != PlanFileVersion {
+		return fmt.Errorf("unsupported plan version %d", p.Version)
+	}
+	depths := map[string]int{ConsolePool.Name: 1}
+	for _, pool := range p.Pools {
+		depths[pool.Name] = pool.Depth
+	}
+	index := make(map[int]int, len(p.Edges))
+	for i := range p.Edges {
+		if _, ok := index[p.Edges[i].ID]; ok {
+			return fmt.Errorf("duplicate edge id %d", p.Edges[i].ID)
+		}
+		index[p.Edges[i].ID] = i
+	}
+	// blocking[i] is the number of edges edges[i] is waiting for.
+	blocking := make([]int, len(p.Edges))
+	dependents := make([][]int, len(p.Edges))
+	var ready []int
+	for i := range p.Edges {
+		for _, id := range p.Edges[i].After {
+			j, ok := index[id]
+			if !ok {
+				return fmt.Errorf("edge %d depends on unknown edge %d", p.Edges[i].ID, id)
+			}
+			blocking[i]++
+			dependents[j] = append(dependents[j], i)
+		}
+		if blocking[i] == 0 {
+			ready = append(ready, i)
+		}
+	}
+
+	type done struct {
+		i        int
+		exitCode ExitStatus
+		output   string
+	}
+	results := make(chan done)
+	inPool := map[string]int{}
+	running := 0
+	finished := 0
+	failuresAllowed := config.FailuresAllowed
+	for finished != len(p.Edges) {
+		// Start as many edges as permitted.
+		for k := 0; k < len(ready) && ctx.Err() == nil && failuresAllowed != 0; {
+			if config.Parallelism > 0 && running >= config.Parallelism {
+				break
+			}
+			i := ready[k]
+			e := &p.Edges[i]
+			if d := depths[e.Pool]; d != 0 && inPool[e.Pool] >= d {
+				k++
+				continue
+			}
+			ready = append(ready[:k], ready[k+1:]...)
+			inPool[e.Pool]++
+			running++
+			go func() {
+				exitCode, output := runPlanEdge(ctx, e, config)
+				results <- done{i, exitCode, output}
+			}()
+		}
+		if running == 0 {
+			break
+		}
+		r := <-results
+		running--
+		finished++
+		e := &p.Edges[r.i]
+		inPool[e.Pool]--
+		if onFinish != nil {
+			onFinish(e, r.exitCode, r.output)
+		}
+		if r.exitCode != ExitSuccess {
+			if failuresAllowed != 0 {
+				failuresAllowed--
+			}
+			continue
+		}
+		for _, j := range dependents[r.i] {
+			if blocking[j]--; blocking[j] == 0 {
+				ready = append(ready, j)
+			}
+		}
+		sort.Ints(ready)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if failuresAllowed == 0 {
+		if config.FailuresAllowed > 1 {
+			return errors.New("subcommands failed")
+		}
+		return errors.New("subcommand failed")
+	} else if failuresAllowed < config.FailuresAllowed {
+		return errors.New("cannot make progress due to previous errors")
+	} else if finished != len(p.Edges) {
+		return errors.New("dependency cycle in the plan")
+	}
+	return nil
+}
+
+// runPlanEdge runs the command of e after creating its output directories
+// and its response file.
+func runPlanEdge(ctx context.Context, e *PlanEdge, config *BuildConfig) (ExitStatus, string) {
+	if config.DryRun {
+		return ExitSuccess, ""
+	}
+	for _, o := range e.Outputs {
+		if err := os.MkdirAll(filepath.Dir(o), 0o777); err != nil {
+			return ExitFailure, err.Error()
+		}
+	}
+	if e.Rspfile != "" {
+		if err := ioutil.WriteFile(e.Rspfile, []byte(e.RspfileContent), 0o666); err != nil {
+			return ExitFailure, err.Error()
+		}
+	}
+	s := subprocess{shell: config.PosixShell}
+	s.run(ctx, e.Command, nil, e.Cwd, e.Pool == ConsolePool.Name)
+	if ctx.Err() != nil {
+		return ExitInterrupted, s.buf
+	}
+	if s.exitCode != 0 {
+		return ExitFailure, s.buf
+	}
+	if e.Rspfile != "" && !Debug.KeepRsp {
+		_ = os.Remove(e.Rspfile)
+	}
+	return ExitSuccess, s.buf
+}
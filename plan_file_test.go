@@ -0,0 +1,100 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestBuildTest_ExportPlan(t *testing.T) {
+	b := NewBuildTest(t)
+	b.AssertParse(&b.state, "pool link\n  depth = 1\nbuild cat12b: cat cat1 cat2\n  pool = link\nbuild all: phony cat12 cat12b\n", ParseManifestOpts{})
+	if _, err := b.builder.addTargetName("all"); err != nil {
+		t.Fatal(err)
+	}
+	p, err := b.builder.ExportPlan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &PlanFile{
+		Version: PlanFileVersion,
+		Pools:   []PlanPool{{Name: "link", Depth: 1}},
+		Edges: []PlanEdge{
+			{ID: 0, Rule: "cat", Command: "cat in1 > cat1", Inputs: []string{"in1"}, Outputs: []string{"cat1"}},
+			{ID: 1, Rule: "cat", Command: "cat in1 in2 > cat2", Inputs: []string{"in1", "in2"}, Outputs: []string{"cat2"}},
+			{ID: 2, Rule: "cat", Command: "cat cat1 cat2 > cat12", Inputs: []string{"cat1", "cat2"}, Outputs: []string{"cat12"}, After: []int{0, 1}},
+			{ID: 3, Rule: "cat", Command: "cat cat1 cat2 > cat12b", Inputs: []string{"cat1", "cat2"}, Outputs: []string{"cat12b"}, Pool: "link", After: []int{0, 1}},
+		},
+	}
+	if diff := cmp.Diff(want, p); diff != "" {
+		t.Fatal(diff)
+	}
+	if len(b.commandRunner.commandsRan) != 0 {
+		t.Fatal(b.commandRunner.commandsRan)
+	}
+}
+
+func TestExecutePlan(t *testing.T) {
+	CreateTempDirAndEnter(t)
+	p := &PlanFile{
+		Version: PlanFileVersion,
+		Edges: []PlanEdge{
+			{ID: 3, Command: "echo b", Outputs: []string{"out/b"}, After: []int{7}},
+			{ID: 7, Command: "echo a", Outputs: []string{"out/a"}},
+			{ID: 9, Command: "echo c", Outputs: []string{"out/c"}, After: []int{3, 7}},
+		},
+	}
+	config := NewBuildConfig()
+	config.Parallelism = 4
+	var got []string
+	err := ExecutePlan(context.Background(), p, &config, func(e *PlanEdge, exitCode ExitStatus, output string) {
+		if exitCode != ExitSuccess {
+			t.Errorf("%d: %d", e.ID, exitCode)
+		}
+		got = append(got, strings.TrimSpace(output))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"a", "b", "c"}, got); diff != "" {
+		t.Fatal(diff)
+	}
+
+	// The dependents of a failed edge are not run.
+	p.Edges[1].Command = "exit 1"
+	got = nil
+	err = ExecutePlan(context.Background(), p, &config, func(e *PlanEdge, exitCode ExitStatus, output string) {
+		got = append(got, e.Command)
+	})
+	if err == nil || err.Error() != "subcommand failed" {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"exit 1"}, got); diff != "" {
+		t.Fatal(diff)
+	}
+
+	p.Edges[0].After = []int{1}
+	if err := ExecutePlan(context.Background(), p, &config, nil); err == nil || err.Error() != "edge 3 depends on unknown edge 1" {
+		t.Fatal(err)
+	}
+	p.Version = 0
+	if err := ExecutePlan(context.Background(), p, &config, nil); err == nil || err.Error() != "unsupported plan version 0" {
+		t.Fatal(err)
+	}
+}
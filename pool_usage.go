@@ -0,0 +1,114 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"sort"
+	"time"
+)
+
+// PoolUsage summarizes how a pool was used.
+type PoolUsage struct {
+	Pool *Pool
+	// Edges is the number of edges in the manifest assigned to this pool.
+	Edges int
+	// Ran is the number of edges of this pool that ran in the last build.
+	Ran int
+	// Busy is the sum of the duration of the edges of this pool in the last
+	// build.
+	Busy time.Duration
+	// Saturated is the wall time during which all the slots of the pool were in
+	// use during the last build. This is when edges had to wait on the pool.
+	//
+	// It is always 0 for pools with an infinite depth.
+	Saturated time.Duration
+}
+
+// ComputePoolUsage returns the usage of each pool in state, sorted by name.
+//
+// entries is the last build, as returned by ReadLastBuild(). It can be nil.
+func ComputePoolUsage(state *State, entries []*LogEntry) []PoolUsage {
+	usage := make(map[*Pool]*PoolUsage, len(state.Pools))
+	for _, p := range state.AllPools() {
+		usage[p] = &PoolUsage{Pool: p}
+	}
+	for _, e := range state.Edges {
+		if u := usage[e.Pool]; u != nil {
+			u.Edges++
+		}
+	}
+
+	// Edges with multiple outputs have one entry per output.
+	type interval struct {
+		start, end int32
+	}
+	seen := map[*Edge]struct{}{}
+	intervals := map[*Pool][]interval{}
+	for _, entry := range entries {
+		n := state.Paths[entry.output]
+		if n == nil || n.InEdge == nil {
+			continue
+		}
+		if _, ok := seen[n.InEdge]; ok {
+			continue
+		}
+		seen[n.InEdge] = struct{}{}
+		u := usage[n.InEdge.Pool]
+		if u == nil {
+			continue
+		}
+		u.Ran++
+		u.Busy += time.Duration(entry.endTime-entry.startTime) * time.Millisecond
+		intervals[u.Pool] = append(intervals[u.Pool], interval{entry.startTime, entry.endTime})
+	}
+
+	for p, l := range intervals {
+		if p.depth == 0 {
+			continue
+		}
+		// Sweep through the start and end events. Process ends before starts at
+		// the same timestamp.
+		type event struct {
+			t     int32
+			delta int
+		}
+		events := make([]event, 0, 2*len(l))
+		for _, i := range l {
+			events = append(events, event{i.start, 1}, event{i.end, -1})
+		}
+		sort.Slice(events, func(i, j int) bool {
+			if events[i].t != events[j].t {
+				return events[i].t < events[j].t
+			}
+			return events[i].delta < events[j].delta
+		})
+		running := 0
+		var saturated int32
+		for i, e := range events {
+			if running >= p.depth && i != 0 {
+				saturated += e.t - events[i-1].t
+			}
+			running += e.delta
+		}
+		usage[p].Saturated = time.Duration(saturated) * time.Millisecond
+	}
+
+	out := make([]PoolUsage, 0, len(usage))
+	for _, u := range usage {
+		out = append(out, *u)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Pool.Name < out[j].Pool.Name })
+	return out
+}
@@ -0,0 +1,46 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"testing"
+	"time"
+)
+
+func TestComputePoolUsage(t *testing.T) {
+	s := NewStateTestWithBuiltinRules(t)
+	s.AssertParse(&s.state, "pool link\n  depth = 1\nrule link\n  command = link\n  pool = link\nbuild a b: link in\nbuild c: link in\nbuild d: cat in\n", ParseManifestOpts{})
+	entries := []*LogEntry{
+		// a and b are from the same edge.
+		{output: "a", startTime: 0, endTime: 100},
+		{output: "b", startTime: 0, endTime: 100},
+		{output: "d", startTime: 0, endTime: 150},
+		{output: "c", startTime: 100, endTime: 300},
+		{output: "stale", startTime: 0, endTime: 1000},
+	}
+	usage := ComputePoolUsage(&s.state, entries)
+	if len(usage) != 3 {
+		t.Fatal(usage)
+	}
+	if u := usage[0]; u.Pool != DefaultPool || u.Edges != 1 || u.Ran != 1 || u.Busy != 150*time.Millisecond || u.Saturated != 0 {
+		t.Fatalf("%+v", u)
+	}
+	if u := usage[1]; u.Pool != ConsolePool || u.Edges != 0 || u.Ran != 0 {
+		t.Fatalf("%+v", u)
+	}
+	if u := usage[2]; u.Pool.Name != "link" || u.Edges != 2 || u.Ran != 2 || u.Busy != 300*time.Millisecond || u.Saturated != 300*time.Millisecond {
+		t.Fatalf("%+v", u)
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import "sync"
+
+// prefetcher warms the OS page cache with the source files of the edges
+// about to run, so on a cold cache the IO overlaps with the commands already
+// running.
+//
+// Only source files are prefetched; generated files were just written and
+// are likely still cached. Errors are ignored, it is only a hint.
+type prefetcher struct {
+	fetch func(path string)
+	wg    sync.WaitGroup
+
+	// Only accessed by the build goroutine.
+	seen map[*Node]struct{}
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queue  []string
+	closed bool
+}
+
+func newPrefetcher(workers int, fetch func(path string)) *prefetcher {
+	p := &prefetcher{fetch: fetch, seen: map[*Node]struct{}{}}
+	p.cond = sync.NewCond(&p.mu)
+	p.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.run()
+	}
+	return p
+}
+
+// edge queues the source files read by the edge, skipping the order-only
+// inputs.
+func (p *prefetcher) edge(e *Edge) {
+	if e.Rule == PhonyRule {
+		return
+	}
+	var paths []string
+	for i, n := range e.Inputs {
+		if e.IsOrderOnly(i) {
+			break
+		}
+		if n.InEdge != nil {
+			continue
+		}
+		if _, ok := p.seen[n]; ok {
+			continue
+		}
+		p.seen[n] = struct{}{}
+		paths = append(paths, n.Path)
+	}
+	if len(paths) == 0 {
+		return
+	}
+	p.mu.Lock()
+	p.queue = append(p.queue, paths...)
+	p.mu.Unlock()
+	p.cond.Broadcast()
+}
+
+func (p *prefetcher) run() {
+	defer p.wg.Done()
+	for {
+		p.mu.Lock()
+		for len(p.queue) == 0 && !p.closed {
+			p.cond.Wait()
+		}
+		if p.closed {
+			p.mu.Unlock()
+			return
+		}
+		path := p.queue[0]
+		p.queue = p.queue[1:]
+		p.mu.Unlock()
+		p.fetch(path)
+	}
+}
+
+// shutdown discards the pending files and waits for the workers to exit.
+func (p *prefetcher) shutdown() {
+	p.mu.Lock()
+	p.closed = true
+	p.queue = nil
+	p.mu.Unlock()
+	p.cond.Broadcast()
+	p.wg.Wait()
+}
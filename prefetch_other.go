@@ -0,0 +1,35 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux || !(amd64 || arm64)
+// +build !linux !amd64,!arm64
+
+package nin
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// prefetchFile reads the file so it is in the OS cache when the command
+// reads it. There is no portable way to read ahead asynchronously.
+func prefetchFile(path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	_, _ = io.Copy(ioutil.Discard, f)
+	_ = f.Close()
+}
@@ -0,0 +1,70 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"io/ioutil"
+	"sort"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestPrefetcher(t *testing.T) {
+	b := NewStateTestWithBuiltinRules(t)
+	b.AssertParse(&b.state, "build out: cat in1 in2 | imp || oo\nbuild in2: cat src\nbuild out2: cat in1 src\n", ParseManifestOpts{})
+
+	fetched := make(chan string)
+	p := newPrefetcher(2, func(path string) {
+		fetched <- path
+	})
+	// Generated and order-only inputs are skipped and each source file is
+	// only fetched once.
+	for _, e := range b.state.Edges {
+		p.edge(e)
+	}
+	var got []string
+	for i := 0; i < 3; i++ {
+		got = append(got, <-fetched)
+	}
+	p.shutdown()
+	sort.Strings(got)
+	if diff := cmp.Diff([]string{"imp", "in1", "src"}, got); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestBuildTest_Prefetch(t *testing.T) {
+	b := NewBuildTest(t)
+	b.config.PrefetchWorkers = 2
+	CreateTempDirAndEnter(t)
+	if err := ioutil.WriteFile("in", []byte("data"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	b.AssertParse(&b.state, "build out: cat in\n", ParseManifestOpts{})
+	b.fs.Create("in", "")
+	if _, err := b.builder.addTargetName("out"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.builder.Build(); err != nil {
+		t.Fatal(err)
+	}
+	if b.builder.prefetch != nil {
+		t.Fatal("expected the prefetcher to be shut down")
+	}
+	if diff := cmp.Diff([]string{"cat in > out"}, b.commandRunner.commandsRan); diff != "" {
+		t.Fatal(diff)
+	}
+}
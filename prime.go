@@ -0,0 +1,87 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import "sync"
+
+// PrimeStats is the work found by Builder.Prime.
+type PrimeStats struct {
+	// Edges is the number of commands the build would run.
+	Edges int
+	// Sources is the number of source files read by these commands and
+	// Hashed the number of them that were not already in the digest store.
+	Sources int
+	Hashed  int
+}
+
+// Prime does everything a build of the targets does before running the
+// first command, without running any: it stats the files, loads the deps
+// log entries, depfiles and dyndep files, and hashes the source files read
+// by the commands to run into digests, with workers goroutines.
+//
+// It is meant to be run after a reboot or a checkout, so the OS caches and
+// the digest store are warm for the next build.
+func (b *Builder) Prime(targets []*Node, digests *DigestStore, workers int) (PrimeStats, error) {
+	var s PrimeStats
+	unlock := b.state.lock()
+	for _, t := range targets {
+		if _, err := b.addTarget(t); err != nil {
+			unlock()
+			return s, err
+		}
+	}
+	seen := map[*Node]struct{}{}
+	var sources []string
+	for e, want := range b.plan.want {
+		if want == WantNothing || e.Rule == PhonyRule {
+			continue
+		}
+		s.Edges++
+		for _, n := range e.Inputs[:len(e.Inputs)-int(e.OrderOnlyDeps)] {
+			if _, ok := seen[n]; ok || n.InEdge != nil || n.Exists != ExistenceStatusExists {
+				continue
+			}
+			seen[n] = struct{}{}
+			sources = append(sources, n.Path)
+		}
+	}
+	unlock()
+	s.Sources = len(sources)
+	before := digests.Hashed()
+
+	if workers < 1 {
+		workers = 1
+	}
+	ch := make(chan string)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for p := range ch {
+				// Errors are ignored, the file will be hashed again when
+				// needed.
+				_, _ = digests.Get(b.di, p)
+			}
+		}()
+	}
+	for _, p := range sources {
+		ch <- p
+	}
+	close(ch)
+	wg.Wait()
+	s.Hashed = digests.Hashed() - before
+	return s, nil
+}
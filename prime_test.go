@@ -0,0 +1,45 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import "testing"
+
+func TestBuildTest_Prime(t *testing.T) {
+	b := NewBuildTest(t)
+	digests := NewDigestStore()
+	s, err := b.builder.Prime([]*Node{b.GetNode("cat12")}, digests, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != (PrimeStats{Edges: 3, Sources: 2, Hashed: 2}) {
+		t.Fatal(s)
+	}
+	if len(b.commandRunner.commandsRan) != 0 {
+		t.Fatal(b.commandRunner.commandsRan)
+	}
+	if digests.Len() != 2 {
+		t.Fatal(digests.Len())
+	}
+
+	// The digests are reused.
+	b.state.Reset()
+	b.builder = NewBuilder(&b.state, &b.config, nil, nil, &b.fs, b.status, 0)
+	if s, err = b.builder.Prime([]*Node{b.GetNode("cat1")}, digests, 1); err != nil {
+		t.Fatal(err)
+	}
+	if s != (PrimeStats{Edges: 1, Sources: 1}) {
+		t.Fatal(s)
+	}
+}
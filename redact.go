@@ -0,0 +1,99 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// RedactMask replaces the secrets masked by a Redactor.
+const RedactMask = "***"
+
+// Redactor masks the secrets in the commands and their output before they are
+// printed or written to a file, e.g. the tokens passed to the code signing
+// and upload steps, so they don't leak into the CI artifacts.
+//
+// The build log is not affected since it only records a hash of the
+// commands.
+//
+// A nil Redactor masks nothing.
+type Redactor struct {
+	values   []string
+	patterns []*regexp.Regexp
+}
+
+// NewRedactor returns a Redactor masking the value of the environment
+// variables named env and the matches of the regexps patterns. When a pattern
+// has a group, only the text of the first group is masked, e.g.
+// `--token[= ](\S+)` keeps the flag name.
+//
+// The values shorter than 4 characters are ignored; masking them would make
+// the output unreadable without protecting much.
+func NewRedactor(patterns, env []string) (*Redactor, error) {
+	r := &Redactor{}
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("redact: %w", err)
+		}
+		r.patterns = append(r.patterns, re)
+	}
+	for _, name := range env {
+		if v := os.Getenv(name); len(v) >= 4 {
+			r.values = append(r.values, v)
+		}
+	}
+	// Mask the longest values first in case one contains another.
+	sort.SliceStable(r.values, func(i, j int) bool { return len(r.values[i]) > len(r.values[j]) })
+	return r, nil
+}
+
+// Redact returns s with the secrets replaced by RedactMask.
+func (r *Redactor) Redact(s string) string {
+	if r == nil || s == "" {
+		return s
+	}
+	for _, v := range r.values {
+		s = strings.ReplaceAll(s, v, RedactMask)
+	}
+	for _, re := range r.patterns {
+		if re.NumSubexp() == 0 {
+			s = re.ReplaceAllLiteralString(s, RedactMask)
+			continue
+		}
+		matches := re.FindAllStringSubmatchIndex(s, -1)
+		if len(matches) == 0 {
+			continue
+		}
+		var b strings.Builder
+		last := 0
+		for _, m := range matches {
+			// The first group may not participate in the match.
+			if m[2] < 0 {
+				continue
+			}
+			b.WriteString(s[last:m[2]])
+			b.WriteString(RedactMask)
+			last = m[3]
+		}
+		b.WriteString(s[last:])
+		s = b.String()
+	}
+	return s
+}
@@ -0,0 +1,49 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"testing"
+)
+
+func TestRedactor(t *testing.T) {
+	t.Setenv("NIN_TEST_KEY", "s3cr3t-key")
+	t.Setenv("NIN_TEST_SHORT", "ab")
+	r, err := NewRedactor([]string{`--token[= ](\S+)`, `ghp_[A-Za-z0-9]+`}, []string{"NIN_TEST_KEY", "NIN_TEST_SHORT", "NIN_TEST_UNSET"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []struct {
+		in   string
+		want string
+	}{
+		{"", ""},
+		{"codesign -k s3cr3t-key ab", "codesign -k *** ab"},
+		{"upload --token=abc --token def out", "upload --token=*** --token *** out"},
+		{"git clone https://ghp_XyZ123@host/r", "git clone https://***@host/r"},
+	}
+	for i, l := range data {
+		if got := r.Redact(l.in); got != l.want {
+			t.Fatalf("#%d: %q", i, got)
+		}
+	}
+	var none *Redactor
+	if got := none.Redact("--token=abc"); got != "--token=abc" {
+		t.Fatal(got)
+	}
+	if _, err := NewRedactor([]string{"("}, nil); err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -0,0 +1,203 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Relocation replaces a directory with another one in the paths recorded in
+// the logs, so a build directory that was copied or moved, along with the
+// source tree it refers to, stays incremental.
+type Relocation struct {
+	Old string
+	New string
+}
+
+// NewRelocation returns a Relocation of the directory oldDir to newDir.
+func NewRelocation(oldDir, newDir string) (Relocation, error) {
+	r := Relocation{
+		Old: CanonicalizePath(filepath.ToSlash(oldDir)),
+		New: CanonicalizePath(filepath.ToSlash(newDir)),
+	}
+	if oldDir == "" || newDir == "" || r.Old == "." || r.New == "." {
+		return r, errors.New("the directories to relocate must not be empty")
+	}
+	if r.Old == r.New {
+		return r, errors.New("the directories to relocate are the same")
+	}
+	return r, nil
+}
+
+// Path returns path relocated and whether it is in the old directory.
+func (r *Relocation) Path(path string) (string, bool) {
+	if path == r.Old {
+		return r.New, true
+	}
+	if strings.HasPrefix(path, r.Old) && path[len(r.Old)] == '/' {
+		return r.New + path[len(r.Old):], true
+	}
+	return path, false
+}
+
+// Command returns command with the occurrences of the old directory replaced,
+// when it is an absolute path. Relative directories are too ambiguous to be
+// replaced in free form text.
+func (r *Relocation) Command(command string) string {
+	if !filepath.IsAbs(r.Old) && !strings.HasPrefix(r.Old, "/") {
+		return command
+	}
+	var b strings.Builder
+	for {
+		i := strings.Index(command, r.Old)
+		if i == -1 {
+			break
+		}
+		end := i + len(r.Old)
+		b.WriteString(command[:i])
+		// Skip the occurrences in the middle of another path but not the ones
+		// after a flag, e.g. -I/old/include.
+		j := i - 1
+		for j >= 0 && isPathChar(command[j]) {
+			j--
+		}
+		if (j < 0 || command[j] != '/') && (end == len(command) || !isPathChar(command[end])) {
+			b.WriteString(r.New)
+		} else {
+			b.WriteString(r.Old)
+		}
+		command = command[end:]
+	}
+	b.WriteString(command)
+	return b.String()
+}
+
+// isPathChar returns true if c can be part of a file name.
+func isPathChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '_' || c == '-' || c == '+'
+}
+
+// RelocateBuildLog rewrites the build log at path with the outputs and the
+// commands relocated. It returns the number of entries changed.
+//
+// Only the commands recorded by log version 6 and later can be relocated;
+// the older ones are only recorded as a hash.
+func RelocateBuildLog(path string, r Relocation) (int, error) {
+	defer metricRecord(".ninja_log relocate")()
+	b := NewBuildLog()
+	if err := b.Load(path); err != nil {
+		return 0, err
+	}
+	entries := make([]*LogEntry, 0, len(b.Entries))
+	for _, e := range b.Entries {
+		entries = append(entries, e)
+	}
+	changed := 0
+	for _, e := range entries {
+		output, moved := r.Path(e.output)
+		if e.hasCommand() {
+			if c := r.Command(e.command); c != e.command {
+				e.command = c
+				e.commandHash128 = HashCommand128(c)
+				moved = true
+			}
+		}
+		if !moved {
+			continue
+		}
+		changed++
+		if output != e.output {
+			// An entry already recorded for the new path is older than the build
+			// being relocated.
+			delete(b.Entries, e.output)
+			e.output = output
+			b.Entries[output] = e
+		}
+	}
+	if changed == 0 {
+		return 0, nil
+	}
+	return changed, b.Recompact(path, noDeadPaths{})
+}
+
+// RelocateDepsLog rewrites the deps log at path with the paths of the nodes
+// relocated. It returns the number of paths changed.
+func RelocateDepsLog(path string, r Relocation) (int, error) {
+	defer metricRecord(".ninja_deps relocate")()
+	state := NewState()
+	d := DepsLog{}
+	if err := d.Load(path, &state); err != nil {
+		return 0, err
+	}
+	if err := d.Close(); err != nil {
+		return 0, err
+	}
+	changed := 0
+	// nodes maps the ids in d to the nodes in the new log.
+	nodes := make([]*Node, len(d.Nodes))
+	newState := NewState()
+	for i, n := range d.Nodes {
+		p, moved := r.Path(n.Path)
+		if moved {
+			changed++
+		}
+		nodes[i] = newState.GetNode(p, n.SlashBits)
+	}
+	if changed == 0 {
+		return 0, nil
+	}
+
+	tempPath := path + ".relocate"
+	if err := os.Remove(tempPath); err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	newLog := DepsLog{NoChecksum: true}
+	if err := newLog.OpenForWrite(tempPath); err != nil {
+		return 0, err
+	}
+	for id, deps := range d.Deps {
+		if deps == nil {
+			continue
+		}
+		inputs := make([]*Node, len(deps.Nodes))
+		for i, n := range deps.Nodes {
+			inputs[i] = nodes[n.ID]
+		}
+		if err := newLog.recordDeps(nodes[id], deps.MTime, inputs); err != nil {
+			_ = newLog.Close()
+			return 0, err
+		}
+	}
+	if err := newLog.Close(); err != nil {
+		return 0, err
+	}
+	if err := os.Remove(path); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tempPath, path); err != nil {
+		return 0, err
+	}
+	return changed, newLog.sum.save(d.checksumFS(), path)
+}
+
+// noDeadPaths is a BuildLogUser keeping all the entries.
+type noDeadPaths struct{}
+
+func (noDeadPaths) IsPathDead(string) bool {
+	return false
+}
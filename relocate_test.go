@@ -0,0 +1,120 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRelocation(t *testing.T) {
+	r, err := NewRelocation("/old/", "/new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for in, want := range map[string]string{
+		"/old":       "/new",
+		"/old/a":     "/new/a",
+		"/older/a":   "/older/a",
+		"/x/old/a":   "/x/old/a",
+		"relative/a": "relative/a",
+	} {
+		if got, _ := r.Path(in); got != want {
+			t.Fatalf("%s: %s != %s", in, got, want)
+		}
+	}
+	got := r.Command("cc -I/old/include -I/older /old/a.c -o /x/old/a.o")
+	if want := "cc -I/new/include -I/older /new/a.c -o /x/old/a.o"; got != want {
+		t.Fatal(got)
+	}
+	if _, err := NewRelocation("out", "./out/"); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestRelocateBuildLog(t *testing.T) {
+	s := NewStateTestWithBuiltinRules(t)
+	s.AssertParse(&s.state, "build /old/out: cat /old/in\nbuild rel: cat in\n", ParseManifestOpts{})
+	path := filepath.Join(t.TempDir(), ".ninja_log")
+	l := NewBuildLog()
+	if err := l.OpenForWrite(path, noDeadPaths{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range s.state.Edges {
+		if err := l.RecordCommand(e, 1, 2, 3); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, _ := NewRelocation("/old", "/new")
+	if n, err := RelocateBuildLog(path, r); n != 1 || err != nil {
+		t.Fatal(n, err)
+	}
+	l2 := NewBuildLog()
+	if err := l2.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	e := l2.Entries["/new/out"]
+	if e == nil || l2.Entries["rel"] == nil || len(l2.Entries) != 2 {
+		t.Fatal(l2.Entries)
+	}
+	if e.command != "cat /new/in > /new/out" || e.commandHash128 != HashCommand128(e.command) || e.mtime != 3 {
+		t.Fatal(e)
+	}
+}
+
+func TestRelocateDepsLog(t *testing.T) {
+	s := NewState()
+	path := filepath.Join(t.TempDir(), ".ninja_deps")
+	d := DepsLog{}
+	if err := d.OpenForWrite(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.recordDeps(s.GetNode("out.o", 0), 1, []*Node{s.GetNode("/old/a.h", 0), s.GetNode("b.h", 0)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, _ := NewRelocation("/old", "/new")
+	if n, err := RelocateDepsLog(path, r); n != 1 || err != nil {
+		t.Fatal(n, err)
+	}
+	s2 := NewState()
+	d2 := DepsLog{}
+	if err := d2.Load(path, &s2); err != nil {
+		t.Fatal(err)
+	}
+	defer d2.Close()
+	deps := d2.GetDeps(s2.Paths["out.o"])
+	if deps == nil {
+		t.Fatal("missing deps")
+	}
+	var got []string
+	for _, n := range deps.Nodes {
+		got = append(got, n.Path)
+	}
+	sort.Strings(got)
+	if diff := cmp.Diff([]string{"/new/a.h", "b.h"}, got); diff != "" {
+		t.Fatal(diff)
+	}
+}
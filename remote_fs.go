@@ -0,0 +1,249 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The remote file system protocol is plain HTTP, one request per operation:
+//
+//	GET    /stat?path=P  returns the mtime of P as a decimal number.
+//	GET    /file?path=P  returns the content of P.
+//	PUT    /file?path=P  replaces the content of P with the request body.
+//	DELETE /file?path=P  removes P.
+//	POST   /dir?path=P   creates the directory P.
+//
+// Every request carries the server's token as "Authorization: Bearer TOKEN",
+// otherwise it is rejected with 401. P must be relative to the root of the
+// server and stay under it, otherwise the request is rejected with 403.
+//
+// A missing file is reported as 404 and an already existing directory as 409,
+// so os.IsNotExist() and os.IsExist() work on the client side. Any other
+// failure is reported as 500 with the error message as the body.
+
+// RemoteFileSystem is an implementation of FileSystem that proxies all the
+// accesses to a server created with NewRemoteFileSystemHandler.
+//
+// This permits running the planner on one machine while the tree lives on
+// another one.
+type RemoteFileSystem struct {
+	// URL is the base URL of the server, e.g. "http://fileserver:8080".
+	URL string
+	// Client is the HTTP client to use. http.DefaultClient is used if nil.
+	Client *http.Client
+	// Token is the secret passed to NewRemoteFileSystemHandler.
+	Token string
+}
+
+// Stat implements FileSystem.
+func (r *RemoteFileSystem) Stat(path string) (TimeStamp, error) {
+	b, err := r.do("stat", http.MethodGet, "/stat", path, nil)
+	if err != nil {
+		return -1, err
+	}
+	v, err := strconv.ParseInt(string(b), 10, 64)
+	if err != nil {
+		return -1, fmt.Errorf("stat %s: invalid reply %q", path, b)
+	}
+	return TimeStamp(v), nil
+}
+
+// WriteFile implements FileSystem.
+func (r *RemoteFileSystem) WriteFile(path, contents string) error {
+	_, err := r.do("write", http.MethodPut, "/file", path, strings.NewReader(contents))
+	return err
+}
+
+// MakeDir implements FileSystem.
+func (r *RemoteFileSystem) MakeDir(path string) error {
+	_, err := r.do("mkdir", http.MethodPost, "/dir", path, nil)
+	return err
+}
+
+// ReadFile implements FileSystem.
+func (r *RemoteFileSystem) ReadFile(path string) ([]byte, error) {
+	b, err := r.do("read", http.MethodGet, "/file", path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != 0 {
+		// Honor the FileReader contract of a trailing zero byte.
+		b = append(b, 0)
+	}
+	return b, nil
+}
+
+// RemoveFile implements FileSystem.
+func (r *RemoteFileSystem) RemoveFile(path string) error {
+	_, err := r.do("remove", http.MethodDelete, "/file", path, nil)
+	return err
+}
+
+// do sends one request and returns the body of the reply.
+func (r *RemoteFileSystem) do(op, method, endpoint, path string, body io.Reader) ([]byte, error) {
+	c := r.Client
+	if c == nil {
+		c = http.DefaultClient
+	}
+	u := strings.TrimSuffix(r.URL, "/") + endpoint + "?path=" + url.QueryEscape(path)
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, &os.PathError{Op: op, Path: path, Err: err}
+	}
+	req.Header.Set("Authorization", "Bearer "+r.Token)
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, &os.PathError{Op: op, Path: path, Err: err}
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return nil, &os.PathError{Op: op, Path: path, Err: err}
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return b, nil
+	case http.StatusNotFound:
+		return nil, &os.PathError{Op: op, Path: path, Err: os.ErrNotExist}
+	case http.StatusConflict:
+		return nil, &os.PathError{Op: op, Path: path, Err: os.ErrExist}
+	default:
+		return nil, &os.PathError{Op: op, Path: path, Err: errors.New(strings.TrimSpace(string(b)))}
+	}
+}
+
+// NewRemoteFileSystemHandler returns a http.Handler that serves the files of fs
+// under the directory root to RemoteFileSystem clients presenting token.
+//
+// The paths requested are relative to root; absolute paths and paths escaping
+// root are rejected. Symlinks under root are followed. token must not be
+// empty.
+func NewRemoteFileSystemHandler(fs FileSystem, root, token string) http.Handler {
+	if token == "" {
+		panic("a token is required")
+	}
+	want := []byte("Bearer " + token)
+	m := http.NewServeMux()
+	// handle wraps f with the authentication and resolves the path requested
+	// under root.
+	handle := func(pattern string, f func(w http.ResponseWriter, req *http.Request, p string)) {
+		m.HandleFunc(pattern, func(w http.ResponseWriter, req *http.Request) {
+			if subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), want) != 1 {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			p, ok := remoteFileSystemPath(root, req.URL.Query().Get("path"))
+			if !ok {
+				http.Error(w, "forbidden path", http.StatusForbidden)
+				return
+			}
+			f(w, req, p)
+		})
+	}
+	handle("/stat", func(w http.ResponseWriter, req *http.Request, path string) {
+		if req.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		mtime, err := fs.Stat(path)
+		if mtime < 0 {
+			remoteFileSystemError(w, err)
+			return
+		}
+		_, _ = io.WriteString(w, strconv.FormatInt(int64(mtime), 10))
+	})
+	handle("/file", func(w http.ResponseWriter, req *http.Request, path string) {
+		switch req.Method {
+		case http.MethodGet:
+			b, err := fs.ReadFile(path)
+			if err != nil {
+				remoteFileSystemError(w, err)
+				return
+			}
+			if len(b) != 0 {
+				// Strip the trailing zero byte.
+				b = b[:len(b)-1]
+			}
+			_, _ = w.Write(b)
+		case http.MethodPut:
+			var buf bytes.Buffer
+			if _, err := buf.ReadFrom(req.Body); err != nil {
+				remoteFileSystemError(w, err)
+				return
+			}
+			if err := fs.WriteFile(path, buf.String()); err != nil {
+				remoteFileSystemError(w, err)
+			}
+		case http.MethodDelete:
+			if err := fs.RemoveFile(path); err != nil {
+				remoteFileSystemError(w, err)
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	handle("/dir", func(w http.ResponseWriter, req *http.Request, path string) {
+		if req.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := fs.MakeDir(path); err != nil {
+			remoteFileSystemError(w, err)
+		}
+	})
+	return m
+}
+
+// remoteFileSystemPath returns the path of p under root. It returns false if p
+// is absolute or escapes root once cleaned.
+func remoteFileSystemPath(root, p string) (string, bool) {
+	if p == "" || filepath.IsAbs(p) || filepath.VolumeName(p) != "" {
+		return "", false
+	}
+	p = path.Clean(filepath.ToSlash(p))
+	if strings.HasPrefix(p, "/") || p == ".." || strings.HasPrefix(p, "../") {
+		return "", false
+	}
+	if root == "" {
+		return p, true
+	}
+	return path.Join(filepath.ToSlash(root), p), true
+}
+
+func remoteFileSystemError(w http.ResponseWriter, err error) {
+	switch {
+	case os.IsNotExist(err):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case os.IsExist(err):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case err == nil:
+		http.Error(w, "unknown error", http.StatusInternalServerError)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"errors"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func newRemoteFileSystemTest(t *testing.T, fs FileSystem) *RemoteFileSystem {
+	s := httptest.NewServer(NewRemoteFileSystemHandler(fs, "", "secret"))
+	t.Cleanup(s.Close)
+	return &RemoteFileSystem{URL: s.URL, Client: s.Client(), Token: "secret"}
+}
+
+func TestRemoteFileSystem(t *testing.T) {
+	v := NewVirtualFileSystem()
+	v.Tick()
+	v.Create("in", "content")
+	v.Create("empty", "")
+	r := newRemoteFileSystemTest(t, &v)
+
+	if mtime, err := r.Stat("in"); mtime != 2 || err != nil {
+		t.Fatal(mtime, err)
+	}
+	if mtime, err := r.Stat("missing"); mtime != 0 || err != nil {
+		t.Fatal(mtime, err)
+	}
+	b, err := r.ReadFile("in")
+	if err != nil || string(b) != "content\x00" {
+		t.Fatalf("%q, %v", b, err)
+	}
+	if b, err := r.ReadFile("empty"); len(b) != 0 || err != nil {
+		t.Fatalf("%q, %v", b, err)
+	}
+	if _, err := r.ReadFile("missing"); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+
+	if err := r.WriteFile("out", "a\nb"); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := v.ReadFile("out"); string(b) != "a\nb\x00" || err != nil {
+		t.Fatalf("%q, %v", b, err)
+	}
+	if err := r.MakeDir("dir"); err != nil {
+		t.Fatal(err)
+	}
+	if d := v.DirectoriesMade(); len(d) != 1 || d[0] != "dir" {
+		t.Fatal(d)
+	}
+	if err := r.RemoveFile("out"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.RemoveFile("out"); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+}
+
+func TestRemoteFileSystem_StatError(t *testing.T) {
+	v := NewVirtualFileSystem()
+	v.Create("bad", "")
+	v.SetStatError("bad", errors.New("oops"))
+	r := newRemoteFileSystemTest(t, &v)
+	mtime, err := r.Stat("bad")
+	if mtime != -1 || err == nil || err.Error() != "stat bad: oops" {
+		t.Fatal(mtime, err)
+	}
+}
+
+func TestRemoteFileSystem_Token(t *testing.T) {
+	v := NewVirtualFileSystem()
+	v.Create("in", "content")
+	r := newRemoteFileSystemTest(t, &v)
+	for _, token := range []string{"", "wrong"} {
+		r.Token = token
+		if _, err := r.ReadFile("in"); err == nil || err.Error() != "read in: unauthorized" {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRemoteFileSystem_Paths(t *testing.T) {
+	v := NewVirtualFileSystem()
+	v.Create("root/in", "content")
+	v.Create("out", "secret")
+	s := httptest.NewServer(NewRemoteFileSystemHandler(&v, "root", "secret"))
+	defer s.Close()
+	r := &RemoteFileSystem{URL: s.URL, Client: s.Client(), Token: "secret"}
+	for _, p := range []string{"in", "./in", "a/../in"} {
+		if b, err := r.ReadFile(p); err != nil || string(b) != "content\x00" {
+			t.Fatalf("%s: %q, %v", p, b, err)
+		}
+	}
+	for _, p := range []string{"", "/out", "../out", "a/../../out", "..", "/root/in"} {
+		if _, err := r.ReadFile(p); err == nil || err.Error() != "read "+p+": forbidden path" {
+			t.Fatalf("%s: %v", p, err)
+		}
+		if err := r.WriteFile(p, "x"); err == nil {
+			t.Fatalf("%s: expected an error", p)
+		}
+	}
+	if b, _ := v.ReadFile("out"); string(b) != "secret\x00" {
+		t.Fatalf("%q", b)
+	}
+}
+
+func TestRemoteFileSystem_Unreachable(t *testing.T) {
+	s := httptest.NewServer(nil)
+	r := &RemoteFileSystem{URL: s.URL, Client: s.Client()}
+	s.Close()
+	if mtime, err := r.Stat("in"); mtime != -1 || err == nil {
+		t.Fatal(mtime, err)
+	}
+}
+
+func TestRemoteFileSystem_RealDisk(t *testing.T) {
+	CreateTempDirAndEnter(t)
+	r := newRemoteFileSystemTest(t, &RealDiskInterface{})
+	if err := MakeDirs(r, "a/b/c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.MakeDir("a"); !os.IsExist(err) {
+		t.Fatal(err)
+	}
+	if err := r.WriteFile("a/b/c", "x"); err != nil {
+		t.Fatal(err)
+	}
+	if mtime, err := r.Stat("a/b/c"); mtime <= 0 || err != nil {
+		t.Fatal(mtime, err)
+	}
+}
+
+func TestRemoteFileSystem_Parse(t *testing.T) {
+	v := NewVirtualFileSystem()
+	v.Create("build.ninja", "rule cat\n  command = cat $in > $out\nsubninja sub.ninja\n")
+	v.Create("sub.ninja", "build out: cat in\n")
+	r := newRemoteFileSystemTest(t, &v)
+
+	state := NewState()
+	input, err := r.ReadFile("build.ninja")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ParseManifest(&state, r, ParseManifestOpts{}, "build.ninja", input); err != nil {
+		t.Fatal(err)
+	}
+	if state.Paths["out"] == nil {
+		t.Fatal("expected out")
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import "sort"
+
+// ReplaySchedule is the schedule of a recorded build. It makes a Builder
+// start the same edges in the same order and with the same overlap, to
+// reproduce failures that only happen with a particular schedule, e.g. a
+// missing dependency.
+//
+// An edge is only started once all the edges before it were started and all
+// the edges that had completed when it started in the recorded build
+// completed. Edges not in the recorded build are started when the next
+// recorded edge is not ready. Recorded edges that are not part of the build
+// are ignored, but the dependencies between the recorded edges must not have
+// changed.
+type ReplaySchedule struct {
+	// order is the edges sorted by start time.
+	order []scheduledEdge
+	// waits[i] is the number of edges in byEnd that must be done before
+	// order[i] is started.
+	waits []int
+	// byEnd is the edges sorted by end time.
+	byEnd    []*Edge
+	index    map[*Edge]struct{}
+	done     map[*Edge]struct{}
+	next     int
+	doneUpTo int
+	peak     int
+}
+
+// NewReplaySchedule returns the schedule of the build recorded in entries,
+// as returned by ReadLastBuild().
+func NewReplaySchedule(state *State, entries []*LogEntry) *ReplaySchedule {
+	r := &ReplaySchedule{
+		order: scheduledEdges(state, entries),
+		index: map[*Edge]struct{}{},
+		done:  map[*Edge]struct{}{},
+	}
+	sort.SliceStable(r.order, func(i, j int) bool { return r.order[i].start < r.order[j].start })
+	byEnd := make([]scheduledEdge, len(r.order))
+	copy(byEnd, r.order)
+	sort.SliceStable(byEnd, func(i, j int) bool { return byEnd[i].end < byEnd[j].end })
+	r.byEnd = make([]*Edge, len(byEnd))
+	for i, e := range byEnd {
+		r.byEnd[i] = e.edge
+		r.index[e.edge] = struct{}{}
+	}
+	r.waits = make([]int, len(r.order))
+	for i, e := range r.order {
+		r.waits[i] = sort.Search(len(byEnd), func(j int) bool { return byEnd[j].end > e.start })
+		if running := i + 1 - r.waits[i]; running > r.peak {
+			r.peak = running
+		}
+	}
+	return r
+}
+
+// Edges returns the recorded edges, in the order they were started.
+func (r *ReplaySchedule) Edges() []*Edge {
+	out := make([]*Edge, len(r.order))
+	for i, e := range r.order {
+		out[i] = e.edge
+	}
+	return out
+}
+
+// Parallelism returns the maximum number of edges that ran concurrently.
+func (r *ReplaySchedule) Parallelism() int {
+	return r.peak
+}
+
+// Replay makes the builder follow r. It must be called before Build.
+func (b *Builder) Replay(r *ReplaySchedule) {
+	b.plan.replay = r
+}
+
+// findWork returns the next edge to start or nil if it must wait for edges
+// to complete.
+func (r *ReplaySchedule) findWork(p *plan) *Edge {
+	for r.next < len(r.order) {
+		e := r.order[r.next].edge
+		w, ok := p.want[e]
+		if !ok || w == WantNothing {
+			// The edge is not part of this build.
+			r.next++
+			r.finished(e)
+			continue
+		}
+		if w == WantToFinish && r.doneUpTo >= r.waits[r.next] {
+			if f := p.ready.popMatching(1, func(x *Edge) bool { return x == e }); len(f) != 0 {
+				r.next++
+				return e
+			}
+		}
+		break
+	}
+	// Start the edges that were not recorded, e.g. phony edges, right away.
+	f := p.ready.popMatching(1, func(x *Edge) bool {
+		_, ok := r.index[x]
+		return !ok || r.next == len(r.order)
+	})
+	if len(f) != 0 {
+		return f[0]
+	}
+	return nil
+}
+
+// finished records that the edge completed, successfully or not.
+func (r *ReplaySchedule) finished(e *Edge) {
+	if _, ok := r.index[e]; !ok {
+		return
+	}
+	r.done[e] = struct{}{}
+	for r.doneUpTo < len(r.byEnd) {
+		if _, ok := r.done[r.byEnd[r.doneUpTo]]; !ok {
+			break
+		}
+		r.doneUpTo++
+	}
+}
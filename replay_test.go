@@ -0,0 +1,89 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestBuildTest_Replay(t *testing.T) {
+	b := NewBuildTest(t)
+	b.commandRunner.maxActiveEdges = 2
+	// cat2 started first, cat1 only once cat2 completed.
+	entries := []*LogEntry{
+		{output: "cat2", startTime: 0, endTime: 10},
+		{output: "cat1", startTime: 10, endTime: 20},
+		{output: "cat12", startTime: 20, endTime: 30},
+		{output: "unknown", startTime: 30, endTime: 40},
+	}
+	r := NewReplaySchedule(&b.state, entries)
+	if p := r.Parallelism(); p != 1 {
+		t.Fatal(p)
+	}
+	var got []string
+	for _, e := range r.Edges() {
+		got = append(got, e.Outputs[0].Path)
+	}
+	if diff := cmp.Diff([]string{"cat2", "cat1", "cat12"}, got); diff != "" {
+		t.Fatal(diff)
+	}
+	b.builder.Replay(r)
+	b.builder.Hooks.BeforeEdge = func(edge *Edge) EdgeDecision {
+		if n := len(b.commandRunner.activeEdges); n != 0 {
+			t.Errorf("%s started with %d edges running", edge.Outputs[0].Path, n)
+		}
+		return EdgeDecision{}
+	}
+	if _, err := b.builder.addTargetName("cat12"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.builder.Build(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"cat in1 in2 > cat2", "cat in1 > cat1", "cat cat1 cat2 > cat12"}
+	if diff := cmp.Diff(want, b.commandRunner.commandsRan); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestBuildTest_ReplayOverlap(t *testing.T) {
+	b := NewBuildTest(t)
+	b.commandRunner.maxActiveEdges = 2
+	b.AssertParse(&b.state, "build all: phony cat12 cat3\nbuild cat3: cat in1\n", ParseManifestOpts{})
+	// cat3 is not recorded, it is started when the recorded edges are not
+	// ready.
+	entries := []*LogEntry{
+		{output: "cat2", startTime: 0, endTime: 10},
+		{output: "cat1", startTime: 5, endTime: 20},
+		{output: "cat12", startTime: 20, endTime: 30},
+	}
+	r := NewReplaySchedule(&b.state, entries)
+	if p := r.Parallelism(); p != 2 {
+		t.Fatal(p)
+	}
+	b.builder.Replay(r)
+	if _, err := b.builder.addTargetName("all"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.builder.Build(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"cat in1 in2 > cat2", "cat in1 > cat1", "cat in1 > cat3", "cat cat1 cat2 > cat12"}
+	if diff := cmp.Diff(want, b.commandRunner.commandsRan); diff != "" {
+		t.Fatal(diff)
+	}
+}
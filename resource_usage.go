@@ -0,0 +1,141 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ResourceUsage is the resources used by the command of an edge, including
+// the processes it waited for.
+//
+// MaxRSS, ReadBytes and WrittenBytes are only known on posix. The I/O is the
+// one reaching the block devices, so reads served from the page cache are not
+// counted, and it is only known on Linux.
+type ResourceUsage struct {
+	UserTime   time.Duration
+	SystemTime time.Duration
+	// MaxRSS is the maximum resident set size in bytes of the largest process.
+	MaxRSS       int64
+	ReadBytes    int64
+	WrittenBytes int64
+}
+
+// String returns the usage as serialized in the build log.
+func (r *ResourceUsage) String() string {
+	return fmt.Sprintf("%d,%d,%d,%d,%d", r.UserTime.Microseconds(), r.SystemTime.Microseconds(), r.MaxRSS, r.ReadBytes, r.WrittenBytes)
+}
+
+// parseResourceUsage parses the output of ResourceUsage.String().
+func parseResourceUsage(s string) (ResourceUsage, error) {
+	f := strings.Split(s, ",")
+	if len(f) != 5 {
+		return ResourceUsage{}, errors.New("invalid resource usage")
+	}
+	var v [5]int64
+	for i := range f {
+		var err error
+		if v[i], err = strconv.ParseInt(f[i], 10, 64); err != nil {
+			return ResourceUsage{}, err
+		}
+	}
+	return ResourceUsage{
+		UserTime:     time.Duration(v[0]) * time.Microsecond,
+		SystemTime:   time.Duration(v[1]) * time.Microsecond,
+		MaxRSS:       v[2],
+		ReadBytes:    v[3],
+		WrittenBytes: v[4],
+	}, nil
+}
+
+// RuleUsage is the resources used by the edges of a rule.
+type RuleUsage struct {
+	Rule  string
+	Edges int
+	// UserTime, SystemTime, ReadBytes and WrittenBytes are the sums for all the
+	// edges. MaxRSS is the largest one.
+	ResourceUsage
+}
+
+// UsageSummary aggregates the resources used by the edges per rule, to find
+// the rules that are CPU or memory hogs.
+//
+// Call Record from BuilderHooks.AfterEdge.
+type UsageSummary struct {
+	rules map[string]*RuleUsage
+}
+
+// Record adds the resources used by an edge.
+func (u *UsageSummary) Record(rule string, usage *ResourceUsage) {
+	if u.rules == nil {
+		u.rules = map[string]*RuleUsage{}
+	}
+	r := u.rules[rule]
+	if r == nil {
+		r = &RuleUsage{Rule: rule}
+		u.rules[rule] = r
+	}
+	r.Edges++
+	r.UserTime += usage.UserTime
+	r.SystemTime += usage.SystemTime
+	r.ReadBytes += usage.ReadBytes
+	r.WrittenBytes += usage.WrittenBytes
+	if usage.MaxRSS > r.MaxRSS {
+		r.MaxRSS = usage.MaxRSS
+	}
+}
+
+// Rules returns the usage per rule, sorted by decreasing CPU time.
+func (u *UsageSummary) Rules() []RuleUsage {
+	out := make([]RuleUsage, 0, len(u.rules))
+	for _, r := range u.rules {
+		out = append(out, *r)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		ci := out[i].UserTime + out[i].SystemTime
+		cj := out[j].UserTime + out[j].SystemTime
+		if ci != cj {
+			return ci > cj
+		}
+		return out[i].Rule < out[j].Rule
+	})
+	return out
+}
+
+// RecordBuildLog adds the resources recorded in the build log for the edges
+// of state. Each edge is counted once, and the entries without resource usage,
+// e.g. recorded by an older version, are skipped.
+func (u *UsageSummary) RecordBuildLog(state *State, l *BuildLog) {
+	seen := map[*Edge]struct{}{}
+	for p, e := range l.Entries {
+		if e.usage == (ResourceUsage{}) {
+			continue
+		}
+		n := state.Paths[p]
+		if n == nil || n.InEdge == nil {
+			continue
+		}
+		if _, ok := seen[n.InEdge]; ok {
+			continue
+		}
+		seen[n.InEdge] = struct{}{}
+		u.Record(n.InEdge.Rule.Name, &e.usage)
+	}
+}
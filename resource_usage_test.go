@@ -0,0 +1,66 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestUsageSummary(t *testing.T) {
+	s := NewStateTestWithBuiltinRules(t)
+	s.AssertParse(&s.state,
+		"rule cc\n  command = cc $in -o $out\n"+
+			"build a.o: cc a.c\n"+
+			"build b.o: cc b.c\n"+
+			"build out1 out2: cat a.o b.o\n"+
+			"build old: cat in\n",
+		ParseManifestOpts{})
+	path := filepath.Join(t.TempDir(), ".ninja_log")
+	l := NewBuildLog()
+	if err := l.OpenForWrite(path, noDeadPaths{}); err != nil {
+		t.Fatal(err)
+	}
+	usages := []ResourceUsage{
+		{UserTime: time.Second, MaxRSS: 100, ReadBytes: 1},
+		{UserTime: time.Second, SystemTime: time.Second, MaxRSS: 200, WrittenBytes: 2},
+		{UserTime: time.Millisecond, MaxRSS: 10},
+		{},
+	}
+	for i, e := range s.state.Edges {
+		if err := l.RecordCommandUsage(e, 0, 1, 1, &usages[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	l2 := NewBuildLog()
+	if err := l2.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	u := UsageSummary{}
+	u.RecordBuildLog(&s.state, &l2)
+	want := []RuleUsage{
+		{Rule: "cc", Edges: 2, ResourceUsage: ResourceUsage{UserTime: 2 * time.Second, SystemTime: time.Second, MaxRSS: 200, ReadBytes: 1, WrittenBytes: 2}},
+		{Rule: "cat", Edges: 1, ResourceUsage: ResourceUsage{UserTime: time.Millisecond, MaxRSS: 10}},
+	}
+	if diff := cmp.Diff(want, u.Rules()); diff != "" {
+		t.Fatal(diff)
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// SandboxProfile returns a profile for macOS's sandbox-exec(1) that only
+// permits the command of edge to write its outputs, its depfile and its
+// response file, plus the temporary directories.
+//
+// dir is the absolute path of the build directory, used to resolve the
+// relative paths. Use it with:
+//
+//	sandbox-exec -f edge.sb /bin/sh -c "<command>"
+//
+// Reading is permitted everywhere, so an undeclared input isn't detected. If
+// denyNetwork is true, network access is also denied.
+func SandboxProfile(edge *Edge, dir string, denyNetwork bool) string {
+	var paths []string
+	add := func(p string) {
+		if p == "" {
+			return
+		}
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(dir, p)
+		}
+		paths = append(paths, filepath.Clean(p))
+	}
+	for _, o := range edge.Outputs {
+		add(o.Path)
+	}
+	add(edge.GetUnescapedDepfile())
+	add(edge.GetUnescapedRspfile())
+	sort.Strings(paths)
+
+	var b strings.Builder
+	b.WriteString("(version 1)\n(allow default)\n(deny file-write*)\n(allow file-write*\n")
+	for i, p := range paths {
+		if i != 0 && paths[i-1] == p {
+			continue
+		}
+		// Tools often write to a temporary file next to the output then rename
+		// it, e.g. "foo.o.tmp".
+		b.WriteString("  (regex #\"^" + sandboxRegexpQuote(p) + "([.-][^/]*)?$\")\n")
+	}
+	b.WriteString("  (subpath \"/private/tmp\")\n  (subpath \"/private/var/folders\")\n  (literal \"/dev/null\")\n  (literal \"/dev/zero\")\n  (literal \"/dev/dtracehelper\")\n  (regex #\"^/dev/tty\"))\n")
+	if denyNetwork {
+		// Permit localhost and the unix sockets, e.g. for a compiler cache.
+		b.WriteString("(deny network*)\n(allow network* (local ip \"localhost:*\"))\n(allow network* (remote ip \"localhost:*\"))\n(allow network* (remote unix-socket))\n")
+	}
+	return b.String()
+}
+
+// sandboxRegexpQuote escapes p to be used in a regex of a sandbox profile.
+func sandboxRegexpQuote(p string) string {
+	var b strings.Builder
+	for _, c := range p {
+		if strings.ContainsRune(`\.+*?()|[]{}^$"`, c) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
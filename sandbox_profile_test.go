@@ -0,0 +1,48 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestSandboxProfile(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("posix paths")
+	}
+	s := NewStateTestWithBuiltinRules(t)
+	s.AssertParse(&s.state, "rule cc\n  command = cc $in -o $out\n  depfile = $out.d\nbuild obj/a+b.o: cc a.c\n", ParseManifestOpts{})
+	got := SandboxProfile(s.state.Edges[0], "/src/out", false)
+	want := "(version 1)\n" +
+		"(allow default)\n" +
+		"(deny file-write*)\n" +
+		"(allow file-write*\n" +
+		"  (regex #\"^/src/out/obj/a\\+b\\.o([.-][^/]*)?$\")\n" +
+		"  (regex #\"^/src/out/obj/a\\+b\\.o\\.d([.-][^/]*)?$\")\n" +
+		"  (subpath \"/private/tmp\")\n" +
+		"  (subpath \"/private/var/folders\")\n" +
+		"  (literal \"/dev/null\")\n" +
+		"  (literal \"/dev/zero\")\n" +
+		"  (literal \"/dev/dtracehelper\")\n" +
+		"  (regex #\"^/dev/tty\"))\n"
+	if got != want {
+		t.Fatalf("want:\n%s\ngot:\n%s", want, got)
+	}
+	if got := SandboxProfile(s.state.Edges[0], "/src/out", true); !strings.HasSuffix(got, "(allow network* (remote unix-socket))\n") {
+		t.Fatal(got)
+	}
+}
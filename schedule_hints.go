@@ -0,0 +1,175 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Thresholds under which the schedule hints are not worth reporting.
+const (
+	// minHintCost is the minimum absolute cost of a problem.
+	minHintCost = time.Second
+	// minHintRatio is the minimum cost of a problem relative to the total
+	// capacity of the build, that is its duration times the parallelism.
+	minHintRatio = 0.1
+)
+
+// scheduledEdge is an edge that ran during a build.
+type scheduledEdge struct {
+	edge       *Edge
+	start, end int32
+}
+
+// scheduledEdges returns the edges of the manifest that ran in entries.
+func scheduledEdges(state *State, entries []*LogEntry) []scheduledEdge {
+	// Edges with multiple outputs have one entry per output.
+	seen := map[*Edge]struct{}{}
+	var edges []scheduledEdge
+	for _, entry := range entries {
+		n := state.Paths[entry.output]
+		if n == nil || n.InEdge == nil {
+			continue
+		}
+		if _, ok := seen[n.InEdge]; ok {
+			continue
+		}
+		seen[n.InEdge] = struct{}{}
+		edges = append(edges, scheduledEdge{n.InEdge, entry.startTime, entry.endTime})
+	}
+	return edges
+}
+
+// AnalyzeSchedule looks at the schedule of the last build and returns hints
+// about pools, parallelism or graph shape that caused job slots to be idle.
+//
+// entries is the last build, as returned by ReadLastBuild(). parallelism is
+// the number of jobs that could run concurrently.
+func AnalyzeSchedule(state *State, entries []*LogEntry, parallelism int) []string {
+	if parallelism <= 1 {
+		return nil
+	}
+	edges := scheduledEdges(state, entries)
+	if len(edges) == 0 {
+		return nil
+	}
+
+	// Sweep through the start and end events. Process ends before starts at
+	// the same timestamp.
+	type event struct {
+		t     int32
+		start bool
+		e     *scheduledEdge
+	}
+	events := make([]event, 0, 2*len(edges))
+	for i := range edges {
+		events = append(events, event{edges[i].start, true, &edges[i]}, event{edges[i].end, false, &edges[i]})
+	}
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].t != events[j].t {
+			return events[i].t < events[j].t
+		}
+		return !events[i].start && events[j].start
+	})
+	buildStart := events[0].t
+	buildEnd := events[len(events)-1].t
+	wall := time.Duration(buildEnd-buildStart) * time.Millisecond
+	minCost := time.Duration(float64(wall) * float64(parallelism) * minHintRatio)
+	if minCost < minHintCost {
+		minCost = minHintCost
+	}
+
+	const maxChain = 3
+	running := map[*scheduledEdge]struct{}{}
+	inPool := map[*Pool]int{}
+	idle := map[*Pool]time.Duration{}
+	peak := 0
+	// tailStart is the end of the last segment where more than one edge ran.
+	tailStart := buildStart
+	// chain is the last edges that ran alone after tailStart.
+	var chain []string
+	truncated := false
+	prev := buildStart
+	for _, ev := range events {
+		if ev.t != prev {
+			dt := time.Duration(ev.t-prev) * time.Millisecond
+			n := len(running)
+			if n > peak {
+				peak = n
+			}
+			if n < parallelism {
+				for p, c := range inPool {
+					if p.depth != 0 && c >= p.depth {
+						idle[p] += time.Duration(parallelism-n) * dt
+					}
+				}
+			}
+			if n > 1 {
+				tailStart = ev.t
+				chain = chain[:0]
+				truncated = false
+			} else if n == 1 {
+				for e := range running {
+					if p := e.edge.Outputs[0].Path; len(chain) == 0 || chain[len(chain)-1] != p {
+						if len(chain) == maxChain {
+							chain = append(chain[:0], chain[1:]...)
+							truncated = true
+						}
+						chain = append(chain, p)
+					}
+				}
+			}
+			prev = ev.t
+		}
+		if ev.start {
+			running[ev.e] = struct{}{}
+			inPool[ev.e.edge.Pool]++
+		} else {
+			delete(running, ev.e)
+			inPool[ev.e.edge.Pool]--
+		}
+	}
+
+	var hints []string
+
+	// Pools that were full while job slots were idle.
+	pools := make([]*Pool, 0, len(idle))
+	for p := range idle {
+		pools = append(pools, p)
+	}
+	sort.Slice(pools, func(i, j int) bool { return pools[i].Name < pools[j].Name })
+	for _, p := range pools {
+		if d := idle[p]; d >= minCost {
+			hints = append(hints, fmt.Sprintf("pool %s depth=%d caused %s of idle job slots; consider increasing its depth", p.Name, p.depth, d.Round(time.Second)))
+		}
+	}
+
+	// A serial tail at the end of the build.
+	if tail := time.Duration(buildEnd-tailStart) * time.Millisecond; len(chain) != 0 && tail*time.Duration(parallelism-1) >= minCost {
+		if truncated {
+			chain = append([]string{"..."}, chain...)
+		}
+		hints = append(hints, fmt.Sprintf("last %s ran a single edge (critical path: %s)", tail.Round(time.Second), strings.Join(chain, " -> ")))
+	}
+
+	// The graph never allowed using all the job slots.
+	if unused := wall * time.Duration(parallelism-peak); peak < parallelism && len(edges) >= parallelism && unused >= minCost {
+		hints = append(hints, fmt.Sprintf("at most %d edges ran concurrently out of %d job slots; the graph or the pools limit the parallelism", peak, parallelism))
+	}
+	return hints
+}
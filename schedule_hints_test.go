@@ -0,0 +1,71 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestAnalyzeSchedule_PoolAndTail(t *testing.T) {
+	s := NewStateTestWithBuiltinRules(t)
+	s.AssertParse(&s.state, "pool link\n  depth = 1\nrule link\n  command = link\n  pool = link\nbuild a: cat in\nbuild b: cat in\nbuild l1: link a\nbuild l2: link b\nbuild final: cat l1 l2\n", ParseManifestOpts{})
+	// a and b run concurrently, then l1 and l2 are serialized by the pool,
+	// then final runs alone.
+	entries := []*LogEntry{
+		{output: "a", startTime: 0, endTime: 1000},
+		{output: "b", startTime: 0, endTime: 1000},
+		{output: "l1", startTime: 1000, endTime: 11000},
+		{output: "l2", startTime: 11000, endTime: 21000},
+		{output: "final", startTime: 21000, endTime: 31000},
+	}
+	want := []string{
+		"pool link depth=1 caused 1m20s of idle job slots; consider increasing its depth",
+		"last 30s ran a single edge (critical path: l1 -> l2 -> final)",
+		"at most 2 edges ran concurrently out of 5 job slots; the graph or the pools limit the parallelism",
+	}
+	if diff := cmp.Diff(want, AnalyzeSchedule(&s.state, entries, 5)); diff != "" {
+		t.Fatalf("+want, -got: %s", diff)
+	}
+}
+
+func TestAnalyzeSchedule_Balanced(t *testing.T) {
+	s := NewStateTestWithBuiltinRules(t)
+	s.AssertParse(&s.state, "build a: cat in\nbuild b: cat in\n", ParseManifestOpts{})
+	entries := []*LogEntry{
+		{output: "a", startTime: 0, endTime: 10000},
+		{output: "b", startTime: 0, endTime: 10100},
+	}
+	if got := AnalyzeSchedule(&s.state, entries, 2); len(got) != 0 {
+		t.Fatal(got)
+	}
+	if got := AnalyzeSchedule(&s.state, nil, 2); len(got) != 0 {
+		t.Fatal(got)
+	}
+}
+
+func TestAnalyzeSchedule_Cheap(t *testing.T) {
+	s := NewStateTestWithBuiltinRules(t)
+	s.AssertParse(&s.state, "build a: cat in\nbuild b: cat a\n", ParseManifestOpts{})
+	// A trivial incremental build is not worth a hint.
+	entries := []*LogEntry{
+		{output: "a", startTime: 0, endTime: 20},
+		{output: "b", startTime: 20, endTime: 40},
+	}
+	if got := AnalyzeSchedule(&s.state, entries, 2); len(got) != 0 {
+		t.Fatal(got)
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Scope is a scope of the manifest.
+//
+// The scoping model is:
+//
+//   - The main manifest and each subninja create a scope. The rules and
+//     variables declared in a scope are visible to its child scopes but not to
+//     its parent.
+//   - An include shares the scope of the file including it.
+//   - A rule or a variable may shadow one of a parent scope. A rule can't be
+//     declared twice in the same scope.
+//   - Pools are global, whichever scope declares them, as in ninja. As an
+//     extension, a subninja may declare a pool with the name of a pool
+//     declared in a parent scope; the edges of the subninja and of its
+//     children then use this pool instead. Any other duplicate pool is an
+//     error.
+type Scope struct {
+	// Filename is the file that created the scope.
+	Filename string
+	Env      *BindingEnv
+	Parent   *Scope
+	// Edges is the number of edges declared in this scope.
+	Edges int
+	// ShadowedRules are the rules declared in this scope hiding a rule of a
+	// parent scope.
+	ShadowedRules []ScopeShadow
+	// ShadowedVariables are the variables declared in this scope hiding a
+	// variable of a parent scope.
+	ShadowedVariables []ScopeShadow
+}
+
+// ScopeShadow is a rule or a variable hiding one of a parent scope.
+type ScopeShadow struct {
+	Name string
+	// Filename is the file of the parent scope declaring the hidden one.
+	Filename string
+}
+
+// Depth returns the number of parents of the scope.
+func (s *Scope) Depth() int {
+	d := 0
+	for p := s.Parent; p != nil; p = p.Parent {
+		d++
+	}
+	return d
+}
+
+// Scopes returns the scopes of the manifest that contain at least one edge,
+// along with their parents, parents first and then sorted by file name.
+func (s *State) Scopes() []*Scope {
+	scopes := map[*BindingEnv]*Scope{}
+	var get func(env *BindingEnv) *Scope
+	get = func(env *BindingEnv) *Scope {
+		if sc := scopes[env]; sc != nil {
+			return sc
+		}
+		sc := &Scope{Filename: env.Filename, Env: env}
+		scopes[env] = sc
+		if env.Parent != nil {
+			sc.Parent = get(env.Parent)
+			sc.ShadowedRules, sc.ShadowedVariables = findShadows(env)
+		}
+		return sc
+	}
+	get(s.Bindings)
+	for _, e := range s.Edges {
+		env := e.Env
+		if env == nil {
+			continue
+		}
+		// Skip the edge's own environment.
+		for env.Filename == "" && env.Parent != nil {
+			env = env.Parent
+		}
+		get(env).Edges++
+	}
+
+	out := make([]*Scope, 0, len(scopes))
+	for _, sc := range scopes {
+		out = append(out, sc)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if di, dj := out[i].Depth(), out[j].Depth(); di != dj {
+			return di < dj
+		}
+		return out[i].Filename < out[j].Filename
+	})
+	return out
+}
+
+// poolConflict returns the pool that a pool named name declared in the scope
+// env would conflict with, if any.
+//
+// Unless allowOverride is false, a pool declared in a parent scope is not a
+// conflict, it is shadowed.
+func (s *State) poolConflict(env *BindingEnv, name string, allowOverride bool) *Pool {
+	if c := env.Pools[name]; c != nil {
+		// Declared twice in the same scope.
+		return c
+	}
+	existing := s.Pools[name]
+	if existing == nil || allowOverride && env.Parent != nil && lookupScopedPool(env.Parent, name) != nil {
+		return nil
+	}
+	// The pool is a builtin one or was declared in a scope that is not a
+	// parent.
+	return existing
+}
+
+// addPool adds pool to the scope env. poolConflict must have been called
+// first.
+func (s *State) addPool(env *BindingEnv, pool *Pool) {
+	if s.Pools[pool.Name] == nil {
+		s.Pools[pool.Name] = pool
+	} else {
+		s.scopedPools = append(s.scopedPools, pool)
+	}
+	if env.Pools == nil {
+		env.Pools = map[string]*Pool{}
+	}
+	env.Pools[pool.Name] = pool
+}
+
+// duplicatePoolMessage returns the error message for a pool named name
+// conflicting with the pool c.
+func duplicatePoolMessage(name string, c *Pool, disableExtensions bool) string {
+	// TODO(maruel): Use %q for real quoting.
+	if c.Filename == "" || disableExtensions {
+		return fmt.Sprintf("duplicate pool '%s'", name)
+	}
+	return fmt.Sprintf("duplicate pool '%s', previously declared at %s:%d", name, c.Filename, c.Line)
+}
+
+// lookupPool returns the pool visible from the scope env.
+func (s *State) lookupPool(env *BindingEnv, name string) *Pool {
+	if p := lookupScopedPool(env, name); p != nil {
+		return p
+	}
+	return s.Pools[name]
+}
+
+// lookupScopedPool returns the pool declared in env or its parents.
+func lookupScopedPool(env *BindingEnv, name string) *Pool {
+	for e := env; e != nil; e = e.Parent {
+		if p := e.Pools[name]; p != nil {
+			return p
+		}
+	}
+	return nil
+}
+
+// AllPools returns the global pools and the pools overriding them in
+// subninja scopes.
+func (s *State) AllPools() []*Pool {
+	out := make([]*Pool, 0, len(s.Pools)+len(s.scopedPools))
+	for _, p := range s.Pools {
+		out = append(out, p)
+	}
+	return append(out, s.scopedPools...)
+}
+
+// findShadows returns the rules and variables of env hiding the ones of a
+// parent scope.
+func findShadows(env *BindingEnv) ([]ScopeShadow, []ScopeShadow) {
+	var rules, vars []ScopeShadow
+	for name := range env.Rules {
+		if r := env.Parent.LookupRule(name); r != nil {
+			rules = append(rules, ScopeShadow{Name: name, Filename: r.Filename})
+		}
+	}
+	for name := range env.Bindings {
+		for p := env.Parent; p != nil; p = p.Parent {
+			if _, ok := p.Bindings[name]; ok {
+				vars = append(vars, ScopeShadow{Name: name, Filename: p.Filename})
+				break
+			}
+		}
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Name < rules[j].Name })
+	sort.Slice(vars, func(i, j int) bool { return vars[i].Name < vars[j].Name })
+	return rules, vars
+}
@@ -0,0 +1,218 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParserTest_SubninjaRuleDoesNotLeak(t *testing.T) {
+	for _, c := range concurrencyVals {
+		t.Run(c.String(), func(t *testing.T) {
+			p := NewParserTest(t, c)
+			p.fs.Create("sub.ninja", "rule inner\n  command = inner\nbuild a: inner\n")
+			opts := ParseManifestOpts{Concurrency: p.Concurrency}
+			err := p.parseTest("subninja sub.ninja\nbuild b: inner\n", opts)
+			if err == nil || err.Error() != "input:2: unknown build rule 'inner'\nbuild b: inner\n         ^ near here" {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestParserTest_SubninjaVariableDoesNotLeak(t *testing.T) {
+	for _, c := range concurrencyVals {
+		t.Run(c.String(), func(t *testing.T) {
+			p := NewParserTest(t, c)
+			p.fs.Create("sub.ninja", "var = inner\nnew = inner\nbuild a: r\n")
+			p.assertParse("var = outer\nrule r\n  command = r $var $new\nsubninja sub.ninja\nbuild b: r\n")
+			if got := p.state.Paths["a"].InEdge.EvaluateCommand(false); got != "r inner inner" {
+				t.Fatal(got)
+			}
+			if got := p.state.Paths["b"].InEdge.EvaluateCommand(false); got != "r outer " {
+				t.Fatal(got)
+			}
+			if got := p.state.Bindings.LookupVariable("new"); got != "" {
+				t.Fatal(got)
+			}
+		})
+	}
+}
+
+func TestParserTest_IncludeSharesScope(t *testing.T) {
+	for _, c := range concurrencyVals {
+		t.Run(c.String(), func(t *testing.T) {
+			p := NewParserTest(t, c)
+			p.fs.Create("inc.ninja", "rule r\n  command = r $var\nvar = inc\n")
+			p.fs.Create("sub.ninja", "include inc.ninja\nbuild a: r\n")
+			p.assertParse("include inc.ninja\nbuild b: r\nsubninja sub.ninja\n")
+			if got := p.state.Paths["b"].InEdge.EvaluateCommand(false); got != "r inc" {
+				t.Fatal(got)
+			}
+			// The include in sub.ninja declares its own copy of the rule in the
+			// subninja's scope.
+			if got := p.state.Paths["a"].InEdge.Rule; got == p.state.Paths["b"].InEdge.Rule {
+				t.Fatal("expected a different rule")
+			}
+			opts := ParseManifestOpts{Concurrency: p.Concurrency}
+			if err := p.parseTest("include inc.ninja\n", opts); err == nil {
+				t.Fatal("expected duplicate rule error")
+			}
+		})
+	}
+}
+
+func TestParserTest_SubninjaPoolIsGlobal(t *testing.T) {
+	for _, c := range concurrencyVals {
+		t.Run(c.String(), func(t *testing.T) {
+			p := NewParserTest(t, c)
+			p.fs.Create("sub.ninja", "pool p\n  depth = 2\nbuild a: r\n  pool = p\n")
+			p.assertParse("rule r\n  command = r\nsubninja sub.ninja\n")
+			if got := p.state.Pools["p"]; got == nil || p.state.Paths["a"].InEdge.Pool != got {
+				t.Fatal(got)
+			}
+			// Pools are global, so they can't be declared again in a sibling scope.
+			p.fs.Create("sub2.ninja", "pool p\n  depth = 1\n")
+			opts := ParseManifestOpts{Concurrency: p.Concurrency}
+			want := "sub2.ninja:1: duplicate pool 'p', previously declared at sub.ninja:1\n"
+			if err := p.parseTest("subninja sub2.ninja\n", opts); err == nil || !strings.HasPrefix(err.Error(), want) {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestParserTest_SubninjaPoolOverride(t *testing.T) {
+	for _, c := range concurrencyVals {
+		t.Run(c.String(), func(t *testing.T) {
+			p := NewParserTest(t, c)
+			p.fs.Create("sub.ninja", "build a: r\n  pool = p\npool p\n  depth = 1\nbuild b: r\n  pool = p\nsubninja sub2.ninja\n")
+			p.fs.Create("sub2.ninja", "build c: r\n  pool = p\nbuild d: r\n  pool = q\n")
+			p.assertParse("rule r\n  command = r\npool p\n  depth = 4\npool q\n  depth = 2\nbuild e: r\n  pool = p\nsubninja sub.ninja\n")
+			global := p.state.Pools["p"]
+			if global == nil || global.Depth() != 4 || global.Filename != "input" {
+				t.Fatal(global)
+			}
+			if got := p.state.Paths["e"].InEdge.Pool; got != global {
+				t.Fatal(got)
+			}
+			// Like in ninja, a pool must be declared before being used, so an edge
+			// declared before the override uses the global pool.
+			if got := p.state.Paths["a"].InEdge.Pool; got != global {
+				t.Fatal(got)
+			}
+			// The subninja overrides the pool for itself and its children.
+			local := p.state.Paths["b"].InEdge.Pool
+			if local == global || local.Name != "p" || local.Depth() != 1 || local.Filename != "sub.ninja" || local.Line != 3 {
+				t.Fatal(local)
+			}
+			if got := p.state.Paths["c"].InEdge.Pool; got != local {
+				t.Fatal(got)
+			}
+			if got := p.state.Paths["d"].InEdge.Pool; got != p.state.Pools["q"] {
+				t.Fatal(got)
+			}
+			if got := len(p.state.AllPools()); got != 5 {
+				t.Fatal(got)
+			}
+		})
+	}
+}
+
+func TestParserTest_SubninjaPoolOverrideErrors(t *testing.T) {
+	for _, c := range concurrencyVals {
+		t.Run(c.String(), func(t *testing.T) {
+			data := []struct {
+				in   string
+				opts ParseManifestOpts
+				want string
+			}{
+				{
+					"pool p\n  depth = 2\nsubninja sub.ninja\n",
+					ParseManifestOpts{},
+					"sub.ninja:3: duplicate pool 'p', previously declared at sub.ninja:1\n",
+				},
+				{
+					"pool p\n  depth = 2\nsubninja sub2.ninja\n",
+					ParseManifestOpts{DisableExtensions: true},
+					"sub2.ninja:1: duplicate pool 'p'\n",
+				},
+				{
+					"subninja sub3.ninja\n",
+					ParseManifestOpts{},
+					"sub3.ninja:1: duplicate pool 'console'\n",
+				},
+			}
+			for i, l := range data {
+				p := NewParserTest(t, c)
+				p.fs.Create("sub.ninja", "pool p\n  depth = 1\npool p\n  depth = 1\n")
+				p.fs.Create("sub2.ninja", "pool p\n  depth = 1\n")
+				p.fs.Create("sub3.ninja", "pool console\n  depth = 1\n")
+				l.opts.Concurrency = p.Concurrency
+				if err := p.parseTest(l.in, l.opts); err == nil || !strings.HasPrefix(err.Error(), l.want) {
+					t.Fatal(i, err)
+				}
+			}
+		})
+	}
+}
+
+func TestState_Scopes(t *testing.T) {
+	for _, c := range concurrencyVals {
+		t.Run(c.String(), func(t *testing.T) {
+			p := NewParserTest(t, c)
+			p.fs.Create("a.ninja", "rule r\n  command = a\ncflags = -O2\nbuild a: r\n  cflags = -O0\nsubninja c.ninja\n")
+			p.fs.Create("b.ninja", "build b: r\n")
+			p.fs.Create("c.ninja", "other = 1\nbuild c: r\n")
+			p.assertParse("rule r\n  command = r\ncflags = -O3\nsubninja a.ninja\nsubninja b.ninja\nbuild d: r\n")
+
+			type scope struct {
+				Filename string
+				Parent   string
+				Depth    int
+				Edges    int
+				Rules    []ScopeShadow
+				Vars     []ScopeShadow
+			}
+			var got []scope
+			for _, s := range p.state.Scopes() {
+				sc := scope{Filename: s.Filename, Depth: s.Depth(), Edges: s.Edges, Rules: s.ShadowedRules, Vars: s.ShadowedVariables}
+				if s.Parent != nil {
+					sc.Parent = s.Parent.Filename
+				}
+				got = append(got, sc)
+			}
+			want := []scope{
+				{Filename: "input", Edges: 1},
+				{
+					Filename: "a.ninja",
+					Parent:   "input",
+					Depth:    1,
+					Edges:    1,
+					Rules:    []ScopeShadow{{"r", "input"}},
+					Vars:     []ScopeShadow{{"cflags", "input"}},
+				},
+				{Filename: "b.ninja", Parent: "input", Depth: 1, Edges: 1},
+				{Filename: "c.ninja", Parent: "a.ninja", Depth: 2, Edges: 1},
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
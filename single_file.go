@@ -0,0 +1,91 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"fmt"
+)
+
+// CompileEdge returns the edge compiling the source file path, e.g. the edge
+// producing foo.o from foo.cc.
+//
+// The first edge using path as an explicit input is preferred. A file that is
+// not an input of any edge, e.g. a header found via a depfile, is resolved to
+// the first edge that recorded it in depsLog, which may be nil.
+func (s *State) CompileEdge(path string, depsLog *DepsLog) (*Edge, error) {
+	node := s.Paths[path]
+	if node == nil {
+		return nil, &ErrUnknownTarget{Target: path}
+	}
+	var found *Edge
+	for _, e := range node.OutEdges {
+		if e.Rule == PhonyRule || len(e.Outputs) == 0 {
+			continue
+		}
+		if found == nil {
+			found = e
+		}
+		explicit := len(e.Inputs) - int(e.ImplicitDeps) - int(e.OrderOnlyDeps)
+		for _, i := range e.Inputs[:explicit] {
+			if i == node {
+				return e, nil
+			}
+		}
+	}
+	if found != nil {
+		return found, nil
+	}
+	if depsLog != nil {
+		if n := depsLog.GetFirstReverseDepsNode(node); n != nil && n.InEdge != nil {
+			return n.InEdge, nil
+		}
+	}
+	// TODO(maruel): Use %q for real quoting.
+	return nil, fmt.Errorf("'%s' is not compiled by any edge", path)
+}
+
+// SingleFileEdges returns the edges to run to build edge alone: edge itself
+// and, recursively, the edges producing its inputs that do not exist yet,
+// e.g. generated headers.
+//
+// The inputs that exist are used as is, even if they are out of date. Use it
+// with Builder.RestrictTo to skip the unrelated work, e.g. to compile a single
+// file from an IDE.
+func SingleFileEdges(edge *Edge, di FileSystem) ([]*Edge, error) {
+	out := []*Edge{edge}
+	seen := map[*Edge]struct{}{edge: {}}
+	for i := 0; i < len(out); i++ {
+		for _, n := range out[i].Inputs {
+			in := n.InEdge
+			if in == nil {
+				continue
+			}
+			if _, ok := seen[in]; ok {
+				continue
+			}
+			if in.Rule != PhonyRule {
+				if err := n.statIfNecessary(di); err != nil {
+					return nil, err
+				}
+				if n.Exists == ExistenceStatusExists {
+					continue
+				}
+			}
+			seen[in] = struct{}{}
+			out = append(out, in)
+		}
+	}
+	return out, nil
+}
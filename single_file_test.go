@@ -0,0 +1,49 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"testing"
+)
+
+func TestState_CompileEdge(t *testing.T) {
+	s := NewStateTestWithBuiltinRules(t)
+	s.AssertParse(&s.state, "build lint: cat | a.cc\nbuild a.o: cat a.cc\nbuild b.o: cat b.cc\n", ParseManifestOpts{})
+	if e, err := s.state.CompileEdge("a.cc", nil); err != nil || e.Outputs[0].Path != "a.o" {
+		t.Fatal(e, err)
+	}
+	if _, err := s.state.CompileEdge("b.o", nil); err == nil {
+		t.Fatal("expected error")
+	}
+	if _, err := s.state.CompileEdge("nope.cc", nil); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestSingleFileEdges(t *testing.T) {
+	s := NewStateTestWithBuiltinRules(t)
+	s.AssertParse(&s.state, "build gen.h: cat gen.in\nbuild stale.h: cat stale.in\nbuild lib.a: cat lib.cc\nbuild a.o: cat a.cc | lib.a stale.h || gen.h\n", ParseManifestOpts{})
+	fs := NewVirtualFileSystem()
+	fs.Create("stale.h", "")
+	fs.Create("lib.a", "")
+	edges, err := SingleFileEdges(s.state.Paths["a.o"].InEdge, &fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The existing inputs are used as is.
+	if len(edges) != 2 || edges[0].Outputs[0].Path != "a.o" || edges[1].Outputs[0].Path != "gen.h" {
+		t.Fatal(edges)
+	}
+}
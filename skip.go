@@ -0,0 +1,110 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"runtime"
+	"strings"
+)
+
+// The "skip" binding removes the edge from the graph at parse time when its
+// condition is true, so one generated manifest can serve several host
+// platforms instead of generating one manifest per platform, e.g.
+//
+//	build out/foo: link foo.o
+//	  skip = $nin_host_os == windows
+//	build out/foo: link_msvc foo.obj
+//	  skip = $nin_host_os != windows
+//
+// The condition is expanded like any binding, against the variables declared
+// so far. It is true if the expansion is not empty, except for "a == b" and
+// "a != b" which compare both sides, trimmed.
+//
+// The outputs of a skipped edge are not added to the graph, so another edge
+// can generate them. The variables nin_host_os and nin_host_arch are
+// predefined with the platform nin runs on, e.g. "linux" and "amd64", unless
+// the manifest declares them.
+
+// SkippedEdge is an edge removed from the graph by its "skip" binding.
+type SkippedEdge struct {
+	Rule *Rule
+	// Outputs are the paths the edge would generate, canonicalized.
+	Outputs []string
+	// Condition is the expanded value of the "skip" binding.
+	Condition string
+}
+
+// hostBindings are the variables predefined in the root scope when the nin
+// extensions are enabled.
+var hostBindings = map[string]string{
+	"nin_host_os":   runtime.GOOS,
+	"nin_host_arch": runtime.GOARCH,
+}
+
+// addHostBindings declares the hostBindings not already declared in env.
+func addHostBindings(env *BindingEnv) {
+	for k, v := range hostBindings {
+		if _, ok := env.Bindings[k]; !ok {
+			env.Bindings[k] = v
+		}
+	}
+}
+
+// skipCondition returns true if the expanded value of a "skip" binding is
+// true.
+func skipCondition(v string) bool {
+	if i := strings.Index(v, "=="); i != -1 {
+		return strings.TrimSpace(v[:i]) == strings.TrimSpace(v[i+2:])
+	}
+	if i := strings.Index(v, "!="); i != -1 {
+		return strings.TrimSpace(v[:i]) != strings.TrimSpace(v[i+2:])
+	}
+	return strings.TrimSpace(v) != ""
+}
+
+// skipEdge returns true if edge, the last one added to s, is skipped. It is
+// then removed from s and recorded in s.Skipped with the outputs outs,
+// evaluated in env.
+func (s *State) skipEdge(edge *Edge, outs []EvalString, env Env) bool {
+	cond := edge.GetBinding("skip")
+	if !skipCondition(cond) {
+		return false
+	}
+	s.Edges = s.Edges[:len(s.Edges)-1]
+	skipped := SkippedEdge{Rule: edge.Rule, Outputs: make([]string, 0, len(outs)), Condition: cond}
+	for _, o := range outs {
+		if p := o.Evaluate(env); p != "" {
+			p, _ = CanonicalizePathBits(p)
+			skipped.Outputs = append(skipped.Outputs, p)
+		}
+	}
+	s.Skipped = append(s.Skipped, skipped)
+	return true
+}
+
+// SkippedOutputs returns the edges skipped by their "skip" binding, indexed
+// by their outputs. An output can be skipped by several edges; the first one
+// is returned.
+func (s *State) SkippedOutputs() map[string]*SkippedEdge {
+	out := make(map[string]*SkippedEdge, len(s.Skipped))
+	for i := range s.Skipped {
+		for _, o := range s.Skipped[i].Outputs {
+			if _, ok := out[o]; !ok {
+				out[o] = &s.Skipped[i]
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,107 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"errors"
+	"runtime"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSkipCondition(t *testing.T) {
+	data := []struct {
+		in   string
+		want bool
+	}{
+		{"", false},
+		{" ", false},
+		{"1", true},
+		{"linux == linux", true},
+		{"linux==windows", false},
+		{" == windows", false},
+		{"linux != windows", true},
+		{"linux != linux", false},
+	}
+	for i, l := range data {
+		if got := skipCondition(l.in); got != l.want {
+			t.Errorf("#%d: skipCondition(%q) = %t", i, l.in, got)
+		}
+	}
+}
+
+func TestParse_Skip(t *testing.T) {
+	manifest := "nin_features = skip\nos = linux\n" +
+		"rule cc\n  command = cc $in -o $out\n" +
+		"rule cl\n  command = cl $in /Fo$out\n  pool = msvc\n  skip = $os != windows\n" +
+		"build foo.o: cc foo.c\n  skip = $os == windows\n" +
+		"build foo.o: cl foo.c\n" +
+		"build bar.o: cc bar.c\n  skip = $is_mac\n" +
+		"build all: phony foo.o bar.o\n"
+	for _, c := range []ParseManifestConcurrency{ParseManifestSerial, ParseManifestConcurrentParsing} {
+		t.Run(c.String(), func(t *testing.T) {
+			s := NewStateTestWithBuiltinRules(t)
+			// The pool of the skipped edge is not declared, and its output
+			// doesn't conflict with the other edge.
+			s.AssertParse(&s.state, manifest, ParseManifestOpts{Concurrency: c, ErrOnDupeEdge: true})
+			if len(s.state.Edges) != 3 {
+				t.Fatal(len(s.state.Edges))
+			}
+			if r := s.state.Paths["foo.o"].InEdge.Rule.Name; r != "cc" {
+				t.Fatal(r)
+			}
+			want := []SkippedEdge{{Rule: s.state.Bindings.Rules["cl"], Outputs: []string{"foo.o"}, Condition: "linux != windows"}}
+			if diff := cmp.Diff(want, s.state.Skipped); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+func TestParse_SkipHostBindings(t *testing.T) {
+	s := NewStateTestWithBuiltinRules(t)
+	s.AssertParse(&s.state, "nin_features = skip\nrule cc\n  command = cc $in -o $out\nbuild out/"+runtime.GOOS+"/foo.o: cc foo.c\nbuild out/other/foo.o: cc foo.c\n  skip = $nin_host_os == "+runtime.GOOS+"\n", ParseManifestOpts{})
+	if len(s.state.Edges) != 1 || s.state.Edges[0].Outputs[0].Path != "out/"+runtime.GOOS+"/foo.o" {
+		t.Fatal(s.state.Edges)
+	}
+
+	// The manifest can override them.
+	s = NewStateTestWithBuiltinRules(t)
+	s.AssertParse(&s.state, "nin_features = skip\nnin_host_os = plan9\nrule cc\n  command = cc $in -o $out\nbuild foo.o: cc foo.c\n  skip = $nin_host_os == plan9\n", ParseManifestOpts{})
+	if len(s.state.Edges) != 0 {
+		t.Fatal(s.state.Edges)
+	}
+
+	// Without the extensions, skip is an unknown binding and the edge is kept.
+	s = NewStateTestWithBuiltinRules(t)
+	s.AssertParse(&s.state, "rule cc\n  command = cc $in -o $out\nbuild foo.o: cc foo.c\n  skip = 1\n", ParseManifestOpts{DisableExtensions: true})
+	if len(s.state.Edges) != 1 || len(s.state.Skipped) != 0 {
+		t.Fatal(s.state.Edges)
+	}
+}
+
+func TestBuildTest_SkippedInput(t *testing.T) {
+	b := NewBuildTest(t)
+	b.AssertParse(&b.state, "nin_features = skip\nbuild gen.h: cat gen.in\n  skip = 1\nbuild out: cat gen.h\n", ParseManifestOpts{})
+	_, err := b.builder.addTargetName("out")
+	var m *ErrMissingInput
+	if !errors.As(err, &m) || m.Skipped != "1" {
+		t.Fatal(err)
+	}
+	if want := "'gen.h', needed by 'out', missing and its edge is skipped (skip = 1)"; err.Error() != want {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,287 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// snapshotHeader is the first line of a snapshot.
+const snapshotHeader = "# nin snapshot v1"
+
+// snapshotSuffix is the suffix of the snapshot files, after the sequence
+// number.
+const snapshotSuffix = ".snap.gz"
+
+// Snapshot is the state of the graph at the end of a build, so two builds can
+// be compared at the graph level, e.g. to find what changed between
+// yesterday's green build and today's failing one.
+type Snapshot struct {
+	// Seq is the sequence number of the snapshot, increasing with each build.
+	Seq int
+	// Time is when the build ended.
+	Time time.Time
+	// Succeeded is true if the build succeeded.
+	Succeeded bool
+	// Nodes are the files of the graph the build looked at, sorted by path.
+	Nodes []SnapshotNode
+}
+
+// SnapshotNode is the state of a file at the end of a build.
+type SnapshotNode struct {
+	Path string
+	// MTime is the mtime of the file, or 0 if it doesn't exist. For the
+	// outputs, it is the one recorded in the build log.
+	MTime TimeStamp
+	// Output is true if the file is generated by an edge.
+	Output bool
+	// Dirty is true if the file was still out of date at the end of the
+	// build, e.g. because its edge failed.
+	Dirty bool
+	// CommandHash is the hash of the command that last built the output, as
+	// recorded in the build log, or 0 if unknown.
+	CommandHash uint64
+}
+
+// TakeSnapshot returns the snapshot of the nodes of state that the build
+// examined, with the outputs' mtime and command from log.
+func TakeSnapshot(state *State, log *BuildLog, succeeded bool) *Snapshot {
+	s := &Snapshot{Time: time.Now(), Succeeded: succeeded}
+	for p, n := range state.Paths {
+		if n == nil || (n.InEdge != nil && n.InEdge.Rule == PhonyRule) {
+			continue
+		}
+		// The edges built successfully have their outputs ready.
+		dirty := n.Dirty && (n.InEdge == nil || !n.InEdge.OutputsReady)
+		sn := SnapshotNode{Path: p, MTime: n.MTime, Output: n.InEdge != nil, Dirty: dirty}
+		if sn.Output && log != nil {
+			if e := log.Entries[p]; e != nil {
+				sn.MTime = e.mtime
+				sn.CommandHash = e.legacyHash()
+			}
+		}
+		if sn.MTime < 0 {
+			// Not examined by this build.
+			continue
+		}
+		s.Nodes = append(s.Nodes, sn)
+	}
+	sort.Slice(s.Nodes, func(i, j int) bool { return s.Nodes[i].Path < s.Nodes[j].Path })
+	return s
+}
+
+// WriteSnapshot writes s in dir, numbered after the last one, and removes
+// the oldest snapshots to only keep keep of them.
+//
+// dir can be the one of ArchiveBuild; the snapshots are numbered separately
+// from the builds.
+//
+// Nothing is written if s is identical to the last snapshot besides its
+// time, so repeated no-op builds don't evict the interesting ones.
+func WriteSnapshot(dir string, s *Snapshot, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0o777); err != nil {
+		return err
+	}
+	seqs, err := historySeqs(dir, snapshotSuffix)
+	if err != nil {
+		return err
+	}
+	s.Seq = 1
+	if len(seqs) != 0 {
+		last := seqs[len(seqs)-1]
+		if prev, err := ReadSnapshot(dir, last); err == nil && prev.Succeeded == s.Succeeded && snapshotNodesEqual(prev.Nodes, s.Nodes) {
+			s.Seq = last
+			return nil
+		}
+		s.Seq = last + 1
+	}
+	if err := writeGzip(filepath.Join(dir, fmt.Sprintf("%06d", s.Seq)+snapshotSuffix), []byte(s.serialize())); err != nil {
+		return err
+	}
+	seqs = append(seqs, s.Seq)
+	for len(seqs) > keep {
+		if err := os.Remove(filepath.Join(dir, fmt.Sprintf("%06d", seqs[0])+snapshotSuffix)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		seqs = seqs[1:]
+	}
+	return nil
+}
+
+// SnapshotSeqs returns the sequence numbers of the snapshots in dir, the
+// oldest first.
+//
+// It is not an error if dir doesn't exist.
+func SnapshotSeqs(dir string) ([]int, error) {
+	seqs, err := historySeqs(dir, snapshotSuffix)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return seqs, err
+}
+
+// ReadSnapshot reads the snapshot seq written by WriteSnapshot in dir.
+func ReadSnapshot(dir string, seq int) (*Snapshot, error) {
+	p := filepath.Join(dir, fmt.Sprintf("%06d", seq)+snapshotSuffix)
+	data, err := readGzip(p)
+	if err != nil {
+		return nil, err
+	}
+	s, err := parseSnapshot(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", p, err)
+	}
+	s.Seq = seq
+	return s, nil
+}
+
+// serialize returns the text form of s: a header with the time and the
+// outcome of the build, then a line per node with its path, mtime, flags and
+// command hash separated by tabs.
+func (s *Snapshot) serialize() string {
+	var b strings.Builder
+	status := "failed"
+	if s.Succeeded {
+		status = "ok"
+	}
+	fmt.Fprintf(&b, "%s\ntime %s\nstatus %s\n", snapshotHeader, s.Time.UTC().Format(time.RFC3339), status)
+	for _, n := range s.Nodes {
+		flags := ""
+		if n.Output {
+			flags += "o"
+		}
+		if n.Dirty {
+			flags += "d"
+		}
+		if flags == "" {
+			flags = "-"
+		}
+		fmt.Fprintf(&b, "%s\t%d\t%s\t%x\n", n.Path, n.MTime, flags, n.CommandHash)
+	}
+	return b.String()
+}
+
+func parseSnapshot(data string) (*Snapshot, error) {
+	lines := strings.Split(strings.TrimRight(data, "\n"), "\n")
+	if len(lines) < 3 || lines[0] != snapshotHeader {
+		return nil, fmt.Errorf("unsupported snapshot format")
+	}
+	s := &Snapshot{}
+	t, err := time.Parse(time.RFC3339, strings.TrimPrefix(lines[1], "time "))
+	if err != nil {
+		return nil, err
+	}
+	s.Time = t
+	switch lines[2] {
+	case "status ok":
+		s.Succeeded = true
+	case "status failed":
+	default:
+		return nil, fmt.Errorf("invalid status %q", lines[2])
+	}
+	s.Nodes = make([]SnapshotNode, 0, len(lines)-3)
+	for i, l := range lines[3:] {
+		f := strings.Split(l, "\t")
+		if len(f) != 4 {
+			return nil, fmt.Errorf("line %d: expected 4 fields", i+4)
+		}
+		mtime, err := strconv.ParseInt(f[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+4, err)
+		}
+		hash, err := strconv.ParseUint(f[3], 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+4, err)
+		}
+		s.Nodes = append(s.Nodes, SnapshotNode{
+			Path:        f[0],
+			MTime:       TimeStamp(mtime),
+			Output:      strings.Contains(f[2], "o"),
+			Dirty:       strings.Contains(f[2], "d"),
+			CommandHash: hash,
+		})
+	}
+	return s, nil
+}
+
+func snapshotNodesEqual(a, b []SnapshotNode) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// SnapshotChange is how a node differs between two snapshots. Old is unset
+// for an added node and New for a removed one.
+type SnapshotChange struct {
+	Path string
+	Old  *SnapshotNode
+	New  *SnapshotNode
+}
+
+// MTimeChanged returns true if the file was modified, or rebuilt for an
+// output.
+func (c *SnapshotChange) MTimeChanged() bool {
+	return c.Old != nil && c.New != nil && c.Old.MTime != c.New.MTime
+}
+
+// CommandChanged returns true if the output was last built by another
+// command.
+func (c *SnapshotChange) CommandChanged() bool {
+	return c.Old != nil && c.New != nil && c.Old.CommandHash != c.New.CommandHash && c.Old.CommandHash != 0 && c.New.CommandHash != 0
+}
+
+// DirtyChanged returns true if the node became dirty or clean.
+func (c *SnapshotChange) DirtyChanged() bool {
+	return c.Old != nil && c.New != nil && c.Old.Dirty != c.New.Dirty
+}
+
+// DiffSnapshots returns the nodes that differ between a and b, sorted by
+// path.
+func DiffSnapshots(a, b *Snapshot) []SnapshotChange {
+	var out []SnapshotChange
+	i, j := 0, 0
+	for i < len(a.Nodes) || j < len(b.Nodes) {
+		switch {
+		case j == len(b.Nodes) || (i < len(a.Nodes) && a.Nodes[i].Path < b.Nodes[j].Path):
+			out = append(out, SnapshotChange{Path: a.Nodes[i].Path, Old: &a.Nodes[i]})
+			i++
+		case i == len(a.Nodes) || b.Nodes[j].Path < a.Nodes[i].Path:
+			out = append(out, SnapshotChange{Path: b.Nodes[j].Path, New: &b.Nodes[j]})
+			j++
+		default:
+			if c := (SnapshotChange{Path: a.Nodes[i].Path, Old: &a.Nodes[i], New: &b.Nodes[j]}); c.MTimeChanged() || c.CommandChanged() || c.DirtyChanged() {
+				out = append(out, c)
+			}
+			i++
+			j++
+		}
+	}
+	return out
+}
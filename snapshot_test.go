@@ -0,0 +1,130 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestTakeSnapshot(t *testing.T) {
+	s := NewStateTestWithBuiltinRules(t)
+	s.AssertParse(&s.state, "build a.o: cat a.c\nbuild b.o: cat b.c\nbuild all: phony a.o b.o\nbuild other.o: cat other.c\n", ParseManifestOpts{})
+	for _, n := range s.state.Paths {
+		n.MTime = -1
+	}
+	s.state.Paths["a.c"].MTime = 2
+	s.state.Paths["b.c"].MTime = 3
+	s.state.Paths["a.o"].MTime = 1
+	s.state.Paths["a.o"].Dirty = true
+	s.state.Paths["b.o"].MTime = 4
+	s.state.Paths["b.o"].Dirty = true
+	s.state.Paths["b.o"].InEdge.OutputsReady = true
+	log := NewBuildLog()
+	log.Entries["b.o"] = &LogEntry{output: "b.o", commandHash: 0x1234, mtime: 5}
+
+	got := TakeSnapshot(&s.state, &log, false)
+	if got.Succeeded {
+		t.Fatal("expected failed")
+	}
+	// The phony edge and the nodes not examined by the build are ignored.
+	want := []SnapshotNode{
+		{Path: "a.c", MTime: 2},
+		{Path: "a.o", MTime: 1, Output: true, Dirty: true},
+		{Path: "b.c", MTime: 3},
+		{Path: "b.o", MTime: 5, Output: true, CommandHash: 0x1234},
+	}
+	if diff := cmp.Diff(want, got.Nodes); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestWriteSnapshot(t *testing.T) {
+	dir := CreateTempDirAndEnter(t)
+	now := time.Date(2022, 3, 4, 5, 6, 7, 0, time.UTC)
+	s1 := &Snapshot{Time: now, Succeeded: true, Nodes: []SnapshotNode{{Path: "a.c", MTime: 2}, {Path: "a.o", MTime: 3, Output: true, CommandHash: 0xabc}}}
+	if err := WriteSnapshot(dir, s1, 2); err != nil {
+		t.Fatal(err)
+	}
+	// Identical, not written.
+	s2 := &Snapshot{Time: now.Add(time.Hour), Succeeded: true, Nodes: s1.Nodes}
+	if err := WriteSnapshot(dir, s2, 2); err != nil {
+		t.Fatal(err)
+	}
+	if s1.Seq != 1 || s2.Seq != 1 {
+		t.Fatal(s1.Seq, s2.Seq)
+	}
+	s3 := &Snapshot{Time: now.Add(2 * time.Hour), Nodes: []SnapshotNode{{Path: "a.c", MTime: 4}, {Path: "a.o", MTime: 3, Output: true, Dirty: true, CommandHash: 0xabc}, {Path: "b.c", MTime: 1}}}
+	if err := WriteSnapshot(dir, s3, 2); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadSnapshot(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(s1, got); diff != "" {
+		t.Fatal(diff)
+	}
+	s4 := &Snapshot{Time: now.Add(3 * time.Hour), Succeeded: true}
+	if err := WriteSnapshot(dir, s4, 2); err != nil {
+		t.Fatal(err)
+	}
+	// Only the last 2 are kept.
+	if seqs, err := SnapshotSeqs(dir); err != nil || !cmp.Equal(seqs, []int{2, 3}) {
+		t.Fatal(seqs, err)
+	}
+
+	a, err := ReadSnapshot(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(s3, a); diff != "" {
+		t.Fatal(diff)
+	}
+	changes := DiffSnapshots(s1, a)
+	var paths []string
+	for _, c := range changes {
+		paths = append(paths, c.Path)
+	}
+	if !cmp.Equal(paths, []string{"a.c", "a.o", "b.c"}) {
+		t.Fatal(paths)
+	}
+	if c := changes[0]; !c.MTimeChanged() || c.CommandChanged() || c.DirtyChanged() {
+		t.Fatal(c)
+	}
+	if c := changes[1]; c.MTimeChanged() || c.CommandChanged() || !c.DirtyChanged() {
+		t.Fatal(c)
+	}
+	if c := changes[2]; c.Old != nil || c.New == nil {
+		t.Fatal(c)
+	}
+
+	// The snapshots share the directory of the archived builds.
+	if err := ioutil.WriteFile("log", []byte("# ninja log v7\n1\t2\t3\tout\t1\n"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	if err := ArchiveBuild(dir, "log", 0, nil, 2); err != nil {
+		t.Fatal(err)
+	}
+	if builds, err := ReadHistory(dir); err != nil || len(builds) != 1 || builds[0].Seq != 1 {
+		t.Fatal(builds, err)
+	}
+	if seqs, err := SnapshotSeqs(dir); err != nil || !cmp.Equal(seqs, []int{2, 3}) {
+		t.Fatal(seqs, err)
+	}
+}
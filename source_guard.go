@@ -0,0 +1,143 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SourceChange is a source file modified while the build ran.
+type SourceChange struct {
+	Path string
+	// Edges are the edges that ran when the file was modified, sorted by
+	// their first output. One of them modified it.
+	Edges []*Edge
+}
+
+func (s *SourceChange) Error() string {
+	if len(s.Edges) == 1 {
+		e := s.Edges[0]
+		return fmt.Sprintf("source file '%s' was modified by rule '%s' building '%s'", s.Path, e.Rule.Name, e.Outputs[0].Path)
+	}
+	names := make([]string, 0, len(s.Edges))
+	for _, e := range s.Edges {
+		names = append(names, "'"+e.Outputs[0].Path+"'")
+	}
+	return fmt.Sprintf("source file '%s' was modified while building %s", s.Path, strings.Join(names, ", "))
+}
+
+// SourceGuard detects the commands writing to the source files, to keep the
+// checkouts pristine, e.g. on CI.
+//
+// The mtime of the sources is checked as the edges complete, so a change is
+// attributed to the edges that ran since the previous check. When it is a
+// single edge, this edge is failed.
+//
+// Use BeforeEdge and AfterEdge from the BuilderHooks of the same names, then
+// call Check once the build completed.
+type SourceGuard struct {
+	// Interval is the minimum time between two checks while the build runs.
+	// 0 checks after each edge, which attributes the changes precisely with
+	// a parallelism of 1.
+	Interval time.Duration
+
+	fs     FileSystem
+	files  []string
+	stamps []TimeStamp
+	last   time.Time
+	// running are the edges started and not completed yet.
+	running map[*Edge]struct{}
+	// ran are the edges that completed since the previous check.
+	ran     map[*Edge]struct{}
+	changes []SourceChange
+}
+
+// NewSourceGuard records the mtime of sources, the paths of the source files.
+func NewSourceGuard(fs FileSystem, sources []string) (*SourceGuard, error) {
+	g := &SourceGuard{
+		fs:      fs,
+		files:   sources,
+		stamps:  make([]TimeStamp, len(sources)),
+		last:    time.Now(),
+		running: map[*Edge]struct{}{},
+		ran:     map[*Edge]struct{}{},
+	}
+	for i, f := range sources {
+		mtime, err := fs.Stat(f)
+		if mtime < 0 {
+			return nil, err
+		}
+		g.stamps[i] = mtime
+	}
+	return g, nil
+}
+
+// BeforeEdge implements BuilderHooks.BeforeEdge. It never alters the edge.
+func (g *SourceGuard) BeforeEdge(e *Edge) EdgeDecision {
+	g.running[e] = struct{}{}
+	return EdgeDecision{}
+}
+
+// AfterEdge implements BuilderHooks.AfterEdge. It fails result.Edge if it
+// is the only edge that could have modified a source file.
+func (g *SourceGuard) AfterEdge(result *Result, startTimeMillis, endTimeMillis int32) {
+	delete(g.running, result.Edge)
+	g.ran[result.Edge] = struct{}{}
+	if time.Since(g.last) < g.Interval {
+		return
+	}
+	for _, c := range g.check() {
+		if len(c.Edges) == 1 && c.Edges[0] == result.Edge {
+			result.ExitCode = ExitFailure
+			result.Output += c.Error() + "\n"
+		}
+	}
+}
+
+// Check checks the sources one last time and returns all the changes found
+// during the build, sorted by path.
+func (g *SourceGuard) Check() []SourceChange {
+	g.check()
+	sort.Slice(g.changes, func(i, j int) bool { return g.changes[i].Path < g.changes[j].Path })
+	return g.changes
+}
+
+// check stats the sources and returns the new changes.
+func (g *SourceGuard) check() []SourceChange {
+	g.last = time.Now()
+	var edges []*Edge
+	for e := range g.running {
+		edges = append(edges, e)
+	}
+	for e := range g.ran {
+		edges = append(edges, e)
+	}
+	g.ran = map[*Edge]struct{}{}
+	sort.Slice(edges, func(i, j int) bool { return edges[i].Outputs[0].Path < edges[j].Outputs[0].Path })
+	start := len(g.changes)
+	for i, f := range g.files {
+		mtime, _ := g.fs.Stat(f)
+		if mtime == g.stamps[i] {
+			continue
+		}
+		// Report each modification once.
+		g.stamps[i] = mtime
+		g.changes = append(g.changes, SourceChange{Path: f, Edges: edges})
+	}
+	return g.changes[start:]
+}
@@ -0,0 +1,54 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"testing"
+)
+
+func TestSourceGuard(t *testing.T) {
+	b := NewBuildTest(t)
+	g, err := NewSourceGuard(&b.fs, []string{"in1", "in2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.builder.Hooks = BuilderHooks{
+		BeforeEdge: g.BeforeEdge,
+		AfterEdge: func(result *Result, startTimeMillis, endTimeMillis int32) {
+			if result.Edge.Outputs[0].Path == "cat2" {
+				// The command sneakily writes to a source file.
+				b.fs.Tick()
+				b.fs.Create("in2", "modified")
+			}
+			g.AfterEdge(result, startTimeMillis, endTimeMillis)
+		},
+	}
+	if _, err := b.builder.addTargetName("cat12"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.builder.Build(); err == nil || err.Error() != "subcommand failed" {
+		t.Fatal(err)
+	}
+	got := g.Check()
+	if len(got) != 1 || got[0].Path != "in2" || len(got[0].Edges) != 1 {
+		t.Fatal(got)
+	}
+	if s := got[0].Error(); s != "source file 'in2' was modified by rule 'cat' building 'cat2'" {
+		t.Fatal(s)
+	}
+	if p := b.builder.Progress(); p.Failed != 1 {
+		t.Fatal(p)
+	}
+}
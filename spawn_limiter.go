@@ -0,0 +1,76 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import "time"
+
+// spawnLimiter is a token bucket limiting the rate at which child processes
+// are started.
+//
+// Very wide builds of tiny edges can otherwise start thousands of processes
+// per second, which thrashes the OS on loaded machines.
+type spawnLimiter struct {
+	// rate is the number of tokens added per second.
+	rate float64
+	// burst is the maximum number of tokens.
+	burst  float64
+	tokens float64
+	last   time.Time
+
+	// Overridden in unit tests.
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+// newSpawnLimiter returns a spawnLimiter allowing rate spawns per second on
+// average, with bursts of up to burst spawns. A burst lower than 1 is set to 1.
+func newSpawnLimiter(rate float64, burst int) *spawnLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	s := &spawnLimiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		now:    time.Now,
+		sleep:  time.Sleep,
+	}
+	s.last = s.now()
+	return s
+}
+
+// wait blocks until a process can be started and consumes a token.
+func (s *spawnLimiter) wait() {
+	s.refill()
+	if s.tokens < 1 {
+		missing := 1 - s.tokens
+		s.sleep(time.Duration(missing / s.rate * float64(time.Second)))
+		s.refill()
+		if s.tokens < 1 {
+			// The sleep was shorter than expected; do not go further in debt.
+			s.tokens = 1
+		}
+	}
+	s.tokens--
+}
+
+func (s *spawnLimiter) refill() {
+	now := s.now()
+	s.tokens += now.Sub(s.last).Seconds() * s.rate
+	if s.tokens > s.burst {
+		s.tokens = s.burst
+	}
+	s.last = now
+}
@@ -0,0 +1,57 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSpawnLimiter(t *testing.T) {
+	now := time.Unix(1000, 0)
+	var sleeps []time.Duration
+	s := newSpawnLimiter(10, 3)
+	s.now = func() time.Time { return now }
+	s.sleep = func(d time.Duration) {
+		sleeps = append(sleeps, d)
+		now = now.Add(d)
+	}
+	s.last = now
+
+	// The burst is immediately available.
+	for i := 0; i < 3; i++ {
+		s.wait()
+	}
+	if len(sleeps) != 0 {
+		t.Fatal(sleeps)
+	}
+	// Then it is limited to the rate.
+	s.wait()
+	s.wait()
+	if diff := cmp.Diff([]time.Duration{100 * time.Millisecond, 100 * time.Millisecond}, sleeps); diff != "" {
+		t.Fatalf("+want, -got: %s", diff)
+	}
+	// Tokens accumulate up to the burst while idle.
+	now = now.Add(time.Hour)
+	sleeps = nil
+	for i := 0; i < 4; i++ {
+		s.wait()
+	}
+	if diff := cmp.Diff([]time.Duration{100 * time.Millisecond}, sleeps); diff != "" {
+		t.Fatalf("+want, -got: %s", diff)
+	}
+}
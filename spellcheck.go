@@ -0,0 +1,134 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"sort"
+	"strings"
+)
+
+// maxSuggestions is the maximum number of candidates suggested for a
+// misspelled name.
+const maxSuggestions = 3
+
+// spellDistance returns how far word is from the misspelled text, the lower
+// the closer, or -1 if word is not a plausible correction.
+//
+// A plain edit distance is useless for long paths: a typo in the file name
+// weighs as much as a different directory, and the allowed distance is too
+// small for long names. Instead the comparison is case insensitive and done
+// per path segment from the base name, which weighs the most and tolerates
+// more edits the longer it is. Omitted leading directories and abbreviated
+// base names, e.g. "foo.o" for "out/obj/foo.o" or "comp" for "compdb", are
+// plausible.
+func spellDistance(text, word string) int {
+	t, w := strings.ToLower(text), strings.ToLower(word)
+	if t == w {
+		return 0
+	}
+	ts, ws := strings.Split(t, "/"), strings.Split(w, "/")
+	tb, wb := ts[len(ts)-1], ws[len(ws)-1]
+	if tb == "" {
+		return -1
+	}
+	maxBase := len(tb) / 3
+	if maxBase < 2 {
+		maxBase = 2
+	}
+	if maxBase >= len(tb) {
+		// Replacing all the characters is not a typo.
+		maxBase = len(tb) - 1
+	}
+	d := editDistance(tb, wb, true, maxBase)
+	if d > maxBase {
+		if len(tb) < 3 || (!strings.HasPrefix(wb, tb) && !strings.HasSuffix(wb, tb)) {
+			return -1
+		}
+		d = maxBase
+	}
+	cost := 3 * d
+	td, wd := ts[:len(ts)-1], ws[:len(ws)-1]
+	for i := 1; i <= len(td) || i <= len(wd); i++ {
+		switch {
+		case i > len(td):
+			// A leading directory omitted.
+			cost++
+		case i > len(wd):
+			// A directory that doesn't exist.
+			cost += 2
+		default:
+			cost += editDistance(td[len(td)-i], wd[len(wd)-i], true, 3)
+		}
+	}
+	return cost
+}
+
+// spellcheck returns the indexes of the closest words to text, best first.
+func spellcheck(text string, words []string) []int {
+	type candidate struct {
+		index int
+		cost  int
+	}
+	var c []candidate
+	for i, w := range words {
+		if d := spellDistance(text, w); d >= 0 {
+			c = append(c, candidate{i, d})
+		}
+	}
+	sort.Slice(c, func(i, j int) bool {
+		if c[i].cost != c[j].cost {
+			return c[i].cost < c[j].cost
+		}
+		return words[c[i].index] < words[c[j].index]
+	})
+	var out []int
+	for _, x := range c {
+		// Only keep the candidates about as close as the best one.
+		if len(out) == maxSuggestions || x.cost > c[0].cost+3 {
+			break
+		}
+		out = append(out, x.index)
+	}
+	return out
+}
+
+// SpellcheckStrings returns the closest matches to a misspelled string, best
+// first, given a list of correct spellings.
+//
+// Returns nil if there is no close enough match.
+func SpellcheckStrings(text string, words ...string) []string {
+	var out []string
+	for _, i := range spellcheck(text, words) {
+		out = append(out, words[i])
+	}
+	return out
+}
+
+// SuggestionText returns the suggestions quoted for an error message, e.g.
+// "'a', 'b' or 'c'".
+func SuggestionText(suggestions []string) string {
+	out := ""
+	for i, s := range suggestions {
+		if i != 0 {
+			if i == len(suggestions)-1 {
+				out += " or "
+			} else {
+				out += ", "
+			}
+		}
+		out += "'" + s + "'"
+	}
+	return out
+}
@@ -0,0 +1,92 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSpellcheckStrings(t *testing.T) {
+	tools := []string{"browse", "clean", "commands", "compdb", "deps", "query", "targets", "test"}
+	data := []struct {
+		in   string
+		want []string
+	}{
+		{"comands", []string{"commands"}},
+		{"CLEAN", []string{"clean"}},
+		{"tset", []string{"test"}},
+		{"comp", []string{"compdb"}},
+		{"x", nil},
+		{"", nil},
+		{"unrelated", nil},
+	}
+	for i, l := range data {
+		if diff := cmp.Diff(l.want, SpellcheckStrings(l.in, tools...)); diff != "" {
+			t.Fatalf("#%d: %s", i, diff)
+		}
+	}
+	if got := SpellcheckString("cleen", tools...); got != "clean" {
+		t.Fatal(got)
+	}
+	// SpellcheckString is ninja's plain edit distance.
+	if got := SpellcheckString("CLEAN", tools...); got != "" {
+		t.Fatal(got)
+	}
+}
+
+func TestState_SpellcheckNodes(t *testing.T) {
+	s := NewStateTestWithBuiltinRules(t)
+	s.AssertParse(&s.state, "build out/obj/third_party/zlib/inflate.o: cat src/inflate.c\nbuild out/obj/base/inflate.o: cat src/inflate.c\nbuild out/obj/base/deflate.o: cat src/deflate.c\n", ParseManifestOpts{})
+	data := []struct {
+		in   string
+		want []string
+	}{
+		// A typo in a long path, beyond the reach of a plain edit distance.
+		{"out/obj/third_prty/zlib/inflte.o", []string{"out/obj/third_party/zlib/inflate.o"}},
+		// The directories omitted; the closest directory first.
+		{"inflate.o", []string{"out/obj/base/inflate.o", "out/obj/third_party/zlib/inflate.o", "src/inflate.c"}},
+		{"deflate.o", []string{"out/obj/base/deflate.o", "src/deflate.c"}},
+		{"OUT/OBJ/BASE/DEFLATE.O", []string{"out/obj/base/deflate.o"}},
+		{"src/inflate.cc", []string{"src/inflate.c"}},
+		{"out/obj/base/unrelated.o", nil},
+	}
+	for i, l := range data {
+		var got []string
+		for _, n := range s.state.SpellcheckNodes(l.in) {
+			got = append(got, n.Path)
+		}
+		if diff := cmp.Diff(l.want, got); diff != "" {
+			t.Fatalf("#%d: %s", i, diff)
+		}
+	}
+	// SpellcheckNode is ninja's plain edit distance.
+	if n := s.state.SpellcheckNode("inflate.o"); n != nil {
+		t.Fatal(n.Path)
+	}
+	if n := s.state.SpellcheckNode("src/inflate.cc"); n == nil || n.Path != "src/inflate.c" {
+		t.Fatal(n)
+	}
+}
+
+func TestSuggestionText(t *testing.T) {
+	if got := SuggestionText([]string{"a"}); got != "'a'" {
+		t.Fatal(got)
+	}
+	if got := SuggestionText([]string{"a", "b", "c"}); got != "'a', 'b' or 'c'" {
+		t.Fatal(got)
+	}
+}
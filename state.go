@@ -17,6 +17,7 @@ package nin
 import (
 	"fmt"
 	"sort"
+	"sync"
 )
 
 // Pool is a pool for delayed edges.
@@ -30,6 +31,10 @@ import (
 // completes).
 type Pool struct {
 	Name string
+	// Filename and Line are where the pool was declared. They are not set for
+	// the builtin pools.
+	Filename string
+	Line     int
 
 	// |currentUse| is the total of the weights of the edges which are
 	// currently scheduled in the Plan (i.e. the edges in Plan::ready).
@@ -51,6 +56,22 @@ func NewPool(name string, depth int) *Pool {
 	}
 }
 
+// Depth returns the maximum number of concurrent edges in this pool. 0 means
+// infinite.
+func (p *Pool) Depth() int {
+	return p.depth
+}
+
+// CurrentUse returns the number of edges currently scheduled in this pool.
+func (p *Pool) CurrentUse() int {
+	return p.currentUse
+}
+
+// DelayedEdges returns the number of edges waiting for this pool.
+func (p *Pool) DelayedEdges() int {
+	return len(p.delayed.edges)
+}
+
 // A depth of 0 is infinite
 func (p *Pool) isValid() bool {
 	return p.depth >= 0
@@ -136,6 +157,33 @@ type State struct {
 
 	Bindings *BindingEnv
 	Defaults []*Node
+
+	// Groups are the named sets of targets declared with "defaultgroup".
+	Groups map[string][]*Node
+
+	// Skipped are the edges removed from the graph by their "skip" binding.
+	Skipped []SkippedEdge
+
+	// scopedPools are the pools overriding a global pool in a subninja scope.
+	// See Scope.
+	scopedPools []*Pool
+
+	// ManifestFiles are the files loaded via include and subninja statements,
+	// sorted. Changing any of them requires regenerating the manifest.
+	ManifestFiles []string
+
+	// shadowed are the paths generated by both a phony edge and another edge.
+	// Only the first edge is kept. See ShadowedAliases().
+	shadowed []*Node
+
+	// noMemoize is set by DisableMemoization.
+	noMemoize bool
+	// posixShell is set by UsePosixShell.
+	posixShell bool
+
+	// mu is held for writing by the Builder while it updates the graph and for
+	// reading by View(). It is nil if the State wasn't created with NewState.
+	mu *sync.RWMutex
 }
 
 //type Paths ExternalStringHashMap<Node*>::Type
@@ -148,6 +196,7 @@ func NewState() State {
 		Paths:    map[string]*Node{},
 		Pools:    map[string]*Pool{},
 		Bindings: NewBindingEnv(nil),
+		mu:       &sync.RWMutex{},
 	}
 	s.Bindings.Rules[PhonyRule.Name] = PhonyRule
 	s.Pools[DefaultPool.Name] = DefaultPool
@@ -155,6 +204,34 @@ func NewState() State {
 	return s
 }
 
+// View calls fn with the state locked for reading.
+//
+// State is not safe for concurrent use in general. A Builder running on
+// another goroutine locks the state while it updates the graph, i.e. while
+// scanning the dependencies in AddTarget and while starting and finishing
+// edges in Build, and unlocks it while waiting for commands to complete.
+// Reading Nodes and Edges from fn is thus guaranteed to observe a consistent
+// graph.
+//
+// fn must not modify the state. View must not be called from a Status or
+// BuilderHooks callback, as these are called with the state already locked.
+func (s *State) View(fn func()) {
+	if s.mu != nil {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+	}
+	fn()
+}
+
+// lock locks the state for writing and returns the function to unlock it.
+func (s *State) lock() func() {
+	if s.mu == nil {
+		return func() {}
+	}
+	s.mu.Lock()
+	return s.mu.Unlock
+}
+
 // addEdge creates a new edge with this rule on the default pool.
 func (s *State) addEdge(rule *Rule) *Edge {
 	edge := &Edge{
@@ -162,6 +239,9 @@ func (s *State) addEdge(rule *Rule) *Edge {
 		Pool: DefaultPool,
 		Env:  s.Bindings,
 		ID:   int32(len(s.Edges)),
+
+		noMemoize:  s.noMemoize,
+		posixShell: s.posixShell,
 	}
 	s.Edges = append(s.Edges, edge)
 	return edge
@@ -185,7 +265,8 @@ func (s *State) GetNode(path string, slashBits uint64) *Node {
 	return node
 }
 
-// SpellcheckNode returns the node with the closest name.
+// SpellcheckNode returns the node with the closest name, as ninja does: by
+// edit distance only. See SpellcheckNodes for a more helpful one.
 func (s *State) SpellcheckNode(path string) *Node {
 	const maxValidEditDistance = 3
 	minDistance := maxValidEditDistance + 1
@@ -200,6 +281,21 @@ func (s *State) SpellcheckNode(path string) *Node {
 	return result
 }
 
+// SpellcheckNodes returns the nodes with the closest names, best first.
+func (s *State) SpellcheckNodes(path string) []*Node {
+	paths := make([]string, 0, len(s.Paths))
+	for p, node := range s.Paths {
+		if node != nil {
+			paths = append(paths, p)
+		}
+	}
+	var out []*Node
+	for _, i := range spellcheck(path, paths) {
+		out = append(out, s.Paths[paths[i]])
+	}
+	return out
+}
+
 func (s *State) addIn(edge *Edge, path string, slashBits uint64) {
 	node := s.GetNode(path, slashBits)
 	edge.Inputs = append(edge.Inputs, node)
@@ -209,6 +305,9 @@ func (s *State) addIn(edge *Edge, path string, slashBits uint64) {
 func (s *State) addOut(edge *Edge, path string, slashBits uint64) bool {
 	node := s.GetNode(path, slashBits)
 	if node.InEdge != nil {
+		if edge.Rule == PhonyRule || node.InEdge.Rule == PhonyRule {
+			s.shadowed = append(s.shadowed, node)
+		}
 		return false
 	}
 	edge.Outputs = append(edge.Outputs, node)
@@ -225,13 +324,32 @@ func (s *State) addValidation(edge *Edge, path string, slashBits uint64) {
 func (s *State) addDefault(path string) error {
 	node := s.Paths[path]
 	if node == nil {
-		// TODO(maruel): Use %q for real quoting.
-		return fmt.Errorf("unknown target '%s'", path)
+		return &ErrUnknownTarget{Target: path}
 	}
 	s.Defaults = append(s.Defaults, node)
 	return nil
 }
 
+func (s *State) addDefaultGroup(name string, paths []string) error {
+	if _, ok := s.Groups[name]; ok {
+		// TODO(maruel): Use %q for real quoting.
+		return fmt.Errorf("duplicate defaultgroup '%s'", name)
+	}
+	nodes := make([]*Node, 0, len(paths))
+	for _, path := range paths {
+		node := s.Paths[path]
+		if node == nil {
+			return &ErrUnknownTarget{Target: path}
+		}
+		nodes = append(nodes, node)
+	}
+	if s.Groups == nil {
+		s.Groups = map[string][]*Node{}
+	}
+	s.Groups[name] = nodes
+	return nil
+}
+
 // RootNodes return the root node(s) of the graph.
 //
 // Root nodes have no output edges.
@@ -295,7 +413,7 @@ func (s *State) Dump() {
 	}
 	if len(s.Pools) != 0 {
 		fmt.Printf("resource_pools:\n")
-		for _, p := range s.Pools {
+		for _, p := range s.AllPools() {
 			if p.Name != "" {
 				p.Dump()
 			}
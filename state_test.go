@@ -56,3 +56,42 @@ func TestState_Basic(t *testing.T) {
 		t.Fatal("dirty")
 	}
 }
+
+func TestState_View(t *testing.T) {
+	b := NewBuildTest(t)
+	if _, err := b.builder.addTargetName("cat12"); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	stop := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			b.state.View(func() {
+				for _, e := range b.state.Edges {
+					_ = e.OutputsReady
+					for _, o := range e.Outputs {
+						_ = o.Dirty
+						_ = o.MTime
+					}
+				}
+			})
+			select {
+			case <-stop:
+				return
+			default:
+			}
+		}
+	}()
+	err := b.builder.Build()
+	close(stop)
+	<-done
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.state.View(func() {
+		if !b.GetNode("cat12").InEdge.OutputsReady {
+			t.Fatal("expected outputs ready")
+		}
+	})
+}
@@ -19,15 +19,99 @@ package nin
 
 // Status is the interface that tracks the status of a build:
 // completion fraction, printing updates.
+//
+// The methods are called from the goroutine running Builder.Build, one at a
+// time. Use NewMultiStatus to have several implementations observe the same
+// build.
 type Status interface {
+	// PlanHasTotalEdges is called when the number of edges to run changes,
+	// including edges discovered by dyndep loading.
 	PlanHasTotalEdges(total int)
+	// BuildEdgeStarted is called when the command of an edge is started.
 	BuildEdgeStarted(edge *Edge, startTimeMillis int32)
+	// BuildEdgeFinished is called when the command of an edge completed, with
+	// its combined stdout and stderr.
 	BuildEdgeFinished(edge *Edge, endTimeMillis int32, success bool, output string)
+	// BuildLoadDyndeps is called before a dyndep file is loaded.
 	BuildLoadDyndeps()
+	// BuildStarted is called before the first command is started.
 	BuildStarted()
+	// BuildFinished is called once the build completed, successfully or not.
 	BuildFinished()
 
+	// Info, Warning and Error report messages with a fmt.Printf style format.
 	Info(msg string, i ...interface{})
 	Warning(msg string, i ...interface{})
 	Error(msg string, i ...interface{})
 }
+
+// NewMultiStatus returns a Status that forwards every call to each of sinks,
+// in order.
+//
+// This is useful to have for example a terminal printer and a machine
+// readable event stream observe the same build.
+func NewMultiStatus(sinks ...Status) Status {
+	m := make(multiStatus, 0, len(sinks))
+	for _, s := range sinks {
+		if s != nil {
+			m = append(m, s)
+		}
+	}
+	return m
+}
+
+type multiStatus []Status
+
+func (m multiStatus) PlanHasTotalEdges(total int) {
+	for _, s := range m {
+		s.PlanHasTotalEdges(total)
+	}
+}
+
+func (m multiStatus) BuildEdgeStarted(edge *Edge, startTimeMillis int32) {
+	for _, s := range m {
+		s.BuildEdgeStarted(edge, startTimeMillis)
+	}
+}
+
+func (m multiStatus) BuildEdgeFinished(edge *Edge, endTimeMillis int32, success bool, output string) {
+	for _, s := range m {
+		s.BuildEdgeFinished(edge, endTimeMillis, success, output)
+	}
+}
+
+func (m multiStatus) BuildLoadDyndeps() {
+	for _, s := range m {
+		s.BuildLoadDyndeps()
+	}
+}
+
+func (m multiStatus) BuildStarted() {
+	for _, s := range m {
+		s.BuildStarted()
+	}
+}
+
+func (m multiStatus) BuildFinished() {
+	for _, s := range m {
+		s.BuildFinished()
+	}
+}
+
+func (m multiStatus) Info(msg string, i ...interface{}) {
+	for _, s := range m {
+		s.Info(msg, i...)
+	}
+}
+
+func (m multiStatus) Warning(msg string, i ...interface{}) {
+	for _, s := range m {
+		s.Warning(msg, i...)
+	}
+}
+
+func (m multiStatus) Error(msg string, i ...interface{}) {
+	for _, s := range m {
+		s.Error(msg, i...)
+	}
+}
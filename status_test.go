@@ -0,0 +1,93 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// statusRecorder records the calls it receives.
+type statusRecorder struct {
+	calls []string
+}
+
+func (s *statusRecorder) PlanHasTotalEdges(total int) {
+	s.calls = append(s.calls, fmt.Sprintf("total %d", total))
+}
+
+func (s *statusRecorder) BuildEdgeStarted(edge *Edge, startTimeMillis int32) {
+	s.calls = append(s.calls, "started "+edge.Outputs[0].Path)
+}
+
+func (s *statusRecorder) BuildEdgeFinished(edge *Edge, endTimeMillis int32, success bool, output string) {
+	s.calls = append(s.calls, fmt.Sprintf("finished %s %t", edge.Outputs[0].Path, success))
+}
+
+func (s *statusRecorder) BuildLoadDyndeps() {
+	s.calls = append(s.calls, "dyndeps")
+}
+
+func (s *statusRecorder) BuildStarted() {
+	s.calls = append(s.calls, "build started")
+}
+
+func (s *statusRecorder) BuildFinished() {
+	s.calls = append(s.calls, "build finished")
+}
+
+func (s *statusRecorder) Info(msg string, i ...interface{}) {
+	s.calls = append(s.calls, "info "+fmt.Sprintf(msg, i...))
+}
+
+func (s *statusRecorder) Warning(msg string, i ...interface{}) {
+	s.calls = append(s.calls, "warning "+fmt.Sprintf(msg, i...))
+}
+
+func (s *statusRecorder) Error(msg string, i ...interface{}) {
+	s.calls = append(s.calls, "error "+fmt.Sprintf(msg, i...))
+}
+
+func TestMultiStatus(t *testing.T) {
+	b := NewBuildTest(t)
+	r1 := &statusRecorder{}
+	r2 := &statusRecorder{}
+	b.builder.status = NewMultiStatus(r1, nil, r2)
+	b.Dirty("cat1")
+	if _, err := b.builder.addTargetName("cat1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.builder.Build(); err != nil {
+		t.Fatal(err)
+	}
+	b.builder.status.Warning("%d", 42)
+
+	want := []string{
+		"total 1",
+		"build started",
+		"started cat1",
+		"finished cat1 true",
+		"build finished",
+		"warning 42",
+	}
+	if diff := cmp.Diff(want, r1.calls); diff != "" {
+		t.Fatal(diff)
+	}
+	if diff := cmp.Diff(want, r2.calls); diff != "" {
+		t.Fatal(diff)
+	}
+}
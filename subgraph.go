@@ -0,0 +1,73 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+// AddTargets adds multiple targets to the build. It returns true if any of
+// them needs to be built.
+//
+// It stops at the first error.
+func (b *Builder) AddTargets(targets []*Node) (bool, error) {
+	defer b.state.lock()()
+	dirty := false
+	for _, t := range targets {
+		do, err := b.addTarget(t)
+		if err != nil {
+			return false, err
+		}
+		dirty = dirty || do
+	}
+	return dirty, nil
+}
+
+// RestrictTo limits the build to edges. The other edges are considered up to
+// date even if they are dirty, and their outputs are used as is. The phony
+// edges are always considered, so aliases still work.
+//
+// For example, an IDE can compile a single file without building the
+// generated headers it depends on. It must be called before adding the
+// targets. A nil slice removes the restriction.
+func (b *Builder) RestrictTo(edges []*Edge) {
+	if edges == nil {
+		b.plan.only = nil
+		return
+	}
+	b.plan.only = make(map[*Edge]struct{}, len(edges))
+	for _, e := range edges {
+		b.plan.only[e] = struct{}{}
+	}
+}
+
+// skipExcludedInputs marks the edges producing the inputs of edge that are
+// excluded as up to date, so edge can be scheduled right away.
+func (p *plan) skipExcludedInputs(edge *Edge) {
+	if p.only == nil {
+		return
+	}
+	for _, n := range edge.Inputs {
+		if in := n.InEdge; in != nil && p.excluded(in) {
+			in.OutputsReady = true
+		}
+	}
+}
+
+// excluded returns true if edge is excluded from the build by
+// Builder.RestrictTo.
+func (p *plan) excluded(edge *Edge) bool {
+	if p.only == nil || edge.Rule == PhonyRule {
+		return false
+	}
+	_, ok := p.only[edge]
+	return !ok
+}
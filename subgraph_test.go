@@ -0,0 +1,57 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestBuildTest_AddTargets(t *testing.T) {
+	b := NewBuildTest(t)
+	b.AssertParse(&b.state, "build mid: cat in\nbuild out: cat mid\nbuild other: cat in\n", ParseManifestOpts{})
+	b.fs.Create("in", "")
+	if dirty, err := b.builder.AddTargets([]*Node{b.GetNode("out"), b.GetNode("other")}); !dirty || err != nil {
+		t.Fatal(dirty, err)
+	}
+	if err := b.builder.Build(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"cat in > mid", "cat mid > out", "cat in > other"}
+	if diff := cmp.Diff(want, b.commandRunner.commandsRan); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestBuildTest_RestrictTo(t *testing.T) {
+	b := NewBuildTest(t)
+	b.AssertParse(&b.state, "build mid: cat in\nbuild out: cat mid\nbuild other: cat in\nbuild all: phony out other\n", ParseManifestOpts{})
+	b.fs.Create("mid", "")
+	b.fs.Tick()
+	b.fs.Create("in", "")
+
+	// Only the edge of out is built, even if mid is dirty.
+	b.builder.RestrictTo([]*Edge{b.GetNode("out").InEdge})
+	if dirty, err := b.builder.AddTargets([]*Node{b.GetNode("all")}); !dirty || err != nil {
+		t.Fatal(dirty, err)
+	}
+	if err := b.builder.Build(); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"cat mid > out"}, b.commandRunner.commandsRan); diff != "" {
+		t.Fatal(diff)
+	}
+}
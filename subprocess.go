@@ -30,6 +30,10 @@ type subprocess struct {
 	done     int32
 	exitCode int32
 	buf      string
+	usage    ResourceUsage
+	// shell, if set, is the POSIX shell running the command on Windows. See
+	// BuildConfig.PosixShell.
+	shell string
 }
 
 // Done queries if the process is done.
@@ -49,23 +53,62 @@ func (s *subprocess) GetOutput() string {
 	return s.buf
 }
 
-func (s *subprocess) run(ctx context.Context, c string, useConsole bool) {
+// run runs the command c. env, if not nil, is the environment of the
+// process. dir, if not empty, is its working directory.
+func (s *subprocess) run(ctx context.Context, c string, env []string, dir string, useConsole bool) {
 	// The C++ code is fairly involved in its way to setup the process, the code
 	// here is fairly naive.
 	// TODO(maruel):  Enable skipShell. This needs more testing.
-	cmd := createCmd(ctx, c, useConsole, false)
+	cmd := createCmd(ctx, c, s.shell, useConsole, false)
+	cmd.Env = env
+	cmd.Dir = dir
 	buf := bytes.Buffer{}
 	cmd.Stdout = &buf
 	cmd.Stderr = &buf
 	if useConsole {
 		cmd.Stdin = os.Stdin
 	}
-	_ = cmd.Run()
+	err := cmd.Start()
+	if err == nil {
+		stop := func() {}
+		if !useConsole {
+			stop = killOnCancel(ctx, cmd.Process)
+		}
+		err = cmd.Wait()
+		stop()
+	}
+	if err != nil && cmd.ProcessState == nil {
+		// The process didn't start. exec reports a missing working directory as
+		// the shell not found.
+		if _, err2 := os.Stat(dir); dir != "" && err2 != nil {
+			err = err2
+		}
+		buf.WriteString(err.Error() + "\n")
+	}
 	// Skip a memory copy.
 	s.buf = unsafeString(buf.Bytes())
 	// TODO(maruel): For compatibility with ninja, use ExitInterrupted (2) for
 	// interrupted?
 	s.exitCode = int32(cmd.ProcessState.ExitCode())
+	if cmd.ProcessState != nil {
+		s.usage = processUsage(cmd.ProcessState)
+	}
+}
+
+// killOnCancel kills the process p and the processes it started when ctx is
+// canceled. Otherwise a process started by the shell would keep running, and
+// keep the output pipe open, after the shell was killed. It returns the
+// function to call once p exited.
+func killOnCancel(ctx context.Context, p *os.Process) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			killProcessGroup(p)
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
 }
 
 type subprocessSet struct {
@@ -76,6 +119,8 @@ type subprocessSet struct {
 	mu       sync.Mutex
 	running  []*subprocess
 	finished []*subprocess
+	// shell is copied to the subprocesses.
+	shell string
 }
 
 func newSubprocessSet() *subprocessSet {
@@ -115,17 +160,25 @@ func (s *subprocessSet) Finished() int {
 
 // Add starts a new child process.
 func (s *subprocessSet) Add(c string, useConsole bool) *subprocess {
-	subproc := &subprocess{}
+	return s.addFunc(func(ctx context.Context, subproc *subprocess) {
+		subproc.run(ctx, c, nil, "", useConsole)
+	})
+}
+
+// addFunc runs f concurrently as if it was a child process. f must set the
+// output and the exit code of subproc.
+func (s *subprocessSet) addFunc(f func(ctx context.Context, subproc *subprocess)) *subprocess {
+	subproc := &subprocess{shell: s.shell}
 	s.wg.Add(1)
-	go s.enqueue(subproc, c, useConsole)
+	go s.enqueue(subproc, f)
 	s.mu.Lock()
 	s.running = append(s.running, subproc)
 	s.mu.Unlock()
 	return subproc
 }
 
-func (s *subprocessSet) enqueue(subproc *subprocess, c string, useConsole bool) {
-	subproc.run(s.ctx, c, useConsole)
+func (s *subprocessSet) enqueue(subproc *subprocess, f func(ctx context.Context, subproc *subprocess)) {
+	f(s.ctx, subproc)
 	// Do it before sending the channel because procDone is a blocking channel
 	// and the caller relies on Running() == 0 && Finished() == 0. Otherwise
 	// Clear() would hang.
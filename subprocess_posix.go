@@ -19,11 +19,26 @@ package nin
 
 import (
 	"context"
+	"os"
 	"os/exec"
+	"runtime"
 	"syscall"
 )
 
-func createCmd(ctx context.Context, c string, useConsole, enableSkipShell bool) *exec.Cmd {
+// maxCommandLength is the longest command that can be run. On Linux, each
+// argument, here the command passed to sh -c, is limited to MAX_ARG_STRLEN
+// (32 pages). Other systems only limit the total size of the arguments and the
+// environment, ARG_MAX, which is at least 256KiB on macOS and the BSDs.
+var maxCommandLength = func() int {
+	if runtime.GOOS == "linux" {
+		return 32*4096 - 1
+	}
+	return 256*1024 - 1
+}()
+
+// createCmd returns the command to run c with /bin/sh. shell is only used on
+// Windows.
+func createCmd(ctx context.Context, c, shell string, useConsole, enableSkipShell bool) *exec.Cmd {
 	// The commands being run use shell redirection. The C++ version uses
 	// system() which always uses the default shell.
 	//
@@ -43,8 +58,44 @@ func createCmd(ctx context.Context, c string, useConsole, enableSkipShell bool)
 	}
 
 	// When useConsole is false, it is a new process group on posix.
-	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Setpgid: !useConsole,
+	if useConsole {
+		cmd.SysProcAttr = consoleProcAttr
+	} else {
+		cmd.SysProcAttr = processGroupProcAttr
 	}
 	return cmd
 }
+
+// killProcessGroup kills the process group led by p. The processes not run in
+// the console are started in their own group.
+func killProcessGroup(p *os.Process) {
+	_ = syscall.Kill(-p.Pid, syscall.SIGKILL)
+}
+
+// processUsage returns the resources used by a process that exited, and by
+// the processes it waited for.
+func processUsage(p *os.ProcessState) ResourceUsage {
+	u := ResourceUsage{UserTime: p.UserTime(), SystemTime: p.SystemTime()}
+	if r, ok := p.SysUsage().(*syscall.Rusage); ok {
+		switch runtime.GOOS {
+		case "darwin":
+			// It is in bytes on macOS.
+			u.MaxRSS = int64(r.Maxrss)
+		case "linux":
+			u.MaxRSS = int64(r.Maxrss) * 1024
+			// Blocks of 512 bytes.
+			u.ReadBytes = int64(r.Inblock) * 512
+			u.WrittenBytes = int64(r.Oublock) * 512
+		default:
+			u.MaxRSS = int64(r.Maxrss) * 1024
+		}
+	}
+	return u
+}
+
+// The process attributes are only read when starting a process so they are
+// shared to save an allocation per spawn.
+var (
+	consoleProcAttr      = &syscall.SysProcAttr{}
+	processGroupProcAttr = &syscall.SysProcAttr{Setpgid: true}
+)
@@ -387,3 +387,17 @@ func TestSubprocessTest_ReadStdin(t *testing.T) {
 		t.Fatal("expected equal")
 	}
 }
+
+func TestSubprocessTest_ResourceUsage(t *testing.T) {
+	subprocs := newSubprocessSetTest(t)
+	subproc := subprocs.Add(testCommand(), false)
+	for !subproc.Done() {
+		subprocs.DoWork()
+	}
+	if subproc.Finish() != ExitSuccess {
+		t.Fatal(subproc.GetOutput())
+	}
+	if runtime.GOOS != "windows" && subproc.usage.MaxRSS == 0 {
+		t.Fatal("expected the max RSS to be recorded")
+	}
+}
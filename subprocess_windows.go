@@ -16,12 +16,18 @@ package nin
 
 import (
 	"context"
+	"os"
 	"os/exec"
 	"strings"
 	"syscall"
 )
 
-func createCmd(ctx context.Context, c string, useConsole, enableSkipShell bool) *exec.Cmd {
+// maxCommandLength is the longest command line CreateProcess accepts.
+var maxCommandLength = 32767 - 1
+
+// createCmd returns the command to run c. shell, if set, is the POSIX shell,
+// e.g. the sh.exe of MSYS2, running it.
+func createCmd(ctx context.Context, c, shell string, useConsole, enableSkipShell bool) *exec.Cmd {
 	// The commands being run use shell redirection. The C++ version uses
 	// system() which always uses the default shell.
 	//
@@ -29,22 +35,18 @@ func createCmd(ctx context.Context, c string, useConsole, enableSkipShell bool)
 	// saving an unnecessary exec(). Only use this when we detect no quote, no
 	// shell redirection character.
 	// TODO(maruel): This is incorrect and temporary.
-	skipShell := true || (enableSkipShell && !strings.ContainsAny(c, "%><&|^"))
+	skipShell := shell == "" && (true || (enableSkipShell && !strings.ContainsAny(c, "%><&|^")))
 
 	ex := ""
 	var args []string
-	if skipShell {
+	if shell != "" {
+		// MSYS2 or Cygwin.
+		ex = shell
+		args = []string{"-c", c}
+	} else if skipShell {
 		// Ignore the parsed arguments on Windows and feedback the original string.
-		//
-		// TODO(maruel): Handle quoted space. It's only necessary from the
-		// perspective of finding the primary executable to run.
-		i := strings.IndexByte(c, ' ')
-		if i == -1 {
-			// A single executable with no argument.
-			ex = c
-		} else {
-			ex = c[:i]
-		}
+		// The program is only needed to find the executable to run.
+		ex = win32Program(c)
 		args = []string{c}
 	} else {
 		ex = "cmd.exe"
@@ -66,6 +68,9 @@ func createCmd(ctx context.Context, c string, useConsole, enableSkipShell bool)
 		cmd.Args = nil
 	}
 	if useConsole {
+		if cmd.SysProcAttr == nil {
+			cmd.SysProcAttr = &syscall.SysProcAttr{}
+		}
 		cmd.SysProcAttr.CreationFlags = syscall.CREATE_NEW_PROCESS_GROUP
 	}
 
@@ -74,3 +79,18 @@ func createCmd(ctx context.Context, c string, useConsole, enableSkipShell bool)
 	// PostQueuedCompletionStatus(CreateIoCompletionPort()) via SetConsoleCtrlHandler(fn, FALSE).
 	return cmd
 }
+
+// processUsage returns the resources used by a process that exited.
+//
+// killProcessGroup kills p.
+//
+// TODO(maruel): Use a job object to also kill the processes it started.
+func killProcessGroup(p *os.Process) {
+	_ = p.Kill()
+}
+
+// Only the CPU time is known; the memory and I/O counters require the process
+// handle, which is closed once the process is waited for.
+func processUsage(p *os.ProcessState) ResourceUsage {
+	return ResourceUsage{UserTime: p.UserTime(), SystemTime: p.SystemTime()}
+}
@@ -0,0 +1,257 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+const testCacheSignature = "# nin tests v1\n"
+
+// IsTestEdge returns true if the edge runs a test, i.e. it has "test = 1".
+func IsTestEdge(e *Edge) bool {
+	return e.Rule != PhonyRule && e.GetBinding("test") != ""
+}
+
+// TestEdges returns the edges running a test.
+func TestEdges(state *State) []*Edge {
+	var out []*Edge
+	for _, e := range state.Edges {
+		if IsTestEdge(e) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// testResult is a result cached by TestCache.
+type testResult struct {
+	key      [sha256.Size]byte
+	exitCode ExitStatus
+	output   string
+}
+
+// TestCache caches the results of the test edges, keyed by their command and
+// the content of their inputs.
+//
+// Contrary to the build log, which reruns a test when an input is rebuilt, a
+// test only runs again when the content of an input changed. A failure is
+// cached too, so it is reported again without rerunning the test.
+//
+// Use BeforeEdge as BuilderHooks.BeforeEdge and call Record from
+// BuilderHooks.AfterEdge. It is safe for concurrent use.
+type TestCache struct {
+	// FS is used to hash the inputs.
+	FS FileSystem
+	// Digests caches the digests of the inputs.
+	Digests *DigestStore
+	// TrackTools must be BuildConfig.TrackTools, so the command of the edges
+	// is the one recorded in the build log.
+	TrackTools bool
+
+	mu      sync.Mutex
+	entries map[string]testResult
+	// pending are the keys of the tests being run.
+	pending map[*Edge][sha256.Size]byte
+	dirty   bool
+	stats   TestStats
+}
+
+// TestStats counts the test edges that completed in a build.
+type TestStats struct {
+	Passed int
+	Failed int
+	// Cached is the number of tests, passed or failed, whose result was
+	// reused instead of running them.
+	Cached int
+}
+
+// NewTestCache returns an empty TestCache.
+func NewTestCache(fs FileSystem, digests *DigestStore) *TestCache {
+	return &TestCache{FS: fs, Digests: digests, entries: map[string]testResult{}, pending: map[*Edge][sha256.Size]byte{}}
+}
+
+// Stats returns the counts of the tests that completed.
+func (t *TestCache) Stats() TestStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.stats
+}
+
+// key returns the key of the result of a test edge.
+func (t *TestCache) key(e *Edge) ([sha256.Size]byte, error) {
+	h := sha256.New()
+	command, _ := e.logCommand(&toolTracker{all: t.TrackTools, digests: t.Digests})
+	_, _ = h.Write([]byte(command))
+	h.Write([]byte{0})
+	for _, n := range e.Inputs[:len(e.Inputs)-int(e.OrderOnlyDeps)] {
+		d, err := t.Digests.Get(t.FS, n.Path)
+		if err != nil {
+			return [sha256.Size]byte{}, err
+		}
+		_, _ = h.Write([]byte(n.Path))
+		h.Write([]byte{0})
+		_, _ = h.Write(d.Hash[:])
+	}
+	var k [sha256.Size]byte
+	copy(k[:], h.Sum(nil))
+	return k, nil
+}
+
+// BeforeEdge implements BuilderHooks.BeforeEdge. It skips the test edges
+// whose result is cached.
+func (t *TestCache) BeforeEdge(e *Edge) EdgeDecision {
+	if !IsTestEdge(e) || len(e.Outputs) == 0 {
+		return EdgeDecision{}
+	}
+	k, err := t.key(e)
+	if err != nil {
+		// Let the command run and report the problem, if any.
+		return EdgeDecision{}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if r, ok := t.entries[e.Outputs[0].Path]; ok && r.key == k {
+		if r.exitCode != ExitSuccess {
+			return EdgeDecision{Err: errors.New(r.output)}
+		}
+		return EdgeDecision{Skip: true}
+	}
+	t.pending[e] = k
+	return EdgeDecision{}
+}
+
+// Record records the result of an edge. Only the results of the test edges
+// that ran are cached.
+func (t *TestCache) Record(result *Result) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !IsTestEdge(result.Edge) {
+		return
+	}
+	if result.ExitCode == ExitSuccess {
+		t.stats.Passed++
+	} else {
+		t.stats.Failed++
+	}
+	k, ok := t.pending[result.Edge]
+	if !ok {
+		if result.notRun {
+			t.stats.Cached++
+		}
+		return
+	}
+	delete(t.pending, result.Edge)
+	if result.notRun || result.ExitCode == ExitInterrupted {
+		return
+	}
+	t.entries[result.Edge.Outputs[0].Path] = testResult{key: k, exitCode: result.ExitCode, output: result.Output}
+	t.dirty = true
+}
+
+// Load loads the results from the file at path.
+//
+// It is not an error if the file doesn't exist.
+func (t *TestCache) Load(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if !bytes.HasPrefix(data, []byte(testCacheSignature)) {
+		return fmt.Errorf("%s: invalid signature", path)
+	}
+	data = data[len(testCacheSignature):]
+	entries := map[string]testResult{}
+	for lineno := 2; len(data) != 0; lineno++ {
+		i := bytes.IndexByte(data, '\n')
+		if i == -1 {
+			// Truncated by an interrupted write.
+			break
+		}
+		line := data[:i]
+		data = data[i+1:]
+		f := bytes.SplitN(line, []byte{'\t'}, 4)
+		if len(f) != 4 {
+			return fmt.Errorf("%s:%d: expected 4 fields", path, lineno)
+		}
+		var r testResult
+		n, err1 := hex.Decode(r.key[:], f[0])
+		code, err2 := strconv.Atoi(string(f[1]))
+		output, err3 := strconv.Unquote(string(f[2]))
+		if err1 != nil || err2 != nil || err3 != nil || n != len(r.key) {
+			return fmt.Errorf("%s:%d: invalid entry", path, lineno)
+		}
+		r.exitCode = ExitStatus(code)
+		r.output = output
+		entries[string(f[3])] = r
+	}
+	t.mu.Lock()
+	t.entries = entries
+	t.dirty = false
+	t.mu.Unlock()
+	return nil
+}
+
+// Save writes the results to the file at path if they changed since the last
+// Load or Save.
+func (t *TestCache) Save(path string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.dirty {
+		return nil
+	}
+	paths := make([]string, 0, len(t.entries))
+	for p := range t.entries {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o666)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	_, _ = w.WriteString(testCacheSignature)
+	for _, p := range paths {
+		r := t.entries[p]
+		_, _ = fmt.Fprintf(w, "%x\t%d\t%s\t%s\n", r.key, r.exitCode, strconv.Quote(r.output), p)
+	}
+	err = w.Flush()
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	t.dirty = false
+	return nil
+}
@@ -0,0 +1,138 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestBuildTest_TestCache(t *testing.T) {
+	b := NewBuildTest(t)
+	b.AssertParse(&b.state, "nin_features = test\nrule touch\n  command = touch $out\nbuild t1: touch in1\n  test = 1\nbuild o1: touch in1\n", ParseManifestOpts{})
+	if e := TestEdges(&b.state); len(e) != 1 || e[0] != b.GetNode("t1").InEdge {
+		t.Fatal(e)
+	}
+	c := NewTestCache(&b.fs, NewDigestStore())
+	b.builder.Hooks = BuilderHooks{
+		BeforeEdge: c.BeforeEdge,
+		AfterEdge: func(result *Result, startTimeMillis, endTimeMillis int32) {
+			c.Record(result)
+		},
+	}
+	build := func(want ...string) {
+		b.commandRunner.commandsRan = nil
+		b.state.Reset()
+		for _, target := range []string{"t1", "o1"} {
+			if _, err := b.builder.addTargetName(target); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := b.builder.Build(); err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(want, b.commandRunner.commandsRan); diff != "" {
+			t.Fatal(diff)
+		}
+	}
+	build("touch t1", "touch o1")
+	if s := c.Stats(); s != (TestStats{Passed: 1}) {
+		t.Fatal(s)
+	}
+
+	// The input is newer but has the same content; the test is not run again
+	// but the other edge is.
+	b.fs.Tick()
+	b.fs.Create("in1", "")
+	build("touch o1")
+	if s := c.Stats(); s != (TestStats{Passed: 2, Cached: 1}) {
+		t.Fatal(s)
+	}
+
+	b.fs.Tick()
+	b.fs.Create("in1", "changed")
+	build("touch t1", "touch o1")
+
+	if err := c.Save("tests"); err != nil {
+		t.Fatal(err)
+	}
+	c2 := NewTestCache(&b.fs, NewDigestStore())
+	if err := c2.Load("tests"); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(c.entries, c2.entries, cmp.AllowUnexported(testResult{})); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestBuildTest_TestCacheFailure(t *testing.T) {
+	b := NewBuildTest(t)
+	b.AssertParse(&b.state, "nin_features = test\nrule fail\n  command = fail\nbuild t1: fail in1\n  test = 1\n", ParseManifestOpts{})
+	c := NewTestCache(&b.fs, NewDigestStore())
+	for i := 0; i < 2; i++ {
+		b.commandRunner.commandsRan = nil
+		b.state.Reset()
+		b.builder = NewBuilder(&b.state, &b.config, nil, nil, &b.fs, b.status, 0)
+		b.builder.commandRunner = &b.commandRunner
+		b.builder.Hooks = BuilderHooks{
+			BeforeEdge: c.BeforeEdge,
+			AfterEdge: func(result *Result, startTimeMillis, endTimeMillis int32) {
+				c.Record(result)
+			},
+		}
+		if _, err := b.builder.addTargetName("t1"); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.builder.Build(); err == nil || err.Error() != "subcommand failed" {
+			t.Fatal(err)
+		}
+		// The cached failure is reported without running the test again.
+		want := []string{"fail"}
+		if i == 1 {
+			want = nil
+		}
+		if diff := cmp.Diff(want, b.commandRunner.commandsRan); diff != "" {
+			t.Fatal(i, diff)
+		}
+	}
+	if s := c.Stats(); s != (TestStats{Failed: 2, Cached: 1}) {
+		t.Fatal(s)
+	}
+}
+
+func TestTestCache_Load(t *testing.T) {
+	CreateTempDirAndEnter(t)
+	c := NewTestCache(nil, nil)
+	if err := c.Load("missing"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Save("tests"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile("bad", []byte("# nin foo\n"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Load("bad"); err == nil || err.Error() != "bad: invalid signature" {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile("bad", []byte(testCacheSignature+"00\t0\t\"\"\tt1\n"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Load("bad"); err == nil || err.Error() != "bad:2: invalid entry" {
+		t.Fatal(err)
+	}
+}
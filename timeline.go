@@ -0,0 +1,192 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// TimelineEvent is an edge that ran during a build.
+type TimelineEvent struct {
+	Rule string
+	// Output is the first output of the edge.
+	Output string
+	// Start and End are relative to the start of the build.
+	Start time.Duration
+	End   time.Duration
+	// Lane is the job slot the edge is assigned to, so the events of a lane
+	// don't overlap. It is not necessarily the slot the edge ran in.
+	Lane int
+}
+
+// Timeline returns the edges of the manifest that ran in entries, sorted by
+// start time.
+//
+// entries is the last build, as returned by ReadLastBuild().
+func Timeline(state *State, entries []*LogEntry) []TimelineEvent {
+	edges := scheduledEdges(state, entries)
+	sort.SliceStable(edges, func(i, j int) bool { return edges[i].start < edges[j].start })
+	out := make([]TimelineEvent, 0, len(edges))
+	// laneEnd is the end of the last edge of each lane.
+	var laneEnd []int32
+	for _, e := range edges {
+		lane := 0
+		for ; lane < len(laneEnd) && laneEnd[lane] > e.start; lane++ {
+		}
+		if lane == len(laneEnd) {
+			laneEnd = append(laneEnd, 0)
+		}
+		laneEnd[lane] = e.end
+		out = append(out, TimelineEvent{
+			Rule:   e.edge.Rule.Name,
+			Output: e.edge.Outputs[0].Path,
+			Start:  time.Duration(e.start) * time.Millisecond,
+			End:    time.Duration(e.end) * time.Millisecond,
+			Lane:   lane,
+		})
+	}
+	return out
+}
+
+// WriteChromeTrace writes the events in the Chrome trace event format, as
+// loaded by chrome://tracing or https://ui.perfetto.dev.
+func WriteChromeTrace(w io.Writer, events []TimelineEvent) error {
+	type traceEvent struct {
+		Name string `json:"name"`
+		Cat  string `json:"cat"`
+		Ph   string `json:"ph"`
+		Ts   int64  `json:"ts"`
+		Dur  int64  `json:"dur"`
+		Pid  int    `json:"pid"`
+		Tid  int    `json:"tid"`
+	}
+	out := struct {
+		TraceEvents     []traceEvent `json:"traceEvents"`
+		DisplayTimeUnit string       `json:"displayTimeUnit"`
+	}{TraceEvents: make([]traceEvent, 0, len(events)), DisplayTimeUnit: "ms"}
+	for _, e := range events {
+		out.TraceEvents = append(out.TraceEvents, traceEvent{
+			Name: e.Output,
+			Cat:  e.Rule,
+			Ph:   "X",
+			Ts:   e.Start.Microseconds(),
+			Dur:  (e.End - e.Start).Microseconds(),
+			Tid:  e.Lane,
+		})
+	}
+	return json.NewEncoder(w).Encode(&out)
+}
+
+// WriteSpeedscope writes the events as a speedscope profile, as loaded by
+// https://www.speedscope.app. Each lane is a profile where the edges are
+// nested under the frame of their rule.
+func WriteSpeedscope(w io.Writer, name string, events []TimelineEvent) error {
+	type frame struct {
+		Name string `json:"name"`
+	}
+	type event struct {
+		Type  string `json:"type"`
+		Frame int    `json:"frame"`
+		At    int64  `json:"at"`
+	}
+	type profile struct {
+		Type       string  `json:"type"`
+		Name       string  `json:"name"`
+		Unit       string  `json:"unit"`
+		StartValue int64   `json:"startValue"`
+		EndValue   int64   `json:"endValue"`
+		Events     []event `json:"events"`
+	}
+	out := struct {
+		Schema string `json:"$schema"`
+		Shared struct {
+			Frames []frame `json:"frames"`
+		} `json:"shared"`
+		Profiles []profile `json:"profiles"`
+		Name     string    `json:"name"`
+		Exporter string    `json:"exporter"`
+	}{
+		Schema:   "https://www.speedscope.app/file-format-schema.json",
+		Profiles: []profile{},
+		Name:     name,
+		Exporter: "nin",
+	}
+	out.Shared.Frames = []frame{}
+	// A rule and an output can have the same name.
+	type key struct {
+		rule bool
+		name string
+	}
+	frames := map[key]int{}
+	frameOf := func(k key) int {
+		i, ok := frames[k]
+		if !ok {
+			i = len(out.Shared.Frames)
+			frames[k] = i
+			out.Shared.Frames = append(out.Shared.Frames, frame{Name: k.name})
+		}
+		return i
+	}
+	var end int64
+	for _, e := range events {
+		if ms := e.End.Milliseconds(); ms > end {
+			end = ms
+		}
+	}
+	for _, e := range events {
+		for len(out.Profiles) <= e.Lane {
+			out.Profiles = append(out.Profiles, profile{
+				Type:     "evented",
+				Name:     fmt.Sprintf("lane %d", len(out.Profiles)),
+				Unit:     "milliseconds",
+				EndValue: end,
+				Events:   []event{},
+			})
+		}
+		r := frameOf(key{true, e.Rule})
+		o := frameOf(key{false, e.Output})
+		start, stop := e.Start.Milliseconds(), e.End.Milliseconds()
+		p := &out.Profiles[e.Lane]
+		p.Events = append(p.Events, event{"O", r, start}, event{"O", o, start}, event{"C", o, stop}, event{"C", r, stop})
+	}
+	return json.NewEncoder(w).Encode(&out)
+}
+
+// WriteFoldedStacks writes the events as folded stacks, one "rule;output
+// milliseconds" line per edge sorted by rule, as loaded by flamegraph.pl or
+// https://www.speedscope.app.
+func WriteFoldedStacks(w io.Writer, events []TimelineEvent) error {
+	sorted := make([]TimelineEvent, len(events))
+	copy(sorted, events)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Rule != sorted[j].Rule {
+			return sorted[i].Rule < sorted[j].Rule
+		}
+		return sorted[i].Output < sorted[j].Output
+	})
+	b := bufio.NewWriter(w)
+	// The frames are separated by ';' and the count by a space.
+	r := strings.NewReplacer(";", "_", " ", "_")
+	for _, e := range sorted {
+		fmt.Fprintf(b, "%s;%s %d\n", r.Replace(e.Rule), r.Replace(e.Output), (e.End - e.Start).Milliseconds())
+	}
+	return b.Flush()
+}
@@ -0,0 +1,93 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestTimeline(t *testing.T) {
+	s := NewStateTestWithBuiltinRules(t)
+	s.AssertParse(&s.state, "rule link\n  command = link\nbuild a b: link in\nbuild c: link a\nbuild d: cat in\n", ParseManifestOpts{})
+	entries := []*LogEntry{
+		// a and b are from the same edge.
+		{output: "a", startTime: 0, endTime: 100},
+		{output: "b", startTime: 0, endTime: 100},
+		{output: "d", startTime: 10, endTime: 150},
+		{output: "c", startTime: 100, endTime: 300},
+		{output: "stale", startTime: 0, endTime: 1000},
+	}
+	got := Timeline(&s.state, entries)
+	ms := time.Millisecond
+	want := []TimelineEvent{
+		{Rule: "link", Output: "a", Start: 0, End: 100 * ms, Lane: 0},
+		{Rule: "cat", Output: "d", Start: 10 * ms, End: 150 * ms, Lane: 1},
+		{Rule: "link", Output: "c", Start: 100 * ms, End: 300 * ms, Lane: 0},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatal(diff)
+	}
+
+	buf := bytes.Buffer{}
+	if err := WriteFoldedStacks(&buf, got); err != nil {
+		t.Fatal(err)
+	}
+	if s := buf.String(); s != "cat;d 140\nlink;a 100\nlink;c 200\n" {
+		t.Fatal(s)
+	}
+
+	buf.Reset()
+	if err := WriteChromeTrace(&buf, got); err != nil {
+		t.Fatal(err)
+	}
+	var trace struct {
+		TraceEvents []map[string]interface{}
+	}
+	if err := json.Unmarshal(buf.Bytes(), &trace); err != nil {
+		t.Fatal(err)
+	}
+	if len(trace.TraceEvents) != 3 || trace.TraceEvents[1]["dur"] != 140000. || trace.TraceEvents[1]["tid"] != 1. {
+		t.Fatal(trace)
+	}
+
+	buf.Reset()
+	if err := WriteSpeedscope(&buf, "build", got); err != nil {
+		t.Fatal(err)
+	}
+	var profile struct {
+		Shared struct {
+			Frames []struct{ Name string }
+		}
+		Profiles []struct {
+			EndValue int64
+			Events   []struct {
+				Type  string
+				Frame int
+				At    int64
+			}
+		}
+	}
+	if err := json.Unmarshal(buf.Bytes(), &profile); err != nil {
+		t.Fatal(err)
+	}
+	if len(profile.Shared.Frames) != 5 || len(profile.Profiles) != 2 || profile.Profiles[0].EndValue != 300 || len(profile.Profiles[0].Events) != 8 {
+		t.Fatalf("%+v", profile)
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// The "toolchain" binding is a list of directories, separated like PATH, e.g.
+// "toolchain = /opt/clang-14/bin". When set on a rule or an edge:
+//
+//   - The program of the command, when it is a bare name, is resolved in these
+//     directories only.
+//   - The command runs with PATH set to these directories, so the programs it
+//     starts in turn are also resolved in the toolchain.
+//   - The digest of the program is recorded in the build log along the
+//     command, so upgrading the toolchain in place rebuilds the edges that
+//     used the previous binary.
+
+// toolTracker defines how the programs of the commands are identified in the
+// build log. See BuildConfig.TrackTools.
+//
+// A nil toolTracker only tracks the programs of the edges with a toolchain,
+// without caching their digests.
+type toolTracker struct {
+	// all tracks the program of every command, not only the ones of the
+	// edges with a toolchain.
+	all bool
+	// digests caches the digests of the programs.
+	digests *DigestStore
+}
+
+// lookPathCache memoizes the resolution of the programs in PATH.
+var lookPathCache sync.Map
+
+// toolchainDirs returns the directories of the "toolchain" binding of e.
+func (e *Edge) toolchainDirs() []string {
+	v := e.GetBinding("toolchain")
+	if v == "" {
+		return nil
+	}
+	return filepath.SplitList(v)
+}
+
+// commandProgram returns the program of the command, i.e. its first word,
+// and the rest of the command.
+func commandProgram(command string) (string, string) {
+	command = strings.TrimLeft(command, " \t")
+	i := strings.IndexAny(command, " \t")
+	if i == -1 {
+		return command, ""
+	}
+	return command[:i], command[i:]
+}
+
+// lookTool returns the path of the program name in dirs, or "" if not found.
+func lookTool(dirs []string, name string) string {
+	for _, d := range dirs {
+		p := filepath.Join(d, name)
+		if fi, err := os.Stat(p); err == nil && fi.Mode().IsRegular() {
+			return p
+		}
+		if runtime.GOOS == "windows" && filepath.Ext(name) == "" {
+			if fi, err := os.Stat(p + ".exe"); err == nil && fi.Mode().IsRegular() {
+				return p + ".exe"
+			}
+		}
+	}
+	return ""
+}
+
+// toolchainCommand returns the command to run for e with its program resolved
+// in the toolchain, and the environment to run it with. It returns command
+// and nil when e has no toolchain.
+func (e *Edge) toolchainCommand(command string) (string, []string) {
+	dirs := e.toolchainDirs()
+	if len(dirs) == 0 {
+		return command, nil
+	}
+	if prog, rest := commandProgram(command); prog != "" && !strings.ContainsAny(prog, "/\\\"'") {
+		if p := lookTool(dirs, prog); p != "" {
+			command = p + rest
+		}
+	}
+	abs := make([]string, 0, len(dirs))
+	for _, d := range dirs {
+		if a, err := filepath.Abs(d); err == nil {
+			d = a
+		}
+		abs = append(abs, d)
+	}
+	env := os.Environ()
+	path := "PATH=" + strings.Join(abs, string(os.PathListSeparator))
+	found := false
+	for i, kv := range env {
+		// Environment variables are case insensitive on Windows.
+		if len(kv) > 5 && strings.EqualFold(kv[:5], "PATH=") {
+			env[i] = path
+			found = true
+		}
+	}
+	if !found {
+		env = append(env, path)
+	}
+	return command, env
+}
+
+// lookPath returns the path of the program name in PATH, or "" if not found.
+func lookPath(name string) string {
+	if v, ok := lookPathCache.Load(name); ok {
+		return v.(string)
+	}
+	p, err := exec.LookPath(name)
+	if err != nil {
+		p = ""
+	}
+	lookPathCache.Store(name, p)
+	return p
+}
+
+// toolSuffix returns what is appended to the command recorded in the build
+// log to identify its program, or "".
+//
+// It is a shell comment, so the command stays runnable.
+func (e *Edge) toolSuffix(command string, tools *toolTracker) string {
+	dirs := e.toolchainDirs()
+	if len(dirs) == 0 && (tools == nil || !tools.all) {
+		return ""
+	}
+	prog, _ := commandProgram(command)
+	if strings.ContainsAny(prog, "/\\") {
+		c := CanonicalizePath(prog)
+		for _, n := range e.Inputs {
+			if n.Path == c {
+				// A program built by the build is already tracked as an input.
+				return ""
+			}
+		}
+	}
+	p := prog
+	if !strings.ContainsAny(prog, "/\\\"'") {
+		if len(dirs) != 0 {
+			p = lookTool(dirs, prog)
+		} else {
+			p = lookPath(prog)
+		}
+	}
+	var d Digest
+	err := os.ErrNotExist
+	if p != "" {
+		digests := NewDigestStore()
+		if tools != nil && tools.digests != nil {
+			digests = tools.digests
+		}
+		// The programs are real files, independently of the FileSystem used by
+		// the build.
+		d, err = digests.Get(&RealDiskInterface{}, p)
+	}
+	switch {
+	case len(dirs) == 0 && err != nil:
+		// Probably a shell builtin.
+		return ""
+	case len(dirs) == 0:
+		return " # tool sha256:" + d.String()
+	case err != nil:
+		return " # toolchain missing " + prog
+	default:
+		return " # toolchain sha256:" + d.String()
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestToolchain(t *testing.T) {
+	dir := CreateTempDirAndEnter(t)
+	if err := os.Mkdir("tc", 0o777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join("tc", "cc"), []byte("v1"), 0o777); err != nil {
+		t.Fatal(err)
+	}
+	s := NewStateTestWithBuiltinRules(t)
+	s.AssertParse(&s.state, "nin_features = toolchain\nrule cc\n  command = cc -c $in\n  toolchain = tc\nrule ld\n  command = ld $in\nbuild a.o: cc a.c\nbuild b.o: cc b.c\n  toolchain = other\nbuild a: ld a.o\n", ParseManifestOpts{})
+	a, b, ld := s.state.Edges[0], s.state.Edges[1], s.state.Edges[2]
+
+	command, env := a.toolchainCommand(a.EvaluateCommand(false))
+	if want := filepath.Join("tc", "cc") + " -c a.c"; command != want {
+		t.Fatal(command)
+	}
+	want := "PATH=" + filepath.Join(dir, "tc")
+	found := false
+	for _, kv := range env {
+		if strings.HasPrefix(kv, "PATH=") {
+			if kv != want {
+				t.Fatal(kv)
+			}
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("PATH not set")
+	}
+	// The program is not in the toolchain; the command fails to run.
+	if command, env := b.toolchainCommand(b.EvaluateCommand(false)); command != "cc -c b.c" || env == nil {
+		t.Fatal(command)
+	}
+	if command, env := ld.toolchainCommand(ld.EvaluateCommand(false)); command != "ld a.o" || env != nil {
+		t.Fatal(command)
+	}
+
+	cmd1, hash1 := a.logCommand(nil)
+	if !strings.HasPrefix(cmd1, "cc -c a.c # toolchain sha256:") {
+		t.Fatal(cmd1)
+	}
+	if cmd, _ := b.logCommand(nil); cmd != "cc -c b.c # toolchain missing cc" {
+		t.Fatal(cmd)
+	}
+	if cmd, _ := ld.logCommand(nil); cmd != "ld a.o" {
+		t.Fatal(cmd)
+	}
+
+	// Upgrading the toolchain in place changes the command recorded in the
+	// build log.
+	if err := ioutil.WriteFile(filepath.Join("tc", "cc"), []byte("v2"), 0o777); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(filepath.Join("tc", "cc"), future, future); err != nil {
+		t.Fatal(err)
+	}
+	a.invalidateBindings()
+	cmd2, hash2 := a.logCommand(nil)
+	if cmd1 == cmd2 || hash1 == hash2 {
+		t.Fatal(cmd2)
+	}
+}
+
+func TestTrackTools(t *testing.T) {
+	CreateTempDirAndEnter(t)
+	if err := ioutil.WriteFile("gen", []byte("v1"), 0o777); err != nil {
+		t.Fatal(err)
+	}
+	s := NewStateTestWithBuiltinRules(t)
+	s.AssertParse(&s.state, "rule gen\n  command = ./gen $out\nrule built\n  command = ./tool $out\nrule builtin\n  command = : && ./gen $out\nbuild a: gen\nbuild tool: gen\nbuild b: built | tool\nbuild c: builtin\n", ParseManifestOpts{})
+
+	if cmd, _ := s.state.Edges[0].logCommand(nil); cmd != "./gen a" {
+		t.Fatal(cmd)
+	}
+	for _, e := range s.state.Edges {
+		e.invalidateBindings()
+	}
+	tools := &toolTracker{all: true, digests: NewDigestStore()}
+	if cmd, _ := s.state.Edges[0].logCommand(tools); !strings.HasPrefix(cmd, "./gen a # tool sha256:") {
+		t.Fatal(cmd)
+	}
+	// The program is an input.
+	if cmd, _ := s.state.Edges[2].logCommand(tools); cmd != "./tool b" {
+		t.Fatal(cmd)
+	}
+	// Shell builtins are not tracked.
+	if cmd, _ := s.state.Edges[3].logCommand(tools); cmd != ": && ./gen c" {
+		t.Fatal(cmd)
+	}
+
+	// The builder tracks the tools per its config.
+	config := NewBuildConfig()
+	config.TrackTools = true
+	b := NewBuilder(&s.state, &config, nil, nil, &RealDiskInterface{}, &statusFake{}, 0)
+	if !b.scan.tools.all || b.scan.tools.digests == nil {
+		t.Fatal(b.scan.tools)
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// PoolSuggestion is a pool to create to limit how many edges of some rules
+// run concurrently.
+type PoolSuggestion struct {
+	Name  string
+	Depth int
+	// Rules are the rules to assign to the pool, sorted.
+	Rules []string
+	// Reasons explain the depth, one per rule.
+	Reasons []string
+}
+
+// SuggestPools looks at the durations and the resources recorded in the build
+// log and suggests pools for the rules whose edges can't run at full
+// parallelism without exhausting the memory or the CPUs.
+//
+// memory is the memory available to the build in bytes, 0 to not consider
+// the memory. parallelism is the number of jobs that run concurrently.
+//
+// A rule is limited to memory / its max RSS edges, and to parallelism /
+// the number of CPUs its edges use on average, e.g. a multi-threaded linker.
+// Only the rules whose edges are all in the default pool are considered. The
+// rules with the same depth are grouped in one pool named after the first
+// one.
+func SuggestPools(state *State, l *BuildLog, memory int64, parallelism int) []PoolSuggestion {
+	if parallelism <= 1 {
+		return nil
+	}
+	type ruleStats struct {
+		edges  int
+		wall   time.Duration
+		cpu    time.Duration
+		maxRSS int64
+	}
+	pooled := map[*Rule]struct{}{}
+	for _, e := range state.Edges {
+		if e.Pool != DefaultPool {
+			pooled[e.Rule] = struct{}{}
+		}
+	}
+	stats := map[*Rule]*ruleStats{}
+	seen := map[*Edge]struct{}{}
+	for p, entry := range l.Entries {
+		n := state.Paths[p]
+		if n == nil || n.InEdge == nil || n.InEdge.Rule == PhonyRule {
+			continue
+		}
+		e := n.InEdge
+		if _, ok := seen[e]; ok {
+			continue
+		}
+		seen[e] = struct{}{}
+		if _, ok := pooled[e.Rule]; ok {
+			continue
+		}
+		s := stats[e.Rule]
+		if s == nil {
+			s = &ruleStats{}
+			stats[e.Rule] = s
+		}
+		s.edges++
+		if entry.usage != (ResourceUsage{}) {
+			// Only account the wall time of the edges with a known CPU time.
+			s.wall += time.Duration(entry.endTime-entry.startTime) * time.Millisecond
+			s.cpu += entry.usage.UserTime + entry.usage.SystemTime
+		}
+		if entry.usage.MaxRSS > s.maxRSS {
+			s.maxRSS = entry.usage.MaxRSS
+		}
+	}
+
+	groups := map[int]*PoolSuggestion{}
+	for r, s := range stats {
+		depth := parallelism
+		var reasons []string
+		if memory > 0 && s.maxRSS > 0 {
+			if d := int(memory / s.maxRSS); d < parallelism {
+				depth = d
+				reasons = append(reasons, fmt.Sprintf("up to %.1fGiB", float64(s.maxRSS)/(1<<30)))
+			}
+		}
+		if s.wall > 0 {
+			if cpus := int(math.Round(float64(s.cpu) / float64(s.wall))); cpus >= 2 {
+				if d := parallelism / cpus; d < parallelism {
+					if d < depth {
+						depth = d
+					}
+					reasons = append(reasons, fmt.Sprintf("%d CPUs", cpus))
+				}
+			}
+		}
+		if depth >= parallelism {
+			continue
+		}
+		if depth < 1 {
+			depth = 1
+		}
+		g := groups[depth]
+		if g == nil {
+			g = &PoolSuggestion{Depth: depth}
+			groups[depth] = g
+		}
+		g.Rules = append(g.Rules, r.Name)
+		g.Reasons = append(g.Reasons, r.Name+" uses "+strings.Join(reasons, " and "))
+	}
+
+	out := make([]PoolSuggestion, 0, len(groups))
+	for _, g := range groups {
+		// Keep Reasons in the same order as Rules.
+		sort.Sort(byRule{g})
+		out = append(out, *g)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Depth < out[j].Depth })
+	for i := range out {
+		name := out[i].Rules[0] + "_pool"
+		for j := 2; state.Pools[name] != nil; j++ {
+			name = fmt.Sprintf("%s_pool%d", out[i].Rules[0], j)
+		}
+		out[i].Name = name
+	}
+	return out
+}
+
+// byRule sorts the rules of a PoolSuggestion along their reasons.
+type byRule struct {
+	p *PoolSuggestion
+}
+
+func (b byRule) Len() int           { return len(b.p.Rules) }
+func (b byRule) Less(i, j int) bool { return b.p.Rules[i] < b.p.Rules[j] }
+func (b byRule) Swap(i, j int) {
+	b.p.Rules[i], b.p.Rules[j] = b.p.Rules[j], b.p.Rules[i]
+	b.p.Reasons[i], b.p.Reasons[j] = b.p.Reasons[j], b.p.Reasons[i]
+}
+
+// WritePoolSuggestions writes the pools as a manifest to be included in the
+// main one with "include".
+//
+// A rule can't be redefined, so the assignment of the rules to the pools is
+// left as comments; add "pool = <name>" to the rules.
+func WritePoolSuggestions(w io.Writer, pools []PoolSuggestion) error {
+	b := strings.Builder{}
+	b.WriteString("# Generated by nin -t tune.\n")
+	for _, p := range pools {
+		b.WriteString("\n")
+		for _, r := range p.Reasons {
+			b.WriteString("# " + r + "\n")
+		}
+		fmt.Fprintf(&b, "# Assign with \"pool = %s\" in rules %s.\n", p.Name, strings.Join(p.Rules, ", "))
+		fmt.Fprintf(&b, "pool %s\n  depth = %d\n", p.Name, p.Depth)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
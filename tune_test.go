@@ -0,0 +1,80 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSuggestPools(t *testing.T) {
+	s := NewStateTestWithBuiltinRules(t)
+	s.AssertParse(&s.state, "rule link\n  command = link\nrule solink\n  command = solink\nrule lto\n  command = lto\npool p\n  depth = 1\nrule pooled\n  command = pooled\n  pool = p\nbuild a.o: cat a.c\nbuild a: link a.o\nbuild a.so: solink a.o\nbuild b: lto a.o\nbuild c: pooled a.o\n", ParseManifestOpts{})
+	l := NewBuildLog()
+	add := func(output string, ms int32, u ResourceUsage) {
+		l.Entries[output] = &LogEntry{output: output, startTime: 0, endTime: ms, usage: u}
+	}
+	const gib = 1 << 30
+	add("a.o", 1000, ResourceUsage{UserTime: time.Second, MaxRSS: 100 << 20})
+	add("a", 1000, ResourceUsage{UserTime: time.Second, MaxRSS: 3 * gib})
+	add("a.so", 1000, ResourceUsage{UserTime: time.Second, MaxRSS: 3 * gib})
+	add("b", 1000, ResourceUsage{UserTime: 4 * time.Second, MaxRSS: gib})
+	// Already in a pool.
+	add("c", 1000, ResourceUsage{UserTime: time.Second, MaxRSS: 10 * gib})
+
+	got := SuggestPools(&s.state, &l, 10*gib, 8)
+	want := []PoolSuggestion{
+		{
+			Name:    "lto_pool",
+			Depth:   2,
+			Rules:   []string{"lto"},
+			Reasons: []string{"lto uses 4 CPUs"},
+		},
+		{
+			Name:    "link_pool",
+			Depth:   3,
+			Rules:   []string{"link", "solink"},
+			Reasons: []string{"link uses up to 3.0GiB", "solink uses up to 3.0GiB"},
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatal(diff)
+	}
+
+	b := strings.Builder{}
+	if err := WritePoolSuggestions(&b, got[1:]); err != nil {
+		t.Fatal(err)
+	}
+	wantFile := "# Generated by nin -t tune.\n\n# link uses up to 3.0GiB\n# solink uses up to 3.0GiB\n# Assign with \"pool = link_pool\" in rules link, solink.\npool link_pool\n  depth = 3\n"
+	if b.String() != wantFile {
+		t.Fatal(b.String())
+	}
+	// The output is a valid manifest.
+	s2 := NewStateTestWithBuiltinRules(t)
+	s2.AssertParse(&s2.state, b.String(), ParseManifestOpts{})
+	if p := s2.state.Pools["link_pool"]; p == nil || p.Depth() != 3 {
+		t.Fatal(p)
+	}
+
+	if got := SuggestPools(&s.state, &l, 0, 8); len(got) != 1 || got[0].Name != "lto_pool" {
+		t.Fatal(got)
+	}
+	if got := SuggestPools(&s.state, &l, 10*gib, 1); len(got) != 0 {
+		t.Fatal(got)
+	}
+}
@@ -18,14 +18,20 @@ import (
 	"fmt"
 	"os"
 	"runtime"
+	"strings"
 	"unsafe"
 )
 
 // Have a generic fall-through for different versions of C/C++.
 
+// ProgramName prefixes the messages printed to stderr.
+//
+// It can be set to "ninja" to print the same messages as ninja.
+var ProgramName = "nin"
+
 // Log a fatalf message and exit.
 func fatalf(msg string, s ...interface{}) {
-	fmt.Fprintf(os.Stderr, "nin: fatal: ")
+	fmt.Fprintf(os.Stderr, "%s: fatal: ", ProgramName)
 	fmt.Fprintf(os.Stderr, msg, s...)
 	fmt.Fprintf(os.Stderr, "\n")
 	// On Windows, some tools may inject extra threads.
@@ -37,14 +43,14 @@ func fatalf(msg string, s ...interface{}) {
 
 // Log a warning message.
 func warningf(msg string, s ...interface{}) {
-	fmt.Fprintf(os.Stderr, "nin: warning: ")
+	fmt.Fprintf(os.Stderr, "%s: warning: ", ProgramName)
 	fmt.Fprintf(os.Stderr, msg, s...)
 	fmt.Fprintf(os.Stderr, "\n")
 }
 
 // Log an error message.
 func errorf(msg string, s ...interface{}) {
-	fmt.Fprintf(os.Stderr, "nin: error: ")
+	fmt.Fprintf(os.Stderr, "%s: error: ", ProgramName)
 	fmt.Fprintf(os.Stderr, msg, s...)
 	fmt.Fprintf(os.Stderr, "\n")
 }
@@ -54,110 +60,15 @@ func isPathSeparator(c byte) bool {
 }
 
 // CanonicalizePath canonicalizes a path like "foo/../bar.h" into just "bar.h".
+//
+// It doesn't allocate when the path is already canonical.
 func CanonicalizePath(path string) string {
-	// TODO(maruel): Call site should be the lexers, so that it's done as a
-	// single pass.
 	// WARNING: this function is performance-critical; please benchmark
 	// any changes you make to it.
-	l := len(path)
-	if l == 0 {
+	if isCanonical(path) {
 		return path
 	}
-
-	p := make([]byte, l+1)
-	copy(p, path)
-	// Tell the compiler that l is safe for p.
-	_ = p[l]
-	dst := 0
-	src := 0
-
-	if c := p[src]; c == '/' || c == '\\' {
-		if runtime.GOOS == "windows" && l > 1 {
-			// network path starts with //
-			if c := p[src+1]; c == '/' || c == '\\' {
-				src += 2
-				dst += 2
-			} else {
-				src++
-				dst++
-			}
-		} else {
-			src++
-			dst++
-		}
-	}
-
-	var components [60]int
-	for componentCount := 0; src < l; {
-		if p[src] == '.' {
-			// It is fine to read one byte past because p is l+1 in
-			// length. It will be a 0 zero if so.
-			c := p[src+1]
-			if src+1 == l || (c == '/' || c == '\\') {
-				// '.' component; eliminate.
-				src += 2
-				continue
-			}
-			if c == '.' {
-				// It is fine to read one byte past because p is l+1 in
-				// length. It will be a 0 zero if so.
-				c := p[src+2]
-				if src+2 == l || (c == '/' || c == '\\') {
-					// '..' component.  Back up if possible.
-					if componentCount > 0 {
-						dst = components[componentCount-1]
-						src += 3
-						componentCount--
-					} else {
-						p[dst] = p[src]
-						p[dst+1] = p[src+1]
-						p[dst+2] = p[src+2]
-						dst += 3
-						src += 3
-					}
-					continue
-				}
-			}
-		}
-
-		if c := p[src]; c == '/' || c == '\\' {
-			src++
-			continue
-		}
-
-		if componentCount == len(components) {
-			fatalf("path has too many components : %s", path)
-		}
-		components[componentCount] = dst
-		componentCount++
-
-		for src != l {
-			c := p[src]
-			if c == '/' || c == '\\' {
-				break
-			}
-			p[dst] = c
-			dst++
-			src++
-		}
-		// Copy '/' or final \0 character as well.
-		p[dst] = p[src]
-		dst++
-		src++
-	}
-
-	if dst == 0 {
-		p[dst] = '.'
-		dst += 2
-	}
-	p = p[:dst-1]
-	if runtime.GOOS == "windows" {
-		for i, c := range p {
-			if c == '\\' {
-				p[i] = '/'
-			}
-		}
-	}
+	p, _ := canonicalizePath([]byte(path))
 	return unsafeString(p)
 }
 
@@ -165,95 +76,131 @@ func CanonicalizePath(path string) string {
 // "bar.h".
 //
 // Returns a bits set starting from lowest for a backslash that was
-// normalized to a forward slash. (only used on Windows)
+// normalized to a forward slash. (only used on Windows) Only the first 64
+// path separators are tracked.
+//
+// It doesn't allocate when the path is already canonical.
 func CanonicalizePathBits(path string) (string, uint64) {
-	// TODO(maruel): Call site should be the lexers, so that it's done as a
-	// single pass.
 	// WARNING: this function is performance-critical; please benchmark
 	// any changes you make to it.
-	l := len(path)
-	if l == 0 {
+	if isCanonical(path) {
 		return path, 0
 	}
+	p, bits := canonicalizePath([]byte(path))
+	return unsafeString(p), bits
+}
+
+// isCanonical returns true if path doesn't need to be modified by
+// canonicalizePath.
+//
+// Backslashes are always considered non-canonical, so the slash bits of a
+// canonical path are always 0.
+func isCanonical(path string) bool {
+	l := len(path)
+	if l == 0 || path == "." {
+		return true
+	}
+	if path[l-1] == '/' {
+		return false
+	}
+	i := 0
+	if path[0] == '/' {
+		i++
+	}
+	// ".." components are only kept at the start of the path.
+	leading := true
+	for i <= l {
+		j := i
+		for ; j < l && path[j] != '/'; j++ {
+			if path[j] == '\\' {
+				return false
+			}
+		}
+		switch c := path[i:j]; c {
+		case "", ".":
+			return false
+		case "..":
+			if !leading {
+				return false
+			}
+		default:
+			leading = false
+		}
+		i = j + 1
+	}
+	return true
+}
 
-	p := make([]byte, l+1)
-	copy(p, path)
-	// Tell the compiler that l is safe for p.
-	_ = p[l]
+// canonicalizePath canonicalizes p in place and returns the canonical path,
+// which is a prefix of p, and the slash bits as described in
+// CanonicalizePathBits.
+func canonicalizePath(p []byte) ([]byte, uint64) {
+	l := len(p)
+	if l == 0 {
+		return p, 0
+	}
 	dst := 0
 	src := 0
-
-	if c := p[src]; c == '/' || c == '\\' {
-		if runtime.GOOS == "windows" && l > 1 {
+	if isPathSeparator(p[0]) {
+		if runtime.GOOS == "windows" && l > 1 && isPathSeparator(p[1]) {
 			// network path starts with //
-			if c := p[src+1]; c == '/' || c == '\\' {
-				src += 2
-				dst += 2
-			} else {
-				src++
-				dst++
-			}
+			src += 2
+			dst += 2
 		} else {
 			src++
 			dst++
 		}
 	}
 
-	var components [60]int
-	for componentCount := 0; src < l; {
+	// Start offset in p of each component in the output. Paths rarely have
+	// more than 60 components, so it normally doesn't allocate.
+	var buf [60]int
+	components := buf[:0]
+	// dst may never be larger than src, so the copy can be done in place.
+	//
+	// Each component is copied along its trailing separator. The end of the
+	// path is treated as a separator that is not written, and the last
+	// separator is trimmed at the end.
+	for src < l {
 		if p[src] == '.' {
-			// It is fine to read one byte past because p is l+1 in
-			// length. It will be a 0 zero if so.
-			c := p[src+1]
-			if src+1 == l || (c == '/' || c == '\\') {
+			if src+1 == l || isPathSeparator(p[src+1]) {
 				// '.' component; eliminate.
 				src += 2
 				continue
 			}
-			if c == '.' {
-				// It is fine to read one byte past because p is l+1 in
-				// length. It will be a 0 zero if so.
-				c := p[src+2]
-				if src+2 == l || (c == '/' || c == '\\') {
-					// '..' component.  Back up if possible.
-					if componentCount > 0 {
-						dst = components[componentCount-1]
-						src += 3
-						componentCount--
-					} else {
-						p[dst] = p[src]
-						p[dst+1] = p[src+1]
+			if p[src+1] == '.' && (src+2 == l || isPathSeparator(p[src+2])) {
+				// '..' component.  Back up if possible.
+				if len(components) > 0 {
+					dst = components[len(components)-1]
+					components = components[:len(components)-1]
+				} else {
+					p[dst] = '.'
+					p[dst+1] = '.'
+					if src+2 != l {
 						p[dst+2] = p[src+2]
-						dst += 3
-						src += 3
 					}
-					continue
+					dst += 3
 				}
+				src += 3
+				continue
 			}
 		}
 
-		if c := p[src]; c == '/' || c == '\\' {
+		if isPathSeparator(p[src]) {
 			src++
 			continue
 		}
 
-		if componentCount == len(components) {
-			fatalf("path has too many components : %s", path)
-		}
-		components[componentCount] = dst
-		componentCount++
-
-		for src != l {
-			c := p[src]
-			if c == '/' || c == '\\' {
-				break
-			}
-			p[dst] = c
+		components = append(components, dst)
+		for src != l && !isPathSeparator(p[src]) {
+			p[dst] = p[src]
 			dst++
 			src++
 		}
-		// Copy '/' or final \0 character as well.
-		p[dst] = p[src]
+		// Copy the separator, if not at the end.
+		if src != l {
+			p[dst] = p[src]
+		}
 		dst++
 		src++
 	}
@@ -277,7 +224,7 @@ func CanonicalizePathBits(path string) (string, uint64) {
 			}
 		}
 	}
-	return unsafeString(p), bits
+	return p, bits
 }
 
 func stringNeedsShellEscaping(input string) bool {
@@ -296,9 +243,13 @@ func stringNeedsShellEscaping(input string) bool {
 }
 
 func stringNeedsWin32Escaping(input string) bool {
+	if input == "" {
+		// An empty argument would be skipped by CommandLineToArgvW().
+		return true
+	}
 	for i := 0; i < len(input); i++ {
 		switch input[i] {
-		case ' ', '"':
+		case ' ', '\t', '\n', '\v', '"':
 			return true
 		default:
 		}
@@ -373,9 +324,51 @@ func getWin32EscapedString(input string) string {
 	return result
 }
 
+// Escapes the item for Windows's CommandLineToArgvW() when the command line is
+// interpreted by cmd.exe first.
+//
+// cmd.exe expands variables and interprets its metacharacters even within
+// double quotes, so every metacharacter, including the quotes added for
+// CommandLineToArgvW(), is escaped with a caret.
+func getCmdEscapedString(input string) string {
+	s := getWin32EscapedString(input)
+	if !strings.ContainsAny(s, "()%!^\"<>&|") {
+		return s
+	}
+	var b strings.Builder
+	b.Grow(2 * len(s))
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '(', ')', '%', '!', '^', '"', '<', '>', '&', '|':
+			b.WriteByte('^')
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// win32Program returns the program of a Windows command line, as parsed by
+// CreateProcess: the first argument, which may be quoted to contain spaces.
+func win32Program(c string) string {
+	c = strings.TrimLeft(c, " \t")
+	if strings.HasPrefix(c, "\"") {
+		if i := strings.IndexByte(c[1:], '"'); i != -1 {
+			return c[1 : i+1]
+		}
+		return c[1:]
+	}
+	if i := strings.IndexAny(c, " \t"); i != -1 {
+		return c[:i]
+	}
+	return c
+}
+
 // SpellcheckString provides the closest match to a misspelled string, given a
 // list of correct spellings.
 //
+// It is ninja's algorithm, by edit distance only. See SpellcheckStrings for a
+// more helpful one.
+//
 // Returns "" if there is no close enough match.
 func SpellcheckString(text string, words ...string) string {
 	const maxValidEditDistance = 3
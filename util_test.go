@@ -168,7 +168,6 @@ func TestCanonicalizePath_TooManyComponents(t *testing.T) {
 	if runtime.GOOS != "windows" {
 		t.Skip("windows only")
 	}
-	t.Skip("TODO")
 	type row struct {
 		in string
 		//want      string
@@ -228,6 +227,39 @@ func TestCanonicalizePath_TooManyComponents(t *testing.T) {
 	}
 }
 
+func TestCanonicalizePath_ManyComponents(t *testing.T) {
+	in := strings.Repeat("a/./", 100) + "x.h"
+	want := strings.Repeat("a/", 100) + "x.h"
+	if got := CanonicalizePath(in); got != want {
+		t.Fatal(got)
+	}
+	in = strings.Repeat("a/", 100) + strings.Repeat("../", 99) + "x.h"
+	if got := CanonicalizePath(in); got != "a/x.h" {
+		t.Fatal(got)
+	}
+}
+
+func TestCanonicalizePath_IsCanonical(t *testing.T) {
+	data := []string{
+		"", ".", "..", "/", "//", "./", "a", "a/", "a//b", "a/./b", "a/../b",
+		"../a", "../../a", "a/..", "/..", "/../a", "/a", "a\\b", ".a", "a/.b",
+		"..a", "a/..b", "../a/..",
+	}
+	for _, in := range data {
+		p, bits := canonicalizePath([]byte(in))
+		want := string(p)
+		if isCanonical(in) && (want != in || bits != 0) {
+			t.Fatalf("%q is not canonical, want %q", in, want)
+		}
+		if got := CanonicalizePath(in); got != want {
+			t.Fatalf("%q: want %q, got %q", in, want, got)
+		}
+	}
+	if !isCanonical("../../foo/bar.h") || !isCanonical("/usr/include/stdio.h") {
+		t.Fatal("expected canonical")
+	}
+}
+
 func TestCanonicalizePath_NotNullTerminated(t *testing.T) {
 	t.Skip("This test is irrelevant in Go. Remove once conversion is done")
 }
@@ -255,6 +287,62 @@ func TestPathEscaping_SensiblePathsAreNotNeedlesslyEscaped(t *testing.T) {
 	}
 }
 
+func TestPathEscaping_Win32(t *testing.T) {
+	data := []struct {
+		in   string
+		want string
+	}{
+		{"", "\"\""},
+		{"a\tb", "\"a\tb\""},
+		{"C:\\Program Files\\é.h", "\"C:\\Program Files\\é.h\""},
+		{"dir\\naïve.cc", "dir\\naïve.cc"},
+		{"a b\\", "\"a b\\\\\""},
+		{"a\\\"b", "\"a\\\\\\\"b\""},
+	}
+	for i, l := range data {
+		if got := getWin32EscapedString(l.in); got != l.want {
+			t.Errorf("#%d: %q: want %q, got %q", i, l.in, l.want, got)
+		}
+	}
+}
+
+func TestPathEscaping_Cmd(t *testing.T) {
+	data := []struct {
+		in   string
+		want string
+	}{
+		{"foo.cc", "foo.cc"},
+		{"a&b", "a^&b"},
+		{"100%", "100^%"},
+		{"a b", "^\"a b^\""},
+		{"(x) y", "^\"^(x^) y^\""},
+		{"a\"b", "^\"a\\^\"b^\""},
+	}
+	for i, l := range data {
+		if got := getCmdEscapedString(l.in); got != l.want {
+			t.Errorf("#%d: %q: want %q, got %q", i, l.in, l.want, got)
+		}
+	}
+}
+
+func TestWin32Program(t *testing.T) {
+	data := []struct {
+		in   string
+		want string
+	}{
+		{"cl.exe /c foo.cc", "cl.exe"},
+		{"  cl.exe", "cl.exe"},
+		{"\"C:\\Program Files\\cl.exe\" /c foo.cc", "C:\\Program Files\\cl.exe"},
+		{"\"C:\\unterminated", "C:\\unterminated"},
+		{"a\tb", "a"},
+	}
+	for i, l := range data {
+		if got := win32Program(l.in); got != l.want {
+			t.Errorf("#%d: %q: want %q, got %q", i, l.in, l.want, got)
+		}
+	}
+}
+
 func TestPathEscaping_SensibleWin32PathsAreNotNeedlesslyEscaped(t *testing.T) {
 	path := "some\\sensible\\path\\without\\crazy\\characters.c++"
 	result := getWin32EscapedString(path)
@@ -307,6 +395,10 @@ var dummyBenchmarkValue = ""
 // The Go version with "go test -cpu 1 -bench=. -run BenchmarkCanonicalizePath"
 // has a minimum of 157ns, which multiplied by 2000000 gives 306ms. So the code
 // is nearly 4x slower. I'll have to optimize later.
+//
+// Since the path is already canonical, it now takes the fast path which
+// doesn't allocate; it went from 325ns and 1 allocation to 175ns and none on
+// a slower machine.
 func BenchmarkCanonicalizePathBits(b *testing.B) {
 	b.ReportAllocs()
 	kPath := "../../third_party/WebKit/Source/WebCore/platform/leveldb/LevelDBWriteBatch.cpp"
@@ -328,3 +420,16 @@ func BenchmarkCanonicalizePath(b *testing.B) {
 	// Use s so it's not optimized out.
 	dummyBenchmarkValue = s
 }
+
+// BenchmarkCanonicalizePath_Slow measures a path that needs to be modified,
+// which can't use the fast path.
+func BenchmarkCanonicalizePath_Slow(b *testing.B) {
+	b.ReportAllocs()
+	kPath := "../../third_party/WebKit/Source/./WebCore/platform/../platform/leveldb//LevelDBWriteBatch.cpp"
+	s := ""
+	for i := 0; i < b.N; i++ {
+		s = CanonicalizePath(kPath)
+	}
+	// Use s so it's not optimized out.
+	dummyBenchmarkValue = s
+}
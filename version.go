@@ -16,7 +16,6 @@ package nin
 
 import (
 	"fmt"
-	"log"
 	"strconv"
 	"strings"
 )
@@ -28,6 +27,12 @@ import (
 // TODO(maruel): Figure out our versioning convention.
 const NinjaVersion = "1.10.2.git"
 
+// NinVersion is the version of the nin specific manifest extensions.
+//
+// A manifest opts in the extensions with "nin_required_version", which
+// ninja ignores.
+const NinVersion = "1.0"
+
 // Parse the major/minor components of a version string.
 func parseVersion(version string) (int, int) {
 	end := strings.Index(version, ".")
@@ -57,15 +62,122 @@ func keepNumbers(s string) string {
 	return s
 }
 
+// versionAtLeast returns true if version is at least want. Only the major and
+// minor components are compared.
+func versionAtLeast(version, want string) bool {
+	major, minor := parseVersion(version)
+	wantMajor, wantMinor := parseVersion(want)
+	return major > wantMajor || (major == wantMajor && minor >= wantMinor)
+}
+
+// isVersion returns true if version starts with a number, e.g. "1.10".
+func isVersion(version string) bool {
+	return version != "" && version[0] >= '0' && version[0] <= '9'
+}
+
 // checkNinjaVersion checks whether a version is compatible with the current
 // Ninja version, returns an error if not.
+//
+// Like ninja, a version that is not a number is parsed as 0.0, which only
+// warns.
 func checkNinjaVersion(version string) error {
-	binMajor, binMinor := parseVersion(NinjaVersion)
-	fileMajor, fileMinor := parseVersion(version)
-	if binMajor > fileMajor {
-		log.Printf("ninja executable version (%s) greater than build file ninja_required_version (%s); versions may be incompatible.", NinjaVersion, version)
-	} else if (binMajor == fileMajor && binMinor < fileMinor) || binMajor < fileMajor {
+	binMajor, _ := parseVersion(NinjaVersion)
+	fileMajor, _ := parseVersion(version)
+	if !versionAtLeast(NinjaVersion, version) {
 		return fmt.Errorf("ninja version (%s) incompatible with build file ninja_required_version version (%s)", NinjaVersion, version)
 	}
+	if binMajor > fileMajor {
+		warningf("ninja executable version (%s) greater than build file ninja_required_version (%s); versions may be incompatible.", NinjaVersion, version)
+	}
+	return nil
+}
+
+// NinFeatures are the nin specific manifest extensions supported by this
+// binary, with the nin version that introduced them.
+//
+// A manifest lists the extensions it uses with "nin_features", e.g.
+// "nin_features = defaultgroup batch", so that an older nin binary fails
+// with a clear error instead of a syntax error. Using an extension that is
+// not listed is an error, unless nin_required_version is at least the
+// version that introduced it.
+//
+// The features are the defaultgroup statement, the rule and build bindings
+// of the same name, the builtin rules of the same name and the outroot
+// variable.
+var NinFeatures = map[string]string{
+	"batch":        "1.0",
+	"copy":         "1.0",
+	"cwd":          "1.0",
+	"defaultgroup": "1.0",
+	"hardlink":     "1.0",
+	"mem":          "1.0",
+	"outroot":      "1.0",
+	"remoteable":   "1.0",
+	"rspfile_auto": "1.0",
+	"scan":         "1.0",
+	"skip":         "1.0",
+	"sort_inputs":  "1.0",
+	"stamp":        "1.0",
+	"symlink":      "1.0",
+	"test":         "1.0",
+	"toolchain":    "1.0",
+	"worker":       "1.0",
+}
+
+// checkNinVersion checks whether a manifest's nin_required_version is
+// supported by this binary.
+func checkNinVersion(version string) error {
+	if !isVersion(version) {
+		// TODO(maruel): Use %q for real quoting.
+		return fmt.Errorf("invalid nin_required_version '%s'", version)
+	}
+	if !versionAtLeast(NinVersion, version) {
+		return fmt.Errorf("nin version (%s) incompatible with build file nin_required_version version (%s)", NinVersion, version)
+	}
 	return nil
 }
+
+// checkNinFeatures checks whether all the features listed in a manifest's
+// nin_features are supported by this binary.
+func checkNinFeatures(features string) error {
+	var unknown []string
+	for _, f := range strings.Fields(features) {
+		if _, ok := NinFeatures[f]; !ok {
+			unknown = append(unknown, f)
+		}
+	}
+	if len(unknown) != 0 {
+		return fmt.Errorf("nin version (%s) doesn't support build file nin_features: %s; please update nin", NinVersion, strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// requireNinFeature returns an error if the manifest didn't opt in the nin
+// extension feature, either by listing it in nin_features or by setting
+// nin_required_version to at least the version that introduced it.
+func requireNinFeature(env Env, feature string) error {
+	for _, f := range strings.Fields(env.LookupVariable("nin_features")) {
+		if f == feature {
+			return nil
+		}
+	}
+	version := NinFeatures[feature]
+	if v := env.LookupVariable("nin_required_version"); v != "" && versionAtLeast(v, version) {
+		return nil
+	}
+	return fmt.Errorf("%s requires 'nin_features = %s' or nin_required_version = %s or later", feature, feature, version)
+}
+
+// requireNinBindings is like requireNinFeature for each of the bindings
+// names that is a nin extension, in order. On error, it returns the index of
+// the binding so it can be reported at its own line.
+func requireNinBindings(env Env, names []string) (int, error) {
+	for i, k := range names {
+		if isNinBinding(k) && NinFeatures[k] != "" {
+			if err := requireNinFeature(env, k); err != nil {
+				return i, err
+			}
+		}
+	}
+	return -1, nil
+}
@@ -0,0 +1,211 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"sync"
+)
+
+// VirtualFileSystem is an implementation of FileSystem that uses an in-memory
+// representation of disk state.
+//
+// It also logs file accesses and directory creations so it can be used by
+// tests to verify disk access patterns. Time is simulated: it only advances
+// when Tick() is called.
+//
+// It is safe for concurrent use.
+type VirtualFileSystem struct {
+	mu sync.Mutex
+	// In the C++ code, it's an ordered set. The only test cases that depends on
+	// this is TestBuildTest_MakeDirs.
+	directoriesMade map[string]struct{}
+	filesRead       []string
+	files           map[string]virtualFile
+	filesRemoved    map[string]struct{}
+	filesCreated    map[string]struct{}
+
+	// A simple fake timestamp for file operations.
+	now TimeStamp
+}
+
+// virtualFile is an entry for a single in-memory file.
+type virtualFile struct {
+	mtime     TimeStamp
+	statError error // If mtime is -1.
+	contents  []byte
+}
+
+// NewVirtualFileSystem returns an empty VirtualFileSystem.
+func NewVirtualFileSystem() VirtualFileSystem {
+	return VirtualFileSystem{
+		directoriesMade: map[string]struct{}{},
+		files:           map[string]virtualFile{},
+		filesRemoved:    map[string]struct{}{},
+		filesCreated:    map[string]struct{}{},
+		now:             1,
+	}
+}
+
+// Now returns the current fake time.
+func (v *VirtualFileSystem) Now() TimeStamp {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.now
+}
+
+// Tick "time" forwards; subsequent file operations will be newer than
+// previous ones.
+func (v *VirtualFileSystem) Tick() TimeStamp {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.now++
+	return v.now
+}
+
+// Create "creates" a file with contents.
+func (v *VirtualFileSystem) Create(path string, contents string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.create(path, contents)
+}
+
+func (v *VirtualFileSystem) create(path string, contents string) {
+	f := v.files[path]
+	f.mtime = v.now
+	// Make a copy in case it's a unsafeString() to a buffer that could be
+	// mutated later.
+	f.contents = []byte(contents)
+	v.files[path] = f
+	v.filesCreated[path] = struct{}{}
+}
+
+// SetStatError makes Stat() fail for path with err.
+func (v *VirtualFileSystem) SetStatError(path string, err error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.files[path] = virtualFile{mtime: -1, statError: err}
+}
+
+// FilesRead returns the files read so far, in order.
+func (v *VirtualFileSystem) FilesRead() []string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return append([]string(nil), v.filesRead...)
+}
+
+// FilesCreated returns the files created so far, sorted.
+func (v *VirtualFileSystem) FilesCreated() []string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return sortedKeys(v.filesCreated)
+}
+
+// FilesRemoved returns the files removed so far, sorted.
+func (v *VirtualFileSystem) FilesRemoved() []string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return sortedKeys(v.filesRemoved)
+}
+
+// DirectoriesMade returns the directories created so far, sorted.
+func (v *VirtualFileSystem) DirectoriesMade() []string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return sortedKeys(v.directoriesMade)
+}
+
+// Stat implements FileSystem.
+func (v *VirtualFileSystem) Stat(path string) (TimeStamp, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	i, ok := v.files[path]
+	if ok {
+		return i.mtime, i.statError
+	}
+	return 0, nil
+}
+
+// StatSize implements FileSizer.
+func (v *VirtualFileSystem) StatSize(path string) (TimeStamp, int64, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	i, ok := v.files[path]
+	if ok {
+		return i.mtime, int64(len(i.contents)), i.statError
+	}
+	return 0, 0, nil
+}
+
+// WriteFile implements FileSystem.
+func (v *VirtualFileSystem) WriteFile(path string, contents string) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.create(path, contents)
+	return nil
+}
+
+// MakeDir implements FileSystem.
+func (v *VirtualFileSystem) MakeDir(path string) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	// Should check if a file exists with the same name.
+	v.directoriesMade[path] = struct{}{}
+	return nil
+}
+
+// ReadFile implements FileSystem.
+func (v *VirtualFileSystem) ReadFile(path string) ([]byte, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.filesRead = append(v.filesRead, path)
+	i, ok := v.files[path]
+	if ok {
+		if len(i.contents) == 0 {
+			return nil, nil
+		}
+		// Return a copy since a lot of the code modify the buffer in-place.
+		n := make([]byte, len(i.contents)+1)
+		copy(n, i.contents)
+		return n, nil
+	}
+	return nil, os.ErrNotExist
+}
+
+// RemoveFile implements FileSystem.
+func (v *VirtualFileSystem) RemoveFile(path string) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if _, ok := v.directoriesMade[path]; ok {
+		return errors.New("can't remove directory in unit tests; not true in practice")
+	}
+	if _, ok := v.files[path]; ok {
+		delete(v.files, path)
+		v.filesRemoved[path] = struct{}{}
+		return nil
+	}
+	return os.ErrNotExist
+}
+
+func sortedKeys(m map[string]struct{}) []string {
+	out := make([]string, 0, len(m))
+	for k := range m {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
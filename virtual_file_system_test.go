@@ -0,0 +1,65 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"os"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestVirtualFileSystem(t *testing.T) {
+	v := NewVirtualFileSystem()
+	var fs FileSystem = &v
+	if err := fs.WriteFile("b", "content"); err != nil {
+		t.Fatal(err)
+	}
+	v.Tick()
+	if err := MakeDirs(fs, "dir/sub/a"); err != nil {
+		t.Fatal(err)
+	}
+	v.Create("dir/sub/a", "")
+	if mtime, err := fs.Stat("dir/sub/a"); mtime != 2 || err != nil {
+		t.Fatal(mtime, err)
+	}
+	if mtime, err := fs.Stat("missing"); mtime != 0 || err != nil {
+		t.Fatal(mtime, err)
+	}
+	if b, err := fs.ReadFile("b"); string(b) != "content\x00" || err != nil {
+		t.Fatal(string(b), err)
+	}
+	if _, err := fs.ReadFile("missing"); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	if err := fs.RemoveFile("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.RemoveFile("b"); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"b", "dir/sub/a"}, v.FilesCreated()); diff != "" {
+		t.Fatal(diff)
+	}
+	if diff := cmp.Diff([]string{"b"}, v.FilesRemoved()); diff != "" {
+		t.Fatal(diff)
+	}
+	if diff := cmp.Diff([]string{"dir", "dir/sub"}, v.DirectoriesMade()); diff != "" {
+		t.Fatal(diff)
+	}
+	if diff := cmp.Diff([]string{"b", "missing"}, v.FilesRead()); diff != "" {
+		t.Fatal(diff)
+	}
+}
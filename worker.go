@@ -0,0 +1,322 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// Persistent workers.
+//
+// Rules with "worker = 1" do not start a new process per edge. Instead, the
+// command is split at its first flagfile argument, "@file" or
+// "--flagfile=file", like Bazel does. The arguments before it are the startup
+// arguments: they are run once with the "--persistent_worker" flag. The
+// flagfile and the arguments after it are sent to the worker as a work
+// request. Commands without a flagfile are run normally.
+//
+// The protocol is Bazel's JSON worker protocol: each request and response is
+// a JSON object on a single line. A worker handles one request at a time; more
+// workers with the same startup arguments and environment are started as
+// needed.
+
+// workerRequest is a work request sent to the stdin of a worker.
+type workerRequest struct {
+	Arguments []string `json:"arguments"`
+	RequestID int      `json:"requestId,omitempty"`
+}
+
+// workerResponse is a work response read from the stdout of a worker.
+type workerResponse struct {
+	ExitCode  int    `json:"exitCode"`
+	Output    string `json:"output"`
+	RequestID int    `json:"requestId,omitempty"`
+}
+
+// worker is a running persistent worker process.
+type worker struct {
+	key    string
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+	stderr workerStderr
+}
+
+// workerStderr is the stderr of a worker.
+//
+// It is written to by the goroutine copying the output of the process, so it
+// is locked.
+type workerStderr struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (w *workerStderr) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.Write(p)
+}
+
+// take returns what was written since the last call and clears it.
+func (w *workerStderr) take() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	s := w.buf.String()
+	w.buf.Reset()
+	return s
+}
+
+// workerKey returns the key of the workers started with the startup arguments
+// args and the environment env.
+func workerKey(args, env []string) string {
+	return strings.Join(args, "\x00") + "\x00\x00" + strings.Join(env, "\x00")
+}
+
+// splitWorkerArgs splits args at the first flagfile argument into the startup
+// arguments and the arguments of the request. It returns false if there is no
+// flagfile.
+func splitWorkerArgs(args []string) ([]string, []string, bool) {
+	for i := 1; i < len(args); i++ {
+		if strings.HasPrefix(args[i], "@") || strings.HasPrefix(args[i], "--flagfile=") {
+			return args[:i], args[i:], true
+		}
+	}
+	return nil, nil, false
+}
+
+func startWorker(args, env []string) (*worker, error) {
+	w := &worker{key: workerKey(args, env), cmd: exec.Command(args[0], append(args[1:len(args):len(args)], "--persistent_worker")...)}
+	// A nil env inherits the environment of the process.
+	w.cmd.Env = env
+	w.cmd.Stderr = &w.stderr
+	var err error
+	if w.stdin, err = w.cmd.StdinPipe(); err != nil {
+		return nil, err
+	}
+	stdout, err := w.cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	w.stdout = bufio.NewReader(stdout)
+	if err = w.cmd.Start(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// do sends one request and waits for its response.
+func (w *worker) do(args []string) (*workerResponse, error) {
+	// Only keep what is printed while handling this request.
+	w.stderr.take()
+	b, err := json.Marshal(workerRequest{Arguments: args})
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.stdin.Write(append(b, '\n')); err != nil {
+		return nil, err
+	}
+	line, err := w.stdout.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	resp := &workerResponse{}
+	if err = json.Unmarshal(line, resp); err != nil {
+		return nil, fmt.Errorf("invalid worker response: %w", err)
+	}
+	return resp, nil
+}
+
+// stop closes the stdin of the worker, which signals it to exit.
+func (w *worker) stop() {
+	_ = w.stdin.Close()
+	_ = w.cmd.Wait()
+}
+
+// kill terminates the worker.
+func (w *worker) kill() {
+	_ = w.cmd.Process.Kill()
+	w.stop()
+}
+
+// workerPool holds the persistent workers of a build.
+type workerPool struct {
+	mu   sync.Mutex
+	idle map[string][]*worker
+	busy map[*worker]struct{}
+}
+
+func newWorkerPool() *workerPool {
+	return &workerPool{
+		idle: map[string][]*worker{},
+		busy: map[*worker]struct{}{},
+	}
+}
+
+// get returns an idle worker started with args and env, starting one if
+// needed.
+func (p *workerPool) get(args, env []string) (*worker, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := workerKey(args, env)
+	var w *worker
+	if l := p.idle[key]; len(l) != 0 {
+		w = l[len(l)-1]
+		p.idle[key] = l[:len(l)-1]
+	} else {
+		var err error
+		if w, err = startWorker(args, env); err != nil {
+			return nil, err
+		}
+	}
+	p.busy[w] = struct{}{}
+	return w, nil
+}
+
+// put returns a worker to the pool. A worker that failed is discarded.
+func (p *workerPool) put(w *worker, ok bool) {
+	p.mu.Lock()
+	delete(p.busy, w)
+	if ok {
+		p.idle[w.key] = append(p.idle[w.key], w)
+	}
+	p.mu.Unlock()
+	if !ok {
+		w.kill()
+	}
+}
+
+// run runs one request on a worker started with startup and env.
+func (p *workerPool) run(ctx context.Context, startup, args, env []string) (string, int) {
+	w, err := p.get(startup, env)
+	if err != nil {
+		return fmt.Sprintf("failed to start worker %s: %s\n", startup[0], err), ExitFailure
+	}
+	type result struct {
+		resp *workerResponse
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		resp, err := w.do(args)
+		ch <- result{resp, err}
+	}()
+	select {
+	case <-ctx.Done():
+		p.put(w, false)
+		return "", ExitInterrupted
+	case r := <-ch:
+		if r.err != nil {
+			// put waits for the process to exit, so its stderr is complete.
+			p.put(w, false)
+			return fmt.Sprintf("worker %s failed: %s\n%s", startup[0], r.err, w.stderr.take()), ExitFailure
+		}
+		p.put(w, true)
+		return r.resp.Output, r.resp.ExitCode
+	}
+}
+
+// shutdown stops all the workers.
+func (p *workerPool) shutdown() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, l := range p.idle {
+		for _, w := range l {
+			w.stop()
+		}
+	}
+	for w := range p.busy {
+		w.kill()
+	}
+	p.idle = map[string][]*worker{}
+	p.busy = map[*worker]struct{}{}
+}
+
+// splitCommand splits a command line into arguments, handling single and
+// double quotes.
+//
+// It returns an error if the command uses shell features like redirections,
+// pipes or variables, in which case it cannot be run on a worker.
+func splitCommand(c string) ([]string, error) {
+	var args []string
+	var cur strings.Builder
+	inArg := false
+	for i := 0; i < len(c); i++ {
+		switch ch := c[i]; ch {
+		case ' ', '\t', '\n':
+			if inArg {
+				args = append(args, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+		case '\'':
+			inArg = true
+			j := strings.IndexByte(c[i+1:], '\'')
+			if j == -1 {
+				return nil, errors.New("unterminated quote")
+			}
+			cur.WriteString(c[i+1 : i+1+j])
+			i += j + 1
+		case '"':
+			inArg = true
+			for i++; ; i++ {
+				if i == len(c) {
+					return nil, errors.New("unterminated quote")
+				}
+				if c[i] == '"' {
+					break
+				}
+				if c[i] == '\\' && i+1 < len(c) && strings.IndexByte("\"\\$`", c[i+1]) != -1 {
+					i++
+				} else if c[i] == '$' || c[i] == '`' {
+					return nil, errors.New("shell expansion is not supported")
+				}
+				cur.WriteByte(c[i])
+			}
+		case '\\':
+			if i+1 == len(c) {
+				return nil, errors.New("trailing backslash")
+			}
+			inArg = true
+			i++
+			cur.WriteByte(c[i])
+		case '|', '&', ';', '<', '>', '(', ')', '$', '`', '*', '?', '[':
+			return nil, fmt.Errorf("shell character %q is not supported", ch)
+		case '#', '~':
+			if !inArg {
+				return nil, fmt.Errorf("shell character %q is not supported", ch)
+			}
+			cur.WriteByte(ch)
+		default:
+			inArg = true
+			cur.WriteByte(ch)
+		}
+	}
+	if inArg {
+		args = append(args, cur.String())
+	}
+	if len(args) == 0 {
+		return nil, errors.New("empty command")
+	}
+	return args, nil
+}
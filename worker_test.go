@@ -0,0 +1,171 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// fakeWorkerMain implements a persistent worker that echoes its arguments
+// along with its pid. It is run by TestMain when NIN_TEST_WORKER is set.
+func fakeWorkerMain() int {
+	if len(os.Args) < 2 || os.Args[len(os.Args)-1] != "--persistent_worker" {
+		return 1
+	}
+	r := bufio.NewReader(os.Stdin)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			return 0
+		}
+		req := workerRequest{}
+		if err := json.Unmarshal(line, &req); err != nil {
+			return 1
+		}
+		cmd := ""
+		if len(req.Arguments) > 1 {
+			cmd = req.Arguments[1]
+		}
+		switch cmd {
+		case "crash":
+			fmt.Fprintf(os.Stderr, "crashing\n")
+			return 1
+		case "noisy":
+			fmt.Fprintf(os.Stderr, "noise\n")
+		case "env":
+			req.Arguments = append(req.Arguments, os.Getenv("NIN_TEST_WORKER"))
+		}
+		resp := workerResponse{Output: fmt.Sprintf("%d %s", os.Getpid(), strings.Join(req.Arguments, " "))}
+		if cmd == "fail" {
+			resp.ExitCode = 1
+		}
+		b, _ := json.Marshal(resp)
+		os.Stdout.Write(append(b, '\n'))
+	}
+}
+
+func TestWorkerPool(t *testing.T) {
+	t.Setenv("NIN_TEST_WORKER", "1")
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newWorkerPool()
+	defer p.shutdown()
+	ctx := context.Background()
+	startup := []string{exe}
+
+	out1, code := p.run(ctx, startup, []string{"@a", "b"}, nil)
+	if code != 0 || !strings.HasSuffix(out1, " @a b") {
+		t.Fatal(out1, code)
+	}
+	// The same worker process is reused.
+	out2, code := p.run(ctx, startup, []string{"@a", "c"}, nil)
+	pid := strings.SplitN(out1, " ", 2)[0]
+	if code != 0 || out2 != pid+" @a c" {
+		t.Fatal(out2, code)
+	}
+	if out, code := p.run(ctx, startup, []string{"@a", "fail"}, nil); code != 1 || out != pid+" @a fail" {
+		t.Fatal(out, code)
+	}
+	// Different startup arguments or environment use a different worker, which
+	// is started with the environment.
+	if out, code := p.run(ctx, []string{exe, "-v"}, []string{"@a", "b"}, nil); code != 0 || strings.HasPrefix(out, pid+" ") {
+		t.Fatal(out, code)
+	}
+	env := append(os.Environ(), "NIN_TEST_WORKER=2")
+	if out, code := p.run(ctx, startup, []string{"@a", "env"}, env); code != 0 || strings.HasPrefix(out, pid+" ") || !strings.HasSuffix(out, " env 2") {
+		t.Fatal(out, code)
+	}
+	if out, code := p.run(ctx, startup, []string{"@a", "env"}, nil); code != 0 || out != pid+" @a env 1" {
+		t.Fatal(out, code)
+	}
+	// A crashing worker is replaced. Only the stderr of the failed request is
+	// reported.
+	if out, code := p.run(ctx, startup, []string{"@a", "noisy"}, nil); code != 0 || out != pid+" @a noisy" {
+		t.Fatal(out, code)
+	}
+	// Wait for the stderr of the request to be copied, so it isn't racing with
+	// the next one.
+	w := p.idle[workerKey(startup, nil)][0]
+	for {
+		w.stderr.mu.Lock()
+		done := w.stderr.buf.Len() != 0
+		w.stderr.mu.Unlock()
+		if done {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if out, code := p.run(ctx, startup, []string{"@a", "crash"}, nil); code != 1 || !strings.Contains(out, "crashing") || strings.Contains(out, "noise") {
+		t.Fatal(out, code)
+	}
+	if out, code := p.run(ctx, startup, []string{"@a", "d"}, nil); code != 0 || strings.HasPrefix(out, pid+" ") {
+		t.Fatal(out, code)
+	}
+}
+
+func TestSplitWorkerArgs(t *testing.T) {
+	startup, req, ok := splitWorkerArgs([]string{"java", "-jar", "javac.jar", "@args", "-g"})
+	if !ok {
+		t.Fatal("expected a flagfile")
+	}
+	if diff := cmp.Diff([]string{"java", "-jar", "javac.jar"}, startup); diff != "" {
+		t.Fatal(diff)
+	}
+	if diff := cmp.Diff([]string{"@args", "-g"}, req); diff != "" {
+		t.Fatal(diff)
+	}
+	if _, req, ok := splitWorkerArgs([]string{"tool", "--flagfile=args"}); !ok || req[0] != "--flagfile=args" {
+		t.Fatal(req, ok)
+	}
+	if _, _, ok := splitWorkerArgs([]string{"javac", "-d", "out", "a.java"}); ok {
+		t.Fatal("expected no flagfile")
+	}
+}
+
+func TestSplitCommand(t *testing.T) {
+	data := []struct {
+		in   string
+		want []string
+	}{
+		{"javac -d out a.java", []string{"javac", "-d", "out", "a.java"}},
+		{"tool 'a b' \"c \\\"d\\\"\" e\\ f", []string{"tool", "a b", "c \"d\"", "e f"}},
+		{"tool a#b ''", []string{"tool", "a#b", ""}},
+	}
+	for i, l := range data {
+		got, err := splitCommand(l.in)
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		if diff := cmp.Diff(l.want, got); diff != "" {
+			t.Fatalf("%d: +want, -got: %s", i, diff)
+		}
+	}
+	for _, in := range []string{"a > b", "a | b", "a $HOME", "a \"$HOME\"", "a 'b", "", "a *.c", "a ~/b"} {
+		if _, err := splitCommand(in); err == nil {
+			t.Fatalf("%q: expected error", in)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// The "cwd" binding is the directory the command of the edge runs in,
+// relative to the build directory, e.g. "cwd = third_party/foo". It replaces
+// the "cd third_party/foo && ..." wrappers which require a shell and confuse
+// the tools reading the commands.
+//
+// The paths stay relative to the build directory everywhere in the manifest.
+// Only in the command and the response file content, $in, $in_newline,
+// $in_batch, $out, $depfile and $rspfile are rewritten relative to cwd, so the
+// program finds them. The other paths written in the command must be relative
+// to cwd.
+//
+// The directory must exist; it is not created.
+
+// Cwd returns the directory the command of e runs in, relative to the build
+// directory, or "" to run in the build directory.
+func (e *Edge) Cwd() string {
+	v := e.GetBinding("cwd")
+	if v == "." {
+		return ""
+	}
+	return v
+}
+
+// cwdSuffix returns the suffix recording the working directory in the
+// build log, so moving the command to another directory reruns it.
+func (e *Edge) cwdSuffix() string {
+	if cwd := e.Cwd(); cwd != "" {
+		return ";cwd=" + cwd
+	}
+	return ""
+}
+
+// rebasePath returns p, relative to the build directory, as seen from cwd.
+func rebasePath(cwd, p string) string {
+	if cwd == "" || p == "" || filepath.IsAbs(p) {
+		return p
+	}
+	if filepath.IsAbs(cwd) {
+		if a, err := filepath.Abs(p); err == nil {
+			return a
+		}
+		return p
+	}
+	if r, err := filepath.Rel(cwd, p); err == nil {
+		return r
+	}
+	return p
+}
+
+// makeRebasedPathList is makePathList with the paths relative to cwd.
+func makeRebasedPathList(span []*Node, sep byte, escapeInOut escapeKind, cwd string) string {
+	s := make([]string, 0, len(span))
+	for _, x := range span {
+		s = append(s, escapePath(rebasePath(cwd, x.PathDecanonicalized()), escapeInOut))
+	}
+	return strings.Join(s, string(sep))
+}
@@ -0,0 +1,70 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestEdge_Cwd(t *testing.T) {
+	s := NewStateTestWithBuiltinRules(t)
+	s.AssertParse(&s.state, "nin_features = cwd\nrule cc\n  command = cc -c $in -o $out -MF $depfile\n  depfile = $out.d\n  rspfile = $out.rsp\n  rspfile_content = $in\nbuild obj/a.o: cc src/a.c\n  cwd = src\nbuild b.o: cc b.c\n  cwd = .\n", ParseManifestOpts{})
+	a, b := s.state.Edges[0], s.state.Edges[1]
+	up := filepath.Join("..", "obj", "a.o")
+	if want := "cc -c a.c -o " + up + " -MF " + up + ".d"; a.EvaluateCommand(false) != want {
+		t.Fatal(a.EvaluateCommand(false))
+	}
+	if got := a.GetBinding("rspfile_content"); got != "a.c" {
+		t.Fatal(got)
+	}
+	// nin itself uses the paths relative to the build directory.
+	if got := a.GetUnescapedDepfile(); got != "obj/a.o.d" {
+		t.Fatal(got)
+	}
+	if got := a.GetUnescapedRspfile(); got != "obj/a.o.rsp" {
+		t.Fatal(got)
+	}
+	if _, hash := a.logCommand(nil); hash == HashCommand128(a.EvaluateCommand(true)) {
+		t.Fatal("cwd is not recorded")
+	}
+	if b.Cwd() != "" || b.EvaluateCommand(false) != "cc -c b.c -o b.o -MF b.o.d" {
+		t.Fatal(b.EvaluateCommand(false))
+	}
+}
+
+func TestSubprocess_Dir(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses pwd")
+	}
+	dir := CreateTempDirAndEnter(t)
+	if err := os.Mkdir("sub", 0o777); err != nil {
+		t.Fatal(err)
+	}
+	s := subprocess{}
+	s.run(context.Background(), "pwd", nil, "sub", false)
+	if got := strings.TrimSpace(s.buf); s.exitCode != 0 || filepath.Base(got) != "sub" || !strings.HasSuffix(got, filepath.Base(dir)+"/sub") {
+		t.Fatal(s.buf)
+	}
+	s = subprocess{}
+	s.run(context.Background(), "pwd", nil, "missing", false)
+	if s.exitCode == 0 || !strings.Contains(s.buf, "missing") {
+		t.Fatal(s.exitCode, s.buf)
+	}
+}